@@ -12,13 +12,16 @@ type ClientTCPConn struct {
 }
 
 func NewClientTCPConn(c net.Conn) *ClientTCPConn {
-	return &ClientTCPConn{
+	cc := &ClientTCPConn{
 		TCPConn: conn.TCPConn{
 			TcpConn:          c,
 			ConnCommonFields: conn.NewConnCommonFileds(),
 			PendingMap:       conn.NewPendingMap(),
 		},
 	}
+	cc.SetPeerAddr(c.RemoteAddr())
+	cc.SetIdlePolicy(conn.DefaultIdlePolicy)
+	return cc
 }
 
 func (c *ClientTCPConn) WriteLoop() (err error) {
@@ -43,6 +46,9 @@ func (c *ClientTCPConn) WriteLoop() (err error) {
 			}
 			//c.GetContextLogger().Debugf("msg Out %x", m)
 			err := c.Write(m)
+			if err == conn.ErrConnClosing {
+				continue
+			}
 			if err != nil {
 				c.GetContextLogger().Debugf("write msg is failed %v", err)
 				return err
@@ -1,10 +1,9 @@
 package client
 
 import (
-	"encoding/binary"
 	"fmt"
-	"hash/crc32"
 	"net"
+	"time"
 
 	"github.com/skycoin/net/conn"
 	"github.com/skycoin/net/msg"
@@ -17,7 +16,15 @@ type ClientUDPConn struct {
 func NewClientUDPConn(c *net.UDPConn, addr *net.UDPAddr) *ClientUDPConn {
 	uc := conn.NewUDPConn(c, addr)
 	uc.SendPing = true
-	return &ClientUDPConn{UDPConn: uc}
+	uc.SetConnID(conn.NewConnID())
+	cc := &ClientUDPConn{UDPConn: uc}
+	cc.SetIdlePolicy(conn.DefaultIdlePolicy)
+	return cc
+}
+
+// SetIdlePolicy closes the socket of the client with the connection
+func (c *ClientUDPConn) SetIdlePolicy(p conn.IdlePolicy) {
+	c.WatchIdle(c, p)
 }
 
 func (c *ClientUDPConn) ReadLoop() (err error) {
@@ -32,7 +39,7 @@ func (c *ClientUDPConn) ReadLoop() (err error) {
 		c.Close()
 	}()
 	for {
-		maxBuf := make([]byte, conn.MTU)
+		maxBuf := msg.GetBuffer(conn.MTU)
 		n, err := c.UdpConn.Read(maxBuf)
 		if err != nil {
 			return err
@@ -40,21 +47,45 @@ func (c *ClientUDPConn) ReadLoop() (err error) {
 		c.AddReceivedBytes(n)
 		maxBuf = maxBuf[:n]
 		m := maxBuf[msg.PKG_HEADER_SIZE:]
-		checksum := binary.BigEndian.Uint32(maxBuf[msg.PKG_CRC32_BEGIN:])
-		if checksum != crc32.ChecksumIEEE(m) {
+		if !c.VerifyChecksum(maxBuf) {
 			c.GetContextLogger().Infof("checksum !=")
+			msg.PutBuffer(maxBuf)
 			continue
 		}
 
 		t := m[msg.MSG_TYPE_BEGIN]
 		switch t {
 		case msg.TYPE_PONG:
-		case msg.TYPE_ACK:
+			msg.PutBuffer(maxBuf)
+		case msg.TYPE_MIGRATE:
+			msg.PutBuffer(maxBuf)
+			// the address changed, the id of the ping moves the session
+			err = c.Ping()
+			if err != nil {
+				return err
+			}
+		case msg.TYPE_COOKIE:
+			err = c.RecvCookie(m)
+			msg.PutBuffer(maxBuf)
+			if err != nil {
+				return err
+			}
+		case msg.TYPE_ACK, msg.TYPE_ACK_WINDOW:
 			err = c.RecvAck(m)
+			msg.PutBuffer(maxBuf)
 			if err != nil {
 				return err
 			}
-		case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_REQ, msg.TYPE_RESP:
+		case msg.TYPE_REPORT:
+			err = c.RecvReport(m)
+			msg.PutBuffer(maxBuf)
+			if err != nil {
+				c.GetContextLogger().Debugf("receiver report %v", err)
+			}
+		case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_REQ, msg.TYPE_RESP,
+			msg.TYPE_NORMAL | msg.TYPE_FLAG_COMPRESSED, msg.TYPE_RESP | msg.TYPE_FLAG_COMPRESSED,
+			msg.TYPE_UNRELIABLE, msg.TYPE_UNRELIABLE | msg.TYPE_FLAG_COMPRESSED, msg.TYPE_SKIP,
+			msg.TYPE_BATCH, msg.TYPE_BATCH | msg.TYPE_FLAG_COMPRESSED:
 			err = c.Process(t, m)
 			if err != nil {
 				return err
@@ -67,6 +98,10 @@ func (c *ClientUDPConn) ReadLoop() (err error) {
 	}
 }
 
+func (c *ClientUDPConn) CloseGracefully(timeout time.Duration) error {
+	return conn.CloseGracefully(c, timeout)
+}
+
 func (c *ClientUDPConn) Close() {
 	c.FieldsMutex.RLock()
 	if c.UdpConn != nil {
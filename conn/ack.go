@@ -0,0 +1,176 @@
+package conn
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+const (
+	// received packets that are acked at once
+	DEFAULT_ACK_EVERY = 16
+	// how long the first received packet waits for an ack at most
+	DEFAULT_ACK_DELAY = 2 * time.Millisecond
+	// missing seq ranges of one ack, so it fits in a udp package
+	MAX_ACK_RANGES = (MAX_UDP_PACKAGE_SIZE - msg.ACK_WINDOW_HEADER_SIZE) / ACK_RANGE_SIZE
+	// [start, end) of missing seqs
+	ACK_RANGE_SIZE = 2 * msg.MSG_SEQ_SIZE
+	// missing seqs of one TYPE_ACK, see legacyAck
+	MAX_ACK_MISSING = (MAX_UDP_PACKAGE_SIZE - msg.ACK_HEADER_SIZE) / msg.MSG_SEQ_SIZE
+)
+
+// ackPolicy decides when the received packets are acked, one ack confirms all of them
+type ackPolicy struct {
+	every uint32
+	delay int64
+}
+
+// SetAckPolicy acks the received packets once every of them arrived or the first
+// of them waited delay, the defaults if 0. Fewer acks save bandwidth on asymmetric
+// links, but the delay adds to the rtt seen by the peer
+func (c *UDPConn) SetAckPolicy(every int, delay time.Duration) {
+	if every <= 0 {
+		every = DEFAULT_ACK_EVERY
+	}
+	if delay <= 0 {
+		delay = DEFAULT_ACK_DELAY
+	}
+	atomic.StoreUint32(&c.ackPolicy.every, uint32(every))
+	atomic.StoreInt64(&c.ackPolicy.delay, int64(delay))
+}
+
+func (c *UDPConn) getAckPolicy() (every uint32, delay time.Duration) {
+	return atomic.LoadUint32(&c.ackPolicy.every), time.Duration(atomic.LoadInt64(&c.ackPolicy.delay))
+}
+
+// Ack schedules an ack of seq, see SetAckPolicy. A packet out of order is
+// acked at once, so the peer sees the dup acks of a loss
+func (c *UDPConn) Ack(seq uint32) error {
+	inOrder := false
+	for {
+		h := atomic.LoadUint32(&c.highestRecv)
+		if seq <= h {
+			break
+		}
+		if atomic.CompareAndSwapUint32(&c.highestRecv, h, seq) {
+			inOrder = seq == h+1
+			break
+		}
+	}
+	if !inOrder {
+		atomic.StoreUint32(&c.ackNow, 1)
+	}
+	n := atomic.AddUint32(&c.unacked, 1)
+	every, _ := c.getAckPolicy()
+	if n == 1 || n >= every || !inOrder {
+		select {
+		case c.ackWake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *UDPConn) ackLoop() (err error) {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer func() {
+		timer.Stop()
+		if err != nil {
+			c.SetStatusToError(err)
+		}
+	}()
+
+	for {
+		select {
+		case <-c.ackWake:
+		case <-c.disconnected:
+			return
+		}
+		every, delay := c.getAckPolicy()
+		if atomic.LoadUint32(&c.unacked) < every && atomic.LoadUint32(&c.ackNow) == 0 {
+			timer.Reset(delay)
+			select {
+			case <-timer.C:
+			case <-c.ackWake:
+				if !timer.Stop() {
+					<-timer.C
+				}
+			case <-c.disconnected:
+				return
+			}
+		}
+		// packets arriving from now on wake the loop again
+		atomic.StoreUint32(&c.unacked, 0)
+		atomic.StoreUint32(&c.ackNow, 0)
+		err = c.ack(atomic.LoadUint32(&c.highestRecv))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// legacyAck sends the TYPE_ACK of peers that do not read TYPE_ACK_WINDOW,
+// each missing seq after the header
+func (c *UDPConn) legacyAck(seq, nSeq uint32, missing []uint32) error {
+	p := msg.GetBuffer(msg.ACK_HEADER_SIZE + msg.PKG_HEADER_SIZE + msg.MSG_SEQ_SIZE*len(missing))
+	defer msg.PutBuffer(p)
+	m := p[msg.PKG_HEADER_SIZE:]
+	m[msg.ACK_TYPE_BEGIN] = msg.TYPE_ACK
+	binary.BigEndian.PutUint32(m[msg.ACK_SEQ_BEGIN:], seq)
+	binary.BigEndian.PutUint32(m[msg.ACK_NEXT_SEQ_BEGIN:], nSeq)
+	for i, v := range missing {
+		binary.BigEndian.PutUint32(m[msg.ACK_NEXT_SEQ_END+i*msg.MSG_SEQ_SIZE:], v)
+	}
+	c.PutChecksum(p)
+	return c.WriteExt(p)
+}
+
+// ackRanges turns the sorted missing seqs into [start, end) ranges, at most
+// MAX_ACK_RANGES of them. If there are more, the ack must not confirm anything
+// from the first range left out, so seq is lowered below it
+func ackRanges(seq uint32, missing []uint32) (uint32, [][2]uint32) {
+	var ranges [][2]uint32
+	for _, v := range missing {
+		if l := len(ranges); l > 0 && ranges[l-1][1] == v {
+			ranges[l-1][1]++
+			continue
+		}
+		if len(ranges) == MAX_ACK_RANGES {
+			return v - 1, ranges
+		}
+		ranges = append(ranges, [2]uint32{v, v + 1})
+	}
+	return seq, ranges
+}
+
+// ackMissing is ackRanges for a TYPE_ACK, at most MAX_ACK_MISSING seqs
+func ackMissing(seq uint32, missing []uint32) (uint32, []uint32) {
+	if len(missing) > MAX_ACK_MISSING {
+		return missing[MAX_ACK_MISSING] - 1, missing[:MAX_ACK_MISSING]
+	}
+	return seq, missing
+}
+
+// putAckRanges writes the ranges to b, which must be long enough
+func putAckRanges(b []byte, ranges [][2]uint32) {
+	for i, r := range ranges {
+		binary.BigEndian.PutUint32(b[i*ACK_RANGE_SIZE:], r[0])
+		binary.BigEndian.PutUint32(b[i*ACK_RANGE_SIZE+msg.MSG_SEQ_SIZE:], r[1])
+	}
+}
+
+// getAckRanges reads the ranges of putAckRanges
+func getAckRanges(b []byte) (ranges [][2]uint32) {
+	for ; len(b) >= ACK_RANGE_SIZE; b = b[ACK_RANGE_SIZE:] {
+		ranges = append(ranges, [2]uint32{
+			binary.BigEndian.Uint32(b),
+			binary.BigEndian.Uint32(b[msg.MSG_SEQ_SIZE:]),
+		})
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestAckRanges(t *testing.T) {
+	seq, ranges := ackRanges(20, []uint32{3, 4, 5, 8, 10, 11})
+	if seq != 20 || len(ranges) != 3 || ranges[0] != [2]uint32{3, 6} || ranges[1] != [2]uint32{8, 9} || ranges[2] != [2]uint32{10, 12} {
+		t.Fatalf("seq %d ranges %v", seq, ranges)
+	}
+
+	b := make([]byte, ACK_RANGE_SIZE*len(ranges))
+	putAckRanges(b, ranges)
+	got := getAckRanges(b)
+	if len(got) != len(ranges) {
+		t.Fatalf("got %v", got)
+	}
+	for i := range got {
+		if got[i] != ranges[i] {
+			t.Fatalf("got %v want %v", got, ranges)
+		}
+	}
+
+	var missing []uint32
+	for i := 0; i <= MAX_ACK_RANGES; i++ {
+		missing = append(missing, uint32(2*i+1))
+	}
+	seq, ranges = ackRanges(uint32(2*MAX_ACK_RANGES+10), missing)
+	if len(ranges) != MAX_ACK_RANGES || seq != missing[MAX_ACK_RANGES]-1 {
+		t.Fatalf("seq %d ranges %d", seq, len(ranges))
+	}
+}
+
+func TestAckPolicy(t *testing.T) {
+	c := &UDPConn{ConnCommonFields: NewConnCommonFileds()}
+	c.SetAckPolicy(0, 0)
+	if every, delay := c.getAckPolicy(); every != DEFAULT_ACK_EVERY || delay != DEFAULT_ACK_DELAY {
+		t.Fatalf("every %d delay %v", every, delay)
+	}
+	c.SetAckPolicy(4, time.Hour)
+	c.ackWake = make(chan struct{}, 1)
+	for i := uint32(1); i <= 3; i++ {
+		c.Ack(i)
+	}
+	// the first packet wakes the loop to start the timer
+	<-c.ackWake
+	c.Ack(2)
+	select {
+	case <-c.ackWake:
+	default:
+		t.Fatal("no ack after every packets")
+	}
+	if c.highestRecv != 3 {
+		t.Fatalf("highest %d", c.highestRecv)
+	}
+}
+
+// a peer that only reads TYPE_ACK, as before TYPE_ACK_WINDOW
+func TestLegacyAck(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c := NewUDPConn(sock, peer.LocalAddr().(*net.UDPAddr))
+	defer c.Close()
+	// 5 is a parity shard of the fec, 2 and 6 are missing
+	for _, seq := range []uint32{1, 3, 4, 7} {
+		c.Push(seq, msg.NewUDP(msg.TYPE_NORMAL, seq, []byte{byte(seq)}))
+	}
+	recv := func() []byte {
+		buf := make([]byte, MAX_UDP_PACKAGE_SIZE)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[msg.PKG_HEADER_SIZE:n]
+	}
+	if err = c.ack(7); err != nil {
+		t.Fatal(err)
+	}
+	m := recv()
+	if m[msg.ACK_TYPE_BEGIN] != msg.TYPE_ACK || len(m) != msg.ACK_HEADER_SIZE+msg.MSG_SEQ_SIZE ||
+		binary.BigEndian.Uint32(m[msg.ACK_SEQ_BEGIN:]) != 7 || binary.BigEndian.Uint32(m[msg.ACK_NEXT_SEQ_BEGIN:]) != 2 ||
+		binary.BigEndian.Uint32(m[msg.ACK_NEXT_SEQ_END:]) != 6 {
+		t.Fatalf("ack %x", m)
+	}
+
+	// the peer sent a windowed ack itself
+	w := make([]byte, msg.ACK_WINDOW_HEADER_SIZE)
+	w[msg.ACK_TYPE_BEGIN] = msg.TYPE_ACK_WINDOW
+	binary.BigEndian.PutUint32(w[msg.ACK_WINDOW_BEGIN:], 8)
+	if err = c.RecvAck(w); err != nil {
+		t.Fatal(err)
+	}
+	c.Push(8, msg.NewUDP(msg.TYPE_NORMAL, 8, []byte{8}))
+	if err = c.ack(8); err != nil {
+		t.Fatal(err)
+	}
+	if m = recv(); m[msg.ACK_TYPE_BEGIN] != msg.TYPE_ACK_WINDOW {
+		t.Fatalf("ack %x", m)
+	}
+
+	missing := make([]uint32, MAX_ACK_MISSING+1)
+	for i := range missing {
+		missing[i] = uint32(2*i + 1)
+	}
+	seq, kept := ackMissing(uint32(2*MAX_ACK_MISSING+10), missing)
+	if len(kept) != MAX_ACK_MISSING || seq != missing[MAX_ACK_MISSING]-1 {
+		t.Fatalf("seq %d missing %d", seq, len(kept))
+	}
+}
@@ -0,0 +1,203 @@
+package conn
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// SharedBandwidth is a budget of sent bytes per second shared by many connections.
+// Writes are served by self-clocked weighted fair queueing, so a busy connection
+// can not starve the others and each gets a share of the budget by its weight
+type SharedBandwidth struct {
+	bucket  *tokenBucket
+	virtual float64
+	queue   bandwidthQueue
+	wake    chan struct{}
+	closed  chan struct{}
+	sync.Mutex
+}
+
+type bandwidthRequest struct {
+	finish float64
+	n      int
+	done   chan struct{}
+	index  int
+}
+
+type bandwidthQueue []*bandwidthRequest
+
+func (q bandwidthQueue) Len() int           { return len(q) }
+func (q bandwidthQueue) Less(i, j int) bool { return q[i].finish < q[j].finish }
+func (q bandwidthQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *bandwidthQueue) Push(x interface{}) {
+	r := x.(*bandwidthRequest)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+func (q *bandwidthQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.index = -1
+	*q = old[:len(old)-1]
+	return r
+}
+
+// NewSharedBandwidth starts serving a budget of bytesPerSecond, unlimited if 0
+func NewSharedBandwidth(bytesPerSecond int) *SharedBandwidth {
+	b := &SharedBandwidth{
+		bucket: newTokenBucket(bytesPerSecond),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go b.serve()
+	return b
+}
+
+// SetRate changes the budget, unlimited if 0
+func (b *SharedBandwidth) SetRate(bytesPerSecond int) {
+	b.Lock()
+	b.bucket = newTokenBucket(bytesPerSecond)
+	b.Unlock()
+	b.notify()
+}
+
+// Close releases the waiting writes and makes the budget unlimited
+func (b *SharedBandwidth) Close() {
+	b.Lock()
+	defer b.Unlock()
+	select {
+	case <-b.closed:
+		return
+	default:
+	}
+	close(b.closed)
+	for _, r := range b.queue {
+		r.index = -1
+		close(r.done)
+	}
+	b.queue = nil
+}
+
+func (b *SharedBandwidth) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// serve waits for the budget before it picks the next request,
+// so all writes queued meanwhile compete by their finish tags
+func (b *SharedBandwidth) serve() {
+	for {
+		b.Lock()
+		if len(b.queue) < 1 {
+			b.Unlock()
+			select {
+			case <-b.wake:
+				continue
+			case <-b.closed:
+				return
+			}
+		}
+		wait := b.bucket.debt()
+		if wait > 0 {
+			b.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-b.closed:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		r := heap.Pop(&b.queue).(*bandwidthRequest)
+		b.virtual = r.finish
+		b.bucket.reserve(r.n, -1)
+		b.Unlock()
+		close(r.done)
+	}
+}
+
+// bandwidthShare is the part of a SharedBandwidth a connection gets
+type bandwidthShare struct {
+	b      *SharedBandwidth
+	weight float64
+	// finish tag of the last request of the connection
+	finish float64
+}
+
+// wait blocks until n bytes may be sent, ErrTimeout after deadline,
+// ErrConnClosed after closed and ctx.Err() once ctx is done
+func (s *bandwidthShare) wait(ctx context.Context, n int, deadline time.Time, closed <-chan struct{}) error {
+	b := s.b
+	b.Lock()
+	if b.bucket == nil {
+		b.Unlock()
+		return nil
+	}
+	select {
+	case <-b.closed:
+		b.Unlock()
+		return nil
+	default:
+	}
+	start := b.virtual
+	if s.finish > start {
+		start = s.finish
+	}
+	r := &bandwidthRequest{finish: start + float64(n)/s.weight, n: n, done: make(chan struct{})}
+	s.finish = r.finish
+	heap.Push(&b.queue, r)
+	b.Unlock()
+	b.notify()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	err := ErrConnClosed
+	select {
+	case <-r.done:
+		return nil
+	case <-closed:
+	case <-timeout:
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.Lock()
+	if r.index >= 0 {
+		heap.Remove(&b.queue, r.index)
+		r.index = -1
+	}
+	b.Unlock()
+	return err
+}
+
+// SetSharedBandwidth makes the connection send within b, weighted against the
+// other connections of b, nil leaves it unlimited
+func (c *ConnCommonFields) SetSharedBandwidth(b *SharedBandwidth, weight int) {
+	if b == nil {
+		c.bandwidthShare.Store((*bandwidthShare)(nil))
+		return
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	c.bandwidthShare.Store(&bandwidthShare{b: b, weight: float64(weight)})
+}
+
+func (c *ConnCommonFields) getBandwidthShare() *bandwidthShare {
+	s, _ := c.bandwidthShare.Load().(*bandwidthShare)
+	return s
+}
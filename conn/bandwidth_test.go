@@ -0,0 +1,85 @@
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedBandwidthWeights(t *testing.T) {
+	b := NewSharedBandwidth(200000)
+	defer b.Close()
+	light := NewConnCommonFileds()
+	light.SetSharedBandwidth(b, 1)
+	heavy := NewConnCommonFileds()
+	heavy.SetSharedBandwidth(b, 3)
+
+	// use up the burst so only the fair queue decides
+	if err := light.waitWrite(200000); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent [2]uint64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, c := range []*ConnCommonFields{light, heavy} {
+		wg.Add(1)
+		go func(i int, c *ConnCommonFields) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := c.waitWrite(1000); err != nil {
+					t.Error(err)
+					return
+				}
+				atomic.AddUint64(&sent[i], 1000)
+			}
+		}(i, c)
+	}
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	l, h := atomic.LoadUint64(&sent[0]), atomic.LoadUint64(&sent[1])
+	if total := l + h; total > 220000 {
+		t.Fatalf("sent %d over the budget", total)
+	}
+	ratio := float64(h) / float64(l)
+	if ratio < 2 || ratio > 4 {
+		t.Fatalf("light %d heavy %d, ratio %.2f", l, h, ratio)
+	}
+}
+
+func TestSharedBandwidthCancel(t *testing.T) {
+	b := NewSharedBandwidth(1000)
+	c := NewConnCommonFileds()
+	c.SetSharedBandwidth(b, 1)
+	// the burst, then one second of debt
+	for i := 0; i < 2; i++ {
+		if err := c.waitWrite(1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := c.waitWrite(1000); err != ErrTimeout {
+		t.Fatalf("err %v, want timeout", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	done := make(chan error)
+	go func() { done <- c.waitWrite(1000) }()
+	time.Sleep(50 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not release the write")
+	}
+}
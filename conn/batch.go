@@ -0,0 +1,135 @@
+package conn
+
+import (
+	"net"
+
+	"github.com/skycoin/net/msg"
+)
+
+// packets read or written with one syscall where the platform allows it
+const UDP_BATCH_SIZE = 32
+
+// UDPPacket is a packet of UDPBatchReader, Buf is from msg.GetBuffer
+type UDPPacket struct {
+	Buf  []byte
+	Addr *net.UDPAddr
+}
+
+type batchReader interface {
+	batchSize() int
+	// read fills the first n packets, pkts[i] is read into bufs[i]
+	read(bufs [][]byte, pkts []UDPPacket) (n int, err error)
+}
+
+type batchWriter interface {
+	write(bufs [][]byte) error
+}
+
+// UDPBatchReader reads several packets at once with recvmmsg on linux,
+// one at a time elsewhere
+type UDPBatchReader struct {
+	size   int
+	bufs   [][]byte
+	pkts   []UDPPacket
+	reader batchReader
+}
+
+// NewUDPBatchReader reads packets of up to size bytes from c
+func NewUDPBatchReader(c *net.UDPConn, size int) *UDPBatchReader {
+	reader := newBatchReader(c)
+	return &UDPBatchReader{
+		size:   size,
+		bufs:   make([][]byte, reader.batchSize()),
+		pkts:   make([]UDPPacket, reader.batchSize()),
+		reader: reader,
+	}
+}
+
+// Read blocks until at least one packet arrived, the buffers of the packets
+// belong to the caller
+func (r *UDPBatchReader) Read() ([]UDPPacket, error) {
+	for i := range r.bufs {
+		if r.bufs[i] == nil {
+			r.bufs[i] = msg.GetBuffer(r.size)
+		}
+	}
+	n, err := r.reader.read(r.bufs, r.pkts)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		r.bufs[i] = nil
+	}
+	return r.pkts[:n], nil
+}
+
+type singleReader struct {
+	c *net.UDPConn
+}
+
+func (r singleReader) batchSize() int {
+	return 1
+}
+
+func (r singleReader) read(bufs [][]byte, pkts []UDPPacket) (n int, err error) {
+	n, addr, err := r.c.ReadFromUDP(bufs[0])
+	if err != nil {
+		return
+	}
+	pkts[0] = UDPPacket{Buf: bufs[0][:n], Addr: addr}
+	return 1, nil
+}
+
+type singleWriter struct {
+	c    *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (w singleWriter) write(bufs [][]byte) (err error) {
+	for _, b := range bufs {
+		var n int
+		if w.c.RemoteAddr() != nil {
+			n, err = w.c.Write(b)
+		} else {
+			n, err = w.c.WriteToUDP(b, w.addr)
+		}
+		if err != nil {
+			return err
+		}
+		if n != len(b) {
+			return errNothingWritten
+		}
+	}
+	return nil
+}
+
+// queueBytes is WriteBytes for writePendingMsgs, the packet is sent with the
+// others of the batch at flushBatch. A pooled packet is put back after that
+func (c *UDPConn) queueBytes(bytes []byte, pooled bool) error {
+	c.PutChecksum(bytes)
+	c.AddSentBytes(len(bytes))
+	c.batch = append(c.batch, bytes)
+	if pooled {
+		c.batchPooled = append(c.batchPooled, bytes)
+	}
+	if len(c.batch) >= UDP_BATCH_SIZE {
+		return c.flushBatch()
+	}
+	return nil
+}
+
+func (c *UDPConn) flushBatch() (err error) {
+	if len(c.batch) > 0 {
+		err = c.getBatchWriter().write(c.batch)
+	}
+	for i := range c.batch {
+		c.batch[i] = nil
+	}
+	c.batch = c.batch[:0]
+	for i, b := range c.batchPooled {
+		msg.PutBuffer(b)
+		c.batchPooled[i] = nil
+	}
+	c.batchPooled = c.batchPooled[:0]
+	return
+}
@@ -0,0 +1,229 @@
+package conn
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr of recvmmsg and sendmmsg
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+type mmsgReader struct {
+	raw   syscall.RawConn
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6
+}
+
+func newBatchReader(c *net.UDPConn) batchReader {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return singleReader{c: c}
+	}
+	r := &mmsgReader{
+		raw:   raw,
+		hdrs:  make([]mmsghdr, UDP_BATCH_SIZE),
+		iovs:  make([]unix.Iovec, UDP_BATCH_SIZE),
+		names: make([]unix.RawSockaddrInet6, UDP_BATCH_SIZE),
+	}
+	for i := range r.hdrs {
+		r.hdrs[i].hdr.Iov = &r.iovs[i]
+		r.hdrs[i].hdr.Iovlen = 1
+	}
+	return r
+}
+
+func (r *mmsgReader) batchSize() int {
+	return UDP_BATCH_SIZE
+}
+
+func (r *mmsgReader) read(bufs [][]byte, pkts []UDPPacket) (n int, err error) {
+	for i := range r.hdrs {
+		r.iovs[i].Base = &bufs[i][0]
+		r.iovs[i].SetLen(len(bufs[i]))
+		r.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+		r.hdrs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		r.hdrs[i].len = 0
+	}
+	var errno syscall.Errno
+	err = r.raw.Read(func(fd uintptr) bool {
+		var res uintptr
+		for {
+			res, _, errno = unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.hdrs[0])), uintptr(len(r.hdrs)), 0, 0, 0)
+			if errno != unix.EINTR {
+				break
+			}
+		}
+		if errno == unix.EAGAIN {
+			return false
+		}
+		n = int(res)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	for i := 0; i < n; i++ {
+		pkts[i] = UDPPacket{
+			Buf:  bufs[i][:r.hdrs[i].len],
+			Addr: sockaddrToUDPAddr(&r.names[i]),
+		}
+	}
+	return
+}
+
+func sockaddrToUDPAddr(sa *unix.RawSockaddrInet6) *net.UDPAddr {
+	switch sa.Family {
+	case unix.AF_INET:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3]),
+			Port: ntohs(sa4.Port),
+		}
+	case unix.AF_INET6:
+		addr := &net.UDPAddr{
+			IP:   make(net.IP, net.IPv6len),
+			Port: ntohs(sa.Port),
+		}
+		copy(addr.IP, sa.Addr[:])
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			} else {
+				addr.Zone = strconv.Itoa(int(sa.Scope_id))
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+// ntohs reads a port of a raw sockaddr, it is in network byte order
+func ntohs(port uint16) int {
+	p := (*[2]byte)(unsafe.Pointer(&port))
+	return int(p[0])<<8 | int(p[1])
+}
+
+func htons(port int) uint16 {
+	var r uint16
+	p := (*[2]byte)(unsafe.Pointer(&r))
+	p[0], p[1] = byte(port>>8), byte(port)
+	return r
+}
+
+type mmsgWriter struct {
+	raw syscall.RawConn
+	// nil if the socket is connected
+	name    unsafe.Pointer
+	namelen uint32
+	hdrs    []mmsghdr
+	iovs    []unix.Iovec
+}
+
+func newBatchWriter(c *net.UDPConn, addr *net.UDPAddr) batchWriter {
+	single := singleWriter{c: c, addr: addr}
+	if c == nil {
+		return single
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return single
+	}
+	w := &mmsgWriter{
+		raw:  raw,
+		hdrs: make([]mmsghdr, UDP_BATCH_SIZE),
+		iovs: make([]unix.Iovec, UDP_BATCH_SIZE),
+	}
+	if c.RemoteAddr() == nil {
+		if addr == nil {
+			return single
+		}
+		var local unix.Sockaddr
+		err = raw.Control(func(fd uintptr) {
+			local, err = unix.Getsockname(int(fd))
+		})
+		if err != nil {
+			return single
+		}
+		switch local.(type) {
+		case *unix.SockaddrInet4:
+			ip := addr.IP.To4()
+			if ip == nil {
+				return single
+			}
+			sa := &unix.RawSockaddrInet4{Family: unix.AF_INET, Port: htons(addr.Port)}
+			copy(sa.Addr[:], ip)
+			w.name, w.namelen = unsafe.Pointer(sa), unix.SizeofSockaddrInet4
+		case *unix.SockaddrInet6:
+			ip := addr.IP.To16()
+			if ip == nil || len(addr.Zone) > 0 {
+				return single
+			}
+			sa := &unix.RawSockaddrInet6{Family: unix.AF_INET6, Port: htons(addr.Port)}
+			copy(sa.Addr[:], ip)
+			w.name, w.namelen = unsafe.Pointer(sa), unix.SizeofSockaddrInet6
+		default:
+			return single
+		}
+	}
+	for i := range w.hdrs {
+		w.hdrs[i].hdr.Name = (*byte)(w.name)
+		w.hdrs[i].hdr.Namelen = w.namelen
+		w.hdrs[i].hdr.Iov = &w.iovs[i]
+		w.hdrs[i].hdr.Iovlen = 1
+	}
+	return w
+}
+
+func (w *mmsgWriter) write(bufs [][]byte) error {
+	for len(bufs) > 0 {
+		n := len(bufs)
+		if n > len(w.hdrs) {
+			n = len(w.hdrs)
+		}
+		for i := 0; i < n; i++ {
+			w.iovs[i].Base = &bufs[i][0]
+			w.iovs[i].SetLen(len(bufs[i]))
+		}
+		sent := 0
+		var errno syscall.Errno
+		err := w.raw.Write(func(fd uintptr) bool {
+			for sent < n {
+				var res uintptr
+				res, _, errno = unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&w.hdrs[sent])), uintptr(n-sent), 0, 0, 0)
+				if errno == unix.EINTR {
+					continue
+				}
+				if errno == unix.EAGAIN {
+					return false
+				}
+				if errno != 0 {
+					return true
+				}
+				sent += int(res)
+			}
+			return true
+		})
+		for i := 0; i < n; i++ {
+			w.iovs[i].Base = nil
+		}
+		if err != nil {
+			return err
+		}
+		if errno != 0 {
+			return errno
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import "net"
+
+func newBatchReader(c *net.UDPConn) batchReader {
+	return singleReader{c: c}
+}
+
+func newBatchWriter(c *net.UDPConn, addr *net.UDPAddr) batchWriter {
+	return singleWriter{c: c, addr: addr}
+}
@@ -0,0 +1,73 @@
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPBatchRoundTrip(t *testing.T) {
+	laddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	server, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	n := UDP_BATCH_SIZE + 5
+	var bufs [][]byte
+	for i := 0; i < n; i++ {
+		bufs = append(bufs, bytes.Repeat([]byte{byte(i)}, 10+i))
+	}
+	w := newBatchWriter(client, server.LocalAddr().(*net.UDPAddr))
+	if err = w.write(bufs); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewUDPBatchReader(server, MTU)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	i := 0
+	for i < n {
+		pkts, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pkts {
+			if !bytes.Equal(p.Buf, bufs[i]) {
+				t.Fatalf("packet %d %x", i, p.Buf)
+			}
+			if p.Addr.Port != client.LocalAddr().(*net.UDPAddr).Port || !p.Addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Fatalf("packet %d from %s", i, p.Addr)
+			}
+			i++
+		}
+	}
+
+	// a dialed socket is written without address
+	dialed, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	if err = newBatchWriter(dialed, nil).write(bufs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	for i = 0; i < 2; {
+		pkts, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pkts {
+			if !bytes.Equal(p.Buf, bufs[i]) {
+				t.Fatalf("dialed packet %d %x", i, p.Buf)
+			}
+			i++
+		}
+	}
+}
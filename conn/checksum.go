@@ -0,0 +1,137 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/skycoin/net/msg"
+)
+
+const (
+	CHECKSUM_CRC32  = "crc32"
+	CHECKSUM_XXHASH = "xxhash"
+	// only with an aead cipher suite, which authenticates the bodies already
+	CHECKSUM_NONE = "none"
+)
+
+// checksums a udp connection sends with, bits of the checksums it accepts
+// besides crc32
+const (
+	checksumCRC32 uint32 = 1 << iota
+	checksumXXHash
+	checksumNone
+)
+
+var (
+	ErrUnknownChecksum  = errors.New("unknown checksum")
+	ErrChecksumNeedAEAD = errors.New("checksum none needs an aead cipher suite")
+)
+
+func checksumId(name string) uint32 {
+	switch name {
+	case CHECKSUM_CRC32, "":
+		return checksumCRC32
+	case CHECKSUM_XXHASH:
+		return checksumXXHash
+	case CHECKSUM_NONE:
+		return checksumNone
+	}
+	return 0
+}
+
+// SupportedChecksums returns the checksums of udp packets, cheapest first
+func SupportedChecksums() []string {
+	return []string{CHECKSUM_NONE, CHECKSUM_XXHASH, CHECKSUM_CRC32}
+}
+
+// NegotiateChecksum picks the first of offered that is also in accepted, all
+// supported checksums are accepted if accepted is empty. None is skipped unless
+// aead is true, crc32 is returned if nothing matches
+func NegotiateChecksum(offered, accepted []string, aead bool) string {
+	if len(accepted) < 1 {
+		accepted = SupportedChecksums()
+	}
+	for _, o := range offered {
+		if checksumId(o) == 0 || o == CHECKSUM_NONE && !aead {
+			continue
+		}
+		for _, a := range accepted {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return CHECKSUM_CRC32
+}
+
+// SetChecksum sets the checksum of the udp packets sent from now on. Packets of
+// crc32 are still accepted, they may have been in flight before the peer switched
+func (c *ConnCommonFields) SetChecksum(name string) error {
+	id := checksumId(name)
+	if id == 0 {
+		return ErrUnknownChecksum
+	}
+	if id == checksumNone {
+		if crypto := c.GetCrypto(); crypto == nil || !crypto.IsAEAD() {
+			return ErrChecksumNeedAEAD
+		}
+	}
+	atomic.StoreUint32(&c.checksum, id)
+	atomic.StoreUint32(&c.acceptedChecksums, id)
+	return nil
+}
+
+// AcceptChecksums accepts packets of the offered checksums before the peer
+// answered which one it picked, the answer may come with one of them
+func (c *ConnCommonFields) AcceptChecksums(names []string) {
+	var ids uint32
+	for _, name := range names {
+		ids |= checksumId(name)
+	}
+	for {
+		old := atomic.LoadUint32(&c.acceptedChecksums)
+		if atomic.CompareAndSwapUint32(&c.acceptedChecksums, old, old|ids) {
+			return
+		}
+	}
+}
+
+func (c *ConnCommonFields) GetChecksum() string {
+	switch atomic.LoadUint32(&c.checksum) {
+	case checksumXXHash:
+		return CHECKSUM_XXHASH
+	case checksumNone:
+		return CHECKSUM_NONE
+	}
+	return CHECKSUM_CRC32
+}
+
+// PutChecksum writes the checksum of the packet p to its header
+func (c *ConnCommonFields) PutChecksum(p []byte) {
+	var sum uint32
+	switch atomic.LoadUint32(&c.checksum) {
+	case checksumXXHash:
+		sum = xxhash32(p[msg.PKG_HEADER_SIZE:])
+	case checksumNone:
+	default:
+		sum = crc32.ChecksumIEEE(p[msg.PKG_HEADER_SIZE:])
+	}
+	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], sum)
+}
+
+// VerifyChecksum checks the packet p with the accepted checksums, the one the
+// connection sends with first
+func (c *ConnCommonFields) VerifyChecksum(p []byte) bool {
+	accepted := atomic.LoadUint32(&c.acceptedChecksums)
+	if accepted&checksumNone != 0 {
+		return true
+	}
+	sum := binary.BigEndian.Uint32(p[msg.PKG_CRC32_BEGIN:])
+	m := p[msg.PKG_HEADER_SIZE:]
+	if atomic.LoadUint32(&c.checksum) == checksumXXHash {
+		return sum == xxhash32(m) || sum == crc32.ChecksumIEEE(m)
+	}
+	return sum == crc32.ChecksumIEEE(m) || accepted&checksumXXHash != 0 && sum == xxhash32(m)
+}
@@ -0,0 +1,67 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestXXHash32(t *testing.T) {
+	for s, want := range map[string]uint32{
+		"":    0x02cc5d05,
+		"abc": 0x32d153ff,
+		"Nobody inspects the spammish repetition": 0xe2293b2f,
+	} {
+		if h := xxhash32([]byte(s)); h != want {
+			t.Fatalf("xxhash32(%q) %x want %x", s, h, want)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	if c := NegotiateChecksum([]string{CHECKSUM_NONE, CHECKSUM_XXHASH}, nil, false); c != CHECKSUM_XXHASH {
+		t.Fatalf("negotiated %s without aead", c)
+	}
+	if c := NegotiateChecksum([]string{"md5"}, nil, true); c != CHECKSUM_CRC32 {
+		t.Fatalf("negotiated %s", c)
+	}
+
+	p := msg.GetBuffer(msg.PKG_HEADER_SIZE + 32)
+	defer msg.PutBuffer(p)
+	copy(p[msg.PKG_HEADER_SIZE:], "checksum of the udp packet body")
+
+	a, b := NewConnCommonFileds(), NewConnCommonFileds()
+	a.PutChecksum(p)
+	if err := b.SetChecksum(CHECKSUM_XXHASH); err != nil {
+		t.Fatal(err)
+	}
+	if !b.VerifyChecksum(p) {
+		t.Fatal("crc32 packet in flight rejected")
+	}
+	b.PutChecksum(p)
+	if a.VerifyChecksum(p) {
+		t.Fatal("xxhash packet accepted before it was offered")
+	}
+	a.AcceptChecksums([]string{CHECKSUM_XXHASH})
+	if !a.VerifyChecksum(p) {
+		t.Fatal("offered xxhash packet rejected")
+	}
+	p[len(p)-1]++
+	if a.VerifyChecksum(p) || b.VerifyChecksum(p) {
+		t.Fatal("corrupted packet accepted")
+	}
+
+	if err := a.SetChecksum(CHECKSUM_NONE); err != ErrChecksumNeedAEAD {
+		t.Fatalf("err %v", err)
+	}
+	pk, sk := cipher.GenerateKeyPair()
+	crypto, _ := NewCryptoWithSuite(pk, sk, CIPHER_SUITE_CHACHA20_POLY1305)
+	a.SetCrypto(crypto)
+	if err := a.SetChecksum(CHECKSUM_NONE); err != nil {
+		t.Fatal(err)
+	}
+	if !a.VerifyChecksum(p) {
+		t.Fatal("packet checked with none")
+	}
+}
@@ -0,0 +1,129 @@
+package conn
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+const (
+	// writes this small are coalesced, see SetCoalescing
+	COALESCE_MAX_SIZE = MAX_UDP_PACKAGE_SIZE / 2
+	// length of each message in a msg.TYPE_BATCH body
+	BATCH_LEN_SIZE = 2
+)
+
+// coalescer holds the small writes of a connection until a packet is full
+// or the first of them waited delay
+type coalescer struct {
+	delay time.Duration
+	buf   []byte
+	n     int
+	timer *time.Timer
+	// of a flush by the timer, returned by the next write
+	err error
+	sync.Mutex
+}
+
+// SetCoalescing sends writes smaller than COALESCE_MAX_SIZE together in one
+// packet, it is sent once full or after the first write waited delay. Chatty
+// protocols send fewer packets, but every write may wait delay, see Flush.
+// Off if delay is 0, the default
+func (c *UDPConn) SetCoalescing(delay time.Duration) error {
+	err := c.Flush()
+	c.coalescer.Lock()
+	c.coalescer.delay = delay
+	c.coalescer.Unlock()
+	return err
+}
+
+// Flush sends the coalesced writes at once
+func (c *UDPConn) Flush() error {
+	c.coalescer.Lock()
+	defer c.coalescer.Unlock()
+	return c.flushLocked()
+}
+
+func (c *UDPConn) flushLocked() (err error) {
+	cl := &c.coalescer
+	if cl.timer != nil {
+		cl.timer.Stop()
+	}
+	err, cl.err = cl.err, nil
+	if cl.n == 0 || err != nil {
+		cl.buf, cl.n = cl.buf[:0], 0
+		return
+	}
+	b, t := cl.buf, byte(msg.TYPE_BATCH)
+	if cl.n == 1 {
+		b, t = b[BATCH_LEN_SIZE:], msg.TYPE_NORMAL
+	}
+	// the buffer is owned by the message now
+	cl.buf, cl.n = nil, 0
+	return c.sendToChannel(context.Background(), 0, b, t, time.Time{})
+}
+
+// coalesce returns false if bytes must be sent as they are, the writes
+// coalesced before are flushed then to keep the order
+func (c *UDPConn) coalesce(small bool, bytes []byte) (ok bool, err error) {
+	cl := &c.coalescer
+	cl.Lock()
+	defer cl.Unlock()
+	if cl.delay <= 0 {
+		return false, nil
+	}
+	if !small || len(bytes) >= COALESCE_MAX_SIZE {
+		return false, c.flushLocked()
+	}
+	if len(cl.buf)+BATCH_LEN_SIZE+len(bytes) > MAX_UDP_PACKAGE_SIZE {
+		err = c.flushLocked()
+		if err != nil {
+			return
+		}
+	}
+	if cl.err != nil {
+		err, cl.err = cl.err, nil
+		return
+	}
+	var l [BATCH_LEN_SIZE]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(bytes)))
+	cl.buf = append(append(cl.buf, l[:]...), bytes...)
+	cl.n++
+	if cl.n == 1 {
+		if cl.timer == nil {
+			cl.timer = time.AfterFunc(cl.delay, c.flushTimer)
+		} else {
+			cl.timer.Reset(cl.delay)
+		}
+	}
+	return true, nil
+}
+
+func (c *UDPConn) flushTimer() {
+	c.coalescer.Lock()
+	defer c.coalescer.Unlock()
+	if err := c.flushLocked(); err != nil {
+		c.GetContextLogger().Debugf("flush coalesced writes %v", err)
+		c.coalescer.err = err
+	}
+}
+
+// splitBatch returns the messages of a msg.TYPE_BATCH body
+func splitBatch(b []byte) (ms [][]byte, err error) {
+	for len(b) > 0 {
+		if len(b) < BATCH_LEN_SIZE {
+			return nil, fmt.Errorf("invalid batch %x", b)
+		}
+		l := int(binary.BigEndian.Uint16(b)) + BATCH_LEN_SIZE
+		if len(b) < l {
+			return nil, fmt.Errorf("invalid batch %x", b)
+		}
+		ms = append(ms, b[BATCH_LEN_SIZE:l])
+		b = b[l:]
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestCoalescing(t *testing.T) {
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	as, bs := listen(), listen()
+	defer as.Close()
+	defer bs.Close()
+	a := NewUDPConn(as, bs.LocalAddr().(*net.UDPAddr))
+	b := NewUDPConn(bs, as.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+	defer b.Close()
+
+	ak, ask := cipher.GenerateKeyPair()
+	bk, bsk := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(16)
+	ac, bc := NewCrypto(ak, ask), NewCrypto(bk, bsk)
+	ac.SetTargetKey(bk)
+	bc.SetTargetKey(ak)
+	ac.Init(iv)
+	bc.Init(iv)
+	a.SetCrypto(ac)
+	b.SetCrypto(bc)
+	go a.WriteLoop()
+
+	// delivers the message of seq to b and returns its type
+	deliver := func(seq uint32) byte {
+		buf := make([]byte, MTU)
+		for {
+			bs.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := bs.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := buf[msg.PKG_HEADER_SIZE:n]
+			if len(m) >= msg.MSG_HEADER_SIZE && m[msg.MSG_TYPE_BEGIN] != msg.TYPE_FEC &&
+				binary.BigEndian.Uint32(m[msg.MSG_SEQ_BEGIN:]) == seq {
+				if err = b.Process(m[msg.MSG_TYPE_BEGIN], m); err != nil {
+					t.Fatal(err)
+				}
+				return m[msg.MSG_TYPE_BEGIN]
+			}
+		}
+	}
+	expect := func(want ...string) {
+		for _, w := range want {
+			select {
+			case m := <-b.GetChanIn():
+				if string(m) != w {
+					t.Fatalf("got %q want %q", m, w)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%q not delivered", w)
+			}
+		}
+	}
+
+	a.SetCoalescing(time.Hour)
+	for _, s := range []string{"first", "second", "third"} {
+		if err := a.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.PendingLen() != 0 || atomic.LoadInt32(&a.ca.pendingCnt) != 0 {
+		t.Fatal("coalesced writes sent")
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if typ := deliver(1); typ != msg.TYPE_BATCH {
+		t.Fatalf("type %x", typ)
+	}
+	expect("first", "second", "third")
+
+	// a large write sends the one before first
+	large := make([]byte, COALESCE_MAX_SIZE)
+	a.Write([]byte("small"))
+	a.Write(large)
+	if typ := deliver(2); typ != msg.TYPE_NORMAL {
+		t.Fatalf("type %x", typ)
+	}
+	deliver(3)
+	expect("small", string(large))
+
+	a.SetCoalescing(10 * time.Millisecond)
+	a.Write([]byte("timer"))
+	deliver(4)
+	expect("timer")
+
+	if _, err := splitBatch([]byte{0, 3, 'a'}); err == nil {
+		t.Fatal("short batch split")
+	}
+}
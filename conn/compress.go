@@ -0,0 +1,202 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/skycoin/net/msg"
+)
+
+const (
+	COMPRESSION_NONE   = ""
+	COMPRESSION_SNAPPY = "snappy"
+	COMPRESSION_ZSTD   = "zstd"
+
+	// bodies shorter than this are sent as they are
+	DEFAULT_COMPRESSION_THRESHOLD = 256
+	// a compressed body never expands beyond this
+	MAX_DECOMPRESSED_SIZE = 1 << 20
+)
+
+var (
+	ErrUnknownCompression   = errors.New("unknown compression")
+	ErrDecompressedTooLarge = NewError(ErrTooLarge, "decompressed body is too large")
+)
+
+// Compressor compresses message bodies, the id is sent as the first byte of a
+// compressed body so the peer can decode it without knowing what was negotiated
+type Compressor interface {
+	Name() string
+	Id() byte
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return COMPRESSION_SNAPPY }
+func (snappyCompressor) Id() byte     { return 1 }
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > MAX_DECOMPRESSED_SIZE {
+		return nil, ErrDecompressedTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	e, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_DECOMPRESSED_SIZE), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		panic(err)
+	}
+	return &zstdCompressor{encoder: e, decoder: d}
+}
+
+func (*zstdCompressor) Name() string { return COMPRESSION_ZSTD }
+func (*zstdCompressor) Id() byte     { return 2 }
+
+func (z *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(src, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	return z.decoder.DecodeAll(src, nil)
+}
+
+// in order of preference
+var compressors = []Compressor{newZstdCompressor(), snappyCompressor{}}
+
+// SupportedCompressions returns the names of the supported compressions, best first
+func SupportedCompressions() (names []string) {
+	for _, c := range compressors {
+		names = append(names, c.Name())
+	}
+	return
+}
+
+// NegotiateCompression picks the first of offered that is also in accepted,
+// all supported compressions are accepted if accepted is empty
+func NegotiateCompression(offered, accepted []string) string {
+	if len(accepted) < 1 {
+		accepted = SupportedCompressions()
+	}
+	for _, o := range offered {
+		if getCompressor(o) == nil {
+			continue
+		}
+		for _, a := range accepted {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return COMPRESSION_NONE
+}
+
+func getCompressor(name string) Compressor {
+	for _, c := range compressors {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func getCompressorById(id byte) Compressor {
+	for _, c := range compressors {
+		if c.Id() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+type compression struct {
+	Compressor
+	threshold int
+}
+
+// SetCompression enables compression of outgoing bodies not shorter than threshold,
+// an empty name disables it
+func (c *ConnCommonFields) SetCompression(name string, threshold int) error {
+	if name == COMPRESSION_NONE {
+		c.compression.Store(&compression{})
+		return nil
+	}
+	cp := getCompressor(name)
+	if cp == nil {
+		return ErrUnknownCompression
+	}
+	if threshold <= 0 {
+		threshold = DEFAULT_COMPRESSION_THRESHOLD
+	}
+	c.compression.Store(&compression{Compressor: cp, threshold: threshold})
+	return nil
+}
+
+func (c *ConnCommonFields) GetCompression() string {
+	cp, ok := c.compression.Load().(*compression)
+	if !ok || cp.Compressor == nil {
+		return COMPRESSION_NONE
+	}
+	return cp.Name()
+}
+
+// GetCompressionRatio returns compressed/raw size of the bodies that went through compression
+func (c *ConnCommonFields) GetCompressionRatio() float64 {
+	raw := atomic.LoadUint64(&c.compressionRawBytes)
+	if raw == 0 {
+		return 1
+	}
+	return float64(atomic.LoadUint64(&c.compressionOutBytes)) / float64(raw)
+}
+
+// compressBody returns the type and body to send, the type gets
+// msg.TYPE_FLAG_COMPRESSED if the body was compressed
+func (c *ConnCommonFields) compressBody(t byte, body []byte) (byte, []byte) {
+	cp, ok := c.compression.Load().(*compression)
+	if !ok || cp.Compressor == nil || len(body) < cp.threshold {
+		return t, body
+	}
+	b, err := cp.Compress(body)
+	if err != nil || len(b)+1 >= len(body) {
+		return t, body
+	}
+	result := make([]byte, len(b)+1)
+	result[0] = cp.Id()
+	copy(result[1:], b)
+	atomic.AddUint64(&c.compressionRawBytes, uint64(len(body)))
+	atomic.AddUint64(&c.compressionOutBytes, uint64(len(result)))
+	return t | msg.TYPE_FLAG_COMPRESSED, result
+}
+
+func decompressBody(body []byte) ([]byte, error) {
+	if len(body) < 1 {
+		return nil, fmt.Errorf("invalid compressed body %x", body)
+	}
+	cp := getCompressorById(body[0])
+	if cp == nil {
+		return nil, ErrUnknownCompression
+	}
+	return cp.Decompress(body[1:])
+}
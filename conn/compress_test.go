@@ -0,0 +1,73 @@
+package conn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	for _, c := range []struct {
+		offered, accepted []string
+		compression       string
+	}{
+		{[]string{COMPRESSION_ZSTD, COMPRESSION_SNAPPY}, []string{COMPRESSION_SNAPPY, COMPRESSION_ZSTD}, COMPRESSION_ZSTD},
+		{[]string{COMPRESSION_ZSTD, COMPRESSION_SNAPPY}, []string{COMPRESSION_SNAPPY}, COMPRESSION_SNAPPY},
+		{[]string{COMPRESSION_SNAPPY}, nil, COMPRESSION_SNAPPY},
+		{[]string{"lz4", COMPRESSION_ZSTD}, nil, COMPRESSION_ZSTD},
+		{[]string{"lz4"}, []string{"lz4"}, COMPRESSION_NONE},
+		{[]string{COMPRESSION_ZSTD}, []string{COMPRESSION_SNAPPY}, COMPRESSION_NONE},
+		{nil, nil, COMPRESSION_NONE},
+	} {
+		if compression := NegotiateCompression(c.offered, c.accepted); compression != c.compression {
+			t.Fatalf("offered %v accepted %v: %q, want %q", c.offered, c.accepted, compression, c.compression)
+		}
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	body := bytes.Repeat([]byte("compressed body "), 64)
+	for _, name := range SupportedCompressions() {
+		c := NewConnCommonFileds()
+		if err := c.SetCompression(name, 64); err != nil {
+			t.Fatal(err)
+		}
+		typ, b := c.compressBody(msg.TYPE_NORMAL, body)
+		if typ != msg.TYPE_NORMAL|msg.TYPE_FLAG_COMPRESSED || len(b) >= len(body) {
+			t.Fatalf("%s type %d len %d", name, typ, len(b))
+		}
+		if b[0] != getCompressor(name).Id() {
+			t.Fatalf("%s id %d", name, b[0])
+		}
+		plain, err := decompressBody(b)
+		if err != nil || !bytes.Equal(plain, body) {
+			t.Fatalf("%s round trip err %v", name, err)
+		}
+		if r := c.GetCompressionRatio(); r >= 1 {
+			t.Fatalf("%s ratio %f", name, r)
+		}
+
+		// under the threshold
+		short := body[:63]
+		if typ, b = c.compressBody(msg.TYPE_NORMAL, short); typ != msg.TYPE_NORMAL || !bytes.Equal(b, short) {
+			t.Fatalf("%s short body compressed", name)
+		}
+		// would not shrink
+		random := cipher.RandByte(1024)
+		if typ, b = c.compressBody(msg.TYPE_NORMAL, random); typ != msg.TYPE_NORMAL || !bytes.Equal(b, random) {
+			t.Fatalf("%s random body compressed", name)
+		}
+	}
+	c := NewConnCommonFileds()
+	if err := c.SetCompression("lz4", 0); err != ErrUnknownCompression {
+		t.Fatalf("unknown compression err %v", err)
+	}
+	if typ, _ := c.compressBody(msg.TYPE_NORMAL, body); typ != msg.TYPE_NORMAL {
+		t.Fatal("body compressed without a compression")
+	}
+	if _, err := decompressBody([]byte{0xff, 1, 2}); err != ErrUnknownCompression {
+		t.Fatalf("unknown id err %v", err)
+	}
+}
@@ -2,12 +2,11 @@ package conn
 
 import (
 	"container/list"
+	"context"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -18,13 +17,23 @@ type Connection interface {
 	ReadLoop() error
 	WriteLoop() error
 	Write(bytes []byte) error
+	WriteContext(ctx context.Context, bytes []byte) error
 	GetChanIn() <-chan []byte
 	GetChanOut() chan<- []byte
 	Close()
 	IsClosed() bool
-
-	GetContextLogger() *log.Entry
-	SetContextLogger(*log.Entry)
+	// see CloseGracefully
+	CloseGracefully(timeout time.Duration) error
+	StopWrites()
+	IsClosing() bool
+	// WaitForAcks waits until the messages written are acked
+	WaitForAcks(timeout time.Duration) error
+
+	GetContextLogger() Logger
+	SetContextLogger(Logger)
+	SetLogLevel(level LogLevel)
+	// see Hooks
+	SetHooks(h Hooks)
 
 	GetRemoteAddr() net.Addr
 	IsTCP() bool
@@ -36,19 +45,69 @@ type Connection interface {
 	GetSentBytes() uint64
 	// Get received bytes count
 	GetReceivedBytes() uint64
+	Metrics() Metrics
+	// ack statistics, see PendingMap
+	Stats() Stats
+	LastMinuteStats() Stats
+	LatencyHistogram() *Histogram
+	ResetStats()
 
 	NewPendingChannel() (channel int)
 	DeletePendingChannel(channel int)
+	SetPendingChannelWeight(channel, weight int)
 	WriteToChannel(channel int, bytes []byte) (err error)
 
 	WaitForDisconnected()
+	// closed when the connection is closed
+	Disconnected() <-chan struct{}
 
 	WriteReq(bytes []byte) (err error)
 	WriteResp(bytes []byte) (err error)
+	// see UDPConn.WriteUnreliable
+	WriteUnreliable(bytes []byte) (err error)
+	// see UDPConn.WriteWithDeadline
+	WriteWithDeadline(bytes []byte, deadline time.Time) (err error)
+	// see UDPConn.SetReceiverReportInterval
+	SetReceiverReportInterval(interval time.Duration)
+	// see UDPConn.SetReorderWindow
+	SetReorderWindow(window int, wait time.Duration)
+	// see UDPConn.EnableAckWindow
+	EnableAckWindow()
+	SetReceiverReportCallback(fn func(r ReceiverReport))
+
+	// deadlines follow net.Conn, the zero time means none
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	GetReadDeadline() time.Time
+	GetWriteDeadline() time.Time
+	Read() ([]byte, error)
+	ReadChan(ch <-chan []byte) ([]byte, error)
 
 	SetCrypto(crypto *Crypto)
 	GetCrypto() *Crypto
 
+	// see SetupTimes
+	SetSetupStart(t time.Time)
+	MarkSetup(phase int)
+	SetupTimes() SetupTimes
+
+	SetChannelOptions(o ChannelOptions) error
+	SetOverflowPolicy(p OverflowPolicy)
+	GetDroppedCount() uint64
+	SetRateLimit(l *RateLimit)
+	SetSharedBandwidth(b *SharedBandwidth, weight int)
+	SetMemoryLimit(bytes int)
+	SetMaxMessageSize(bytes uint32)
+	SetIdlePolicy(p IdlePolicy)
+	GetMemoryUsage() int
+
+	SetCompression(name string, threshold int) error
+	SetChecksum(name string) error
+	AcceptChecksums(names []string)
+	GetCompression() string
+	GetCompressionRatio() float64
+
 	AddDirectlyHistory(seq uint32)
 	RemoveDirectlyHistory() (seq uint32)
 	DirectlyHistoryLen() (len int)
@@ -61,9 +120,24 @@ type ConnCommonFields struct {
 	LastAck                    int64  // last time an ACK of receipt was received (better to store id of highest packet id with an ACK?)
 
 	lastReadTime int64
+	// unix nano of lastReadTime for the idle policy
+	lastRead int64
+	idle     idleWatch
 
 	sentBytes     uint64
 	receivedBytes uint64
+	// received messages dropped by the overflow policy
+	droppedCount uint64
+	// string, see SetPeerAddr
+	peerAddr atomic.Value
+
+	compression         atomic.Value
+	compressionRawBytes uint64
+	compressionOutBytes uint64
+
+	// of udp packets, see SetChecksum
+	checksum          uint32
+	acceptedChecksums uint32
 
 	Status int // STATUS_CONNECTING, STATUS_CONNECTED, STATUS_ERROR
 	Err    error
@@ -71,11 +145,24 @@ type ConnCommonFields struct {
 	In           chan []byte
 	Out          chan []byte
 	closed       bool
+	inMutex      sync.RWMutex
 	FieldsMutex  sync.RWMutex
 	WriteMutex   sync.Mutex
 	disconnected chan struct{}
+	// see StopWrites
+	writesStopped int32
+
+	deadlines deadlines
+
+	overflowPolicy OverflowPolicy
+	rateLimiter    atomic.Value
+	bandwidthShare atomic.Value
+	memory         memoryAccount
+	// see SetMaxMessageSize
+	maxMessageSize uint32
 
 	ctxLogger atomic.Value
+	hooks     hooks
 
 	crypto      atomic.Value
 	cryptoMutex sync.Mutex
@@ -83,26 +170,34 @@ type ConnCommonFields struct {
 
 	directlyHistory      *list.List
 	directlyHistoryMutex sync.Mutex
+
+	setup setupMarks
 }
 
 func NewConnCommonFileds() *ConnCommonFields {
-	entry := log.WithField("ctxId", atomic.AddUint32(&ctxId, 1))
+	entry := WithSubsystem(GetLogger(), LOG_CONN).WithField("ctxId", atomic.AddUint32(&ctxId, 1))
 	fields := &ConnCommonFields{
 		lastReadTime:    time.Now().Unix(),
-		In:              make(chan []byte, 128),
-		Out:             make(chan []byte, 1),
+		lastRead:        time.Now().UnixNano(),
+		In:              make(chan []byte, DEFAULT_IN_SIZE),
+		Out:             make(chan []byte, DEFAULT_OUT_SIZE),
 		disconnected:    make(chan struct{}),
 		directlyHistory: list.New(),
 	}
+	fields.setup.start = time.Now().UnixNano()
 	fields.cryptoCond = sync.NewCond(&fields.cryptoMutex)
-	fields.ctxLogger.Store(entry)
+	fields.ctxLogger.Store(loggerValue{entry})
 	return fields
 }
 
 func (c *ConnCommonFields) SetStatusToConnected() {
 	c.FieldsMutex.Lock()
 	c.Status = STATUS_CONNECTED
+	closed := c.closed
 	c.FieldsMutex.Unlock()
+	if !closed {
+		c.runOnConnected()
+	}
 }
 
 func (c *ConnCommonFields) SetStatusToError(err error) {
@@ -115,6 +210,7 @@ func (c *ConnCommonFields) SetStatusToError(err error) {
 	c.Err = err
 	c.FieldsMutex.Unlock()
 	c.GetContextLogger().Debugf("SetStatusToError %v", err)
+	c.runOnError(err)
 }
 
 func (c *ConnCommonFields) UpdateLastAck(s uint32) {
@@ -126,12 +222,12 @@ func (c *ConnCommonFields) UpdateLastAck(s uint32) {
 	c.FieldsMutex.Unlock()
 }
 
-func (c *ConnCommonFields) GetContextLogger() *log.Entry {
-	return c.ctxLogger.Load().(*log.Entry)
+func (c *ConnCommonFields) GetContextLogger() Logger {
+	return c.ctxLogger.Load().(loggerValue).Logger
 }
 
-func (c *ConnCommonFields) SetContextLogger(l *log.Entry) {
-	c.ctxLogger.Store(l)
+func (c *ConnCommonFields) SetContextLogger(l Logger) {
+	c.ctxLogger.Store(loggerValue{l})
 }
 
 func (c *ConnCommonFields) GetChanOut() chan<- []byte {
@@ -144,18 +240,25 @@ func (c *ConnCommonFields) GetChanIn() <-chan []byte {
 
 func (c *ConnCommonFields) Close() {
 	c.FieldsMutex.Lock()
-	defer c.FieldsMutex.Unlock()
-
 	if c.closed {
+		c.FieldsMutex.Unlock()
 		return
 	}
 	c.closed = true
 
 	c.cryptoCond.Broadcast()
 
-	close(c.In)
 	close(c.Out)
 	close(c.disconnected)
+	err := c.Err
+	c.FieldsMutex.Unlock()
+	c.closeMemory()
+
+	// a blocked pushIn gives up once disconnected is closed
+	c.inMutex.Lock()
+	close(c.In)
+	c.inMutex.Unlock()
+	c.runOnDisconnected(err)
 }
 
 func (c *ConnCommonFields) IsClosed() bool {
@@ -168,12 +271,18 @@ func (c *ConnCommonFields) WaitForDisconnected() {
 	<-c.disconnected
 }
 
+func (c *ConnCommonFields) Disconnected() <-chan struct{} {
+	return c.disconnected
+}
+
 func (c *ConnCommonFields) GetLastTime() int64 {
 	return atomic.LoadInt64(&c.lastReadTime)
 }
 
 func (c *ConnCommonFields) UpdateLastTime() {
-	atomic.StoreInt64(&c.lastReadTime, time.Now().Unix())
+	now := time.Now()
+	atomic.StoreInt64(&c.lastReadTime, now.Unix())
+	atomic.StoreInt64(&c.lastRead, now.UnixNano())
 }
 
 func (c *ConnCommonFields) GetSentBytes() uint64 {
@@ -200,6 +309,10 @@ func (c *ConnCommonFields) DeletePendingChannel(channel int) {
 	panic("not implemented")
 }
 
+func (c *ConnCommonFields) SetPendingChannelWeight(channel, weight int) {
+	panic("not implemented")
+}
+
 func (c *ConnCommonFields) WriteToChannel(channel int, bytes []byte) (err error) {
 	panic("not implemented")
 }
@@ -207,6 +320,9 @@ func (c *ConnCommonFields) WriteToChannel(channel int, bytes []byte) (err error)
 func (c *ConnCommonFields) SetCrypto(crypto *Crypto) {
 	c.crypto.Store(crypto)
 	c.cryptoCond.Broadcast()
+	if crypto != nil {
+		c.MarkSetup(SETUP_HANDSHAKE)
+	}
 }
 
 func (c *ConnCommonFields) GetCrypto() *Crypto {
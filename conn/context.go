@@ -0,0 +1,18 @@
+package conn
+
+import "context"
+
+// CloseWhenDone closes c once ctx is done, its ReadLoop and WriteLoop return
+// and blocked writes fail with ErrConnClosed
+func CloseWhenDone(ctx context.Context, c Connection) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.Disconnected():
+		}
+	}()
+}
@@ -0,0 +1,49 @@
+package conn
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+	c := &TCPConn{TcpConn: a, ConnCommonFields: NewConnCommonFileds(), PendingMap: NewPendingMap()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.WriteContext(ctx, []byte("a")); err != context.Canceled {
+		t.Fatalf("err %v", err)
+	}
+	if c.PendingLen() != 0 {
+		t.Fatal("canceled message pending")
+	}
+
+	c.SetRateLimit(&RateLimit{WriteMessages: 1})
+	if err := c.WriteContext(context.Background(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.WriteContext(ctx, []byte("b")); err != context.DeadlineExceeded {
+		t.Fatalf("err %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("gave up after %v", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	CloseWhenDone(ctx, c)
+	cancel()
+	select {
+	case <-c.Disconnected():
+	case <-time.After(time.Second):
+		t.Fatal("not closed")
+	}
+}
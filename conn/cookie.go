@@ -0,0 +1,126 @@
+package conn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+// cookie msg index
+const (
+	COOKIE_CHALLENGE = 0
+	COOKIE_ECHO      = 1
+
+	COOKIE_KIND_BEGIN = msg.MSG_TYPE_END
+	COOKIE_KIND_END   = COOKIE_KIND_BEGIN + 1
+	COOKIE_TIME_BEGIN = COOKIE_KIND_END
+	COOKIE_TIME_END   = COOKIE_TIME_BEGIN + 4
+	COOKIE_MAC_BEGIN  = COOKIE_TIME_END
+	COOKIE_MAC_END    = COOKIE_MAC_BEGIN + 8
+
+	COOKIE_MSG_SIZE = COOKIE_MAC_END
+)
+
+// how long a client may take to echo a cookie
+const COOKIE_LIFETIME = 30 * time.Second
+
+// Cookies are the stateless challenges a server sends to a new address
+// before it makes a connection, like the HelloVerifyRequest of DTLS. Only
+// clients that get the packets of their address can echo them, so spoofed
+// sources cost the server neither memory nor more bytes than they sent
+type Cookies struct {
+	secret []byte
+}
+
+func NewCookies() *Cookies {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &Cookies{secret: secret}
+}
+
+func (k *Cookies) mac(addr *net.UDPAddr, t uint32, b []byte) {
+	h := hmac.New(sha256.New, k.secret)
+	var ts [4]byte
+	binary.BigEndian.PutUint32(ts[:], t)
+	h.Write(ts[:])
+	h.Write(addr.IP.To16())
+	binary.BigEndian.PutUint16(ts[:], uint16(addr.Port))
+	h.Write(ts[:2])
+	copy(b, h.Sum(nil))
+}
+
+// Challenge sends a cookie to addr, which sent n bytes. It is dropped if
+// the cookie is longer
+func (k *Cookies) Challenge(c *net.UDPConn, addr *net.UDPAddr, n int) error {
+	p := make([]byte, msg.PKG_HEADER_SIZE+COOKIE_MSG_SIZE)
+	if len(p) > n {
+		return nil
+	}
+	m := p[msg.PKG_HEADER_SIZE:]
+	m[msg.MSG_TYPE_BEGIN] = msg.TYPE_COOKIE
+	m[COOKIE_KIND_BEGIN] = COOKIE_CHALLENGE
+	t := uint32(time.Now().Unix())
+	binary.BigEndian.PutUint32(m[COOKIE_TIME_BEGIN:], t)
+	k.mac(addr, t, m[COOKIE_MAC_BEGIN:COOKIE_MAC_END])
+	// every connection accepts crc32
+	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], crc32.ChecksumIEEE(m))
+	_, err := c.WriteToUDP(p, addr)
+	return err
+}
+
+// Verify reports whether m echoes a cookie sent to addr less than
+// COOKIE_LIFETIME ago
+func (k *Cookies) Verify(m []byte, addr *net.UDPAddr) bool {
+	if !IsCookieEcho(m) {
+		return false
+	}
+	t := binary.BigEndian.Uint32(m[COOKIE_TIME_BEGIN:])
+	age := time.Since(time.Unix(int64(t), 0))
+	if age < -time.Second || age > COOKIE_LIFETIME {
+		return false
+	}
+	var mac [COOKIE_MAC_END - COOKIE_MAC_BEGIN]byte
+	k.mac(addr, t, mac[:])
+	return hmac.Equal(mac[:], m[COOKIE_MAC_BEGIN:COOKIE_MAC_END])
+}
+
+// IsCookieEcho reports whether m is the echo of a cookie
+func IsCookieEcho(m []byte) bool {
+	return len(m) >= COOKIE_MSG_SIZE && m[msg.MSG_TYPE_BEGIN] == msg.TYPE_COOKIE && m[COOKIE_KIND_BEGIN] == COOKIE_ECHO
+}
+
+// RecvCookie echoes the challenge m of a server and sends the first
+// message not acked again, the server dropped it
+func (c *UDPConn) RecvCookie(m []byte) (err error) {
+	if len(m) < COOKIE_MSG_SIZE || m[COOKIE_KIND_BEGIN] != COOKIE_CHALLENGE {
+		return
+	}
+	c.GetContextLogger().Debug("echo cookie")
+	p := msg.GetBuffer(msg.PKG_HEADER_SIZE + COOKIE_MSG_SIZE)
+	defer msg.PutBuffer(p)
+	copy(p[msg.PKG_HEADER_SIZE:], m[:COOKIE_MSG_SIZE])
+	p[msg.PKG_HEADER_SIZE+COOKIE_KIND_BEGIN] = COOKIE_ECHO
+	c.PutChecksum(p)
+	err = c.WriteExt(p)
+	if err != nil {
+		return
+	}
+	seq, ok := c.getMinUnAckSeq()
+	if !ok {
+		return
+	}
+	if v, ok := c.GetMsg(seq); ok {
+		if um, ok := v.(*msg.UDPMessage); ok {
+			err = c.resendMsg(um)
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestCookies(t *testing.T) {
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	server, client := listen(), listen()
+	defer server.Close()
+	defer client.Close()
+	addr := client.LocalAddr().(*net.UDPAddr)
+	read := func(c *net.UDPConn) []byte {
+		buf := make([]byte, MTU)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[msg.PKG_HEADER_SIZE:n]
+	}
+
+	k := NewCookies()
+	if err := k.Challenge(server, addr, msg.PKG_HEADER_SIZE+COOKIE_MSG_SIZE-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Challenge(server, addr, MTU); err != nil {
+		t.Fatal(err)
+	}
+	challenge := read(client)
+	if len(challenge) != COOKIE_MSG_SIZE || challenge[msg.MSG_TYPE_BEGIN] != msg.TYPE_COOKIE {
+		t.Fatalf("challenge %x, the one larger than the request sent", challenge)
+	}
+	if k.Verify(challenge, addr) {
+		t.Fatal("challenge verified as echo")
+	}
+
+	c := NewUDPConn(client, server.LocalAddr().(*net.UDPAddr))
+	defer c.Close()
+	if err := c.RecvCookie(challenge); err != nil {
+		t.Fatal(err)
+	}
+	echo := read(server)
+	if !k.Verify(echo, addr) {
+		t.Fatal("echo not verified")
+	}
+	if k.Verify(echo, &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1}) || NewCookies().Verify(echo, addr) {
+		t.Fatal("echo verified for another address or server")
+	}
+	echo[COOKIE_MAC_BEGIN] ^= 1
+	if k.Verify(echo, addr) {
+		t.Fatal("tampered echo verified")
+	}
+}
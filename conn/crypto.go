@@ -3,30 +3,144 @@ package conn
 import (
 	"crypto/aes"
 	cipher2 "crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/skycoin/skycoin/src/cipher"
+	"golang.org/x/sys/cpu"
 	"io"
 	"sync"
 	"sync/atomic"
 )
 
+const (
+	// stream cipher over the whole connection, used when nothing was negotiated
+	CIPHER_SUITE_AES_CFB           = "aes-cfb"
+	CIPHER_SUITE_AES_GCM           = "aes-256-gcm"
+	CIPHER_SUITE_CHACHA20_POLY1305 = "chacha20-poly1305"
+
+	// explicit nonce in front of every sealed udp body
+	PACKET_NONCE_SIZE = 8
+	// length prefix of every sealed tcp record
+	RECORD_HEADER_SIZE = 2
+	MAX_RECORD_SIZE    = 1<<16 - 1
+	// how far behind the highest opened packet nonce a packet may still arrive
+	REPLAY_WINDOW_SIZE = 1024
+)
+
+var (
+	ErrUnknownCipherSuite = errors.New("unknown cipher suite")
+	ErrNotAEAD            = errors.New("cipher suite is not aead")
+	ErrReplayed           = NewError(ErrUnauthorized, "packet nonce replayed or too old")
+)
+
+// SupportedCipherSuites returns the supported aead suites, best first. AES-GCM is
+// preferred only when the cpu has AES instructions, ChaCha20-Poly1305 is much
+// faster without them. Suites of RegisterCryptoProvider follow the built-in ones
+func SupportedCipherSuites() []string {
+	suites := []string{CIPHER_SUITE_CHACHA20_POLY1305, CIPHER_SUITE_AES_GCM}
+	if cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ || cpu.ARM64.HasAES && cpu.ARM64.HasPMULL || cpu.S390X.HasAES {
+		suites[0], suites[1] = suites[1], suites[0]
+	}
+	cryptoProvidersMutex.RLock()
+	for _, suite := range cryptoProviderSuites {
+		if suite != CIPHER_SUITE_AES_GCM && suite != CIPHER_SUITE_CHACHA20_POLY1305 {
+			suites = append(suites, suite)
+		}
+	}
+	cryptoProvidersMutex.RUnlock()
+	return suites
+}
+
+// NegotiateCipherSuite picks the first of offered that is also in accepted,
+// all supported suites are accepted if accepted is empty. The legacy stream
+// cipher is returned if nothing matches
+func NegotiateCipherSuite(offered, accepted []string) string {
+	if len(accepted) < 1 {
+		accepted = SupportedCipherSuites()
+	}
+	for _, o := range offered {
+		if !isAEADSuite(o) {
+			continue
+		}
+		for _, a := range accepted {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return CIPHER_SUITE_AES_CFB
+}
+
+func isAEADSuite(suite string) bool {
+	return getCryptoProvider(suite) != nil
+}
+
 type Crypto struct {
-	key     cipher.PubKey
-	secKey  cipher.SecKey
+	keys    KeyProvider
 	target  cipher.PubKey
 	block   atomic.Value
 	es      cipher2.Stream
 	esMutex sync.Mutex
 	ds      cipher2.Stream
 	dsMutex sync.Mutex
+
+	suite    string
+	provider CryptoProvider
+	seal     cipher2.AEAD
+	open     cipher2.AEAD
+	dir      byte
+	sealed   uint64
+	opened   uint64
+
+	window      ReplayWindow
+	windowMutex sync.Mutex
+	replays     uint64
 }
 
 func NewCrypto(key cipher.PubKey, secKey cipher.SecKey) *Crypto {
 	return &Crypto{
-		key:    key,
-		secKey: secKey,
+		keys:  NewSecKeyProvider(key, secKey),
+		suite: CIPHER_SUITE_AES_CFB,
+	}
+}
+
+// NewCryptoWithSuite returns a Crypto for one of the cipher suites,
+// an empty suite is the legacy stream cipher
+func NewCryptoWithSuite(key cipher.PubKey, secKey cipher.SecKey, suite string) (*Crypto, error) {
+	return NewCryptoWithKeyProvider(NewSecKeyProvider(key, secKey), suite)
+}
+
+// NewCryptoWithKeyProvider is NewCryptoWithSuite with the key agreement done by keys
+func NewCryptoWithKeyProvider(keys KeyProvider, suite string) (*Crypto, error) {
+	if len(suite) < 1 {
+		suite = CIPHER_SUITE_AES_CFB
+	}
+	c := &Crypto{keys: keys, suite: suite}
+	if suite != CIPHER_SUITE_AES_CFB {
+		c.provider = getCryptoProvider(suite)
+		if c.provider == nil {
+			return nil, ErrUnknownCipherSuite
+		}
 	}
+	return c, nil
+}
+
+func (c *Crypto) Suite() string {
+	return c.suite
+}
+
+func (c *Crypto) IsAEAD() bool {
+	return c.provider != nil
+}
+
+// Overhead returns how many bytes sealing adds to a udp body
+func (c *Crypto) Overhead() int {
+	if !c.IsAEAD() {
+		return 0
+	}
+	return PACKET_NONCE_SIZE + c.seal.Overhead()
 }
 
 func (c *Crypto) SetTargetKey(target cipher.PubKey) (err error) {
@@ -36,13 +150,26 @@ func (c *Crypto) SetTargetKey(target cipher.PubKey) (err error) {
 		}
 	}()
 	c.target = target
-	ecdh := cipher.ECDH(target, c.secKey)
-	b, err := aes.NewCipher(ecdh)
+	// the provider does the key agreement at Init
+	if c.IsAEAD() {
+		return
+	}
+	secret, err := c.keys.ECDH(target)
+	if err != nil {
+		return
+	}
+	b, err := aes.NewCipher(secret)
+	if err != nil {
+		return
+	}
 	c.block.Store(b)
 	return
 }
 
 func (c *Crypto) Init(iv []byte) (err error) {
+	if c.IsAEAD() {
+		return c.initAEAD(iv)
+	}
 	block := c.block.Load()
 	if block == nil {
 		err = errors.New("call SetTargetKey first")
@@ -58,7 +185,42 @@ func (c *Crypto) Init(iv []byte) (err error) {
 	return
 }
 
+// initAEAD does the handshake of the provider, the lower public key seals with
+// direction 0 so the two sides never share a nonce
+func (c *Crypto) initAEAD(iv []byte) (err error) {
+	if c.target == (cipher.PubKey{}) {
+		return errors.New("call SetTargetKey first")
+	}
+	seal, open, err := c.provider.Handshake(c.keys, c.target, iv)
+	if err != nil {
+		return
+	}
+	if seal.NonceSize() < 9 || open.NonceSize() < 9 {
+		return fmt.Errorf("nonce of suite %s too short", c.suite)
+	}
+	if key := c.keys.PubKey(); string(key[:]) > string(c.target[:]) {
+		c.dir = 1
+	}
+	c.esMutex.Lock()
+	c.dsMutex.Lock()
+	c.seal = seal
+	c.open = open
+	c.dsMutex.Unlock()
+	c.esMutex.Unlock()
+	return
+}
+
+func nonce(aead cipher2.AEAD, dir byte, counter uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	n[0] = dir
+	binary.BigEndian.PutUint64(n[len(n)-8:], counter)
+	return n
+}
+
 func (c *Crypto) Encrypt(data []byte) (err error) {
+	if c.IsAEAD() {
+		return ErrNotAEAD
+	}
 	block := c.block.Load()
 	if block == nil {
 		err = errors.New("call SetTargetKey first")
@@ -72,6 +234,9 @@ func (c *Crypto) Encrypt(data []byte) (err error) {
 }
 
 func (c *Crypto) Decrypt(data []byte) (err error) {
+	if c.IsAEAD() {
+		return ErrNotAEAD
+	}
 	block := c.block.Load()
 	if block == nil {
 		err = errors.New("call SetTargetKey first")
@@ -84,6 +249,183 @@ func (c *Crypto) Decrypt(data []byte) (err error) {
 	return
 }
 
+// SealRecord appends a tcp record of plain to dst, the nonce is the count of
+// records sealed before so records must be written in the order they were sealed
+func (c *Crypto) SealRecord(dst, plain []byte) (result []byte, err error) {
+	c.esMutex.Lock()
+	defer c.esMutex.Unlock()
+	if c.seal == nil {
+		err = ErrNotAEAD
+		return
+	}
+	l := len(plain) + c.seal.Overhead()
+	if l > MAX_RECORD_SIZE {
+		err = NewError(ErrTooLarge, fmt.Sprintf("record too large %d", l))
+		return
+	}
+	var h [RECORD_HEADER_SIZE]byte
+	binary.BigEndian.PutUint16(h[:], uint16(l))
+	result = append(dst, h[:]...)
+	result = c.seal.Seal(result, nonce(c.seal, c.dir, c.sealed), plain, nil)
+	c.sealed++
+	return
+}
+
+// OpenRecord opens the sealed part of a tcp record
+func (c *Crypto) OpenRecord(sealed []byte) (plain []byte, err error) {
+	c.dsMutex.Lock()
+	defer c.dsMutex.Unlock()
+	if c.open == nil {
+		err = ErrNotAEAD
+		return
+	}
+	plain, err = c.open.Open(sealed[:0], nonce(c.open, c.dir^1, c.opened), sealed, nil)
+	if err != nil {
+		err = Wrap(ErrUnauthorized, err)
+		return
+	}
+	c.opened++
+	return
+}
+
+// SealPacket returns [nonce][sealed plain], the nonce is sent with the body
+// because udp packets arrive out of order
+func (c *Crypto) SealPacket(plain []byte) (result []byte, err error) {
+	c.esMutex.Lock()
+	seal := c.seal
+	if seal == nil {
+		c.esMutex.Unlock()
+		err = ErrNotAEAD
+		return
+	}
+	counter := c.sealed
+	c.sealed++
+	c.esMutex.Unlock()
+
+	result = make([]byte, PACKET_NONCE_SIZE, PACKET_NONCE_SIZE+len(plain)+seal.Overhead())
+	binary.BigEndian.PutUint64(result, counter)
+	result = seal.Seal(result, nonce(seal, c.dir, counter), plain, nil)
+	return
+}
+
+// OpenPacket opens a body sealed by SealPacket, ErrReplayed is returned
+// if a packet with the same nonce was opened before
+func (c *Crypto) OpenPacket(b []byte) (plain []byte, err error) {
+	c.dsMutex.Lock()
+	open := c.open
+	c.dsMutex.Unlock()
+	if open == nil {
+		err = ErrNotAEAD
+		return
+	}
+	if len(b) < PACKET_NONCE_SIZE+open.Overhead() {
+		err = fmt.Errorf("invalid sealed packet %x", b)
+		return
+	}
+	counter := binary.BigEndian.Uint64(b)
+	plain, err = open.Open(nil, nonce(open, c.dir^1, counter), b[PACKET_NONCE_SIZE:], nil)
+	if err != nil {
+		err = Wrap(ErrUnauthorized, err)
+		return
+	}
+	// only authentic nonces may move the window
+	c.windowMutex.Lock()
+	ok := c.window.Accept(counter)
+	c.windowMutex.Unlock()
+	if !ok {
+		atomic.AddUint64(&c.replays, 1)
+		plain = nil
+		err = ErrReplayed
+	}
+	return
+}
+
+// SealDatagram seals a body that may be lost, SealPacket with an aead suite.
+// The stream cipher can not skip lost bytes, so its datagrams are encrypted
+// with aes-ctr of a random iv sent in front
+func (c *Crypto) SealDatagram(plain []byte) (result []byte, err error) {
+	if c.IsAEAD() {
+		return c.SealPacket(plain)
+	}
+	block := c.block.Load()
+	if block == nil {
+		err = errors.New("call SetTargetKey first")
+		return
+	}
+	result = make([]byte, aes.BlockSize+len(plain))
+	_, err = io.ReadFull(rand.Reader, result[:aes.BlockSize])
+	if err != nil {
+		return
+	}
+	cipher2.NewCTR(block.(cipher2.Block), result[:aes.BlockSize]).XORKeyStream(result[aes.BlockSize:], plain)
+	return
+}
+
+// OpenDatagram opens a body of SealDatagram
+func (c *Crypto) OpenDatagram(b []byte) (plain []byte, err error) {
+	if c.IsAEAD() {
+		return c.OpenPacket(b)
+	}
+	block := c.block.Load()
+	if block == nil {
+		err = errors.New("call SetTargetKey first")
+		return
+	}
+	if len(b) < aes.BlockSize {
+		err = fmt.Errorf("invalid datagram %x", b)
+		return
+	}
+	plain = make([]byte, len(b)-aes.BlockSize)
+	cipher2.NewCTR(block.(cipher2.Block), b[:aes.BlockSize]).XORKeyStream(plain, b[aes.BlockSize:])
+	return
+}
+
+// GetReplayCount returns how many packets were rejected by the replay window
+func (c *Crypto) GetReplayCount() uint64 {
+	return atomic.LoadUint64(&c.replays)
+}
+
+// ReplayWindow remembers the last REPLAY_WINDOW_SIZE nonces up to top, it is
+// not safe for concurrent use
+type ReplayWindow struct {
+	top  uint64
+	init bool
+	bits [REPLAY_WINDOW_SIZE / 64]uint64
+}
+
+func (w *ReplayWindow) bit(n uint64) (i int, mask uint64) {
+	n %= REPLAY_WINDOW_SIZE
+	return int(n / 64), 1 << (n % 64)
+}
+
+// Accept marks n as seen, false if it was seen already or is out of the window
+func (w *ReplayWindow) Accept(n uint64) bool {
+	if !w.init || n > w.top {
+		if !w.init || n-w.top >= REPLAY_WINDOW_SIZE {
+			w.bits = [REPLAY_WINDOW_SIZE / 64]uint64{}
+		} else {
+			for i := w.top + 1; i < n; i++ {
+				j, m := w.bit(i)
+				w.bits[j] &^= m
+			}
+		}
+		w.init = true
+		w.top = n
+		j, m := w.bit(n)
+		w.bits[j] |= m
+		return true
+	}
+	if w.top-n >= REPLAY_WINDOW_SIZE {
+		return false
+	}
+	j, m := w.bit(n)
+	if w.bits[j]&m > 0 {
+		return false
+	}
+	w.bits[j] |= m
+	return true
+}
+
 type CryptoGetter interface {
 	GetCrypto() *Crypto
 }
@@ -91,6 +433,12 @@ type CryptoGetter interface {
 type CryptoReader struct {
 	rd io.Reader
 	cg CryptoGetter
+
+	// read before the aead crypto was set
+	raw []byte
+	// opened record not read yet
+	plain  []byte
+	record []byte
 }
 
 func NewCryptoReader(rd io.Reader, getter CryptoGetter) *CryptoReader {
@@ -101,14 +449,59 @@ func NewCryptoReader(rd io.Reader, getter CryptoGetter) *CryptoReader {
 }
 
 func (cr *CryptoReader) Read(p []byte) (n int, err error) {
-	n, err = cr.rd.Read(p)
-	if err != nil || n == 0 {
+	if len(cr.plain) == 0 {
+		crypto := cr.cg.GetCrypto()
+		if crypto == nil || !crypto.IsAEAD() {
+			n, err = cr.rd.Read(p)
+			if err != nil || n == 0 {
+				return
+			}
+			// crypto may be set while blocked in Read
+			crypto = cr.cg.GetCrypto()
+			if crypto == nil {
+				return
+			}
+			if !crypto.IsAEAD() {
+				err = crypto.Decrypt(p[:n])
+				return
+			}
+			cr.raw = append(cr.raw, p[:n]...)
+			n = 0
+		}
+		err = cr.readRecord(crypto)
+		if err != nil {
+			return
+		}
+	}
+	n = copy(p, cr.plain)
+	cr.plain = cr.plain[n:]
+	return
+}
+
+func (cr *CryptoReader) readFull(buf []byte) (err error) {
+	n := copy(buf, cr.raw)
+	cr.raw = cr.raw[n:]
+	if n < len(buf) {
+		_, err = io.ReadFull(cr.rd, buf[n:])
+	}
+	return
+}
+
+func (cr *CryptoReader) readRecord(crypto *Crypto) (err error) {
+	var h [RECORD_HEADER_SIZE]byte
+	err = cr.readFull(h[:])
+	if err != nil {
 		return
 	}
-	crypto := cr.cg.GetCrypto()
-	if crypto == nil {
+	l := int(binary.BigEndian.Uint16(h[:]))
+	if cap(cr.record) < l {
+		cr.record = make([]byte, l)
+	}
+	cr.record = cr.record[:l]
+	err = cr.readFull(cr.record)
+	if err != nil {
 		return
 	}
-	err = crypto.Decrypt(p[:n])
+	cr.plain, err = crypto.OpenRecord(cr.record)
 	return
 }
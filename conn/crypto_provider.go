@@ -0,0 +1,82 @@
+package conn
+
+import (
+	"crypto/aes"
+	cipher2 "crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CryptoProvider does the handshake of an aead cipher suite, so a deployment can
+// plug in its own key agreement and aead (Noise, TLS exporter keys, keys that
+// never leave a hardware token) without touching the connections.
+// The connections seal tcp records and udp packets with the returned aeads,
+// the nonces are counters and the lower public key seals with the direction 0
+type CryptoProvider interface {
+	// Handshake returns the aeads that seal the messages to target and open the
+	// messages from target. iv is random for every connection and known to both
+	// sides, keys may be backed by hardware, see KeyProvider
+	Handshake(keys KeyProvider, target cipher.PubKey, iv []byte) (seal, open cipher2.AEAD, err error)
+}
+
+var (
+	cryptoProviders      = make(map[string]CryptoProvider)
+	cryptoProviderSuites []string
+	cryptoProvidersMutex sync.RWMutex
+)
+
+func init() {
+	RegisterCryptoProvider(CIPHER_SUITE_AES_GCM, ecdhProvider{newAEAD: func(key []byte) (cipher2.AEAD, error) {
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher2.NewGCM(b)
+	}})
+	RegisterCryptoProvider(CIPHER_SUITE_CHACHA20_POLY1305, ecdhProvider{newAEAD: chacha20poly1305.New})
+}
+
+// RegisterCryptoProvider makes a cipher suite available to NewCryptoWithSuite and
+// the negotiation at reg. Like sql.Register it panics if the suite is registered twice
+func RegisterCryptoProvider(suite string, p CryptoProvider) {
+	if p == nil {
+		panic("conn: RegisterCryptoProvider provider is nil")
+	}
+	cryptoProvidersMutex.Lock()
+	defer cryptoProvidersMutex.Unlock()
+	if _, ok := cryptoProviders[suite]; ok || suite == CIPHER_SUITE_AES_CFB {
+		panic(fmt.Sprintf("conn: RegisterCryptoProvider called twice for suite %s", suite))
+	}
+	cryptoProviders[suite] = p
+	cryptoProviderSuites = append(cryptoProviderSuites, suite)
+}
+
+func getCryptoProvider(suite string) CryptoProvider {
+	cryptoProvidersMutex.RLock()
+	p := cryptoProviders[suite]
+	cryptoProvidersMutex.RUnlock()
+	return p
+}
+
+// ecdhProvider is the handshake of the built-in suites, the key of the aead is
+// the sha256 of the ecdh secret and the iv
+type ecdhProvider struct {
+	newAEAD func(key []byte) (cipher2.AEAD, error)
+}
+
+func (p ecdhProvider) Handshake(keys KeyProvider, target cipher.PubKey, iv []byte) (seal, open cipher2.AEAD, err error) {
+	secret, err := keys.ECDH(target)
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(iv)
+	seal, err = p.newAEAD(h.Sum(nil))
+	open = seal
+	return
+}
@@ -0,0 +1,204 @@
+package conn
+
+import (
+	"bytes"
+	cipher2 "crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := &ReplayWindow{}
+	for _, n := range []uint64{5, 3, 4, 10, 1} {
+		if !w.Accept(n) {
+			t.Fatalf("%d rejected", n)
+		}
+	}
+	for _, n := range []uint64{5, 3, 10, 1} {
+		if w.Accept(n) {
+			t.Fatalf("%d replayed", n)
+		}
+	}
+	if !w.Accept(10 + REPLAY_WINDOW_SIZE) {
+		t.Fatal("new top rejected")
+	}
+	if w.Accept(10) {
+		t.Fatal("out of window accepted")
+	}
+	if !w.Accept(11) {
+		t.Fatal("11 rejected")
+	}
+	if !w.Accept(10 + 3*REPLAY_WINDOW_SIZE) {
+		t.Fatal("jump rejected")
+	}
+}
+
+func TestOpenPacketReplay(t *testing.T) {
+	ak, as := cipher.GenerateKeyPair()
+	bk, bs := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(16)
+	for _, suite := range SupportedCipherSuites() {
+		a, err := NewCryptoWithSuite(ak, as, suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := NewCryptoWithSuite(bk, bs, suite)
+		if err = a.SetTargetKey(bk); err != nil {
+			t.Fatal(err)
+		}
+		b.SetTargetKey(ak)
+		a.Init(iv)
+		b.Init(iv)
+
+		p1, _ := a.SealPacket([]byte("first"))
+		p2, _ := a.SealPacket([]byte("second"))
+		for _, p := range [][]byte{p2, p1} {
+			c := append([]byte{}, p...)
+			if _, err = b.OpenPacket(c); err != nil {
+				t.Fatal(suite, err)
+			}
+		}
+		plain, err := b.OpenPacket(append([]byte{}, p1...))
+		if err != ErrReplayed || plain != nil {
+			t.Fatalf("%s replay opened %s %v", suite, plain, err)
+		}
+		if b.GetReplayCount() != 1 {
+			t.Fatalf("replays %d", b.GetReplayCount())
+		}
+		// a's own packets must not open with its own receive nonce
+		if _, err = a.OpenPacket(append([]byte{}, p1...)); err == nil {
+			t.Fatal("reflected packet opened")
+		}
+	}
+}
+
+// pskProvider keys each direction by a pre-shared key and the sender,
+// the secret keys are not used
+type pskProvider []byte
+
+func (p pskProvider) aead(from cipher.PubKey, iv []byte) cipher2.AEAD {
+	h := sha256.New()
+	h.Write(p)
+	h.Write(from[:])
+	h.Write(iv)
+	aead, _ := chacha20poly1305.New(h.Sum(nil))
+	return aead
+}
+
+func (p pskProvider) Handshake(keys KeyProvider, target cipher.PubKey, iv []byte) (seal, open cipher2.AEAD, err error) {
+	return p.aead(keys.PubKey(), iv), p.aead(target, iv), nil
+}
+
+func init() {
+	RegisterCryptoProvider("test-psk", pskProvider("secret"))
+}
+
+func TestCryptoProvider(t *testing.T) {
+	if s := NegotiateCipherSuite([]string{"test-psk"}, []string{CIPHER_SUITE_AES_GCM, "test-psk"}); s != "test-psk" {
+		t.Fatalf("negotiated %s", s)
+	}
+	ak, _ := cipher.GenerateKeyPair()
+	bk, _ := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(16)
+	a, err := NewCryptoWithSuite(ak, cipher.SecKey{}, "test-psk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewCryptoWithSuite(bk, cipher.SecKey{}, "test-psk")
+	a.SetTargetKey(bk)
+	b.SetTargetKey(ak)
+	if err = a.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	b.Init(iv)
+	if !a.IsAEAD() {
+		t.Fatal("not aead")
+	}
+
+	r, err := a.SealRecord(nil, []byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := b.OpenRecord(r[RECORD_HEADER_SIZE:])
+	if err != nil || string(plain) != "record" {
+		t.Fatalf("record %s %v", plain, err)
+	}
+	p, _ := b.SealPacket([]byte("packet"))
+	if plain, err = a.OpenPacket(p); err != nil || string(plain) != "packet" {
+		t.Fatalf("packet %s %v", plain, err)
+	}
+}
+
+func TestNegotiateCipherSuite(t *testing.T) {
+	for _, c := range []struct {
+		offered, accepted []string
+		suite             string
+	}{
+		{[]string{CIPHER_SUITE_AES_GCM, CIPHER_SUITE_CHACHA20_POLY1305}, []string{CIPHER_SUITE_CHACHA20_POLY1305, CIPHER_SUITE_AES_GCM}, CIPHER_SUITE_AES_GCM},
+		{[]string{CIPHER_SUITE_AES_GCM, CIPHER_SUITE_CHACHA20_POLY1305}, []string{CIPHER_SUITE_CHACHA20_POLY1305}, CIPHER_SUITE_CHACHA20_POLY1305},
+		{[]string{CIPHER_SUITE_CHACHA20_POLY1305}, nil, CIPHER_SUITE_CHACHA20_POLY1305},
+		{[]string{CIPHER_SUITE_AES_CFB, CIPHER_SUITE_AES_GCM}, nil, CIPHER_SUITE_AES_GCM},
+		{[]string{"unknown"}, []string{"unknown"}, CIPHER_SUITE_AES_CFB},
+		{[]string{CIPHER_SUITE_AES_GCM}, []string{CIPHER_SUITE_CHACHA20_POLY1305}, CIPHER_SUITE_AES_CFB},
+		{nil, nil, CIPHER_SUITE_AES_CFB},
+	} {
+		if suite := NegotiateCipherSuite(c.offered, c.accepted); suite != c.suite {
+			t.Fatalf("offered %v accepted %v: %s, want %s", c.offered, c.accepted, suite, c.suite)
+		}
+	}
+}
+
+type cryptoGetter struct {
+	crypto *Crypto
+}
+
+func (g cryptoGetter) GetCrypto() *Crypto {
+	return g.crypto
+}
+
+func TestCryptoReaderRecords(t *testing.T) {
+	ak, as := cipher.GenerateKeyPair()
+	bk, bs := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(16)
+	for _, suite := range SupportedCipherSuites() {
+		pair := func() (a, b *Crypto) {
+			a, err := NewCryptoWithSuite(ak, as, suite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ = NewCryptoWithSuite(bk, bs, suite)
+			if err = a.SetTargetKey(bk); err != nil {
+				t.Fatal(err)
+			}
+			b.SetTargetKey(ak)
+			a.Init(iv)
+			b.Init(iv)
+			return
+		}
+		a, b := pair()
+		stream, err := a.SealRecord(nil, []byte("hello "))
+		if err != nil {
+			t.Fatal(suite, err)
+		}
+		if stream, err = a.SealRecord(stream, []byte("world")); err != nil {
+			t.Fatal(suite, err)
+		}
+		plain, err := ioutil.ReadAll(NewCryptoReader(bytes.NewReader(stream), cryptoGetter{b}))
+		if err != nil || string(plain) != "hello world" {
+			t.Fatalf("%s read %q err %v", suite, plain, err)
+		}
+
+		a, b = pair()
+		stream, _ = a.SealRecord(nil, []byte("hello"))
+		stream[len(stream)-1] ^= 1
+		_, err = ioutil.ReadAll(NewCryptoReader(bytes.NewReader(stream), cryptoGetter{b}))
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("%s tampered record err %v", suite, err)
+		}
+	}
+}
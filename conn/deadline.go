@@ -0,0 +1,114 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ErrTimeout is returned by Read and writes after the deadline passed
+var ErrTimeout net.Error = timeoutError{}
+
+// deadlines of a connection, the zero time means none
+type deadlines struct {
+	read  time.Time
+	write time.Time
+	// closed and replaced whenever the read deadline changes so a blocked Read sees it
+	changed chan struct{}
+	sync.Mutex
+}
+
+func (c *ConnCommonFields) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline bounds Read and ReadChan, also the ones already blocked
+func (c *ConnCommonFields) SetReadDeadline(t time.Time) error {
+	c.deadlines.Lock()
+	c.deadlines.read = t
+	if c.deadlines.changed != nil {
+		close(c.deadlines.changed)
+		c.deadlines.changed = nil
+	}
+	c.deadlines.Unlock()
+	return nil
+}
+
+func (c *ConnCommonFields) SetWriteDeadline(t time.Time) error {
+	c.deadlines.Lock()
+	c.deadlines.write = t
+	c.deadlines.Unlock()
+	return nil
+}
+
+func (c *ConnCommonFields) GetReadDeadline() (t time.Time) {
+	c.deadlines.Lock()
+	t = c.deadlines.read
+	c.deadlines.Unlock()
+	return
+}
+
+func (c *ConnCommonFields) GetWriteDeadline() (t time.Time) {
+	c.deadlines.Lock()
+	t = c.deadlines.write
+	c.deadlines.Unlock()
+	return
+}
+
+func (c *ConnCommonFields) writeDeadlineExceeded() bool {
+	t := c.GetWriteDeadline()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// Read returns the next message of GetChanIn, io.EOF after the connection was closed
+func (c *ConnCommonFields) Read() ([]byte, error) {
+	return c.ReadChan(c.In)
+}
+
+// ReadChan is Read for wrappers delivering messages on their own channel
+func (c *ConnCommonFields) ReadChan(ch <-chan []byte) ([]byte, error) {
+	for {
+		c.deadlines.Lock()
+		d := c.deadlines.read
+		if c.deadlines.changed == nil {
+			c.deadlines.changed = make(chan struct{})
+		}
+		changed := c.deadlines.changed
+		c.deadlines.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !d.IsZero() {
+			wait := time.Until(d)
+			if wait <= 0 {
+				return nil, ErrTimeout
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case m, ok := <-ch:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				return nil, io.EOF
+			}
+			return m, nil
+		case <-timeout:
+			return nil, ErrTimeout
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package conn
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadDeadline(t *testing.T) {
+	c := NewConnCommonFileds()
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.Read(); err != ErrTimeout {
+		t.Fatalf("err %v", err)
+	}
+
+	c.In <- []byte("a")
+	c.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Read(); err != ErrTimeout {
+		t.Fatalf("past deadline err %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	m, err := c.Read()
+	if err != nil || string(m) != "a" {
+		t.Fatalf("read %s %v", m, err)
+	}
+
+	// extending the deadline wakes a blocked Read
+	done := make(chan error)
+	c.SetReadDeadline(time.Now().Add(time.Hour))
+	go func() {
+		_, err := c.Read()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.SetReadDeadline(time.Now())
+	select {
+	case err = <-done:
+		if err != ErrTimeout {
+			t.Fatalf("err %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Read did not see the new deadline")
+	}
+
+	c.SetReadDeadline(time.Time{})
+	c.Close()
+	if _, err = c.Read(); err != io.EOF {
+		t.Fatalf("closed err %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package conn
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DropReason is why a received message never reached the reader
+type DropReason int
+
+const (
+	// GetChanIn was full, see OverflowPolicy
+	DROP_OVERFLOW DropReason = iota + 1
+	// larger than the max message size or than it may decompress to
+	DROP_TOO_LARGE
+	// the connection closed before the message was queued
+	DROP_CLOSED
+	// an unreliable message over the rate limit, late or not decryptable
+	DROP_UNRELIABLE
+	// a udp packet seen before, see Crypto.OpenPacket
+	DROP_REPLAYED
+	// the server knows no node of the key a message is relayed to
+	DROP_NO_ROUTE
+
+	DROP_REASON_SIZE
+)
+
+var dropReasonNames = map[DropReason]string{
+	DROP_OVERFLOW:   "overflow",
+	DROP_TOO_LARGE:  "too_large",
+	DROP_CLOSED:     "closed",
+	DROP_UNRELIABLE: "unreliable",
+	DROP_REPLAYED:   "replayed",
+	DROP_NO_ROUTE:   "no_route",
+}
+
+func (r DropReason) String() string {
+	if name, ok := dropReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (r DropReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// records kept by DropStats
+const DROP_RECORDS_KEPT = 100
+
+// DropRecord is a dropped message
+type DropRecord struct {
+	Time   time.Time
+	Reason DropReason
+	// of the message body, of its header for DROP_TOO_LARGE
+	Size int
+	// remote address of the connection
+	Peer string `json:",omitempty"`
+	// first byte of the body, the op of messenger messages
+	Op byte
+}
+
+// DropStats counts the dropped messages of the process by reason and keeps
+// the last DROP_RECORDS_KEPT of them, oldest first
+type DropStats struct {
+	Total   uint64
+	Counts  map[string]uint64
+	Records []DropRecord
+}
+
+type dropLog struct {
+	counts  [DROP_REASON_SIZE]uint64
+	records [DROP_RECORDS_KEPT]DropRecord
+	next    int
+	full    bool
+	sync.Mutex
+}
+
+var drops dropLog
+
+func (l *dropLog) add(r DropRecord) {
+	if r.Reason <= 0 || r.Reason >= DROP_REASON_SIZE {
+		return
+	}
+	atomic.AddUint64(&l.counts[r.Reason], 1)
+	l.Lock()
+	l.records[l.next] = r
+	l.next++
+	if l.next == len(l.records) {
+		l.next = 0
+		l.full = true
+	}
+	l.Unlock()
+}
+
+// RecordDrop adds a message dropped above the connections to the DropStats,
+// body is the message as read from the connection
+func RecordDrop(reason DropReason, peer net.Addr, body []byte) {
+	r := DropRecord{Time: time.Now(), Reason: reason, Size: len(body)}
+	if peer != nil {
+		r.Peer = peer.String()
+	}
+	if len(body) > 0 {
+		r.Op = body[0]
+	}
+	drops.add(r)
+}
+
+// GetDropStats returns the messages dropped by all connections
+func GetDropStats() DropStats {
+	s := DropStats{Counts: make(map[string]uint64)}
+	for r := DropReason(1); r < DROP_REASON_SIZE; r++ {
+		n := atomic.LoadUint64(&drops.counts[r])
+		s.Total += n
+		s.Counts[r.String()] = n
+	}
+	drops.Lock()
+	if drops.full {
+		s.Records = append(s.Records, drops.records[drops.next:]...)
+	}
+	s.Records = append(s.Records, drops.records[:drops.next]...)
+	drops.Unlock()
+	return s
+}
+
+// SetPeerAddr sets the remote address the drops of the connection are
+// recorded with
+func (c *ConnCommonFields) SetPeerAddr(addr net.Addr) {
+	if addr != nil {
+		c.peerAddr.Store(addr.String())
+	}
+}
+
+// drop counts a message the connection dropped and records it
+func (c *ConnCommonFields) drop(reason DropReason, size int, op byte) {
+	r := DropRecord{Time: time.Now(), Reason: reason, Size: size, Op: op}
+	if peer, ok := c.peerAddr.Load().(string); ok {
+		r.Peer = peer
+	}
+	drops.add(r)
+}
+
+func (c *ConnCommonFields) dropMessage(reason DropReason, m []byte) {
+	var op byte
+	if len(m) > 0 {
+		op = m[0]
+	}
+	c.drop(reason, len(m), op)
+}
@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDropStats(t *testing.T) {
+	before := GetDropStats()
+	f := NewConnCommonFileds()
+	f.SetPeerAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000})
+	f.SetChannelOptions(ChannelOptions{InSize: 1, Policy: OVERFLOW_DROP_NEWEST})
+	for i := byte(0); i < 3; i++ {
+		if err := f.PushIn([]byte{i, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if err := f.PushIn([]byte{9}); err != ErrConnClosed {
+		t.Fatalf("push after close err %v", err)
+	}
+
+	s := GetDropStats()
+	if s.Total-before.Total != 3 || s.Counts["overflow"]-before.Counts["overflow"] != 2 || s.Counts["closed"]-before.Counts["closed"] != 1 {
+		t.Fatalf("counts %v before %v", s.Counts, before.Counts)
+	}
+	last := s.Records[len(s.Records)-3:]
+	if last[0].Reason != DROP_OVERFLOW || last[0].Op != 1 || last[0].Size != 3 || last[0].Peer != "127.0.0.1:8000" {
+		t.Fatalf("record %+v", last[0])
+	}
+	if last[2].Reason != DROP_CLOSED || last[2].Op != 9 {
+		t.Fatalf("record %+v", last[2])
+	}
+
+	for i := 0; i < DROP_RECORDS_KEPT; i++ {
+		RecordDrop(DROP_NO_ROUTE, nil, nil)
+	}
+	if s = GetDropStats(); len(s.Records) != DROP_RECORDS_KEPT || s.Records[len(s.Records)-1].Reason != DROP_NO_ROUTE {
+		t.Fatalf("%d records kept", len(s.Records))
+	}
+}
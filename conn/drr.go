@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"github.com/skycoin/net/msg"
+)
+
+// DRR_QUANTUM is the bytes a pending channel of weight 1 may send per round,
+// one full udp package so every channel sends at least one message a round
+const DRR_QUANTUM = MAX_UDP_PACKAGE_SIZE + msg.PKG_HEADER_SIZE + msg.MSG_HEADER_SIZE + 64
+
+// popChannelMessage picks the next message of the pending channels by deficit
+// round robin, so a bulk channel can not starve the others and each channel
+// gets a share of the bandwidth by its weight. bifMtx must be held
+func (ca *ca) popChannelMessage() (m *msg.UDPMessage) {
+	for idle := 0; idle < len(ca.bifPdOrder); {
+		if ca.drrPos >= len(ca.bifPdOrder) {
+			ca.drrPos = 0
+		}
+		v := ca.bifPdChans[ca.bifPdOrder[ca.drrPos]]
+		v.mtx.Lock()
+		m = v.head()
+		if m == nil {
+			v.deficit = 0
+			v.mtx.Unlock()
+			ca.drrNext()
+			idle++
+			continue
+		}
+		idle = 0
+		if !ca.drrCharged {
+			v.deficit += v.weight * DRR_QUANTUM
+			ca.drrCharged = true
+		}
+		size := m.PkgBytesLen()
+		if v.deficit < size {
+			m = nil
+			v.mtx.Unlock()
+			ca.drrNext()
+			continue
+		}
+		v.deficit -= size
+		v.pd.DeleteMin()
+		v.mtx.Unlock()
+		v.cond.Broadcast()
+		return
+	}
+	return nil
+}
+
+func (ca *ca) drrNext() {
+	ca.drrPos++
+	ca.drrCharged = false
+}
+
+// head drops acked messages and returns the first one, v.mtx must be held
+func (v *pdChan) head() *msg.UDPMessage {
+	for {
+		element := v.pd.Min()
+		if element == nil {
+			return nil
+		}
+		m := element.(*msg.UDPMessage)
+		if !m.IsAcked() {
+			return m
+		}
+		v.pd.DeleteMin()
+	}
+}
+
+// removeFromOrder keeps the round robin position on the same channel, bifMtx must be held
+func (ca *ca) removeFromOrder(channel int) {
+	for i, id := range ca.bifPdOrder {
+		if id != channel {
+			continue
+		}
+		ca.bifPdOrder = append(ca.bifPdOrder[:i], ca.bifPdOrder[i+1:]...)
+		if i < ca.drrPos {
+			ca.drrPos--
+		} else if i == ca.drrPos {
+			ca.drrCharged = false
+		}
+		return
+	}
+}
+
+func (ca *ca) setPendingChannelWeight(channel, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	ca.bifMtx.RLock()
+	ch, ok := ca.bifPdChans[channel]
+	ca.bifMtx.RUnlock()
+	if !ok {
+		return
+	}
+	ch.mtx.Lock()
+	ch.weight = weight
+	ch.mtx.Unlock()
+}
+
+// SetPendingChannelWeight sets the share of the channel against the other
+// pending channels of the connection, 1 by default
+func (c *UDPConn) SetPendingChannelWeight(channel, weight int) {
+	c.ca.setPendingChannelWeight(channel, weight)
+}
@@ -0,0 +1,47 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestPopChannelMessageWeights(t *testing.T) {
+	ca := newCA()
+	bulk := ca.newPendingChannel()
+	interactive := ca.newPendingChannel()
+	ca.setPendingChannelWeight(interactive, 3)
+	body := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		ca.addToPendingChannel(bulk, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, body))
+		ca.addToPendingChannel(interactive, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, body))
+	}
+	counts := make(map[int]int)
+	ca.bifMtx.Lock()
+	for i := 0; i < 80; i++ {
+		m := ca.popChannelMessage()
+		if m == nil {
+			t.Fatalf("no message at %d", i)
+		}
+		counts[m.GetChannel()]++
+	}
+	ca.bifMtx.Unlock()
+	if counts[bulk] < 15 || counts[bulk] > 25 || counts[interactive] < 55 {
+		t.Fatalf("bulk %d interactive %d", counts[bulk], counts[interactive])
+	}
+
+	// an empty channel does not block the others and gets no credit
+	ca.bifMtx.Lock()
+	for ca.popChannelMessage() != nil {
+	}
+	ca.bifMtx.Unlock()
+	ca.addToPendingChannel(bulk, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, body))
+	ca.bifMtx.Lock()
+	defer ca.bifMtx.Unlock()
+	if m := ca.popChannelMessage(); m == nil || m.GetChannel() != bulk {
+		t.Fatal("bulk message not popped")
+	}
+	if ca.bifPdChans[interactive].deficit != 0 {
+		t.Fatal("empty channel kept its deficit")
+	}
+}
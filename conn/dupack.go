@@ -0,0 +1,86 @@
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+// acks with the same next seq that resend it before its rto, see RFC 5681
+const DUP_ACK_THRESHOLD = 3
+
+// dupAcks counts the acks of the sender which did not move the next seq of
+// the peer while it got packets after it
+type dupAcks struct {
+	next  uint32
+	count int
+	// no other fast retransmit until the next seq passes the highest seq
+	// sent at the last one
+	recover uint32
+	sync.Mutex
+}
+
+// lastAck is the ack sent before, acks are never acked themselves, so an
+// ack only repeats when the packets did not change it
+type lastAck struct {
+	seq    uint32
+	next   uint32
+	window uint32
+	ranges int
+	sent   time.Time
+	sync.Mutex
+}
+
+// recvDupAck resends the next seq of the peer after DUP_ACK_THRESHOLD dup
+// acks, seq is the highest one it got
+func (c *UDPConn) recvDupAck(seq, next uint32) error {
+	d := &c.dupAcks
+	d.Lock()
+	if next != d.next {
+		d.next, d.count = next, 0
+		d.Unlock()
+		return nil
+	}
+	if seq <= next {
+		d.Unlock()
+		return nil
+	}
+	d.count++
+	atomic.AddUint32(&c.dupAckCount, 1)
+	if d.count != DUP_ACK_THRESHOLD || next <= d.recover {
+		d.Unlock()
+		return nil
+	}
+	d.recover = atomic.LoadUint32(&c.seq)
+	d.Unlock()
+
+	v, ok := c.GetMsg(next)
+	if !ok {
+		return nil
+	}
+	m, ok := v.(*msg.UDPMessage)
+	if !ok || m.IsAcked() {
+		return nil
+	}
+	c.GetContextLogger().Debugf("fast retransmit seq %d", next)
+	c.AddLossResendCount()
+	return c.resendMsg(m)
+}
+
+// suppressAck returns true if the ack equals the last one sent less than
+// half a rtt ago, the peer could not have lost it yet
+func (c *UDPConn) suppressAck(seq, next, window uint32, ranges int) bool {
+	l := &c.lastAck
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if l.seq == seq && l.next == next && l.window == window && l.ranges == ranges &&
+		now.Sub(l.sent) < c.GetSRTT()/2 {
+		atomic.AddUint32(&c.suppressedAckCount, 1)
+		return true
+	}
+	l.seq, l.next, l.window, l.ranges, l.sent = seq, next, window, ranges, now
+	return false
+}
@@ -0,0 +1,65 @@
+package conn
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestFastRetransmit(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	c := NewUDPConn(udp, udp.LocalAddr().(*net.UDPAddr))
+	defer c.Close()
+	resends := func() uint32 { return atomic.LoadUint32(&c.lossResendCount) }
+
+	c.addMsg(5, msg.NewUDP(msg.TYPE_NORMAL, 5, []byte("lost")))
+	atomic.StoreUint32(&c.seq, 10)
+	// the first ack of next 5 and one without packets after it are no dup acks
+	for _, seq := range []uint32{7, 5, 8, 9} {
+		c.recvDupAck(seq, 5)
+	}
+	if resends() != 0 {
+		t.Fatal("resend before 3 dup acks")
+	}
+	c.recvDupAck(10, 5)
+	if resends() != 1 {
+		t.Fatal("no fast retransmit")
+	}
+	<-c.pacingChan
+	c.recvDupAck(10, 5)
+	c.recvDupAck(10, 5)
+	if resends() != 1 {
+		t.Fatal("fast retransmit again")
+	}
+
+	// a new loss after the recover seq
+	c.addMsg(11, msg.NewUDP(msg.TYPE_NORMAL, 11, []byte("lost")))
+	atomic.StoreUint32(&c.seq, 12)
+	for i := 0; i < 4; i++ {
+		c.recvDupAck(12, 11)
+	}
+	if resends() != 2 || atomic.LoadUint32(&c.dupAckCount) != 8 {
+		t.Fatalf("resends %d dup acks %d", resends(), c.dupAckCount)
+	}
+}
+
+func TestSuppressAck(t *testing.T) {
+	c := &UDPConn{rto: newRTOEstimator()}
+	if c.suppressAck(1, 2, 3, 0) || c.suppressAck(1, 2, 3, 0) {
+		t.Fatal("suppressed without a rtt")
+	}
+	c.rto.sample(time.Second)
+	if !c.suppressAck(1, 2, 3, 0) {
+		t.Fatal("same ack sent")
+	}
+	if c.suppressAck(1, 2, 4, 0) || c.suppressAck(2, 2, 4, 0) {
+		t.Fatal("new ack suppressed")
+	}
+}
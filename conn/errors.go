@@ -0,0 +1,55 @@
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+// kinds of the errors of conn and the factories, like ErrTimeout they are
+// matched with errors.Is whatever error of the kind was returned
+var (
+	ErrClosed       = errors.New("closed")
+	ErrTooLarge     = errors.New("too large")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+)
+
+// kindError is an error of a kind with its own text, or the text of its cause
+type kindError struct {
+	text  string
+	kind  error
+	cause error
+}
+
+func (e *kindError) Error() string { return e.text }
+
+func (e *kindError) Unwrap() []error {
+	if e.cause == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.cause}
+}
+
+// NewError returns an error with text that errors.Is matches with kind
+func NewError(kind error, text string) error {
+	return &kindError{text: text, kind: kind}
+}
+
+// Wrap returns cause that errors.Is also matches with kind, nil if cause is nil
+func Wrap(kind, cause error) error {
+	if cause == nil || errors.Is(cause, kind) {
+		return cause
+	}
+	return &kindError{text: cause.Error(), kind: kind, cause: cause}
+}
+
+// sockError returns err of the socket with its kind
+func sockError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return Wrap(ErrClosed, err)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return Wrap(ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	for err, kind := range map[error]error{
+		ErrConnClosed:           ErrClosed,
+		ErrConnClosing:          ErrClosed,
+		ErrIdleTimeout:          ErrTimeout,
+		ErrUnreliableTooLarge:   ErrTooLarge,
+		ErrDecompressedTooLarge: ErrTooLarge,
+		ErrReplayed:             ErrUnauthorized,
+	} {
+		if !errors.Is(err, kind) {
+			t.Fatalf("%v is not %v", err, kind)
+		}
+	}
+	if errors.Is(ErrConnClosed, ErrTimeout) {
+		t.Fatal("closed is a timeout")
+	}
+
+	if Wrap(ErrClosed, nil) != nil {
+		t.Fatal("wrapped nil")
+	}
+	err := Wrap(ErrClosed, io.EOF)
+	if !errors.Is(err, ErrClosed) || !errors.Is(err, io.EOF) || err.Error() != io.EOF.Error() {
+		t.Fatalf("wrapped %v", err)
+	}
+	if Wrap(ErrClosed, ErrConnClosed) != ErrConnClosed {
+		t.Fatal("wrapped an error of the kind")
+	}
+}
+
+func TestSocketErrorKind(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := NewUDPConn(c, c.LocalAddr().(*net.UDPAddr))
+	defer uc.Close()
+	c.Close()
+	err = uc.WriteBytes(make([]byte, 8))
+	if !errors.Is(err, ErrClosed) || !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write to a closed socket err %v", err)
+	}
+}
@@ -32,14 +32,18 @@ func TestFec(t *testing.T) {
 
 
 	for i, d := range datas {
+		if d == nil {
+			// lost
+			continue
+		}
 		g, err := decoder.decode(uint32(i+1), d)
 		if err != nil {
 			t.Error(err)
 		}
-		if g != nil && g.Recovered {
-			for i, b := range g.DataRecv {
+		if g != nil && g.recovered {
+			for i, b := range g.dataRecv {
 				if !b {
-					m := g.Datas[i]
+					m := g.datas[i]
 					if len(m) <= msg.MSG_HEADER_SIZE {
 						t.Log("fec recovered len(m) <= msg.MSG_HEADER_SIZE")
 						continue
@@ -0,0 +1,54 @@
+package conn
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ErrConnClosing is returned by writes after StopWrites
+var ErrConnClosing = NewError(ErrClosed, "connection closing")
+
+// how often WaitForAcks looks for unacked messages
+const WAIT_FOR_ACKS_PERIOD = 10 * time.Millisecond
+
+// StopWrites makes new writes fail with ErrConnClosing, messages written
+// before are still sent and resent until acked
+func (c *ConnCommonFields) StopWrites() {
+	atomic.StoreInt32(&c.writesStopped, 1)
+}
+
+func (c *ConnCommonFields) IsClosing() bool {
+	return atomic.LoadInt32(&c.writesStopped) == 1
+}
+
+// waitFor polls done until it is true, ErrTimeout after timeout and
+// ErrConnClosed if the connection closes first
+func (c *ConnCommonFields) waitFor(done func() bool, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(WAIT_FOR_ACKS_PERIOD)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return ErrTimeout
+		case <-c.disconnected:
+			if done() {
+				return nil
+			}
+			return ErrConnClosed
+		}
+	}
+	return nil
+}
+
+// CloseGracefully stops new writes of c, waits up to timeout until the peer
+// acked the messages written before and closes c. ErrTimeout if some were
+// not acked, c is closed anyway
+func CloseGracefully(c Connection, timeout time.Duration) error {
+	c.StopWrites()
+	err := c.WaitForAcks(timeout)
+	c.Close()
+	return err
+}
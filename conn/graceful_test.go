@@ -0,0 +1,55 @@
+package conn
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newPipeTCPConn(c net.Conn) *TCPConn {
+	return &TCPConn{TcpConn: c, ConnCommonFields: NewConnCommonFileds(), PendingMap: NewPendingMap()}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	a, b := net.Pipe()
+	c1, c2 := newPipeTCPConn(a), newPipeTCPConn(b)
+	defer c2.Close()
+	go c1.ReadLoop()
+	// acks after a while
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c2.ReadLoop()
+	}()
+	for i := 0; i < 3; i++ {
+		go func() {
+			if err := c1.Write([]byte("a")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for c1.PendingLen() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c1.CloseGracefully(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if c1.PendingLen() != 0 || !c1.IsClosed() {
+		t.Fatalf("pending %d closed %t", c1.PendingLen(), c1.IsClosed())
+	}
+	if err := c1.Write([]byte("b")); err != ErrConnClosing {
+		t.Fatalf("err %v", err)
+	}
+
+	a, b = net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+	c3 := newPipeTCPConn(a)
+	if err := c3.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c3.CloseGracefully(20 * time.Millisecond); err != ErrTimeout || !c3.IsClosed() {
+		t.Fatalf("err %v closed %t", err, c3.IsClosed())
+	}
+}
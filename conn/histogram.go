@@ -0,0 +1,104 @@
+package conn
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// buckets of a Histogram, values are microseconds. Below HISTOGRAM_SUB_BUCKETS
+// each value has a bucket, above that every power of two is split into half of
+// them, so a value is recorded within 1/32 of itself
+const (
+	HISTOGRAM_SUB_BUCKET_BITS = 6
+	HISTOGRAM_SUB_BUCKETS     = 1 << HISTOGRAM_SUB_BUCKET_BITS
+	// values above are recorded as it, about 35 minutes
+	HISTOGRAM_MAX_VALUE = 1<<31 - 1
+	HISTOGRAM_BUCKETS   = (31-HISTOGRAM_SUB_BUCKET_BITS+1)*HISTOGRAM_SUB_BUCKETS/2 + HISTOGRAM_SUB_BUCKETS/2
+)
+
+// Histogram is a high dynamic range histogram of durations, it records and
+// reads without locks in constant memory
+type Histogram struct {
+	counts [HISTOGRAM_BUCKETS]uint64
+	total  uint64
+	max    uint64
+}
+
+func histogramIndex(v uint64) int {
+	if v > HISTOGRAM_MAX_VALUE {
+		v = HISTOGRAM_MAX_VALUE
+	}
+	if v < HISTOGRAM_SUB_BUCKETS {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v) - HISTOGRAM_SUB_BUCKET_BITS)
+	return int(shift)*HISTOGRAM_SUB_BUCKETS/2 + int(v>>shift)
+}
+
+// histogramValue returns the highest value recorded at index i
+func histogramValue(i int) uint64 {
+	if i < HISTOGRAM_SUB_BUCKETS {
+		return uint64(i)
+	}
+	shift := uint(i/(HISTOGRAM_SUB_BUCKETS/2) - 1)
+	sub := uint64(i - int(shift)*HISTOGRAM_SUB_BUCKETS/2)
+	return sub<<shift + 1<<shift - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	v := uint64(d / time.Microsecond)
+	atomic.AddUint64(&h.counts[histogramIndex(v)], 1)
+	atomic.AddUint64(&h.total, 1)
+	for {
+		max := atomic.LoadUint64(&h.max)
+		if v <= max || atomic.CompareAndSwapUint64(&h.max, max, v) {
+			return
+		}
+	}
+}
+
+// Count returns the number of values recorded
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.total)
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.max)) * time.Microsecond
+}
+
+// Percentile returns the value p percent of the recorded ones are at or
+// below, 0 if none was recorded
+func (h *Histogram) Percentile(p float64) time.Duration {
+	total := h.Count()
+	if total < 1 {
+		return 0
+	}
+	rank := uint64(p/100*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+		if n >= rank {
+			v := histogramValue(i)
+			if max := atomic.LoadUint64(&h.max); v > max {
+				v = max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return h.Max()
+}
+
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.total, 0)
+	atomic.StoreUint64(&h.max, 0)
+}
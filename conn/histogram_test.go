@@ -0,0 +1,53 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := &Histogram{}
+	if h.Percentile(50) != 0 {
+		t.Fatal("percentile of an empty histogram")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	for _, c := range []struct {
+		p    float64
+		want time.Duration
+	}{{50, 500 * time.Millisecond}, {95, 950 * time.Millisecond}, {99, 990 * time.Millisecond}, {100, time.Second}} {
+		got := h.Percentile(c.p)
+		if got < c.want || got > c.want+c.want/32 {
+			t.Fatalf("p%v %s want %s", c.p, got, c.want)
+		}
+	}
+	if h.Count() != 1000 || h.Max() != time.Second {
+		t.Fatalf("count %d max %s", h.Count(), h.Max())
+	}
+	h.Record(time.Hour)
+	if h.Percentile(100) != HISTOGRAM_MAX_VALUE*time.Microsecond {
+		t.Fatalf("max %s", h.Percentile(100))
+	}
+	h.Reset()
+	if h.Count() != 0 || h.Percentile(99) != 0 {
+		t.Fatal("not reset")
+	}
+}
+
+func TestHistogramIndex(t *testing.T) {
+	last := -1
+	for v := uint64(0); v < 1<<20; v++ {
+		i := histogramIndex(v)
+		if i != last && i != last+1 {
+			t.Fatalf("index of %d is %d after %d", v, i, last)
+		}
+		if histogramValue(i) < v {
+			t.Fatalf("value of %d is %d", v, histogramValue(i))
+		}
+		last = i
+	}
+	if histogramIndex(HISTOGRAM_MAX_VALUE) != HISTOGRAM_BUCKETS-1 {
+		t.Fatalf("index of the max value %d", histogramIndex(HISTOGRAM_MAX_VALUE))
+	}
+}
@@ -0,0 +1,88 @@
+package conn
+
+import (
+	"sync"
+)
+
+// Hooks are called when the status of a connection changes, outside of its
+// locks. Each is called at most once and none after OnDisconnected
+type Hooks struct {
+	// the connection is connected, at once if it is already
+	OnConnected func(c Connection)
+	// the first error the connection failed with
+	OnError func(c Connection, err error)
+	// the connection closed, err is the one of OnError or nil
+	OnDisconnected func(c Connection, err error)
+}
+
+type hooks struct {
+	Hooks
+	conn Connection
+	sync.Mutex
+}
+
+// WatchStatus calls h with c, the connection these fields belong to, it
+// replaces the hooks before
+func (c *ConnCommonFields) WatchStatus(conn Connection, h Hooks) {
+	c.hooks.Lock()
+	c.hooks.Hooks, c.hooks.conn = h, conn
+	c.hooks.Unlock()
+	c.FieldsMutex.RLock()
+	connected := c.Status == STATUS_CONNECTED && !c.closed
+	c.FieldsMutex.RUnlock()
+	if connected {
+		c.runOnConnected()
+	}
+}
+
+func (c *ConnCommonFields) takeHook(get func(h *Hooks) bool) (conn Connection) {
+	c.hooks.Lock()
+	defer c.hooks.Unlock()
+	if !get(&c.hooks.Hooks) {
+		return nil
+	}
+	return c.hooks.conn
+}
+
+func (c *ConnCommonFields) runOnConnected() {
+	var fn func(c Connection)
+	conn := c.takeHook(func(h *Hooks) bool {
+		fn, h.OnConnected = h.OnConnected, nil
+		return fn != nil
+	})
+	if conn != nil {
+		fn(conn)
+	}
+}
+
+func (c *ConnCommonFields) runOnError(err error) {
+	var fn func(c Connection, err error)
+	conn := c.takeHook(func(h *Hooks) bool {
+		fn, h.OnError = h.OnError, nil
+		return fn != nil
+	})
+	if conn != nil {
+		fn(conn, err)
+	}
+}
+
+func (c *ConnCommonFields) runOnDisconnected(err error) {
+	var fn func(c Connection, err error)
+	conn := c.takeHook(func(h *Hooks) bool {
+		fn, h.OnDisconnected = h.OnDisconnected, nil
+		// none after the last one
+		h.OnConnected, h.OnError = nil, nil
+		return fn != nil
+	})
+	if conn != nil {
+		fn(conn, err)
+	}
+}
+
+func (c *UDPConn) SetHooks(h Hooks) {
+	c.WatchStatus(c, h)
+}
+
+func (c *TCPConn) SetHooks(h Hooks) {
+	c.WatchStatus(c, h)
+}
@@ -0,0 +1,52 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	c := NewUDPConn(udp, udp.LocalAddr().(*net.UDPAddr))
+
+	var events []string
+	var closeErr error
+	c.SetHooks(Hooks{
+		OnConnected: func(conn Connection) {
+			if conn != c {
+				t.Fatalf("hook of %v", conn)
+			}
+			events = append(events, "connected")
+		},
+		OnError: func(conn Connection, err error) { events = append(events, "error") },
+		OnDisconnected: func(conn Connection, err error) {
+			events = append(events, "disconnected")
+			closeErr = err
+		},
+	})
+	c.SetStatusToConnected()
+	c.SetStatusToConnected()
+	e := errors.New("test")
+	c.SetStatusToError(e)
+	c.SetStatusToError(errors.New("again"))
+	c.Close()
+	c.Close()
+	if len(events) != 3 || events[0] != "connected" || events[1] != "error" || events[2] != "disconnected" || closeErr != e {
+		t.Fatalf("events %v err %v", events, closeErr)
+	}
+
+	// hooks set on a connected connection
+	c = NewUDPConn(udp, udp.LocalAddr().(*net.UDPAddr))
+	c.SetStatusToConnected()
+	connected := false
+	c.SetHooks(Hooks{OnConnected: func(conn Connection) { connected = true }})
+	c.Close()
+	if !connected {
+		t.Fatal("not connected")
+	}
+}
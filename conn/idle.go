@@ -0,0 +1,106 @@
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIdleTimeout = NewError(ErrTimeout, "connection idle timeout")
+
+// IdlePolicy decides what happens to a connection nothing was read from for a
+// while. Pings and their pongs count as reads, so a live peer keeps it awake
+type IdlePolicy struct {
+	// the connection is idle after no reads for this long, never if 0
+	Timeout time.Duration
+	// called once the connection became idle, again only after a read
+	OnIdle func(c Connection)
+	// closes the idle connection after OnIdle
+	Close bool
+}
+
+// DefaultIdlePolicy closes a connection without reads for UDP_GC_PERIOD seconds
+var DefaultIdlePolicy = IdlePolicy{Timeout: UDP_GC_PERIOD * time.Second, Close: true}
+
+type idleWatch struct {
+	policy IdlePolicy
+	conn   Connection
+	timer  *WheelTimer
+	// lastRead of the idle period OnIdle was called for
+	fired int64
+	sync.Mutex
+}
+
+// WatchIdle applies p to c, the connection these fields belong to, and
+// replaces the policy before
+func (c *ConnCommonFields) WatchIdle(conn Connection, p IdlePolicy) {
+	w := &c.idle
+	w.Lock()
+	defer w.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.policy, w.conn, w.fired = p, conn, 0
+	if p.Timeout > 0 {
+		w.timer = ConnTimers.AfterFunc(p.Timeout, c.checkIdle)
+	}
+}
+
+// GetIdlePolicy returns the policy of WatchIdle
+func (c *ConnCommonFields) GetIdlePolicy() IdlePolicy {
+	w := &c.idle
+	w.Lock()
+	defer w.Unlock()
+	return w.policy
+}
+
+// checkIdle runs on the timer of the policy, it sleeps until the connection
+// could be idle next
+func (c *ConnCommonFields) checkIdle() {
+	w := &c.idle
+	w.Lock()
+	if w.timer == nil || c.IsClosed() {
+		w.Unlock()
+		return
+	}
+	p, conn := w.policy, w.conn
+	last := atomic.LoadInt64(&c.lastRead)
+	idle := time.Duration(time.Now().UnixNano() - last)
+	if idle < p.Timeout {
+		w.timer.Reset(p.Timeout - idle)
+		w.Unlock()
+		return
+	}
+	if w.fired == last {
+		w.timer.Reset(p.Timeout)
+		w.Unlock()
+		return
+	}
+	w.fired = last
+	if !p.Close {
+		w.timer.Reset(p.Timeout)
+	}
+	w.Unlock()
+	// off the goroutine of the timer wheel
+	go c.onIdle(conn, p, idle)
+}
+
+func (c *ConnCommonFields) onIdle(conn Connection, p IdlePolicy, idle time.Duration) {
+	c.GetContextLogger().Debugf("idle for %v", idle)
+	if p.OnIdle != nil {
+		p.OnIdle(conn)
+	}
+	if p.Close {
+		c.SetStatusToError(ErrIdleTimeout)
+		conn.Close()
+	}
+}
+
+func (c *UDPConn) SetIdlePolicy(p IdlePolicy) {
+	c.WatchIdle(c, p)
+}
+
+func (c *TCPConn) SetIdlePolicy(p IdlePolicy) {
+	c.WatchIdle(c, p)
+}
@@ -0,0 +1,44 @@
+package conn
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdlePolicy(t *testing.T) {
+	c := &UDPConn{ConnCommonFields: NewConnCommonFileds()}
+	var idles int32
+	c.SetIdlePolicy(IdlePolicy{
+		Timeout: 20 * time.Millisecond,
+		OnIdle: func(conn Connection) {
+			if conn != c {
+				t.Errorf("OnIdle of %v", conn)
+			}
+			atomic.AddInt32(&idles, 1)
+		},
+	})
+	time.Sleep(90 * time.Millisecond)
+	if n := atomic.LoadInt32(&idles); n != 1 {
+		t.Fatalf("OnIdle called %d times", n)
+	}
+	// a read wakes it up, it becomes idle again
+	c.UpdateLastTime()
+	time.Sleep(60 * time.Millisecond)
+	if n := atomic.LoadInt32(&idles); n != 2 {
+		t.Fatalf("OnIdle called %d times after a read", n)
+	}
+	if c.IsClosed() {
+		t.Fatal("closed without Close")
+	}
+
+	c.SetIdlePolicy(IdlePolicy{Timeout: 20 * time.Millisecond, Close: true})
+	select {
+	case <-c.Disconnected():
+	case <-time.After(time.Second):
+		t.Fatal("idle conn not closed")
+	}
+	if c.Err != ErrIdleTimeout {
+		t.Fatalf("err %v", c.Err)
+	}
+}
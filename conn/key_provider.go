@@ -0,0 +1,52 @@
+package conn
+
+import (
+	"fmt"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// KeyProvider holds the secret key of a node and does everything that needs it,
+// so the key can live in an os keystore, a pkcs#11 token or a tpm and never be
+// read into memory
+type KeyProvider interface {
+	PubKey() cipher.PubKey
+	SignHash(hash cipher.SHA256) (cipher.Sig, error)
+	// ECDH returns the shared secret of the key and target
+	ECDH(target cipher.PubKey) ([]byte, error)
+}
+
+// secKeyProvider is a secret key held in memory
+type secKeyProvider struct {
+	pk cipher.PubKey
+	sk cipher.SecKey
+}
+
+// NewSecKeyProvider returns a KeyProvider of a secret key held in memory
+func NewSecKeyProvider(pk cipher.PubKey, sk cipher.SecKey) KeyProvider {
+	return secKeyProvider{pk: pk, sk: sk}
+}
+
+func (p secKeyProvider) PubKey() cipher.PubKey {
+	return p.pk
+}
+
+func (p secKeyProvider) SignHash(hash cipher.SHA256) (sig cipher.Sig, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("SignHash recovered err %v", e)
+		}
+	}()
+	sig = cipher.SignHash(hash, p.sk)
+	return
+}
+
+func (p secKeyProvider) ECDH(target cipher.PubKey) (secret []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("ECDH recovered err %v", e)
+		}
+	}()
+	secret = cipher.ECDH(target, p.sk)
+	return
+}
@@ -0,0 +1,178 @@
+package conn
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// subsystems of SetSubsystemLogLevel
+const (
+	LOG_CONN      = "conn"
+	LOG_FACTORY   = "factory"
+	LOG_DISCOVERY = "discovery"
+	LOG_MONITOR   = "monitor"
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LOG_NONE:
+		return "none"
+	case LOG_ERROR:
+		return "error"
+	case LOG_INFO:
+		return "info"
+	case LOG_DEBUG:
+		return "debug"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel parses the String of a LogLevel
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l := LOG_NONE; l <= LOG_DEBUG; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return LOG_NONE, fmt.Errorf("unknown log level %q", s)
+}
+
+var (
+	// copied on write, the loggers read it on every log
+	subsystemLevels      atomic.Value
+	subsystemLevelsMutex sync.Mutex
+	// level of the subsystems without one, see allowLogLevel
+	baseLogLevel = int32(LOG_DEBUG)
+)
+
+func init() {
+	subsystemLevels.Store(map[string]LogLevel{})
+}
+
+func updateSubsystemLevels(fn func(levels map[string]LogLevel)) {
+	subsystemLevelsMutex.Lock()
+	levels := SubsystemLogLevels()
+	fn(levels)
+	subsystemLevels.Store(levels)
+	subsystemLevelsMutex.Unlock()
+}
+
+// SetSubsystemLogLevel limits the logs of subsystem to level at runtime, the
+// loggers of WithSubsystem follow it at once
+func SetSubsystemLogLevel(subsystem string, level LogLevel) {
+	allowLogLevel(level)
+	updateSubsystemLevels(func(levels map[string]LogLevel) {
+		levels[subsystem] = level
+	})
+}
+
+// ResetSubsystemLogLevel makes subsystem log like the ones without a level
+func ResetSubsystemLogLevel(subsystem string) {
+	updateSubsystemLevels(func(levels map[string]LogLevel) {
+		delete(levels, subsystem)
+	})
+}
+
+// SubsystemLogLevels returns the levels set by SetSubsystemLogLevel
+func SubsystemLogLevels() map[string]LogLevel {
+	current := subsystemLevels.Load().(map[string]LogLevel)
+	levels := make(map[string]LogLevel, len(current))
+	for s, l := range current {
+		levels[s] = l
+	}
+	return levels
+}
+
+func subsystemLogLevel(subsystem string) LogLevel {
+	l, ok := subsystemLevels.Load().(map[string]LogLevel)[subsystem]
+	if !ok {
+		return LogLevel(atomic.LoadInt32(&baseLogLevel))
+	}
+	return l
+}
+
+// allowLogLevel raises the level of the logrus standard logger to level if it
+// is lower, so a subsystem or a connection can log more than the others. The
+// subsystems without a level keep the former level of logrus
+func allowLogLevel(level LogLevel) {
+	std := logrus.StandardLogger()
+	if l, ok := GetLogger().(logrusLogger); !ok || l.Logger != std {
+		return
+	}
+	former := LOG_ERROR
+	switch l := std.GetLevel(); {
+	case l >= logrus.DebugLevel:
+		former = LOG_DEBUG
+	case l == logrus.InfoLevel:
+		former = LOG_INFO
+	}
+	if level <= former {
+		return
+	}
+	for {
+		base := atomic.LoadInt32(&baseLogLevel)
+		if LogLevel(base) <= former || atomic.CompareAndSwapInt32(&baseLogLevel, base, int32(former)) {
+			break
+		}
+	}
+	if level == LOG_DEBUG {
+		std.SetLevel(logrus.DebugLevel)
+	} else {
+		std.SetLevel(logrus.InfoLevel)
+	}
+}
+
+// subsystemLogger drops the logs above the level of its subsystem
+type subsystemLogger struct {
+	Logger
+	subsystem string
+}
+
+// WithSubsystem returns l that logs up to the level of subsystem, see
+// SetSubsystemLogLevel. A level set on l by WithLogLevel is kept and wins
+func WithSubsystem(l Logger, subsystem string) Logger {
+	switch sl := l.(type) {
+	case levelLogger:
+		return l
+	case subsystemLogger:
+		l = sl.Logger
+	}
+	return subsystemLogger{Logger: l, subsystem: subsystem}
+}
+
+func (l subsystemLogger) Debug(args ...interface{}) {
+	if subsystemLogLevel(l.subsystem) >= LOG_DEBUG {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l subsystemLogger) Debugf(format string, args ...interface{}) {
+	if subsystemLogLevel(l.subsystem) >= LOG_DEBUG {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l subsystemLogger) Infof(format string, args ...interface{}) {
+	if subsystemLogLevel(l.subsystem) >= LOG_INFO {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l subsystemLogger) Error(args ...interface{}) {
+	if subsystemLogLevel(l.subsystem) >= LOG_ERROR {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l subsystemLogger) Errorf(format string, args ...interface{}) {
+	if subsystemLogLevel(l.subsystem) >= LOG_ERROR {
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+func (l subsystemLogger) WithField(key string, value interface{}) Logger {
+	return subsystemLogger{Logger: l.Logger.WithField(key, value), subsystem: l.subsystem}
+}
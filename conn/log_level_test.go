@@ -0,0 +1,74 @@
+package conn
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSubsystemLogLevel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	old := GetLogger()
+	SetLogger(SlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	defer SetLogger(old)
+	defer ResetSubsystemLogLevel(LOG_CONN)
+
+	c := NewConnCommonFileds()
+	f := WithSubsystem(c.GetContextLogger(), LOG_FACTORY).WithField("app", "test")
+	SetSubsystemLogLevel(LOG_CONN, LOG_ERROR)
+	c.GetContextLogger().Debug("conn debug")
+	f.Debug("factory debug")
+	if s := buf.String(); strings.Contains(s, "conn debug") || !strings.Contains(s, "factory debug") || !strings.Contains(s, "app=test") {
+		t.Fatalf("log %q", s)
+	}
+	if l := SubsystemLogLevels(); len(l) != 1 || l[LOG_CONN] != LOG_ERROR {
+		t.Fatalf("levels %v", l)
+	}
+
+	// the level of the connection wins
+	c.SetLogLevel(LOG_DEBUG)
+	c.GetContextLogger().Debug("conn debug")
+	if !strings.Contains(buf.String(), "conn debug") {
+		t.Fatalf("log %q", buf.String())
+	}
+	ResetSubsystemLogLevel(LOG_CONN)
+	if l := SubsystemLogLevels(); len(l) != 0 {
+		t.Fatalf("levels %v", l)
+	}
+
+	if l, err := ParseLogLevel(LOG_INFO.String()); err != nil || l != LOG_INFO {
+		t.Fatalf("parse %s %v", l, err)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Fatal("verbose parsed")
+	}
+}
+
+func TestSubsystemLogLevelRaisesLogrus(t *testing.T) {
+	std := logrus.StandardLogger()
+	buf := new(bytes.Buffer)
+	out, level := std.Out, std.GetLevel()
+	std.SetOutput(buf)
+	std.SetLevel(logrus.WarnLevel)
+	defer func() {
+		std.SetOutput(out)
+		std.SetLevel(level)
+		atomic.StoreInt32(&baseLogLevel, int32(LOG_DEBUG))
+		ResetSubsystemLogLevel(LOG_DISCOVERY)
+	}()
+
+	conn := NewConnCommonFileds().GetContextLogger()
+	SetSubsystemLogLevel(LOG_DISCOVERY, LOG_DEBUG)
+	if std.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("logrus level %s", std.GetLevel())
+	}
+	WithSubsystem(conn, LOG_DISCOVERY).Debug("discovery debug")
+	conn.Infof("conn info")
+	if s := buf.String(); !strings.Contains(s, "discovery debug") || strings.Contains(s, "conn info") {
+		t.Fatalf("log %q", s)
+	}
+}
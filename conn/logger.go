@@ -0,0 +1,165 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is what connections and factories log with, LogrusLogger by default.
+// Adapt zap or slog to it and pass it to SetLogger or SetContextLogger
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	// WithField returns a logger that adds key to each log
+	WithField(key string, value interface{}) Logger
+}
+
+var logger atomic.Value
+
+func init() {
+	logger.Store(loggerValue{LogrusLogger(logrus.NewEntry(logrus.StandardLogger()))})
+}
+
+// loggerValue keeps the type stored in logger the same
+type loggerValue struct {
+	Logger
+}
+
+// SetLogger sets the logger of the connections created after
+func SetLogger(l Logger) {
+	logger.Store(loggerValue{l})
+}
+
+// GetLogger returns the logger of SetLogger
+func GetLogger() Logger {
+	return logger.Load().(loggerValue).Logger
+}
+
+type logrusLogger struct {
+	*logrus.Entry
+}
+
+// LogrusLogger logs to e
+func LogrusLogger(e *logrus.Entry) Logger {
+	return logrusLogger{e}
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{l.Entry.WithField(key, value)}
+}
+
+type slogLogger struct {
+	*slog.Logger
+}
+
+// SlogLogger logs to l
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+func (l slogLogger) log(level slog.Level, msg string) {
+	l.Logger.Log(context.Background(), level, msg)
+}
+
+func (l slogLogger) Debug(args ...interface{}) {
+	if l.Enabled(context.Background(), slog.LevelDebug) {
+		l.log(slog.LevelDebug, fmt.Sprint(args...))
+	}
+}
+
+func (l slogLogger) Debugf(format string, args ...interface{}) {
+	if l.Enabled(context.Background(), slog.LevelDebug) {
+		l.log(slog.LevelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l slogLogger) Infof(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) Error(args ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprint(args...))
+}
+
+func (l slogLogger) Errorf(format string, args ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) WithField(key string, value interface{}) Logger {
+	return slogLogger{l.Logger.With(key, value)}
+}
+
+type LogLevel int
+
+const (
+	LOG_NONE LogLevel = iota
+	LOG_ERROR
+	LOG_INFO
+	LOG_DEBUG
+)
+
+// levelLogger drops the logs above its level
+type levelLogger struct {
+	Logger
+	level LogLevel
+}
+
+// WithLogLevel returns l that only logs up to level, in addition to the level
+// of l itself. It replaces the level of the subsystem of l
+func WithLogLevel(l Logger, level LogLevel) Logger {
+	if ll, ok := l.(levelLogger); ok {
+		l = ll.Logger
+	}
+	if sl, ok := l.(subsystemLogger); ok {
+		l = sl.Logger
+	}
+	return levelLogger{Logger: l, level: level}
+}
+
+func (l levelLogger) Debug(args ...interface{}) {
+	if l.level >= LOG_DEBUG {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l levelLogger) Debugf(format string, args ...interface{}) {
+	if l.level >= LOG_DEBUG {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l levelLogger) Infof(format string, args ...interface{}) {
+	if l.level >= LOG_INFO {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l levelLogger) Error(args ...interface{}) {
+	if l.level >= LOG_ERROR {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l levelLogger) Errorf(format string, args ...interface{}) {
+	if l.level >= LOG_ERROR {
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+func (l levelLogger) WithField(key string, value interface{}) Logger {
+	return levelLogger{Logger: l.Logger.WithField(key, value), level: l.level}
+}
+
+// SetLogLevel sets the logs of the connection to level at runtime, over the
+// level of its subsystem
+func (c *ConnCommonFields) SetLogLevel(level LogLevel) {
+	allowLogLevel(level)
+	c.SetContextLogger(WithLogLevel(c.GetContextLogger(), level))
+}
@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := SlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	old := GetLogger()
+	SetLogger(l)
+	defer SetLogger(old)
+
+	c := NewConnCommonFileds()
+	c.SetContextLogger(c.GetContextLogger().WithField("type", "test"))
+	c.GetContextLogger().Debugf("seq %d", 1)
+	if s := buf.String(); !strings.Contains(s, "seq 1") || !strings.Contains(s, "type=test") || !strings.Contains(s, "ctxId=") {
+		t.Fatalf("log %q", s)
+	}
+
+	buf.Reset()
+	c.SetLogLevel(LOG_INFO)
+	c.SetLogLevel(LOG_ERROR)
+	c.GetContextLogger().Debug("debug")
+	c.GetContextLogger().WithField("k", "v").Infof("info")
+	if buf.Len() > 0 {
+		t.Fatalf("log above the level %q", buf.String())
+	}
+	c.GetContextLogger().Errorf("error")
+	if s := buf.String(); !strings.Contains(s, "error") || !strings.Contains(s, "type=test") {
+		t.Fatalf("log %q", s)
+	}
+	c.SetLogLevel(LOG_DEBUG)
+	c.GetContextLogger().Debug("debug")
+	if !strings.Contains(buf.String(), "debug") {
+		t.Fatalf("log %q", buf.String())
+	}
+}
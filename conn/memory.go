@@ -0,0 +1,177 @@
+package conn
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+// bytes held by all connections of the process, see TotalMemoryUsage
+var totalMemory int64
+
+// TotalMemoryUsage returns the bytes held by all open connections
+func TotalMemoryUsage() int64 {
+	return atomic.LoadInt64(&totalMemory)
+}
+
+// memoryAccount counts the bytes a connection holds: sent messages until they
+// are acked and udp messages waiting for reassembly
+type memoryAccount struct {
+	used   int
+	limit  int
+	closed bool
+	// closed and replaced whenever memory is freed so blocked writers check again
+	freed chan struct{}
+	sync.Mutex
+}
+
+// SetMemoryLimit caps the bytes held by the connection, unlimited if 0.
+// Writes wait for acks to free memory and udp messages beyond the cap are
+// dropped without an ack, so the peer sends them again later
+func (c *ConnCommonFields) SetMemoryLimit(bytes int) {
+	m := &c.memory
+	m.Lock()
+	m.limit = bytes
+	m.notify()
+	m.Unlock()
+}
+
+// SetMaxMessageSize caps the body of a received tcp message, a peer sending a
+// larger one is disconnected. msg.MAX_MESSAGE_SIZE if 0
+func (c *ConnCommonFields) SetMaxMessageSize(bytes uint32) {
+	atomic.StoreUint32(&c.maxMessageSize, bytes)
+}
+
+func (c *ConnCommonFields) GetMaxMessageSize() uint32 {
+	if n := atomic.LoadUint32(&c.maxMessageSize); n > 0 {
+		return n
+	}
+	return msg.MAX_MESSAGE_SIZE
+}
+
+// GetMemoryUsage returns the bytes held by the connection
+func (c *ConnCommonFields) GetMemoryUsage() (n int) {
+	m := &c.memory
+	m.Lock()
+	n = m.used
+	m.Unlock()
+	return
+}
+
+// freeMemory returns the bytes left under the limit, false if unlimited
+func (c *ConnCommonFields) freeMemory() (n int, ok bool) {
+	m := &c.memory
+	m.Lock()
+	defer m.Unlock()
+	if m.limit <= 0 {
+		return
+	}
+	return m.limit - m.used, true
+}
+
+// fits must be called with the lock held, a message larger than the limit
+// fits once nothing else is held
+func (m *memoryAccount) fits(n int) bool {
+	return m.limit <= 0 || m.used == 0 || m.used+n <= m.limit
+}
+
+// take must be called with the lock held
+func (m *memoryAccount) take(n int) {
+	m.used += n
+	atomic.AddInt64(&totalMemory, int64(n))
+}
+
+// notify must be called with the lock held
+func (m *memoryAccount) notify() {
+	if m.freed != nil {
+		close(m.freed)
+		m.freed = nil
+	}
+}
+
+// reserveMemory blocks the writer until n bytes fit, ErrTimeout if the write
+// deadline passes first
+func (c *ConnCommonFields) reserveMemory(n int) error {
+	return c.reserveMemoryContext(context.Background(), n)
+}
+
+// reserveMemoryContext is reserveMemory that returns ctx.Err() once ctx is done
+func (c *ConnCommonFields) reserveMemoryContext(ctx context.Context, n int) error {
+	m := &c.memory
+	var timeout <-chan time.Time
+	for {
+		m.Lock()
+		if m.closed {
+			m.Unlock()
+			return ErrConnClosed
+		}
+		if m.fits(n) {
+			m.take(n)
+			m.Unlock()
+			return nil
+		}
+		if m.freed == nil {
+			m.freed = make(chan struct{})
+		}
+		freed := m.freed
+		m.Unlock()
+
+		if timeout == nil {
+			if deadline := c.GetWriteDeadline(); !deadline.IsZero() {
+				timer := time.NewTimer(time.Until(deadline))
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			return ErrTimeout
+		case <-c.disconnected:
+			return ErrConnClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryReserveMemory is reserveMemory without waiting, for the udp read path
+func (c *ConnCommonFields) tryReserveMemory(n int) bool {
+	m := &c.memory
+	m.Lock()
+	defer m.Unlock()
+	if m.closed || !m.fits(n) {
+		return false
+	}
+	m.take(n)
+	return true
+}
+
+func (c *ConnCommonFields) releaseMemory(n int) {
+	if n == 0 {
+		return
+	}
+	m := &c.memory
+	m.Lock()
+	m.used -= n
+	if !m.closed {
+		atomic.AddInt64(&totalMemory, -int64(n))
+	}
+	m.notify()
+	m.Unlock()
+}
+
+// closeMemory takes what the connection still holds off the total
+func (c *ConnCommonFields) closeMemory() {
+	m := &c.memory
+	m.Lock()
+	if !m.closed {
+		m.closed = true
+		atomic.AddInt64(&totalMemory, -int64(m.used))
+	}
+	m.notify()
+	m.Unlock()
+}
@@ -0,0 +1,80 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	total := TotalMemoryUsage()
+	c := NewConnCommonFileds()
+	c.SetMemoryLimit(100)
+	if err := c.reserveMemory(80); err != nil {
+		t.Fatal(err)
+	}
+	if c.tryReserveMemory(40) {
+		t.Fatal("reserved beyond the limit")
+	}
+	if TotalMemoryUsage()-total != 80 {
+		t.Fatalf("total %d", TotalMemoryUsage()-total)
+	}
+
+	c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := c.reserveMemory(40); err != ErrTimeout {
+		t.Fatalf("err %v", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		done <- c.reserveMemory(40)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.releaseMemory(80)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c.GetMemoryUsage() != 40 {
+		t.Fatalf("used %d", c.GetMemoryUsage())
+	}
+
+	c.Close()
+	if TotalMemoryUsage() != total {
+		t.Fatalf("total %d after close", TotalMemoryUsage()-total)
+	}
+	c.releaseMemory(40)
+	if TotalMemoryUsage() != total {
+		t.Fatalf("total %d after release", TotalMemoryUsage()-total)
+	}
+}
+
+func TestStreamQueueHeldBytes(t *testing.T) {
+	q := newStreamQueue()
+	q.Push(2, msg.NewUDP(msg.TYPE_NORMAL, 2, []byte{1, 2}))
+	q.Push(2, msg.NewUDP(msg.TYPE_NORMAL, 2, []byte{1, 2}))
+	q.Push(3, msg.NewUDP(msg.TYPE_NORMAL, 3, []byte{1}))
+	if q.HeldBytes() != 3 {
+		t.Fatalf("held %d", q.HeldBytes())
+	}
+	q.Push(1, msg.NewUDP(msg.TYPE_NORMAL, 1, []byte{1}))
+	if q.HeldBytes() != 0 {
+		t.Fatalf("held %d after pop", q.HeldBytes())
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	c := &TCPConn{ConnCommonFields: NewConnCommonFileds()}
+	header := msg.New(msg.TYPE_NORMAL, 1, make([]byte, 100)).Bytes()
+	c.SetMaxMessageSize(99)
+	if _, err := c.ReadBody(bytes.NewReader(header), make([]byte, msg.MSG_HEADER_SIZE)); !errors.Is(err, msg.ErrMessageTooLarge) || !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err %v", err)
+	}
+	c.SetMaxMessageSize(100)
+	body, err := c.ReadBody(bytes.NewReader(header), make([]byte, msg.MSG_HEADER_SIZE))
+	if err != nil || len(body) != 100 {
+		t.Fatalf("body %d err %v", len(body), err)
+	}
+}
@@ -0,0 +1,63 @@
+package conn
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the counters of a connection
+type Metrics struct {
+	SentBytes     uint64
+	ReceivedBytes uint64
+	// smoothed rtt for udp, average ack latency of the last minute for tcp
+	RTT time.Duration
+	// percentiles of the ack latencies, see LatencyHistogram
+	RTTP50 time.Duration
+	RTTP95 time.Duration
+	RTTP99 time.Duration
+	// udp messages sent again after a timeout or detected loss
+	Retransmissions uint64
+	// sent messages waiting for an ack
+	PendingMessages int
+	// received messages dropped by the overflow policy
+	DroppedMessages uint64
+	// bytes held by the connection, see SetMemoryLimit
+	MemoryBytes int
+	// packets that may be in flight, udp only
+	SendWindow uint32
+	// of the phases of the setup
+	Setup SetupTimes
+}
+
+func (c *TCPConn) Metrics() Metrics {
+	return Metrics{
+		SentBytes:       c.GetSentBytes(),
+		ReceivedBytes:   c.GetReceivedBytes(),
+		RTT:             c.LastMinuteStats().LatencyAvg,
+		RTTP50:          c.LatencyHistogram().Percentile(50),
+		RTTP95:          c.LatencyHistogram().Percentile(95),
+		RTTP99:          c.LatencyHistogram().Percentile(99),
+		PendingMessages: c.PendingLen(),
+		DroppedMessages: c.GetDroppedCount(),
+		MemoryBytes:     c.GetMemoryUsage(),
+		Setup:           c.SetupTimes(),
+	}
+}
+
+func (c *UDPConn) Metrics() Metrics {
+	return Metrics{
+		SentBytes:     c.GetSentBytes(),
+		ReceivedBytes: c.GetReceivedBytes(),
+		RTT:           c.GetSRTT(),
+		RTTP50:        c.LatencyHistogram().Percentile(50),
+		RTTP95:        c.LatencyHistogram().Percentile(95),
+		RTTP99:        c.LatencyHistogram().Percentile(99),
+		Retransmissions: uint64(atomic.LoadUint32(&c.rtoResendCount)) +
+			uint64(atomic.LoadUint32(&c.lossResendCount)),
+		PendingMessages: c.PendingLen(),
+		DroppedMessages: c.GetDroppedCount(),
+		MemoryBytes:     c.GetMemoryUsage(),
+		SendWindow:      c.GetSendWindow(),
+		Setup:           c.SetupTimes(),
+	}
+}
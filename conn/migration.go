@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+
+	"github.com/skycoin/net/msg"
+)
+
+// NewConnID returns a random connection id for SetConnID
+func NewConnID() []byte {
+	id := make([]byte, msg.PING_MSG_CONN_ID_SIZE)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// SetConnID sends id with the pings, so a server keeps the session when the
+// address of the client changes, as when its nat rebinds. The id is not a
+// secret, the crypto of the connection keeps the data of a migrated session
+// from others
+func (c *UDPConn) SetConnID(id []byte) {
+	c.addrMutex.Lock()
+	c.connID = id
+	c.addrMutex.Unlock()
+}
+
+func (c *UDPConn) GetConnID() []byte {
+	c.addrMutex.RLock()
+	defer c.addrMutex.RUnlock()
+	return c.connID
+}
+
+// SetRemoteAddr sends the packets to addr from now on
+func (c *UDPConn) SetRemoteAddr(addr *net.UDPAddr) {
+	c.addrMutex.Lock()
+	c.addr = addr
+	c.batchWriter = newBatchWriter(c.UdpConn, addr)
+	c.addrMutex.Unlock()
+	c.SetPeerAddr(addr)
+	c.GetContextLogger().Debugf("migrated to %s", addr)
+}
+
+func (c *UDPConn) getAddr() *net.UDPAddr {
+	c.addrMutex.RLock()
+	defer c.addrMutex.RUnlock()
+	return c.addr
+}
+
+func (c *UDPConn) getBatchWriter() batchWriter {
+	c.addrMutex.RLock()
+	defer c.addrMutex.RUnlock()
+	return c.batchWriter
+}
+
+// PingConnID returns the connection id of the ping m, nil if m is no ping or
+// has no id
+func PingConnID(m []byte) []byte {
+	if len(m) < msg.PING_MSG_HEADER_SIZE+msg.PING_MSG_CONN_ID_SIZE || m[msg.PING_MSG_TYPE_BEGIN] != msg.TYPE_PING {
+		return nil
+	}
+	id := m[msg.PING_MSG_HEADER_SIZE : msg.PING_MSG_HEADER_SIZE+msg.PING_MSG_CONN_ID_SIZE]
+	if bytes.Equal(id, make([]byte, msg.PING_MSG_CONN_ID_SIZE)) {
+		return nil
+	}
+	return id
+}
+
+// CanStartConn reports whether m may be the first message of a connection,
+// a ping or the message of the first seq. Others of an unknown address are
+// of a connection whose address changed
+func CanStartConn(m []byte) bool {
+	if len(m) < msg.MSG_TYPE_END {
+		return false
+	}
+	switch m[msg.MSG_TYPE_BEGIN] {
+	case msg.TYPE_PING:
+		return true
+	case msg.TYPE_NORMAL, msg.TYPE_REQ, msg.TYPE_RESP,
+		msg.TYPE_NORMAL | msg.TYPE_FLAG_COMPRESSED, msg.TYPE_RESP | msg.TYPE_FLAG_COMPRESSED,
+		msg.TYPE_BATCH, msg.TYPE_BATCH | msg.TYPE_FLAG_COMPRESSED:
+		return len(m) >= msg.MSG_SEQ_END && binary.BigEndian.Uint32(m[msg.MSG_SEQ_BEGIN:msg.MSG_SEQ_END]) == 1
+	}
+	return false
+}
+
+// RequestConnID asks the client at addr for its connection id, it answers
+// with a ping
+func RequestConnID(c *net.UDPConn, addr *net.UDPAddr) error {
+	p := make([]byte, msg.PKG_HEADER_SIZE+msg.MSG_TYPE_SIZE)
+	p[msg.PKG_HEADER_SIZE+msg.MSG_TYPE_BEGIN] = msg.TYPE_MIGRATE
+	// every connection accepts crc32
+	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], crc32.ChecksumIEEE(p[msg.PKG_HEADER_SIZE:]))
+	_, err := c.WriteToUDP(p, addr)
+	return err
+}
@@ -0,0 +1,70 @@
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestUDPConnMigration(t *testing.T) {
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	server, a, b := listen(), listen(), listen()
+	defer server.Close()
+	defer a.Close()
+	defer b.Close()
+
+	c := NewUDPConn(server, a.LocalAddr().(*net.UDPAddr))
+	defer c.Close()
+	c.SetConnID(NewConnID())
+	c.SetRemoteAddr(b.LocalAddr().(*net.UDPAddr))
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MTU)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.VerifyChecksum(buf[:n]) {
+		t.Fatal("checksum")
+	}
+	id := PingConnID(buf[msg.PKG_HEADER_SIZE:n])
+	if !bytes.Equal(id, c.GetConnID()) {
+		t.Fatalf("conn id %x want %x", id, c.GetConnID())
+	}
+	if !CanStartConn(buf[msg.PKG_HEADER_SIZE:n]) {
+		t.Fatal("a ping can not start a connection")
+	}
+
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = a.Read(buf); err == nil {
+		t.Fatal("ping sent to the old address")
+	}
+}
+
+func TestCanStartConn(t *testing.T) {
+	first := msg.New(msg.TYPE_NORMAL, 1, []byte("a")).PkgBytes()[msg.PKG_HEADER_SIZE:]
+	if !CanStartConn(first) {
+		t.Fatal("first seq can not start a connection")
+	}
+	second := msg.New(msg.TYPE_NORMAL, 2, []byte("a")).PkgBytes()[msg.PKG_HEADER_SIZE:]
+	if CanStartConn(second) {
+		t.Fatal("second seq starts a connection")
+	}
+	if CanStartConn([]byte{msg.TYPE_ACK_WINDOW, 0, 0, 0, 1}) {
+		t.Fatal("ack starts a connection")
+	}
+	if PingConnID(msg.GenPingMsg()) != nil {
+		t.Fatal("conn id of a ping without one")
+	}
+}
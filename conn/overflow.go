@@ -0,0 +1,133 @@
+package conn
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to a received message when GetChanIn is full
+type OverflowPolicy int32
+
+const (
+	// wait for the reader, stalls the read loop of the connection
+	OVERFLOW_BLOCK OverflowPolicy = iota
+	// drop the oldest queued message to make room
+	OVERFLOW_DROP_OLDEST
+	// drop the received message
+	OVERFLOW_DROP_NEWEST
+	// close the connection with ErrChannelFull
+	OVERFLOW_ERROR
+)
+
+const (
+	DEFAULT_IN_SIZE  = 128
+	DEFAULT_OUT_SIZE = 1
+)
+
+var (
+	ErrChannelFull = errors.New("in channel is full")
+	// see SetChannelOptions
+	ErrChannelsInUse = errors.New("channels already in use")
+)
+
+type ChannelOptions struct {
+	// buffer sizes of GetChanIn and GetChanOut, the defaults if 0
+	InSize  int
+	OutSize int
+	Policy  OverflowPolicy
+}
+
+// SetChannelOptions replaces the in and out channels, so it is only valid
+// while the connection is still connecting, before the read and write loops
+// start. It returns ErrChannelsInUse after, use SetOverflowPolicy then
+func (c *ConnCommonFields) SetChannelOptions(o ChannelOptions) error {
+	if o.InSize <= 0 {
+		o.InSize = DEFAULT_IN_SIZE
+	}
+	if o.OutSize <= 0 {
+		o.OutSize = DEFAULT_OUT_SIZE
+	}
+	c.FieldsMutex.Lock()
+	if c.Status != STATUS_CONNECTING || c.closed {
+		c.FieldsMutex.Unlock()
+		return ErrChannelsInUse
+	}
+	c.In = make(chan []byte, o.InSize)
+	c.Out = make(chan []byte, o.OutSize)
+	c.FieldsMutex.Unlock()
+	c.SetOverflowPolicy(o.Policy)
+	return nil
+}
+
+// SetOverflowPolicy can be changed at any time
+func (c *ConnCommonFields) SetOverflowPolicy(p OverflowPolicy) {
+	atomic.StoreInt32((*int32)(&c.overflowPolicy), int32(p))
+}
+
+func (c *ConnCommonFields) GetOverflowPolicy() OverflowPolicy {
+	return OverflowPolicy(atomic.LoadInt32((*int32)(&c.overflowPolicy)))
+}
+
+// GetDroppedCount returns how many received messages the overflow policy dropped
+func (c *ConnCommonFields) GetDroppedCount() uint64 {
+	return atomic.LoadUint64(&c.droppedCount)
+}
+
+// PushIn delivers a received message to GetChanIn according to the rate limit
+// and the overflow policy
+func (c *ConnCommonFields) PushIn(m []byte) error {
+	if err := c.waitRead(len(m)); err != nil {
+		return err
+	}
+	return c.pushIn(m)
+}
+
+// pushIn holds inMutex, so Close can not close In while a message is sent
+func (c *ConnCommonFields) pushIn(m []byte) error {
+	c.inMutex.RLock()
+	defer c.inMutex.RUnlock()
+	select {
+	case <-c.disconnected:
+		c.dropMessage(DROP_CLOSED, m)
+		return ErrConnClosed
+	default:
+	}
+	switch c.GetOverflowPolicy() {
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case c.In <- m:
+		default:
+			atomic.AddUint64(&c.droppedCount, 1)
+			c.dropMessage(DROP_OVERFLOW, m)
+		}
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case c.In <- m:
+				return nil
+			default:
+			}
+			select {
+			case old := <-c.In:
+				atomic.AddUint64(&c.droppedCount, 1)
+				c.dropMessage(DROP_OVERFLOW, old)
+			default:
+			}
+		}
+	case OVERFLOW_ERROR:
+		select {
+		case c.In <- m:
+		default:
+			c.dropMessage(DROP_OVERFLOW, m)
+			return ErrChannelFull
+		}
+	default:
+		select {
+		case c.In <- m:
+		case <-c.disconnected:
+			c.dropMessage(DROP_CLOSED, m)
+			return ErrConnClosed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package conn
+
+import (
+	"testing"
+)
+
+func TestOverflowPolicy(t *testing.T) {
+	cases := []struct {
+		policy  OverflowPolicy
+		err     error
+		dropped uint64
+		first   byte
+	}{
+		{OVERFLOW_DROP_OLDEST, nil, 1, 1},
+		{OVERFLOW_DROP_NEWEST, nil, 1, 0},
+		{OVERFLOW_ERROR, ErrChannelFull, 0, 0},
+	}
+	for _, c := range cases {
+		f := NewConnCommonFileds()
+		f.SetChannelOptions(ChannelOptions{InSize: 2, Policy: c.policy})
+		var err error
+		for i := byte(0); i < 3 && err == nil; i++ {
+			err = f.PushIn([]byte{i})
+		}
+		if err != c.err {
+			t.Fatalf("policy %d err %v", c.policy, err)
+		}
+		if f.GetDroppedCount() != c.dropped {
+			t.Fatalf("policy %d dropped %d", c.policy, f.GetDroppedCount())
+		}
+		if m := <-f.In; m[0] != c.first {
+			t.Fatalf("policy %d first %d", c.policy, m[0])
+		}
+	}
+}
+
+// run with -race, Close must not close In under a blocked PushIn
+func TestPushInClose(t *testing.T) {
+	f := NewConnCommonFileds()
+	f.SetChannelOptions(ChannelOptions{InSize: 1})
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			var err error
+			for err == nil {
+				err = f.PushIn([]byte{0})
+			}
+			done <- err
+		}()
+	}
+	f.Close()
+	for i := 0; i < 4; i++ {
+		if err := <-done; err != ErrConnClosed {
+			t.Fatalf("err %v", err)
+		}
+	}
+}
+
+func TestChannelOptionsInUse(t *testing.T) {
+	f := NewConnCommonFileds()
+	if err := f.SetChannelOptions(ChannelOptions{InSize: 4}); err != nil || cap(f.In) != 4 {
+		t.Fatalf("cap %d err %v", cap(f.In), err)
+	}
+	f.SetStatusToConnected()
+	in := f.In
+	if err := f.SetChannelOptions(ChannelOptions{InSize: 8}); err != ErrChannelsInUse {
+		t.Fatalf("connected err %v", err)
+	}
+	if f.In != in {
+		t.Fatal("in channel replaced")
+	}
+}
@@ -0,0 +1,51 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// PACER_BURST is how early a packet may leave before its pacing time. Timers do
+// not fire much more often than once a millisecond, so high rates send small bursts
+const PACER_BURST = time.Millisecond
+
+// pacer spaces the packets of a udp connection by the pacing rate of the
+// congestion control, the pacing gain times the estimated bandwidth
+type pacer struct {
+	// pacing time of the next packet
+	next time.Time
+	// held while sending
+	sync.Mutex
+}
+
+// wait returns how long until the next packet may be sent
+func (p *pacer) wait(now time.Time) time.Duration {
+	early := now.Add(PACER_BURST)
+	if !p.next.After(early) {
+		return 0
+	}
+	return p.next.Sub(early)
+}
+
+// sent moves the pacing time by n bytes at rate bytes per second,
+// an idle connection does not save up time for a burst
+func (p *pacer) sent(n int, rate uint64, now time.Time) {
+	if rate == 0 {
+		return
+	}
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(uint64(n) * uint64(time.Second) / rate))
+}
+
+// sentPacket must be called with the pacer held
+func (c *UDPConn) sentPacket(n int) {
+	c.ca.pacer.sent(n, c.ca.getPacingRate(), time.Now())
+}
+
+func (c *UDPConn) resetPacingTimer(d time.Duration) {
+	c.pacingTimerMutex.Lock()
+	c.pacingTimer.Reset(d)
+	c.pacingTimerMutex.Unlock()
+}
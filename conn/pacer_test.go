@@ -0,0 +1,34 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	var p pacer
+	now := time.Now()
+	if d := p.wait(now); d != 0 {
+		t.Fatalf("first packet waits %v", d)
+	}
+	p.sent(100, 1000, now)
+	if d := p.wait(now); d != 100*time.Millisecond-PACER_BURST {
+		t.Fatalf("wait %v", d)
+	}
+	// small packets at a high rate leave in a burst
+	var q pacer
+	n := 0
+	for q.wait(now) == 0 {
+		q.sent(100, 1000000, now)
+		n++
+	}
+	if n != 11 {
+		t.Fatalf("burst of %d packets", n)
+	}
+	// an idle pacer does not save up
+	later := now.Add(time.Second)
+	q.sent(100, 1000, later)
+	if d := q.wait(later); d != 100*time.Millisecond-PACER_BURST {
+		t.Fatalf("wait after idle %v", d)
+	}
+}
@@ -0,0 +1,38 @@
+package conn
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+// WriteWithDeadline sends bytes like Write but stops resending them once
+// deadline passed, the peer then skips their seq and delivers the messages
+// after it, as live media prefers late data to be dropped over waiting for it.
+// A message sent in parts may be delivered in part. The stream cipher of
+// non-aead crypto can not skip bytes, deadline is ignored with it
+func (c *UDPConn) WriteWithDeadline(bytes []byte, deadline time.Time) (err error) {
+	if crypto := c.GetCrypto(); crypto != nil && !crypto.IsAEAD() {
+		deadline = time.Time{}
+	}
+	return c.writeToChannel(context.Background(), 0, bytes, msg.TYPE_NORMAL, deadline)
+}
+
+// skip replaces the body of m with a TYPE_SKIP message of its seq, it is
+// resent until acked like m. m keeps its size for the memory and inflight
+// accounting
+func (c *UDPConn) skip(m *msg.UDPMessage) {
+	p := make([]byte, msg.PKG_HEADER_SIZE+msg.MSG_HEADER_SIZE)
+	h := p[msg.PKG_HEADER_SIZE:]
+	h[msg.MSG_TYPE_BEGIN] = msg.TYPE_SKIP
+	binary.BigEndian.PutUint32(h[msg.MSG_SEQ_BEGIN:], m.GetSeq())
+	m.Skip(p)
+	c.GetContextLogger().Debugf("deadline passed, skip seq %d", m.GetSeq())
+}
+
+// WriteWithDeadline is Write, tcp is always reliable
+func (c *TCPConn) WriteWithDeadline(bytes []byte, deadline time.Time) error {
+	return c.Write(bytes)
+}
@@ -0,0 +1,95 @@
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestWriteWithDeadline(t *testing.T) {
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	as, bs := listen(), listen()
+	defer as.Close()
+	defer bs.Close()
+	a := NewUDPConn(as, bs.LocalAddr().(*net.UDPAddr))
+	b := NewUDPConn(bs, as.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+	defer b.Close()
+
+	ak, ask := cipher.GenerateKeyPair()
+	bk, bsk := cipher.GenerateKeyPair()
+	ac, _ := NewCryptoWithSuite(ak, ask, CIPHER_SUITE_CHACHA20_POLY1305)
+	bc, _ := NewCryptoWithSuite(bk, bsk, CIPHER_SUITE_CHACHA20_POLY1305)
+	ac.SetTargetKey(bk)
+	bc.SetTargetKey(ak)
+	iv := cipher.RandByte(16)
+	if err := ac.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	a.SetCrypto(ac)
+	b.SetCrypto(bc)
+	go a.WriteLoop()
+
+	read := func(seq uint32) []byte {
+		buf := make([]byte, MTU)
+		for {
+			bs.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := bs.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := buf[msg.PKG_HEADER_SIZE:n]
+			if len(m) >= msg.MSG_HEADER_SIZE && binary.BigEndian.Uint32(m[msg.MSG_SEQ_BEGIN:]) == seq {
+				return m
+			}
+		}
+	}
+	if err := a.WriteWithDeadline([]byte("late"), time.Now().Add(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	first := read(1)
+	if first[msg.MSG_TYPE_BEGIN] != msg.TYPE_NORMAL {
+		t.Fatalf("first sent as type %x", first[msg.MSG_TYPE_BEGIN])
+	}
+	if err := a.Write([]byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	next := append([]byte(nil), read(2)...)
+	// the first is lost, its resend comes after the deadline
+	skip := read(1)
+	if skip[msg.MSG_TYPE_BEGIN] != msg.TYPE_SKIP || len(skip) != msg.MSG_HEADER_SIZE {
+		t.Fatalf("resent as type %x len %d", skip[msg.MSG_TYPE_BEGIN], len(skip))
+	}
+
+	for _, m := range [][]byte{skip, next} {
+		if err := b.Process(m[msg.MSG_TYPE_BEGIN], m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case m := <-b.GetChanIn():
+		if string(m) != "next" {
+			t.Fatalf("got %s", m)
+		}
+	default:
+		t.Fatal("message after the skipped seq not delivered")
+	}
+	select {
+	case m := <-b.GetChanIn():
+		t.Fatalf("%s delivered", m)
+	default:
+	}
+}
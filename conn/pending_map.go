@@ -1,8 +1,7 @@
 package conn
 
 import (
-	"fmt"
-	"math/big"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,171 +9,241 @@ import (
 	"github.com/skycoin/net/msg"
 )
 
+// PendingMap keeps the sent messages by seq until they are acked, in one btree
+// so lookups and the range scans of loss detection are O(log n). Acked messages
+// are only kept as latency samples for Stats
 type PendingMap struct {
-	Pending map[uint32]msg.Interface
+	pending *btree.BTree
 	sync.RWMutex
-	ackedMessages        map[uint32]msg.Interface
-	ackedMessagesMutex   sync.RWMutex
-	lastMinuteAcked      map[uint32]msg.Interface
-	lastMinuteAckedMutex sync.RWMutex
 
-	statistics string
+	// samples of the messages acked since window began
+	acked      []ackSample
+	window     time.Time
+	lastMinute Stats
+	// ack latencies since the connection began or ResetStats
+	latencies *Histogram
+}
+
+type pendingItem struct {
+	seq uint32
+	msg msg.Interface
+}
+
+func (a pendingItem) Less(b btree.Item) bool {
+	return a.seq < b.(pendingItem).seq
+}
+
+type ackSample struct {
+	latency time.Duration
+	bytes   int
+}
+
+// Stats of acked messages
+type Stats struct {
+	Messages int
+	Bytes    int
+	// ack latencies
+	LatencyMin time.Duration
+	LatencyMax time.Duration
+	LatencyAvg time.Duration
+	LatencyP50 time.Duration
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+}
+
+func newStats(acked []ackSample) (s Stats) {
+	if len(acked) < 1 {
+		return
+	}
+	latencies := make([]time.Duration, 0, len(acked))
+	var sum time.Duration
+	for _, v := range acked {
+		latencies = append(latencies, v.latency)
+		sum += v.latency
+		s.Bytes += v.bytes
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	n := len(latencies)
+	percentile := func(p int) time.Duration {
+		i := (n*p+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return latencies[i]
+	}
+	s.Messages = n
+	s.LatencyMin = latencies[0]
+	s.LatencyMax = latencies[n-1]
+	s.LatencyAvg = sum / time.Duration(n)
+	s.LatencyP50 = percentile(50)
+	s.LatencyP90 = percentile(90)
+	s.LatencyP99 = percentile(99)
+	return
 }
 
 func NewPendingMap() *PendingMap {
-	pendingMap := &PendingMap{Pending: make(map[uint32]msg.Interface), ackedMessages: make(map[uint32]msg.Interface)}
-	go pendingMap.analyse()
-	return pendingMap
+	return &PendingMap{pending: btree.New(8), window: time.Now(), latencies: &Histogram{}}
 }
 
 func (m *PendingMap) AddMsg(k uint32, v *msg.Message) {
 	m.Lock()
-	m.Pending[k] = v
+	m.pending.ReplaceOrInsert(pendingItem{seq: k, msg: v})
 	m.Unlock()
 	v.Transmitted()
 }
 
-func (m *PendingMap) DelMsg(k uint32) (ok bool) {
+// GetMsg returns the message k if it still waits for an ack
+func (m *PendingMap) GetMsg(k uint32) (v msg.Interface, ok bool) {
 	m.RLock()
-	v, ok := m.Pending[k]
+	v, ok = m.get(k)
 	m.RUnlock()
+	return
+}
 
-	if !ok {
+// get must be called with the lock held
+func (m *PendingMap) get(k uint32) (v msg.Interface, ok bool) {
+	i := m.pending.Get(pendingItem{seq: k})
+	if i == nil {
 		return
 	}
+	return i.(pendingItem).msg, true
+}
 
-	v.Acked()
-
-	m.ackedMessagesMutex.Lock()
-	m.ackedMessages[k] = v
-	m.ackedMessagesMutex.Unlock()
+func (m *PendingMap) DelMsg(k uint32) (ok bool) {
+	_, ok = m.delMsg(k)
+	return
+}
 
+func (m *PendingMap) delMsg(k uint32) (v msg.Interface, ok bool) {
 	m.Lock()
-	delete(m.Pending, k)
+	i := m.pending.Delete(pendingItem{seq: k})
+	if i == nil {
+		m.Unlock()
+		return
+	}
+	v, ok = i.(pendingItem).msg, true
+	v.Acked()
+	m.addAcked(v)
 	m.Unlock()
 	return
 }
 
-func (m *PendingMap) analyse() {
-	ticker := time.NewTicker(time.Minute)
-	for {
-		select {
-		case <-ticker.C:
-			m.ackedMessagesMutex.Lock()
-			m.lastMinuteAckedMutex.Lock()
-			m.lastMinuteAcked = m.ackedMessages
-			m.lastMinuteAckedMutex.Unlock()
-			m.ackedMessages = make(map[uint32]msg.Interface)
-			m.ackedMessagesMutex.Unlock()
-
-			m.lastMinuteAckedMutex.RLock()
-			if len(m.lastMinuteAcked) < 1 {
-				m.lastMinuteAckedMutex.RUnlock()
-				continue
-			}
-			var max, min int64
-			sum := new(big.Int)
-			bytesSent := 0
-			for _, v := range m.lastMinuteAcked {
-				latency := v.GetRTT().Nanoseconds()
-				if max < latency {
-					max = latency
-				}
-				if min == 0 || min > latency {
-					min = latency
-				}
-				y := new(big.Int)
-				y.SetInt64(latency)
-				sum.Add(sum, y)
-
-				bytesSent += v.TotalSize()
-			}
-			n := new(big.Int)
-			n.SetInt64(int64(len(m.lastMinuteAcked)))
-			avg := new(big.Int)
-			avg.Div(sum, n)
-			m.lastMinuteAckedMutex.RUnlock()
+// addAcked must be called with the lock held
+func (m *PendingMap) addAcked(v msg.Interface) {
+	m.rotate()
+	m.acked = append(m.acked, ackSample{latency: v.GetRTT(), bytes: v.TotalSize()})
+	m.latencies.Record(v.GetRTT())
+}
 
-			m.statistics = fmt.Sprintf("sent: %d bytes, latency: max %d ns, min %d ns, avg %s ns, count %s", bytesSent, max, min, avg, n)
-		}
+// rotate starts a new window once a minute passed, must be called with the lock held
+func (m *PendingMap) rotate() {
+	passed := time.Since(m.window)
+	if passed < time.Minute {
+		return
+	}
+	if passed < 2*time.Minute {
+		m.lastMinute = newStats(m.acked)
+	} else {
+		m.lastMinute = Stats{}
 	}
+	m.acked = nil
+	m.window = m.window.Add(passed.Truncate(time.Minute))
 }
 
-type UDPPendingMap struct {
-	*PendingMap
-	seqs *btree.BTree
+// Stats of the messages acked since the last minute began or ResetStats
+func (m *PendingMap) Stats() Stats {
+	m.Lock()
+	defer m.Unlock()
+	m.rotate()
+	return newStats(m.acked)
+}
+
+// LastMinuteStats of the messages acked in the last full minute
+func (m *PendingMap) LastMinuteStats() (s Stats) {
+	m.Lock()
+	m.rotate()
+	s = m.lastMinute
+	m.Unlock()
+	return
+}
+
+// ResetStats forgets the acked messages of Stats, LastMinuteStats and
+// LatencyHistogram
+func (m *PendingMap) ResetStats() {
+	m.Lock()
+	m.acked = nil
+	m.lastMinute = Stats{}
+	m.latencies.Reset()
+	m.Unlock()
 }
 
-type seq uint32
+// LatencyHistogram of all acked messages
+func (m *PendingMap) LatencyHistogram() *Histogram {
+	return m.latencies
+}
 
-func (a seq) Less(b btree.Item) bool {
-	return a < b.(seq)
+// PendingLen returns the count of messages waiting for an ack
+func (m *PendingMap) PendingLen() (n int) {
+	m.RLock()
+	n = m.pending.Len()
+	m.RUnlock()
+	return
+}
+
+type UDPPendingMap struct {
+	*PendingMap
 }
 
 func NewUDPPendingMap() *UDPPendingMap {
-	m := &UDPPendingMap{
-		PendingMap: NewPendingMap(),
-		seqs:       btree.New(2),
-	}
-	return m
+	return &UDPPendingMap{PendingMap: NewPendingMap()}
 }
 
 func (m *UDPPendingMap) AddMsg(k uint32, v msg.Interface) {
 	m.Lock()
-	m.Pending[k] = v
-	m.seqs.ReplaceOrInsert(seq(k))
+	m.pending.ReplaceOrInsert(pendingItem{seq: k, msg: v})
 	m.Unlock()
 }
 
 func (m *UDPPendingMap) getMinUnAckSeq() (s uint32, ok bool) {
 	m.RLock()
-	r, ok := m.seqs.Min().(seq)
-	if !ok {
-		m.RUnlock()
-		return
+	i := m.pending.Min()
+	if i != nil {
+		s, ok = i.(pendingItem).seq, true
 	}
-	s = uint32(r)
 	m.RUnlock()
 	return
 }
 
 func (m *UDPPendingMap) exists(k uint32) (ok bool) {
 	m.RLock()
-	_, ok = m.Pending[k]
+	_, ok = m.get(k)
 	m.RUnlock()
 	return
 }
 
+// DelMsgAndGetLossMsgs acks k and counts a miss for every message sent before it,
+// those missed resend times are returned as lost
 func (m *UDPPendingMap) DelMsgAndGetLossMsgs(k uint32, resend uint32) (ok bool, um *msg.UDPMessage, loss []*msg.UDPMessage) {
 	m.Lock()
-	v, ok := m.Pending[k]
-	if !ok {
-		m.Unlock()
+	defer m.Unlock()
+	i := m.pending.Delete(pendingItem{seq: k})
+	if i == nil {
 		return
 	}
-	um = v.(*msg.UDPMessage)
+	ok = true
+	um = i.(pendingItem).msg.(*msg.UDPMessage)
 	um.Acked()
-	delete(m.Pending, k)
 
-	m.seqs.AscendLessThan(seq(k), func(i btree.Item) bool {
-		v, ok := m.Pending[uint32(i.(seq))]
+	m.pending.AscendLessThan(pendingItem{seq: k}, func(i btree.Item) bool {
+		v, ok := i.(pendingItem).msg.(*msg.UDPMessage)
 		if ok {
-			v, ok := v.(*msg.UDPMessage)
-			if ok {
-				if v.AddMiss() >= resend {
-					v.ResetMiss()
-					loss = append(loss, v)
-				}
+			if v.AddMiss() >= resend {
+				v.ResetMiss()
+				loss = append(loss, v)
 			}
 		}
 		return true
 	})
-	m.seqs.Delete(seq(k))
-	m.Unlock()
-
-	m.ackedMessagesMutex.Lock()
-	m.ackedMessages[k] = um
-	m.ackedMessagesMutex.Unlock()
-
+	m.addAcked(um)
 	return
 }
@@ -3,6 +3,7 @@ package conn
 import (
 	"github.com/skycoin/net/msg"
 	"testing"
+	"time"
 )
 
 func newUdp(seq uint32) *msg.UDPMessage {
@@ -30,3 +31,87 @@ func TestNewUDPPendingMap(t *testing.T) {
 	t.Log(m.DelMsgAndGetLossMsgs(8, 3))
 	t.Log(m.DelMsgAndGetLossMsgs(9, 3))
 }
+
+func TestPendingMapStats(t *testing.T) {
+	m := NewPendingMap()
+	for i := 1; i <= 100; i++ {
+		m.acked = append(m.acked, ackSample{latency: time.Duration(101-i) * time.Millisecond, bytes: 10})
+	}
+	s := m.Stats()
+	if s.Messages != 100 || s.Bytes != 1000 {
+		t.Fatalf("count %d bytes %d", s.Messages, s.Bytes)
+	}
+	if s.LatencyMin != time.Millisecond || s.LatencyMax != 100*time.Millisecond ||
+		s.LatencyAvg != 50500*time.Microsecond {
+		t.Fatalf("min %v max %v avg %v", s.LatencyMin, s.LatencyMax, s.LatencyAvg)
+	}
+	if s.LatencyP50 != 50*time.Millisecond || s.LatencyP90 != 90*time.Millisecond ||
+		s.LatencyP99 != 99*time.Millisecond {
+		t.Fatalf("p50 %v p90 %v p99 %v", s.LatencyP50, s.LatencyP90, s.LatencyP99)
+	}
+	m.ResetStats()
+	if s = m.Stats(); s != (Stats{}) {
+		t.Fatalf("not reset %+v", s)
+	}
+}
+
+func TestUDPPendingMapLoss(t *testing.T) {
+	m := NewUDPPendingMap()
+	for i := uint32(1); i <= 5; i++ {
+		m.AddMsg(i, newUdp(i))
+	}
+	if ok, _, loss := m.DelMsgAndGetLossMsgs(3, 2); !ok || len(loss) > 0 {
+		t.Fatalf("ok %t loss %v", ok, loss)
+	}
+	// 1 and 2 missed twice, 4 once
+	ok, um, loss := m.DelMsgAndGetLossMsgs(5, 2)
+	if !ok || um.GetSeq() != 5 || len(loss) != 2 || loss[1].GetSeq() != 2 {
+		t.Fatalf("ok %t loss %v", ok, loss)
+	}
+	if ok, _, _ = m.DelMsgAndGetLossMsgs(5, 2); ok {
+		t.Fatal("acked twice")
+	}
+	if s, ok := m.getMinUnAckSeq(); !ok || s != 1 || m.PendingLen() != 3 {
+		t.Fatalf("min %d len %d", s, m.PendingLen())
+	}
+	if m.Stats().Messages != 2 {
+		t.Fatalf("stats %+v", m.Stats())
+	}
+	m.window = m.window.Add(-time.Minute)
+	if m.LastMinuteStats().Messages != 2 || m.Stats().Messages != 0 {
+		t.Fatalf("not rotated %+v", m.LastMinuteStats())
+	}
+}
+
+func TestUDPMessageReleaseWhileResending(t *testing.T) {
+	m := newUdp(7)
+	m.Transmitted()
+	firing := make(chan struct{})
+	done := make(chan struct{})
+	m.SetRTO(time.Millisecond, func(m *msg.UDPMessage) error {
+		close(firing)
+		<-done
+		// released meanwhile, still not pooled
+		if m.GetSeq() != 7 || m.GetResendCount() != 1 {
+			t.Errorf("seq %d resend %d", m.GetSeq(), m.GetResendCount())
+		}
+		return nil
+	})
+	<-firing
+	m.Release()
+	close(done)
+
+	called := false
+	m = newUdp(8)
+	m.Transmitted()
+	m.SetRTO(20*time.Millisecond, func(m *msg.UDPMessage) error {
+		called = true
+		return nil
+	})
+	m.Acked()
+	m.Release()
+	time.Sleep(40 * time.Millisecond)
+	if called {
+		t.Fatal("resent after ack")
+	}
+}
@@ -0,0 +1,110 @@
+package conn
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority is the class of a write, the waiting writes of a higher class are
+// sent first
+type Priority int
+
+const (
+	// transfers that may wait, e.g. app data
+	PRIORITY_BULK Priority = iota
+	// messages of apps, the default
+	PRIORITY_INTERACTIVE
+	// ops and keepalives, they are not held by the rate limits either
+	PRIORITY_CONTROL
+
+	PRIORITY_SIZE
+)
+
+// weights of the pending channels of the priorities of a udp connection, see
+// SetPendingChannelWeight
+var priorityWeights = [PRIORITY_SIZE]int{1, 4, 16}
+
+func (p Priority) String() string {
+	switch p {
+	case PRIORITY_BULK:
+		return "bulk"
+	case PRIORITY_INTERACTIVE:
+		return "interactive"
+	case PRIORITY_CONTROL:
+		return "control"
+	}
+	return "unknown"
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a ctx whose writes by WriteContext are of priority p
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityOf returns the priority of the writes of ctx, PRIORITY_INTERACTIVE
+// if it has none
+func PriorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= 0 && p < PRIORITY_SIZE {
+		return p
+	}
+	return PRIORITY_INTERACTIVE
+}
+
+// priorityGate lets one writer at a time through, the waiting one of the
+// highest priority first
+type priorityGate struct {
+	waiting [PRIORITY_SIZE]int
+	busy    bool
+	cond    *sync.Cond
+	sync.Mutex
+}
+
+func (g *priorityGate) enter(p Priority) {
+	g.Lock()
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.Mutex)
+	}
+	g.waiting[p]++
+	for g.busy || g.higherWaiting(p) {
+		g.cond.Wait()
+	}
+	g.waiting[p]--
+	g.busy = true
+	g.Unlock()
+}
+
+func (g *priorityGate) higherWaiting(p Priority) bool {
+	for q := p + 1; q < PRIORITY_SIZE; q++ {
+		if g.waiting[q] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *priorityGate) leave() {
+	g.Lock()
+	g.busy = false
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+	g.Unlock()
+}
+
+// priorityChannel returns the pending channel of the writes of p, channel 0
+// for PRIORITY_INTERACTIVE. The others are made on their first write
+func (c *UDPConn) priorityChannel(p Priority) int {
+	if p == PRIORITY_INTERACTIVE {
+		return 0
+	}
+	c.priorityMutex.Lock()
+	defer c.priorityMutex.Unlock()
+	if c.priorityChannels[p] == 0 {
+		c.priorityChannels[p] = c.ca.newPendingChannel()
+		c.ca.setPendingChannelWeight(c.priorityChannels[p], priorityWeights[p])
+		c.ca.setPendingChannelWeight(0, priorityWeights[PRIORITY_INTERACTIVE])
+	}
+	return c.priorityChannels[p]
+}
@@ -0,0 +1,48 @@
+package conn
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPriorityGate(t *testing.T) {
+	if PriorityOf(context.Background()) != PRIORITY_INTERACTIVE {
+		t.Fatal("default priority")
+	}
+	if PriorityOf(WithPriority(context.Background(), PRIORITY_BULK)) != PRIORITY_BULK {
+		t.Fatal("priority of ctx")
+	}
+
+	var g priorityGate
+	g.enter(PRIORITY_BULK)
+	order := make(chan Priority, 3)
+	wait := func(p Priority) {
+		go func() {
+			g.enter(p)
+			order <- p
+			g.leave()
+		}()
+		for i := 0; ; i++ {
+			if i > 100 {
+				t.Fatalf("%s writer not waiting", p)
+			}
+			g.Lock()
+			waiting := g.waiting[p]
+			g.Unlock()
+			if waiting == 1 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait(PRIORITY_BULK)
+	wait(PRIORITY_INTERACTIVE)
+	wait(PRIORITY_CONTROL)
+	g.leave()
+	for _, want := range []Priority{PRIORITY_CONTROL, PRIORITY_INTERACTIVE, PRIORITY_BULK} {
+		if p := <-order; p != want {
+			t.Fatalf("%s writer went before the %s one", p, want)
+		}
+	}
+}
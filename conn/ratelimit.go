@@ -0,0 +1,209 @@
+package conn
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var ErrConnClosed = NewError(ErrClosed, "connection closed")
+
+// RateLimit per second, 0 means unlimited. Bursts of up to one second are allowed,
+// a message larger than that waits until its tokens are paid back
+type RateLimit struct {
+	ReadBytes     int
+	ReadMessages  int
+	WriteBytes    int
+	WriteMessages int
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// refill must be called with the lock held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait for them,
+// nothing is taken if the wait would be longer than max
+func (b *tokenBucket) reserve(n int, max time.Duration) (wait time.Duration, ok bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	left := b.tokens - float64(n)
+	if left < 0 {
+		wait = time.Duration(-left / b.rate * float64(time.Second))
+		if max >= 0 && wait > max {
+			return wait, false
+		}
+	}
+	b.tokens = left
+	return wait, true
+}
+
+// take takes n tokens unless the bucket is in debt
+func (b *tokenBucket) take(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// debt returns how long until the bucket has tokens again
+func (b *tokenBucket) debt() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens > 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens/b.rate*float64(time.Second)) + time.Millisecond
+}
+
+func (b *tokenBucket) refund(n int) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.tokens += float64(n)
+	b.Unlock()
+}
+
+type rateLimiter struct {
+	readBytes     *tokenBucket
+	readMessages  *tokenBucket
+	writeBytes    *tokenBucket
+	writeMessages *tokenBucket
+}
+
+// SetRateLimit replaces the limits and starts with full buckets, nil removes them
+func (c *ConnCommonFields) SetRateLimit(l *RateLimit) {
+	if l == nil {
+		c.rateLimiter.Store((*rateLimiter)(nil))
+		return
+	}
+	c.rateLimiter.Store(&rateLimiter{
+		readBytes:     newTokenBucket(l.ReadBytes),
+		readMessages:  newTokenBucket(l.ReadMessages),
+		writeBytes:    newTokenBucket(l.WriteBytes),
+		writeMessages: newTokenBucket(l.WriteMessages),
+	})
+}
+
+func (c *ConnCommonFields) getRateLimiter() *rateLimiter {
+	rl, _ := c.rateLimiter.Load().(*rateLimiter)
+	return rl
+}
+
+// waitRead stalls the read loop until a received message of n bytes is allowed
+func (c *ConnCommonFields) waitRead(n int) error {
+	rl := c.getRateLimiter()
+	if rl == nil {
+		return nil
+	}
+	return c.waitTokens(context.Background(), rl.readMessages, rl.readBytes, n, time.Time{})
+}
+
+// allowRead is waitRead without waiting, for udp where a stalled read would
+// stall every connection of the socket. A refused packet is not acked, so the
+// peer sends it again later
+func (c *ConnCommonFields) allowRead(n int) bool {
+	rl := c.getRateLimiter()
+	if rl == nil {
+		return true
+	}
+	if !rl.readMessages.take(1) {
+		return false
+	}
+	if !rl.readBytes.take(n) {
+		rl.readMessages.refund(1)
+		return false
+	}
+	return true
+}
+
+// waitWrite blocks the writer until n bytes are allowed by the rate limit and
+// the shared bandwidth, ErrTimeout if the write deadline passes first
+func (c *ConnCommonFields) waitWrite(n int) error {
+	return c.waitWriteContext(context.Background(), n)
+}
+
+// waitWriteContext is waitWrite that returns ctx.Err() once ctx is done
+func (c *ConnCommonFields) waitWriteContext(ctx context.Context, n int) error {
+	deadline := c.GetWriteDeadline()
+	if rl := c.getRateLimiter(); rl != nil {
+		err := c.waitTokens(ctx, rl.writeMessages, rl.writeBytes, n, deadline)
+		if err != nil {
+			return err
+		}
+	}
+	if s := c.getBandwidthShare(); s != nil {
+		err := s.wait(ctx, n, deadline, c.disconnected)
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *ConnCommonFields) waitTokens(ctx context.Context, msgs, bytes *tokenBucket, n int, deadline time.Time) error {
+	max := time.Duration(-1)
+	if !deadline.IsZero() {
+		max = time.Until(deadline)
+	}
+	w1, ok := msgs.reserve(1, max)
+	if !ok {
+		return ErrTimeout
+	}
+	w2, ok := bytes.reserve(n, max)
+	if !ok {
+		msgs.refund(1)
+		return ErrTimeout
+	}
+	if w2 > w1 {
+		w1 = w2
+	}
+	if w1 <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(w1)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.disconnected:
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
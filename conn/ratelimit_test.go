@@ -0,0 +1,60 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100)
+	if w, ok := b.reserve(100, -1); !ok || w != 0 {
+		t.Fatalf("burst wait %v %v", w, ok)
+	}
+	if w, ok := b.reserve(50, -1); !ok || w < 400*time.Millisecond || w > 500*time.Millisecond {
+		t.Fatalf("wait %v %v", w, ok)
+	}
+	if _, ok := b.reserve(100, time.Second); ok {
+		t.Fatal("reserved beyond max")
+	}
+	if b.take(1) {
+		t.Fatal("took from a bucket in debt")
+	}
+	if newTokenBucket(0) != nil {
+		t.Fatal("0 is not unlimited")
+	}
+}
+
+func TestRateLimitWrite(t *testing.T) {
+	c := NewConnCommonFileds()
+	c.SetRateLimit(&RateLimit{WriteMessages: 10})
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		if err := c.waitWrite(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("12 messages at 10/s took %v", d)
+	}
+	c.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if err := c.waitWrite(1); err != ErrTimeout {
+		t.Fatalf("err %v, want timeout", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	c.SetRateLimit(nil)
+	if err := c.waitWrite(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetRateLimit(&RateLimit{ReadBytes: 10})
+	if !c.allowRead(1200) {
+		t.Fatal("first packet refused")
+	}
+	if c.allowRead(1) {
+		t.Fatal("packet accepted in debt")
+	}
+	go c.Close()
+	if err := c.waitRead(1); err != ErrConnClosed {
+		t.Fatalf("err %v, want closed", err)
+	}
+}
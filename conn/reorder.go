@@ -0,0 +1,142 @@
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// how long an unreliable message waits for the ones before it by default
+const DEFAULT_REORDER_WAIT = 20 * time.Millisecond
+
+// reorderBuffer holds the unreliable messages arriving before the ones sent
+// earlier, see SetReorderWindow
+type reorderBuffer struct {
+	window uint32
+	wait   time.Duration
+	msgs   *btree.BTree
+	timer  *time.Timer
+	armed  bool
+	sync.Mutex
+}
+
+type reordered struct {
+	seq  uint32
+	body []byte
+}
+
+func (a reordered) Less(b btree.Item) bool {
+	return a.seq < b.(reordered).seq
+}
+
+// SetReorderWindow delivers the unreliable messages in order, an early one
+// waits until those before it arrived, at most wait or until it is window
+// seqs ahead. Missing ones are skipped then and dropped if they come later.
+// Off if window is 0, the default, the newest message is delivered at once.
+// Reliable messages are always delivered in order
+func (c *UDPConn) SetReorderWindow(window int, wait time.Duration) {
+	if wait <= 0 {
+		wait = DEFAULT_REORDER_WAIT
+	}
+	r := &c.reorder
+	r.Lock()
+	defer r.Unlock()
+	if window <= 0 {
+		r.window = 0
+		c.flushReordered()
+		return
+	}
+	r.window, r.wait = uint32(window), wait
+	if r.msgs == nil {
+		r.msgs = btree.New(2)
+	}
+}
+
+// reorderUnreliable returns false if the reorder buffer is off
+func (c *UDPConn) reorderUnreliable(seq uint32, body []byte) (ok bool, err error) {
+	r := &c.reorder
+	r.Lock()
+	defer r.Unlock()
+	if r.window == 0 {
+		return false, nil
+	}
+	next := atomic.LoadUint32(&c.unreliableRecv) + 1
+	if int32(seq-next) < 0 || r.msgs.Has(reordered{seq: seq}) {
+		c.GetContextLogger().Debugf("drop unreliable seq %d, next %d", seq, next)
+		c.dropMessage(DROP_UNRELIABLE, body)
+		return true, nil
+	}
+	r.msgs.ReplaceOrInsert(reordered{seq: seq, body: body})
+	err = c.popReordered(false)
+	if err != nil {
+		return true, err
+	}
+	for r.msgs.Len() > 0 && r.msgs.Max().(reordered).seq-atomic.LoadUint32(&c.unreliableRecv) > r.window {
+		err = c.popReordered(true)
+		if err != nil {
+			return true, err
+		}
+	}
+	switch {
+	case r.msgs.Len() == 0 && r.armed:
+		r.armed = false
+		r.timer.Stop()
+	case r.msgs.Len() > 0 && !r.armed:
+		r.armed = true
+		if r.timer == nil {
+			r.timer = time.AfterFunc(r.wait, c.reorderTimeout)
+		} else {
+			r.timer.Reset(r.wait)
+		}
+	}
+	return true, nil
+}
+
+// popReordered delivers the messages in order from the next seq, skip gives
+// up the missing ones before the first message held
+func (c *UDPConn) popReordered(skip bool) error {
+	r := &c.reorder
+	for r.msgs.Len() > 0 {
+		m := r.msgs.Min().(reordered)
+		if !skip && m.seq != atomic.LoadUint32(&c.unreliableRecv)+1 {
+			return nil
+		}
+		skip = false
+		r.msgs.DeleteMin()
+		atomic.StoreUint32(&c.unreliableRecv, m.seq)
+		if err := c.pushIn(m.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *UDPConn) reorderTimeout() {
+	r := &c.reorder
+	r.Lock()
+	defer r.Unlock()
+	r.armed = false
+	if r.msgs == nil || r.msgs.Len() == 0 {
+		return
+	}
+	c.GetContextLogger().Debugf("skip unreliable seq %d", atomic.LoadUint32(&c.unreliableRecv)+1)
+	if err := c.popReordered(true); err != nil {
+		return
+	}
+	if r.msgs.Len() > 0 {
+		r.armed = true
+		r.timer.Reset(r.wait)
+	}
+}
+
+// flushReordered delivers the messages held, the lock must be held
+func (c *UDPConn) flushReordered() {
+	r := &c.reorder
+	for r.msgs != nil && r.msgs.Len() > 0 {
+		if c.popReordered(true) != nil {
+			return
+		}
+	}
+}
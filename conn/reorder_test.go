@@ -0,0 +1,63 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestReorderWindow(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	c := NewUDPConn(udp, udp.LocalAddr().(*net.UDPAddr))
+	defer c.Close()
+
+	process := func(seqs ...uint32) {
+		for _, seq := range seqs {
+			if err := c.processUnreliable(msg.TYPE_UNRELIABLE, seq, []byte(fmt.Sprint(seq))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect := func(seqs ...uint32) {
+		for _, seq := range seqs {
+			select {
+			case m := <-c.GetChanIn():
+				if string(m) != fmt.Sprint(seq) {
+					t.Fatalf("got %s want %d", m, seq)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%d not delivered", seq)
+			}
+		}
+		select {
+		case m := <-c.GetChanIn():
+			t.Fatalf("%s delivered", m)
+		default:
+		}
+	}
+
+	c.SetReorderWindow(3, time.Hour)
+	process(1, 3)
+	expect(1)
+	process(2)
+	expect(2, 3)
+	// 7 is too far ahead, 4 is given up and dropped later
+	process(5, 6)
+	expect()
+	process(7, 4)
+	expect(5, 6, 7)
+
+	c.SetReorderWindow(3, 10*time.Millisecond)
+	process(9)
+	expect()
+	time.Sleep(50 * time.Millisecond)
+	process(8)
+	expect(9)
+}
@@ -0,0 +1,230 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+var ErrReportTooShort = errors.New("receiver report too short")
+
+// ReceiverReport is what the receiver of a udp connection saw in the interval
+// before it was sent, so a sender like an adaptive bitrate app reacts to loss
+// and queueing before the acks and the congestion window show it
+type ReceiverReport struct {
+	// highest seq received of the reliable and the unreliable messages
+	HighestSeq           uint32
+	HighestUnreliableSeq uint32
+	// of the packets of the interval that did not arrive, 0 to 1 in steps of 1/256
+	LossFraction float64
+	// smoothed difference between consecutive interarrival times, the packets
+	// carry no send time so it includes how regularly the sender sent
+	Jitter time.Duration
+	// bytes per second
+	ReceiveRate uint32
+}
+
+// seqStats counts the packets above the highest seq of the last interval
+type seqStats struct {
+	highest  uint32
+	base     uint32
+	received uint32
+}
+
+func (s *seqStats) add(seq uint32) {
+	if int32(seq-s.base) <= 0 {
+		return
+	}
+	s.received++
+	if int32(seq-s.highest) > 0 {
+		s.highest = seq
+	}
+}
+
+// next returns the packets expected and lost in the interval and starts the next one
+func (s *seqStats) next() (expected, lost uint32) {
+	expected = s.highest - s.base
+	if s.received < expected {
+		lost = expected - s.received
+	}
+	s.base, s.received = s.highest, 0
+	return
+}
+
+type receiverStats struct {
+	reliable     seqStats
+	unreliable   seqStats
+	bytes        int
+	since        time.Time
+	lastArrival  time.Time
+	lastInterval time.Duration
+	jitter       float64
+	sync.Mutex
+}
+
+// SetReceiverReportInterval sends a ReceiverReport to the peer every interval,
+// none if 0
+func (c *UDPConn) SetReceiverReportInterval(interval time.Duration) {
+	if interval < 0 {
+		interval = 0
+	}
+	atomic.StoreInt64(&c.reportInterval, int64(interval))
+	select {
+	case c.reportWake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *UDPConn) getReportInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.reportInterval))
+}
+
+// SetReceiverReportCallback calls fn with each report of the peer, it runs on
+// the read loop and must not block
+func (c *UDPConn) SetReceiverReportCallback(fn func(r ReceiverReport)) {
+	c.reportCallback.Store(fn)
+}
+
+func (c *UDPConn) recordArrival(t byte, seq uint32, n int) {
+	if c.getReportInterval() == 0 {
+		return
+	}
+	now := time.Now()
+	s := &c.receiverStats
+	s.Lock()
+	if t&^msg.TYPE_FLAG_COMPRESSED == msg.TYPE_UNRELIABLE {
+		s.unreliable.add(seq)
+	} else {
+		s.reliable.add(seq)
+	}
+	s.bytes += n
+	if s.since.IsZero() {
+		s.since = now
+	}
+	if !s.lastArrival.IsZero() {
+		interval := now.Sub(s.lastArrival)
+		if s.lastInterval > 0 {
+			d := interval - s.lastInterval
+			if d < 0 {
+				d = -d
+			}
+			s.jitter += (float64(d) - s.jitter) / 16
+		}
+		s.lastInterval = interval
+	}
+	s.lastArrival = now
+	s.Unlock()
+}
+
+// nextReport returns the report of the interval and starts the next one
+func (c *UDPConn) nextReport() (r ReceiverReport) {
+	now := time.Now()
+	s := &c.receiverStats
+	s.Lock()
+	defer s.Unlock()
+	expected, lost := s.reliable.next()
+	e, l := s.unreliable.next()
+	expected += e
+	lost += l
+	r.HighestSeq, r.HighestUnreliableSeq = s.reliable.highest, s.unreliable.highest
+	if expected > 0 {
+		r.LossFraction = float64(lost) / float64(expected)
+	}
+	r.Jitter = time.Duration(s.jitter)
+	if d := now.Sub(s.since); !s.since.IsZero() && d > 0 {
+		r.ReceiveRate = uint32(float64(s.bytes) / d.Seconds())
+	}
+	s.bytes, s.since = 0, now
+	return
+}
+
+func (c *UDPConn) reportLoop() {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	for {
+		interval := c.getReportInterval()
+		if interval == 0 {
+			select {
+			case <-c.reportWake:
+				continue
+			case <-c.disconnected:
+				return
+			}
+		}
+		timer.Reset(interval)
+		select {
+		case <-timer.C:
+		case <-c.reportWake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			continue
+		case <-c.disconnected:
+			return
+		}
+		err := c.WriteBytes(genReport(c.nextReport()))
+		if err != nil {
+			c.GetContextLogger().Debugf("write receiver report %v", err)
+		}
+	}
+}
+
+func genReport(r ReceiverReport) []byte {
+	p := make([]byte, msg.PKG_HEADER_SIZE+msg.REPORT_HEADER_SIZE)
+	m := p[msg.PKG_HEADER_SIZE:]
+	m[msg.REPORT_TYPE_BEGIN] = msg.TYPE_REPORT
+	binary.BigEndian.PutUint32(m[msg.REPORT_SEQ_BEGIN:], r.HighestSeq)
+	binary.BigEndian.PutUint32(m[msg.REPORT_UNRELIABLE_SEQ_BEGIN:], r.HighestUnreliableSeq)
+	loss := r.LossFraction * 256
+	if loss > 255 {
+		loss = 255
+	}
+	m[msg.REPORT_LOSS_BEGIN] = byte(loss)
+	jitter := r.Jitter / time.Microsecond
+	if jitter > 1<<32-1 {
+		jitter = 1<<32 - 1
+	}
+	binary.BigEndian.PutUint32(m[msg.REPORT_JITTER_BEGIN:], uint32(jitter))
+	binary.BigEndian.PutUint32(m[msg.REPORT_RATE_BEGIN:], r.ReceiveRate)
+	return p
+}
+
+func parseReport(m []byte) (r ReceiverReport, err error) {
+	if len(m) < msg.REPORT_HEADER_SIZE {
+		err = ErrReportTooShort
+		return
+	}
+	r.HighestSeq = binary.BigEndian.Uint32(m[msg.REPORT_SEQ_BEGIN:msg.REPORT_SEQ_END])
+	r.HighestUnreliableSeq = binary.BigEndian.Uint32(m[msg.REPORT_UNRELIABLE_SEQ_BEGIN:msg.REPORT_UNRELIABLE_SEQ_END])
+	r.LossFraction = float64(m[msg.REPORT_LOSS_BEGIN]) / 256
+	r.Jitter = time.Duration(binary.BigEndian.Uint32(m[msg.REPORT_JITTER_BEGIN:msg.REPORT_JITTER_END])) * time.Microsecond
+	r.ReceiveRate = binary.BigEndian.Uint32(m[msg.REPORT_RATE_BEGIN:msg.REPORT_RATE_END])
+	return
+}
+
+// RecvReport hands the receiver report m of the peer to the report callback
+func (c *UDPConn) RecvReport(m []byte) (err error) {
+	r, err := parseReport(m)
+	if err != nil {
+		return
+	}
+	c.GetContextLogger().Debugf("receiver report %+v", r)
+	if fn, ok := c.reportCallback.Load().(func(r ReceiverReport)); ok && fn != nil {
+		fn(r)
+	}
+	return
+}
+
+// SetReceiverReportInterval does nothing, tcp delivers every message in order
+func (c *TCPConn) SetReceiverReportInterval(interval time.Duration) {
+}
+
+func (c *TCPConn) SetReceiverReportCallback(fn func(r ReceiverReport)) {
+}
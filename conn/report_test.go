@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestReceiverReport(t *testing.T) {
+	c := &UDPConn{ConnCommonFields: NewConnCommonFileds()}
+	c.SetReceiverReportInterval(time.Second)
+	// 6 and 7 are lost
+	for _, seq := range []uint32{1, 2, 3, 4, 5, 8, 9, 10} {
+		c.recordArrival(msg.TYPE_NORMAL, seq, 100)
+	}
+	c.recordArrival(msg.TYPE_UNRELIABLE, 2, 100)
+	r := c.nextReport()
+	// 12 expected and 3 lost
+	if r.HighestSeq != 10 || r.HighestUnreliableSeq != 2 || r.LossFraction != 3.0/12 {
+		t.Fatalf("report %+v", r)
+	}
+	r, err := parseReport(genReport(r)[msg.PKG_HEADER_SIZE:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.HighestSeq != 10 || r.LossFraction != 64.0/256 {
+		t.Fatalf("parsed %+v", r)
+	}
+
+	// a resend of the last interval is not counted
+	c.recordArrival(msg.TYPE_NORMAL, 7, 100)
+	c.recordArrival(msg.TYPE_NORMAL, 11, 100)
+	if r = c.nextReport(); r.LossFraction != 0 || r.HighestSeq != 11 {
+		t.Fatalf("next interval %+v", r)
+	}
+}
+
+func TestReceiverReportLoop(t *testing.T) {
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	as, bs := listen(), listen()
+	defer as.Close()
+	defer bs.Close()
+	a := NewUDPConn(as, bs.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+	a.SetReceiverReportInterval(10 * time.Millisecond)
+	buf := make([]byte, MTU)
+	bs.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := bs.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != msg.PKG_HEADER_SIZE+msg.REPORT_HEADER_SIZE || buf[msg.PKG_HEADER_SIZE] != msg.TYPE_REPORT {
+		t.Fatalf("report %x", buf[:n])
+	}
+
+	b := &UDPConn{ConnCommonFields: NewConnCommonFileds()}
+	got := make(chan ReceiverReport, 1)
+	b.SetReceiverReportCallback(func(r ReceiverReport) { got <- r })
+	if err = b.RecvReport(buf[msg.PKG_HEADER_SIZE:n]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	default:
+		t.Fatal("callback not called")
+	}
+}
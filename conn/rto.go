@@ -0,0 +1,108 @@
+package conn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+const (
+	RTO_INITIAL = 300 * time.Millisecond
+	RTO_MIN     = 100 * time.Millisecond
+	RTO_MAX     = 60 * time.Second
+	// clock granularity of the rto, see RFC 6298
+	RTO_GRANULARITY = time.Millisecond
+	// successive timeouts of a message doubling the rto
+	RTO_MAX_BACKOFF = 6
+)
+
+// rtoEstimator tracks the smoothed rtt and its variance of a connection
+// and computes the retransmission timeout of RFC 6298
+type rtoEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	// successive timeouts without a new rtt sample
+	backoff uint32
+	sync.RWMutex
+}
+
+func newRTOEstimator() *rtoEstimator {
+	return &rtoEstimator{rto: RTO_INITIAL}
+}
+
+// sample must only get rtts of messages which were not retransmitted (Karn)
+func (e *rtoEstimator) sample(r time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	if e.srtt == 0 {
+		e.srtt = r
+		e.rttvar = r / 2
+	} else {
+		delta := e.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	k := 4 * e.rttvar
+	if k < RTO_GRANULARITY {
+		k = RTO_GRANULARITY
+	}
+	e.rto = clampRTO(e.srtt + k)
+	e.backoff = 0
+}
+
+// timeout backs off after the resend-th successive timeout of a message,
+// a burst of lost messages counts once
+func (e *rtoEstimator) timeout(resend uint32) {
+	if resend > RTO_MAX_BACKOFF {
+		resend = RTO_MAX_BACKOFF
+	}
+	e.Lock()
+	if resend > e.backoff {
+		e.backoff = resend
+	}
+	e.Unlock()
+}
+
+// get returns the rto of a message sent resend times before
+func (e *rtoEstimator) get(resend uint32) time.Duration {
+	e.RLock()
+	defer e.RUnlock()
+	shift := e.backoff
+	if resend > shift {
+		shift = resend
+	}
+	if shift > RTO_MAX_BACKOFF {
+		shift = RTO_MAX_BACKOFF
+	}
+	return clampRTO(e.rto << shift)
+}
+
+func (e *rtoEstimator) getSRTT() time.Duration {
+	e.RLock()
+	defer e.RUnlock()
+	return e.srtt
+}
+
+func clampRTO(rto time.Duration) time.Duration {
+	if rto < RTO_MIN {
+		return RTO_MIN
+	}
+	if rto > RTO_MAX {
+		return RTO_MAX
+	}
+	return rto
+}
+
+func (c *UDPConn) getRTO(m *msg.UDPMessage) time.Duration {
+	return c.rto.get(m.GetResendCount())
+}
+
+// GetSRTT returns the smoothed rtt, 0 before the first ack
+func (c *UDPConn) GetSRTT() time.Duration {
+	return c.rto.getSRTT()
+}
@@ -0,0 +1,42 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimator(t *testing.T) {
+	e := newRTOEstimator()
+	if rto := e.get(0); rto != RTO_INITIAL {
+		t.Fatalf("initial rto %v", rto)
+	}
+	e.sample(200 * time.Millisecond)
+	// srtt 200ms, rttvar 100ms
+	if rto := e.get(0); rto != 600*time.Millisecond {
+		t.Fatalf("first sample rto %v", rto)
+	}
+	e.sample(200 * time.Millisecond)
+	// srtt 200ms, rttvar 75ms
+	if rto := e.get(0); rto != 500*time.Millisecond {
+		t.Fatalf("second sample rto %v", rto)
+	}
+	if srtt := e.getSRTT(); srtt != 200*time.Millisecond {
+		t.Fatalf("srtt %v", srtt)
+	}
+
+	e.timeout(1)
+	e.timeout(1)
+	if rto := e.get(0); rto != time.Second {
+		t.Fatalf("backoff rto %v", rto)
+	}
+	if rto := e.get(2); rto != 2*time.Second {
+		t.Fatalf("message backoff rto %v", rto)
+	}
+	if rto := e.get(100); rto != 500*time.Millisecond<<RTO_MAX_BACKOFF {
+		t.Fatalf("max backoff rto %v", rto)
+	}
+	e.sample(200 * time.Millisecond)
+	if rto := e.get(0); rto >= time.Second {
+		t.Fatalf("backoff not reset %v", rto)
+	}
+}
@@ -0,0 +1,64 @@
+package conn
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// phases of the setup of a connection, see MarkSetup
+const (
+	// dialed or accepted
+	SETUP_CONNECT = iota
+	// crypto set
+	SETUP_HANDSHAKE
+	// key registered on the server
+	SETUP_REGISTRATION
+	// first services offered to the discovery
+	SETUP_FIRST_SERVICES
+	SETUP_PHASES
+)
+
+// SetupTimes are the durations of the setup phases of a connection, each
+// from the phase reached before it. A phase not reached is 0
+type SetupTimes struct {
+	Connect       time.Duration
+	Handshake     time.Duration
+	Registration  time.Duration
+	FirstServices time.Duration
+}
+
+// setupMarks are unix nanos of the start and of every phase reached
+type setupMarks struct {
+	start  int64
+	phases [SETUP_PHASES]int64
+}
+
+// SetSetupStart sets when the setup started, e.g. before the dial. It is
+// the creation of the connection by default
+func (c *ConnCommonFields) SetSetupStart(t time.Time) {
+	atomic.StoreInt64(&c.setup.start, t.UnixNano())
+}
+
+// MarkSetup records that phase is reached now, once
+func (c *ConnCommonFields) MarkSetup(phase int) {
+	if phase < 0 || phase >= SETUP_PHASES {
+		return
+	}
+	atomic.CompareAndSwapInt64(&c.setup.phases[phase], 0, time.Now().UnixNano())
+}
+
+func (c *ConnCommonFields) SetupTimes() (t SetupTimes) {
+	last := atomic.LoadInt64(&c.setup.start)
+	durations := [SETUP_PHASES]*time.Duration{&t.Connect, &t.Handshake, &t.Registration, &t.FirstServices}
+	for i, d := range durations {
+		at := atomic.LoadInt64(&c.setup.phases[i])
+		if at == 0 {
+			continue
+		}
+		if at > last {
+			*d = time.Duration(at - last)
+		}
+		last = at
+	}
+	return
+}
@@ -0,0 +1,26 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetupTimes(t *testing.T) {
+	c := NewConnCommonFileds()
+	c.SetSetupStart(time.Now().Add(-20 * time.Millisecond))
+	c.MarkSetup(SETUP_CONNECT)
+	time.Sleep(10 * time.Millisecond)
+	// no handshake, the registration counts from the connect
+	c.MarkSetup(SETUP_REGISTRATION)
+	c.MarkSetup(SETUP_PHASES)
+
+	s := c.SetupTimes()
+	if s.Connect < 20*time.Millisecond || s.Handshake != 0 || s.Registration < 10*time.Millisecond || s.FirstServices != 0 {
+		t.Fatalf("setup times %+v", s)
+	}
+	// marked once
+	c.MarkSetup(SETUP_REGISTRATION)
+	if c.SetupTimes().Registration != s.Registration {
+		t.Fatal("registration marked again")
+	}
+}
@@ -0,0 +1,101 @@
+package conn
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// SocketOptions tune the sockets of listeners and connections, the zero
+// values keep the defaults of go and the system
+type SocketOptions struct {
+	// turns TCP_NODELAY off, so small tcp writes are batched by Nagle
+	Nagle bool
+	// SO_RCVBUF and SO_SNDBUF in bytes
+	ReadBuffer  int
+	WriteBuffer int
+	// idle time before the first tcp keepalive probe, off if negative
+	KeepAlive time.Duration
+	// time between tcp keepalive probes and how many are lost before the
+	// connection closes, linux only
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// DSCP of the packets sent, the TOS or traffic class is DSCP<<2. Linux only
+	DSCP int
+}
+
+// Control sets the buffers and the DSCP of a socket before it binds or
+// connects, for net.ListenConfig and net.Dialer. Accepted tcp connections
+// inherit them from the listener. Linux only, see Apply for the others
+func (o *SocketOptions) Control(network, address string, c syscall.RawConn) (err error) {
+	if o == nil {
+		return
+	}
+	cerr := c.Control(func(fd uintptr) {
+		err = controlSocket(network, fd, o)
+	})
+	if err == nil {
+		err = cerr
+	}
+	return
+}
+
+// Apply sets the options of the tcp or udp conn c once it is connected,
+// accepted or listening
+func (o *SocketOptions) Apply(c net.Conn) (err error) {
+	if o == nil {
+		return
+	}
+	if b, ok := c.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	}); ok {
+		if o.ReadBuffer > 0 {
+			err = b.SetReadBuffer(o.ReadBuffer)
+			if err != nil {
+				return
+			}
+		}
+		if o.WriteBuffer > 0 {
+			err = b.SetWriteBuffer(o.WriteBuffer)
+			if err != nil {
+				return
+			}
+		}
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	err = tc.SetNoDelay(!o.Nagle)
+	if err != nil {
+		return
+	}
+	switch {
+	case o.KeepAlive < 0:
+		return tc.SetKeepAlive(false)
+	case o.KeepAlive > 0:
+		err = tc.SetKeepAlive(true)
+		if err != nil {
+			return
+		}
+		err = tc.SetKeepAlivePeriod(o.KeepAlive)
+		if err != nil {
+			return
+		}
+	}
+	if o.KeepAliveInterval <= 0 && o.KeepAliveCount <= 0 {
+		return
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		err = setKeepAliveProbes(fd, o.KeepAliveInterval, o.KeepAliveCount)
+	})
+	if err == nil {
+		err = cerr
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package conn
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func controlSocket(network string, fd uintptr, o *SocketOptions) (err error) {
+	if o.ReadBuffer > 0 {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReadBuffer)
+		if err != nil {
+			return
+		}
+	}
+	if o.WriteBuffer > 0 {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, o.WriteBuffer)
+		if err != nil {
+			return
+		}
+	}
+	if o.DSCP <= 0 {
+		return
+	}
+	tos := o.DSCP << 2
+	if strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+	if err != nil && !strings.HasSuffix(network, "4") {
+		// an ipv6 socket of a dual stack listener
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	return
+}
+
+func setKeepAliveProbes(fd uintptr, interval time.Duration, count int) (err error) {
+	if interval > 0 {
+		secs := int((interval + time.Second - 1) / time.Second)
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs)
+		if err != nil {
+			return
+		}
+	}
+	if count > 0 {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, count)
+	}
+	return
+}
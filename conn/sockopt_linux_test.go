@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptions(t *testing.T) {
+	o := &SocketOptions{
+		Nagle:             true,
+		ReadBuffer:        64 << 10,
+		KeepAlive:         time.Minute,
+		KeepAliveInterval: 5 * time.Second,
+		KeepAliveCount:    3,
+		DSCP:              46,
+	}
+	lc := net.ListenConfig{Control: o.Control}
+	ln, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	d := net.Dialer{Control: o.Control}
+	c, err := d.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = o.Apply(c); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(level, opt int) (v int) {
+		raw.Control(func(fd uintptr) {
+			v, err = unix.GetsockoptInt(int(fd), level, opt)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if v := get(unix.IPPROTO_TCP, unix.TCP_NODELAY); v != 0 {
+		t.Fatalf("TCP_NODELAY %d", v)
+	}
+	// the kernel doubles it
+	if v := get(unix.SOL_SOCKET, unix.SO_RCVBUF); v < o.ReadBuffer {
+		t.Fatalf("SO_RCVBUF %d", v)
+	}
+	if v := get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); v != 60 {
+		t.Fatalf("TCP_KEEPIDLE %d", v)
+	}
+	if v := get(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL); v != 5 {
+		t.Fatalf("TCP_KEEPINTVL %d", v)
+	}
+	if v := get(unix.IPPROTO_TCP, unix.TCP_KEEPCNT); v != 3 {
+		t.Fatalf("TCP_KEEPCNT %d", v)
+	}
+	if v := get(unix.IPPROTO_IP, unix.IP_TOS); v != 46<<2 {
+		t.Fatalf("IP_TOS %d", v)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import "time"
+
+func controlSocket(network string, fd uintptr, o *SocketOptions) error {
+	return nil
+}
+
+func setKeepAliveProbes(fd uintptr, interval time.Duration, count int) error {
+	return nil
+}
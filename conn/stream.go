@@ -2,7 +2,6 @@ package conn
 
 import (
 	"github.com/google/btree"
-	"github.com/sirupsen/logrus"
 	"github.com/skycoin/net/msg"
 	"sync"
 )
@@ -12,11 +11,14 @@ type streamQueue interface {
 	Len() (s int)
 	GetNextAckSeq() (s uint32)
 	GetMissingSeqs(start, end uint32) (seqs []uint32)
+	// body bytes of the messages waiting for reassembly
+	HeldBytes() (n int)
 }
 
 type defaultStreamQueue struct {
 	ackedSeq uint32
 	msgs     *btree.BTree
+	held     int
 	mutex    sync.RWMutex
 }
 
@@ -37,7 +39,7 @@ func (a packet) Less(b btree.Item) bool {
 
 func (q *defaultStreamQueue) Push(k uint32, m *msg.UDPMessage) (ok bool, msgs []*msg.UDPMessage) {
 	defer func() {
-		logrus.Debugf("streamQueue push k %d return %t, len %d", k, ok, len(msgs))
+		WithSubsystem(GetLogger(), LOG_CONN).Debugf("streamQueue push k %d return %t, len %d", k, ok, len(msgs))
 	}()
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -68,6 +70,7 @@ func (q *defaultStreamQueue) pop() (msgs []*msg.UDPMessage) {
 		if min.seq == i {
 			msgs = append(msgs, min.data)
 			q.msgs.DeleteMin()
+			q.held -= len(min.data.Body)
 			q.ackedSeq = i
 		} else {
 			break
@@ -80,10 +83,14 @@ func (q *defaultStreamQueue) pop() (msgs []*msg.UDPMessage) {
 }
 
 func (q *defaultStreamQueue) push(k uint32, m *msg.UDPMessage) {
-	q.msgs.ReplaceOrInsert(packet{
+	old := q.msgs.ReplaceOrInsert(packet{
 		seq:  k,
 		data: m,
 	})
+	if old != nil {
+		q.held -= len(old.(packet).data.Body)
+	}
+	q.held += len(m.Body)
 }
 
 func (q *defaultStreamQueue) Len() (s int) {
@@ -93,6 +100,13 @@ func (q *defaultStreamQueue) Len() (s int) {
 	return
 }
 
+func (q *defaultStreamQueue) HeldBytes() (n int) {
+	q.mutex.RLock()
+	n = q.held
+	q.mutex.RUnlock()
+	return
+}
+
 func (q *defaultStreamQueue) GetNextAckSeq() (s uint32) {
 	q.mutex.RLock()
 	s = q.ackedSeq + 1
@@ -128,6 +142,7 @@ type fecStreamQueue struct {
 
 	ackedSeq uint32
 	msgs     *btree.BTree
+	held     int
 	mutex    sync.RWMutex
 }
 
@@ -161,7 +176,7 @@ func (q *fecStreamQueue) Push(k uint32, m *msg.UDPMessage) (ok bool, msgs []*msg
 		return
 	}
 	defer func() {
-		logrus.Debugf("fecStreamQueue push k %d return %t, len %d", k, ok, len(msgs))
+		WithSubsystem(GetLogger(), LOG_CONN).Debugf("fecStreamQueue push k %d return %t, len %d", k, ok, len(msgs))
 	}()
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -192,6 +207,7 @@ func (q *fecStreamQueue) pop() (msgs []*msg.UDPMessage) {
 		if min.seq == i {
 			msgs = append(msgs, min.data)
 			q.msgs.DeleteMin()
+			q.held -= len(min.data.Body)
 			q.ackedSeq = i
 		} else {
 			break
@@ -204,10 +220,14 @@ func (q *fecStreamQueue) pop() (msgs []*msg.UDPMessage) {
 }
 
 func (q *fecStreamQueue) push(k uint32, m *msg.UDPMessage) {
-	q.msgs.ReplaceOrInsert(packet{
+	old := q.msgs.ReplaceOrInsert(packet{
 		seq:  k,
 		data: m,
 	})
+	if old != nil {
+		q.held -= len(old.(packet).data.Body)
+	}
+	q.held += len(m.Body)
 }
 
 func (q *fecStreamQueue) Len() (s int) {
@@ -217,6 +237,13 @@ func (q *fecStreamQueue) Len() (s int) {
 	return
 }
 
+func (q *fecStreamQueue) HeldBytes() (n int) {
+	q.mutex.RLock()
+	n = q.held
+	q.mutex.RUnlock()
+	return
+}
+
 func (q *fecStreamQueue) GetNextAckSeq() (s uint32) {
 	q.mutex.RLock()
 	s = q._getNextAckSeq()
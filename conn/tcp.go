@@ -2,6 +2,7 @@ package conn
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -20,6 +21,8 @@ type TCPConn struct {
 	*ConnCommonFields
 	*PendingMap
 	TcpConn net.Conn
+	// orders the writers by priority before WriteMutex
+	writeGate priorityGate
 }
 
 func (c *TCPConn) ReadLoop() (err error) {
@@ -55,14 +58,8 @@ func (c *TCPConn) ReadLoop() (err error) {
 			n := msg.PING_MSG_HEADER_END
 			reader.Discard(n)
 			c.AddReceivedBytes(n)
-		case msg.TYPE_REQ, msg.TYPE_RESP:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
-			if err != nil {
-				return err
-			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
+		case msg.TYPE_REQ, msg.TYPE_RESP, msg.TYPE_RESP | msg.TYPE_FLAG_COMPRESSED:
+			body, err := c.ReadBody(reader, header)
 			if err != nil {
 				return err
 			}
@@ -71,16 +68,17 @@ func (c *TCPConn) ReadLoop() (err error) {
 				c.DelMsg(seq)
 				c.UpdateLastAck(seq)
 			}
+			// a resp is pending at the sender like any other message
+			if msg_t != msg.TYPE_REQ {
+				c.Ack(binary.BigEndian.Uint32(header[msg.MSG_SEQ_BEGIN:msg.MSG_SEQ_END]))
+			}
 
-			c.In <- m.Body
-		case msg.TYPE_NORMAL:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+			err = c.PushIn(body)
 			if err != nil {
 				return err
 			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
+		case msg.TYPE_NORMAL, msg.TYPE_NORMAL | msg.TYPE_FLAG_COMPRESSED:
+			body, err := c.ReadBody(reader, header)
 			if err != nil {
 				return err
 			}
@@ -88,7 +86,10 @@ func (c *TCPConn) ReadLoop() (err error) {
 			seq := binary.BigEndian.Uint32(header[msg.MSG_SEQ_BEGIN:msg.MSG_SEQ_END])
 			c.Ack(seq)
 			//c.GetContextLogger().Debugf("c.In <- m.Body %x", m.Body)
-			c.In <- m.Body
+			err = c.PushIn(body)
+			if err != nil {
+				return err
+			}
 		default:
 			c.GetContextLogger().Debugf("not implemented msg type %d", t)
 			return fmt.Errorf("not implemented msg type %d", msg_t)
@@ -112,6 +113,9 @@ func (c *TCPConn) WriteLoop() (err error) {
 			}
 			c.GetContextLogger().Debugf("msg Out %x", m)
 			err := c.Write(m)
+			if err == ErrConnClosing {
+				continue
+			}
 			if err != nil {
 				c.GetContextLogger().Debugf("write msg is failed %v", err)
 				return err
@@ -120,10 +124,6 @@ func (c *TCPConn) WriteLoop() (err error) {
 	}
 }
 
-func getTCPReadDeadline() time.Time {
-	return time.Now().Add(time.Second * TCP_READ_TIMEOUT)
-}
-
 func (c *TCPConn) ReadBytes(r io.Reader, buf []byte, min int) (err error) {
 	n, err := io.ReadAtLeast(r, buf, min)
 	if err != nil {
@@ -133,35 +133,194 @@ func (c *TCPConn) ReadBytes(r io.Reader, buf []byte, min int) (err error) {
 	return
 }
 
+// ReadBody reads a msg into header and returns its decompressed body
+func (c *TCPConn) ReadBody(reader io.Reader, header []byte) (body []byte, err error) {
+	err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+	if err != nil {
+		return
+	}
+
+	m, err := msg.NewByHeader(header, c.GetMaxMessageSize())
+	if err != nil {
+		c.GetContextLogger().Debugf("read msg header %x: %v", header, err)
+		if err == msg.ErrMessageTooLarge {
+			c.drop(DROP_TOO_LARGE, int(binary.BigEndian.Uint32(header[msg.MSG_LEN_BEGIN:msg.MSG_LEN_END])), 0)
+			err = Wrap(ErrTooLarge, err)
+		}
+		return
+	}
+	t, body := m.Type, m.Body
+	m.Release()
+	err = c.ReadBytes(reader, body, len(body))
+	if err != nil {
+		return
+	}
+	if t&msg.TYPE_FLAG_COMPRESSED > 0 {
+		size := len(body)
+		body, err = decompressBody(body)
+		if err == ErrDecompressedTooLarge {
+			c.drop(DROP_TOO_LARGE, size, 0)
+		}
+		return
+	}
+	return body, nil
+}
+
 func (c *TCPConn) Write(bytes []byte) error {
+	return c.WriteContext(context.Background(), bytes)
+}
+
+// WriteContext is Write that returns ctx.Err() if ctx is done before the
+// message is sent, it waits for the rate limit and memory until then. The
+// message is written before the waiting ones of a lower PriorityOf(ctx)
+func (c *TCPConn) WriteContext(ctx context.Context, bytes []byte) error {
+	if c.IsClosing() {
+		return ErrConnClosing
+	}
+	p := PriorityOf(ctx)
+	if p < PRIORITY_CONTROL {
+		if err := c.waitWriteContext(ctx, len(bytes)); err != nil {
+			return err
+		}
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	t, bytes := c.compressBody(msg.TYPE_NORMAL, bytes)
+	if err := c.reserveMemoryContext(ctx, msg.MSG_HEADER_SIZE+len(bytes)); err != nil {
+		return err
+	}
 	s := atomic.AddUint32(&c.seq, 1)
-	m := msg.New(msg.TYPE_NORMAL, s, bytes)
+	m := msg.New(t, s, bytes)
+	m.Retain()
 	c.AddMsg(s, m)
-	return c.WriteBytes(m.Bytes())
+	err := c.writeMsg(p, m)
+	m.Release()
+	return err
 }
 
 func (c *TCPConn) WriteReq(bytes []byte) error {
+	if c.IsClosing() {
+		return ErrConnClosing
+	}
+	if err := c.waitWrite(len(bytes)); err != nil {
+		return err
+	}
+	if err := c.reserveMemory(msg.MSG_HEADER_SIZE + len(bytes)); err != nil {
+		return err
+	}
 	s := atomic.AddUint32(&c.seq, 1)
 	m := msg.New(msg.TYPE_REQ, s, bytes)
+	m.Retain()
 	c.AddMsg(s, m)
 	c.AddDirectlyHistory(s)
-	return c.writeDirectly(m.Bytes())
+	buf := msg.GetBuffer(msg.MSG_HEADER_SIZE + len(bytes))
+	m.PutHeader(buf)
+	copy(buf[msg.MSG_HEADER_END:], bytes)
+	err := c.writeDirectly(buf)
+	msg.PutBuffer(buf)
+	m.Release()
+	return err
 }
 
 func (c *TCPConn) WriteResp(bytes []byte) error {
+	if c.IsClosing() {
+		return ErrConnClosing
+	}
+	if err := c.waitWrite(len(bytes)); err != nil {
+		return err
+	}
+	t, bytes := c.compressBody(msg.TYPE_RESP, bytes)
+	if err := c.reserveMemory(msg.MSG_HEADER_SIZE + len(bytes)); err != nil {
+		return err
+	}
 	s := atomic.AddUint32(&c.seq, 1)
-	m := msg.New(msg.TYPE_RESP, s, bytes)
+	m := msg.New(t, s, bytes)
+	m.Retain()
 	c.AddMsg(s, m)
-	return c.WriteBytes(m.Bytes())
+	err := c.writeMsg(PRIORITY_INTERACTIVE, m)
+	m.Release()
+	return err
+}
+
+// writeMsg writes header and body without joining them when there is no crypto,
+// otherwise they are encrypted in a pooled buffer so the caller's body stays untouched
+func (c *TCPConn) writeMsg(p Priority, m *msg.Message) (err error) {
+	c.lockWrite(p)
+	defer c.unlockWrite()
+	crypto := c.GetCrypto()
+	if crypto == nil {
+		header := msg.GetBuffer(msg.MSG_HEADER_SIZE)
+		m.PutHeader(header)
+		bufs := net.Buffers{header, m.Body}
+		n, err := bufs.WriteTo(c.TcpConn)
+		c.AddSentBytes(int(n))
+		msg.PutBuffer(header)
+		if err != nil {
+			c.writeFailed(err)
+		}
+		return sockError(err)
+	}
+	buf := msg.GetBuffer(msg.MSG_HEADER_SIZE + len(m.Body))
+	m.PutHeader(buf)
+	copy(buf[msg.MSG_HEADER_END:], m.Body)
+	if crypto.IsAEAD() {
+		err = c.writeSealed(crypto, buf)
+	} else {
+		err = crypto.Encrypt(buf)
+		if err == nil {
+			err = c.write(buf)
+		}
+	}
+	msg.PutBuffer(buf)
+	return
+}
+
+// writeSealed writes bytes as aead records, WriteMutex must be held
+func (c *TCPConn) writeSealed(crypto *Crypto, bytes []byte) (err error) {
+	max := MAX_RECORD_SIZE - crypto.seal.Overhead()
+	for len(bytes) > 0 {
+		n := len(bytes)
+		if n > max {
+			n = max
+		}
+		buf := msg.GetBuffer(RECORD_HEADER_SIZE + n + crypto.seal.Overhead())
+		buf, err = crypto.SealRecord(buf[:0], bytes[:n])
+		if err == nil {
+			err = c.write(buf)
+		}
+		msg.PutBuffer(buf)
+		if err != nil {
+			return
+		}
+		bytes = bytes[n:]
+	}
+	return
 }
 
 func (c *TCPConn) writeDirectly(bytes []byte) (err error) {
+	c.lockWrite(PRIORITY_CONTROL)
+	defer c.unlockWrite()
+	return c.write(bytes)
+}
+
+// lockWrite takes WriteMutex once no writer of a higher priority waits
+func (c *TCPConn) lockWrite(p Priority) {
+	c.writeGate.enter(p)
 	c.WriteMutex.Lock()
-	defer c.WriteMutex.Unlock()
+}
+
+func (c *TCPConn) unlockWrite() {
+	c.WriteMutex.Unlock()
+	c.writeGate.leave()
+}
+
+// WriteMutex must be held
+func (c *TCPConn) write(bytes []byte) (err error) {
 	for index := 0; index != len(bytes); {
 		n, err := c.TcpConn.Write(bytes[index:])
 		if err != nil {
-			return err
+			c.writeFailed(err)
+			return sockError(err)
 		}
 		index += n
 		c.AddSentBytes(n)
@@ -169,20 +328,49 @@ func (c *TCPConn) writeDirectly(bytes []byte) (err error) {
 	return
 }
 
+// WriteBytes encrypts bytes in place, the stream cipher and the socket
+// must see frames in the same order so both happen under WriteMutex
 func (c *TCPConn) WriteBytes(bytes []byte) (err error) {
+	c.lockWrite(PRIORITY_CONTROL)
+	defer c.unlockWrite()
 	crypto := c.GetCrypto()
+	if crypto != nil && crypto.IsAEAD() {
+		return c.writeSealed(crypto, bytes)
+	}
 	if crypto != nil {
 		err = crypto.Encrypt(bytes)
 		if err != nil {
 			return
 		}
 	}
-	err = c.writeDirectly(bytes)
+	err = c.write(bytes)
 	return
 }
 
+// writeFailed closes the connection after a write timed out, the peer may
+// have got part of a frame so the stream can't be used anymore
+func (c *TCPConn) writeFailed(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.SetStatusToError(err)
+		c.Close()
+	}
+}
+
+// SetWriteDeadline also sets the deadline of the socket, a write that
+// times out closes the connection
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.ConnCommonFields.SetWriteDeadline(t)
+	return c.TcpConn.SetWriteDeadline(t)
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
 func (c *TCPConn) Ack(seq uint32) error {
-	resp := make([]byte, msg.MSG_SEQ_END)
+	resp := msg.GetBuffer(msg.MSG_SEQ_END)
+	defer msg.PutBuffer(resp)
 	resp[msg.MSG_TYPE_BEGIN] = msg.TYPE_ACK
 	binary.BigEndian.PutUint32(resp[msg.MSG_SEQ_BEGIN:], seq)
 	return c.WriteBytes(resp)
@@ -192,9 +380,23 @@ func (c *TCPConn) Ping() error {
 	return c.WriteBytes(msg.GenPingMsg())
 }
 
-func (c *TCPConn) UpdateLastTime() {
-	c.TcpConn.SetReadDeadline(getTCPReadDeadline())
-	c.ConnCommonFields.UpdateLastTime()
+// DelMsg also frees the memory of the acked message
+func (c *TCPConn) DelMsg(seq uint32) (ok bool) {
+	v, ok := c.PendingMap.delMsg(seq)
+	if ok {
+		m := v.(*msg.Message)
+		c.releaseMemory(msg.MSG_HEADER_SIZE + int(m.Len))
+		m.Release()
+	}
+	return
+}
+
+func (c *TCPConn) WaitForAcks(timeout time.Duration) error {
+	return c.waitFor(func() bool { return c.PendingLen() == 0 }, timeout)
+}
+
+func (c *TCPConn) CloseGracefully(timeout time.Duration) error {
+	return CloseGracefully(c, timeout)
 }
 
 func (c *TCPConn) Close() {
@@ -0,0 +1,145 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CONN_TIMER_TICK  = 10 * time.Millisecond
+	CONN_TIMER_SLOTS = 1024
+)
+
+// ConnTimers is the wheel of the idle watches and the pings of every
+// connection
+var ConnTimers = NewTimerWheel(CONN_TIMER_TICK, CONN_TIMER_SLOTS)
+
+// TimerWheel fires the timers of many connections from a single ticker, a
+// tick late at most. The ticker only runs while a timer is pending, so idle
+// connections do not each wake the scheduler with a timer of their own
+type TimerWheel struct {
+	tick time.Duration
+	// heads of the timers due in each slot
+	slots   []*WheelTimer
+	pos     int
+	count   int
+	running bool
+	sync.Mutex
+}
+
+// WheelTimer is the AfterFunc of a TimerWheel. Unlike the one of
+// time.AfterFunc fn runs on the goroutine of the wheel, so it must not block
+// and starts a goroutine for anything slow
+type WheelTimer struct {
+	w  *TimerWheel
+	fn func()
+	// -1 if not pending
+	slot int
+	// turns of the wheel left before it fires
+	rounds     int
+	prev, next *WheelTimer
+}
+
+func NewTimerWheel(tick time.Duration, slots int) *TimerWheel {
+	return &TimerWheel{tick: tick, slots: make([]*WheelTimer, slots)}
+}
+
+// AfterFunc calls fn after d
+func (w *TimerWheel) AfterFunc(d time.Duration, fn func()) *WheelTimer {
+	t := &WheelTimer{w: w, fn: fn, slot: -1}
+	w.Lock()
+	w.add(t, d)
+	w.Unlock()
+	return t
+}
+
+// Stop reports whether it stopped the timer before it fired
+func (t *WheelTimer) Stop() bool {
+	t.w.Lock()
+	defer t.w.Unlock()
+	return t.w.remove(t)
+}
+
+// Reset fires the timer after d again, it reports whether it was pending
+func (t *WheelTimer) Reset(d time.Duration) bool {
+	t.w.Lock()
+	defer t.w.Unlock()
+	pending := t.w.remove(t)
+	t.w.add(t, d)
+	return pending
+}
+
+// Len returns the pending timers
+func (w *TimerWheel) Len() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.count
+}
+
+// add puts t the ticks of d after the current one, so it never fires early
+func (w *TimerWheel) add(t *WheelTimer, d time.Duration) {
+	ticks := int((d+w.tick-1)/w.tick) + 1
+	t.slot = (w.pos + ticks) % len(w.slots)
+	t.rounds = (ticks - 1) / len(w.slots)
+	t.prev = nil
+	t.next = w.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[t.slot] = t
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+func (w *TimerWheel) remove(t *WheelTimer) bool {
+	if t.slot < 0 {
+		return false
+	}
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.slot, t.prev, t.next = -1, nil, nil
+	w.count--
+	return true
+}
+
+func (w *TimerWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	var due []*WheelTimer
+	for range ticker.C {
+		w.Lock()
+		w.pos = (w.pos + 1) % len(w.slots)
+		for t := w.slots[w.pos]; t != nil; {
+			next := t.next
+			if t.rounds > 0 {
+				t.rounds--
+			} else {
+				w.remove(t)
+				due = append(due, t)
+			}
+			t = next
+		}
+		stop := w.count == 0
+		if stop {
+			w.running = false
+		}
+		w.Unlock()
+		for i, t := range due {
+			t.fn()
+			due[i] = nil
+		}
+		due = due[:0]
+		if stop {
+			return
+		}
+	}
+}
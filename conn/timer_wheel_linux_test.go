@@ -0,0 +1,89 @@
+package conn
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	IDLE_BENCH_CONNS  = 50000
+	IDLE_BENCH_PERIOD = time.Second
+)
+
+func cpuTime() time.Duration {
+	var r syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &r)
+	return time.Duration(r.Utime.Nano() + r.Stime.Nano())
+}
+
+// benchmarkIdle reports the cpu the process spends per op of 10ms while conns
+// idle connections ping every IDLE_BENCH_PERIOD
+func benchmarkIdle(b *testing.B, start func(stop chan struct{})) {
+	stop := make(chan struct{})
+	start(stop)
+	defer close(stop)
+	// spread the first ticks
+	time.Sleep(IDLE_BENCH_PERIOD)
+	b.ResetTimer()
+	before := cpuTime()
+	time.Sleep(time.Duration(b.N) * 10 * time.Millisecond)
+	b.ReportMetric(float64(cpuTime()-before)/float64(b.N), "cpu-ns/op")
+}
+
+func BenchmarkIdleTickers(b *testing.B) {
+	benchmarkIdle(b, func(stop chan struct{}) {
+		for i := 0; i < IDLE_BENCH_CONNS; i++ {
+			go func() {
+				ticker := time.NewTicker(IDLE_BENCH_PERIOD)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+					case <-stop:
+						return
+					}
+				}
+			}()
+		}
+	})
+}
+
+type benchPing struct {
+	timer *WheelTimer
+	tick  chan struct{}
+	sync.Mutex
+}
+
+func (p *benchPing) fire() {
+	select {
+	case p.tick <- struct{}{}:
+	default:
+	}
+	p.Lock()
+	p.timer.Reset(IDLE_BENCH_PERIOD)
+	p.Unlock()
+}
+
+func BenchmarkIdleTimerWheel(b *testing.B) {
+	benchmarkIdle(b, func(stop chan struct{}) {
+		w := NewTimerWheel(CONN_TIMER_TICK, CONN_TIMER_SLOTS)
+		for i := 0; i < IDLE_BENCH_CONNS; i++ {
+			p := &benchPing{tick: make(chan struct{}, 1)}
+			p.Lock()
+			p.timer = w.AfterFunc(time.Duration(i)*IDLE_BENCH_PERIOD/IDLE_BENCH_CONNS, p.fire)
+			p.Unlock()
+			go func() {
+				defer p.timer.Stop()
+				for {
+					select {
+					case <-p.tick:
+					case <-stop:
+						return
+					}
+				}
+			}()
+		}
+	})
+}
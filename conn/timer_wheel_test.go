@@ -0,0 +1,45 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := NewTimerWheel(5*time.Millisecond, 8)
+	fired := make(chan time.Time, 4)
+	start := time.Now()
+	// more than a turn of the wheel
+	timer := w.AfterFunc(60*time.Millisecond, func() { fired <- time.Now() })
+	select {
+	case at := <-fired:
+		if d := at.Sub(start); d < 60*time.Millisecond {
+			t.Fatalf("fired early after %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not fired")
+	}
+	if timer.Stop() {
+		t.Fatal("stopped a fired timer")
+	}
+
+	stopped := w.AfterFunc(10*time.Millisecond, func() { fired <- time.Now() })
+	if !stopped.Stop() || w.Len() != 0 {
+		t.Fatal("timer not stopped")
+	}
+	if stopped.Reset(10 * time.Millisecond) {
+		t.Fatal("reset reports a stopped timer pending")
+	}
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("reset timer not fired")
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.Lock()
+	running := w.running
+	w.Unlock()
+	if running {
+		t.Fatal("wheel runs without timers")
+	}
+}
@@ -1,13 +1,12 @@
 package conn
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/btree"
-	"github.com/sirupsen/logrus"
 	"github.com/skycoin/net/msg"
-	"hash/crc32"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -23,23 +22,48 @@ type UDPConn struct {
 	*UDPPendingMap
 	streamQueue
 	UdpConn *net.UDPConn
-	addr    *net.UDPAddr
+	// pending channels of the priorities, see WriteContext
+	priorityChannels [PRIORITY_SIZE]int
+	priorityMutex    sync.Mutex
+	// see SetRemoteAddr
+	addrMutex sync.RWMutex
+	addr      *net.UDPAddr
+	// sent with the pings, see SetConnID
+	connID []byte
 
 	// write loop with ping
 	SendPing bool
-	rto      time.Duration
-	rtt      time.Duration
+	rto      *rtoEstimator
 
 	rtoResendCount  uint32
 	lossResendCount uint32
 	ackCount        uint32
 	overAckCount    uint32
-
-	lastAck     uint32
-	lastCnt     uint32
-	lastCnted   uint32
-	lastAckCond *sync.Cond
-	lastAckMtx  sync.Mutex
+	// see DUP_ACK_THRESHOLD
+	dupAckCount        uint32
+	suppressedAckCount uint32
+	dupAcks            dupAcks
+	lastAck            lastAck
+
+	// see SetAckPolicy
+	ackPolicy   ackPolicy
+	highestRecv uint32
+	unacked     uint32
+	ackWake     chan struct{}
+	ackNow      uint32
+	// see EnableAckWindow
+	ackWindow int32
+
+	// seqs of WriteUnreliable, the highest delivered one
+	unreliableSeq  uint32
+	unreliableRecv uint32
+	reorder        reorderBuffer
+
+	// see SetReceiverReportInterval
+	reportInterval int64
+	reportWake     chan struct{}
+	receiverStats  receiverStats
+	reportCallback atomic.Value
 
 	// congestion algorithm
 	*ca
@@ -50,8 +74,18 @@ type UDPConn struct {
 	// fec
 	*fecEncoder
 	*fecDecoder
+
+	// see SetCoalescing
+	coalescer coalescer
+
+	// packets of writePendingMsgs, see queueBytes
+	batchWriter batchWriter
+	batch       [][]byte
+	batchPooled [][]byte
 }
 
+var errNothingWritten = errors.New("nothing was written")
+
 const (
 	dataShards   = 4
 	parityShards = 1
@@ -65,18 +99,26 @@ func NewUDPConn(c *net.UDPConn, addr *net.UDPAddr) *UDPConn {
 		ConnCommonFields: NewConnCommonFileds(),
 		UDPPendingMap:    NewUDPPendingMap(),
 		streamQueue:      newFECStreamQueue(dataShards, parityShards),
-		rto:              300 * time.Millisecond,
+		rto:              newRTOEstimator(),
 		fecEncoder:       newFECEncoder(dataShards, parityShards),
 		fecDecoder:       newFECDecoder(dataShards, parityShards),
 	}
+	if addr != nil {
+		conn.SetPeerAddr(addr)
+	}
 	conn.ca = newCA()
 	conn.pacingTimer = time.NewTimer(0)
 	if !conn.pacingTimer.Stop() {
 		<-conn.pacingTimer.C
 	}
 	conn.pacingChan = make(chan struct{}, 1)
-	conn.lastAckCond = sync.NewCond(&conn.lastAckMtx)
+	conn.ackWake = make(chan struct{}, 1)
+	conn.reportWake = make(chan struct{}, 1)
+	conn.SetAckPolicy(0, 0)
+	conn.SetIdlePolicy(DefaultIdlePolicy)
+	conn.batchWriter = newBatchWriter(c, addr)
 	go conn.ackLoop()
+	go conn.reportLoop()
 	return conn
 }
 
@@ -108,6 +150,9 @@ func (c *UDPConn) writeLoop() (err error) {
 				return nil
 			}
 			err := c.Write(m)
+			if err == ErrConnClosing {
+				continue
+			}
 			if err != nil {
 				c.GetContextLogger().Debugf("write msg is failed %v", err)
 				return err
@@ -129,23 +174,33 @@ func (c *UDPConn) writeLoop() (err error) {
 }
 
 func (c *UDPConn) writeLoopWithPing() (err error) {
-	ticker := time.NewTicker(time.Second * UDP_PING_TICK_PERIOD)
+	tick := make(chan struct{}, 1)
+	timer := ConnTimers.AfterFunc(time.Second*UDP_PING_TICK_PERIOD, func() {
+		select {
+		case tick <- struct{}{}:
+		default:
+		}
+	})
 	defer func() {
-		ticker.Stop()
+		timer.Stop()
 		if err != nil {
 			c.SetStatusToError(err)
 		}
 	}()
 
+	// a server migrates the connection once it knows the id
+	if c.GetConnID() != nil {
+		err = c.Ping()
+		if err != nil {
+			return
+		}
+	}
 	for {
 		select {
-		case <-ticker.C:
-			nowUnix := time.Now().Unix()
-			lastTime := c.GetLastTime()
-			if nowUnix-lastTime >= UDP_GC_PERIOD {
-				c.Close()
-				return errors.New("timeout")
-			} else if nowUnix-lastTime < UDP_PING_TICK_PERIOD {
+		case <-tick:
+			timer.Reset(time.Second * UDP_PING_TICK_PERIOD)
+			// the idle policy closes the connection if the pings are not answered
+			if time.Now().Unix()-c.GetLastTime() < UDP_PING_TICK_PERIOD {
 				continue
 			}
 			err := c.Ping()
@@ -158,6 +213,9 @@ func (c *UDPConn) writeLoopWithPing() (err error) {
 				return nil
 			}
 			err := c.Write(m)
+			if err == ErrConnClosing {
+				continue
+			}
 			if err != nil {
 				c.GetContextLogger().Debugf("write msg is failed %v", err)
 				return err
@@ -178,79 +236,125 @@ func (c *UDPConn) writeLoopWithPing() (err error) {
 	}
 }
 
-func (c *UDPConn) ackLoop() (err error) {
-	t := time.NewTicker(2 * time.Millisecond)
-	defer func() {
-		t.Stop()
-		if err != nil {
-			c.SetStatusToError(err)
-		}
-	}()
-
-	for {
-		select {
-		case <-t.C:
-			la := atomic.LoadUint32(&c.lastAck)
-			lt := atomic.LoadUint32(&c.lastCnt)
-			if lt != c.lastCnted {
-				err = c.ack(la)
-				if err != nil {
-					return
-				}
-				c.lastCnted = lt
-			} else {
-				t.Stop()
-				c.lastAckMtx.Lock()
-				c.lastAckCond.Wait()
-				c.lastAckMtx.Unlock()
-				t = time.NewTicker(2 * time.Millisecond)
-			}
-		case <-c.disconnected:
-			return
-		}
-	}
-}
-
 func (c *UDPConn) Write(bytes []byte) (err error) {
 	err = c.WriteToChannel(0, bytes)
 	return
 }
 
+// WriteContext is Write that returns ctx.Err() if ctx is done before the
+// message is queued, a queued message is sent and resent until acked. The
+// messages of PriorityOf(ctx) are queued on a pending channel of its weight
+func (c *UDPConn) WriteContext(ctx context.Context, bytes []byte) (err error) {
+	err = c.writeToChannel(ctx, c.priorityChannel(PriorityOf(ctx)), bytes, msg.TYPE_NORMAL, time.Time{})
+	return
+}
+
 func (c *UDPConn) WriteToChannel(channel int, bytes []byte) (err error) {
-	err = c.writeToChannel(channel, bytes, msg.TYPE_NORMAL)
+	err = c.writeToChannel(context.Background(), channel, bytes, msg.TYPE_NORMAL, time.Time{})
 	return
 }
 
-func (c *UDPConn) writeToChannel(channel int, bytes []byte, msgt byte) (err error) {
+func (c *UDPConn) writeToChannel(ctx context.Context, channel int, bytes []byte, msgt byte, deadline time.Time) (err error) {
+	if c.IsClosing() {
+		return ErrConnClosing
+	}
+	if channel == 0 {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		ok, err := c.coalesce(msgt == msg.TYPE_NORMAL && deadline.IsZero(), bytes)
+		if ok || err != nil {
+			return err
+		}
+	}
+	return c.sendToChannel(ctx, channel, bytes, msgt, deadline)
+}
+
+func (c *UDPConn) sendToChannel(ctx context.Context, channel int, bytes []byte, msgt byte, deadline time.Time) (err error) {
+	if c.IsClosing() {
+		return ErrConnClosing
+	}
+	if PriorityOf(ctx) < PRIORITY_CONTROL {
+		err = c.waitWriteContext(ctx, len(bytes))
+		if err != nil {
+			return
+		}
+	}
 	if len(bytes) > MAX_UDP_PACKAGE_SIZE {
 		for i := 0; i < len(bytes)/MAX_UDP_PACKAGE_SIZE; i++ {
-			err = c.addToChannel(channel, bytes[i*MAX_UDP_PACKAGE_SIZE:(i+1)*MAX_UDP_PACKAGE_SIZE], msgt)
+			err = c.addToChannel(ctx, channel, bytes[i*MAX_UDP_PACKAGE_SIZE:(i+1)*MAX_UDP_PACKAGE_SIZE], msgt, deadline)
 			if err != nil {
 				return
 			}
 		}
 		i := len(bytes) % MAX_UDP_PACKAGE_SIZE
 		if i > 0 {
-			err = c.addToChannel(channel, bytes[len(bytes)-i:], msgt)
+			err = c.addToChannel(ctx, channel, bytes[len(bytes)-i:], msgt, deadline)
 			if err != nil {
 				return
 			}
 		}
 	} else {
-		err = c.addToChannel(channel, bytes, msgt)
+		err = c.addToChannel(ctx, channel, bytes, msgt, deadline)
 	}
 	return
 }
 
-func (c *UDPConn) addToChannel(channel int, bytes []byte, msgt byte) (err error) {
+func (c *UDPConn) addToChannel(ctx context.Context, channel int, bytes []byte, msgt byte, deadline time.Time) (err error) {
+	if c.writeDeadlineExceeded() {
+		return ErrTimeout
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if msgt != msg.TYPE_REQ {
+		msgt, bytes = c.compressBody(msgt, bytes)
+		// aead bodies are sealed once here so the length is fixed before it counts in flight
+		crypto := c.GetCrypto()
+		if crypto != nil && crypto.IsAEAD() {
+			bytes, err = crypto.SealPacket(bytes)
+			if err != nil {
+				return
+			}
+		}
+	}
 	m := msg.NewUDPWithoutSeq(msgt, bytes)
+	if !deadline.IsZero() {
+		m.SetDeadline(deadline)
+	}
+	err = c.reserveMemoryContext(ctx, m.PkgBytesLen())
+	if err != nil {
+		m.Release()
+		return
+	}
 	c.addToPendingChannel(channel, m)
-	c.pacingChan <- struct{}{}
+	// writes wait for the write loop to take the wake up so they are held
+	// back while it is behind. The message is queued, a wait cut short by ctx
+	// or the write deadline leaves it to the wake up pending
+	select {
+	case c.pacingChan <- struct{}{}:
+		return
+	default:
+	}
+	var timeout <-chan time.Time
+	if d := c.GetWriteDeadline(); !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.pacingChan <- struct{}{}:
+	case <-timeout:
+	case <-ctx.Done():
+	case <-c.disconnected:
+		err = ErrConnClosed
+	}
 	return
 }
 
 func (c *UDPConn) resendCallback(m *msg.UDPMessage) (err error) {
 	c.AddRTOResendCount()
+	c.rto.timeout(m.GetResendCount())
 	err = c.resendMsg(m)
 	if err != nil {
 		c.SetStatusToError(err)
@@ -263,9 +367,11 @@ func (c *UDPConn) transmitted(m *msg.UDPMessage) {
 	seq := m.GetSeq()
 	c.ca.updateLastSentSeq(seq)
 	c.ca.checkAppLimited(seq)
+	// released by delMsg
+	m.Retain()
 	c.addMsg(seq, m)
 	m.Transmitted()
-	m.SetRTO(c.getRTO(), c.resendCallback)
+	m.SetRTO(c.getRTO(m), c.resendCallback)
 	m.UpdateState(c.getDelivered(), c.getDeliveredTime(), c.getSentTime())
 }
 
@@ -281,10 +387,17 @@ func (c *UDPConn) resendMsg(m *msg.UDPMessage) (err error) {
 }
 
 func (c *UDPConn) writePendingMsgs() (err error) {
-	c.ca.nextPacingMutex.Lock()
-	defer c.ca.nextPacingMutex.Unlock()
+	c.ca.pacer.Lock()
+	defer c.ca.pacer.Unlock()
+	defer func() {
+		e := c.flushBatch()
+		if err == nil {
+			err = e
+		}
+	}()
 	for {
-		if !c.ca.isPacingTime() {
+		if d := c.ca.pacer.wait(time.Now()); d > 0 {
+			c.resetPacingTimer(d)
 			return nil
 		}
 		m := c.ca.popMessage()
@@ -292,64 +405,88 @@ func (c *UDPConn) writePendingMsgs() (err error) {
 		if m == nil {
 			return nil
 		}
-		tx := !m.IsTransmitted()
-		if tx {
-			m.SetSeq(c.GetNextSeq())
-			c.GetContextLogger().Debugf("new msg seq %d", m.GetSeq())
-		} else {
-			c.GetContextLogger().Debugf("resend msg seq %d", m.GetSeq())
+		err = c.writePendingMsg(m)
+		m.Release()
+		if err != nil {
+			return
 		}
-		var pkgBytes []byte
-		switch m.Type {
-		case msg.TYPE_NORMAL, msg.TYPE_RESP:
-			pkgBytes = m.GetCache()
-			if len(pkgBytes) == 0 {
-				pkgBytes = m.PkgBytes()
-				crypto := c.GetCrypto()
-				if crypto != nil {
-					err = crypto.Encrypt(pkgBytes[msg.PKG_HEADER_SIZE+msg.MSG_HEADER_END:])
-					if err != nil {
-						return
-					}
+	}
+}
+
+// writePendingMsg sends a popped message, a new one also waits for its ack
+func (c *UDPConn) writePendingMsg(m *msg.UDPMessage) (err error) {
+	tx := !m.IsTransmitted()
+	if tx {
+		m.SetSeq(c.GetNextSeq())
+		c.GetContextLogger().Debugf("new msg seq %d", m.GetSeq())
+	} else {
+		c.GetContextLogger().Debugf("resend msg seq %d", m.GetSeq())
+		if !m.IsSkipped() && m.Expired(time.Now()) {
+			c.skip(m)
+		}
+	}
+	var pkgBytes []byte
+	pooled := false
+	switch m.Type &^ msg.TYPE_FLAG_COMPRESSED {
+	case msg.TYPE_NORMAL, msg.TYPE_RESP, msg.TYPE_BATCH:
+		pkgBytes = m.GetCache()
+		if len(pkgBytes) == 0 {
+			// resends reuse the cache while a batch may still hold it, so
+			// it is not pooled
+			pkgBytes = make([]byte, m.PkgBytesLen())
+			m.PutPkg(pkgBytes)
+			crypto := c.GetCrypto()
+			if crypto != nil && !crypto.IsAEAD() {
+				err = crypto.Encrypt(pkgBytes[msg.PKG_HEADER_SIZE+msg.MSG_HEADER_END:])
+				if err != nil {
+					return
 				}
-				m.SetCache(pkgBytes)
 			}
-			err = c.WriteBytes(pkgBytes)
-		case msg.TYPE_REQ:
-			c.AddDirectlyHistory(m.GetSeq())
-			pkgBytes = m.PkgBytes()
-			err = c.WriteBytes(pkgBytes)
+			m.SetCache(pkgBytes)
 		}
+	case msg.TYPE_REQ:
+		c.AddDirectlyHistory(m.GetSeq())
+		pkgBytes = m.PkgBytes()
+		pooled = true
+	}
+	// the encoder copies pkgBytes, it has to run before a pooled one is queued
+	var ps [][]byte
+	if tx {
+		ps, err = c.fecEncoder.encode(pkgBytes[msg.PKG_HEADER_SIZE:])
 		if err != nil {
+			if pooled {
+				msg.PutBuffer(pkgBytes)
+			}
 			return err
 		}
-		d := c.ca.calcPacingTime(m.PkgBytesLen())
-		c.pacingTimerMutex.Lock()
-		c.pacingTimer.Reset(d)
-		c.pacingTimerMutex.Unlock()
-		if tx {
-			c.transmitted(m)
-			ps, err := c.fecEncoder.encode(pkgBytes[msg.PKG_HEADER_SIZE:])
-			if err != nil {
-				return err
-			}
-			if len(ps) > 0 {
-				for _, v := range ps {
-					err = c.WriteBytes(fec(v, c.GetNextSeq()))
-					if err != nil {
-						return err
-					}
+	}
+	err = c.queueBytes(pkgBytes, pooled)
+	if err != nil {
+		return err
+	}
+	c.sentPacket(len(pkgBytes))
+	if tx {
+		c.transmitted(m)
+		if len(ps) > 0 {
+			for _, v := range ps {
+				p := fec(v, c.GetNextSeq())
+				err = c.queueBytes(p, true)
+				c.sentPacket(len(p))
+				if err != nil {
+					return err
 				}
 			}
-		} else {
-			m.SetRTO(c.getRTO(), c.resendCallback)
 		}
+	} else {
+		m.SetRTO(c.getRTO(m), c.resendCallback)
 	}
+	return
 }
 
+// fec returns a pooled buffer, put it back after it was written
 func fec(b []byte, seq uint32) (result []byte) {
 	hz := msg.PKG_HEADER_SIZE + msg.MSG_HEADER_SIZE
-	result = make([]byte, hz+len(b))
+	result = msg.GetBuffer(hz + len(b))
 	l := copy(result[hz:], b)
 	m := result[msg.PKG_HEADER_SIZE:]
 	m[0] = msg.TYPE_FEC
@@ -362,6 +499,17 @@ func (c *UDPConn) Process(t byte, m []byte) (err error) {
 	seq := binary.BigEndian.Uint32(m[msg.MSG_SEQ_BEGIN:msg.MSG_SEQ_END])
 	l := binary.BigEndian.Uint32(m[msg.MSG_LEN_BEGIN:msg.MSG_LEN_END])
 	c.GetContextLogger().Debugf("seq %d l %d, len %d \n%x", seq, l, len(m), m)
+	c.recordArrival(t, seq, len(m))
+	if t == msg.TYPE_SKIP {
+		// not a shard of the fec group, that was encoded with the skipped message
+		return c.process(t, seq, nil)
+	}
+	if t&^msg.TYPE_FLAG_COMPRESSED == msg.TYPE_UNRELIABLE {
+		if uint32(len(m)) >= msg.MSG_HEADER_END+l {
+			err = c.processUnreliable(t, seq, m[msg.MSG_HEADER_END:msg.MSG_HEADER_END+l])
+		}
+		return
+	}
 	if t == msg.TYPE_FEC {
 		m = m[msg.MSG_HEADER_END:]
 	}
@@ -402,7 +550,20 @@ func (c *UDPConn) Process(t byte, m []byte) (err error) {
 }
 
 func (c *UDPConn) process(t byte, seq uint32, m []byte) (err error) {
-	switch t {
+	if t&^msg.TYPE_FLAG_COMPRESSED != msg.TYPE_REQ && !c.allowRead(len(m)) {
+		c.GetContextLogger().Debugf("rate limited seq %d", seq)
+		return
+	}
+	// not acked beyond the memory limit, so the peer sends it again later
+	if !c.tryReserveMemory(len(m)) {
+		c.GetContextLogger().Debugf("memory limited seq %d", seq)
+		return
+	}
+	held := c.HeldBytes()
+	defer func() {
+		c.releaseMemory(len(m) - (c.HeldBytes() - held))
+	}()
+	switch t &^ msg.TYPE_FLAG_COMPRESSED {
 	case msg.TYPE_REQ:
 		if c.DirectlyHistoryLen() > 0 {
 			seq := c.RemoveDirectlyHistory()
@@ -420,7 +581,7 @@ func (c *UDPConn) process(t byte, seq uint32, m []byte) (err error) {
 			}
 		}
 		fallthrough
-	case msg.TYPE_NORMAL:
+	case msg.TYPE_NORMAL, msg.TYPE_BATCH, msg.TYPE_SKIP:
 		err = c.Ack(seq)
 		if err != nil {
 			return
@@ -429,84 +590,137 @@ func (c *UDPConn) process(t byte, seq uint32, m []byte) (err error) {
 	ok, ms := c.Push(seq, msg.NewUDP(t, seq, m))
 	if ok {
 		for _, m := range ms {
+			if m.Type == msg.TYPE_SKIP {
+				c.GetContextLogger().Debugf("skip seq %d", m.GetSeq())
+				continue
+			}
 			if m.Type != msg.TYPE_REQ {
 				c.GetContextLogger().Debugf("MustGetCrypto t %d seq %d \n%x", m.Type, m.GetSeq(), m.Body)
 				crypto := c.MustGetCrypto()
-				err = crypto.Decrypt(m.Body)
+				if crypto.IsAEAD() {
+					m.Body, err = crypto.OpenPacket(m.Body)
+					if err == ErrReplayed {
+						c.GetContextLogger().Debugf("drop replayed seq %d", m.GetSeq())
+						c.drop(DROP_REPLAYED, len(m.Body), 0)
+						err = nil
+						continue
+					}
+				} else {
+					err = crypto.Decrypt(m.Body)
+				}
 				c.GetContextLogger().Debugf("MustGetCrypto out t %d seq %d \n%x", m.Type, m.GetSeq(), m.Body)
 				if err != nil {
 					return
 				}
 			}
-			c.In <- m.Body
+			body := m.Body
+			if m.Type&msg.TYPE_FLAG_COMPRESSED > 0 {
+				body, err = decompressBody(body)
+				if err != nil {
+					return
+				}
+			}
+			if m.Type&^msg.TYPE_FLAG_COMPRESSED != msg.TYPE_BATCH {
+				// rate limited before the ack
+				err = c.pushIn(body)
+				if err != nil {
+					return
+				}
+				continue
+			}
+			var batch [][]byte
+			batch, err = splitBatch(body)
+			if err != nil {
+				return
+			}
+			for _, b := range batch {
+				err = c.pushIn(b)
+				if err != nil {
+					return
+				}
+			}
 		}
 	}
 	return
 }
 
 func (c *UDPConn) WriteReq(bytes []byte) (err error) {
-	err = c.writeToChannel(0, bytes, msg.TYPE_REQ)
+	err = c.writeToChannel(context.Background(), 0, bytes, msg.TYPE_REQ, time.Time{})
 	return
 }
 
 func (c *UDPConn) WriteResp(bytes []byte) (err error) {
-	err = c.writeToChannel(0, bytes, msg.TYPE_RESP)
+	err = c.writeToChannel(context.Background(), 0, bytes, msg.TYPE_RESP, time.Time{})
 	return
 }
 
 func (c *UDPConn) WriteBytes(bytes []byte) (err error) {
-	checksum := crc32.ChecksumIEEE(bytes[msg.PKG_CRC32_END:])
-	binary.BigEndian.PutUint32(bytes[msg.PKG_CRC32_BEGIN:], checksum)
+	c.PutChecksum(bytes)
 	l := len(bytes)
 	c.AddSentBytes(l)
-	n, err := c.UdpConn.WriteToUDP(bytes, c.addr)
+	n, err := c.writeTo(bytes)
 	c.GetContextLogger().Debugf("write out %x", bytes)
 	if err == nil && n != l {
-		return errors.New("nothing was written")
+		return errNothingWritten
 	}
-	return
+	return sockError(err)
+}
+
+// writeTo writes to the address of the connection, a client socket is
+// connected to it already
+func (c *UDPConn) writeTo(bytes []byte) (int, error) {
+	if c.UdpConn.RemoteAddr() != nil {
+		return c.UdpConn.Write(bytes)
+	}
+	return c.UdpConn.WriteToUDP(bytes, c.getAddr())
 }
 
 func (c *UDPConn) WriteExt(bytes []byte) (err error) {
 	l := len(bytes)
 	c.AddSentBytes(l)
-	n, err := c.UdpConn.WriteToUDP(bytes, c.addr)
+	n, err := c.writeTo(bytes)
 	c.GetContextLogger().Debugf("write out %x", bytes)
 	if err == nil && n != l {
-		return errors.New("nothing was written")
+		return errNothingWritten
 	}
-	return
-}
-
-func (c *UDPConn) Ack(seq uint32) error {
-	atomic.StoreUint32(&c.lastAck, seq)
-	atomic.AddUint32(&c.lastCnt, 1)
-	c.lastAckCond.Broadcast()
-	return nil
+	return sockError(err)
 }
 
 func (c *UDPConn) ack(seq uint32) error {
 	nSeq := c.GetNextAckSeq()
 	c.GetContextLogger().Debugf("ack %d, next %d", seq, nSeq)
 	var missing []uint32
-	var ml int
 	if seq > nSeq+1 {
 		missing = c.GetMissingSeqs(nSeq+1, seq)
 		c.GetContextLogger().Debugf("missing %v", missing)
-		ml = len(missing)
 	}
-	p := make([]byte, msg.ACK_HEADER_SIZE+msg.PKG_HEADER_SIZE+4*ml)
+	if !c.isAckWindow() {
+		seq, missing = ackMissing(seq, missing)
+		if c.suppressAck(seq, nSeq, 0, len(missing)) {
+			c.GetContextLogger().Debugf("suppress ack %d, next %d", seq, nSeq)
+			return nil
+		}
+		return c.legacyAck(seq, nSeq, missing)
+	}
+	var ranges [][2]uint32
+	if len(missing) > 0 {
+		seq, ranges = ackRanges(seq, missing)
+	}
+	window := c.recvWindow()
+	if c.suppressAck(seq, nSeq, window, len(ranges)) {
+		c.GetContextLogger().Debugf("suppress ack %d, next %d", seq, nSeq)
+		return nil
+	}
+	p := msg.GetBuffer(msg.ACK_WINDOW_HEADER_SIZE + msg.PKG_HEADER_SIZE + ACK_RANGE_SIZE*len(ranges))
+	defer msg.PutBuffer(p)
 	m := p[msg.PKG_HEADER_SIZE:]
-	m[msg.ACK_TYPE_BEGIN] = msg.TYPE_ACK
+	m[msg.ACK_TYPE_BEGIN] = msg.TYPE_ACK_WINDOW
 	binary.BigEndian.PutUint32(m[msg.ACK_SEQ_BEGIN:], seq)
 	binary.BigEndian.PutUint32(m[msg.ACK_NEXT_SEQ_BEGIN:], nSeq)
+	binary.BigEndian.PutUint32(m[msg.ACK_WINDOW_BEGIN:], window)
+	putAckRanges(m[msg.ACK_WINDOW_END:], ranges)
 
-	for i, v := range missing {
-		binary.BigEndian.PutUint32(m[msg.ACK_NEXT_SEQ_END+i*4:], v)
-	}
-
-	checksum := crc32.ChecksumIEEE(m)
-	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], checksum)
+	c.PutChecksum(p)
 	return c.WriteExt(p)
 }
 
@@ -516,6 +730,21 @@ func (c *UDPConn) RecvAck(m []byte) (err error) {
 	}
 	seq := binary.BigEndian.Uint32(m[msg.ACK_SEQ_BEGIN:msg.ACK_SEQ_END])
 	ns := binary.BigEndian.Uint32(m[msg.ACK_NEXT_SEQ_BEGIN:msg.ACK_NEXT_SEQ_END])
+	// missing seqs, ranges of them in a windowed ack
+	var ranges [][2]uint32
+	if m[msg.ACK_TYPE_BEGIN] == msg.TYPE_ACK_WINDOW {
+		if len(m) < msg.ACK_WINDOW_HEADER_SIZE {
+			return fmt.Errorf("invalid ack msg %x", m)
+		}
+		c.EnableAckWindow()
+		c.ca.setRwnd(binary.BigEndian.Uint32(m[msg.ACK_WINDOW_BEGIN:msg.ACK_WINDOW_END]))
+		ranges = getAckRanges(m[msg.ACK_WINDOW_END:])
+	} else {
+		for i := msg.ACK_NEXT_SEQ_END; len(m)-i >= 4; i += 4 {
+			v := binary.BigEndian.Uint32(m[i:])
+			ranges = append(ranges, [2]uint32{v, v + 1})
+		}
+	}
 
 	c.GetContextLogger().Debugf("recv ack %d, next %d", seq, ns)
 	err = c.delMsg(seq, false)
@@ -531,36 +760,36 @@ func (c *UDPConn) RecvAck(m []byte) (err error) {
 	}
 
 	if seq > ns+1 {
-		i := msg.ACK_NEXT_SEQ_END
-		mm := make(map[uint32]struct{})
-		for len(m)-i >= 4 {
-			v := binary.BigEndian.Uint32(m[i:])
-			mm[v] = struct{}{}
-			i = i + 4
-		}
-		c.GetContextLogger().Debugf("recover ack [%d-%d) missing %v", ns+1, seq, mm)
+		c.GetContextLogger().Debugf("recover ack [%d-%d) missing %v", ns+1, seq, ranges)
 
+		r := 0
 		for j := ns + 1; j < seq; j++ {
-			if _, ok := mm[j]; !ok {
-				err = c.delMsg(j, true)
-				if err != nil {
-					return
-				}
+			for r < len(ranges) && ranges[r][1] <= j {
+				r++
+			}
+			if r < len(ranges) && ranges[r][0] <= j {
+				continue
+			}
+			err = c.delMsg(j, true)
+			if err != nil {
+				return
 			}
 		}
 	}
 
-	return
+	return c.recvDupAck(seq, ns)
 }
 
 func (c *UDPConn) Ping() error {
 	c.GetContextLogger().Debug("ping")
-	p := make([]byte, msg.PING_MSG_HEADER_SIZE+msg.PKG_HEADER_SIZE)
+	id := c.GetConnID()
+	p := msg.GetBuffer(msg.PING_MSG_HEADER_SIZE + msg.PKG_HEADER_SIZE + len(id))
+	defer msg.PutBuffer(p)
 	m := p[msg.PKG_HEADER_SIZE:]
 	m[msg.PING_MSG_TYPE_BEGIN] = msg.TYPE_PING
 	binary.BigEndian.PutUint64(m[msg.PING_MSG_TIME_BEGIN:], msg.UnixMillisecond())
-	checksum := crc32.ChecksumIEEE(m)
-	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], checksum)
+	copy(m[msg.PING_MSG_HEADER_SIZE:], id)
+	c.PutChecksum(p)
 	return c.WriteExt(p)
 }
 
@@ -568,6 +797,18 @@ func (c *UDPConn) GetNextSeq() uint32 {
 	return atomic.AddUint32(&c.seq, 1)
 }
 
+// WaitForAcks also waits for the messages not sent yet
+func (c *UDPConn) WaitForAcks(timeout time.Duration) error {
+	return c.waitFor(func() bool {
+		return c.PendingLen() == 0 && atomic.LoadInt32(&c.ca.pendingCnt) == 0
+	}, timeout)
+}
+
+func (c *UDPConn) CloseGracefully(timeout time.Duration) error {
+	c.Flush()
+	return CloseGracefully(c, timeout)
+}
+
 func (c *UDPConn) Close() {
 	c.ConnCommonFields.Close()
 }
@@ -578,34 +819,26 @@ func (c *UDPConn) String() string {
 			rtoResend:%d,
 			lossResend:%d,
 			ack:%d,
-			overAck:%d,`,
+			overAck:%d,
+			dupAck:%d,
+			suppressedAck:%d,
+			compression:%s %.2f,
+			replays:%d,`,
 		c.GetRemoteAddr().String(),
 		atomic.LoadUint32(&c.rtoResendCount),
 		atomic.LoadUint32(&c.lossResendCount),
 		atomic.LoadUint32(&c.ackCount),
 		atomic.LoadUint32(&c.overAckCount),
+		atomic.LoadUint32(&c.dupAckCount),
+		atomic.LoadUint32(&c.suppressedAckCount),
+		c.GetCompression(),
+		c.GetCompressionRatio(),
+		c.getReplayCount(),
 	)
 }
 
 func (c *UDPConn) GetRemoteAddr() net.Addr {
-	return c.addr
-}
-
-func (c *UDPConn) getRTO() (rto time.Duration) {
-	c.FieldsMutex.RLock()
-	rto = c.rto
-	c.FieldsMutex.RUnlock()
-	return
-}
-
-func (c *UDPConn) setRTO(rto time.Duration) {
-	c.GetContextLogger().Debugf("setRTO %d", rto)
-	if rto < 100*time.Millisecond {
-		rto = 100 * time.Millisecond
-	}
-	c.FieldsMutex.Lock()
-	c.rto = rto
-	c.FieldsMutex.Unlock()
+	return c.getAddr()
 }
 
 func (c *UDPConn) addMsg(k uint32, v *msg.UDPMessage) {
@@ -639,6 +872,8 @@ func (c *UDPConn) delMsg(seq uint32, ignore bool) error {
 		c.ca.bifMtx.Lock()
 		c.ca.bif -= um.PkgBytesLen()
 		c.ca.bifMtx.Unlock()
+		c.releaseMemory(um.PkgBytesLen())
+		um.Release()
 		return c.writePendingMsgs()
 	} else if !ignore {
 		c.GetContextLogger().Debugf("over ack %s", c)
@@ -671,8 +906,12 @@ func (c *UDPConn) IsUDP() bool {
 	return true
 }
 
-func (c *UDPConn) getRTT() time.Duration {
-	return time.Duration(atomic.LoadInt64((*int64)(&c.rtt)))
+func (c *UDPConn) getReplayCount() uint64 {
+	crypto := c.GetCrypto()
+	if crypto == nil {
+		return 0
+	}
+	return crypto.GetReplayCount()
 }
 
 type rttSampler struct {
@@ -731,21 +970,8 @@ func (c *UDPConn) updateRTT(t time.Duration) {
 	if t <= 0 {
 		panic("updateRTT t <= 0")
 	}
-	r := c.rttSamples.push(rtt(t))
-	if r <= 0 {
-		return
-	}
-	for {
-		ot := c.getRTT()
-		if time.Duration(r) != ot {
-			ok := atomic.CompareAndSwapInt64((*int64)(&c.rtt), int64(ot), int64(r))
-			if !ok {
-				continue
-			}
-			c.setRTO(t * 3)
-		}
-		break
-	}
+	c.rto.sample(t)
+	c.rttSamples.push(rtt(t))
 }
 
 const rttUnit = time.Microsecond
@@ -852,12 +1078,12 @@ type ca struct {
 	bwFilter        *maxBandwidthFilter
 	cwnd            uint32
 	usedCwnd        uint32
+	rwnd            uint32 // receive window of the peer
 	cwndMtx         sync.Mutex
 	mode
 	pacingGain      int
 	pacingRate      uint64
-	nextPacingTime  time.Time
-	nextPacingMutex sync.RWMutex
+	pacer           pacer
 	lastCycleStart  time.Time
 	cycleOffset     int
 	cwndGain        int
@@ -869,6 +1095,10 @@ type ca struct {
 	bifMtx     sync.RWMutex
 	bifPdId    int
 	bifPdChans map[int]*pdChan
+	// channels in deficit round robin order, see popChannelMessage
+	bifPdOrder []int
+	drrPos     int
+	drrCharged bool
 
 	resendChan *reChan
 
@@ -890,12 +1120,16 @@ type pdChan struct {
 	cond  *sync.Cond
 	maxPd int
 	end   bool
+
+	weight  int
+	deficit int
 }
 
 func newPdChan(max int) *pdChan {
 	pd := &pdChan{
-		pd:    btree.New(2),
-		maxPd: max,
+		pd:     btree.New(2),
+		maxPd:  max,
+		weight: 1,
 	}
 	pd.cond = sync.NewCond(&pd.mtx)
 	return pd
@@ -917,6 +1151,7 @@ func newCA() *ca {
 		rttSamples: newRttSampler(16),
 		bwFilter:   newMaxBandwidthFilter(bandwidthWindowSize, 0, 0),
 		cwnd:       10,
+		rwnd:       MAX_CWND,
 		pacingGain: highGain,
 		pacingRate: highGain * 10 * BW_UNIT / 1000,
 		cwndGain:   highGain,
@@ -925,6 +1160,7 @@ func newCA() *ca {
 	}
 
 	c.bifPdChans[c.bifPdId] = newPdChan(100)
+	c.bifPdOrder = append(c.bifPdOrder, c.bifPdId)
 	return c
 }
 
@@ -956,6 +1192,7 @@ func (ca *ca) newPendingChannel() (channel int) {
 	ca.bifPdId++
 	channel = ca.bifPdId
 	ca.bifPdChans[channel] = newPdChan(10)
+	ca.bifPdOrder = append(ca.bifPdOrder, channel)
 	return
 }
 
@@ -1005,10 +1242,13 @@ func (ca *ca) addToPendingChannel(channel int, m *msg.UDPMessage) {
 
 func (ca *ca) addToResendChannel(m *msg.UDPMessage) {
 	ca.resendChan.mtx.Lock()
-	ca.resendChan.pd.ReplaceOrInsert(m)
+	if ca.resendChan.pd.ReplaceOrInsert(m) == nil {
+		m.Retain()
+	}
 	ca.resendChan.mtx.Unlock()
 }
 
+// popMessage returns a message to send, release it after
 func (ca *ca) popMessage() (m *msg.UDPMessage) {
 	ca.resendChan.mtx.Lock()
 	for {
@@ -1019,6 +1259,7 @@ func (ca *ca) popMessage() (m *msg.UDPMessage) {
 		m = element.(*msg.UDPMessage)
 		ca.resendChan.pd.DeleteMin()
 		if m.IsAcked() {
+			m.Release()
 			m = nil
 			continue
 		}
@@ -1029,46 +1270,21 @@ func (ca *ca) popMessage() (m *msg.UDPMessage) {
 
 	ca.cwndMtx.Lock()
 	defer ca.cwndMtx.Unlock()
-	if ca.cwnd < ca.usedCwnd+1 {
-		logrus.Debugf("popMessage cwnd %d used %d", ca.cwnd, ca.usedCwnd)
+	if ca.windowFull() {
+		WithSubsystem(GetLogger(), LOG_CONN).Debugf("popMessage cwnd %d rwnd %d used %d", ca.cwnd, ca.rwnd, ca.usedCwnd)
 		return
 	}
 
 	ca.bifMtx.Lock()
 	defer ca.bifMtx.Unlock()
 	defer ca.gcChannel()
-OUT:
-	for _, v := range ca.bifPdChans {
-		v.mtx.Lock()
-		pd := v.pd
-		if pd.Len() < 1 {
-			v.mtx.Unlock()
-			continue
-		}
-		for {
-			element := pd.Min()
-			if element == nil {
-				v.mtx.Unlock()
-				continue OUT
-			}
-			m = element.(*msg.UDPMessage)
-			pd.DeleteMin()
-			if m.IsAcked() {
-				m = nil
-				continue
-			}
-			break
-		}
-
-		ca.usedCwnd++
-		v.mtx.Unlock()
-		v.cond.Broadcast()
-		atomic.AddInt32(&ca.pendingCnt, -1)
-
-		ca.bif += m.PkgBytesLen()
+	m = ca.popChannelMessage()
+	if m == nil {
 		return
 	}
-
+	ca.usedCwnd++
+	atomic.AddInt32(&ca.pendingCnt, -1)
+	ca.bif += m.PkgBytesLen()
 	return
 }
 
@@ -1084,6 +1300,7 @@ func (ca *ca) gcChannel() {
 	}
 	for _, id := range ids {
 		delete(ca.bifPdChans, id)
+		ca.removeFromOrder(id)
 	}
 }
 
@@ -1118,8 +1335,8 @@ func (ca *ca) isCwndFull() (r bool) {
 func (ca *ca) setCwnd(cwnd uint32) {
 	if cwnd < 4 {
 		cwnd = 4
-	} else if cwnd > 200 {
-		cwnd = 200
+	} else if cwnd > MAX_CWND {
+		cwnd = MAX_CWND
 	}
 
 	ca.cwndMtx.Lock()
@@ -1135,20 +1352,6 @@ func (ca *ca) setPacingRate(rate uint64) {
 	atomic.StoreUint64(&ca.pacingRate, rate)
 }
 
-func (ca *ca) calcPacingTime(len int) (d time.Duration) {
-	d = time.Duration(uint64(len*1000000000) / ca.getPacingRate())
-	r := time.Now().Add(d)
-	logrus.Debugf("calcPacingTime %s", d)
-	ca.nextPacingTime = r
-	return
-}
-
-func (ca *ca) isPacingTime() (r bool) {
-	r = !time.Now().Before(ca.nextPacingTime)
-	logrus.Debugf("nextPacingTime %s %t", ca.nextPacingTime, r)
-	return
-}
-
 func (ca *ca) checkAppLimited(seq uint32) {
 	pd := atomic.LoadInt32(&ca.pendingCnt)
 	if pd > 0 {
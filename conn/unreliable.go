@@ -0,0 +1,95 @@
+package conn
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/net/msg"
+)
+
+var ErrUnreliableTooLarge = NewError(ErrTooLarge, "unreliable message is larger than a udp package")
+
+// WriteUnreliable sends bytes once, it is neither acked nor sent again and the
+// peer delivers it as it arrives, dropping it if a newer one was delivered
+// already. It is for apps that prefer the newest data over all data like voice
+// or games, bytes must fit into MAX_UDP_PACKAGE_SIZE. Such messages count
+// against the rate limits but not the congestion window or the pacing
+func (c *UDPConn) WriteUnreliable(bytes []byte) (err error) {
+	if c.IsClosing() {
+		return ErrConnClosing
+	}
+	if len(bytes) > MAX_UDP_PACKAGE_SIZE {
+		return ErrUnreliableTooLarge
+	}
+	if c.writeDeadlineExceeded() {
+		return ErrTimeout
+	}
+	err = c.waitWriteContext(context.Background(), len(bytes))
+	if err != nil {
+		return
+	}
+	t, body := c.compressBody(msg.TYPE_UNRELIABLE, bytes)
+	if crypto := c.GetCrypto(); crypto != nil {
+		body, err = crypto.SealDatagram(body)
+		if err != nil {
+			return
+		}
+	}
+	m := msg.New(t, atomic.AddUint32(&c.unreliableSeq, 1), body)
+	p := m.PkgBytes()
+	m.Release()
+	err = c.WriteBytes(p)
+	msg.PutBuffer(p)
+	return
+}
+
+func (c *UDPConn) processUnreliable(t byte, seq uint32, m []byte) (err error) {
+	if !c.allowRead(len(m)) {
+		c.GetContextLogger().Debugf("rate limited unreliable seq %d", seq)
+		c.drop(DROP_UNRELIABLE, len(m), 0)
+		return
+	}
+	body := m
+	if crypto := c.GetCrypto(); crypto != nil {
+		body, err = crypto.OpenDatagram(body)
+		if err != nil {
+			// lost like any other unreliable message
+			c.GetContextLogger().Debugf("drop unreliable seq %d: %v", seq, err)
+			c.drop(DROP_UNRELIABLE, len(m), 0)
+			return nil
+		}
+	}
+	if t&msg.TYPE_FLAG_COMPRESSED > 0 {
+		body, err = decompressBody(body)
+		if err != nil {
+			c.GetContextLogger().Debugf("drop unreliable seq %d: %v", seq, err)
+			c.drop(DROP_UNRELIABLE, len(m), 0)
+			return nil
+		}
+	}
+	if ok, err := c.reorderUnreliable(seq, body); ok {
+		return err
+	}
+	for {
+		last := atomic.LoadUint32(&c.unreliableRecv)
+		if int32(seq-last) <= 0 {
+			c.GetContextLogger().Debugf("drop unreliable seq %d, delivered %d", seq, last)
+			c.dropMessage(DROP_UNRELIABLE, body)
+			return
+		}
+		if atomic.CompareAndSwapUint32(&c.unreliableRecv, last, seq) {
+			break
+		}
+	}
+	return c.pushIn(body)
+}
+
+// WriteUnreliable is Write, tcp is always reliable
+func (c *TCPConn) WriteUnreliable(bytes []byte) error {
+	return c.Write(bytes)
+}
+
+// SetReorderWindow does nothing, tcp delivers every message in order
+func (c *TCPConn) SetReorderWindow(window int, wait time.Duration) {
+}
@@ -0,0 +1,83 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestWriteUnreliable(t *testing.T) {
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	as, bs := listen(), listen()
+	defer as.Close()
+	defer bs.Close()
+	a := NewUDPConn(as, bs.LocalAddr().(*net.UDPAddr))
+	b := NewUDPConn(bs, as.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+	defer b.Close()
+
+	ak, ask := cipher.GenerateKeyPair()
+	bk, bsk := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(16)
+	ac, bc := NewCrypto(ak, ask), NewCrypto(bk, bsk)
+	ac.SetTargetKey(bk)
+	bc.SetTargetKey(ak)
+	ac.Init(iv)
+	bc.Init(iv)
+	a.SetCrypto(ac)
+	b.SetCrypto(bc)
+
+	var packets [][]byte
+	for _, s := range []string{"first", "second", "third"} {
+		if err := a.WriteUnreliable([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MTU)
+		bs.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := bs.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.VerifyChecksum(buf[:n]) {
+			t.Fatal("checksum")
+		}
+		packets = append(packets, buf[msg.PKG_HEADER_SIZE:n])
+	}
+	if a.PendingLen() != 0 {
+		t.Fatalf("%d unreliable messages wait for an ack", a.PendingLen())
+	}
+	// the second arrives after the third and is dropped
+	for _, i := range []int{0, 2, 1} {
+		if err := b.Process(packets[i][msg.MSG_TYPE_BEGIN], packets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"first", "third"} {
+		select {
+		case m := <-b.GetChanIn():
+			if string(m) != want {
+				t.Fatalf("got %s want %s", m, want)
+			}
+		default:
+			t.Fatalf("%s not delivered", want)
+		}
+	}
+	select {
+	case m := <-b.GetChanIn():
+		t.Fatalf("late %s delivered", m)
+	default:
+	}
+
+	if err := a.WriteUnreliable(make([]byte, MAX_UDP_PACKAGE_SIZE+1)); err != ErrUnreliableTooLarge {
+		t.Fatalf("too large err %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package conn
+
+import "sync/atomic"
+
+// MAX_CWND bounds the congestion window in packets, the receive window of the
+// peer is the real limit
+const MAX_CWND = 4096
+
+// recvWindow is how many more packets the connection can take: the room left in
+// GetChanIn minus the packets waiting for reassembly, as they need that room too.
+// It is smaller under a memory limit
+func (c *UDPConn) recvWindow() uint32 {
+	w := cap(c.In) - len(c.In) - c.streamQueue.Len()
+	if free, ok := c.freeMemory(); ok && free/MAX_UDP_PACKAGE_SIZE < w {
+		w = free / MAX_UDP_PACKAGE_SIZE
+	}
+	if w < 0 {
+		w = 0
+	}
+	return uint32(w)
+}
+
+// EnableAckWindow makes the acks of c TYPE_ACK_WINDOW with the receive window
+// and the missing seqs as ranges. A peer that does not read them drops the
+// connection, so c sends TYPE_ACK until the peer offered them or sent one
+func (c *UDPConn) EnableAckWindow() {
+	atomic.StoreInt32(&c.ackWindow, 1)
+}
+
+func (c *UDPConn) isAckWindow() bool {
+	return atomic.LoadInt32(&c.ackWindow) == 1
+}
+
+// EnableAckWindow does nothing, tcp has no acks
+func (c *TCPConn) EnableAckWindow() {
+}
+
+// setRwnd takes the receive window of a windowed ack
+func (ca *ca) setRwnd(rwnd uint32) {
+	ca.cwndMtx.Lock()
+	ca.rwnd = rwnd
+	ca.cwndMtx.Unlock()
+}
+
+// windowFull must be called with cwndMtx held. With nothing in flight one packet
+// is sent even to a closed receive window, its ack tells when the window opens
+func (ca *ca) windowFull() bool {
+	w := ca.cwnd
+	if ca.rwnd < w {
+		w = ca.rwnd
+	}
+	return ca.usedCwnd > 0 && ca.usedCwnd >= w
+}
+
+// GetSendWindow returns how many packets may be in flight, the smaller of the
+// congestion window and the receive window of the peer
+func (c *UDPConn) GetSendWindow() uint32 {
+	c.ca.cwndMtx.Lock()
+	defer c.ca.cwndMtx.Unlock()
+	if c.ca.rwnd < c.ca.cwnd {
+		return c.ca.rwnd
+	}
+	return c.ca.cwnd
+}
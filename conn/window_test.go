@@ -0,0 +1,47 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/skycoin/net/msg"
+)
+
+func TestRecvWindow(t *testing.T) {
+	c := NewUDPConn(nil, nil)
+	defer c.Close()
+	c.SetChannelOptions(ChannelOptions{InSize: 8})
+	c.In <- []byte{1}
+	c.In <- []byte{2}
+	if w := c.recvWindow(); w != 6 {
+		t.Fatalf("window %d", w)
+	}
+	// out of order, waits for seq 1
+	c.Push(2, msg.NewUDP(msg.TYPE_NORMAL, 2, []byte{2}))
+	if w := c.recvWindow(); w != 5 {
+		t.Fatalf("window %d with reassembly", w)
+	}
+	c.SetMemoryLimit(3 * MAX_UDP_PACKAGE_SIZE)
+	if w := c.recvWindow(); w != 3 {
+		t.Fatalf("window %d with memory limit", w)
+	}
+}
+
+func TestWindowFull(t *testing.T) {
+	ca := newCA()
+	ca.rwnd = 0
+	if ca.windowFull() {
+		t.Fatal("no probe to a closed window")
+	}
+	ca.usedCwnd = 1
+	if !ca.windowFull() {
+		t.Fatal("closed window not full")
+	}
+	ca.rwnd = 20
+	if ca.windowFull() || ca.cwnd != 10 {
+		t.Fatal("window full")
+	}
+	ca.usedCwnd = 10
+	if !ca.windowFull() {
+		t.Fatal("cwnd not full")
+	}
+}
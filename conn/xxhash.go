@@ -0,0 +1,54 @@
+package conn
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	xxPrime32_1 = 2654435761
+	xxPrime32_2 = 2246822519
+	xxPrime32_3 = 3266489917
+	xxPrime32_4 = 668265263
+	xxPrime32_5 = 374761393
+)
+
+func xxRound32(acc, input uint32) uint32 {
+	return bits.RotateLeft32(acc+input*xxPrime32_2, 13) * xxPrime32_1
+}
+
+// xxhash32 is XXH32 with seed 0
+func xxhash32(b []byte) uint32 {
+	n := len(b)
+	var h, seed uint32
+	if n >= 16 {
+		v1 := seed + xxPrime32_1 + xxPrime32_2
+		v2 := seed + xxPrime32_2
+		v3 := seed
+		v4 := seed - xxPrime32_1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = xxRound32(v1, binary.LittleEndian.Uint32(b))
+			v2 = xxRound32(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = xxRound32(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = xxRound32(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxPrime32_5
+	}
+	h += uint32(n)
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * xxPrime32_3
+		h = bits.RotateLeft32(h, 17) * xxPrime32_4
+	}
+	for _, c := range b {
+		h += uint32(c) * xxPrime32_5
+		h = bits.RotateLeft32(h, 11) * xxPrime32_1
+	}
+	h ^= h >> 15
+	h *= xxPrime32_2
+	h ^= h >> 13
+	h *= xxPrime32_3
+	h ^= h >> 16
+	return h
+}
@@ -1,14 +1,35 @@
 package factory
 
-import "github.com/skycoin/net/conn"
+import (
+	"sync"
+
+	"github.com/skycoin/net/conn"
+)
 
 type Connection struct {
 	conn.Connection
-	factory    Factory
-	RealObject interface{}
+	factory Factory
+	// set by the owner of the connection, use Get/SetRealObject once
+	// the connection is shared with other goroutines
+	RealObject      interface{}
+	realObjectMutex sync.RWMutex
 }
 
 func newConnection(connection conn.Connection, factory Factory) (c *Connection) {
 	c = &Connection{Connection: connection, factory: factory}
+	c.MarkSetup(conn.SETUP_CONNECT)
+	return
+}
+
+func (c *Connection) SetRealObject(o interface{}) {
+	c.realObjectMutex.Lock()
+	c.RealObject = o
+	c.realObjectMutex.Unlock()
+}
+
+func (c *Connection) GetRealObject() (o interface{}) {
+	c.realObjectMutex.RLock()
+	o = c.RealObject
+	c.realObjectMutex.RUnlock()
 	return
 }
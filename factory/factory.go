@@ -1,17 +1,49 @@
 package factory
 
-import "sync"
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/skycoin/net/conn"
+)
 
 type Factory interface {
 	Listen(address string) error
 	Connect(address string) (conn *Connection, err error)
+	// ConnectContext is Connect that gives up once ctx is done
+	ConnectContext(ctx context.Context, address string) (conn *Connection, err error)
 	GetConns() (result []*Connection)
 	ForEachConn(fn func(connection *Connection))
+	ForEachAcceptedConn(fn func(connection *Connection))
 	Close() error
 }
 
 type FactoryCommonFields struct {
 	AcceptedCallback func(connection *Connection)
+	// applied to every new connection, the defaults if nil
+	ChannelOptions *conn.ChannelOptions
+	// applied to every new connection, unlimited if nil
+	RateLimit *conn.RateLimit
+	// shared by the writes of all connections with the weight 1, unlimited if nil
+	Bandwidth *conn.SharedBandwidth
+	// bytes each connection may hold, unlimited if 0
+	MemoryLimit int
+	// largest body of a received tcp message, msg.MAX_MESSAGE_SIZE if 0
+	MaxMessageSize uint32
+	// udp connections send a receiver report this often, never if 0
+	ReceiverReportInterval time.Duration
+	// udp connections deliver unreliable messages in order, see
+	// conn.UDPConn.SetReorderWindow. Off if 0
+	ReorderWindow int
+	ReorderWait   time.Duration
+	// applied to every new connection, conn.DefaultIdlePolicy if nil
+	IdlePolicy *conn.IdlePolicy
+	// set on every new connection before it is connected, see conn.Hooks
+	Hooks *conn.Hooks
+	// of the listener and every new connection, the defaults if nil
+	SocketOptions *conn.SocketOptions
 
 	connections      map[*Connection]struct{}
 	connectionsMutex sync.RWMutex
@@ -26,6 +58,52 @@ func NewFactoryCommonFields() FactoryCommonFields {
 	return FactoryCommonFields{connections: make(map[*Connection]struct{}), acceptedConnections: make(map[*Connection]struct{})}
 }
 
+func (f *FactoryCommonFields) listenConfig() (lc net.ListenConfig) {
+	if f.SocketOptions != nil {
+		lc.Control = f.SocketOptions.Control
+	}
+	return
+}
+
+func (f *FactoryCommonFields) dialer() (d net.Dialer) {
+	if f.SocketOptions != nil {
+		d.Control = f.SocketOptions.Control
+	}
+	return
+}
+
+func (f *FactoryCommonFields) applyConnOptions(c conn.Connection) {
+	if f.ChannelOptions != nil {
+		if err := c.SetChannelOptions(*f.ChannelOptions); err != nil {
+			c.GetContextLogger().Debugf("channel options err %v", err)
+		}
+	}
+	if f.RateLimit != nil {
+		c.SetRateLimit(f.RateLimit)
+	}
+	if f.Bandwidth != nil {
+		c.SetSharedBandwidth(f.Bandwidth, 1)
+	}
+	if f.MemoryLimit > 0 {
+		c.SetMemoryLimit(f.MemoryLimit)
+	}
+	if f.MaxMessageSize > 0 {
+		c.SetMaxMessageSize(f.MaxMessageSize)
+	}
+	if f.ReceiverReportInterval > 0 {
+		c.SetReceiverReportInterval(f.ReceiverReportInterval)
+	}
+	if f.ReorderWindow > 0 {
+		c.SetReorderWindow(f.ReorderWindow, f.ReorderWait)
+	}
+	if f.IdlePolicy != nil {
+		c.SetIdlePolicy(*f.IdlePolicy)
+	}
+	if f.Hooks != nil {
+		c.SetHooks(*f.Hooks)
+	}
+}
+
 func (f *FactoryCommonFields) AddConn(conn *Connection) {
 	f.connectionsMutex.Lock()
 	f.connections[conn] = struct{}{}
@@ -72,6 +150,14 @@ func (f *FactoryCommonFields) ForEachConn(fn func(connection *Connection)) {
 	}
 }
 
+func (f *FactoryCommonFields) ForEachAcceptedConn(fn func(connection *Connection)) {
+	f.acceptedConnectionsMutex.RLock()
+	defer f.acceptedConnectionsMutex.RUnlock()
+	for k := range f.acceptedConnections {
+		fn(k)
+	}
+}
+
 func (f *FactoryCommonFields) RemoveConn(conn *Connection) {
 	f.connectionsMutex.Lock()
 	delete(f.connections, conn)
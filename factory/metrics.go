@@ -0,0 +1,102 @@
+package factory
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skycoin/net/conn"
+)
+
+const metricsPrefix = "skycoin_net_"
+
+type metric struct {
+	name, help, kind string
+	value            func(m *conn.Metrics) float64
+}
+
+var connMetrics = []metric{
+	{"conn_sent_bytes_total", "Bytes sent on the connection.", "counter",
+		func(m *conn.Metrics) float64 { return float64(m.SentBytes) }},
+	{"conn_received_bytes_total", "Bytes received on the connection.", "counter",
+		func(m *conn.Metrics) float64 { return float64(m.ReceivedBytes) }},
+	{"conn_rtt_seconds", "Round trip time of the connection.", "gauge",
+		func(m *conn.Metrics) float64 { return m.RTT.Seconds() }},
+	{"conn_rtt_p50_seconds", "Median ack latency of the connection.", "gauge",
+		func(m *conn.Metrics) float64 { return m.RTTP50.Seconds() }},
+	{"conn_rtt_p95_seconds", "95th percentile of the ack latencies of the connection.", "gauge",
+		func(m *conn.Metrics) float64 { return m.RTTP95.Seconds() }},
+	{"conn_rtt_p99_seconds", "99th percentile of the ack latencies of the connection.", "gauge",
+		func(m *conn.Metrics) float64 { return m.RTTP99.Seconds() }},
+	{"conn_retransmissions_total", "Messages sent again after a timeout or loss.", "counter",
+		func(m *conn.Metrics) float64 { return float64(m.Retransmissions) }},
+	{"conn_pending_messages", "Sent messages waiting for an ack.", "gauge",
+		func(m *conn.Metrics) float64 { return float64(m.PendingMessages) }},
+	{"conn_dropped_messages_total", "Received messages dropped by the overflow policy.", "counter",
+		func(m *conn.Metrics) float64 { return float64(m.DroppedMessages) }},
+	{"conn_setup_connect_seconds", "Time the connection took to dial or be accepted.", "gauge",
+		func(m *conn.Metrics) float64 { return m.Setup.Connect.Seconds() }},
+	{"conn_setup_handshake_seconds", "Time the crypto handshake took after the connect.", "gauge",
+		func(m *conn.Metrics) float64 { return m.Setup.Handshake.Seconds() }},
+	{"conn_setup_registration_seconds", "Time the key registration took after the handshake.", "gauge",
+		func(m *conn.Metrics) float64 { return m.Setup.Registration.Seconds() }},
+	{"conn_setup_first_services_seconds", "Time until the first services were offered after the registration.", "gauge",
+		func(m *conn.Metrics) float64 { return m.Setup.FirstServices.Seconds() }},
+}
+
+type connSample struct {
+	labels  string
+	metrics conn.Metrics
+}
+
+// MetricsHandler serves the connection statistics of factories in the
+// Prometheus text format
+func MetricsHandler(factories ...Factory) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var samples []connSample
+		counts := make(map[string]int)
+		collect := func(side string) func(c *Connection) {
+			return func(c *Connection) {
+				t := "udp"
+				if c.IsTCP() {
+					t = "tcp"
+				}
+				counts[fmt.Sprintf(`type="%s",side="%s"`, t, side)]++
+				samples = append(samples, connSample{
+					labels:  fmt.Sprintf(`type="%s",side="%s",addr="%s"`, t, side, escapeLabel(c.GetRemoteAddr().String())),
+					metrics: c.Metrics(),
+				})
+			}
+		}
+		for _, f := range factories {
+			f.ForEachConn(collect("client"))
+			f.ForEachAcceptedConn(collect("accepted"))
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		b := bufio.NewWriter(w)
+		fmt.Fprintf(b, "# HELP %sconnections Open connections.\n# TYPE %sconnections gauge\n", metricsPrefix, metricsPrefix)
+		for labels, n := range counts {
+			fmt.Fprintf(b, "%sconnections{%s} %d\n", metricsPrefix, labels, n)
+		}
+		for _, m := range connMetrics {
+			fmt.Fprintf(b, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, m.name, m.help, metricsPrefix, m.name, m.kind)
+			for i := range samples {
+				fmt.Fprintf(b, "%s%s{%s} %g\n", metricsPrefix, m.name, samples[i].labels, m.value(&samples[i].metrics))
+			}
+		}
+		drops := conn.GetDropStats()
+		fmt.Fprintf(b, "# HELP %sdropped_messages_total Messages of all connections dropped before the reader got them.\n# TYPE %sdropped_messages_total counter\n", metricsPrefix, metricsPrefix)
+		for reason, n := range drops.Counts {
+			fmt.Fprintf(b, "%sdropped_messages_total{reason=\"%s\"} %d\n", metricsPrefix, reason, n)
+		}
+		b.Flush()
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -1,7 +1,9 @@
 package factory
 
 import (
+	"context"
 	"net"
+	"time"
 
 	"github.com/skycoin/net/client"
 	"github.com/skycoin/net/server"
@@ -18,14 +20,12 @@ func NewTCPFactory() *TCPFactory {
 }
 
 func (factory *TCPFactory) Listen(address string) error {
-	addr, err := net.ResolveTCPAddr("tcp", address)
-	if err != nil {
-		return err
-	}
-	ln, err := net.ListenTCP("tcp", addr)
+	lc := factory.listenConfig()
+	l, err := lc.Listen(context.Background(), "tcp", address)
 	if err != nil {
 		return err
 	}
+	ln := l.(*net.TCPListener)
 	factory.fieldsMutex.Lock()
 	factory.listener = ln
 	factory.fieldsMutex.Unlock()
@@ -53,20 +53,37 @@ func (factory *TCPFactory) Close() error {
 
 func (factory *TCPFactory) createConn(c *net.TCPConn) *Connection {
 	tcpConn := server.NewServerTCPConn(c)
+	factory.applyConnOptions(tcpConn)
 	tcpConn.SetStatusToConnected()
 	conn := newConnection(tcpConn, factory)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "tcp"))
+	if err := factory.SocketOptions.Apply(c); err != nil {
+		conn.GetContextLogger().Debugf("socket options err %v", err)
+	}
 	factory.AddAcceptedConn(conn)
 	go factory.AcceptedCallback(conn)
 	return conn
 }
 
 func (factory *TCPFactory) Connect(address string) (conn *Connection, err error) {
-	c, err := net.Dial("tcp", address)
+	return factory.ConnectContext(context.Background(), address)
+}
+
+func (factory *TCPFactory) ConnectContext(ctx context.Context, address string) (conn *Connection, err error) {
+	start := time.Now()
+	d := factory.dialer()
+	c, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return
+	}
+	err = factory.SocketOptions.Apply(c)
 	if err != nil {
+		c.Close()
 		return
 	}
 	cn := client.NewClientTCPConn(c)
+	factory.applyConnOptions(cn)
+	cn.SetSetupStart(start)
 	cn.SetStatusToConnected()
 	conn = newConnection(cn, factory)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "tcp"))
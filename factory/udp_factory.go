@@ -1,6 +1,7 @@
 package factory
 
 import (
+	"context"
 	"net"
 	"sync"
 	"time"
@@ -17,23 +18,32 @@ type UDPFactory struct {
 
 	udpConnMapMutex sync.RWMutex
 	udpConnMap      map[string]*Connection
+	// by the connection ids of the clients, see MigrateConn
+	udpConnIDs map[string]*Connection
+
+	// new addresses echo a cookie before they get a connection, see
+	// conn.Cookies. Clients before cookies can not connect then
+	RequireCookies bool
 
 	stopGC chan bool
 }
 
 func NewUDPFactory() *UDPFactory {
-	udpFactory := &UDPFactory{stopGC: make(chan bool), FactoryCommonFields: NewFactoryCommonFields(), udpConnMap: make(map[string]*Connection)}
+	udpFactory := &UDPFactory{stopGC: make(chan bool), FactoryCommonFields: NewFactoryCommonFields(), udpConnMap: make(map[string]*Connection), udpConnIDs: make(map[string]*Connection)}
 	go udpFactory.GC()
 	return udpFactory
 }
 
 func (factory *UDPFactory) Listen(address string) error {
-	addr, err := net.ResolveUDPAddr("udp", address)
+	lc := factory.listenConfig()
+	pc, err := lc.ListenPacket(context.Background(), "udp", address)
 	if err != nil {
 		return err
 	}
-	udp, err := net.ListenUDP("udp", addr)
+	udp := pc.(*net.UDPConn)
+	err = factory.SocketOptions.Apply(udp)
 	if err != nil {
+		udp.Close()
 		return err
 	}
 	factory.fieldsMutex.Lock()
@@ -41,6 +51,10 @@ func (factory *UDPFactory) Listen(address string) error {
 	factory.fieldsMutex.Unlock()
 	go func() {
 		udpc := server.NewServerUDPConn(udp)
+		udpc.SetConnTable(udpConnTable{factory})
+		if factory.RequireCookies {
+			udpc.SetCookies(conn.NewCookies())
+		}
 		udpc.ReadLoop(factory.createConn)
 	}()
 	return nil
@@ -60,11 +74,16 @@ func (factory *UDPFactory) Close() error {
 func (factory *UDPFactory) createConn(c *net.UDPConn, addr *net.UDPAddr) *conn.UDPConn {
 	factory.udpConnMapMutex.Lock()
 	if cc, ok := factory.udpConnMap[addr.String()]; ok {
-		factory.udpConnMapMutex.Unlock()
-		return cc.Connection.(*conn.UDPConn)
+		if !cc.IsClosed() {
+			factory.udpConnMapMutex.Unlock()
+			return cc.Connection.(*conn.UDPConn)
+		}
+		// closed by the idle policy before GC removed it
+		factory.removeUDPConn(addr.String(), cc)
 	}
 
 	udpConn := conn.NewUDPConn(c, addr)
+	factory.applyConnOptions(udpConn)
 	udpConn.SetStatusToConnected()
 	connection := newConnection(udpConn, factory)
 	factory.udpConnMap[addr.String()] = connection
@@ -79,8 +98,11 @@ func (factory *UDPFactory) createConn(c *net.UDPConn, addr *net.UDPAddr) *conn.U
 func (factory *UDPFactory) createConnAfterListen(addr *net.UDPAddr) (*Connection, bool) {
 	factory.udpConnMapMutex.Lock()
 	if cc, ok := factory.udpConnMap[addr.String()]; ok {
-		factory.udpConnMapMutex.Unlock()
-		return cc, false
+		if !cc.IsClosed() {
+			factory.udpConnMapMutex.Unlock()
+			return cc, false
+		}
+		factory.removeUDPConn(addr.String(), cc)
 	}
 
 	factory.fieldsMutex.Lock()
@@ -88,6 +110,7 @@ func (factory *UDPFactory) createConnAfterListen(addr *net.UDPAddr) (*Connection
 	factory.fieldsMutex.Unlock()
 
 	udpConn := conn.NewUDPConn(ln, addr)
+	factory.applyConnOptions(udpConn)
 	udpConn.SendPing = true
 	udpConn.SetStatusToConnected()
 	connection := newConnection(udpConn, factory)
@@ -97,6 +120,68 @@ func (factory *UDPFactory) createConnAfterListen(addr *net.UDPAddr) (*Connection
 	return connection, true
 }
 
+type udpConnTable struct {
+	factory *UDPFactory
+}
+
+func (t udpConnTable) FindConn(addr *net.UDPAddr) *conn.UDPConn {
+	t.factory.udpConnMapMutex.RLock()
+	defer t.factory.udpConnMapMutex.RUnlock()
+	if cc, ok := t.factory.udpConnMap[addr.String()]; ok {
+		return cc.Connection.(*conn.UDPConn)
+	}
+	return nil
+}
+
+func (t udpConnTable) FindConnByID(id []byte) *conn.UDPConn {
+	t.factory.udpConnMapMutex.RLock()
+	defer t.factory.udpConnMapMutex.RUnlock()
+	if cc, ok := t.factory.udpConnIDs[string(id)]; ok {
+		return cc.Connection.(*conn.UDPConn)
+	}
+	return nil
+}
+
+func (t udpConnTable) MigrateConn(cc *conn.UDPConn, id []byte, addr *net.UDPAddr) {
+	factory := t.factory
+	factory.udpConnMapMutex.Lock()
+	defer factory.udpConnMapMutex.Unlock()
+	from := cc.GetRemoteAddr().String()
+	connection, ok := factory.udpConnMap[from]
+	if !ok || connection.Connection != cc {
+		return
+	}
+	if _, ok := factory.udpConnIDs[string(id)]; !ok {
+		cc.SetConnID(append([]byte(nil), id...))
+		factory.udpConnIDs[string(id)] = connection
+	}
+	to := addr.String()
+	if from == to {
+		return
+	}
+	// a connection made by packets of the new address before the ping
+	if other, ok := factory.udpConnMap[to]; ok {
+		delete(factory.udpConnMap, to)
+		go other.Close()
+	}
+	delete(factory.udpConnMap, from)
+	factory.udpConnMap[to] = connection
+	cc.SetRemoteAddr(addr)
+	connection.GetContextLogger().Infof("udp connection migrated from %s to %s", from, to)
+}
+
+func (factory *UDPFactory) removeUDPConn(key string, connection *Connection) {
+	if factory.udpConnMap[key] == connection {
+		delete(factory.udpConnMap, key)
+	}
+	if uc, ok := connection.Connection.(*conn.UDPConn); ok {
+		if id := uc.GetConnID(); id != nil && factory.udpConnIDs[string(id)] == connection {
+			delete(factory.udpConnIDs, string(id))
+		}
+	}
+}
+
+// GC removes the connections closed by their idle policy or otherwise
 func (factory *UDPFactory) GC() {
 	ticker := time.NewTicker(time.Second * conn.UDP_GC_PERIOD)
 	for {
@@ -104,13 +189,11 @@ func (factory *UDPFactory) GC() {
 		case <-factory.stopGC:
 			return
 		case <-ticker.C:
-			nowUnix := time.Now().Unix()
-			var closed []string
+			closed := make(map[string]*Connection)
 			factory.udpConnMapMutex.RLock()
 			for k, udp := range factory.udpConnMap {
-				if nowUnix-udp.GetLastTime() >= conn.UDP_GC_PERIOD {
-					udp.Close()
-					closed = append(closed, k)
+				if udp.IsClosed() {
+					closed[k] = udp
 				}
 			}
 			factory.udpConnMapMutex.RUnlock()
@@ -118,8 +201,8 @@ func (factory *UDPFactory) GC() {
 				continue
 			}
 			factory.udpConnMapMutex.Lock()
-			for _, u := range closed {
-				delete(factory.udpConnMap, u)
+			for k, udp := range closed {
+				factory.removeUDPConn(k, udp)
 			}
 			factory.udpConnMapMutex.Unlock()
 		}
@@ -127,15 +210,26 @@ func (factory *UDPFactory) GC() {
 }
 
 func (factory *UDPFactory) Connect(address string) (conn *Connection, err error) {
-	addr, err := net.ResolveUDPAddr("udp", address)
+	return factory.ConnectContext(context.Background(), address)
+}
+
+func (factory *UDPFactory) ConnectContext(ctx context.Context, address string) (conn *Connection, err error) {
+	start := time.Now()
+	d := factory.dialer()
+	c, err := d.DialContext(ctx, "udp", address)
 	if err != nil {
 		return
 	}
-	udp, err := net.DialUDP("udp", nil, addr)
+	err = factory.SocketOptions.Apply(c)
 	if err != nil {
+		c.Close()
 		return
 	}
+	udp := c.(*net.UDPConn)
+	addr := udp.RemoteAddr().(*net.UDPAddr)
 	cn := client.NewClientUDPConn(udp, addr)
+	factory.applyConnOptions(cn)
+	cn.SetSetupStart(start)
 	cn.SetStatusToConnected()
 	conn = newConnection(cn, factory)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "udp"))
@@ -168,7 +262,7 @@ func (factory *UDPFactory) AddAcceptedConn(conn *Connection) {
 
 func (factory *UDPFactory) RemoveAcceptedConn(conn *Connection) {
 	factory.udpConnMapMutex.Lock()
-	delete(factory.udpConnMap, conn.GetRemoteAddr().String())
+	factory.removeUDPConn(conn.GetRemoteAddr().String(), conn)
 	factory.udpConnMapMutex.Unlock()
 	factory.FactoryCommonFields.RemoveAcceptedConn(conn)
 }
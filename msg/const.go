@@ -40,6 +40,23 @@ const (
 	TYPE_ACK    = 0x80
 	TYPE_PING   = 0x81
 	TYPE_PONG   = 0x82
+	// TYPE_ACK followed by the receive window of the sender
+	TYPE_ACK_WINDOW = 0x83
+	// a server asks for the connection id of a client whose address changed
+	TYPE_MIGRATE = 0x84
+	// sent once and delivered as it arrives, see UDPConn.WriteUnreliable
+	TYPE_UNRELIABLE = 0x05
+	// fills the seq of a message given up at its deadline, it has no body
+	TYPE_SKIP = 0x06
+	// TYPE_NORMAL of several messages, each after its uint16 length
+	TYPE_BATCH = 0x07
+	// what the receiver saw in the last interval, see conn.ReceiverReport
+	TYPE_REPORT = 0x85
+	// a stateless challenge of a server to a new address and its echo, see conn.Cookies
+	TYPE_COOKIE = 0x86
+
+	// set on TYPE_NORMAL, TYPE_BATCH and TYPE_RESP when the body is compressed
+	TYPE_FLAG_COMPRESSED = 0x40
 )
 
 const (
@@ -62,3 +79,38 @@ const (
 
 	ACK_HEADER_SIZE
 )
+
+// windowed ack msg index, the [start, end) ranges of missing seqs follow the window
+const (
+	ACK_WINDOW_SIZE  = 4
+	ACK_WINDOW_BEGIN = ACK_HEADER_END
+	ACK_WINDOW_END   = ACK_WINDOW_BEGIN + ACK_WINDOW_SIZE
+
+	ACK_WINDOW_HEADER_SIZE = ACK_WINDOW_END
+)
+
+const (
+	REPORT_LOSS_SIZE   = 1
+	REPORT_JITTER_SIZE = 4
+	REPORT_RATE_SIZE   = 4
+)
+
+// receiver report msg index
+const (
+	REPORT_HEADER_BEGIN = 0
+	REPORT_TYPE_BEGIN
+	REPORT_TYPE_END = REPORT_TYPE_BEGIN + MSG_TYPE_SIZE
+	REPORT_SEQ_BEGIN
+	REPORT_SEQ_END = REPORT_SEQ_BEGIN + MSG_SEQ_SIZE
+	REPORT_UNRELIABLE_SEQ_BEGIN
+	REPORT_UNRELIABLE_SEQ_END = REPORT_UNRELIABLE_SEQ_BEGIN + MSG_SEQ_SIZE
+	REPORT_LOSS_BEGIN
+	REPORT_LOSS_END = REPORT_LOSS_BEGIN + REPORT_LOSS_SIZE
+	REPORT_JITTER_BEGIN
+	REPORT_JITTER_END = REPORT_JITTER_BEGIN + REPORT_JITTER_SIZE
+	REPORT_RATE_BEGIN
+	REPORT_RATE_END = REPORT_RATE_BEGIN + REPORT_RATE_SIZE
+	REPORT_HEADER_END
+
+	REPORT_HEADER_SIZE
+)
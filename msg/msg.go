@@ -2,6 +2,7 @@ package msg
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/btree"
 	"sync"
@@ -34,28 +35,87 @@ type Message struct {
 	rtt           time.Duration
 
 	cache []byte
+
+	// holders, see Retain
+	refs int32
 }
 
-func NewByHeader(header []byte) *Message {
-	m := &Message{}
-	m.Type = uint8(header[0])
-	m.seq = binary.BigEndian.Uint32(header[MSG_SEQ_BEGIN:MSG_SEQ_END])
-	m.Len = binary.BigEndian.Uint32(header[MSG_LEN_BEGIN:MSG_LEN_END])
-	if m.Len > MAX_MESSAGE_SIZE {
-		panic(fmt.Errorf("msg len(%d) >  max len(%d)", m.Len, MAX_MESSAGE_SIZE))
+var (
+	messagePool    = sync.Pool{New: func() interface{} { return new(Message) }}
+	udpMessagePool = sync.Pool{New: func() interface{} { return &UDPMessage{Message: new(Message)} }}
+)
+
+func getMessage() *Message {
+	m := messagePool.Get().(*Message)
+	m.refs = 1
+	return m
+}
+
+// reset must not be called while others use msg
+func (msg *Message) reset() {
+	msg.Type = 0
+	msg.seq = 0
+	msg.Len = 0
+	msg.Body = nil
+	msg.status = 0
+	msg.transmittedAt = time.Time{}
+	msg.ackedAt = time.Time{}
+	msg.rtt = 0
+	msg.cache = nil
+	msg.refs = 0
+}
+
+// Retain adds a holder of msg, every holder calls Release once. A new message
+// has one holder
+func (msg *Message) Retain() {
+	atomic.AddInt32(&msg.refs, 1)
+}
+
+// Release drops a holder, the last one gives msg back to the pool. Body and the
+// cache are not pooled, slices of them stay valid
+func (msg *Message) Release() {
+	if atomic.AddInt32(&msg.refs, -1) != 0 {
+		return
 	}
+	msg.reset()
+	messagePool.Put(msg)
+}
+
+var (
+	ErrHeaderTooShort  = errors.New("msg header too short")
+	ErrMessageTooLarge = errors.New("msg len larger than max len")
+)
 
+// NewByHeader returns a message with a body of the len in header to read into,
+// it fails if the len is larger than max. MAX_MESSAGE_SIZE is used if max is 0
+func NewByHeader(header []byte, max uint32) (*Message, error) {
+	if len(header) < MSG_HEADER_SIZE {
+		return nil, ErrHeaderTooShort
+	}
+	if max == 0 {
+		max = MAX_MESSAGE_SIZE
+	}
+	l := binary.BigEndian.Uint32(header[MSG_LEN_BEGIN:MSG_LEN_END])
+	if l > max {
+		return nil, ErrMessageTooLarge
+	}
+	m := getMessage()
+	m.Type = uint8(header[0])
+	m.seq = binary.BigEndian.Uint32(header[MSG_SEQ_BEGIN:MSG_SEQ_END])
+	m.Len = l
 	m.Body = make([]byte, m.Len)
 
-	return m
+	return m, nil
 }
 
 func New(t uint8, seq uint32, bytes []byte) *Message {
-	return &Message{Type: t, seq: seq, Len: uint32(len(bytes)), Body: bytes}
+	m := getMessage()
+	m.Type, m.seq, m.Len, m.Body = t, seq, uint32(len(bytes)), bytes
+	return m
 }
 
 func NewWithoutSeq(t uint8, bytes []byte) *Message {
-	return &Message{Type: t, Len: uint32(len(bytes)), Body: bytes}
+	return New(t, 0, bytes)
 }
 
 func (msg *Message) String() string {
@@ -100,22 +160,20 @@ func (msg *Message) Bytes() (result []byte) {
 	return result
 }
 
+// PkgBytes returns the package of msg in a buffer from GetBuffer, give it back
+// with PutBuffer once it was written
 func (msg *Message) PkgBytes() (result []byte) {
-	if len(result) > 0 {
-		return
-	}
+	result = GetBuffer(msg.PkgBytesLen())
+	msg.PutPkg(result)
+	return
+}
 
-	result = make([]byte, PKG_HEADER_SIZE+MSG_HEADER_SIZE+msg.Len)
-	m := result[PKG_HEADER_SIZE:]
-	m[0] = byte(msg.Type)
-	binary.BigEndian.PutUint32(m[MSG_SEQ_BEGIN:MSG_SEQ_END], msg.GetSeq())
-	binary.BigEndian.PutUint32(m[MSG_LEN_BEGIN:MSG_LEN_END], msg.Len)
+// PutPkg writes the package of msg into b, which must be PkgBytesLen long, the
+// package header is left for the conn
+func (msg *Message) PutPkg(b []byte) {
+	m := b[PKG_HEADER_SIZE:]
+	msg.PutHeader(m)
 	copy(m[MSG_HEADER_END:], msg.Body)
-
-	msg.Lock()
-	msg.cache = result
-	msg.Unlock()
-	return
 }
 
 func (msg *Message) SetCache(result []byte) {
@@ -137,12 +195,17 @@ func (msg *Message) PkgBytesLen() int {
 
 func (msg *Message) HeaderBytes() []byte {
 	result := make([]byte, MSG_HEADER_SIZE)
-	result[0] = byte(msg.Type)
-	binary.BigEndian.PutUint32(result[MSG_SEQ_BEGIN:MSG_SEQ_END], msg.GetSeq())
-	binary.BigEndian.PutUint32(result[MSG_LEN_BEGIN:MSG_LEN_END], msg.Len)
+	msg.PutHeader(result)
 	return result
 }
 
+// PutHeader writes the msg header into b, which must be at least MSG_HEADER_SIZE long
+func (msg *Message) PutHeader(b []byte) {
+	b[0] = byte(msg.Type)
+	binary.BigEndian.PutUint32(b[MSG_SEQ_BEGIN:MSG_SEQ_END], msg.GetSeq())
+	binary.BigEndian.PutUint32(b[MSG_LEN_BEGIN:MSG_LEN_END], msg.Len)
+}
+
 func (msg *Message) TotalSize() int {
 	msg.RLock()
 	defer msg.RUnlock()
@@ -204,9 +267,15 @@ func (msg *Message) GetRTT() (rtt time.Duration) {
 type UDPMessage struct {
 	*Message
 
-	miss        uint32
-	resendCnt   uint32
+	miss      uint32
+	resendCnt uint32
+	// reused by the next SetRTO, also after the message is pooled
 	resendTimer *time.Timer
+	resendFn    func(m *UDPMessage) error
+	// fires of resendTimer that did not run yet
+	resendFires int
+	resending   bool
+	released    bool
 
 	delivered     uint64
 	deliveredTime time.Time
@@ -214,18 +283,89 @@ type UDPMessage struct {
 
 	channel    int64
 	channelSeq uint32
+
+	// see SetDeadline
+	deadline time.Time
+	skipped  bool
 }
 
 func NewUDP(t uint8, seq uint32, bytes []byte) *UDPMessage {
-	return &UDPMessage{
-		Message: New(t, seq, bytes),
-	}
+	m := udpMessagePool.Get().(*UDPMessage)
+	m.Type, m.seq, m.Len, m.Body = t, seq, uint32(len(bytes)), bytes
+	m.refs = 1
+	return m
 }
 
 func NewUDPWithoutSeq(t uint8, bytes []byte) *UDPMessage {
-	return &UDPMessage{
-		Message: NewWithoutSeq(t, bytes),
+	return NewUDP(t, 0, bytes)
+}
+
+// Release is Message.Release, a message whose resend timer is about to fire is
+// pooled by the timer
+func (msg *UDPMessage) Release() {
+	if atomic.AddInt32(&msg.refs, -1) != 0 {
+		return
+	}
+	msg.Lock()
+	msg.released = true
+	if msg.resendTimer != nil && msg.resendTimer.Stop() {
+		msg.resendFires--
+	}
+	if msg.resending || msg.resendFires > 0 {
+		msg.Unlock()
+		return
 	}
+	msg.Unlock()
+	msg.recycle()
+}
+
+func (msg *UDPMessage) recycle() {
+	msg.Message.reset()
+	msg.miss = 0
+	msg.resendCnt = 0
+	msg.resendFn = nil
+	msg.resendFires = 0
+	msg.resending = false
+	msg.released = false
+	msg.delivered = 0
+	msg.deliveredTime = time.Time{}
+	msg.sentTime = time.Time{}
+	msg.channel = 0
+	msg.channelSeq = 0
+	msg.deadline = time.Time{}
+	msg.skipped = false
+	udpMessagePool.Put(msg)
+}
+
+// SetDeadline stops the resends of msg after t, it is skipped instead
+func (msg *UDPMessage) SetDeadline(t time.Time) {
+	msg.Lock()
+	msg.deadline = t
+	msg.Unlock()
+}
+
+// Expired reports whether the deadline of msg passed before now
+func (msg *UDPMessage) Expired(now time.Time) (r bool) {
+	msg.RLock()
+	r = !msg.deadline.IsZero() && now.After(msg.deadline)
+	msg.RUnlock()
+	return
+}
+
+// Skip sends p instead of msg from now on and forgets the body
+func (msg *UDPMessage) Skip(p []byte) {
+	msg.Lock()
+	msg.cache = p
+	msg.Body = nil
+	msg.skipped = true
+	msg.Unlock()
+}
+
+func (msg *UDPMessage) IsSkipped() (r bool) {
+	msg.RLock()
+	r = msg.skipped
+	msg.RUnlock()
+	return
 }
 
 func (msg *UDPMessage) UpdateState(delivered uint64, deliveredTime, sentTime time.Time) {
@@ -236,20 +376,44 @@ func (msg *UDPMessage) UpdateState(delivered uint64, deliveredTime, sentTime tim
 	msg.Unlock()
 }
 
+// SetRTO calls fn after rto unless the message was acked, it replaces the rto
+// set before. The caller backs rto off by GetResendCount
 func (msg *UDPMessage) SetRTO(rto time.Duration, fn func(m *UDPMessage) error) {
 	msg.Lock()
-	msg.resendTimer = time.AfterFunc(rto*time.Duration((msg.resendCnt)*3/2+1), func() {
-		msg.Lock()
-		if msg.status&MSG_STATUS_ACKED > 0 {
-			msg.Unlock()
-			return
-		}
-		msg.resendCnt++
+	msg.resendFn = fn
+	if msg.resendTimer == nil {
+		msg.resendTimer = time.AfterFunc(rto, msg.resend)
+		msg.resendFires++
+	} else if !msg.resendTimer.Reset(rto) {
+		msg.resendFires++
+	}
+	msg.Unlock()
+}
+
+func (msg *UDPMessage) resend() {
+	msg.Lock()
+	msg.resendFires--
+	if msg.released || msg.status&MSG_STATUS_ACKED > 0 {
+		recycle := msg.released && msg.resendFires == 0 && !msg.resending
 		msg.Unlock()
-		msg.ResetMiss()
-		fn(msg)
-	})
+		if recycle {
+			msg.recycle()
+		}
+		return
+	}
+	msg.resendCnt++
+	msg.resending = true
+	fn := msg.resendFn
+	msg.Unlock()
+	msg.ResetMiss()
+	fn(msg)
+	msg.Lock()
+	msg.resending = false
+	recycle := msg.released && msg.resendFires == 0
 	msg.Unlock()
+	if recycle {
+		msg.recycle()
+	}
 }
 
 func (msg *UDPMessage) GetResendCount() (c uint32) {
@@ -264,8 +428,8 @@ func (msg *UDPMessage) Acked() {
 	msg.status |= MSG_STATUS_ACKED
 	msg.ackedAt = time.Now()
 	msg.rtt = msg.ackedAt.Sub(msg.transmittedAt)
-	if msg.resendTimer != nil {
-		msg.resendTimer.Stop()
+	if msg.resendTimer != nil && msg.resendTimer.Stop() {
+		msg.resendFires--
 	}
 	msg.Unlock()
 }
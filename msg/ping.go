@@ -7,6 +7,8 @@ import (
 
 const (
 	PING_MSG_TIME_SIZE = 8
+	// a ping of a udp client is followed by its connection id
+	PING_MSG_CONN_ID_SIZE = 8
 )
 
 const (
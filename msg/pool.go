@@ -0,0 +1,39 @@
+package msg
+
+import "sync"
+
+// size classes of pooled buffers, the largest one holds a full message with headers
+var bufferSizes = [...]int{64, 512, 2048, 16384}
+
+var bufferPools [len(bufferSizes)]sync.Pool
+
+func init() {
+	for i := range bufferPools {
+		size := bufferSizes[i]
+		bufferPools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+}
+
+// GetBuffer returns a buffer of len size, from the pool if size fits a class
+func GetBuffer(size int) []byte {
+	for i, s := range bufferSizes {
+		if size <= s {
+			return bufferPools[i].Get().([]byte)[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+// PutBuffer gives a buffer obtained from GetBuffer back to the pool,
+// b must not be used after that
+func PutBuffer(b []byte) {
+	c := cap(b)
+	for i, s := range bufferSizes {
+		if c == s {
+			bufferPools[i].Put(b[:c])
+			return
+		}
+	}
+}
@@ -15,13 +15,16 @@ type ServerTCPConn struct {
 }
 
 func NewServerTCPConn(c *net.TCPConn) *ServerTCPConn {
-	return &ServerTCPConn{
+	cc := &ServerTCPConn{
 		TCPConn: conn.TCPConn{
 			TcpConn:          c,
 			ConnCommonFields: conn.NewConnCommonFileds(),
 			PendingMap:       conn.NewPendingMap(),
 		},
 	}
+	cc.SetPeerAddr(c.RemoteAddr())
+	cc.SetIdlePolicy(conn.DefaultIdlePolicy)
+	return cc
 }
 
 func (c *ServerTCPConn) ReadLoop() (err error) {
@@ -65,25 +68,16 @@ func (c *ServerTCPConn) ReadLoop() (err error) {
 				return err
 			}
 		case msg.TYPE_REQ:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+			body, err := c.ReadBody(reader, header)
 			if err != nil {
 				return err
 			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
+			err = c.PushIn(body)
 			if err != nil {
 				return err
 			}
-			c.In <- m.Body
-		case msg.TYPE_RESP:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
-			if err != nil {
-				return err
-			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
+		case msg.TYPE_RESP, msg.TYPE_RESP | msg.TYPE_FLAG_COMPRESSED:
+			body, err := c.ReadBody(reader, header)
 			if err != nil {
 				return err
 			}
@@ -92,15 +86,14 @@ func (c *ServerTCPConn) ReadLoop() (err error) {
 				c.DelMsg(seq)
 				c.UpdateLastAck(seq)
 			}
-			c.In <- m.Body
-		case msg.TYPE_NORMAL:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+			// a resp is pending at the sender like any other message
+			c.Ack(binary.BigEndian.Uint32(header[msg.MSG_SEQ_BEGIN:msg.MSG_SEQ_END]))
+			err = c.PushIn(body)
 			if err != nil {
 				return err
 			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
+		case msg.TYPE_NORMAL, msg.TYPE_NORMAL | msg.TYPE_FLAG_COMPRESSED:
+			body, err := c.ReadBody(reader, header)
 			if err != nil {
 				return err
 			}
@@ -108,7 +101,10 @@ func (c *ServerTCPConn) ReadLoop() (err error) {
 			seq := binary.BigEndian.Uint32(header[msg.MSG_TYPE_END:msg.MSG_SEQ_END])
 			c.Ack(seq)
 			//c.GetContextLogger().Debugf("c.In <- m.Body %x", m.Body)
-			c.In <- m.Body
+			err = c.PushIn(body)
+			if err != nil {
+				return err
+			}
 		default:
 			c.GetContextLogger().Debugf("not implemented msg type %d", t)
 			return fmt.Errorf("not implemented msg type %d", msg_t)
@@ -1,17 +1,31 @@
 package server
 
 import (
-	"encoding/binary"
 	"fmt"
 	"github.com/skycoin/net/conn"
 	"github.com/skycoin/net/msg"
-	"hash/crc32"
 	"net"
 	"time"
 )
 
 type ServerUDPConn struct {
 	conn.UDPConn
+
+	// see SetConnTable
+	table ConnTable
+	// see SetCookies
+	cookies *conn.Cookies
+}
+
+// ConnTable finds the connections of the packets of a ServerUDPConn by their
+// address or by the connection id of their pings
+type ConnTable interface {
+	// FindConn returns nil if addr has no connection
+	FindConn(addr *net.UDPAddr) *conn.UDPConn
+	// FindConnByID returns nil if no connection has id
+	FindConnByID(id []byte) *conn.UDPConn
+	// MigrateConn remembers the id of cc and moves it to addr
+	MigrateConn(cc *conn.UDPConn, id []byte, addr *net.UDPAddr)
 }
 
 func NewServerUDPConn(c *net.UDPConn) *ServerUDPConn {
@@ -23,6 +37,59 @@ func NewServerUDPConn(c *net.UDPConn) *ServerUDPConn {
 	}
 }
 
+// SetConnTable migrates a connection to the new address of its client when
+// its pings come from there. Packets of an unknown address that can not start
+// a connection are dropped and the client is asked for its id, call it before
+// ReadLoop
+func (c *ServerUDPConn) SetConnTable(t ConnTable) {
+	c.table = t
+}
+
+// SetCookies makes a connection only for the addresses that echo a cookie,
+// see conn.Cookies. It needs the ConnTable, call it before ReadLoop
+func (c *ServerUDPConn) SetCookies(k *conn.Cookies) {
+	c.cookies = k
+}
+
+func (c *ServerUDPConn) getConn(fn func(c *net.UDPConn, addr *net.UDPAddr) *conn.UDPConn, p []byte, addr *net.UDPAddr) *conn.UDPConn {
+	if c.table == nil {
+		return fn(c.UdpConn, addr)
+	}
+	m := p[msg.PKG_HEADER_SIZE:]
+	id := conn.PingConnID(m)
+	if id != nil {
+		if cc := c.table.FindConnByID(id); cc != nil {
+			if cc.VerifyChecksum(p) {
+				c.table.MigrateConn(cc, id, addr)
+			}
+			return cc
+		}
+	}
+	cc := c.table.FindConn(addr)
+	if cc == nil && c.cookies != nil {
+		if c.cookies.Verify(m, addr) {
+			return fn(c.UdpConn, addr)
+		}
+		if conn.CanStartConn(m) {
+			err := c.cookies.Challenge(c.UdpConn, addr, len(p))
+			c.GetContextLogger().Debugf("cookie to %s err %v", addr, err)
+			return nil
+		}
+	}
+	if cc == nil {
+		if !conn.CanStartConn(m) {
+			err := conn.RequestConnID(c.UdpConn, addr)
+			c.GetContextLogger().Debugf("request conn id of %s err %v", addr, err)
+			return nil
+		}
+		cc = fn(c.UdpConn, addr)
+	}
+	if id != nil && cc.VerifyChecksum(p) {
+		c.table.MigrateConn(cc, id, addr)
+	}
+	return cc
+}
+
 func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *conn.UDPConn) (err error) {
 	defer func() {
 		//if e := recover(); e != nil {
@@ -36,12 +103,10 @@ func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *con
 	}()
 	var lst = time.Time{}
 	var rt = time.Time{}
-	var at = time.Time{}
-	var nt = time.Time{}
+	r := conn.NewUDPBatchReader(c.UdpConn, conn.MTU)
 	for {
-		maxBuf := make([]byte, conn.MTU)
 		rt = time.Now()
-		n, addr, err := c.UdpConn.ReadFromUDP(maxBuf)
+		pkts, err := r.Read()
 		c.GetContextLogger().Debugf("process read udp d %s", time.Now().Sub(rt))
 		if !lst.IsZero() {
 			c.GetContextLogger().Debugf("read udp d %s", time.Now().Sub(lst))
@@ -50,7 +115,7 @@ func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *con
 		if err != nil {
 			if e, ok := err.(net.Error); ok {
 				if e.Timeout() {
-					cc := fn(c.UdpConn, addr)
+					cc := fn(c.UdpConn, nil)
 					cc.GetContextLogger().Debug("close in")
 					close(cc.In)
 					continue
@@ -58,87 +123,120 @@ func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *con
 			}
 			return err
 		}
-		c.AddReceivedBytes(n)
-		maxBuf = maxBuf[:n]
-		cc := fn(c.UdpConn, addr)
-		m := maxBuf[msg.PKG_HEADER_SIZE:]
-		checksum := binary.BigEndian.Uint32(maxBuf[msg.PKG_CRC32_BEGIN:])
-		if checksum != crc32.ChecksumIEEE(m) {
-			c.GetContextLogger().Infof("checksum !=")
-			continue
+		for _, p := range pkts {
+			c.process(fn, p.Buf, p.Addr)
 		}
+	}
+}
 
-		t := m[msg.MSG_TYPE_BEGIN]
-		switch t {
-		case msg.TYPE_ACK:
-			at = time.Now()
-			func() {
-				var err error
-				defer func() {
-					if e := recover(); e != nil {
-						cc.GetContextLogger().Debug(e)
-						err = fmt.Errorf("readloop panic err:%v", e)
-					}
-					if err != nil {
-						cc.SetStatusToError(err)
-						cc.Close()
-					}
-				}()
-				err = cc.RecvAck(m)
-			}()
-			c.GetContextLogger().Debugf("process ack d %s", time.Now().Sub(at))
-		case msg.TYPE_PONG:
-		case msg.TYPE_PING:
-			func() {
-				var err error
-				defer func() {
-					if e := recover(); e != nil {
-						cc.GetContextLogger().Debug(e)
-						err = fmt.Errorf("readloop panic err:%v", e)
-					}
-					if err != nil {
-						cc.SetStatusToError(err)
-						cc.Close()
-					}
-				}()
-				m[msg.PING_MSG_TYPE_BEGIN] = msg.TYPE_PONG
-				checksum := crc32.ChecksumIEEE(m)
-				binary.BigEndian.PutUint32(maxBuf[msg.PKG_CRC32_BEGIN:], checksum)
-				err = cc.WriteExt(maxBuf)
+func (c *ServerUDPConn) process(fn func(c *net.UDPConn, addr *net.UDPAddr) *conn.UDPConn, maxBuf []byte, addr *net.UDPAddr) {
+	var at = time.Time{}
+	var nt = time.Time{}
+	c.AddReceivedBytes(len(maxBuf))
+	if len(maxBuf) <= msg.PKG_HEADER_SIZE {
+		msg.PutBuffer(maxBuf)
+		return
+	}
+	cc := c.getConn(fn, maxBuf, addr)
+	if cc == nil {
+		msg.PutBuffer(maxBuf)
+		return
+	}
+	m := maxBuf[msg.PKG_HEADER_SIZE:]
+	if !cc.VerifyChecksum(maxBuf) {
+		c.GetContextLogger().Infof("checksum !=")
+		msg.PutBuffer(maxBuf)
+		return
+	}
+
+	t := m[msg.MSG_TYPE_BEGIN]
+	switch t {
+	case msg.TYPE_ACK, msg.TYPE_ACK_WINDOW:
+		at = time.Now()
+		func() {
+			var err error
+			defer func() {
+				if e := recover(); e != nil {
+					cc.GetContextLogger().Debug(e)
+					err = fmt.Errorf("readloop panic err:%v", e)
+				}
 				if err != nil {
-					return
+					cc.SetStatusToError(err)
+					cc.Close()
 				}
-				cc.GetContextLogger().Debugf("pong")
 			}()
-		case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_REQ, msg.TYPE_RESP:
-			nt = time.Now()
-			func() {
-				var err error
-				//defer func() {
-				//	if e := recover(); e != nil {
-				//		cc.GetContextLogger().Debug(e)
-				//		err = fmt.Errorf("readloop panic err:%v", e)
-				//	}
-				//	if err != nil {
-				//		cc.SetStatusToError(err)
-				//		cc.Close()
-				//	}
-				//}()
-				err = cc.Process(t, m)
+			err = cc.RecvAck(m)
+		}()
+		c.GetContextLogger().Debugf("process ack d %s", time.Now().Sub(at))
+		msg.PutBuffer(maxBuf)
+	case msg.TYPE_PONG:
+		msg.PutBuffer(maxBuf)
+	case msg.TYPE_COOKIE:
+		err := cc.RecvCookie(m)
+		if err != nil {
+			cc.GetContextLogger().Debugf("cookie %v", err)
+		}
+		msg.PutBuffer(maxBuf)
+	case msg.TYPE_REPORT:
+		err := cc.RecvReport(m)
+		if err != nil {
+			cc.GetContextLogger().Debugf("receiver report %v", err)
+		}
+		msg.PutBuffer(maxBuf)
+	case msg.TYPE_PING:
+		func() {
+			var err error
+			defer func() {
+				if e := recover(); e != nil {
+					cc.GetContextLogger().Debug(e)
+					err = fmt.Errorf("readloop panic err:%v", e)
+				}
 				if err != nil {
-					return
+					cc.SetStatusToError(err)
+					cc.Close()
 				}
 			}()
-			c.GetContextLogger().Debugf("process normal d %s", time.Now().Sub(nt))
-		default:
-			cc.GetContextLogger().Debugf("not implemented msg type %d", t)
-			cc.SetStatusToError(fmt.Errorf("not implemented msg type %d", t))
-			cc.Close()
-			continue
-		}
-
-		cc.UpdateLastTime()
+			m[msg.PING_MSG_TYPE_BEGIN] = msg.TYPE_PONG
+			cc.PutChecksum(maxBuf)
+			err = cc.WriteExt(maxBuf)
+			if err != nil {
+				return
+			}
+			cc.GetContextLogger().Debugf("pong")
+		}()
+		msg.PutBuffer(maxBuf)
+	case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_REQ, msg.TYPE_RESP,
+		msg.TYPE_NORMAL | msg.TYPE_FLAG_COMPRESSED, msg.TYPE_RESP | msg.TYPE_FLAG_COMPRESSED,
+		msg.TYPE_UNRELIABLE, msg.TYPE_UNRELIABLE | msg.TYPE_FLAG_COMPRESSED, msg.TYPE_SKIP,
+		msg.TYPE_BATCH, msg.TYPE_BATCH | msg.TYPE_FLAG_COMPRESSED:
+		// the buffer is retained by the stream queue, it is not put back
+		nt = time.Now()
+		func() {
+			var err error
+			//defer func() {
+			//	if e := recover(); e != nil {
+			//		cc.GetContextLogger().Debug(e)
+			//		err = fmt.Errorf("readloop panic err:%v", e)
+			//	}
+			//	if err != nil {
+			//		cc.SetStatusToError(err)
+			//		cc.Close()
+			//	}
+			//}()
+			err = cc.Process(t, m)
+			if err != nil {
+				return
+			}
+		}()
+		c.GetContextLogger().Debugf("process normal d %s", time.Now().Sub(nt))
+	default:
+		cc.GetContextLogger().Debugf("not implemented msg type %d", t)
+		cc.SetStatusToError(fmt.Errorf("not implemented msg type %d", t))
+		cc.Close()
+		return
 	}
+
+	cc.UpdateLastTime()
 }
 
 func (c *ServerUDPConn) Close() {
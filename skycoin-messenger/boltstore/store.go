@@ -0,0 +1,77 @@
+// Package boltstore keeps the services of a discovery server in a BoltDB file,
+// see factory.MessengerFactory.UseDiscoveryStore
+package boltstore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+	bolt "go.etcd.io/bbolt"
+)
+
+var servicesBucket = []byte("services")
+
+// Store of the services by node key, the values are json
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the store at path
+func Open(path string) (s *Store, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(servicesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Save(node cipher.PubKey, ns *factory.NodeServices) error {
+	v, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).Put(node[:], v)
+	})
+}
+
+func (s *Store) Delete(node cipher.PubKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).Delete(node[:])
+	})
+}
+
+// Load skips the records it can not read
+func (s *Store) Load() (services map[cipher.PubKey]*factory.NodeServices, err error) {
+	services = make(map[cipher.PubKey]*factory.NodeServices)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).ForEach(func(k, v []byte) error {
+			var node cipher.PubKey
+			if len(k) != len(node) {
+				return nil
+			}
+			copy(node[:], k)
+			ns := &factory.NodeServices{}
+			if json.Unmarshal(v, ns) != nil {
+				return nil
+			}
+			services[node] = ns
+			return nil
+		})
+	})
+	return
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,51 @@
+package boltstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "discovery.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := cipher.PubKey([33]byte{0x01}), cipher.PubKey([33]byte{0x02})
+	service := cipher.PubKey([33]byte{0xf1})
+	ns := &factory.NodeServices{Services: []*factory.Service{{Key: service, Attributes: []string{"vpn"}}}, TTL: 30}
+	if err = s.Save(a, ns); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save(b, ns); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	services, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[a] == nil || services[a].TTL != 30 ||
+		services[a].Services[0].Key != service || services[a].Services[0].Attributes[0] != "vpn" {
+		t.Fatalf("loaded %+v", services)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skycoin/net/skycoin-messenger/dns"
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/util/file"
+)
+
+var (
+	nodeAddress string
+	seedPath    string
+	// node:app of the resolver app, this app is the resolver if empty
+	resolver string
+	// of the resolver
+	upstream string
+	// of the client
+	listenAddress string
+	cacheSize     int
+)
+
+func parseFlags() {
+	flag.StringVar(&nodeAddress, "node-address", ":5998", "address of the node to connect to")
+	flag.StringVar(&seedPath, "seed-path", filepath.Join(file.UserHome(), ".skywire", "dns", "keys.json"), "path of the keys of the app")
+	flag.StringVar(&resolver, "resolver", "", "node:app of the resolver to query, run as the resolver if empty")
+	flag.StringVar(&upstream, "upstream", dns.DEFAULT_UPSTREAM, "dns server the resolver queries")
+	flag.StringVar(&listenAddress, "address", "127.0.0.1:53", "udp and tcp address the client answers queries on")
+	flag.IntVar(&cacheSize, "cache", dns.DEFAULT_CACHE_SIZE, "answers the client caches")
+	flag.Parse()
+}
+
+func main() {
+	parseFlags()
+
+	osSignal := make(chan os.Signal, 1)
+	signal.Notify(osSignal, os.Interrupt, os.Kill)
+
+	var conn atomic.Value
+	config := &factory.ConnConfig{
+		Reconnect:      true,
+		SeedConfigPath: seedPath,
+		OnConnected: func(connection *factory.Connection) {
+			conn.Store(connection)
+			if len(resolver) > 0 {
+				return
+			}
+			l, err := connection.ListenApp("", "dns")
+			if err != nil {
+				log.Errorf("listen for dns queries err %v", err)
+				return
+			}
+			go func() {
+				<-connection.Disconnected()
+				l.Close()
+			}()
+			go (&dns.Server{Upstream: upstream}).Serve(l)
+			log.Infof("resolver at %s", connection.GetKey().Hex())
+		},
+	}
+
+	f := factory.NewMessengerFactory()
+	err := f.ConnectWithConfig(nodeAddress, config)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if len(resolver) > 0 {
+		node, app, err := factory.ParseAppAddress(resolver)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		client := dns.NewClient(func(ctx context.Context) (net.Conn, error) {
+			c, ok := conn.Load().(*factory.Connection)
+			if !ok {
+				return nil, errors.New("not connected to the node")
+			}
+			return c.DialApp(ctx, node, app)
+		}, cacheSize)
+		pc, err := net.ListenPacket("udp", listenAddress)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		l, err := net.Listen("tcp", listenAddress)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		go client.ServeUDP(pc)
+		go client.ServeTCP(l)
+		log.Infof("answering dns queries on %s", listenAddress)
+	}
+
+	select {
+	case signal := <-osSignal:
+		if signal == os.Interrupt {
+			log.Debugln("exit by signal Interrupt")
+		} else if signal == os.Kill {
+			log.Debugln("exit by signal Kill")
+		}
+	}
+}
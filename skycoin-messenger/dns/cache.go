@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// answers cached by default
+const DEFAULT_CACHE_SIZE = 1024
+
+type cacheEntry struct {
+	answer  []byte
+	ttls    []int
+	stored  time.Time
+	expires time.Time
+}
+
+// cache of answers by their question until the smallest ttl of their records
+type cache struct {
+	entries map[string]*cacheEntry
+	max     int
+	sync.Mutex
+}
+
+func newCache(max int) *cache {
+	return &cache{entries: make(map[string]*cacheEntry), max: max}
+}
+
+// put caches answer of the question key that ends at end
+func (c *cache) put(key string, answer []byte, end int) {
+	if c.max < 1 || answer[2]&FLAG_TC > 0 {
+		return
+	}
+	if r := rcode(answer); r != RCODE_NOERROR && r != RCODE_NXDOMAIN {
+		return
+	}
+	offsets, min, ok, err := ttls(answer, end)
+	if err != nil || !ok || min == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		answer:  append([]byte(nil), answer...),
+		ttls:    offsets,
+		stored:  now,
+		expires: now.Add(time.Duration(min) * time.Second),
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		c.evict(now)
+	}
+	c.entries[key] = e
+}
+
+// evict drops the expired entries, an arbitrary one if none expired
+func (c *cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) < c.max {
+		return
+	}
+	for k := range c.entries {
+		delete(c.entries, k)
+		return
+	}
+}
+
+// get returns a copy of the answer of key with the ttls counted down and the id
+// of the query
+func (c *cache) get(key string, queryID uint16) (answer []byte, ok bool) {
+	now := time.Now()
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.Unlock()
+	if !ok {
+		return
+	}
+	answer = append([]byte(nil), e.answer...)
+	setID(answer, queryID)
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, off := range e.ttls {
+		ttl := binary.BigEndian.Uint32(answer[off:])
+		if ttl > age {
+			ttl -= age
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(answer[off:], ttl)
+	}
+	return
+}
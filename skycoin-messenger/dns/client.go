@@ -0,0 +1,237 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long a query of ServeUDP and ServeTCP waits for its answer
+const DEFAULT_QUERY_TIMEOUT = 5 * time.Second
+
+var (
+	ErrStreamClosed = errors.New("dns stream to the resolver closed")
+	ErrIDsExhausted = errors.New("all dns ids are waiting for answers")
+)
+
+// stream is a conn to the resolver, its queries are matched to the answers by
+// their ids as answers come back in any order
+type stream struct {
+	conn    net.Conn
+	pending map[uint16]chan []byte
+	nextID  uint16
+}
+
+// Client answers the queries of local apps through a Server on a trusted node,
+// so they do not reach the local network
+type Client struct {
+	// dial returns a new conn to the Server, e.g. a transport of DialApp
+	dial  func(ctx context.Context) (net.Conn, error)
+	cache *cache
+
+	stream *stream
+	mutex  sync.Mutex
+}
+
+// NewClient caches up to cacheSize answers, none if 0
+func NewClient(dial func(ctx context.Context) (net.Conn, error), cacheSize int) *Client {
+	return &Client{dial: dial, cache: newCache(cacheSize)}
+}
+
+// Exchange returns the answer to query from the cache or the Server
+func (c *Client) Exchange(ctx context.Context, query []byte) (answer []byte, err error) {
+	key, end, err := question(query)
+	if err != nil {
+		return
+	}
+	qid := id(query)
+	answer, ok := c.cache.get(key, qid)
+	if ok {
+		return
+	}
+
+	ch := make(chan []byte, 1)
+	s, sid, err := c.send(ctx, query, ch)
+	if err != nil {
+		return
+	}
+	select {
+	case answer, ok = <-ch:
+		if !ok {
+			return nil, ErrStreamClosed
+		}
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(s.pending, sid)
+		c.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+	akey, _, err := question(answer)
+	if err != nil {
+		return nil, err
+	}
+	if akey != key {
+		return nil, ErrInvalidMsg
+	}
+	setID(answer, qid)
+	c.cache.put(key, answer, end)
+	return
+}
+
+// send writes query with an id of the stream that ch waits for, the stream is
+// dialed if there is none
+func (c *Client) send(ctx context.Context, query []byte, ch chan []byte) (s *stream, sid uint16, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s = c.stream
+	if s == nil {
+		var conn net.Conn
+		conn, err = c.dial(ctx)
+		if err != nil {
+			return
+		}
+		s = &stream{conn: conn, pending: make(map[uint16]chan []byte)}
+		c.stream = s
+		go c.readLoop(s)
+	}
+	if len(s.pending) > MAX_SIZE {
+		err = ErrIDsExhausted
+		return
+	}
+	for {
+		s.nextID++
+		if _, ok := s.pending[s.nextID]; !ok {
+			break
+		}
+	}
+	sid = s.nextID
+	q := append([]byte(nil), query...)
+	setID(q, sid)
+	d, _ := ctx.Deadline()
+	s.conn.SetWriteDeadline(d)
+	err = writeMsg(s.conn, q)
+	if err != nil {
+		c.closeStream(s)
+		return
+	}
+	s.pending[sid] = ch
+	return
+}
+
+func (c *Client) readLoop(s *stream) {
+	for {
+		answer, err := readMsg(s.conn)
+		if err != nil {
+			log.Debugf("dns stream read err %v", err)
+			c.mutex.Lock()
+			c.closeStream(s)
+			c.mutex.Unlock()
+			return
+		}
+		if len(answer) < HEADER_SIZE {
+			continue
+		}
+		c.mutex.Lock()
+		ch, ok := s.pending[id(answer)]
+		delete(s.pending, id(answer))
+		c.mutex.Unlock()
+		if ok {
+			ch <- answer
+		}
+	}
+}
+
+// closeStream fails the queries waiting on s, mutex must be held
+func (c *Client) closeStream(s *stream) {
+	s.conn.Close()
+	for k, ch := range s.pending {
+		close(ch)
+		delete(s.pending, k)
+	}
+	if c.stream == s {
+		c.stream = nil
+	}
+}
+
+// ServeUDP answers the queries to pc until it is closed, point the resolver
+// of the system or of the socks and vpn apps at it
+func (c *Client) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, MAX_SIZE)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			answer := c.answer(query, addr)
+			if answer == nil {
+				return
+			}
+			_, end, _ := question(query)
+			if len(answer) > udpSize(query, end) {
+				answer = truncated(answer, end)
+			}
+			pc.WriteTo(answer, addr)
+		}()
+	}
+}
+
+// ServeTCP answers the queries of the conns of l until it is closed
+func (c *Client) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			var mutex sync.Mutex
+			for {
+				query, err := readMsg(conn)
+				if err != nil {
+					return
+				}
+				go func() {
+					answer := c.answer(query, conn.RemoteAddr())
+					if answer == nil {
+						return
+					}
+					mutex.Lock()
+					writeMsg(conn, answer)
+					mutex.Unlock()
+				}()
+			}
+		}()
+	}
+}
+
+// answer returns the answer to query of a local app, servfail if Exchange
+// failed and nil if query is invalid
+func (c *Client) answer(query []byte, from net.Addr) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_QUERY_TIMEOUT)
+	defer cancel()
+	answer, err := c.Exchange(ctx, query)
+	if err == nil {
+		return answer
+	}
+	log.Debugf("dns query from %s err %v", from, err)
+	_, end, e := question(query)
+	if e != nil {
+		return nil
+	}
+	return servfail(query, end)
+}
+
+// Close closes the stream to the Server, the next query dials a new one
+func (c *Client) Close() {
+	c.mutex.Lock()
+	if c.stream != nil {
+		c.closeStream(c.stream)
+	}
+	c.mutex.Unlock()
+}
@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testQuery(id uint16, name string) []byte {
+	q := []byte{0, 0, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(q, id)
+	for _, l := range bytes.Split([]byte(name), []byte(".")) {
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	return append(q, 0, 0, 1, 0, 1)
+}
+
+func testAnswer(query []byte, ttl uint32) []byte {
+	a := append([]byte(nil), query...)
+	a[2] |= FLAG_QR
+	a[7] = 1
+	a = append(a, 0xc0, HEADER_SIZE, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 1, 2, 3, 4)
+	binary.BigEndian.PutUint32(a[len(a)-10:], ttl)
+	return a
+}
+
+// testUpstream answers every query with ttl and counts them
+func testUpstream(t *testing.T, ttl uint32) (addr string, queries *int32, close func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries = new(int32)
+	go func() {
+		buf := make([]byte, MAX_SIZE)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			pc.WriteTo(testAnswer(buf[:n], ttl), from)
+		}
+	}()
+	return pc.LocalAddr().String(), queries, func() { pc.Close() }
+}
+
+func testClient(t *testing.T, upstream string) (*Client, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&Server{Upstream: upstream, Timeout: time.Second}).Serve(l)
+	c := NewClient(func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}, DEFAULT_CACHE_SIZE)
+	return c, func() {
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestExchange(t *testing.T) {
+	upstream, queries, closeUpstream := testUpstream(t, 60)
+	defer closeUpstream()
+	c, closeClient := testClient(t, upstream)
+	defer closeClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := testQuery(0x1234, "example.com")
+	answer, err := c.Exchange(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(answer, testAnswer(q, 60)) {
+		t.Fatalf("answer %x", answer)
+	}
+	// names are case insensitive
+	q = testQuery(0x4321, "EXAMPLE.com")
+	answer, err = c.Exchange(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id(answer) != 0x4321 || rcode(answer) != RCODE_NOERROR {
+		t.Fatalf("cached answer %x", answer)
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Fatalf("%d queries upstream", n)
+	}
+
+	if _, err = c.Exchange(ctx, q[:HEADER_SIZE]); err != ErrInvalidMsg {
+		t.Fatalf("invalid query err %v", err)
+	}
+}
+
+func TestExchangeNoCache(t *testing.T) {
+	// answers with ttl 0 are not cached
+	upstream, queries, closeUpstream := testUpstream(t, 0)
+	defer closeUpstream()
+	c, closeClient := testClient(t, upstream)
+	defer closeClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Exchange(ctx, testQuery(1, "example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Fatalf("%d queries upstream", n)
+	}
+}
+
+func TestServfail(t *testing.T) {
+	upstream, _, closeUpstream := testUpstream(t, 60)
+	closeUpstream()
+	c, closeClient := testClient(t, upstream)
+	defer closeClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	answer, err := c.Exchange(ctx, testQuery(1, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode(answer) != RCODE_SERVFAIL || answer[2]&FLAG_QR == 0 {
+		t.Fatalf("answer %x", answer)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache(1)
+	q := testQuery(1, "example.com")
+	key, end, err := question(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put(key, testAnswer(q, 60), end)
+	c.entries[key].stored = time.Now().Add(-10 * time.Second)
+	answer, ok := c.get(key, 2)
+	if !ok || id(answer) != 2 {
+		t.Fatalf("answer %x", answer)
+	}
+	if ttl := binary.BigEndian.Uint32(answer[len(answer)-10:]); ttl != 50 {
+		t.Fatalf("ttl %d", ttl)
+	}
+
+	c.entries[key].expires = time.Now()
+	if _, ok = c.get(key, 2); ok {
+		t.Fatal("expired answer")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	q := testQuery(1, "example.com")
+	_, end, _ := question(q)
+	if s := udpSize(q, end); s != MIN_UDP_SIZE {
+		t.Fatalf("udp size %d", s)
+	}
+	// with an opt of 4096
+	q[11] = 1
+	q = append(q, 0, 0, TYPE_OPT, 0x10, 0, 0, 0, 0, 0, 0, 0)
+	if s := udpSize(q, end); s != 4096 {
+		t.Fatalf("udp size %d", s)
+	}
+	m := truncated(testAnswer(q, 60), end)
+	if len(m) != end || m[2]&FLAG_TC == 0 || m[7] != 0 {
+		t.Fatalf("truncated %x", m)
+	}
+}
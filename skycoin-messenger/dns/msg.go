@@ -0,0 +1,204 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	HEADER_SIZE = 12
+	// of a message over tcp, see rfc 1035 4.2.2
+	LEN_SIZE = 2
+	MAX_SIZE = 1<<16 - 1
+	// of answers over udp without edns
+	MIN_UDP_SIZE = 512
+
+	FLAG_QR = 0x80
+	FLAG_TC = 0x02
+
+	RCODE_NOERROR  = 0
+	RCODE_SERVFAIL = 2
+	RCODE_NXDOMAIN = 3
+
+	TYPE_OPT = 41
+)
+
+var (
+	ErrInvalidMsg     = errors.New("invalid dns message")
+	ErrNotOneQuestion = errors.New("dns message does not have one question")
+)
+
+func id(m []byte) uint16 {
+	return binary.BigEndian.Uint16(m)
+}
+
+func setID(m []byte, id uint16) {
+	binary.BigEndian.PutUint16(m, id)
+}
+
+func rcode(m []byte) byte {
+	return m[3] & 0x0f
+}
+
+// question returns the question of m as a cache key and where it ends
+func question(m []byte) (key string, end int, err error) {
+	if len(m) < HEADER_SIZE {
+		err = ErrInvalidMsg
+		return
+	}
+	if binary.BigEndian.Uint16(m[4:]) != 1 {
+		err = ErrNotOneQuestion
+		return
+	}
+	end = HEADER_SIZE
+	for {
+		if end >= len(m) {
+			err = ErrInvalidMsg
+			return
+		}
+		l := int(m[end])
+		if l == 0 {
+			end++
+			break
+		}
+		// no pointers in the question of a query
+		if l > 63 {
+			err = ErrInvalidMsg
+			return
+		}
+		end += 1 + l
+	}
+	end += 4
+	if end > len(m) {
+		err = ErrInvalidMsg
+		return
+	}
+	// names are case insensitive
+	key = strings.ToLower(string(m[HEADER_SIZE:end-4])) + string(m[end-4:end])
+	return
+}
+
+// skipName returns where the name at off ends
+func skipName(m []byte, off int) (int, error) {
+	for {
+		if off >= len(m) {
+			return 0, ErrInvalidMsg
+		}
+		l := int(m[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// a pointer ends the name
+			return off + 2, nil
+		case l > 63:
+			return 0, ErrInvalidMsg
+		}
+		off += 1 + l
+	}
+}
+
+// ttls returns the offsets of the ttls of the records of the answer m after
+// its question and the smallest of them, ok is false if it has none
+func ttls(m []byte, off int) (offsets []int, min uint32, ok bool, err error) {
+	n := int(binary.BigEndian.Uint16(m[6:])) + int(binary.BigEndian.Uint16(m[8:])) + int(binary.BigEndian.Uint16(m[10:]))
+	for i := 0; i < n; i++ {
+		off, err = skipName(m, off)
+		if err != nil {
+			return
+		}
+		if off+10 > len(m) {
+			err = ErrInvalidMsg
+			return
+		}
+		t := binary.BigEndian.Uint16(m[off:])
+		// the ttl of opt is not one
+		if t != TYPE_OPT {
+			ttl := binary.BigEndian.Uint32(m[off+4:])
+			if !ok || ttl < min {
+				min = ttl
+			}
+			ok = true
+			offsets = append(offsets, off+4)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+		if off > len(m) {
+			err = ErrInvalidMsg
+			return
+		}
+	}
+	return
+}
+
+// servfail returns the answer to query that the server failed
+func servfail(query []byte, end int) []byte {
+	m := make([]byte, end)
+	copy(m, query[:end])
+	m[2] |= FLAG_QR
+	m[3] = m[3]&0xf0 | RCODE_SERVFAIL
+	for i := 6; i < HEADER_SIZE; i++ {
+		m[i] = 0
+	}
+	return m
+}
+
+// udpSize returns the size of answers over udp the sender of query accepts,
+// its edns udp size or 512
+func udpSize(query []byte, off int) int {
+	size := MIN_UDP_SIZE
+	n := int(binary.BigEndian.Uint16(query[6:])) + int(binary.BigEndian.Uint16(query[8:])) + int(binary.BigEndian.Uint16(query[10:]))
+	for i := 0; i < n; i++ {
+		var err error
+		off, err = skipName(query, off)
+		if err != nil || off+10 > len(query) {
+			break
+		}
+		if binary.BigEndian.Uint16(query[off:]) == TYPE_OPT {
+			// the class of opt is the udp size
+			if s := int(binary.BigEndian.Uint16(query[off+2:])); s > size {
+				size = s
+			}
+			break
+		}
+		off += 10 + int(binary.BigEndian.Uint16(query[off+8:]))
+	}
+	return size
+}
+
+// truncated returns the header and the question of answer with tc set, so
+// the sender asks again over tcp
+func truncated(answer []byte, end int) []byte {
+	m := make([]byte, end)
+	copy(m, answer[:end])
+	m[2] |= FLAG_TC
+	for i := 6; i < HEADER_SIZE; i++ {
+		m[i] = 0
+	}
+	return m
+}
+
+// readMsg reads a message with its length in front
+func readMsg(r io.Reader) (m []byte, err error) {
+	var l [LEN_SIZE]byte
+	_, err = io.ReadFull(r, l[:])
+	if err != nil {
+		return
+	}
+	m = make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, m)
+	return
+}
+
+// writeMsg writes m with its length in front
+func writeMsg(w io.Writer, m []byte) (err error) {
+	if len(m) > MAX_SIZE {
+		return ErrInvalidMsg
+	}
+	b := make([]byte, LEN_SIZE+len(m))
+	binary.BigEndian.PutUint16(b, uint16(len(m)))
+	copy(b[LEN_SIZE:], m)
+	_, err = w.Write(b)
+	return
+}
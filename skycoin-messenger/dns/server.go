@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resolver of a Server without Upstream
+const DEFAULT_UPSTREAM = "1.1.1.1:53"
+
+// Server runs on the trusted node, it answers the queries of Clients that
+// arrive over transports with its Upstream resolver
+type Server struct {
+	Upstream string
+	// of a query to Upstream, DEFAULT_QUERY_TIMEOUT if 0
+	Timeout time.Duration
+}
+
+// Serve answers the queries of the conns of l until it is closed, l is e.g.
+// the listener of ListenApp
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the queries of conn until it is closed, at once and in the
+// order Upstream answers them
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	var mutex sync.Mutex
+	for {
+		query, err := readMsg(conn)
+		if err != nil {
+			return
+		}
+		_, end, err := question(query)
+		if err != nil {
+			log.Debugf("dns query from %s err %v", conn.RemoteAddr(), err)
+			continue
+		}
+		go func() {
+			answer, err := s.exchange(query)
+			if err != nil {
+				log.Debugf("dns upstream err %v", err)
+				answer = servfail(query, end)
+			}
+			mutex.Lock()
+			writeMsg(conn, answer)
+			mutex.Unlock()
+		}()
+	}
+}
+
+// exchange asks Upstream over udp and over tcp if the answer was truncated
+func (s *Server) exchange(query []byte) (answer []byte, err error) {
+	upstream := s.Upstream
+	if len(upstream) < 1 {
+		upstream = DEFAULT_UPSTREAM
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_QUERY_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout("udp", upstream, timeout)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(deadline)
+	_, err = conn.Write(query)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	buf := make([]byte, MAX_SIZE)
+	for {
+		var n int
+		n, err = conn.Read(buf)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		// drop stray datagrams
+		if n >= HEADER_SIZE && id(buf) == id(query) {
+			answer = buf[:n]
+			break
+		}
+	}
+	conn.Close()
+	if answer[2]&FLAG_TC == 0 {
+		return
+	}
+
+	conn, err = net.DialTimeout("tcp", upstream, time.Until(deadline))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	err = writeMsg(conn, query)
+	if err != nil {
+		return
+	}
+	return readMsg(conn)
+}
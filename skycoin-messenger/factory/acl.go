@@ -0,0 +1,240 @@
+package factory
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// ServiceACL decides the nodes the discovery shows a service to and that may
+// build app conns to it. The server enforces all of it, the node of the
+// service again all but the Rules, it does not know the context of the others
+type ServiceACL struct {
+	// hex keys of the nodes allowed, all if empty
+	Allow []string `json:",omitempty"`
+	// hex keys of the nodes denied even if allowed
+	Deny []string `json:",omitempty"`
+	// on the context the node registered with, see ConnConfig.Context. Every
+	// rule must pass
+	Rules []ACLRule `json:",omitempty"`
+	// unix after which the service is hidden from all, never if 0
+	Expires int64 `json:",omitempty"`
+}
+
+// ACLRule passes a node whose context has Key set to one of Values, or fails
+// it if Deny
+type ACLRule struct {
+	Key    string
+	Values []string
+	Deny   bool `json:",omitempty"`
+}
+
+// ACLCounters of the queries and app conns a service with an acl was
+// shown to or built for and hidden from or refused
+type ACLCounters struct {
+	Allowed uint64
+	Denied  uint64
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether node may see the service, ctx gives the context of
+// node. The rules are skipped if ctx is nil
+func (a *ServiceACL) allows(node cipher.PubKey, ctx func(key string) (string, bool), now time.Time) bool {
+	if a.Expires > 0 && now.Unix() > a.Expires {
+		return false
+	}
+	hex := node.Hex()
+	if contains(a.Deny, hex) {
+		return false
+	}
+	if len(a.Allow) > 0 && !contains(a.Allow, hex) {
+		return false
+	}
+	if ctx == nil {
+		return true
+	}
+	for _, r := range a.Rules {
+		v, ok := ctx(r.Key)
+		matched := ok && contains(r.Values, v)
+		if matched == r.Deny {
+			return false
+		}
+	}
+	return true
+}
+
+// acl returns the ACL of s, the AllowNodes of the services offered before
+// there were acls become its Allow
+func (s *Service) acl() *ServiceACL {
+	if s.ACL != nil {
+		return s.ACL
+	}
+	if len(s.AllowNodes) > 0 {
+		return &ServiceACL{Allow: s.AllowNodes}
+	}
+	return nil
+}
+
+// service returns the service key of ns
+func (ns *NodeServices) service(key cipher.PubKey) *Service {
+	for _, s := range ns.Services {
+		if s.Key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// contextOf reads the string values of the context of conn
+func contextOf(conn *Connection) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := conn.LoadContext(key)
+		if !ok {
+			return "", false
+		}
+		s, ok := v.(string)
+		return s, ok
+	}
+}
+
+// querier returns the key and context of the conn of a query, empty for a
+// conn without key
+func querier(conn *Connection) (key cipher.PubKey, ctx func(key string) (string, bool)) {
+	if conn == nil || !conn.IsKeySet() {
+		return EMPATY_PUBLIC_KEY, func(string) (string, bool) { return "", false }
+	}
+	return conn.GetKey(), contextOf(conn)
+}
+
+// _visible reports whether service of node is shown to querier and counts it
+// if the service has an acl
+func (sd *serviceDiscovery) _visible(service cipher.PubKey, ns *NodeServices, querier cipher.PubKey, ctx func(key string) (string, bool), now time.Time) bool {
+	s := ns.service(service)
+	if s == nil {
+		return true
+	}
+	acl := s.acl()
+	if acl == nil {
+		return true
+	}
+	allowed := acl.allows(querier, ctx, now)
+	sd.countACL(service, allowed)
+	return allowed
+}
+
+func (sd *serviceDiscovery) countACL(service cipher.PubKey, allowed bool) {
+	v, _ := sd.aclCounters.LoadOrStore(service, &ACLCounters{})
+	c := v.(*ACLCounters)
+	if allowed {
+		atomic.AddUint64(&c.Allowed, 1)
+	} else {
+		atomic.AddUint64(&c.Denied, 1)
+	}
+}
+
+// filterVisible drops the services of nodes, a result of findByAttributes,
+// not shown to the querier of conn
+func (sd *serviceDiscovery) filterVisible(nodes map[string][]cipher.PubKey, conn *Connection) map[string][]cipher.PubKey {
+	key, ctx := querier(conn)
+	now := time.Now()
+	sd.subscription2SubscriberMutex.RLock()
+	defer sd.subscription2SubscriberMutex.RUnlock()
+
+	for node, keys := range nodes {
+		nodeKey, err := cipher.PubKeyFromHex(node)
+		if err != nil {
+			continue
+		}
+		visible := keys[:0]
+		for _, k := range keys {
+			m, ok := sd.subscription2Subscriber[k]
+			if !ok {
+				continue
+			}
+			ns, ok := m.Nodes[nodeKey]
+			if !ok || sd._visible(k, ns, key, ctx, now) {
+				visible = append(visible, k)
+			}
+		}
+		if len(visible) < 1 {
+			delete(nodes, node)
+			continue
+		}
+		nodes[node] = visible
+	}
+	return nodes
+}
+
+// filterVisibleNodes drops the nodes of infos, a result of
+// findServiceAddresses, whose service is not shown to the querier of conn
+func (sd *serviceDiscovery) filterVisibleNodes(infos []*ServiceInfo, conn *Connection) []*ServiceInfo {
+	key, ctx := querier(conn)
+	now := time.Now()
+	sd.subscription2SubscriberMutex.RLock()
+	defer sd.subscription2SubscriberMutex.RUnlock()
+
+	for _, info := range infos {
+		if info == nil {
+			continue
+		}
+		m, ok := sd.subscription2Subscriber[info.PubKey]
+		if !ok {
+			continue
+		}
+		visible := info.Nodes[:0]
+		for _, n := range info.Nodes {
+			ns, ok := m.Nodes[n.PubKey]
+			if !ok || sd._visible(info.PubKey, ns, key, ctx, now) {
+				visible = append(visible, n)
+			}
+		}
+		info.Nodes = visible
+	}
+	return infos
+}
+
+// ACLCounters returns the counters of the services with an acl offered to
+// the server since it started
+func (f *MessengerFactory) ACLCounters() map[cipher.PubKey]ACLCounters {
+	result := make(map[cipher.PubKey]ACLCounters)
+	f.aclCounters.Range(func(k, v interface{}) bool {
+		c := v.(*ACLCounters)
+		result[k.(cipher.PubKey)] = ACLCounters{
+			Allowed: atomic.LoadUint64(&c.Allowed),
+			Denied:  atomic.LoadUint64(&c.Denied),
+		}
+		return true
+	})
+	return result
+}
+
+// allowBuild reports whether node may build an app conn to app on the
+// server conn c, run on the server
+func (f *MessengerFactory) allowBuild(c *Connection, app, node cipher.PubKey) bool {
+	s, ok := c.getService(app)
+	if !ok {
+		return true
+	}
+	acl := s.acl()
+	if acl == nil {
+		return true
+	}
+	var ctx func(key string) (string, bool)
+	if from, ok := f.GetConnection(node); ok {
+		ctx = contextOf(from)
+	} else {
+		ctx = func(string) (string, bool) { return "", false }
+	}
+	allowed := acl.allows(node, ctx, time.Now())
+	f.serviceDiscovery.countACL(app, allowed)
+	return allowed
+}
@@ -0,0 +1,71 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestServiceACL(t *testing.T) {
+	sd := newServiceDiscovery()
+	node := NewSeedConfig().publicKey
+	allowed, denied, other := NewSeedConfig().publicKey, NewSeedConfig().publicKey, NewSeedConfig().publicKey
+	open, private := NewSeedConfig().publicKey, NewSeedConfig().publicKey
+	sd.restore(node, &NodeServices{Services: []*Service{
+		{Key: open, Attributes: []string{"acl"}},
+		{Key: private, Attributes: []string{"acl"}, ACL: &ServiceACL{
+			Deny:  []string{denied.Hex()},
+			Rules: []ACLRule{{Key: "operator", Values: []string{"acme"}}, {Key: "banned", Values: []string{"1"}, Deny: true}},
+		}},
+	}})
+	querier := func(key cipher.PubKey, ctx map[string]string) *Connection {
+		c := &Connection{key: key, keySet: true}
+		for k, v := range ctx {
+			c.StoreContext(k, v)
+		}
+		return c
+	}
+	sees := func(c *Connection) bool {
+		keys := sd.filterVisible(sd.findByAttributes("acl"), c)[node.Hex()]
+		if len(keys) < 1 || keys[0] != open && keys[len(keys)-1] != open {
+			t.Fatal("service without acl hidden")
+		}
+		return len(keys) == 2
+	}
+
+	if !sees(querier(allowed, map[string]string{"operator": "acme"})) {
+		t.Fatal("hidden from a node the rules pass")
+	}
+	if sees(querier(denied, map[string]string{"operator": "acme"})) {
+		t.Fatal("shown to a denied node")
+	}
+	if sees(querier(other, map[string]string{"operator": "other"})) {
+		t.Fatal("shown to a node of another operator")
+	}
+	if sees(querier(other, map[string]string{"operator": "acme", "banned": "1"})) {
+		t.Fatal("shown to a node a deny rule fails")
+	}
+	if sees(nil) {
+		t.Fatal("shown to a conn without key")
+	}
+	var counters ACLCounters
+	if v, ok := sd.aclCounters.Load(private); ok {
+		counters = *v.(*ACLCounters)
+	}
+	if counters.Allowed != 1 || counters.Denied != 4 {
+		t.Fatalf("counters %+v", counters)
+	}
+
+	acl := &ServiceACL{Allow: []string{allowed.Hex()}, Expires: time.Now().Unix() - 1}
+	if acl.allows(allowed, nil, time.Now()) {
+		t.Fatal("expired acl allows")
+	}
+	acl.Expires = 0
+	if !acl.allows(allowed, nil, time.Now()) || acl.allows(other, nil, time.Now()) {
+		t.Fatal("allow list")
+	}
+	if (&Service{AllowNodes: []string{allowed.Hex()}}).acl().allows(other, nil, time.Now()) {
+		t.Fatal("AllowNodes not taken as the acl")
+	}
+}
@@ -0,0 +1,80 @@
+package factory
+
+import (
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// the server closes anonymous conns without reads for this long, unless
+// MessengerFactory.AnonymousIdleTimeout
+const DEFAULT_ANONYMOUS_IDLE_TIMEOUT = 30 * time.Second
+
+var ErrAnonymousOP = cn.NewError(cn.ErrUnauthorized, "op not allowed for anonymous clients")
+
+// ops an anonymous client may send, it only queries the discovery
+var anonymousOPs = map[byte]bool{
+	OP_REG_KEY:             true,
+	OP_REG_SIG:             true,
+	OP_QUERY_SERVICE_NODES: true,
+	OP_QUERY_BY_ATTRS:      true,
+	OP_PING:                true,
+}
+
+// AnonymousOPPolicies are the timeouts of anonymous clients for the ops
+// without one in MessengerFactory.OPPolicies, shorter than
+// DefaultOPPolicies as they only wait for the server
+func AnonymousOPPolicies() map[byte]OPPolicy {
+	return map[byte]OPPolicy{
+		OP_REG_KEY:             {Timeout: 5 * time.Second},
+		OP_QUERY_SERVICE_NODES: {Timeout: 2 * time.Second, Retries: 1},
+		OP_QUERY_BY_ATTRS:      {Timeout: 2 * time.Second, Retries: 1},
+		OP_PING:                {Timeout: 2 * time.Second},
+	}
+}
+
+var anonymousOPPolicies = AnonymousOPPolicies()
+
+// anonymousKeys are made for a conn and never stored
+func anonymousKeys() (key cipher.PubKey, keys cn.KeyProvider, err error) {
+	key, sec := cipher.GenerateKeyPair()
+	keys = cn.NewSecKeyProvider(key, sec)
+	return
+}
+
+// IsAnonymous reports whether the conn is of an anonymous client, see
+// ConnConfig.Anonymous
+func (c *Connection) IsAnonymous() (b bool) {
+	c.fieldsMutex.RLock()
+	b = c.anonymous
+	c.fieldsMutex.RUnlock()
+	return
+}
+
+func (c *Connection) setAnonymous() {
+	c.fieldsMutex.Lock()
+	c.anonymous = true
+	c.fieldsMutex.Unlock()
+}
+
+// acceptAnonymous keeps the anonymous conn out of the registry and gives it
+// the limits of the anonymous clients, run on the server at reg
+func (f *MessengerFactory) acceptAnonymous(conn *Connection) {
+	conn.setAnonymous()
+	conn.EnableSkipFactoryReg()
+	if f.AnonymousRateLimit != nil {
+		conn.SetRateLimit(f.AnonymousRateLimit)
+	}
+	p := cn.DefaultIdlePolicy
+	if f.IdlePolicy != nil {
+		p = *f.IdlePolicy
+	}
+	p.Timeout = f.AnonymousIdleTimeout
+	if p.Timeout <= 0 {
+		p.Timeout = DEFAULT_ANONYMOUS_IDLE_TIMEOUT
+	}
+	p.Close = true
+	conn.SetIdlePolicy(p)
+	conn.GetContextLogger().Debugf("anonymous client")
+}
@@ -0,0 +1,81 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestAnonymousClient(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25963"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sc := NewSeedConfig()
+	node := NewMessengerFactory()
+	if err := node.ConnectWithConfig("127.0.0.1:25963", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	node.ForEachConn(func(c *Connection) {
+		if err := c.OfferService("anonymous"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	resps := make(chan *QueryByAttrsResp, 1)
+	c := NewMessengerFactory()
+	err := c.ConnectWithConfig("127.0.0.1:25963", &ConnConfig{
+		Anonymous: true,
+		FindServiceNodesByAttributesCallback: func(resp *QueryByAttrsResp) {
+			resps <- resp
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var conn *Connection
+	c.ForEachConn(func(connection *Connection) { conn = connection })
+	if !conn.IsAnonymous() || conn.getOPPolicy(OP_QUERY_BY_ATTRS).Timeout == 0 {
+		t.Fatal("not anonymous")
+	}
+	registered := 0
+	s.ForEachAcceptedConnection(func(key cipher.PubKey, conn *Connection) { registered++ })
+	if registered != 1 {
+		t.Fatalf("%d conns registered", registered)
+	}
+
+	for i := 0; ; i++ {
+		if err := conn.FindServiceNodesByAttributes("anonymous"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case resp := <-resps:
+			if len(resp.Result[sc.publicKey.Hex()]) == 1 {
+				goto OFFER
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no resp to the query")
+		}
+		if i > 50 {
+			t.Fatal("service not found")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+OFFER:
+	// the server closes the conn of an op it does not allow
+	if err := conn.OfferService("anonymous"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.Disconnected():
+	case <-time.After(5 * time.Second):
+		t.Fatal("offer of an anonymous client accepted")
+	}
+}
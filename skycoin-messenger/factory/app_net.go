@@ -0,0 +1,125 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+var (
+	ErrAppConnFailed  = errors.New("app conn failed")
+	ErrAppAddress     = errors.New("app address is not node:app in hex")
+	ErrAppDialPending = errors.New("app conn to the app is being built already")
+)
+
+// ListenApp offers a service with attrs whose transports end at the returned
+// listener, e.g. for grpc.Server.Serve. The node dials address, a local port
+// if empty
+func (c *Connection) ListenApp(address string, attrs ...string) (l net.Listener, err error) {
+	if len(address) < 1 {
+		address = "127.0.0.1:0"
+	}
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		return
+	}
+	err = c.OfferServiceWithAddress(l.Addr().String(), attrs...)
+	if err != nil {
+		l.Close()
+		l = nil
+	}
+	return
+}
+
+// DialApp builds an app connection to app on node by the strategies of
+// MessengerFactory.BuildStrategies and returns the first to connect, once ctx
+// is done it gives up with ctx.Err()
+func (c *Connection) DialApp(ctx context.Context, node, app cipher.PubKey) (conn net.Conn, err error) {
+	conn, _, err = c.DialAppWithStrategy(ctx, node, app)
+	return
+}
+
+// dialAppByTransport builds the udp transport of node to app and connects to
+// the port the node serves it at
+func (c *Connection) dialAppByTransport(ctx context.Context, node, app cipher.PubKey) (conn net.Conn, err error) {
+	resp, err := c.awaitAppConnection(ctx, node, app)
+	if err != nil {
+		return
+	}
+	if resp.Failed {
+		c.GetContextLogger().Debugf("dial app %s: %s", app.Hex(), resp.Msg.Msg)
+		return nil, ErrAppConnFailed
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(resp.Host, strconv.Itoa(resp.Port)))
+}
+
+// awaitAppConnection builds the transport of node to app and returns its resp
+func (c *Connection) awaitAppConnection(ctx context.Context, node, app cipher.PubKey) (resp *AppConnResp, err error) {
+	ch := make(chan *AppConnResp, 1)
+	if _, loaded := c.appDials.LoadOrStore(app, ch); loaded {
+		return nil, ErrAppDialPending
+	}
+	defer c.appDials.Delete(app)
+	err = c.BuildAppConnection(node, app)
+	if err != nil {
+		return
+	}
+	select {
+	case resp = <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.Disconnected():
+		err = ErrAppConnFailed
+	}
+	return
+}
+
+// AppDialer returns a dialer of DialApp for addresses "node:app" of hex public
+// keys, e.g. grpc.Dial(node.Hex()+":"+app.Hex(), grpc.WithContextDialer(c.AppDialer()))
+func (c *Connection) AppDialer() func(ctx context.Context, address string) (net.Conn, error) {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		node, app, err := ParseAppAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		return c.DialApp(ctx, node, app)
+	}
+}
+
+// ParseAppAddress splits "node:app" into the public keys
+func ParseAppAddress(address string) (node, app cipher.PubKey, err error) {
+	keys := strings.Split(address, ":")
+	if len(keys) != 2 {
+		err = ErrAppAddress
+		return
+	}
+	node, err = cipher.PubKeyFromHex(keys[0])
+	if err != nil {
+		err = ErrAppAddress
+		return
+	}
+	app, err = cipher.PubKeyFromHex(keys[1])
+	if err != nil {
+		err = ErrAppAddress
+	}
+	return
+}
+
+// dialed hands resp to a DialApp waiting for it, false if none
+func (c *Connection) dialed(resp *AppConnResp) bool {
+	v, ok := c.appDials.Load(resp.App)
+	if !ok {
+		return false
+	}
+	r := *resp
+	select {
+	case v.(chan *AppConnResp) <- &r:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package factory
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestDialApp(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25947"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sc := NewSeedConfig()
+	c := NewMessengerFactory()
+	defer c.Close()
+	if err := c.ConnectWithConfig("127.0.0.1:25947", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	var client *Connection
+	c.ForEachConn(func(conn *Connection) { client = conn })
+	deadline := time.Now().Add(5 * time.Second)
+	server, ok := s.GetConnection(sc.publicKey)
+	for !ok {
+		if time.Now().After(deadline) {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+		server, ok = s.GetConnection(sc.publicKey)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	node, _ := cipher.GenerateKeyPair()
+	app, _ := cipher.GenerateKeyPair()
+
+	dial := func(failed bool) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		go func() {
+			// what the node of the server answers once the transport is up
+			for {
+				if _, ok := client.appDials.Load(app); ok {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			server.writeOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{App: app, Port: port, Failed: failed})
+		}()
+		return client.AppDialer()(ctx, node.Hex()+":"+app.Hex())
+	}
+	conn, err := dial(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err = dial(true); err != ErrAppConnFailed {
+		t.Fatalf("failed dial err %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = client.DialApp(ctx, node, app); err != context.DeadlineExceeded {
+		t.Fatalf("unanswered dial err %v", err)
+	}
+}
+
+func TestParseAppAddress(t *testing.T) {
+	node, _ := cipher.GenerateKeyPair()
+	app, _ := cipher.GenerateKeyPair()
+	n, a, err := ParseAppAddress(node.Hex() + ":" + app.Hex())
+	if err != nil || n != node || a != app {
+		t.Fatalf("parse %s %s %v", n.Hex(), a.Hex(), err)
+	}
+	for _, address := range []string{"", node.Hex(), node.Hex() + ":x", "127.0.0.1:80"} {
+		if _, _, err = ParseAppAddress(address); err != ErrAppAddress {
+			t.Fatalf("address %q err %v", address, err)
+		}
+	}
+}
+
+func TestDialAppStrategies(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25956"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	connect := func(f *MessengerFactory) (conn *Connection) {
+		sc := NewSeedConfig()
+		if err := f.ConnectWithConfig("127.0.0.1:25956", &ConnConfig{SeedConfig: sc}); err != nil {
+			t.Fatal(err)
+		}
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return
+	}
+	n := NewMessengerFactory()
+	defer n.Close()
+	node := connect(n)
+	c := NewMessengerFactory()
+	c.BuildStrategies = DefaultBuildStrategies()
+	defer c.Close()
+	client := connect(c)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	app, _ := cipher.GenerateKeyPair()
+	err = node.UpdateServices(&NodeServices{Services: []*Service{{
+		Key:      app,
+		Metadata: ServiceMetadata{SERVICE_METADATA_TCP_ADDRESS: l.Addr().String()},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the server is no proxy, the udp transport never answers
+	conn, strategy, err := client.DialAppWithStrategy(ctx, node.GetKey(), app)
+	if err != nil || strategy != BUILD_STRATEGY_TCP {
+		t.Fatalf("dial by %q err %v", strategy, err)
+	}
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := client.appDials.Load(app); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("udp strategy not cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other, _ := cipher.GenerateKeyPair()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// the tcp strategy fails first, the err is still the one of the first strategy
+	if _, _, err = client.DialAppWithStrategy(ctx, node.GetKey(), other); err != ErrNoDirectAddress {
+		t.Fatalf("dial app without address err %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package factory
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// match modes of FindServiceNodesByAttributePatterns
+const (
+	ATTR_MATCH_EXACT = ""
+	// the attributes starting with the pattern
+	ATTR_MATCH_PREFIX = "prefix"
+	// * matches any characters and ? one, e.g. "vpn-*"
+	ATTR_MATCH_WILDCARD = "wildcard"
+	// the attributes the regexp matches whole
+	ATTR_MATCH_REGEX = "regex"
+)
+
+// longest pattern the server compiles
+const MAX_ATTR_PATTERN_SIZE = 256
+
+func attrMatcher(match, pattern string) (fn func(attr string) bool, err error) {
+	if len(pattern) > MAX_ATTR_PATTERN_SIZE {
+		return nil, fmt.Errorf("attribute pattern longer than %d", MAX_ATTR_PATTERN_SIZE)
+	}
+	switch match {
+	case ATTR_MATCH_PREFIX:
+		return func(attr string) bool {
+			return strings.HasPrefix(attr, pattern)
+		}, nil
+	case ATTR_MATCH_WILDCARD:
+		pattern = regexp.QuoteMeta(pattern)
+		pattern = strings.Replace(pattern, `\*`, ".*", -1)
+		pattern = strings.Replace(pattern, `\?`, ".", -1)
+	case ATTR_MATCH_REGEX:
+	default:
+		return nil, fmt.Errorf("unknown attribute match %q", match)
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return
+	}
+	return re.MatchString, nil
+}
+
+// matchAttributes returns the keys of the services with an attribute fn
+// matches, subscription2SubscriberMutex must be held
+func (sd *serviceDiscovery) matchAttributes(fn func(attr string) bool) map[cipher.PubKey]struct{} {
+	keys := make(map[cipher.PubKey]struct{})
+	for attr, m := range sd.attribute2Keys {
+		if !fn(attr) {
+			continue
+		}
+		for k := range m {
+			keys[k] = struct{}{}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,154 @@
+package factory
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// policies picking the node of a service offered by more than one, see
+// MessengerFactory.BalancePolicy
+const (
+	// the first node by key
+	BALANCE_FIRST = ""
+	// each node in turn
+	BALANCE_ROUND_ROBIN = "round_robin"
+	// the node the factory has the fewest transports to, in turn if even
+	BALANCE_LEAST_CONNECTIONS = "least_connections"
+	// a random node, each as likely as its advertised capacity
+	BALANCE_WEIGHTED = "weighted"
+)
+
+// key of the Service.Metadata a service advertises its capacity in for
+// BALANCE_WEIGHTED, a positive integer. Nodes without one weigh 1
+const SERVICE_METADATA_CAPACITY = "capacity"
+
+// balancer keeps the turns of the services for round robin
+type balancer struct {
+	turns map[cipher.PubKey]uint64
+	rand  *rand.Rand
+	sync.Mutex
+}
+
+func (b *balancer) turn(service cipher.PubKey) (t uint64) {
+	b.Lock()
+	if b.turns == nil {
+		b.turns = make(map[cipher.PubKey]uint64)
+	}
+	t = b.turns[service]
+	b.turns[service]++
+	b.Unlock()
+	return
+}
+
+func (b *balancer) intn(n int) (r int) {
+	b.Lock()
+	if b.rand == nil {
+		b.rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	r = b.rand.Intn(n)
+	b.Unlock()
+	return
+}
+
+func capacity(m ServiceMetadata) int {
+	c, err := strconv.Atoi(m[SERVICE_METADATA_CAPACITY])
+	if err != nil || c < 1 {
+		return 1
+	}
+	return c
+}
+
+// PickNode returns the node of nodes offering service the BalancePolicy of
+// the factory picks
+func (f *MessengerFactory) PickNode(service cipher.PubKey, nodes []*NodeInfo) (node cipher.PubKey, ok bool) {
+	if len(nodes) < 1 {
+		return
+	}
+	sorted := append([]*NodeInfo(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].PubKey[:], sorted[j].PubKey[:]) < 0
+	})
+	switch f.BalancePolicy {
+	case BALANCE_ROUND_ROBIN:
+		node = sorted[f.balancer.turn(service)%uint64(len(sorted))].PubKey
+	case BALANCE_LEAST_CONNECTIONS:
+		transports := f.transportsByNode()
+		var least []*NodeInfo
+		for _, n := range sorted {
+			if len(least) > 0 && transports[n.PubKey] > transports[least[0].PubKey] {
+				continue
+			}
+			if len(least) > 0 && transports[n.PubKey] < transports[least[0].PubKey] {
+				least = least[:0]
+			}
+			least = append(least, n)
+		}
+		node = least[f.balancer.turn(service)%uint64(len(least))].PubKey
+	case BALANCE_WEIGHTED:
+		total := 0
+		for _, n := range sorted {
+			total += capacity(n.Metadata)
+		}
+		r := f.balancer.intn(total)
+		for _, n := range sorted {
+			r -= capacity(n.Metadata)
+			if r < 0 {
+				node = n.PubKey
+				break
+			}
+		}
+	default:
+		node = sorted[0].PubKey
+	}
+	return node, true
+}
+
+// transportsByNode counts the transports the conns of the factory built to
+// each node
+func (f *MessengerFactory) transportsByNode() map[cipher.PubKey]int {
+	count := make(map[cipher.PubKey]int)
+	f.ForEachConn(func(c *Connection) {
+		c.appTransportsMutex.RLock()
+		for _, tr := range c.appTransports {
+			if tr.IsClientSide() {
+				count[tr.ToNode]++
+			}
+		}
+		c.appTransportsMutex.RUnlock()
+	})
+	return count
+}
+
+// ServiceNodes returns the nodes of resp offering service with its metadata
+func (resp *QueryByAttrsResp) ServiceNodes(service cipher.PubKey) (nodes []*NodeInfo) {
+	for n, keys := range resp.Result {
+		for _, key := range keys {
+			if key != service {
+				continue
+			}
+			node, err := cipher.PubKeyFromHex(n)
+			if err != nil {
+				break
+			}
+			nodes = append(nodes, &NodeInfo{PubKey: node, Metadata: resp.Metadata[n][key.Hex()]})
+			break
+		}
+	}
+	return
+}
+
+// BuildBalancedAppConnection builds the app connection to app on the node of
+// nodes the BalancePolicy of the factory picks, e.g. the Nodes of a
+// ServiceInfo or the ServiceNodes of a QueryByAttrsResp
+func (c *Connection) BuildBalancedAppConnection(app cipher.PubKey, nodes []*NodeInfo) error {
+	node, ok := c.factory.PickNode(app, nodes)
+	if !ok {
+		return ErrNoServiceNode
+	}
+	return c.BuildAppConnection(node, app)
+}
@@ -0,0 +1,59 @@
+package factory
+
+import (
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestPickNode(t *testing.T) {
+	service := NewSeedConfig().publicKey
+	resp := &QueryByAttrsResp{Result: make(map[string][]cipher.PubKey), Metadata: make(map[string]map[string]ServiceMetadata)}
+	for i := 0; i < 3; i++ {
+		node := NewSeedConfig().publicKey.Hex()
+		resp.Result[node] = []cipher.PubKey{service}
+		if i == 0 {
+			resp.Metadata[node] = map[string]ServiceMetadata{service.Hex(): {SERVICE_METADATA_CAPACITY: "1000"}}
+		}
+	}
+	nodes := resp.ServiceNodes(service)
+	if len(nodes) != 3 {
+		t.Fatalf("%d service nodes", len(nodes))
+	}
+	f := NewMessengerFactory()
+	picks := func(policy string) map[cipher.PubKey]int {
+		f.BalancePolicy = policy
+		count := make(map[cipher.PubKey]int)
+		for i := 0; i < 300; i++ {
+			node, ok := f.PickNode(service, nodes)
+			if !ok {
+				t.Fatal("no node picked")
+			}
+			count[node]++
+		}
+		return count
+	}
+
+	if count := picks(BALANCE_FIRST); len(count) != 1 {
+		t.Fatalf("first picked %d nodes", len(count))
+	}
+	for _, policy := range []string{BALANCE_ROUND_ROBIN, BALANCE_LEAST_CONNECTIONS} {
+		for _, n := range nodes {
+			if c := picks(policy)[n.PubKey]; c != 100 {
+				t.Fatalf("%s picked a node %d times of 300", policy, c)
+			}
+		}
+	}
+	heavy := nodes[0].PubKey
+	for _, n := range nodes {
+		if capacity(n.Metadata) == 1000 {
+			heavy = n.PubKey
+		}
+	}
+	if c := picks(BALANCE_WEIGHTED)[heavy]; c < 270 {
+		t.Fatalf("weighted picked the node of capacity 1000 %d times of 300", c)
+	}
+	if _, ok := f.PickNode(service, nil); ok {
+		t.Fatal("picked of no nodes")
+	}
+}
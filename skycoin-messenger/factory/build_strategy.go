@@ -0,0 +1,156 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// the udp transport the node builds through the server
+	BUILD_STRATEGY_UDP = "udp"
+	// tcp straight to the address in the metadata of the service
+	BUILD_STRATEGY_TCP = "tcp"
+)
+
+// key of Service.Metadata with the address apps reach the service at over
+// tcp, see TCPBuildStrategy
+const SERVICE_METADATA_TCP_ADDRESS = "tcp-address"
+
+var ErrNoDirectAddress = errors.New("service has no direct tcp address")
+
+// BuildStrategy is a way of DialApp to connect to an app
+type BuildStrategy struct {
+	Name string
+	// the strategy starts this long after the one before it, at once if 0
+	Delay time.Duration
+	Dial  func(ctx context.Context, c *Connection, node, app cipher.PubKey) (net.Conn, error)
+}
+
+// UDPBuildStrategy builds the transport of the node, the only strategy if
+// MessengerFactory.BuildStrategies is empty
+func UDPBuildStrategy() BuildStrategy {
+	return BuildStrategy{Name: BUILD_STRATEGY_UDP, Dial: func(ctx context.Context, c *Connection, node, app cipher.PubKey) (net.Conn, error) {
+		return c.dialAppByTransport(ctx, node, app)
+	}}
+}
+
+// TCPBuildStrategy dials the SERVICE_METADATA_TCP_ADDRESS the node offers the
+// app with, found by a query of the app key
+func TCPBuildStrategy() BuildStrategy {
+	return BuildStrategy{Name: BUILD_STRATEGY_TCP, Dial: func(ctx context.Context, c *Connection, node, app cipher.PubKey) (net.Conn, error) {
+		address, err := c.findAppTCPAddress(ctx, node, app)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	}}
+}
+
+// DefaultBuildStrategies races tcp to the app against the udp transport
+func DefaultBuildStrategies() []BuildStrategy {
+	return []BuildStrategy{TCPBuildStrategy(), UDPBuildStrategy()}
+}
+
+type buildResult struct {
+	index int
+	conn  net.Conn
+	err   error
+}
+
+// DialAppWithStrategy is DialApp that returns the name of the strategy that
+// connected. The strategies still running are cancelled then and the conns
+// they make are closed. If all fail the err is the one of the first strategy
+func (c *Connection) DialAppWithStrategy(ctx context.Context, node, app cipher.PubKey) (conn net.Conn, strategy string, err error) {
+	strategies := c.factory.BuildStrategies
+	if len(strategies) < 1 {
+		strategies = []BuildStrategy{UDPBuildStrategy()}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan buildResult, len(strategies))
+	var delay time.Duration
+	for i, s := range strategies {
+		delay += s.Delay
+		go func(i int, s BuildStrategy, delay time.Duration) {
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					results <- buildResult{index: i, err: ctx.Err()}
+					return
+				}
+			}
+			conn, err := s.Dial(ctx, c, node, app)
+			results <- buildResult{index: i, conn: conn, err: err}
+		}(i, s, delay)
+	}
+	errs := make([]error, len(strategies))
+	for left := len(strategies); left > 0; left-- {
+		r := <-results
+		if r.err != nil {
+			c.GetContextLogger().Debugf("dial app %s by %s: %v", app.Hex(), strategies[r.index].Name, r.err)
+			errs[r.index] = r.err
+			continue
+		}
+		cancel()
+		go func(left int) {
+			for ; left > 0; left-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(left - 1)
+		strategy = strategies[r.index].Name
+		c.GetContextLogger().Debugf("dial app %s by %s", app.Hex(), strategy)
+		return r.conn, strategy, nil
+	}
+	return nil, "", errs[0]
+}
+
+// findAppTCPAddress queries the discovery for the SERVICE_METADATA_TCP_ADDRESS
+// of app on node
+func (c *Connection) findAppTCPAddress(ctx context.Context, node, app cipher.PubKey) (address string, err error) {
+	q := newQuery([]cipher.PubKey{app})
+	ch := make(chan string, 1)
+	// run by QueryResp.Run, the resp is pooled so only the address leaves it
+	c.keyQueries.Store(q.Seq, func(resp *QueryResp) {
+		var address string
+		for _, info := range resp.Result {
+			if info == nil || info.PubKey != app {
+				continue
+			}
+			for _, n := range info.Nodes {
+				if n.PubKey == node {
+					address = n.Metadata[SERVICE_METADATA_TCP_ADDRESS]
+				}
+			}
+		}
+		select {
+		case ch <- address:
+		default:
+		}
+	})
+	defer c.keyQueries.Delete(q.Seq)
+	err = c.writeTrackedOP(pendingOPKey{op: OP_QUERY_SERVICE_NODES, seq: q.Seq}, q)
+	if err != nil {
+		return
+	}
+	select {
+	case address = <-ch:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.Disconnected():
+		return "", ErrAppConnFailed
+	}
+	if len(address) < 1 {
+		err = ErrNoDirectAddress
+	}
+	return
+}
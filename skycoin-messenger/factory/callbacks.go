@@ -0,0 +1,214 @@
+package factory
+
+import (
+	"context"
+	"sync"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// errors of the callbacks, matched by their kind with errors.Is, e.g.
+// errors.Is(err, cn.ErrNotFound). A query or app conn without a resp in time
+// fails with ErrOPTimeout
+var (
+	ErrNoServiceNodes = cn.NewError(cn.ErrNotFound, "no service nodes found")
+	ErrAppNotFound    = cn.NewError(cn.ErrNotFound, "node or app not found")
+	ErrAppNotAllowed  = cn.NewError(cn.ErrUnauthorized, "app conn not allowed")
+)
+
+// KeysQueryCallback gets the resp of a query by keys or why there is none.
+// The resp is pooled, it must not be kept once the callback returns
+type KeysQueryCallback func(ctx context.Context, resp *QueryResp, err error)
+
+// AttrsQueryCallback gets the resp of a query by attributes or why there is
+// none, the resp must not be kept either
+type AttrsQueryCallback func(ctx context.Context, resp *QueryByAttrsResp, err error)
+
+// AppConnCallback gets the resp of BuildAppConnection, err is set if it
+// failed. The feedback returned is sent to the app, one with the port and
+// the msg of resp if nil
+type AppConnCallback func(ctx context.Context, resp *AppConnResp, err error) *AppFeedback
+
+// typedErr is Err or ErrNoServiceNodes if no key has a node
+func (resp *QueryResp) typedErr() error {
+	if resp.Err != nil {
+		return resp.Err
+	}
+	for _, info := range resp.Result {
+		if info != nil && len(info.Nodes) > 0 {
+			return nil
+		}
+	}
+	return ErrNoServiceNodes
+}
+
+func (resp *QueryByAttrsResp) typedErr() error {
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if len(resp.Result) < 1 && len(resp.Next) < 1 {
+		return ErrNoServiceNodes
+	}
+	return nil
+}
+
+// typedErr is the error of a failed app conn by the priority of its msg
+func (resp *AppConnResp) typedErr() error {
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if !resp.Failed {
+		return nil
+	}
+	switch resp.Msg.Priority {
+	case NotFound:
+		return ErrAppNotFound
+	case NotAllowed:
+		return ErrAppNotAllowed
+	case Timeout:
+		return ErrOPTimeout
+	}
+	return ErrAppConnFailed
+}
+
+// Context is done once the conn is closed, it is the ctx of the callbacks
+// of ConnConfig
+func (c *Connection) Context() context.Context {
+	c.ctxOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.ctx = ctx
+		go func() {
+			<-c.Disconnected()
+			cancel()
+		}()
+	})
+	return c.ctx
+}
+
+// queryWatch ends a query made with a ctx once, by its resp, by ctx or by
+// the conn closing
+type queryWatch struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func (w *queryWatch) finish(fn func()) {
+	w.once.Do(func() {
+		close(w.done)
+		fn()
+	})
+}
+
+// watchQuery fails the query of key once ctx is done or the conn closed, a
+// resp after that is dropped if the op has an OPPolicy
+func (c *Connection) watchQuery(ctx context.Context, key pendingOPKey, w *queryWatch, fail func(err error)) {
+	go func() {
+		var err error
+		select {
+		case <-w.done:
+			return
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-c.Disconnected():
+			err = cn.ErrConnClosed
+		}
+		c.pendingOPs.Delete(key)
+		fail(err)
+	}()
+}
+
+// FindServiceNodesByKeysContext finds the nodes of the services of keys, fn
+// gets the resp once or the error, ErrNoServiceNodes if no key has a node,
+// ErrOPTimeout or ctx.Err()
+func (c *Connection) FindServiceNodesByKeysContext(ctx context.Context, keys []cipher.PubKey, fn KeysQueryCallback) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	query := newQuery(keys)
+	w := &queryWatch{done: make(chan struct{})}
+	finish := func(resp *QueryResp, err error) {
+		w.finish(func() {
+			c.keyQueries.Delete(query.Seq)
+			fn(ctx, resp, err)
+		})
+	}
+	c.keyQueries.Store(query.Seq, func(resp *QueryResp) { finish(resp, resp.typedErr()) })
+	key := pendingOPKey{op: OP_QUERY_SERVICE_NODES, seq: query.Seq}
+	err = c.writeTrackedOP(key, query)
+	if err != nil {
+		w.finish(func() { c.keyQueries.Delete(query.Seq) })
+		return
+	}
+	c.watchQuery(ctx, key, w, func(err error) { finish(nil, err) })
+	return
+}
+
+// FindServiceNodesByAttributesContext finds the nodes offering services of
+// attrs, fn gets the resp once or the error like
+// FindServiceNodesByKeysContext
+func (c *Connection) FindServiceNodesByAttributesContext(ctx context.Context, fn AttrsQueryCallback, attrs ...string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	query := c.newQueryByAttrs(attrs)
+	w := &queryWatch{done: make(chan struct{})}
+	finish := func(resp *QueryByAttrsResp, err error) {
+		w.finish(func() {
+			c.attrQueries.Delete(query.Seq)
+			fn(ctx, resp, err)
+		})
+	}
+	c.attrQueries.Store(query.Seq, func(resp *QueryByAttrsResp) { finish(resp, resp.typedErr()) })
+	key := pendingOPKey{op: OP_QUERY_BY_ATTRS, seq: query.Seq}
+	err = c.writeTrackedOP(key, query)
+	if err != nil {
+		w.finish(func() { c.attrQueries.Delete(query.Seq) })
+		return
+	}
+	c.watchQuery(ctx, key, w, func(err error) { finish(nil, err) })
+	return
+}
+
+// keysQueryResp passes the resp of a query by keys to the callback of its
+// seq or of the conn
+func (c *Connection) keysQueryResp(resp *QueryResp) {
+	if fn, ok := c.keyQueries.Load(resp.Seq); ok {
+		fn.(func(resp *QueryResp))(resp)
+		return
+	}
+	if c.onServiceNodesByKeys != nil {
+		c.onServiceNodesByKeys(c.Context(), resp, resp.typedErr())
+	} else if c.findServiceNodesByKeysCallback != nil {
+		c.findServiceNodesByKeysCallback(resp)
+	}
+}
+
+func (c *Connection) attrsQueryResp(resp *QueryByAttrsResp) {
+	if fn, ok := c.attrQueries.Load(resp.Seq); ok {
+		fn.(func(resp *QueryByAttrsResp))(resp)
+		return
+	}
+	if c.onServiceNodesByAttributes != nil {
+		c.onServiceNodesByAttributes(c.Context(), resp, resp.typedErr())
+	} else if c.findServiceNodesByAttributesCallback != nil {
+		c.findServiceNodesByAttributesCallback(resp)
+	}
+}
+
+func (c *Connection) hasAppConnCallback() bool {
+	return c.onAppConnection != nil || c.appConnectionInitCallback != nil
+}
+
+// appConnResp returns the feedback of the callback of the conn to resp
+func (c *Connection) appConnResp(resp *AppConnResp) (fb *AppFeedback) {
+	if c.onAppConnection != nil {
+		fb = c.onAppConnection(c.Context(), resp, resp.typedErr())
+	} else if c.appConnectionInitCallback != nil {
+		fb = c.appConnectionInitCallback(resp)
+	}
+	if fb == nil {
+		fb = &AppFeedback{Port: resp.Port, Failed: resp.Failed, Msg: resp.Msg}
+	}
+	return
+}
@@ -0,0 +1,129 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestContextCallbacks(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25970"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// never answers the queries without servers to forward them to
+	proxy := NewMessengerFactory()
+	proxy.Proxy = true
+	proxy.SetDefaultSeedConfig(NewSeedConfig())
+	if err := proxy.Listen("127.0.0.1:25971"); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	connect := func(address string, config *ConnConfig) (*MessengerFactory, *Connection) {
+		f := NewMessengerFactory()
+		config.SeedConfig = NewSeedConfig()
+		if err := f.ConnectWithConfig(address, config); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return f, conn
+	}
+	a, offering := connect("127.0.0.1:25970", &ConnConfig{})
+	defer a.Close()
+	if err := offering.OfferService("cb"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(s.serviceDiscovery.findByAttributes("cb")) < 1; i++ {
+		if i > 50 {
+			t.Fatal("service not offered")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	type result struct {
+		ctx   context.Context
+		nodes int
+		err   error
+	}
+	results := make(chan result, 4)
+	b, conn := connect("127.0.0.1:25970", &ConnConfig{
+		OnServiceNodesByAttributes: func(ctx context.Context, resp *QueryByAttrsResp, err error) {
+			results <- result{ctx: ctx, nodes: len(resp.Result), err: err}
+		},
+	})
+	defer b.Close()
+	next := func() result {
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("no callback")
+		}
+		return result{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	attrs := func(ctx context.Context, resp *QueryByAttrsResp, err error) {
+		r := result{ctx: ctx, err: err}
+		if resp != nil {
+			r.nodes = len(resp.Result)
+		}
+		results <- r
+	}
+	if err := conn.FindServiceNodesByAttributesContext(ctx, attrs, "cb"); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err != nil || r.nodes != 1 || r.ctx != ctx {
+		t.Fatalf("query of an offered service %+v", r)
+	}
+	if err := conn.FindServiceNodesByAttributesContext(ctx, attrs, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err != ErrNoServiceNodes || !errors.Is(r.err, cn.ErrNotFound) {
+		t.Fatalf("query of a missing service err %v", r.err)
+	}
+
+	// the callback of the conn
+	if err := conn.FindServiceNodesByAttributes("cb"); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err != nil || r.nodes != 1 || r.ctx != conn.Context() {
+		t.Fatalf("conn callback %+v", r)
+	}
+
+	p, unanswered := connect("127.0.0.1:25971", &ConnConfig{})
+	defer p.Close()
+	short, cancelShort := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelShort()
+	errs := make(chan error, 1)
+	err := unanswered.FindServiceNodesByKeysContext(short, []cipher.PubKey{offering.GetKey()}, func(ctx context.Context, resp *QueryResp, err error) {
+		errs <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errs:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unanswered query err %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unanswered query not failed by its ctx")
+	}
+
+	b.Close()
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("ctx of a closed conn not done")
+	}
+}
@@ -0,0 +1,49 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+func TestRegCompression(t *testing.T) {
+	msc := NewSeedConfig()
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(msc)
+	s.Compressions = []string{cn.COMPRESSION_SNAPPY}
+	if err := s.Listen("127.0.0.1:25994"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewMessengerFactory()
+	defer c.Close()
+	compression := func(offered []string) string {
+		sc := NewSeedConfig()
+		err := c.ConnectWithConfig("127.0.0.1:25994", &ConnConfig{
+			SeedConfig:   sc,
+			TargetKey:    msc.publicKey,
+			UseCrypto:    RegWithKeyAndEncryptionVersion,
+			Compressions: offered,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		for i := 0; i < 100 && conn == nil; i++ {
+			conn, _ = s.GetConnection(sc.publicKey)
+			time.Sleep(10 * time.Millisecond)
+		}
+		if conn == nil {
+			t.Fatal("not registered")
+		}
+		return conn.GetCompression()
+	}
+	if name := compression([]string{cn.COMPRESSION_SNAPPY}); name != cn.COMPRESSION_SNAPPY {
+		t.Fatalf("offered snappy got %q", name)
+	}
+	// regs are pooled, the offer of the last client must not carry over
+	if name := compression(nil); name != cn.COMPRESSION_NONE {
+		t.Fatalf("offered none got %q", name)
+	}
+}
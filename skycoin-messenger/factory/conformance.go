@@ -0,0 +1,315 @@
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// wait for each frame of a conformance case
+const CONFORMANCE_TIMEOUT = 5 * time.Second
+
+// ConformanceCase is a scripted exchange with a server over unencrypted tcp,
+// the cases of testdata/conformance are run by any implementation of the
+// protocol. "$PUBKEY" in a Body is replaced by the key of SecKey, $PUBKEY_HEX
+// in a Body or Message by its hex
+type ConformanceCase struct {
+	Name        string
+	Description string `json:",omitempty"`
+	// hex secret key of the client
+	SecKey string `json:",omitempty"`
+	Steps  []ConformanceStep
+}
+
+// ConformanceStep does one of its fields
+type ConformanceStep struct {
+	// sent as a TYPE_NORMAL frame
+	Send *ConformanceFrame `json:",omitempty"`
+	// hex written to the socket as is
+	Raw  string           `json:",omitempty"`
+	Sign *ConformanceSign `json:",omitempty"`
+	// the next frame, acks are skipped
+	Expect *ConformanceFrame `json:",omitempty"`
+	// the server closes the connection without sending another frame
+	ExpectClose bool `json:",omitempty"`
+}
+
+// ConformanceFrame is an op message or, by Type, a ping or pong
+type ConformanceFrame struct {
+	// msg.TYPE_NORMAL if 0, only compared on Expect
+	Type byte `json:",omitempty"`
+	Op   byte
+	// json of the op, compared as decoded values
+	Body json.RawMessage `json:",omitempty"`
+	// fields Body must have, for values chosen by the server
+	Fields []string `json:",omitempty"`
+	// hex of the whole op message, used instead of Op and Body if set
+	Message string `json:",omitempty"`
+}
+
+// ConformanceSign sends Op with {"Sig": sig} of the sha256 of the bytes in
+// Field of the last expected Body
+type ConformanceSign struct {
+	Op    byte
+	Field string
+	// SecKey of the case if empty
+	SecKey string `json:",omitempty"`
+}
+
+// LoadConformanceCases reads a json array of cases
+func LoadConformanceCases(path string) (cases []*ConformanceCase, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &cases)
+	return
+}
+
+// RunConformanceCase runs c against the server at address on a new connection
+func RunConformanceCase(address string, c *ConformanceCase) error {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := &conformanceRunner{conn: conn, reader: bufio.NewReader(conn)}
+	if len(c.SecKey) > 0 {
+		r.secKey, err = cipher.SecKeyFromHex(c.SecKey)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.Name, err)
+		}
+		r.pubKey = cipher.PubKeyFromSecKey(r.secKey)
+	}
+	for i, step := range c.Steps {
+		err = r.step(&step)
+		if err != nil {
+			return fmt.Errorf("%s step %d: %w", c.Name, i, err)
+		}
+	}
+	return nil
+}
+
+type conformanceRunner struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    uint32
+	secKey cipher.SecKey
+	pubKey cipher.PubKey
+	// fields of the last expected body
+	fields map[string]json.RawMessage
+}
+
+func (r *conformanceRunner) step(s *ConformanceStep) (err error) {
+	switch {
+	case s.Send != nil:
+		var m []byte
+		m, err = r.message(s.Send)
+		if err != nil {
+			return
+		}
+		err = r.send(m)
+	case len(s.Raw) > 0:
+		var b []byte
+		b, err = hex.DecodeString(s.Raw)
+		if err != nil {
+			return
+		}
+		_, err = r.conn.Write(b)
+	case s.Sign != nil:
+		err = r.sign(s.Sign)
+	case s.Expect != nil:
+		err = r.expect(s.Expect)
+	case s.ExpectClose:
+		err = r.expectClose()
+	default:
+		err = fmt.Errorf("empty step")
+	}
+	return
+}
+
+func (r *conformanceRunner) replace(s string) string {
+	if strings.Contains(s, `"$PUBKEY"`) {
+		js, _ := json.Marshal(r.pubKey)
+		s = strings.Replace(s, `"$PUBKEY"`, string(js), -1)
+	}
+	return strings.Replace(s, "$PUBKEY_HEX", r.pubKey.Hex(), -1)
+}
+
+func (r *conformanceRunner) message(f *ConformanceFrame) ([]byte, error) {
+	if len(f.Message) > 0 {
+		return hex.DecodeString(r.replace(f.Message))
+	}
+	m := make([]byte, MSG_HEADER_END, MSG_HEADER_END+len(f.Body))
+	m[MSG_OP_BEGIN] = f.Op
+	if len(f.Body) > 0 {
+		m = append(m, r.replace(string(f.Body))...)
+	}
+	return m, nil
+}
+
+func (r *conformanceRunner) send(m []byte) error {
+	r.seq++
+	_, err := r.conn.Write(msg.New(msg.TYPE_NORMAL, r.seq, m).Bytes())
+	return err
+}
+
+func (r *conformanceRunner) sign(s *ConformanceSign) (err error) {
+	sk := r.secKey
+	if len(s.SecKey) > 0 {
+		sk, err = cipher.SecKeyFromHex(s.SecKey)
+		if err != nil {
+			return
+		}
+	}
+	v, ok := r.fields[s.Field]
+	if !ok {
+		return fmt.Errorf("no field %s to sign", s.Field)
+	}
+	var b []byte
+	err = json.Unmarshal(v, &b)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(&struct{ Sig cipher.Sig }{cipher.SignHash(cipher.SumSHA256(b), sk)})
+	if err != nil {
+		return
+	}
+	m := make([]byte, MSG_HEADER_END+len(body))
+	m[MSG_OP_BEGIN] = s.Op
+	copy(m[MSG_HEADER_END:], body)
+	return r.send(m)
+}
+
+// read returns the next frame that is not an ack, normal and resp frames
+// are acked like TCPConn does
+func (r *conformanceRunner) read() (t byte, body []byte, err error) {
+	for {
+		r.conn.SetReadDeadline(time.Now().Add(CONFORMANCE_TIMEOUT))
+		t, err = r.reader.ReadByte()
+		if err != nil {
+			return
+		}
+		switch t {
+		case msg.TYPE_ACK:
+			_, err = r.reader.Discard(msg.MSG_SEQ_SIZE)
+			if err != nil {
+				return
+			}
+		case msg.TYPE_PING, msg.TYPE_PONG:
+			body = make([]byte, msg.PING_MSG_TIME_SIZE)
+			_, err = io.ReadFull(r.reader, body)
+			return
+		case msg.TYPE_NORMAL, msg.TYPE_REQ, msg.TYPE_RESP:
+			header := make([]byte, msg.MSG_HEADER_SIZE)
+			header[msg.MSG_TYPE_BEGIN] = t
+			_, err = io.ReadFull(r.reader, header[msg.MSG_TYPE_END:])
+			if err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(header[msg.MSG_LEN_BEGIN:msg.MSG_LEN_END])
+			if n > msg.MAX_MESSAGE_SIZE {
+				err = fmt.Errorf("frame of %d bytes", n)
+				return
+			}
+			body = make([]byte, n)
+			_, err = io.ReadFull(r.reader, body)
+			if err != nil || t == msg.TYPE_REQ {
+				return
+			}
+			ack := make([]byte, msg.MSG_SEQ_END)
+			ack[msg.MSG_TYPE_BEGIN] = msg.TYPE_ACK
+			copy(ack[msg.MSG_SEQ_BEGIN:], header[msg.MSG_SEQ_BEGIN:msg.MSG_SEQ_END])
+			_, err = r.conn.Write(ack)
+			return
+		default:
+			err = fmt.Errorf("unknown frame type %x", t)
+			return
+		}
+	}
+}
+
+func (r *conformanceRunner) expect(f *ConformanceFrame) (err error) {
+	t, body, err := r.read()
+	if err != nil {
+		return
+	}
+	want := f.Type
+	if want == 0 {
+		want = msg.TYPE_NORMAL
+	}
+	if t != want {
+		return fmt.Errorf("frame type %x want %x", t, want)
+	}
+	if len(f.Message) > 0 {
+		var m []byte
+		m, err = r.message(f)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(body, m) {
+			err = fmt.Errorf("message %x want %x", body, m)
+		}
+		return
+	}
+	if want != msg.TYPE_NORMAL && want != msg.TYPE_REQ && want != msg.TYPE_RESP {
+		return
+	}
+	if len(body) < MSG_HEADER_END || body[MSG_OP_BEGIN] != f.Op {
+		return fmt.Errorf("message %x want op %x", body, f.Op)
+	}
+	js := body[MSG_HEADER_END:]
+	r.fields = nil
+	if len(js) > 0 {
+		err = json.Unmarshal(js, &r.fields)
+		if err != nil {
+			return fmt.Errorf("body %s: %v", js, err)
+		}
+	}
+	for _, name := range f.Fields {
+		if _, ok := r.fields[name]; !ok {
+			return fmt.Errorf("body %s without %s", js, name)
+		}
+	}
+	if len(f.Body) > 0 {
+		var got, want interface{}
+		json.Unmarshal(js, &got)
+		err = json.Unmarshal([]byte(r.replace(string(f.Body))), &want)
+		if err != nil {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("body %s want %s", js, r.replace(string(f.Body)))
+		}
+	}
+	return
+}
+
+func (r *conformanceRunner) expectClose() error {
+	t, body, err := r.read()
+	if err == nil {
+		return fmt.Errorf("frame %x %x instead of close", t, body)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	if e, ok := err.(net.Error); ok {
+		if e.Timeout() {
+			return fmt.Errorf("not closed")
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/skycoin/net/msg"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// golden op message and its tcp frame with seq 1
+type conformanceGolden struct {
+	Name    string
+	Op      byte
+	Body    json.RawMessage `json:",omitempty"`
+	Message string
+	Frame   string
+}
+
+var (
+	goldenA = cipher.NewPubKey(append([]byte{2}, bytes.Repeat([]byte{0x11}, 32)...))
+	goldenB = cipher.NewPubKey(append([]byte{3}, bytes.Repeat([]byte{0x22}, 32)...))
+)
+
+func goldenOP(op byte, object interface{}) func() []byte {
+	return func() []byte {
+		body, err := json.Marshal(object)
+		if err != nil {
+			panic(err)
+		}
+		return append([]byte{op}, body...)
+	}
+}
+
+var conformanceBuilders = map[string]func() []byte{
+	"reg":      func() []byte { return GenRegMsg() },
+	"reg resp": goldenOP(OP_REG|RESP_PREFIX, &regResp{PubKey: goldenA}),
+	"reg with key": goldenOP(OP_REG_KEY, &regWithKey{
+		PublicKey:    goldenA,
+		Version:      RegWithKeyAndEncryptionVersion,
+		Compressions: []string{"snappy"},
+		Suites:       []string{"aes-gcm"},
+		Checksums:    []string{"xxhash", "crc32"},
+	}),
+	"reg with key resp": goldenOP(OP_REG_KEY|RESP_PREFIX, &regWithKeyResp{
+		Num:       bytes.Repeat([]byte{1}, 16),
+		Hash:      cipher.SumSHA256([]byte("conformance")),
+		PublicKey: goldenB,
+		Version:   RegWithKeyAndEncryptionVersion,
+		Suite:     "aes-gcm",
+		Checksum:  "xxhash",
+		Session:   bytes.Repeat([]byte{2}, 8),
+	}),
+	"reg sig": goldenOP(OP_REG_SIG, &regCheckSig{
+		Version: RegWithKeyAndEncryptionVersion,
+		Session: bytes.Repeat([]byte{2}, 8),
+	}),
+	"reg sig resp": goldenOP(OP_REG_SIG|RESP_PREFIX, &regResp{PubKey: goldenA}),
+	"send":         func() []byte { return GenSendMsg(goldenA, goldenB, []byte("hello")) },
+	"send traced": func() []byte {
+		m := GenSendMsg(goldenA, goldenB, []byte("hello"))
+		m[MSG_OP_BEGIN] = OP_SEND_TRACED
+		hop := []byte{TRACE_HEADER_SIZE, byte(TRACE_APP), 0, 0, 0, 0, 0, 0, 0, 1}
+		return append(m[:SEND_MSG_META_END], append(hop, "hello"...)...)
+	},
+	"custom": func() []byte { return append([]byte{OP_CUSTOM}, "hello"...) },
+	"offer service": goldenOP(OP_OFFER_SERVICE, &struct {
+		*NodeServices
+		opNonce
+	}{&NodeServices{
+		Services:       []*Service{{Key: goldenA, Attributes: []string{"vpn"}, AllowNodes: []string{goldenB.Hex()}}},
+		ServiceAddress: ":8000",
+	}, opNonce{Session: bytes.Repeat([]byte{2}, 8), Nonce: 1}}),
+	"query service nodes": goldenOP(OP_QUERY_SERVICE_NODES, &query{Keys: []cipher.PubKey{goldenA}, Seq: 1}),
+	"query service nodes resp": goldenOP(OP_QUERY_SERVICE_NODES|RESP_PREFIX, &QueryResp{
+		Seq:    1,
+		Result: []*ServiceInfo{{PubKey: goldenA, Nodes: []*NodeInfo{{PubKey: goldenB, Address: "127.0.0.1:8000"}}}},
+	}),
+	"query by attrs": goldenOP(OP_QUERY_BY_ATTRS, &queryByAttrs{Attrs: []string{"vpn"}, Seq: 2}),
+	"query by attrs resp": goldenOP(OP_QUERY_BY_ATTRS|RESP_PREFIX, &QueryByAttrsResp{
+		Result: map[string][]cipher.PubKey{goldenB.Hex(): {goldenA}},
+		Seq:    2,
+	}),
+	"build app conn": goldenOP(OP_BUILD_APP_CONN, &appConn{Node: goldenB, App: goldenA}),
+	"build app conn resp": goldenOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{
+		App:  goldenA,
+		Port: 8000,
+		Msg:  PriorityMsg{Priority: Connected, Msg: "connected"},
+	}),
+	"forward node conn": goldenOP(OP_FORWARD_NODE_CONN, &forwardNodeConn{
+		Node:     goldenB,
+		App:      goldenA,
+		FromApp:  goldenA,
+		FromNode: goldenB,
+		Num:      bytes.Repeat([]byte{1}, 16),
+	}),
+	"build node conn resp": goldenOP(OP_BUILD_NODE_CONN|RESP_PREFIX, &buildConn{
+		Address:  "127.0.0.1:8000",
+		Node:     goldenB,
+		App:      goldenA,
+		FromApp:  goldenA,
+		FromNode: goldenB,
+		Num:      bytes.Repeat([]byte{1}, 16),
+	}),
+	"forward node conn resp": goldenOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
+		Node:     goldenB,
+		App:      goldenA,
+		FromApp:  goldenA,
+		FromNode: goldenB,
+		Msg:      PriorityMsg{Priority: Building, Msg: "building udp connection"},
+		Num:      bytes.Repeat([]byte{1}, 16),
+	}),
+	"build app conn ok": goldenOP(OP_BUILD_APP_CONN_OK, &buildConnResp{
+		Node:     goldenB,
+		App:      goldenA,
+		FromApp:  goldenA,
+		FromNode: goldenB,
+	}),
+	"build app conn ok resp": goldenOP(OP_BUILD_APP_CONN_OK|RESP_PREFIX, &nop{}),
+	"app conn ack resp":      goldenOP(OP_APP_CONN_ACK|RESP_PREFIX, &connAck{FromApp: goldenA, App: goldenB}),
+	"app feedback": goldenOP(OP_APP_FEEDBACK, &AppFeedback{
+		App:  goldenA,
+		Port: 8000,
+		Msg:  PriorityMsg{Priority: Connected, Msg: "connected"},
+	}),
+	"app message": goldenOP(OP_APP_MESSAGE, &appMessage{
+		App:     goldenA,
+		Msg:     PriorityMsg{Priority: Connected, Msg: "connected"},
+		opNonce: opNonce{Session: bytes.Repeat([]byte{2}, 8), Nonce: 2},
+	}),
+	"drain":     goldenOP(OP_DRAIN, &drain{}),
+	"ping":      goldenOP(OP_PING, &ping{Seq: 1}),
+	"ping resp": goldenOP(OP_PING|RESP_PREFIX, &pong{Seq: 1}),
+	"federation": goldenOP(OP_FEDERATION, &federation{
+		Nodes: []*federatedNode{{
+			Node: goldenA,
+			Time: 1,
+			Services: &NodeServices{
+				Services:       []*Service{{Key: goldenB, Attributes: []string{"vpn"}}},
+				ServiceAddress: "127.0.0.1:8000",
+			},
+		}},
+		TTL: 30,
+	}),
+	"rotate key": goldenOP(OP_ROTATE_KEY, &rotateKey{
+		NewKey:  goldenB,
+		opNonce: opNonce{Session: bytes.Repeat([]byte{2}, 8), Nonce: 3},
+	}),
+	"rotate key resp":            goldenOP(OP_ROTATE_KEY|RESP_PREFIX, &rotateKeyResp{NewKey: goldenB}),
+	"stream data":                func() []byte { return genStreamFrame(STREAM_DATA, 1, []byte("hello")) },
+	"call":                       goldenOP(OP_CALL, &call{Seq: 1, Method: "echo", Req: json.RawMessage(`"hello"`)}),
+	"call resp":                  goldenOP(OP_CALL|RESP_PREFIX, &callResp{Seq: 1, Resp: json.RawMessage(`"hello"`)}),
+	"transport closed resp":      goldenOP(OP_TRANSPORT_CLOSED|RESP_PREFIX, &transportClosed{Node: goldenB, App: goldenA}),
+	"transport reconnected resp": goldenOP(OP_TRANSPORT_RECONNECTED|RESP_PREFIX, &transportReconnected{Node: goldenB, App: goldenA}),
+}
+
+func TestConformanceFrames(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/conformance/frames.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var goldens []*conformanceGolden
+	err = json.Unmarshal(data, &goldens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	ops := make(map[byte]bool)
+	for _, g := range goldens {
+		build, ok := conformanceBuilders[g.Name]
+		if !ok {
+			t.Fatalf("no builder for %s", g.Name)
+		}
+		names[g.Name] = true
+		m := build()
+		if hex.EncodeToString(m) != g.Message {
+			t.Fatalf("%s message %x want %s", g.Name, m, g.Message)
+		}
+		if m[MSG_OP_BEGIN] != g.Op {
+			t.Fatalf("%s op %x want %x", g.Name, m[MSG_OP_BEGIN], g.Op)
+		}
+		ops[g.Op&^RESP_PREFIX] = true
+		if len(g.Body) > 0 {
+			var body bytes.Buffer
+			json.Compact(&body, g.Body)
+			if !bytes.Equal(body.Bytes(), m[MSG_HEADER_END:]) {
+				t.Fatalf("%s body %s want %s", g.Name, m[MSG_HEADER_END:], body.Bytes())
+			}
+		}
+		frame := msg.New(msg.TYPE_NORMAL, 1, m).Bytes()
+		if hex.EncodeToString(frame) != g.Frame {
+			t.Fatalf("%s frame %x want %s", g.Name, frame, g.Frame)
+		}
+	}
+	for name := range conformanceBuilders {
+		if !names[name] {
+			t.Fatalf("no golden frame for %s", name)
+		}
+	}
+	for op := byte(0); op < OP_SIZE; op++ {
+		if !ops[op] {
+			t.Fatalf("no golden frame for op %d", op)
+		}
+	}
+
+	trace, send, ok := parseTrace(conformanceBuilders["send traced"]())
+	if !ok || len(trace.Hops) != 1 || trace.Hops[0].Time.UnixNano() != 1 {
+		t.Fatalf("trace %v", trace)
+	}
+	if !bytes.Equal(send, conformanceBuilders["send"]()) {
+		t.Fatalf("traced send %x", send)
+	}
+}
+
+func TestConformanceTranscripts(t *testing.T) {
+	s := NewMessengerFactory()
+	if err := s.Listen("127.0.0.1:25945"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cases, err := LoadConformanceCases("testdata/conformance/transcripts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		if err = RunConformanceCase("127.0.0.1:25945", c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package factory
 
 import (
+	"context"
 	"crypto/aes"
-	"encoding/json"
 	"errors"
 	"github.com/skycoin/net/conn"
 	"github.com/skycoin/net/factory"
@@ -12,6 +12,8 @@ import (
 	"time"
 )
 
+var ErrRegTimeout = conn.NewError(conn.ErrTimeout, "reg timeout")
+
 type Connection struct {
 	*factory.Connection
 	factory *MessengerFactory
@@ -20,14 +22,35 @@ type Connection struct {
 	key        cipher.PubKey
 	keySetCond *sync.Cond
 	keySet     bool
-	secKey     cipher.SecKey
+	keys       conn.KeyProvider
 	targetKey  cipher.PubKey
 
+	// offered to the server at reg
+	compressions         []string
+	compressionThreshold int
+	cipherSuites         []string
+	checksums            []string
+	encodings            []string
+	// opEncoding of the ops written, see SetEncoding
+	encoding int32
+	// see ConnConfig.Region
+	region string
+
+	opSession opSession
+	// see ContextValidator
+	regRejection *RegRejection
+	// see KeyPins
+	serverAddress string
+	regErr        error
+
 	context sync.Map
 
 	services    *NodeServices
 	servicesMap map[cipher.PubKey]*Service
-	fieldsMutex sync.RWMutex
+	// see NodeServices.TTL
+	servicesExpiry  *conn.WheelTimer
+	servicesRefresh *conn.WheelTimer
+	fieldsMutex     sync.RWMutex
 
 	in chan []byte
 
@@ -38,7 +61,44 @@ type Connection struct {
 
 	connectTime int64
 
+	// see DialApp
+	appDials sync.Map
+	// app => struct{} of the transports being built again, see
+	// ConnConfig.TransportReconnect
+	transportRebuilds sync.Map
+	// seq => func(resp *QueryResp) of the queries made by the conn itself,
+	// see findAppTCPAddress
+	keyQueries sync.Map
+	// seq => func(resp *QueryByAttrsResp), see FindServiceNodesByAttributesContext
+	attrQueries sync.Map
+	// see Context
+	ctx     context.Context
+	ctxOnce sync.Once
+	// ops waiting for their resp, see OPPolicy
+	pendingOPs sync.Map
+
+	// new key => *keyRotation, see RotateKey
+	rotations sync.Map
+
+	// see OpenStream
+	streams streamMux
+
+	// seq => chan *callResult, see Call
+	callSeq uint32
+	calls   sync.Map
+
+	// see Ping
+	pingSeq uint64
+	pingRTT int64
+	pings   sync.Map
+
+	// see Drain
+	draining         bool
+	activeTransports int32
+
 	skipFactoryReg bool
+	// see ConnConfig.Anonymous
+	anonymous bool
 
 	appMessages        []PriorityMsg
 	appMessagesPty     Priority
@@ -56,6 +116,13 @@ type Connection struct {
 	// call after received response for BuildAppConnection
 	appConnectionInitCallback func(resp *AppConnResp) *AppFeedback
 
+	// see ConnConfig
+	onServiceNodesByKeys       KeysQueryCallback
+	onServiceNodesByAttributes AttrsQueryCallback
+	onAppConnection            AppConnCallback
+	onTransportState           TransportStateCallback
+	transportReconnect         *transportReconnect
+
 	onConnected    func(connection *Connection)
 	onDisconnected func(connection *Connection)
 	reconnect      func()
@@ -68,8 +135,9 @@ func newConnection(c *factory.Connection, factory *MessengerFactory) *Connection
 		factory:       factory,
 		appTransports: make(map[cipher.PubKey]*Transport),
 	}
-	c.RealObject = connection
+	c.SetRealObject(connection)
 	connection.keySetCond = sync.NewCond(connection.fieldsMutex.RLocker())
+	connection.SetContextLogger(conn.WithSubsystem(c.GetContextLogger(), conn.LOG_FACTORY))
 	return connection
 }
 
@@ -82,8 +150,9 @@ func newClientConnection(c *factory.Connection, factory *MessengerFactory) *Conn
 		proxyConnections: make(map[uint32]*Connection),
 		appTransports:    make(map[cipher.PubKey]*Transport),
 	}
-	c.RealObject = connection
+	c.SetRealObject(connection)
 	connection.keySetCond = sync.NewCond(connection.fieldsMutex.RLocker())
+	connection.SetContextLogger(conn.WithSubsystem(c.GetContextLogger(), conn.LOG_FACTORY))
 	go func() {
 		connection.preprocessor()
 	}()
@@ -97,8 +166,9 @@ func newUDPClientConnection(c *factory.Connection, factory *MessengerFactory) *C
 		factory:    factory,
 		in:         make(chan []byte),
 	}
-	c.RealObject = connection
+	c.SetRealObject(connection)
 	connection.keySetCond = sync.NewCond(connection.fieldsMutex.RLocker())
+	connection.SetContextLogger(conn.WithSubsystem(c.GetContextLogger(), conn.LOG_FACTORY))
 	go func() {
 		connection.preprocessor()
 	}()
@@ -111,8 +181,9 @@ func newUDPServerConnection(c *factory.Connection, factory *MessengerFactory) *C
 		Connection: c,
 		factory:    factory,
 	}
-	c.RealObject = connection
+	c.SetRealObject(connection)
 	connection.keySetCond = sync.NewCond(connection.fieldsMutex.RLocker())
+	connection.SetContextLogger(conn.WithSubsystem(c.GetContextLogger(), conn.LOG_FACTORY))
 	return connection
 }
 
@@ -138,11 +209,20 @@ func (c *Connection) SetKey(key cipher.PubKey) {
 	c.keySet = true
 	c.fieldsMutex.Unlock()
 	c.keySetCond.Broadcast()
+	c.markSetup(conn.SETUP_REGISTRATION)
 	if c.onConnected != nil {
 		c.onConnected(c)
 	}
 }
 
+// markSetup is MarkSetup of the underlying connection, test connections
+// have none
+func (c *Connection) markSetup(phase int) {
+	if c.Connection != nil {
+		c.MarkSetup(phase)
+	}
+}
+
 func (c *Connection) IsKeySet() (b bool) {
 	c.fieldsMutex.RLock()
 	b = c.keySet
@@ -153,25 +233,35 @@ func (c *Connection) IsKeySet() (b bool) {
 func (c *Connection) GetKey() cipher.PubKey {
 	c.fieldsMutex.RLock()
 	defer c.fieldsMutex.RUnlock()
-	if !c.keySet {
+	for !c.keySet && !c.closed {
 		c.keySetCond.Wait()
 	}
 	return c.key
 }
 
-func (c *Connection) SetSecKey(key cipher.SecKey) {
+// SetKeyProvider sets the secret key of the node, see conn.KeyProvider
+func (c *Connection) SetKeyProvider(keys conn.KeyProvider) {
 	c.fieldsMutex.Lock()
-	c.secKey = key
+	c.keys = keys
 	c.fieldsMutex.Unlock()
 }
 
-func (c *Connection) GetSecKey() (key cipher.SecKey) {
+func (c *Connection) GetKeyProvider() (keys conn.KeyProvider) {
 	c.fieldsMutex.RLock()
-	key = c.secKey
+	keys = c.keys
 	c.fieldsMutex.RUnlock()
 	return
 }
 
+func (c *Connection) signHash(hash cipher.SHA256) (sig cipher.Sig, err error) {
+	keys := c.GetKeyProvider()
+	if keys == nil {
+		err = errors.New("no key provider")
+		return
+	}
+	return keys.SignHash(hash)
+}
+
 func (c *Connection) SetTargetKey(key cipher.PubKey) {
 	c.fieldsMutex.Lock()
 	c.targetKey = key
@@ -222,22 +312,64 @@ func (c *Connection) Reg() error {
 
 func (c *Connection) RegWithKey(key cipher.PubKey, context map[string]string) error {
 	c.StoreContext(publicKey, key)
-	return c.writeOPReq(OP_REG_KEY, &regWithKey{PublicKey: key, Context: context, Version: RegWithKeyAndEncryptionVersion})
+	return c.writeOPReq(OP_REG_KEY, c.newRegWithKey(key, context))
 }
 
 func (c *Connection) RegWithKeys(key, target cipher.PubKey, context map[string]string) error {
 	c.StoreContext(publicKey, key)
 	c.SetTargetKey(target)
-	return c.writeOPReq(OP_REG_KEY, &regWithKey{PublicKey: key, Context: context, Version: RegWithKeyAndEncryptionVersion})
+	return c.writeOPReq(OP_REG_KEY, c.newRegWithKey(key, context))
+}
+
+func (c *Connection) newRegWithKey(key cipher.PubKey, context map[string]string) *regWithKey {
+	reg := &regWithKey{
+		PublicKey:    key,
+		Context:      context,
+		Version:      RegWithKeyAndEncryptionVersion,
+		Compressions: c.compressions,
+		Suites:       c.cipherSuites,
+		Anonymous:    c.IsAnonymous(),
+		Encodings:    c.encodings,
+	}
+	if c.IsUDP() {
+		// the server acks with TYPE_ACK_WINDOW from then on, the client once
+		// it got the first of them
+		reg.AckWindow = true
+	}
+	if c.IsUDP() && len(c.checksums) > 0 {
+		reg.Checksums = c.checksums
+		// the resp may already come with the checksum the server picked
+		c.AcceptChecksums(c.checksums)
+	}
+	return reg
 }
 
 // register services to discovery
 func (c *Connection) UpdateServices(ns *NodeServices) error {
+	if ns != nil {
+		for _, s := range ns.Services {
+			if s.Metadata.size() > MAX_SERVICE_METADATA_SIZE {
+				return ErrServiceMetadataSize
+			}
+		}
+	}
+	ns = c.withRegion(ns)
+	if ns != nil && ns.TTL == 0 && c.factory.ServiceTTL > 0 {
+		withTTL := *ns
+		withTTL.TTL = ttlSeconds(c.factory.ServiceTTL)
+		ns = &withTTL
+	}
 	c.setServices(ns)
 	if ns == nil {
 		ns = &NodeServices{}
+	} else {
+		c.markSetup(conn.SETUP_FIRST_SERVICES)
 	}
-	err := c.writeOP(OP_OFFER_SERVICE, ns)
+	c.refreshServices(ns.TTL)
+	err := c.writeOP(OP_OFFER_SERVICE, &struct {
+		*NodeServices
+		opNonce
+	}{ns, c.nextOPNonce()})
 	if err != nil {
 		return err
 	}
@@ -275,12 +407,30 @@ func (c *Connection) OfferStaticServiceWithAddress(address string, attrs ...stri
 
 // find services by attributes
 func (c *Connection) FindServiceNodesByAttributes(attrs ...string) error {
-	return c.writeOP(OP_QUERY_BY_ATTRS, newQueryByAttrs(attrs))
+	q := c.newQueryByAttrs(attrs)
+	return c.writeTrackedOP(pendingOPKey{op: OP_QUERY_BY_ATTRS, seq: q.Seq}, q)
+}
+
+// FindServiceNodesByAttributePatterns finds services by patterns of the
+// match mode, e.g. ATTR_MATCH_WILDCARD and "vpn-*". Servers before the modes
+// match the patterns exactly
+func (c *Connection) FindServiceNodesByAttributePatterns(match string, patterns ...string) error {
+	q := c.newQueryByAttrs(patterns)
+	q.Match = match
+	return c.writeTrackedOP(pendingOPKey{op: OP_QUERY_BY_ATTRS, seq: q.Seq}, q)
+}
+
+// FindServiceNodesByAttributesPage finds a page of at most limit nodes after
+// cursor, the resp has the cursor of the next page. The first page has no cursor
+func (c *Connection) FindServiceNodesByAttributesPage(match, cursor string, limit int, patterns ...string) error {
+	q := c.newQueryByAttrs(patterns)
+	q.Match, q.Cursor, q.Limit = match, cursor, limit
+	return c.writeTrackedOP(pendingOPKey{op: OP_QUERY_BY_ATTRS, seq: q.Seq}, q)
 }
 
 // find services by attributes
 func (c *Connection) FindServiceNodesWithSeqByAttributes(attrs ...string) (seq uint32, err error) {
-	q := newQueryByAttrs(attrs)
+	q := c.newQueryByAttrs(attrs)
 	seq = q.Seq
 	err = c.writeOP(OP_QUERY_BY_ATTRS, q)
 	return
@@ -288,11 +438,15 @@ func (c *Connection) FindServiceNodesWithSeqByAttributes(attrs ...string) (seq u
 
 // find services nodes by service public keys
 func (c *Connection) FindServiceNodesByKeys(keys []cipher.PubKey) error {
-	return c.writeOP(OP_QUERY_SERVICE_NODES, newQuery(keys))
+	q := newQuery(keys)
+	return c.writeTrackedOP(pendingOPKey{op: OP_QUERY_SERVICE_NODES, seq: q.Seq}, q)
 }
 
 func (c *Connection) BuildAppConnection(node, app cipher.PubKey) error {
-	return c.writeOP(OP_BUILD_APP_CONN, &appConn{Node: node, App: app})
+	if c.IsDraining() {
+		return ErrDraining
+	}
+	return c.writeTrackedOP(pendingOPKey{op: OP_BUILD_APP_CONN, app: app}, &appConn{Node: node, App: app, Reconnect: c.transportReconnect != nil || c.onTransportState != nil})
 }
 
 func (c *Connection) Send(to cipher.PubKey, msg []byte) error {
@@ -312,6 +466,8 @@ func (c *Connection) preprocessor() (err error) {
 			c.GetContextLogger().Debugf("preprocessor err %v", err)
 		}
 		c.Close()
+		// only the preprocessor sends to c.in, so it is the one to close it
+		close(c.in)
 	}()
 OUTER:
 	for {
@@ -331,7 +487,7 @@ OUTER:
 				if r != nil {
 					body := m[MSG_HEADER_END:]
 					if len(body) > 0 {
-						err = json.Unmarshal(body, r)
+						err = unmarshalOP(body, r)
 						if err != nil {
 							return
 						}
@@ -350,7 +506,26 @@ OUTER:
 				}
 			}
 
-			c.in <- m
+			if opn == OP_PING {
+				err = c.answerPing(m[MSG_HEADER_END:])
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if opn == OP_STREAM {
+				err = c.receiveStreamFrame(m[MSG_HEADER_END:])
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if opn == OP_SEND_TRACED {
+				m = c.receiveTraced(m)
+			}
+			if !c.deliver(m) {
+				return
+			}
 		}
 	}
 	for {
@@ -359,11 +534,23 @@ OUTER:
 			if !ok {
 				return
 			}
-			c.in <- m
+			if !c.deliver(m) {
+				return
+			}
 		}
 	}
 }
 
+// deliver blocks until m is read from c.in, false if the connection closed first
+func (c *Connection) deliver(m []byte) bool {
+	select {
+	case c.in <- m:
+		return true
+	case <-c.Disconnected():
+		return false
+	}
+}
+
 func (c *Connection) GetChanIn() <-chan []byte {
 	if c.in == nil {
 		return c.Connection.GetChanIn()
@@ -371,30 +558,36 @@ func (c *Connection) GetChanIn() <-chan []byte {
 	return c.in
 }
 
+// Read returns the next message of GetChanIn, bounded by the read deadline
+func (c *Connection) Read() ([]byte, error) {
+	return c.ReadChan(c.GetChanIn())
+}
+
 func (c *Connection) Close() {
-	if c.reconnect != nil {
+	// a rejected reg is rejected again
+	if c.reconnect != nil && !c.IsDraining() && c.GetRegRejection() == nil && c.getRegErr() == nil {
 		go c.reconnect()
 	}
 	if c.onDisconnected != nil {
 		c.onDisconnected(c)
 	}
-	c.keySetCond.Broadcast()
 	c.fieldsMutex.Lock()
 	defer c.fieldsMutex.Unlock()
 	if c.closed {
 		return
 	}
 	c.closed = true
+	c.keySetCond.Broadcast()
+	c.closeStreams()
+	if c.clientSide() && c.factory != nil {
+		go c.factory.failoverTransports(c)
+	}
 	if c.keySet {
 		if !c.skipFactoryReg {
 			c.factory.unregister(c.key, c)
 		}
 		c.keySet = false
 	}
-	if c.in != nil {
-		close(c.in)
-	}
-
 	c.appTransportsMutex.RLock()
 	defer c.appTransportsMutex.RUnlock()
 
@@ -407,30 +600,89 @@ func (c *Connection) Close() {
 	c.Connection.Close()
 }
 
+// CloseGracefully closes the connection once the peer acked the messages written
+// before, see conn.CloseGracefully
+func (c *Connection) CloseGracefully(timeout time.Duration) error {
+	c.StopWrites()
+	err := c.WaitForAcks(timeout)
+	c.Close()
+	return err
+}
+
+// WaitForKey waits until the read deadline if one is set, 15 seconds otherwise
 func (c *Connection) WaitForKey() (err error) {
+	return c.WaitForKeyContext(context.Background())
+}
+
+// WaitForKeyContext is WaitForKey that closes the connection once ctx is done
+func (c *Connection) WaitForKeyContext(ctx context.Context) (err error) {
 	ok := make(chan struct{})
 	go func() {
 		c.GetKey()
 		close(ok)
 	}()
-	select {
-	case <-time.After(15 * time.Second):
-		c.Close()
-		err = errors.New("reg timeout")
-	case <-ok:
+	wait := DEFAULT_REG_TIMEOUT
+	if p := c.getOPPolicy(OP_REG_KEY); p.Timeout > 0 {
+		wait = p.Timeout
+	}
+	if d := c.GetReadDeadline(); !d.IsZero() {
+		wait = time.Until(d)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	disconnected := c.Disconnected()
+	for {
+		select {
+		case <-timer.C:
+			c.Close()
+			return ErrRegTimeout
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		case <-disconnected:
+			if r := c.GetRegRejection(); r != nil {
+				return r
+			}
+			if err := c.getRegErr(); err != nil {
+				return err
+			}
+			disconnected = nil
+		case <-ok:
+			return nil
+		}
 	}
-	return err
 }
 
 func (c *Connection) writeOPBytes(op byte, body []byte) error {
 	data := make([]byte, MSG_HEADER_END+len(body))
 	data[MSG_OP_BEGIN] = op
 	copy(data[MSG_HEADER_END:], body)
-	return c.Write(data)
+	return c.WriteContext(priorityContexts[opPriority(op)], data)
+}
+
+// contexts of the writes of each priority
+var priorityContexts [conn.PRIORITY_SIZE]context.Context
+
+func init() {
+	for p := range priorityContexts {
+		priorityContexts[p] = conn.WithPriority(context.Background(), conn.Priority(p))
+	}
+}
+
+// opPriority is the priority an op is written with, the messages of apps
+// come after the ops of discovery and the keepalives
+func opPriority(op byte) conn.Priority {
+	switch op &^ RESP_PREFIX {
+	case OP_SEND, OP_SEND_TRACED, OP_CUSTOM, OP_APP_MESSAGE:
+		return conn.PRIORITY_INTERACTIVE
+	case OP_STREAM:
+		return conn.PRIORITY_BULK
+	}
+	return conn.PRIORITY_CONTROL
 }
 
 func (c *Connection) writeOP(op byte, object interface{}) error {
-	js, err := json.Marshal(object)
+	js, err := c.marshalOP(object)
 	if err != nil {
 		return err
 	}
@@ -439,7 +691,7 @@ func (c *Connection) writeOP(op byte, object interface{}) error {
 }
 
 func (c *Connection) writeOPReq(op byte, object interface{}) error {
-	body, err := json.Marshal(object)
+	body, err := c.marshalOP(object)
 	if err != nil {
 		return err
 	}
@@ -451,7 +703,7 @@ func (c *Connection) writeOPReq(op byte, object interface{}) error {
 }
 
 func (c *Connection) writeOPResp(op byte, object interface{}) error {
-	body, err := json.Marshal(object)
+	body, err := c.marshalOP(object)
 	if err != nil {
 		return err
 	}
@@ -526,6 +778,9 @@ func (c *Connection) PutMessage(v PriorityMsg) bool {
 	c.appMessages = append(c.appMessages, v)
 	c.appMessagesPty = v.Priority
 	c.appMessagesMutex.Unlock()
+	if c.factory != nil && c.IsKeySet() {
+		c.factory.reportAppMessage(c.GetKey(), v)
+	}
 	return true
 }
 
@@ -559,12 +814,26 @@ func (c *Connection) GetAppFeedback() *AppFeedback {
 }
 
 func (c *Connection) SetCrypto(pk cipher.PubKey, sk cipher.SecKey, target cipher.PubKey, iv []byte) (err error) {
+	return c.SetCryptoWithSuite(pk, sk, target, iv, conn.CIPHER_SUITE_AES_CFB)
+}
+
+func (c *Connection) SetCryptoWithSuite(pk cipher.PubKey, sk cipher.SecKey, target cipher.PubKey, iv []byte, suite string) (err error) {
+	return c.SetCryptoWithKeyProvider(conn.NewSecKeyProvider(pk, sk), target, iv, suite)
+}
+
+func (c *Connection) SetCryptoWithKeyProvider(keys conn.KeyProvider, target cipher.PubKey, iv []byte, suite string) (err error) {
 	c.fieldsMutex.Lock()
 	defer c.fieldsMutex.Unlock()
 	if c.Connection.GetCrypto() != nil {
 		return
 	}
-	crypto := conn.NewCrypto(pk, sk)
+	if keys == nil {
+		return errors.New("no key provider")
+	}
+	crypto, err := conn.NewCryptoWithKeyProvider(keys, suite)
+	if err != nil {
+		return
+	}
 	err = crypto.SetTargetKey(target)
 	if err != nil {
 		return
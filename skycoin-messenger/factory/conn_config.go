@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/skycoin/net/conn"
 	"github.com/skycoin/skycoin/src/cipher"
 	"github.com/skycoin/skycoin/src/cipher/go-bip39"
 )
@@ -30,6 +31,40 @@ type ConnConfig struct {
 
 	TargetKey cipher.PubKey
 
+	// compressions offered to the server, best first, e.g. conn.SupportedCompressions()
+	Compressions []string
+	// bodies shorter than this are not compressed, conn.DEFAULT_COMPRESSION_THRESHOLD if 0
+	CompressionThreshold int
+
+	// cipher suites offered to the server, best first, e.g. conn.SupportedCipherSuites()
+	CipherSuites []string
+
+	// checksums of udp packets offered to the server, cheapest first, e.g. conn.SupportedChecksums()
+	Checksums []string
+
+	// binary encodings of ops offered to the server, best first, e.g.
+	// SupportedEncodings(). The ops are json if empty or none is accepted
+	Encodings []string
+
+	// the client only queries the discovery with a key of its own made for
+	// the conn and never stored. The server does not register it, allows it
+	// the queries only and limits it by AnonymousRateLimit. Its ops wait by
+	// AnonymousOPPolicies. SeedConfig and SeedConfigPath are ignored
+	Anonymous bool
+
+	// of the node, given to the services offered without one and the queries
+	// by attributes ask for the nearest nodes first, see QUERY_ORDER_NEAREST
+	Region string
+
+	// the transports built by BuildAppConnection are built again with
+	// backoff once their path fails, OnTransportState is told each step
+	TransportReconnect bool
+	// first wait between two builds, doubled up to MAX_RETRY_WAIT,
+	// DEFAULT_RETRY_WAIT if 0
+	TransportReconnectWait time.Duration
+	// builds before giving up, unlimited if 0
+	TransportReconnectAttempts int
+
 	// callbacks
 
 	FindServiceNodesByKeysCallback func(resp *QueryResp)
@@ -38,6 +73,16 @@ type ConnConfig struct {
 
 	AppConnectionInitCallback func(resp *AppConnResp) *AppFeedback
 
+	// like the callbacks above with the error of the resp, e.g.
+	// ErrNoServiceNodes, ErrOPTimeout or ErrAppNotAllowed. Their ctx is the
+	// Context of the conn. They replace the ones above if set
+	OnServiceNodesByKeys       KeysQueryCallback
+	OnServiceNodesByAttributes AttrsQueryCallback
+	OnAppConnection            AppConnCallback
+	// told the states of the transports built by BuildAppConnection, they
+	// are not built again without TransportReconnect
+	OnTransportState TransportStateCallback
+
 	// call after connected to server
 	OnConnected func(connection *Connection)
 	// call after disconnected
@@ -48,8 +93,11 @@ type SeedConfig struct {
 	Seed      string
 	SecKey    string
 	PublicKey string
+	// uri of the secret key in a key store, see RegisterKeyStore.
+	// Seed and SecKey are empty then, the key is never written to the file
+	KeyStore  string `json:",omitempty"`
 	publicKey cipher.PubKey
-	secKey    cipher.SecKey
+	keys      conn.KeyProvider
 }
 
 func (sc *SeedConfig) parse() (err error) {
@@ -58,6 +106,9 @@ func (sc *SeedConfig) parse() (err error) {
 			err = fmt.Errorf("invalid seed config %#v", sc)
 		}
 	}()
+	if len(sc.KeyStore) > 0 {
+		return sc.openKeyStore()
+	}
 	var key cipher.PubKey
 	key, err = cipher.PubKeyFromHex(sc.PublicKey)
 	if err != nil {
@@ -69,10 +120,31 @@ func (sc *SeedConfig) parse() (err error) {
 	if err != nil {
 		return
 	}
-	sc.secKey = secKey
+	sc.keys = conn.NewSecKeyProvider(key, secKey)
 	return
 }
 
+// openKeyStore opens the key once, PublicKey must match it if set
+func (sc *SeedConfig) openKeyStore() (err error) {
+	if sc.keys == nil {
+		sc.keys, err = OpenKeyStore(sc.KeyStore)
+		if err != nil {
+			return
+		}
+	}
+	sc.publicKey = sc.keys.PubKey()
+	if len(sc.PublicKey) > 0 && sc.PublicKey != sc.publicKey.Hex() {
+		return fmt.Errorf("key store %s has key %s, not %s", sc.KeyStore, sc.publicKey.Hex(), sc.PublicKey)
+	}
+	sc.PublicKey = sc.publicKey.Hex()
+	return
+}
+
+// Keys returns the key pair of the config for signing
+func (sc *SeedConfig) Keys() conn.KeyProvider {
+	return sc.keys
+}
+
 func NewSeedConfig() *SeedConfig {
 	entropy, err := bip39.NewEntropy(128)
 	if err != nil {
@@ -88,11 +160,22 @@ func NewSeedConfig() *SeedConfig {
 		SecKey:    sk.Hex(),
 		Seed:      seed,
 		publicKey: pk,
-		secKey:    sk,
+		keys:      conn.NewSecKeyProvider(pk, sk),
 	}
 	return sc
 }
 
+// NewSeedConfigWithKeyStore returns a SeedConfig of the key at uri in a key store,
+// write it with WriteSeedConfig to keep only the public key and uri on disk
+func NewSeedConfigWithKeyStore(uri string) (sc *SeedConfig, err error) {
+	sc = &SeedConfig{KeyStore: uri}
+	err = sc.openKeyStore()
+	if err != nil {
+		sc = nil
+	}
+	return
+}
+
 func ReadSeedConfig(path string) (sc *SeedConfig, err error) {
 	fb, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -117,11 +200,11 @@ func ReadOrCreateSeedConfig(path string) (sc *SeedConfig, err error) {
 			sc = NewSeedConfig()
 			err = WriteSeedConfig(sc, path)
 			if err != nil {
-				err = fmt.Errorf("failed to write seed config  %v", err)
+				err = fmt.Errorf("failed to write seed config  %w", err)
 				return
 			}
 		} else {
-			err = fmt.Errorf("failed to read seed config %v", err)
+			err = fmt.Errorf("failed to read seed config %w", err)
 			return
 		}
 	}
@@ -53,6 +53,28 @@ const (
 	OP_REG_KEY
 	OP_REG_SIG
 
+	// app messages a node reports to the server
+	OP_APP_MESSAGE
+	// the peer stops routing new transports to the sender
+	OP_DRAIN
+	// im messages carrying a trace, see SendTraced
+	OP_SEND_TRACED
+	// probe answered with its resp, see Ping
+	OP_PING
+	// registration table of a discovery server gossiped to the others, see Federate
+	OP_FEDERATION
+	// the node replaces its key on the conn, see RotateKey
+	OP_ROTATE_KEY
+	// frames of the streams of a conn, see Stream
+	OP_STREAM
+	// request to a handler of the server, see Call
+	OP_CALL
+	// the node tells the app a transport it built lost its path, see
+	// ConnConfig.TransportReconnect
+	OP_TRANSPORT_CLOSED
+	// the node carried a transport of the app over to another server
+	OP_TRANSPORT_RECONNECTED
+
 	OP_SIZE
 )
 
@@ -0,0 +1,105 @@
+package factory
+
+import (
+	"fmt"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// ContextValidator checks the context a client sends at reg, e.g. its
+// version, platform or invite code. A rejection is sent to the client and
+// closes the connection, annotations are stored on the connection like the
+// context, see Connection.LoadContext
+type ContextValidator func(key cipher.PubKey, context map[string]string) (annotations map[string]string, rejection *RegRejection)
+
+// ContextCommitter is run with the context and the annotations of a reg the
+// ContextValidator accepted once the client proved its key, e.g. to consume a
+// single use token. A rejection closes the connection
+type ContextCommitter func(key cipher.PubKey, context map[string]string) (rejection *RegRejection)
+
+// RegRejection is why the server rejected a reg
+type RegRejection struct {
+	// context field rejected, empty if not one of them
+	Field string `json:",omitempty"`
+	// for clients to tell the reasons apart, e.g. "outdated"
+	Code    string
+	Message string `json:",omitempty"`
+}
+
+func (r *RegRejection) Error() string {
+	if len(r.Field) > 0 {
+		return fmt.Sprintf("reg rejected, %s %s: %s", r.Field, r.Code, r.Message)
+	}
+	return fmt.Sprintf("reg rejected, %s: %s", r.Code, r.Message)
+}
+
+// Unwrap makes the rejection match cn.ErrUnauthorized
+func (r *RegRejection) Unwrap() error {
+	return cn.ErrUnauthorized
+}
+
+// how long the rejection may take to reach the client before it is closed
+const REG_REJECTION_TIMEOUT = time.Second
+
+// validateContext returns the rejection of f.ContextValidator once it was
+// sent to the client
+func (f *MessengerFactory) validateContext(conn *Connection, reg *regWithKey) error {
+	if f.ContextValidator == nil {
+		return nil
+	}
+	annotations, rejection := f.ContextValidator(reg.PublicKey, reg.Context)
+	if rejection == nil {
+		for k, v := range annotations {
+			conn.StoreContext(k, v)
+		}
+		if f.ContextCommitter != nil {
+			pending := make(map[string]string, len(reg.Context)+len(annotations))
+			for k, v := range reg.Context {
+				pending[k] = v
+			}
+			for k, v := range annotations {
+				pending[k] = v
+			}
+			conn.StoreContext(regContext, pending)
+		}
+		return nil
+	}
+	conn.GetContextLogger().Infof("reg %s %v", reg.PublicKey.Hex(), rejection)
+	err := conn.writeOP(OP_REG_KEY|RESP_PREFIX, &regWithKeyResp{Version: reg.Version, Rejection: rejection})
+	if err != nil {
+		return err
+	}
+	conn.WaitForAcks(REG_REJECTION_TIMEOUT)
+	return rejection
+}
+
+// commitContext runs f.ContextCommitter on the context accepted at the reg
+// of key, once its signature was verified
+func (f *MessengerFactory) commitContext(conn *Connection, key cipher.PubKey) error {
+	v, ok := conn.context.Load(regContext)
+	if !ok {
+		return nil
+	}
+	conn.context.Delete(regContext)
+	context, _ := v.(map[string]string)
+	if rejection := f.ContextCommitter(key, context); rejection != nil {
+		conn.GetContextLogger().Infof("reg %s %v", key.Hex(), rejection)
+		return rejection
+	}
+	return nil
+}
+
+func (c *Connection) setRegRejection(r *RegRejection) {
+	c.fieldsMutex.Lock()
+	c.regRejection = r
+	c.fieldsMutex.Unlock()
+}
+
+// GetRegRejection returns why the server rejected the reg, nil if it did not
+func (c *Connection) GetRegRejection() *RegRejection {
+	c.fieldsMutex.RLock()
+	defer c.fieldsMutex.RUnlock()
+	return c.regRejection
+}
@@ -0,0 +1,97 @@
+package factory
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestContextValidator(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	var seenMutex sync.Mutex
+	seen := make(map[cipher.PubKey]map[string]string)
+	s.ContextValidator = func(key cipher.PubKey, context map[string]string) (map[string]string, *RegRejection) {
+		seenMutex.Lock()
+		seen[key] = context
+		seenMutex.Unlock()
+		if context["version"] != "2" {
+			return nil, &RegRejection{Field: "version", Code: "outdated", Message: "update to 2"}
+		}
+		return map[string]string{"tier": "beta"}, nil
+	}
+	if err := s.Listen("127.0.0.1:25951"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := NewMessengerFactory()
+	defer c.Close()
+	start := time.Now()
+	err := c.ConnectWithConfig("127.0.0.1:25951", &ConnConfig{
+		SeedConfig: NewSeedConfig(),
+		Context:    map[string]string{"version": "1"},
+		Reconnect:  true,
+	})
+	r, ok := err.(*RegRejection)
+	if !ok || r.Field != "version" || r.Code != "outdated" || r.Message != "update to 2" || !errors.Is(err, cn.ErrUnauthorized) {
+		t.Fatalf("err %v", err)
+	}
+	if d := time.Since(start); d > REG_REJECTION_TIMEOUT {
+		t.Fatalf("rejected after %v", d)
+	}
+
+	sc := NewSeedConfig()
+	err = c.ConnectWithConfig("127.0.0.1:25951", &ConnConfig{
+		SeedConfig: sc,
+		Context:    map[string]string{"version": "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sc.publicKey
+	var conn *Connection
+	for i := 0; i < 100 && conn == nil; i++ {
+		conn, _ = s.GetConnection(key)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatal("not registered")
+	}
+	if v, _ := conn.LoadContext("tier"); v != "beta" {
+		t.Fatalf("tier %v", v)
+	}
+
+	// regs are pooled, the claims of one node must not reach the next
+	connect := func(context map[string]string) cipher.PubKey {
+		sc := NewSeedConfig()
+		if err := c.ConnectWithConfig("127.0.0.1:25951", &ConnConfig{SeedConfig: sc, Context: context}); err != nil {
+			t.Fatal(err)
+		}
+		return sc.publicKey
+	}
+	connect(map[string]string{"version": "2", "operator": "acme"})
+	key = connect(map[string]string{"version": "2"})
+	seenMutex.Lock()
+	context := seen[key]
+	seenMutex.Unlock()
+	if len(context) != 1 {
+		t.Fatalf("validator saw %v", context)
+	}
+	for i := 0; i < 100; i++ {
+		if conn, _ = s.GetConnection(key); conn != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatal("not registered")
+	}
+	if v, ok := conn.LoadContext("operator"); ok {
+		t.Fatalf("operator of another node %v", v)
+	}
+}
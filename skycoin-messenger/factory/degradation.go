@@ -0,0 +1,223 @@
+package factory
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cn "github.com/skycoin/net/conn"
+)
+
+// DegradationLevel is how much load the factory sheds, every level sheds the
+// load of the ones before it too
+type DegradationLevel int32
+
+const (
+	DEGRADATION_NONE DegradationLevel = iota
+	// new connections and transports are closed once accepted
+	DEGRADATION_REJECT
+	// the transports up to Degradation.DropWeight are closed
+	DEGRADATION_DROP_TRANSPORTS
+	// the app messages read are dropped and the memory is given back to the system
+	DEGRADATION_SHRINK_CACHES
+)
+
+func (l DegradationLevel) String() string {
+	switch l {
+	case DEGRADATION_NONE:
+		return "none"
+	case DEGRADATION_REJECT:
+		return "reject"
+	case DEGRADATION_DROP_TRANSPORTS:
+		return "drop transports"
+	case DEGRADATION_SHRINK_CACHES:
+		return "shrink caches"
+	}
+	return strconv.Itoa(int(l))
+}
+
+const (
+	DEFAULT_DEGRADATION_INTERVAL   = time.Second
+	DEFAULT_DEGRADATION_HYSTERESIS = 0.9
+)
+
+var ErrMemoryPressure = errors.New("rejected under memory pressure")
+
+// Degradation sheds load in order once the memory crosses its watermarks, so
+// the process slows down instead of running out of memory. See
+// MessengerFactory.Degrade
+type Degradation struct {
+	// process RSS in bytes where each level starts, from DEGRADATION_REJECT
+	// on. A watermark of 0 skips its level
+	RSS []uint64
+	// the same for the bytes held by the connections, see cn.TotalMemoryUsage
+	Buffers []int64
+	// a level is left once the memory is below this part of its watermark,
+	// DEFAULT_DEGRADATION_HYSTERESIS if 0
+	Hysteresis float64
+	// transports up to this weight are closed at DEGRADATION_DROP_TRANSPORTS,
+	// 1 if 0, the weight of a transport by default
+	DropWeight int
+	// how often the memory is checked, DEFAULT_DEGRADATION_INTERVAL if 0
+	Interval time.Duration
+	// called whenever the level changes
+	OnLevel func(e DegradationEvent)
+
+	// for tests
+	readRSS func() uint64
+}
+
+// DegradationEvent is a change of the degradation level
+type DegradationEvent struct {
+	From, To DegradationLevel
+	RSS      uint64
+	Buffers  int64
+}
+
+// level returns the level of the memory at the current level, which is kept
+// until the memory is Hysteresis below its watermark
+func (d *Degradation) level(current DegradationLevel, rss uint64, buffers int64) DegradationLevel {
+	h := d.Hysteresis
+	if h <= 0 {
+		h = DEFAULT_DEGRADATION_HYSTERESIS
+	}
+	crossed := func(l DegradationLevel, part float64) bool {
+		i := int(l) - 1
+		if i < len(d.RSS) && d.RSS[i] > 0 && float64(rss) >= float64(d.RSS[i])*part {
+			return true
+		}
+		return i < len(d.Buffers) && d.Buffers[i] > 0 && float64(buffers) >= float64(d.Buffers[i])*part
+	}
+	l := DEGRADATION_NONE
+	for i := DEGRADATION_REJECT; i <= DEGRADATION_SHRINK_CACHES; i++ {
+		if crossed(i, 1) {
+			l = i
+		}
+	}
+	for i := current; i > l; i-- {
+		if crossed(i, h) {
+			return i
+		}
+	}
+	return l
+}
+
+// processRSS returns the resident memory of the process, the memory go got
+// from the system if it is unknown
+func processRSS() uint64 {
+	if b, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys
+}
+
+// Degrade checks the memory by d until the factory is closed
+func (f *MessengerFactory) Degrade(d *Degradation) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = DEFAULT_DEGRADATION_INTERVAL
+	}
+	readRSS := d.readRSS
+	if readRSS == nil {
+		readRSS = processRSS
+	}
+	f.fieldsMutex.Lock()
+	if f.degradationStop == nil {
+		f.degradationStop = make(chan struct{})
+	}
+	stop := f.degradationStop
+	f.fieldsMutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			f.checkMemory(d, readRSS(), cn.TotalMemoryUsage())
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// DegradationLevel returns the load the factory sheds now
+func (f *MessengerFactory) DegradationLevel() DegradationLevel {
+	return DegradationLevel(atomic.LoadInt32(&f.degradationLevel))
+}
+
+func (f *MessengerFactory) checkMemory(d *Degradation, rss uint64, buffers int64) {
+	from := f.DegradationLevel()
+	to := d.level(from, rss, buffers)
+	if to != from {
+		atomic.StoreInt32(&f.degradationLevel, int32(to))
+		log.Warnf("degradation %s => %s, rss %d buffers %d", from, to, rss, buffers)
+		if d.OnLevel != nil {
+			d.OnLevel(DegradationEvent{From: from, To: to, RSS: rss, Buffers: buffers})
+		}
+	}
+	// shed again while the level holds, the load comes back
+	if to >= DEGRADATION_DROP_TRANSPORTS {
+		f.dropTransports(d.DropWeight)
+	}
+	if to >= DEGRADATION_SHRINK_CACHES && from < DEGRADATION_SHRINK_CACHES {
+		f.shrinkCaches()
+	}
+}
+
+// rejectUnderPressure reports whether a new connection must be closed
+func (f *MessengerFactory) rejectUnderPressure() bool {
+	return f.DegradationLevel() >= DEGRADATION_REJECT
+}
+
+func (f *MessengerFactory) dropTransports(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	f.ForEachTransport(func(t *Transport) {
+		if t.getWeight() <= weight {
+			log.Debugf("degradation close transport %s => %s", t.FromApp.Hex(), t.ToApp.Hex())
+			t.Close()
+		}
+	})
+}
+
+func (f *MessengerFactory) shrinkCaches() {
+	f.ForEachConn(func(conn *Connection) {
+		conn.dropReadMessages()
+	})
+	debug.FreeOSMemory()
+}
+
+func (t *Transport) getWeight() int {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	if t.weight < 1 {
+		return 1
+	}
+	return t.weight
+}
+
+// dropReadMessages frees the app messages returned by GetMessages already
+func (c *Connection) dropReadMessages() {
+	c.appMessagesMutex.Lock()
+	if c.appMessagesReadCnt > 0 {
+		c.appMessages = append([]PriorityMsg(nil), c.appMessages[c.appMessagesReadCnt:]...)
+		c.appMessagesReadCnt = 0
+	}
+	c.appMessagesMutex.Unlock()
+}
@@ -0,0 +1,79 @@
+package factory
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDegradation(t *testing.T) {
+	d := &Degradation{RSS: []uint64{100, 0, 300}, Buffers: []int64{0, 20}}
+	for _, c := range []struct {
+		current DegradationLevel
+		rss     uint64
+		buffers int64
+		want    DegradationLevel
+	}{
+		{DEGRADATION_NONE, 99, 0, DEGRADATION_NONE},
+		{DEGRADATION_NONE, 100, 0, DEGRADATION_REJECT},
+		{DEGRADATION_NONE, 100, 20, DEGRADATION_DROP_TRANSPORTS},
+		{DEGRADATION_NONE, 300, 0, DEGRADATION_SHRINK_CACHES},
+		// kept until 10% below the watermark
+		{DEGRADATION_SHRINK_CACHES, 280, 0, DEGRADATION_SHRINK_CACHES},
+		{DEGRADATION_SHRINK_CACHES, 260, 0, DEGRADATION_REJECT},
+		{DEGRADATION_DROP_TRANSPORTS, 0, 18, DEGRADATION_DROP_TRANSPORTS},
+		{DEGRADATION_DROP_TRANSPORTS, 0, 17, DEGRADATION_NONE},
+	} {
+		if l := d.level(c.current, c.rss, c.buffers); l != c.want {
+			t.Fatalf("level %s rss %d buffers %d => %s, want %s", c.current, c.rss, c.buffers, l, c.want)
+		}
+	}
+
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25953"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var rss uint64 = 200
+	events := make(chan DegradationEvent, 2)
+	s.Degrade(&Degradation{
+		RSS:      []uint64{100},
+		Interval: 10 * time.Millisecond,
+		OnLevel: func(e DegradationEvent) {
+			events <- e
+		},
+		readRSS: func() uint64 {
+			return atomic.LoadUint64(&rss)
+		},
+	})
+	if e := <-events; e.From != DEGRADATION_NONE || e.To != DEGRADATION_REJECT || e.RSS != 200 {
+		t.Fatalf("event %+v", e)
+	}
+
+	c := NewMessengerFactory()
+	defer c.Close()
+	sc := NewSeedConfig()
+	c.ConnectWithConfig("127.0.0.1:25953", &ConnConfig{SeedConfig: sc})
+	if _, ok := s.GetConnection(sc.publicKey); ok {
+		t.Fatal("registered under memory pressure")
+	}
+
+	atomic.StoreUint64(&rss, 50)
+	if e := <-events; e.To != DEGRADATION_NONE {
+		t.Fatalf("event %+v", e)
+	}
+	if err := c.ConnectWithConfig("127.0.0.1:25953", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	// the server registers it once the client signed the reg
+	for i := 0; ; i++ {
+		if _, ok := s.GetConnection(sc.publicKey); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("not registered after the pressure")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
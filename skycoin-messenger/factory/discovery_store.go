@@ -0,0 +1,86 @@
+package factory
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// DiscoveryStore keeps the services offered to a discovery server so they
+// survive its restart, e.g. boltstore.Store
+type DiscoveryStore interface {
+	// Save replaces the services of node
+	Save(node cipher.PubKey, ns *NodeServices) error
+	Delete(node cipher.PubKey) error
+	// Load returns the services of every node saved
+	Load() (map[cipher.PubKey]*NodeServices, error)
+	Close() error
+}
+
+// UseDiscoveryStore registers the services in s again and saves every offer
+// from now on. The restored services of a node are dropped once it offers
+// again or leaves, or after their TTL. s is closed with the factory, which
+// keeps the services saved then for the next start
+func (f *MessengerFactory) UseDiscoveryStore(s DiscoveryStore) error {
+	services, err := s.Load()
+	if err != nil {
+		return err
+	}
+	for node, ns := range services {
+		f.restoreServices(node, ns)
+	}
+	factoryLogger().Infof("restored the services of %d nodes", len(services))
+	f.fieldsMutex.Lock()
+	f.discoveryStore = s
+	f.fieldsMutex.Unlock()
+	return nil
+}
+
+func (f *MessengerFactory) restoreServices(node cipher.PubKey, ns *NodeServices) {
+	f.serviceDiscovery.restore(node, ns)
+	if ns.TTL <= 0 {
+		return
+	}
+	time.AfterFunc(time.Duration(ns.TTL)*time.Second, func() {
+		if f.serviceDiscovery.dropRestored(node, ns) {
+			f.deleteStoredServices(node)
+		}
+	})
+}
+
+func (f *MessengerFactory) getDiscoveryStore() (s DiscoveryStore) {
+	if atomic.LoadInt32(&f.closing) != 0 {
+		return
+	}
+	f.fieldsMutex.RLock()
+	s = f.discoveryStore
+	f.fieldsMutex.RUnlock()
+	return
+}
+
+func (f *MessengerFactory) saveServices(node cipher.PubKey, ns *NodeServices) {
+	s := f.getDiscoveryStore()
+	if s == nil {
+		return
+	}
+	var err error
+	if len(ns.Services) < 1 {
+		err = s.Delete(node)
+	} else {
+		err = s.Save(node, ns)
+	}
+	if err != nil {
+		factoryLogger().Errorf("save services of %s err %v", node.Hex(), err)
+	}
+}
+
+func (f *MessengerFactory) deleteStoredServices(node cipher.PubKey) {
+	s := f.getDiscoveryStore()
+	if s == nil {
+		return
+	}
+	if err := s.Delete(node); err != nil {
+		factoryLogger().Errorf("delete services of %s err %v", node.Hex(), err)
+	}
+}
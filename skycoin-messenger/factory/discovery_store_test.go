@@ -0,0 +1,101 @@
+package factory
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+type memDiscoveryStore struct {
+	services map[cipher.PubKey]*NodeServices
+	sync.Mutex
+}
+
+func (s *memDiscoveryStore) Save(node cipher.PubKey, ns *NodeServices) error {
+	s.Lock()
+	s.services[node] = ns
+	s.Unlock()
+	return nil
+}
+
+func (s *memDiscoveryStore) Delete(node cipher.PubKey) error {
+	s.Lock()
+	delete(s.services, node)
+	s.Unlock()
+	return nil
+}
+
+func (s *memDiscoveryStore) Load() (map[cipher.PubKey]*NodeServices, error) {
+	s.Lock()
+	defer s.Unlock()
+	services := make(map[cipher.PubKey]*NodeServices, len(s.services))
+	for k, v := range s.services {
+		services[k] = v
+	}
+	return services, nil
+}
+
+func (s *memDiscoveryStore) Close() error {
+	return nil
+}
+
+func (s *memDiscoveryStore) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.services)
+}
+
+func TestDiscoveryStore(t *testing.T) {
+	store := &memDiscoveryStore{services: make(map[cipher.PubKey]*NodeServices)}
+	listen := func() *MessengerFactory {
+		s := NewMessengerFactory()
+		s.SetDefaultSeedConfig(NewSeedConfig())
+		if err := s.UseDiscoveryStore(store); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Listen("127.0.0.1:25957"); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := listen()
+	sc := NewSeedConfig()
+	connect := func() (f *MessengerFactory, conn *Connection) {
+		f = NewMessengerFactory()
+		if err := f.ConnectWithConfig("127.0.0.1:25957", &ConnConfig{SeedConfig: sc}); err != nil {
+			t.Fatal(err)
+		}
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return
+	}
+	c, conn := connect()
+	if err := conn.OfferService("vpn"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if store.len() != 1 {
+		t.Fatal("offer not saved")
+	}
+	s.Close()
+	c.Close()
+	time.Sleep(200 * time.Millisecond)
+	if store.len() != 1 {
+		t.Fatal("services deleted by the close of the server")
+	}
+
+	s = listen()
+	defer s.Close()
+	if len(s.findByAttributes("vpn")[sc.publicKey.Hex()]) != 1 {
+		t.Fatal("services not restored")
+	}
+	// the node comes back and leaves
+	c, _ = connect()
+	time.Sleep(200 * time.Millisecond)
+	c.Close()
+	time.Sleep(200 * time.Millisecond)
+	if len(s.findByAttributes("vpn")) != 0 || store.len() != 0 {
+		t.Fatal("restored services kept after the node left")
+	}
+}
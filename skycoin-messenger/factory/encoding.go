@@ -0,0 +1,95 @@
+package factory
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+)
+
+// encodings of the bodies of ops, negotiated at reg like the compressions
+const (
+	ENCODING_JSON    = ""
+	ENCODING_MSGPACK = "msgpack"
+)
+
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+type opEncoding int32
+
+const (
+	opEncodingJSON opEncoding = iota
+	opEncodingMsgpack
+)
+
+// SupportedEncodings returns the binary encodings of ops to offer or accept
+// at reg, json is always supported
+func SupportedEncodings() []string {
+	return []string{ENCODING_MSGPACK}
+}
+
+// NegotiateEncoding returns the first offered encoding that is accepted,
+// json if none. All supported are accepted if accepted is empty
+func NegotiateEncoding(offered, accepted []string) string {
+	if len(accepted) < 1 {
+		accepted = SupportedEncodings()
+	}
+	for _, o := range offered {
+		if o != ENCODING_MSGPACK {
+			continue
+		}
+		for _, a := range accepted {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return ENCODING_JSON
+}
+
+// SetEncoding makes the ops written by c encoded by name. The ops read are
+// decoded by the encoding they come in, so both sides may switch at any time
+func (c *Connection) SetEncoding(name string) error {
+	e := opEncodingJSON
+	switch name {
+	case ENCODING_JSON:
+	case ENCODING_MSGPACK:
+		e = opEncodingMsgpack
+	default:
+		return ErrUnknownEncoding
+	}
+	atomic.StoreInt32(&c.encoding, int32(e))
+	return nil
+}
+
+// GetEncoding returns the encoding of the ops written by c
+func (c *Connection) GetEncoding() string {
+	if opEncoding(atomic.LoadInt32(&c.encoding)) == opEncodingMsgpack {
+		return ENCODING_MSGPACK
+	}
+	return ENCODING_JSON
+}
+
+func (c *Connection) marshalOP(object interface{}) ([]byte, error) {
+	if opEncoding(atomic.LoadInt32(&c.encoding)) == opEncodingMsgpack {
+		return marshalMsgpack(object)
+	}
+	return json.Marshal(object)
+}
+
+// isMsgpackBody reports if body is msgpack, the json of an op is an object
+// or null and never starts with a msgpack map or nil
+func isMsgpackBody(body []byte) bool {
+	if len(body) < 1 {
+		return false
+	}
+	b := body[0]
+	return b&0xf0 == 0x80 || b == msgpackMap16 || b == msgpackMap32 || b == msgpackNil
+}
+
+// unmarshalOP decodes body by the encoding it is in
+func unmarshalOP(body []byte, v interface{}) error {
+	if isMsgpackBody(body) {
+		return unmarshalMsgpack(body, v)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,147 @@
+package factory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMsgpackGoldens(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/conformance/frames.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var goldens []*conformanceGolden
+	err = json.Unmarshal(data, &goldens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range goldens {
+		pools := ops
+		if g.Op&RESP_PREFIX > 0 {
+			pools = resps
+		}
+		i := int(g.Op &^ RESP_PREFIX)
+		if len(g.Body) < 1 || i >= len(pools) || pools[i] == nil {
+			continue
+		}
+		if _, ok := pools[i].New().(rawOP); ok {
+			continue
+		}
+		want := pools[i].New()
+		err = json.Unmarshal(g.Body, want)
+		if err != nil {
+			t.Fatalf("%s %v", g.Name, err)
+		}
+		wantJSON, _ := json.Marshal(want)
+
+		var sent interface{} = want
+		if o, ok := want.(*offer); ok {
+			// as UpdateServices sends it
+			sent = &struct {
+				*NodeServices
+				opNonce
+			}{o.Services, o.opNonce}
+		}
+		body, err := marshalMsgpack(sent)
+		if err != nil {
+			t.Fatalf("%s %v", g.Name, err)
+		}
+		if !isMsgpackBody(body) || len(body) >= len(g.Body) {
+			t.Fatalf("%s body %x", g.Name, body)
+		}
+		// into an op that held one before like the pooled ones
+		got := pools[i].New()
+		json.Unmarshal(g.Body, got)
+		err = unmarshalOP(body, got)
+		if err != nil {
+			t.Fatalf("%s %v", g.Name, err)
+		}
+		if js, _ := json.Marshal(got); !bytes.Equal(js, wantJSON) {
+			t.Fatalf("%s round trip %s want %s", g.Name, js, wantJSON)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25972"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.HandleCall("echo", func(conn *Connection, req json.RawMessage) (interface{}, error) {
+		var v string
+		err := json.Unmarshal(req, &v)
+		return v, err
+	})
+
+	connect := func(encodings []string) (*MessengerFactory, *Connection) {
+		c := NewMessengerFactory()
+		err := c.ConnectWithConfig("127.0.0.1:25972", &ConnConfig{
+			SeedConfig: NewSeedConfig(),
+			Encodings:  encodings,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		c.ForEachConn(func(c *Connection) { conn = c })
+		return c, conn
+	}
+	bc, binary := connect(SupportedEncodings())
+	defer bc.Close()
+	jc, plain := connect(nil)
+	defer jc.Close()
+
+	if e := binary.GetEncoding(); e != ENCODING_MSGPACK {
+		t.Fatalf("encoding %q", e)
+	}
+	if e := plain.GetEncoding(); e != ENCODING_JSON {
+		t.Fatalf("encoding of a conn offering none %q", e)
+	}
+	var sc *Connection
+	for i := 0; i < 100 && sc == nil; i++ {
+		sc, _ = s.GetConnection(binary.GetKey())
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sc == nil || sc.GetEncoding() != ENCODING_MSGPACK {
+		t.Fatalf("encoding of the server %v", sc)
+	}
+
+	var resp string
+	if err := binary.Call("echo", "hello", &resp, time.Second); err != nil || resp != "hello" {
+		t.Fatalf("call %q err %v", resp, err)
+	}
+	err := binary.OfferServiceWithAddress("127.0.0.1:8000", "encoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the json conn finds what the msgpack one offered
+	found := make(chan *QueryByAttrsResp, 1)
+	for i := 0; i < 100; i++ {
+		err = plain.FindServiceNodesByAttributesContext(plain.Context(), func(ctx context.Context, r *QueryByAttrsResp, err error) {
+			if err == nil {
+				select {
+				case found <- &QueryByAttrsResp{Result: r.Result}:
+				default:
+				}
+			}
+		}, "encoding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-found:
+			if len(r.Result) != 1 {
+				t.Fatalf("result %v", r.Result)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("service offered over msgpack not found")
+}
@@ -0,0 +1,219 @@
+package factory
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// context field of the token a new node sends at reg
+	ENROLLMENT_TOKEN_CONTEXT = "enrollment-token"
+	// annotation of the account an enrolled node is bound to
+	ENROLLMENT_ACCOUNT_CONTEXT = "enrollment-account"
+
+	enrollmentIDSize    = 16
+	enrollmentTokenSize = len(cipher.PubKey{}) + enrollmentIDSize + 8 + len(cipher.Sig{})
+)
+
+var ErrInvalidEnrollmentToken = errors.New("invalid enrollment token")
+
+type enrollmentToken struct {
+	Account cipher.PubKey
+	ID      [enrollmentIDSize]byte
+	Expires int64
+	Sig     cipher.Sig
+}
+
+func (t *enrollmentToken) hash() cipher.SHA256 {
+	b := make([]byte, 0, enrollmentTokenSize)
+	b = append(b, t.Account[:]...)
+	b = append(b, t.ID[:]...)
+	b = appendUint64(b, uint64(t.Expires))
+	return cipher.SumSHA256(b)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], v)
+	return append(b, n[:]...)
+}
+
+// IssueEnrollmentToken returns a single use token that binds a new node to
+// the account of keys at a server whose Enrollment knows the account. It
+// expires after ttl, never if 0
+func IssueEnrollmentToken(keys cn.KeyProvider, ttl time.Duration) (string, error) {
+	t := &enrollmentToken{Account: keys.PubKey()}
+	copy(t.ID[:], cipher.RandByte(enrollmentIDSize))
+	if ttl > 0 {
+		t.Expires = time.Now().Add(ttl).Unix()
+	}
+	sig, err := keys.SignHash(t.hash())
+	if err != nil {
+		return "", err
+	}
+	t.Sig = sig
+	return t.String(), nil
+}
+
+func (t *enrollmentToken) String() string {
+	b := make([]byte, 0, enrollmentTokenSize)
+	b = append(b, t.Account[:]...)
+	b = append(b, t.ID[:]...)
+	b = appendUint64(b, uint64(t.Expires))
+	b = append(b, t.Sig[:]...)
+	return hex.EncodeToString(b)
+}
+
+func parseEnrollmentToken(s string) (t *enrollmentToken, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != enrollmentTokenSize {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	t = &enrollmentToken{}
+	b = b[copy(t.Account[:], b):]
+	b = b[copy(t.ID[:], b):]
+	t.Expires = int64(binary.BigEndian.Uint64(b))
+	copy(t.Sig[:], b[8:])
+	if cipher.VerifySignature(t.Account, t.Sig, t.hash()) != nil {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	return
+}
+
+// Enrollment binds nodes to the accounts of their operators by the tokens
+// of IssueEnrollmentToken, so a fleet can be closed on a shared server. Use
+// Validate as the ContextValidator and Commit as the ContextCommitter of the
+// server
+type Enrollment struct {
+	// nodes without a token or binding are rejected if true, they register
+	// unbound otherwise
+	Required bool
+
+	accounts map[cipher.PubKey]struct{}
+	// expiry of the tokens used, 0 if they never expire
+	used  map[[enrollmentIDSize]byte]int64
+	nodes map[cipher.PubKey]cipher.PubKey
+	sync.Mutex
+}
+
+func NewEnrollment(required bool, accounts ...cipher.PubKey) *Enrollment {
+	e := &Enrollment{
+		Required: required,
+		accounts: make(map[cipher.PubKey]struct{}),
+		used:     make(map[[enrollmentIDSize]byte]int64),
+		nodes:    make(map[cipher.PubKey]cipher.PubKey),
+	}
+	for _, a := range accounts {
+		e.accounts[a] = struct{}{}
+	}
+	return e
+}
+
+// AddAccount accepts the tokens of account from now on
+func (e *Enrollment) AddAccount(account cipher.PubKey) {
+	e.Lock()
+	e.accounts[account] = struct{}{}
+	e.Unlock()
+}
+
+// RemoveAccount rejects the tokens of account and unbinds its nodes
+func (e *Enrollment) RemoveAccount(account cipher.PubKey) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.accounts, account)
+	for node, a := range e.nodes {
+		if a == account {
+			delete(e.nodes, node)
+		}
+	}
+}
+
+// Account returns the account node is bound to
+func (e *Enrollment) Account(node cipher.PubKey) (account cipher.PubKey, ok bool) {
+	e.Lock()
+	account, ok = e.nodes[node]
+	e.Unlock()
+	return
+}
+
+// Unbind makes node present a new token at its next reg
+func (e *Enrollment) Unbind(node cipher.PubKey) {
+	e.Lock()
+	delete(e.nodes, node)
+	e.Unlock()
+}
+
+// Validate is a ContextValidator, a node bound before needs no token. The
+// token is only checked, Commit consumes it once the node proved its key
+func (e *Enrollment) Validate(key cipher.PubKey, context map[string]string) (map[string]string, *RegRejection) {
+	e.Lock()
+	defer e.Unlock()
+	account, ok := e.nodes[key]
+	if ok {
+		return map[string]string{ENROLLMENT_ACCOUNT_CONTEXT: account.Hex()}, nil
+	}
+	s, ok := context[ENROLLMENT_TOKEN_CONTEXT]
+	if !ok {
+		if e.Required {
+			return nil, &RegRejection{Field: ENROLLMENT_TOKEN_CONTEXT, Code: "required"}
+		}
+		return nil, nil
+	}
+	t, rejection := e.checkToken(s)
+	if rejection != nil {
+		return nil, rejection
+	}
+	return map[string]string{ENROLLMENT_ACCOUNT_CONTEXT: t.Account.Hex()}, nil
+}
+
+// Commit is a ContextCommitter, it consumes the token Validate accepted and
+// binds the node to its account
+func (e *Enrollment) Commit(key cipher.PubKey, context map[string]string) *RegRejection {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.nodes[key]; ok {
+		return nil
+	}
+	s, ok := context[ENROLLMENT_TOKEN_CONTEXT]
+	if !ok {
+		return nil
+	}
+	// used by another node since Validate
+	t, rejection := e.checkToken(s)
+	if rejection != nil {
+		return rejection
+	}
+	now := time.Now().Unix()
+	for id, expires := range e.used {
+		if expires > 0 && expires < now {
+			delete(e.used, id)
+		}
+	}
+	e.used[t.ID] = t.Expires
+	e.nodes[key] = t.Account
+	return nil
+}
+
+// checkToken parses s, e is locked
+func (e *Enrollment) checkToken(s string) (*enrollmentToken, *RegRejection) {
+	t, err := parseEnrollmentToken(s)
+	if err != nil {
+		return nil, &RegRejection{Field: ENROLLMENT_TOKEN_CONTEXT, Code: "invalid", Message: err.Error()}
+	}
+	if _, ok := e.accounts[t.Account]; !ok {
+		return nil, &RegRejection{Field: ENROLLMENT_TOKEN_CONTEXT, Code: "unknown-account"}
+	}
+	if t.Expires > 0 && t.Expires < time.Now().Unix() {
+		return nil, &RegRejection{Field: ENROLLMENT_TOKEN_CONTEXT, Code: "expired"}
+	}
+	if _, ok := e.used[t.ID]; ok {
+		return nil, &RegRejection{Field: ENROLLMENT_TOKEN_CONTEXT, Code: "used"}
+	}
+	return t, nil
+}
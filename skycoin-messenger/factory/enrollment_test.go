@@ -0,0 +1,83 @@
+package factory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnrollment(t *testing.T) {
+	operator := NewSeedConfig()
+	e := NewEnrollment(true, operator.publicKey)
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	s.ContextValidator = e.Validate
+	s.ContextCommitter = e.Commit
+	if err := s.Listen("127.0.0.1:25952"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := NewMessengerFactory()
+	defer c.Close()
+	connect := func(sc *SeedConfig, token string) error {
+		var ctx map[string]string
+		if len(token) > 0 {
+			ctx = map[string]string{ENROLLMENT_TOKEN_CONTEXT: token}
+		}
+		return c.ConnectWithConfig("127.0.0.1:25952", &ConnConfig{SeedConfig: sc, Context: ctx})
+	}
+	rejected := func(err error, code string) {
+		if r, ok := err.(*RegRejection); !ok || r.Code != code {
+			t.Fatalf("err %v, want %s", err, code)
+		}
+	}
+
+	node := NewSeedConfig()
+	rejected(connect(node, ""), "required")
+	token, err := IssueEnrollmentToken(operator.Keys(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key of node claimed without its secret key
+	impostor := &SeedConfig{PublicKey: node.PublicKey, SecKey: NewSeedConfig().SecKey}
+	if err = connect(impostor, token); err != nil {
+		t.Fatal(err)
+	}
+	// the server closes it at the signature
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := e.Account(node.publicKey); ok {
+		t.Fatal("node bound by a wrong signature")
+	}
+	// the token is still unused
+	if err = connect(node, token); err != nil {
+		t.Fatal(err)
+	}
+	// bound once the server verified the signature
+	for i := 0; i < 100; i++ {
+		if _, ok := e.Account(node.publicKey); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a, ok := e.Account(node.publicKey); !ok || a != operator.publicKey {
+		t.Fatalf("node bound to %v %t", a, ok)
+	}
+	// enrolled already
+	if err = connect(node, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected(connect(NewSeedConfig(), token), "used")
+	// a byte of S, the last one is the recovery id
+	corrupted, err := parseEnrollmentToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted.Sig[48] ^= 0xff
+	rejected(connect(NewSeedConfig(), corrupted.String()), "invalid")
+	other, _ := IssueEnrollmentToken(NewSeedConfig().Keys(), 0)
+	rejected(connect(NewSeedConfig(), other), "unknown-account")
+	expired := &enrollmentToken{Account: operator.publicKey, Expires: time.Now().Add(-time.Minute).Unix()}
+	expired.Sig, _ = operator.Keys().SignHash(expired.hash())
+	rejected(connect(NewSeedConfig(), expired.String()), "expired")
+}
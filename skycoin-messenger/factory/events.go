@@ -0,0 +1,215 @@
+package factory
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// EventType is what an Event tells of
+type EventType int
+
+const (
+	// an accepted conn registered its key
+	EVENT_CONN_REGISTERED EventType = iota + 1
+	// an accepted conn left or a newer conn of its key replaced it
+	EVENT_CONN_UNREGISTERED
+	// a node offered services to the discovery, none if it withdrew them
+	EVENT_SERVICES_OFFERED
+	// the discovery dropped the services of a node closed or expired
+	EVENT_SERVICES_REMOVED
+	// a transport to an app got its conn between the nodes
+	EVENT_TRANSPORT_BUILT
+	EVENT_TRANSPORT_CLOSED
+	// the server relayed a message between two nodes
+	EVENT_MESSAGE_RELAYED
+	// a server presented Key instead of the one pinned, Peer, and the client
+	// refused it, see KeyPins
+	EVENT_SERVER_KEY_CHANGED
+	// an accepted conn replaced its key, Peer, by Key, see RotateKey
+	EVENT_KEY_ROTATED
+	// the server a transport was built through closed and the node carried
+	// it over to another server it is connected to
+	EVENT_TRANSPORT_RECONNECTED
+)
+
+var eventNames = map[EventType]string{
+	EVENT_CONN_REGISTERED:       "conn_registered",
+	EVENT_CONN_UNREGISTERED:     "conn_unregistered",
+	EVENT_SERVICES_OFFERED:      "services_offered",
+	EVENT_SERVICES_REMOVED:      "services_removed",
+	EVENT_TRANSPORT_BUILT:       "transport_built",
+	EVENT_TRANSPORT_CLOSED:      "transport_closed",
+	EVENT_MESSAGE_RELAYED:       "message_relayed",
+	EVENT_SERVER_KEY_CHANGED:    "server_key_changed",
+	EVENT_KEY_ROTATED:           "key_rotated",
+	EVENT_TRANSPORT_RECONNECTED: "transport_reconnected",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// events a subscriber may fall behind by before it misses the next ones
+const DEFAULT_EVENT_BUFFER = 256
+
+// Event of the lifecycle of the factory, see Subscribe
+type Event struct {
+	Type EventType
+	Time time.Time
+	// the node registered, offering or relayed from. The remote node of a
+	// transport
+	Key cipher.PubKey
+	// the node a message was relayed to, the remote app of a transport
+	Peer cipher.PubKey
+	// of the node, nil for the transports
+	Conn *Connection
+	// of EVENT_SERVICES_OFFERED
+	Services *NodeServices
+	// of EVENT_TRANSPORT_BUILT, EVENT_TRANSPORT_CLOSED and
+	// EVENT_TRANSPORT_RECONNECTED
+	Transport *Transport
+	// bytes of a relayed message
+	Size int
+}
+
+// Subscription receives the events of the factory on C until Unsubscribe or
+// the Close of the factory closes it
+type Subscription struct {
+	// first for the alignment of the atomics
+	dropped uint64
+
+	C <-chan Event
+	c chan Event
+	// bit of each type subscribed to, all if 0
+	types uint64
+	bus   *eventBus
+}
+
+// Dropped returns the events missed while C was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe closes C, the events still buffered in it are kept
+func (s *Subscription) Unsubscribe() {
+	s.bus.remove(s)
+}
+
+func (s *Subscription) wants(t EventType) bool {
+	return s.types == 0 || s.types&(1<<uint(t)) != 0
+}
+
+// eventBus fans the events out to the subscriptions, publishing never
+// blocks the factory
+type eventBus struct {
+	// len of subs, read without the lock by publish
+	count  int32
+	subs   map[*Subscription]struct{}
+	closed bool
+	sync.RWMutex
+}
+
+func (b *eventBus) add(s *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		close(s.c)
+		return
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[s] = struct{}{}
+	atomic.StoreInt32(&b.count, int32(len(b.subs)))
+}
+
+func (b *eventBus) remove(s *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.c)
+	atomic.StoreInt32(&b.count, int32(len(b.subs)))
+}
+
+func (b *eventBus) close() {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		close(s.c)
+	}
+	b.subs = nil
+	atomic.StoreInt32(&b.count, 0)
+}
+
+func (b *eventBus) publish(e Event) {
+	if atomic.LoadInt32(&b.count) < 1 {
+		return
+	}
+	e.Time = time.Now()
+	b.RLock()
+	defer b.RUnlock()
+	for s := range b.subs {
+		if !s.wants(e.Type) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns the stream of the events of types, of all if none. C
+// holds buffer events, DEFAULT_EVENT_BUFFER if 0, the ones coming while it is
+// full are dropped and counted by Dropped
+func (f *MessengerFactory) Subscribe(buffer int, types ...EventType) *Subscription {
+	if buffer <= 0 {
+		buffer = DEFAULT_EVENT_BUFFER
+	}
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, bus: &f.events}
+	for _, t := range types {
+		s.types |= 1 << uint(t)
+	}
+	f.events.add(s)
+	return s
+}
+
+func (f *MessengerFactory) publish(e Event) {
+	f.events.publish(e)
+}
+
+// Key is empty if conn sent before it registered
+func (f *MessengerFactory) publishRelayed(from *Connection, to cipher.PubKey, size int) {
+	if atomic.LoadInt32(&f.events.count) < 1 {
+		return
+	}
+	e := Event{Type: EVENT_MESSAGE_RELAYED, Peer: to, Conn: from, Size: size}
+	if from.IsKeySet() {
+		e.Key = from.GetKey()
+	}
+	f.publish(e)
+}
+
+// published on the factory that created the transport
+func (t *Transport) publish(typ EventType) {
+	if t.creator == nil {
+		return
+	}
+	e := Event{Type: typ, Key: t.ToNode, Peer: t.ToApp, Transport: t}
+	if !t.clientSide {
+		e.Key, e.Peer = t.FromNode, t.FromApp
+	}
+	t.creator.publish(e)
+}
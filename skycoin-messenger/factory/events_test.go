@@ -0,0 +1,63 @@
+package factory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25961"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sub := s.Subscribe(0, EVENT_CONN_REGISTERED, EVENT_SERVICES_OFFERED, EVENT_CONN_UNREGISTERED)
+	all := s.Subscribe(1)
+	next := func() Event {
+		select {
+		case e := <-sub.C:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	sc := NewSeedConfig()
+	c := NewMessengerFactory()
+	if err := c.ConnectWithConfig("127.0.0.1:25961", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	var conn *Connection
+	c.ForEachConn(func(connection *Connection) { conn = connection })
+	if e := next(); e.Type != EVENT_CONN_REGISTERED || e.Key != sc.publicKey || e.Conn == nil {
+		t.Fatalf("registered %v %s", e.Type, e.Key.Hex())
+	}
+	if err := conn.OfferService("events"); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != EVENT_SERVICES_OFFERED || e.Services == nil || e.Services.Services[0].Attributes[0] != "events" {
+		t.Fatalf("offered %v", e.Type)
+	}
+	c.Close()
+	if e := next(); e.Type != EVENT_CONN_UNREGISTERED || e.Key != sc.publicKey {
+		t.Fatalf("unregistered %v", e.Type)
+	}
+
+	// removed went to the full subscription of all events only
+	if all.Dropped() < 1 {
+		t.Fatal("full subscription dropped nothing")
+	}
+	all.Unsubscribe()
+	if _, ok := <-all.C; !ok {
+		t.Fatal("buffered event lost")
+	}
+	if _, ok := <-all.C; ok {
+		t.Fatal("not closed by Unsubscribe")
+	}
+	s.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatal("not closed by the factory")
+	}
+}
@@ -1,18 +1,23 @@
 package factory
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	cn "github.com/skycoin/net/conn"
 	"github.com/skycoin/net/factory"
 	"github.com/skycoin/skycoin/src/cipher"
 	"io/ioutil"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MessengerFactory struct {
+	// first for the alignment of the atomics, see RegistryVersion
+	regVersion uint64
+
 	factory             factory.Factory
 	udp                 *factory.UDPFactory
 	udpMutex            sync.Mutex
@@ -21,10 +26,13 @@ type MessengerFactory struct {
 
 	// custom msg callback
 	CustomMsgHandler func(*Connection, []byte)
+	// traced msg callback at the destination, the trace is logged if nil
+	OnTrace func(conn *Connection, from cipher.PubKey, trace *Trace)
 
 	// will deliver the services data to server if true
 	Proxy bool
 	serviceDiscovery
+	appMessageHub
 
 	defaultSeedConfig *SeedConfig
 
@@ -32,6 +40,102 @@ type MessengerFactory struct {
 	// on accepted callback
 	OnAcceptedUDPCallback func(connection *Connection)
 
+	// compressions the server accepts when offered at reg, compression is disabled if empty
+	Compressions []string
+	// bodies shorter than this are not compressed, conn.DEFAULT_COMPRESSION_THRESHOLD if 0
+	CompressionThreshold int
+	// cipher suites the server accepts when offered at reg, all supported if empty
+	CipherSuites []string
+	// checksums of udp packets the server accepts when offered at reg, all supported if empty
+	Checksums []string
+	// encodings of ops the server accepts when offered at reg, all supported if empty
+	Encodings []string
+	// buffer sizes and overflow policy of new connections, the defaults if nil
+	ChannelOptions *cn.ChannelOptions
+	// per connection read and write limits, unlimited if nil
+	RateLimit *cn.RateLimit
+	// budget shared by the writes of all connections, unlimited if nil
+	Bandwidth *cn.SharedBandwidth
+	// bytes each connection may hold in unacked and unreassembled messages, unlimited if 0
+	MemoryLimit int
+	// largest body of a tcp message a connection accepts, msg.MAX_MESSAGE_SIZE if 0
+	MaxMessageSize uint32
+	// udp connections send a receiver report this often, see cn.ReceiverReport. Never if 0
+	ReceiverReportInterval time.Duration
+	// new udp addresses echo a cookie before they get a connection, see cn.Cookies
+	UDPCookies bool
+	// of the listeners and every new connection, the defaults if nil
+	SocketOptions *cn.SocketOptions
+	// of every connection, cn.DefaultIdlePolicy if nil. OnIdle gets the conn below the messenger one
+	IdlePolicy *cn.IdlePolicy
+	// client side transports without app traffic for this long close the conn
+	// between nodes and build it again on the next app conn, never if 0
+	TransportIdleTimeout time.Duration
+	// transports are refused unless the node at the other end offers a key
+	// for the data of the apps, see Transport.IsEndToEnd
+	RequireTransportE2E bool
+	// the ops of tcp clients run on this many workers shared by all connections,
+	// taking turns between them, in a goroutine per connection if 0
+	OpWorkers int
+	// ops each connection may queue before its reads wait, DEFAULT_OP_QUEUE_SIZE if 0
+	OpQueueSize int
+	// how many ops of a kind may run on the workers at once, e.g. OP_QUERY_BY_ATTRS: 2
+	OpLimits map[byte]int
+	// how long clients wait for the resps of their ops and how often they retry,
+	// e.g. DefaultOPPolicies(). The ops without a policy wait forever
+	OPPolicies map[byte]OPPolicy
+	// the services offered carry it as NodeServices.TTL and are offered again
+	// every third of it, so the discovery drops them once a node is gone. Never if 0
+	ServiceTTL time.Duration
+	// how DialApp connects to apps, raced in order. The udp transport only if
+	// empty, see DefaultBuildStrategies
+	BuildStrategies []BuildStrategy
+	// nodes in a resp to OP_QUERY_BY_ATTRS, clients page through the rest.
+	// Unlimited if 0
+	MaxQueryResults int
+	// checks the context of clients at reg, all are accepted if nil
+	ContextValidator ContextValidator
+	// run on the context ContextValidator accepted once the key is proven
+	ContextCommitter ContextCommitter
+	// bandwidth of the messages relayed between nodes per operator, unlimited if nil
+	RelayQuotas *RelayQuotas
+	// read and write limits of the conns of anonymous clients instead of
+	// RateLimit, see ConnConfig.Anonymous
+	AnonymousRateLimit *cn.RateLimit
+	// anonymous conns without reads for this long are closed,
+	// DEFAULT_ANONYMOUS_IDLE_TIMEOUT if 0
+	AnonymousIdleTimeout time.Duration
+	// keys of the servers the clients connect to, not checked if nil
+	KeyPins *KeyPins
+	// regs and queries per second of a client ip or key, unlimited if nil
+	RegLimits *RegLimits
+	// clients must sign the challenge of the server bound to their key at
+	// reg, the ones that sign the bare nonce of the reg are refused
+	RequireRegChallenge bool
+	// how PickNode picks between the nodes offering a service, e.g.
+	// BALANCE_ROUND_ROBIN. The first by key if empty
+	BalancePolicy string
+	balancer      balancer
+
+	opScheduler *opScheduler
+
+	// see Degrade
+	degradationLevel int32
+	degradationStop  chan struct{}
+	// see CheckHealth
+	healthStop chan struct{}
+
+	// see UseDiscoveryStore
+	discoveryStore DiscoveryStore
+	// set by Close, the services of the conns closed then stay stored
+	closing int32
+	// see Federate
+	federator *federator
+	// see Subscribe
+	events eventBus
+	// see HandleCall
+	callHandlers map[string]CallHandler
+
 	fieldsMutex sync.RWMutex
 }
 
@@ -42,8 +146,18 @@ func NewMessengerFactory() *MessengerFactory {
 func (f *MessengerFactory) Listen(address string) (err error) {
 	tcp := factory.NewTCPFactory()
 	tcp.AcceptedCallback = f.acceptedCallback
+	tcp.ChannelOptions = f.ChannelOptions
+	tcp.RateLimit = f.RateLimit
+	tcp.Bandwidth = f.Bandwidth
+	tcp.MemoryLimit = f.MemoryLimit
+	tcp.MaxMessageSize = f.MaxMessageSize
+	tcp.IdlePolicy = f.IdlePolicy
+	tcp.SocketOptions = f.SocketOptions
 	f.fieldsMutex.Lock()
 	f.factory = tcp
+	if f.OpWorkers > 0 && f.opScheduler == nil {
+		f.opScheduler = newOPScheduler(f.OpWorkers, f.OpQueueSize, f.OpLimits, f.executeOP)
+	}
 	f.fieldsMutex.Unlock()
 	err = tcp.Listen(address)
 	if err != nil {
@@ -52,6 +166,15 @@ func (f *MessengerFactory) Listen(address string) (err error) {
 	if !f.Proxy {
 		udp := factory.NewUDPFactory()
 		udp.AcceptedCallback = f.acceptedUDPCallback
+		udp.ChannelOptions = f.ChannelOptions
+		udp.RateLimit = f.RateLimit
+		udp.Bandwidth = f.Bandwidth
+		udp.MemoryLimit = f.MemoryLimit
+		udp.MaxMessageSize = f.MaxMessageSize
+		udp.IdlePolicy = f.IdlePolicy
+		udp.SocketOptions = f.SocketOptions
+		udp.ReceiverReportInterval = f.ReceiverReportInterval
+		udp.RequireCookies = f.UDPCookies
 		f.fieldsMutex.Lock()
 		f.udp = udp
 		f.fieldsMutex.Unlock()
@@ -62,11 +185,16 @@ func (f *MessengerFactory) Listen(address string) (err error) {
 
 func (f *MessengerFactory) acceptedUDPCallback(connection *factory.Connection) {
 	var err error
-	conn, ok := connection.RealObject.(*Connection)
+	conn, ok := connection.GetRealObject().(*Connection)
 	if !ok {
 		conn = newUDPServerConnection(connection, f)
 	}
 	conn.SetContextLogger(conn.GetContextLogger().WithField("app", "messenger"))
+	if f.rejectUnderPressure() {
+		conn.GetContextLogger().Debug(ErrMemoryPressure)
+		conn.Close()
+		return
+	}
 	//defer func() {
 	//	if e := recover(); e != nil {
 	//		conn.GetContextLogger().Errorf("acceptedUDPCallback recover err %v", e)
@@ -103,47 +231,71 @@ func (f *MessengerFactory) callbackLoop(conn *Connection) (err error) {
 			if len(m) < MSG_HEADER_END {
 				return
 			}
-			opn := m[MSG_OP_BEGIN]
-			op := getOP(int(opn))
-			if op == nil {
-				conn.GetContextLogger().Debugf("op not found %x", m)
-				continue
-			}
-			var rb []byte
-			if sop, ok := op.(simpleOP); ok {
-				body := m[MSG_HEADER_END:]
-				if len(body) > 0 {
-					err = json.Unmarshal(m[MSG_HEADER_END:], sop)
-					if err != nil {
-						return
-					}
-				}
-				var r resp
-				r, err = sop.Execute(f, conn)
-				if err != nil {
-					return
-				}
-				if r != nil {
-					rb, err = json.Marshal(r)
-				}
-			} else if rop, ok := op.(rawOP); ok {
-				rb, err = rop.RawExecute(f, conn, m)
-			} else {
-				err = errors.New("not implement op type")
+			err = f.executeOP(conn, m)
+			if err != nil {
 				return
 			}
+		}
+	}
+}
+
+// executeOP runs the op of m from conn and writes its resp
+func (f *MessengerFactory) executeOP(conn *Connection, m []byte) (err error) {
+	opn := m[MSG_OP_BEGIN]
+	if opn == OP_PING|RESP_PREFIX {
+		return conn.runPong(m[MSG_HEADER_END:])
+	}
+	if conn.IsAnonymous() && !anonymousOPs[opn] {
+		return ErrAnonymousOP
+	}
+	if opn == OP_STREAM {
+		return conn.receiveStreamFrame(m[MSG_HEADER_END:])
+	}
+	if !f.allowOPRate(conn, opn) {
+		if isRegOP(opn) {
+			return ErrRegLimited
+		}
+		return
+	}
+	op := getOP(int(opn))
+	if op == nil {
+		conn.GetContextLogger().Debugf("op not found %x", m)
+		return
+	}
+	var rb []byte
+	if sop, ok := op.(simpleOP); ok {
+		body := m[MSG_HEADER_END:]
+		if len(body) > 0 {
+			err = unmarshalOP(m[MSG_HEADER_END:], sop)
 			if err != nil {
 				return
 			}
-			if rb != nil {
-				err = conn.writeOPBytes(opn|RESP_PREFIX, rb)
-				if err != nil {
-					return
-				}
-			}
-			putOP(int(opn), op)
 		}
+		var r resp
+		r, err = sop.Execute(f, conn)
+		if err != nil {
+			return
+		}
+		if r != nil {
+			rb, err = conn.marshalOP(r)
+		}
+	} else if rop, ok := op.(rawOP); ok {
+		rb, err = rop.RawExecute(f, conn, m)
+	} else {
+		err = errors.New("not implement op type")
+		return
 	}
+	if err != nil {
+		return
+	}
+	if rb != nil {
+		err = conn.writeOPBytes(opn|RESP_PREFIX, rb)
+		if err != nil {
+			return
+		}
+	}
+	putOP(int(opn), op)
+	return
 }
 
 func (f *MessengerFactory) acceptedCallback(connection *factory.Connection) {
@@ -160,6 +312,17 @@ func (f *MessengerFactory) acceptedCallback(connection *factory.Connection) {
 		f.discoveryUnregister(conn)
 		conn.Close()
 	}()
+	if f.rejectUnderPressure() {
+		err = ErrMemoryPressure
+		return
+	}
+	f.fieldsMutex.RLock()
+	s := f.opScheduler
+	f.fieldsMutex.RUnlock()
+	if s != nil {
+		err = s.loop(conn)
+		return
+	}
 	err = f.callbackLoop(conn)
 }
 
@@ -169,16 +332,21 @@ func (f *MessengerFactory) register(key cipher.PubKey, connection *Connection) {
 	if ok {
 		if c == connection {
 			f.regConnectionsMutex.Unlock()
-			log.Debugf("reg %s %p already", key.Hex(), connection)
+			factoryLogger().Debugf("reg %s %p already", key.Hex(), connection)
 			return
 		}
-		log.Debugf("reg close %s %p for %p", key.Hex(), c, connection)
+		factoryLogger().Debugf("reg close %s %p for %p", key.Hex(), c, connection)
 		defer c.Close()
 	}
 	connection.UpdateConnectTime()
 	f.regConnections[key] = connection
+	atomic.AddUint64(&f.regVersion, 1)
 	f.regConnectionsMutex.Unlock()
-	log.Debugf("reg %s %p", key.Hex(), connection)
+	factoryLogger().Debugf("reg %s %p", key.Hex(), connection)
+	if ok {
+		f.publish(Event{Type: EVENT_CONN_UNREGISTERED, Key: key, Conn: c})
+	}
+	f.publish(Event{Type: EVENT_CONN_REGISTERED, Key: key, Conn: connection})
 }
 
 // Get accepted connection by key
@@ -198,16 +366,24 @@ func (f *MessengerFactory) ForEachAcceptedConnection(fn func(key cipher.PubKey,
 	f.regConnectionsMutex.RUnlock()
 }
 
+// RegistryVersion changes whenever an accepted connection registers or leaves,
+// so a view of ForEachAcceptedConnection is current while it holds
+func (f *MessengerFactory) RegistryVersion() uint64 {
+	return atomic.LoadUint64(&f.regVersion)
+}
+
 func (f *MessengerFactory) unregister(key cipher.PubKey, connection *Connection) {
 	f.regConnectionsMutex.Lock()
 	c, ok := f.regConnections[key]
 	if ok && c == connection {
 		delete(f.regConnections, key)
+		atomic.AddUint64(&f.regVersion, 1)
 		f.regConnectionsMutex.Unlock()
-		log.Debugf("unreg %s %p", key.Hex(), c)
+		factoryLogger().Debugf("unreg %s %p", key.Hex(), c)
+		f.publish(Event{Type: EVENT_CONN_UNREGISTERED, Key: key, Conn: c})
 	} else if ok {
 		f.regConnectionsMutex.Unlock()
-		log.Debugf("unreg %s %p != new %p", key.Hex(), connection, c)
+		factoryLogger().Debugf("unreg %s %p != new %p", key.Hex(), connection, c)
 	} else {
 		f.regConnectionsMutex.Unlock()
 	}
@@ -217,7 +393,12 @@ func (f *MessengerFactory) Connect(address string) (err error) {
 	return f.ConnectWithConfig(address, nil)
 }
 
-func (f *MessengerFactory) loadSeedConfig(config *ConnConfig) (key cipher.PubKey, secKey cipher.SecKey, err error) {
+// ConnectContext is Connect that gives up once ctx is done
+func (f *MessengerFactory) ConnectContext(ctx context.Context, address string) (err error) {
+	return f.ConnectWithConfigContext(ctx, address, nil)
+}
+
+func (f *MessengerFactory) loadSeedConfig(config *ConnConfig) (key cipher.PubKey, keys cn.KeyProvider, err error) {
 	var sc *SeedConfig
 	if config.SeedConfig != nil {
 		sc = config.SeedConfig
@@ -236,7 +417,7 @@ func (f *MessengerFactory) loadSeedConfig(config *ConnConfig) (key cipher.PubKey
 		return
 	}
 	key = sc.publicKey
-	secKey = sc.secKey
+	keys = sc.keys
 	return
 }
 
@@ -266,6 +447,13 @@ func (f *MessengerFactory) GetDefaultSeedConfig() (sc *SeedConfig) {
 }
 
 func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig) (err error) {
+	return f.ConnectWithConfigContext(context.Background(), address, config)
+}
+
+// ConnectWithConfigContext is ConnectWithConfig that closes the connection and
+// returns ctx.Err() if ctx is done before the server registered the key, the
+// connection outlives ctx after that
+func (f *MessengerFactory) ConnectWithConfigContext(ctx context.Context, address string, config *ConnConfig) (err error) {
 	var conn *Connection
 	defer func() {
 		if err != nil && conn != nil {
@@ -275,12 +463,20 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 	f.fieldsMutex.Lock()
 	if f.factory == nil {
 		tcpFactory := factory.NewTCPFactory()
+		tcpFactory.ChannelOptions = f.ChannelOptions
+		tcpFactory.RateLimit = f.RateLimit
+		tcpFactory.Bandwidth = f.Bandwidth
+		tcpFactory.MemoryLimit = f.MemoryLimit
+		tcpFactory.MaxMessageSize = f.MaxMessageSize
+		tcpFactory.IdlePolicy = f.IdlePolicy
+		tcpFactory.SocketOptions = f.SocketOptions
 		f.factory = tcpFactory
 	}
+	ff := f.factory
 	f.fieldsMutex.Unlock()
-	c, err := f.factory.Connect(address)
+	c, err := ff.ConnectContext(ctx, address)
 	if err != nil {
-		if config != nil && config.Reconnect {
+		if config != nil && config.Reconnect && ctx.Err() == nil {
 			go func() {
 				time.Sleep(config.ReconnectWait)
 				f.ConnectWithConfig(address, config)
@@ -290,12 +486,23 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 	}
 	conn = newClientConnection(c, f)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("app", "messenger"))
+	conn.serverAddress = address
 	if config != nil {
 		conn.onConnected = config.OnConnected
 		conn.onDisconnected = config.OnDisconnected
 		conn.findServiceNodesByKeysCallback = config.FindServiceNodesByKeysCallback
 		conn.findServiceNodesByAttributesCallback = config.FindServiceNodesByAttributesCallback
 		conn.appConnectionInitCallback = config.AppConnectionInitCallback
+		conn.onServiceNodesByKeys = config.OnServiceNodesByKeys
+		conn.onServiceNodesByAttributes = config.OnServiceNodesByAttributes
+		conn.onAppConnection = config.OnAppConnection
+		conn.onTransportState = config.OnTransportState
+		if config.TransportReconnect {
+			conn.transportReconnect = &transportReconnect{
+				wait:     config.TransportReconnectWait,
+				attempts: config.TransportReconnectAttempts,
+			}
+		}
 		if config.Reconnect {
 			conn.reconnect = func() {
 				time.Sleep(config.ReconnectWait)
@@ -307,11 +514,21 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 				conn.StoreContext(k, v)
 			}
 		}
+		conn.compressions = config.Compressions
+		conn.compressionThreshold = config.CompressionThreshold
+		conn.cipherSuites = config.CipherSuites
+		conn.encodings = config.Encodings
+		conn.region = config.Region
 		var key cipher.PubKey
-		var secKey cipher.SecKey
-		key, secKey, err = f.loadSeedConfig(config)
+		var keys cn.KeyProvider
+		if config.Anonymous {
+			conn.setAnonymous()
+			key, keys, err = anonymousKeys()
+		} else {
+			key, keys, err = f.loadSeedConfig(config)
+		}
 		if err == nil {
-			conn.SetSecKey(secKey)
+			conn.SetKeyProvider(keys)
 			if config.TargetKey != EMPATY_PUBLIC_KEY {
 				err = conn.RegWithKeys(key, config.TargetKey, config.Context)
 			} else {
@@ -328,7 +545,7 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 	if err != nil {
 		return
 	}
-	err = conn.WaitForKey()
+	err = conn.WaitForKeyContext(ctx)
 	return
 }
 
@@ -337,6 +554,15 @@ func (f *MessengerFactory) listenForUDP() (err error) {
 	if f.udp == nil {
 		ff := factory.NewUDPFactory()
 		ff.AcceptedCallback = f.acceptedUDPCallback
+		ff.ChannelOptions = f.ChannelOptions
+		ff.RateLimit = f.RateLimit
+		ff.Bandwidth = f.Bandwidth
+		ff.MemoryLimit = f.MemoryLimit
+		ff.MaxMessageSize = f.MaxMessageSize
+		ff.IdlePolicy = f.IdlePolicy
+		ff.SocketOptions = f.SocketOptions
+		ff.ReceiverReportInterval = f.ReceiverReportInterval
+		ff.RequireCookies = f.UDPCookies
 		err = ff.Listen(":0")
 		if err != nil {
 			f.fieldsMutex.Unlock()
@@ -349,13 +575,14 @@ func (f *MessengerFactory) listenForUDP() (err error) {
 }
 
 func (f *MessengerFactory) connectUDPWithConfig(address string, config *ConnConfig) (connection *Connection, err error) {
-	f.fieldsMutex.Lock()
-	if f.udp == nil {
+	f.fieldsMutex.RLock()
+	udp := f.udp
+	f.fieldsMutex.RUnlock()
+	if udp == nil {
 		err = errors.New("udp is nil")
 		return
 	}
-	f.fieldsMutex.Unlock()
-	c, err := f.udp.ConnectAfterListen(address)
+	c, err := udp.ConnectAfterListen(address)
 	if err != nil {
 		return nil, err
 	}
@@ -369,11 +596,16 @@ func (f *MessengerFactory) connectUDPWithConfig(address string, config *ConnConf
 			connection.factory = config.Creator
 		}
 		if config.UseCrypto == RegWithKeyAndEncryptionVersion {
+			connection.compressions = config.Compressions
+			connection.compressionThreshold = config.CompressionThreshold
+			connection.cipherSuites = config.CipherSuites
+			connection.checksums = config.Checksums
+			connection.encodings = config.Encodings
 			var key cipher.PubKey
-			var secKey cipher.SecKey
-			key, secKey, err = f.loadSeedConfig(config)
+			var keys cn.KeyProvider
+			key, keys, err = f.loadSeedConfig(config)
 			if err == nil {
-				connection.SetSecKey(secKey)
+				connection.SetKeyProvider(keys)
 				if config.TargetKey != EMPATY_PUBLIC_KEY {
 					err = connection.RegWithKeys(key, config.TargetKey, config.Context)
 				} else {
@@ -387,13 +619,14 @@ func (f *MessengerFactory) connectUDPWithConfig(address string, config *ConnConf
 }
 
 func (f *MessengerFactory) acceptUDPWithConfig(address string, config *ConnConfig) (connection *Connection, err error) {
-	f.fieldsMutex.Lock()
-	if f.udp == nil {
+	f.fieldsMutex.RLock()
+	udp := f.udp
+	f.fieldsMutex.RUnlock()
+	if udp == nil {
 		err = errors.New("udp is nil")
 		return
 	}
-	f.fieldsMutex.Unlock()
-	c, err := f.udp.ConnectAfterListen(address)
+	c, err := udp.ConnectAfterListen(address)
 	if err != nil {
 		return nil, err
 	}
@@ -401,14 +634,18 @@ func (f *MessengerFactory) acceptUDPWithConfig(address string, config *ConnConfi
 		return nil, nil
 	}
 	connection = newUDPServerConnection(c, f)
-	go f.udp.AcceptedCallback(c)
+	go udp.AcceptedCallback(c)
 	connection.SetContextLogger(connection.GetContextLogger().WithField("app", "transport"))
 	return
 }
 
 func (f *MessengerFactory) Close() (err error) {
+	atomic.StoreInt32(&f.closing, 1)
 	f.fieldsMutex.RLock()
 	defer f.fieldsMutex.RUnlock()
+	if f.discoveryStore != nil {
+		defer f.discoveryStore.Close()
+	}
 	if f.factory != nil {
 		err = f.factory.Close()
 	}
@@ -418,13 +655,34 @@ func (f *MessengerFactory) Close() (err error) {
 	if f.udp != nil {
 		err = f.udp.Close()
 	}
+	if f.opScheduler != nil {
+		f.opScheduler.close()
+	}
+	if f.degradationStop != nil {
+		close(f.degradationStop)
+		f.degradationStop = nil
+	}
+	if f.federator != nil {
+		f.federator.close()
+	}
+	if f.healthStop != nil {
+		close(f.healthStop)
+		f.healthStop = nil
+	}
+	f.events.close()
 	return
 }
 
 // Execute fn for each connection that connected to server
 func (f *MessengerFactory) ForEachConn(fn func(connection *Connection)) {
-	f.factory.ForEachConn(func(conn *factory.Connection) {
-		real := conn.RealObject
+	f.fieldsMutex.RLock()
+	ff := f.factory
+	f.fieldsMutex.RUnlock()
+	if ff == nil {
+		return
+	}
+	ff.ForEachConn(func(conn *factory.Connection) {
+		real := conn.GetRealObject()
 		if real == nil {
 			return
 		}
@@ -441,6 +699,14 @@ func (f *MessengerFactory) ForEachConn(fn func(connection *Connection)) {
 
 func (f *MessengerFactory) discoveryRegister(conn *Connection, ns *NodeServices) {
 	f.serviceDiscovery.register(conn, ns)
+	f.saveServices(conn.GetKey(), ns)
+	if len(ns.Services) > 0 {
+		conn.markSetup(cn.SETUP_FIRST_SERVICES)
+	}
+	conn.expireServices(ns.TTL, func() {
+		f.discoveryUnregister(conn)
+	})
+	f.publish(Event{Type: EVENT_SERVICES_OFFERED, Key: conn.GetKey(), Conn: conn, Services: ns})
 	if f.Proxy {
 		nodeServices := f.pack()
 		f.ForEachConn(func(connection *Connection) {
@@ -450,7 +716,11 @@ func (f *MessengerFactory) discoveryRegister(conn *Connection, ns *NodeServices)
 }
 
 func (f *MessengerFactory) discoveryUnregister(conn *Connection) {
-	f.serviceDiscovery.unregister(conn)
+	if f.serviceDiscovery.unregister(conn) {
+		f.deleteStoredServices(conn.GetKey())
+		f.publish(Event{Type: EVENT_SERVICES_REMOVED, Key: conn.GetKey(), Conn: conn})
+	}
+	conn.expireServices(0, nil)
 	if f.Proxy {
 		nodeServices := f.pack()
 		f.ForEachConn(func(connection *Connection) {
@@ -459,6 +729,12 @@ func (f *MessengerFactory) discoveryUnregister(conn *Connection) {
 	}
 }
 
+// factoryLogger is the logger of the factory itself, the connections log
+// with their own
+func factoryLogger() cn.Logger {
+	return cn.WithSubsystem(cn.GetLogger(), cn.LOG_FACTORY)
+}
+
 func (f *MessengerFactory) DisableLogger() {
 	log.SetOutput(ioutil.Discard)
 }
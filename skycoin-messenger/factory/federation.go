@@ -0,0 +1,287 @@
+package factory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func init() {
+	ops[OP_FEDERATION] = &sync.Pool{
+		New: func() interface{} {
+			return new(federation)
+		},
+	}
+}
+
+const (
+	DEFAULT_FEDERATION_INTERVAL = 10 * time.Second
+	// a peer silent for this many intervals loses its nodes
+	FEDERATION_TTL_INTERVALS = 3
+	FEDERATION_DIAL_TIMEOUT  = 5 * time.Second
+)
+
+var (
+	ErrNotFederationPeer = errors.New("not a federation peer")
+	ErrNoServerSeed      = errors.New("federation needs the default seed config of the server")
+)
+
+// FederationPeer is another discovery server of the federation
+type FederationPeer struct {
+	Address string
+	// its gossip is taken only from this key
+	Key cipher.PubKey
+}
+
+// Federation of discovery servers, see MessengerFactory.Federate
+type Federation struct {
+	// every other server of the federation, each gossips the nodes offering
+	// to it and no others
+	Peers []FederationPeer
+	// how often the nodes are gossiped, DEFAULT_FEDERATION_INTERVAL if 0
+	Interval time.Duration
+}
+
+type federation struct {
+	Nodes []*federatedNode
+	// seconds the nodes hold without the next gossip, forever if 0
+	TTL int
+}
+
+type federatedNode struct {
+	Node cipher.PubKey
+	// unix nano of the offer on the server of the node
+	Time     int64
+	Services *NodeServices
+}
+
+// UnmarshalJSON drops what the op held before it came from the pool, the
+// nodes are kept by the discovery
+func (req *federation) UnmarshalJSON(data []byte) error {
+	type plain federation
+	*req = federation{}
+	return json.Unmarshal(data, (*plain)(req))
+}
+
+// run on the server the peer gossips to
+func (req *federation) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	fed := f.getFederator()
+	if fed == nil || !conn.IsKeySet() || !fed.isPeer(conn.GetKey()) {
+		err = ErrNotFederationPeer
+		return
+	}
+	origin := conn.GetKey()
+	conn.discoveryLogger().Debugf("federation gossip of %d nodes ttl %d", len(req.Nodes), req.TTL)
+	f.serviceDiscovery.federate(origin, req.Nodes)
+	fed.expire(origin, time.Duration(req.TTL)*time.Second, func() {
+		f.serviceDiscovery.federate(origin, nil)
+	})
+	return
+}
+
+// Federate gossips the services offered to f to the peers every interval and
+// takes theirs, so a client of any server of the federation finds the nodes
+// of all. Each server gossips to every other one. When a node offered to more
+// than one server the newest offer wins, so the clocks of the servers must
+// agree. The nodes of a peer are dropped once it stops gossiping
+func (f *MessengerFactory) Federate(fed Federation) error {
+	sc := f.GetDefaultSeedConfig()
+	if sc == nil {
+		return ErrNoServerSeed
+	}
+	if fed.Interval <= 0 {
+		fed.Interval = DEFAULT_FEDERATION_INTERVAL
+	}
+	r := &federator{
+		Federation: fed,
+		f:          f,
+		seed:       sc,
+		expiry:     make(map[cipher.PubKey]*time.Timer),
+		stop:       make(chan struct{}),
+	}
+	f.fieldsMutex.Lock()
+	old := f.federator
+	f.federator = r
+	f.fieldsMutex.Unlock()
+	if old != nil {
+		old.close()
+	}
+	for _, peer := range fed.Peers {
+		go r.gossipTo(peer)
+	}
+	return nil
+}
+
+func (f *MessengerFactory) getFederator() (r *federator) {
+	f.fieldsMutex.RLock()
+	r = f.federator
+	f.fieldsMutex.RUnlock()
+	return
+}
+
+type federator struct {
+	Federation
+	f    *MessengerFactory
+	seed *SeedConfig
+	// peer => drops its nodes once it stops gossiping
+	expiry      map[cipher.PubKey]*time.Timer
+	expiryMutex sync.Mutex
+	stop        chan struct{}
+	closeOnce   sync.Once
+}
+
+func (r *federator) close() {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+	})
+	r.expiryMutex.Lock()
+	for _, t := range r.expiry {
+		t.Stop()
+	}
+	r.expiryMutex.Unlock()
+}
+
+func (r *federator) isPeer(key cipher.PubKey) bool {
+	for _, peer := range r.Peers {
+		if peer.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *federator) expire(peer cipher.PubKey, ttl time.Duration, fn func()) {
+	r.expiryMutex.Lock()
+	defer r.expiryMutex.Unlock()
+	if t, ok := r.expiry[peer]; ok {
+		t.Stop()
+		delete(r.expiry, peer)
+	}
+	if ttl <= 0 {
+		return
+	}
+	r.expiry[peer] = time.AfterFunc(ttl, fn)
+}
+
+// gossip is the table sent to the peers, the TTL covers the intervals of
+// FEDERATION_TTL_INTERVALS in whole seconds
+func (r *federator) gossip() *federation {
+	ttl := FEDERATION_TTL_INTERVALS * r.Interval
+	return &federation{
+		Nodes: r.f.serviceDiscovery.offered(),
+		TTL:   int((ttl + time.Second - 1) / time.Second),
+	}
+}
+
+// gossipTo sends the table to peer every interval over a client conn of its
+// own, connected again once closed
+func (r *federator) gossipTo(peer FederationPeer) {
+	client := NewMessengerFactory()
+	defer client.Close()
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	var conn *Connection
+	for {
+		if conn == nil || conn.IsClosed() {
+			conn = r.connect(client, peer)
+		}
+		if conn != nil {
+			err := conn.writeOP(OP_FEDERATION, r.gossip())
+			if err != nil {
+				conn.GetContextLogger().Errorf("federation gossip to %s err %v", peer.Address, err)
+				conn.Close()
+				conn = nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *federator) connect(client *MessengerFactory, peer FederationPeer) (conn *Connection) {
+	ctx, cancel := context.WithTimeout(context.Background(), FEDERATION_DIAL_TIMEOUT)
+	defer cancel()
+	// the conns of the peers parse their own copy
+	seed := *r.seed
+	err := client.ConnectWithConfigContext(ctx, peer.Address, &ConnConfig{SeedConfig: &seed})
+	if err != nil {
+		factoryLogger().Errorf("federation connect to %s err %v", peer.Address, err)
+		return
+	}
+	client.ForEachConn(func(connection *Connection) {
+		if !connection.IsClosed() {
+			conn = connection
+		}
+	})
+	if conn != nil {
+		// the peer sends nothing the federation reads
+		go func() {
+			for range conn.GetChanIn() {
+			}
+		}()
+	}
+	return
+}
+
+// federate merges the nodes gossiped by origin, the newest offer of a node
+// wins. The nodes origin gossiped before and left out now are dropped
+func (sd *serviceDiscovery) federate(origin cipher.PubKey, nodes []*federatedNode) {
+	sd.subscription2SubscriberMutex.Lock()
+	defer sd.subscription2SubscriberMutex.Unlock()
+
+	gossiped := make(map[cipher.PubKey]struct{}, len(nodes))
+	for _, n := range nodes {
+		if n.Services == nil || len(n.Services.Services) < 1 {
+			continue
+		}
+		gossiped[n.Node] = struct{}{}
+		local, isLocal := sd.local[n.Node]
+		if isLocal && local.at >= n.Time {
+			continue
+		}
+		if old, ok := sd.federated[n.Node]; ok {
+			if old.origin != origin && old.at >= n.Time {
+				continue
+			}
+			sd._unregisterServices(n.Node, old.ns)
+		} else if isLocal {
+			// the node offered to origin after it offered here
+			sd._unregisterServices(n.Node, local.ns)
+		}
+		if ns, ok := sd.restored[n.Node]; ok {
+			delete(sd.restored, n.Node)
+			sd._unregisterServices(n.Node, ns)
+		}
+		sd.federated[n.Node] = &offeredServices{ns: n.Services, at: n.Time, origin: origin}
+		sd._registerServices(n.Node, n.Services)
+	}
+	for node, s := range sd.federated {
+		if _, ok := gossiped[node]; ok || s.origin != origin {
+			continue
+		}
+		delete(sd.federated, node)
+		sd._unregisterServices(node, s.ns)
+		if local, ok := sd.local[node]; ok {
+			sd._registerServices(node, local.ns)
+		}
+	}
+}
+
+// offered returns the nodes offering to this server for the peers
+func (sd *serviceDiscovery) offered() []*federatedNode {
+	sd.subscription2SubscriberMutex.RLock()
+	defer sd.subscription2SubscriberMutex.RUnlock()
+
+	nodes := make([]*federatedNode, 0, len(sd.local))
+	for node, s := range sd.local {
+		nodes = append(nodes, &federatedNode{Node: node, Time: s.at, Services: s.ns})
+	}
+	return nodes
+}
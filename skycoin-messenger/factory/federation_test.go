@@ -0,0 +1,101 @@
+package factory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFederateNewestOffer(t *testing.T) {
+	sd := newServiceDiscovery()
+	o1, o2, node := NewSeedConfig().publicKey, NewSeedConfig().publicKey, NewSeedConfig().publicKey
+	gossip := func(at int64, attr string) []*federatedNode {
+		return []*federatedNode{{Node: node, Time: at, Services: &NodeServices{Services: []*Service{{Key: node, Attributes: []string{attr}}}}}}
+	}
+	offers := func(attr string) bool {
+		return len(sd.findByAttributes(attr)[node.Hex()]) == 1
+	}
+
+	sd.federate(o1, gossip(2, "a"))
+	sd.federate(o2, gossip(1, "b"))
+	if !offers("a") || offers("b") {
+		t.Fatal("older offer won")
+	}
+	sd.federate(o2, gossip(3, "b"))
+	if offers("a") || !offers("b") {
+		t.Fatal("newer offer lost")
+	}
+	sd.federate(o2, nil)
+	if offers("b") {
+		t.Fatal("node kept after its server left it out")
+	}
+	sd.federate(o1, gossip(2, "a"))
+	if !offers("a") {
+		t.Fatal("offer of o1 not taken again")
+	}
+}
+
+func TestFederation(t *testing.T) {
+	addresses := []string{"127.0.0.1:25958", "127.0.0.1:25959"}
+	seeds := []*SeedConfig{NewSeedConfig(), NewSeedConfig()}
+	var servers []*MessengerFactory
+	for i, address := range addresses {
+		s := NewMessengerFactory()
+		s.SetDefaultSeedConfig(seeds[i])
+		if err := s.Listen(address); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	for i, s := range servers {
+		peer := FederationPeer{Address: addresses[1-i], Key: seeds[1-i].publicKey}
+		if err := s.Federate(Federation{Peers: []FederationPeer{peer}, Interval: 100 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := NewSeedConfig()
+	connect := func(address string) (f *MessengerFactory, conn *Connection) {
+		f = NewMessengerFactory()
+		if err := f.ConnectWithConfig(address, &ConnConfig{SeedConfig: sc}); err != nil {
+			t.Fatal(err)
+		}
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return
+	}
+	// every server finds attr for the node within a few gossips
+	waitFor := func(attr string) {
+		for i := 0; ; i++ {
+			if len(servers[0].findByAttributes(attr)[sc.publicKey.Hex()]) == 1 &&
+				len(servers[1].findByAttributes(attr)[sc.publicKey.Hex()]) == 1 {
+				return
+			}
+			if i > 50 {
+				t.Fatalf("servers do not agree on %s", attr)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	c1, conn1 := connect(addresses[0])
+	defer c1.Close()
+	if err := conn1.OfferService("first"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("first")
+
+	// the later offer to the other server wins on both
+	time.Sleep(10 * time.Millisecond)
+	c2, conn2 := connect(addresses[1])
+	if err := conn2.OfferService("second"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("second")
+	if len(servers[0].findByAttributes("first")) != 0 {
+		t.Fatal("older offer still found")
+	}
+
+	// and the first offer is back once the node leaves the other server
+	c2.Close()
+	waitFor("first")
+}
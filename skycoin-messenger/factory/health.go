@@ -0,0 +1,213 @@
+package factory
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_INTERVAL = 30 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = 5 * time.Second
+)
+
+// HealthCheck of the services offered to the server, see CheckHealth
+type HealthCheck struct {
+	// between the rounds, DEFAULT_HEALTH_CHECK_INTERVAL if 0
+	Interval time.Duration
+	// a probe taking longer fails, DEFAULT_HEALTH_CHECK_TIMEOUT if 0
+	Timeout time.Duration
+	// failed probes in a row that make a service unhealthy, 1 if 0
+	MaxFailures int
+}
+
+// ServiceHealth of a service offered to the server
+type ServiceHealth struct {
+	Healthy bool
+	// failed probes in a row
+	Failures int `json:",omitempty"`
+	// unix of the last probe that passed, 0 if none did
+	Passed int64 `json:",omitempty"`
+	// of the last probe that failed
+	Err string `json:",omitempty"`
+}
+
+type healthKey struct {
+	node, service cipher.PubKey
+}
+
+// CheckHealth probes the nodes offering to the server every interval until
+// it is closed: the node must answer a ping over its conn and the services
+// with a SERVICE_METADATA_TCP_ADDRESS must accept a tcp conn there. The
+// queries leave out the services that fail MaxFailures probes in a row until
+// one passes again, and return the health of the others
+func (f *MessengerFactory) CheckHealth(hc HealthCheck) {
+	if hc.Interval <= 0 {
+		hc.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	if hc.MaxFailures < 1 {
+		hc.MaxFailures = 1
+	}
+	f.fieldsMutex.Lock()
+	if f.healthStop != nil {
+		close(f.healthStop)
+	}
+	stop := make(chan struct{})
+	f.healthStop = stop
+	f.fieldsMutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			f.checkHealth(hc)
+		}
+	}()
+}
+
+// checkHealth is a round of probes
+func (f *MessengerFactory) checkHealth(hc HealthCheck) {
+	type probe struct {
+		conn *Connection
+		ns   *NodeServices
+	}
+	var probes []probe
+	f.ForEachAcceptedConnection(func(key cipher.PubKey, conn *Connection) {
+		if ns := conn.GetServices(); ns != nil && len(ns.Services) > 0 {
+			probes = append(probes, probe{conn: conn, ns: ns})
+		}
+	})
+	checked := make(map[healthKey]struct{})
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for _, p := range probes {
+		node := p.conn.GetKey()
+		for _, s := range p.ns.Services {
+			checked[healthKey{node: node, service: s.Key}] = struct{}{}
+		}
+		wg.Add(1)
+		go func(p probe) {
+			defer wg.Done()
+			results := probeServices(p.conn, p.ns, hc.Timeout)
+			mutex.Lock()
+			defer mutex.Unlock()
+			for service, err := range results {
+				f.serviceDiscovery.reportHealth(healthKey{node: node, service: service}, err, hc.MaxFailures)
+			}
+		}(p)
+	}
+	wg.Wait()
+	f.serviceDiscovery.dropHealth(checked)
+}
+
+// probeServices returns the error of the probe of each service of ns, nil if
+// it passed
+func probeServices(conn *Connection, ns *NodeServices, timeout time.Duration) map[cipher.PubKey]error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, pingErr := conn.Ping(ctx)
+	results := make(map[cipher.PubKey]error, len(ns.Services))
+	for _, s := range ns.Services {
+		address := s.Metadata[SERVICE_METADATA_TCP_ADDRESS]
+		if pingErr != nil || len(address) < 1 {
+			results[s.Key] = pingErr
+			continue
+		}
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", address)
+		if err == nil {
+			c.Close()
+		}
+		results[s.Key] = err
+	}
+	return results
+}
+
+func (sd *serviceDiscovery) reportHealth(key healthKey, err error, maxFailures int) {
+	sd.subscription2SubscriberMutex.Lock()
+	defer sd.subscription2SubscriberMutex.Unlock()
+	h, ok := sd.health[key]
+	if !ok {
+		h = &ServiceHealth{}
+		sd.health[key] = h
+	}
+	if err != nil {
+		h.Failures++
+		h.Err = err.Error()
+	} else {
+		h.Failures = 0
+		h.Err = ""
+		h.Passed = time.Now().Unix()
+	}
+	h.Healthy = h.Failures < maxFailures
+}
+
+// dropHealth forgets the services not checked in the last round
+func (sd *serviceDiscovery) dropHealth(checked map[healthKey]struct{}) {
+	sd.subscription2SubscriberMutex.Lock()
+	defer sd.subscription2SubscriberMutex.Unlock()
+	for key := range sd.health {
+		if _, ok := checked[key]; !ok {
+			delete(sd.health, key)
+		}
+	}
+}
+
+// _unhealthy reports whether service of node failed its last probes, the
+// ones not checked yet are healthy
+func (sd *serviceDiscovery) _unhealthy(node, service cipher.PubKey) bool {
+	h, ok := sd.health[healthKey{node: node, service: service}]
+	return ok && !h.Healthy
+}
+
+// _health returns a copy of the health of service of node, nil if not checked
+func (sd *serviceDiscovery) _health(node, service cipher.PubKey) *ServiceHealth {
+	h, ok := sd.health[healthKey{node: node, service: service}]
+	if !ok {
+		return nil
+	}
+	r := *h
+	return &r
+}
+
+// findHealth returns the health of the services in nodes, a result of
+// findByAttributes, by node and service key
+func (sd *serviceDiscovery) findHealth(nodes map[string][]cipher.PubKey) map[string]map[string]*ServiceHealth {
+	sd.subscription2SubscriberMutex.RLock()
+	defer sd.subscription2SubscriberMutex.RUnlock()
+
+	if len(sd.health) < 1 {
+		return nil
+	}
+	var result map[string]map[string]*ServiceHealth
+	for node, keys := range nodes {
+		nodeKey, err := cipher.PubKeyFromHex(node)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			h := sd._health(nodeKey, key)
+			if h == nil {
+				continue
+			}
+			if result == nil {
+				result = make(map[string]map[string]*ServiceHealth)
+			}
+			if result[node] == nil {
+				result[node] = make(map[string]*ServiceHealth)
+			}
+			result[node][key.Hex()] = h
+		}
+	}
+	return result
+}
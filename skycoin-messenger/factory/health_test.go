@@ -0,0 +1,71 @@
+package factory
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25962"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.CheckHealth(HealthCheck{Interval: 50 * time.Millisecond, Timeout: time.Second, MaxFailures: 2})
+
+	// the address of the service, nothing listens there yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	sc := NewSeedConfig()
+	c := NewMessengerFactory()
+	if err := c.ConnectWithConfig("127.0.0.1:25962", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var conn *Connection
+	c.ForEachConn(func(connection *Connection) { conn = connection })
+	err = conn.UpdateServices(&NodeServices{Services: []*Service{{
+		Key:        sc.publicKey,
+		Attributes: []string{"health"},
+		Metadata:   ServiceMetadata{SERVICE_METADATA_TCP_ADDRESS: address},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := func() bool {
+		return len(s.findByAttributes("health")[sc.publicKey.Hex()]) == 1
+	}
+	waitFor := func(want bool) {
+		for i := 0; found() != want; i++ {
+			if i > 100 {
+				t.Fatalf("found %v", !want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	// found until it fails the probes
+	waitFor(true)
+	waitFor(false)
+
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	waitFor(true)
+	h := s.findHealth(s.findByAttributes("health"))[sc.publicKey.Hex()][sc.publicKey.Hex()]
+	if h == nil || !h.Healthy || h.Passed == 0 || h.Failures != 0 {
+		t.Fatalf("health %#v", h)
+	}
+	info := s._findServiceAddress(sc.publicKey, EMPATY_PUBLIC_KEY)
+	if len(info) != 1 || info[0].Health == nil {
+		t.Fatal("no health of the node of the service")
+	}
+}
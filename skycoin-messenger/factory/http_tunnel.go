@@ -0,0 +1,53 @@
+package factory
+
+import (
+	"errors"
+	"net"
+)
+
+// attribute of the services of HTTPTunnels
+const HTTP_TUNNEL_ATTR = "http"
+
+var ErrTunnelNodeUnknown = errors.New("node key of the conn is unknown, connect with ConnConfig.TargetKey")
+
+// HTTPTunnel exposes a local http server through the node of an app conn,
+// the node forwards each transport to the service to a new conn to Local
+type HTTPTunnel struct {
+	// the local server, the node dials it so it has to be reachable from there
+	Local string
+	// node:app, see AppDialer
+	Public string
+
+	conn *Connection
+}
+
+// ExposeHTTP offers the http server at local with attrs as a service of the
+// node, which reports Public of the tunnel to the manager
+func (c *Connection) ExposeHTTP(local string, attrs ...string) (t *HTTPTunnel, err error) {
+	_, _, err = net.SplitHostPort(local)
+	if err != nil {
+		return
+	}
+	node := c.GetTargetKey()
+	if node == EMPATY_PUBLIC_KEY {
+		err = ErrTunnelNodeUnknown
+		return
+	}
+	app := c.GetKey()
+	t = &HTTPTunnel{Local: local, Public: node.Hex() + ":" + app.Hex(), conn: c}
+	err = c.UpdateServices(&NodeServices{Services: []*Service{{
+		Key:           app,
+		Attributes:    append([]string{HTTP_TUNNEL_ATTR}, attrs...),
+		Address:       local,
+		PublicAddress: t.Public,
+	}}})
+	if err != nil {
+		t = nil
+	}
+	return
+}
+
+// Close withdraws the service of the tunnel
+func (t *HTTPTunnel) Close() error {
+	return t.conn.UpdateServices(nil)
+}
@@ -0,0 +1,74 @@
+package factory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExposeHTTP(t *testing.T) {
+	nsc := NewSeedConfig()
+	s := NewMessengerFactory()
+	s.Proxy = true
+	s.SetDefaultSeedConfig(nsc)
+	if err := s.Listen("127.0.0.1:25948"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewMessengerFactory()
+	defer c.Close()
+	if err := c.ConnectWithConfig("127.0.0.1:25948", &ConnConfig{SeedConfig: NewSeedConfig()}); err != nil {
+		t.Fatal(err)
+	}
+	var app *Connection
+	c.ForEachConn(func(conn *Connection) { app = conn })
+	if _, err := app.ExposeHTTP("127.0.0.1:8080"); err != ErrTunnelNodeUnknown {
+		t.Fatalf("expose without node key err %v", err)
+	}
+
+	c = NewMessengerFactory()
+	defer c.Close()
+	if err := c.ConnectWithConfig("127.0.0.1:25948", &ConnConfig{SeedConfig: NewSeedConfig(), TargetKey: nsc.publicKey}); err != nil {
+		t.Fatal(err)
+	}
+	c.ForEachConn(func(conn *Connection) { app = conn })
+	if _, err := app.ExposeHTTP("8080"); err == nil {
+		t.Fatal("expose without a port")
+	}
+	tunnel, err := app.ExposeHTTP("127.0.0.1:8080", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Public != nsc.publicKey.Hex()+":"+app.GetKey().Hex() {
+		t.Fatalf("public %s", tunnel.Public)
+	}
+
+	// what the node reports to the manager
+	public := func() string {
+		ns := s.pack()
+		if ns == nil {
+			return ""
+		}
+		for _, service := range ns.Services {
+			if service.Key == app.GetKey() {
+				return service.PublicAddress
+			}
+		}
+		return ""
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for public() != tunnel.Public {
+		if time.Now().After(deadline) {
+			t.Fatalf("reported %q want %q", public(), tunnel.Public)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for public() != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("reported %q after close", public())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,164 @@
+package factory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+var ErrServerKeyChanged = cn.NewError(cn.ErrUnauthorized, "server key differs from the pinned one")
+
+// KeyPins are the keys of the servers the clients of a factory connect to by
+// address, see MessengerFactory.KeyPins. A server without a pin is trusted
+// on its first connect and pinned, later connects to the address are refused
+// if it presents another key until Pin or Unpin
+type KeyPins struct {
+	// the pins are written here if not empty
+	path string
+	pins map[string]cipher.PubKey
+	sync.Mutex
+}
+
+// NewKeyPins keeps the pins in memory
+func NewKeyPins() *KeyPins {
+	return &KeyPins{pins: make(map[string]cipher.PubKey)}
+}
+
+// LoadKeyPins reads the pins of path, none if it does not exist yet, and
+// writes them there on every change
+func LoadKeyPins(path string) (p *KeyPins, err error) {
+	p = NewKeyPins()
+	p.path = path
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			p = nil
+		}
+		return
+	}
+	var pins map[string]string
+	err = json.Unmarshal(b, &pins)
+	if err != nil {
+		p = nil
+		return
+	}
+	for address, hex := range pins {
+		var key cipher.PubKey
+		key, err = cipher.PubKeyFromHex(hex)
+		if err != nil {
+			p = nil
+			return
+		}
+		p.pins[address] = key
+	}
+	return
+}
+
+// Pin sets the key of the server at address, before its first connect or
+// to accept the new key of a server that changed it
+func (p *KeyPins) Pin(address string, key cipher.PubKey) error {
+	p.Lock()
+	defer p.Unlock()
+	p.pins[address] = key
+	return p.save()
+}
+
+// Unpin forgets the key of the server at address, the next connect pins the
+// key it presents
+func (p *KeyPins) Unpin(address string) error {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.pins, address)
+	return p.save()
+}
+
+// Get returns the key pinned for address
+func (p *KeyPins) Get(address string) (key cipher.PubKey, ok bool) {
+	p.Lock()
+	key, ok = p.pins[address]
+	p.Unlock()
+	return
+}
+
+// check returns the pin of address and ErrServerKeyChanged if key is another
+// one, key is pinned if pin and address has no pin yet
+func (p *KeyPins) check(address string, key cipher.PubKey, pin bool) (pinned cipher.PubKey, err error) {
+	p.Lock()
+	defer p.Unlock()
+	pinned, ok := p.pins[address]
+	if !ok {
+		if !pin {
+			return key, nil
+		}
+		p.pins[address] = key
+		return key, p.save()
+	}
+	if pinned != key {
+		err = ErrServerKeyChanged
+	}
+	return
+}
+
+func (p *KeyPins) save() error {
+	if len(p.path) < 1 {
+		return nil
+	}
+	pins := make(map[string]string, len(p.pins))
+	for address, key := range p.pins {
+		pins[address] = key.Hex()
+	}
+	b, err := json.Marshal(pins)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p.path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.path, b, 0600)
+}
+
+// checkServerKey refuses the server of the conn if its key is not the one
+// pinned for the address the conn connected to. The key is pinned if pin,
+// once the reg with it completed
+func (c *Connection) checkServerKey(key cipher.PubKey, pin bool) error {
+	pins := c.factory.KeyPins
+	address := c.getServerAddress()
+	if pins == nil || len(address) < 1 {
+		return nil
+	}
+	pinned, err := pins.check(address, key, pin)
+	if err == ErrServerKeyChanged {
+		c.GetContextLogger().Errorf("server %s presented key %s, pinned %s", address, key.Hex(), pinned.Hex())
+		c.factory.publish(Event{Type: EVENT_SERVER_KEY_CHANGED, Key: key, Peer: pinned, Conn: c})
+		c.setRegErr(err)
+	}
+	return err
+}
+
+func (c *Connection) getServerAddress() (address string) {
+	c.fieldsMutex.RLock()
+	address = c.serverAddress
+	c.fieldsMutex.RUnlock()
+	return
+}
+
+func (c *Connection) setRegErr(err error) {
+	c.fieldsMutex.Lock()
+	c.regErr = err
+	c.fieldsMutex.Unlock()
+}
+
+func (c *Connection) getRegErr() (err error) {
+	c.fieldsMutex.RLock()
+	err = c.regErr
+	c.fieldsMutex.RUnlock()
+	return
+}
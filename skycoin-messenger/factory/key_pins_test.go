@@ -0,0 +1,110 @@
+package factory
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyPins(t *testing.T) {
+	const address = "127.0.0.1:25964"
+	listen := func() *MessengerFactory {
+		s := NewMessengerFactory()
+		s.SetDefaultSeedConfig(NewSeedConfig())
+		if err := s.Listen(address); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	path := filepath.Join(t.TempDir(), "pins.json")
+	pins, err := LoadKeyPins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewMessengerFactory()
+	c.KeyPins = pins
+	defer c.Close()
+	sub := c.Subscribe(0, EVENT_SERVER_KEY_CHANGED)
+	config := &ConnConfig{SeedConfig: NewSeedConfig()}
+
+	s := listen()
+	defer s.Close()
+	if err := c.ConnectWithConfig(address, config); err != nil {
+		t.Fatal(err)
+	}
+	first := s.GetDefaultSeedConfig().publicKey
+	if key, ok := pins.Get(address); !ok || key != first {
+		t.Fatal("key not pinned on the first connect")
+	}
+	s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// another server at the address
+	s = listen()
+	defer s.Close()
+	if err := c.ConnectWithConfig(address, config); !errors.Is(err, ErrServerKeyChanged) {
+		t.Fatalf("connect to a changed key err %v", err)
+	}
+	select {
+	case e := <-sub.C:
+		if e.Key != s.GetDefaultSeedConfig().publicKey || e.Peer != first {
+			t.Fatal("event of the wrong keys")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event of the changed key")
+	}
+
+	// the pins survive a restart of the client, the override takes the new key
+	pins, err = LoadKeyPins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := pins.Get(address); key != first {
+		t.Fatal("pin not saved")
+	}
+	if err := pins.Pin(address, s.GetDefaultSeedConfig().publicKey); err != nil {
+		t.Fatal(err)
+	}
+	c.KeyPins = pins
+	if err := c.ConnectWithConfig(address, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyPinsFirstConnectImpostor(t *testing.T) {
+	const address = "127.0.0.1:25990"
+	listen := func(sc *SeedConfig) *MessengerFactory {
+		s := NewMessengerFactory()
+		s.SetDefaultSeedConfig(sc)
+		if err := s.Listen(address); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	pins := NewKeyPins()
+	c := NewMessengerFactory()
+	c.KeyPins = pins
+	defer c.Close()
+	genuine := NewSeedConfig()
+	config := &ConnConfig{SeedConfig: NewSeedConfig(), TargetKey: genuine.publicKey, UseCrypto: RegWithKeyAndEncryptionVersion}
+
+	impostor := NewSeedConfig()
+	s := listen(impostor)
+	c.ConnectWithConfig(address, config)
+	time.Sleep(100 * time.Millisecond)
+	if key, ok := pins.Get(address); ok && key != genuine.publicKey {
+		t.Fatal("key of the impostor pinned")
+	}
+	s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	s = listen(genuine)
+	defer s.Close()
+	if err := c.ConnectWithConfig(address, config); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := pins.Get(address); !ok || key != genuine.publicKey {
+		t.Fatal("key of the server not pinned")
+	}
+}
@@ -0,0 +1,52 @@
+package factory
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/skycoin/net/conn"
+)
+
+// KeyStore opens the key at uri, e.g. pkcs11:token=node;object=key or
+// tpm:0x81000001. The key stays in the store, signing at reg and the key
+// agreement of the crypto are done by the returned provider
+type KeyStore func(uri string) (conn.KeyProvider, error)
+
+var (
+	keyStores      = make(map[string]KeyStore)
+	keyStoresMutex sync.RWMutex
+)
+
+// RegisterKeyStore makes the uris starting with scheme: usable as SeedConfig.KeyStore.
+// Like sql.Register it panics if the scheme is registered twice
+func RegisterKeyStore(scheme string, store KeyStore) {
+	if store == nil {
+		panic("factory: RegisterKeyStore store is nil")
+	}
+	keyStoresMutex.Lock()
+	defer keyStoresMutex.Unlock()
+	if _, ok := keyStores[scheme]; ok {
+		panic(fmt.Sprintf("factory: RegisterKeyStore called twice for scheme %s", scheme))
+	}
+	keyStores[scheme] = store
+}
+
+// OpenKeyStore opens uri with the key store registered for its scheme
+func OpenKeyStore(uri string) (conn.KeyProvider, error) {
+	i := strings.IndexByte(uri, ':')
+	if i < 1 {
+		return nil, fmt.Errorf("invalid key store uri %s", uri)
+	}
+	keyStoresMutex.RLock()
+	store, ok := keyStores[uri[:i]]
+	keyStoresMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key store %s", uri[:i])
+	}
+	keys, err := store(uri)
+	if err == nil && keys == nil {
+		err = fmt.Errorf("key store %s returned no key", uri[:i])
+	}
+	return keys, err
+}
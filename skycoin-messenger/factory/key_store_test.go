@@ -0,0 +1,101 @@
+package factory
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// tokenKey counts what the key store was asked to do with the key
+type tokenKey struct {
+	conn.KeyProvider
+	signs, ecdhs int32
+}
+
+func (k *tokenKey) SignHash(hash cipher.SHA256) (cipher.Sig, error) {
+	atomic.AddInt32(&k.signs, 1)
+	return k.KeyProvider.SignHash(hash)
+}
+
+func (k *tokenKey) ECDH(target cipher.PubKey) ([]byte, error) {
+	atomic.AddInt32(&k.ecdhs, 1)
+	return k.KeyProvider.ECDH(target)
+}
+
+var tokenKeys = map[string]*tokenKey{}
+
+func init() {
+	for _, name := range []string{"server", "client"} {
+		pk, sk := cipher.GenerateKeyPair()
+		tokenKeys["token:"+name] = &tokenKey{KeyProvider: conn.NewSecKeyProvider(pk, sk)}
+	}
+	RegisterKeyStore("token", func(uri string) (conn.KeyProvider, error) {
+		k, ok := tokenKeys[uri]
+		if !ok {
+			return nil, errors.New("no such key")
+		}
+		return k, nil
+	})
+}
+
+func TestKeyStore(t *testing.T) {
+	if _, err := OpenKeyStore("token:missing"); err == nil {
+		t.Fatal("opened a missing key")
+	}
+	if _, err := OpenKeyStore("nokeystore"); err == nil {
+		t.Fatal("opened an uri without scheme")
+	}
+
+	ssc, err := NewSeedConfigWithKeyStore("token:server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(ssc)
+	if err := s.Listen("127.0.0.1:25943"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	csc, err := NewSeedConfigWithKeyStore("token:client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(csc.SecKey) > 0 || len(csc.Seed) > 0 {
+		t.Fatalf("secret in seed config %#v", csc)
+	}
+	c := NewMessengerFactory()
+	defer c.Close()
+	err = c.ConnectWithConfig("127.0.0.1:25943", &ConnConfig{
+		SeedConfig:   csc,
+		UseCrypto:    RegWithKeyAndEncryptionVersion,
+		CipherSuites: conn.SupportedCipherSuites(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.GetConnection(csc.publicKey); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client, server := tokenKeys["token:client"], tokenKeys["token:server"]
+	if atomic.LoadInt32(&client.signs) < 1 || atomic.LoadInt32(&client.ecdhs) < 1 || atomic.LoadInt32(&server.ecdhs) < 1 {
+		t.Fatalf("client signs %d ecdhs %d, server ecdhs %d", client.signs, client.ecdhs, server.ecdhs)
+	}
+
+	csc.PublicKey = ssc.PublicKey
+	csc.keys = nil
+	if err := csc.parse(); err == nil {
+		t.Fatal("parsed a seed config of another key")
+	}
+}
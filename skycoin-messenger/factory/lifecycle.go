@@ -0,0 +1,227 @@
+package factory
+
+import (
+	"sync"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+const (
+	// first wait between two attempts of a lifecycle step
+	DEFAULT_RETRY_WAIT = time.Second
+	// the wait doubles after every failed attempt up to this
+	MAX_RETRY_WAIT = 30 * time.Second
+)
+
+// Discovery is a discovery server the node stays connected to
+type Discovery struct {
+	Address string
+	// of the connection, the callbacks are called after the ones of the
+	// lifecycle and Reconnect is ignored, the lifecycle reconnects
+	Config *ConnConfig
+}
+
+// Lifecycle brings a node up in order: the listener first, then the discovery
+// connections, then the services, offered on each connection once its key is
+// set. Failed steps are retried with backoff until Stop, lost discovery
+// connections are connected again and offered the services again
+type Lifecycle struct {
+	Factory *MessengerFactory
+	// address of Factory.Listen, nothing is listened on if empty
+	ListenAddress string
+	Discoveries   []Discovery
+	// offered to every discovery server, a service without a key gets the key of the node
+	Services *NodeServices
+	// DEFAULT_RETRY_WAIT if 0
+	RetryWait time.Duration
+
+	pending int
+	ready   chan struct{}
+	done    chan struct{}
+	started bool
+	stopped bool
+	mutex   sync.Mutex
+}
+
+// Start runs the steps in the background, see Ready
+func (l *Lifecycle) Start() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.started {
+		return
+	}
+	l.started = true
+	l.init()
+	l.pending = len(l.Discoveries)
+	if len(l.ListenAddress) > 0 {
+		l.pending++
+	}
+	if l.pending == 0 {
+		close(l.ready)
+	}
+	go l.run()
+}
+
+// init must be called with the lock held
+func (l *Lifecycle) init() {
+	if l.ready == nil {
+		l.ready = make(chan struct{})
+		l.done = make(chan struct{})
+	}
+}
+
+// Ready is closed once the listener is up and every discovery server was
+// offered the services at least once
+func (l *Lifecycle) Ready() <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.init()
+	return l.ready
+}
+
+// IsReady reports whether Ready is closed
+func (l *Lifecycle) IsReady() bool {
+	select {
+	case <-l.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop ends the retries and reconnects, the connections and the listener are
+// left to Factory.Close
+func (l *Lifecycle) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.init()
+	if !l.stopped {
+		l.stopped = true
+		close(l.done)
+	}
+}
+
+func (l *Lifecycle) stepDone() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pending--
+	if l.pending == 0 {
+		close(l.ready)
+	}
+}
+
+// sleep waits before the next attempt, false if stopped first
+func (l *Lifecycle) sleep(wait *time.Duration) bool {
+	t := time.NewTimer(*wait)
+	defer t.Stop()
+	*wait *= 2
+	if *wait > MAX_RETRY_WAIT {
+		*wait = MAX_RETRY_WAIT
+	}
+	select {
+	case <-t.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *Lifecycle) retryWait() time.Duration {
+	if l.RetryWait > 0 {
+		return l.RetryWait
+	}
+	return DEFAULT_RETRY_WAIT
+}
+
+func (l *Lifecycle) run() {
+	if len(l.ListenAddress) > 0 {
+		wait := l.retryWait()
+		for {
+			err := l.Factory.Listen(l.ListenAddress)
+			if err == nil {
+				break
+			}
+			cn.GetLogger().Errorf("lifecycle listen %s err %v", l.ListenAddress, err)
+			if !l.sleep(&wait) {
+				return
+			}
+		}
+		l.stepDone()
+	}
+	for i := range l.Discoveries {
+		go l.keepConnected(l.Discoveries[i])
+	}
+}
+
+// keepConnected connects to d again whenever the connection is lost
+func (l *Lifecycle) keepConnected(d Discovery) {
+	var ready sync.Once
+	wait := l.retryWait()
+	for {
+		var config ConnConfig
+		if d.Config != nil {
+			config = *d.Config
+		}
+		config.Reconnect = false
+		onConnected, onDisconnected := config.OnConnected, config.OnDisconnected
+		closed := make(chan struct{})
+		var closedOnce sync.Once
+		config.OnConnected = func(connection *Connection) {
+			go l.offer(connection, func() { ready.Do(l.stepDone) })
+			if onConnected != nil {
+				onConnected(connection)
+			}
+		}
+		config.OnDisconnected = func(connection *Connection) {
+			closedOnce.Do(func() { close(closed) })
+			if onDisconnected != nil {
+				onDisconnected(connection)
+			}
+		}
+
+		err := l.Factory.ConnectWithConfig(d.Address, &config)
+		if err == nil {
+			wait = l.retryWait()
+			select {
+			case <-closed:
+			case <-l.done:
+				return
+			}
+		} else {
+			cn.GetLogger().Errorf("lifecycle connect %s err %v", d.Address, err)
+		}
+		if !l.sleep(&wait) {
+			return
+		}
+	}
+}
+
+// offer offers the services on connection, whose key is set
+func (l *Lifecycle) offer(connection *Connection, ready func()) {
+	if l.Services == nil {
+		ready()
+		return
+	}
+	key := connection.GetKey()
+	ns := &NodeServices{ServiceAddress: l.Services.ServiceAddress}
+	for _, s := range l.Services.Services {
+		service := *s
+		if service.Key == EMPATY_PUBLIC_KEY {
+			service.Key = key
+		}
+		ns.Services = append(ns.Services, &service)
+	}
+	wait := l.retryWait()
+	for {
+		err := connection.UpdateServices(ns)
+		if err == nil {
+			ready()
+			return
+		}
+		connection.GetContextLogger().Errorf("lifecycle offer services err %v", err)
+		if connection.IsClosed() || !l.sleep(&wait) {
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package factory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	sc := NewSeedConfig()
+	key := sc.publicKey
+	c := NewMessengerFactory()
+	defer c.Close()
+	l := &Lifecycle{
+		Factory:     c,
+		Discoveries: []Discovery{{Address: "127.0.0.1:25944", Config: &ConnConfig{SeedConfig: sc}}},
+		Services:    &NodeServices{Services: []*Service{{Attributes: []string{"lifecycle"}}}},
+		RetryWait:   20 * time.Millisecond,
+	}
+	defer l.Stop()
+	l.Start()
+
+	// the server comes up late, the connect is retried
+	time.Sleep(50 * time.Millisecond)
+	if l.IsReady() {
+		t.Fatal("ready without server")
+	}
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25944"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	select {
+	case <-l.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready")
+	}
+	found := func() bool {
+		nodes := s.findByAttributes("lifecycle")
+		return len(nodes) == 1 && len(nodes[key.Hex()]) == 1
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !found() {
+		if time.Now().After(deadline) {
+			t.Fatalf("service not found %v", s.findByAttributes("lifecycle"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a lost connection is connected again and offered the services again
+	conn, ok := s.GetConnection(key)
+	if !ok {
+		t.Fatal("client not registered")
+	}
+	conn.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if again, ok := s.GetConnection(key); ok && again != conn && found() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not connected again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,40 @@
+package factory
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/skycoin/net/factory"
+)
+
+// MetricsHandler serves the statistics of the tcp and udp connections of the
+// factory in the Prometheus text format
+func (f *MessengerFactory) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fs []factory.Factory
+		f.fieldsMutex.RLock()
+		if f.factory != nil {
+			fs = append(fs, f.factory)
+		}
+		if f.udp != nil {
+			fs = append(fs, f.udp)
+		}
+		f.fieldsMutex.RUnlock()
+		factory.MetricsHandler(fs...).ServeHTTP(w, r)
+		if f.RegLimits != nil {
+			writeRegLimitMetrics(w, f.RegLimits.Stats())
+		}
+	})
+}
+
+func writeRegLimitMetrics(w http.ResponseWriter, s RegLimitStats) {
+	const prefix = "skycoin_net_"
+	fmt.Fprintf(w, "# HELP %sreg_ops_total Reg and query ops of the clients checked against the reg limits.\n# TYPE %sreg_ops_total counter\n", prefix, prefix)
+	fmt.Fprintf(w, "%sreg_ops_total{op=\"reg\"} %d\n", prefix, s.Regs)
+	fmt.Fprintf(w, "%sreg_ops_total{op=\"query\"} %d\n", prefix, s.Queries)
+	fmt.Fprintf(w, "# HELP %sreg_ops_limited_total Reg and query ops over a reg limit.\n# TYPE %sreg_ops_limited_total counter\n", prefix, prefix)
+	fmt.Fprintf(w, "%sreg_ops_limited_total{op=\"reg\",by=\"ip\"} %d\n", prefix, s.RegsLimitedByIP)
+	fmt.Fprintf(w, "%sreg_ops_limited_total{op=\"reg\",by=\"key\"} %d\n", prefix, s.RegsLimitedByKey)
+	fmt.Fprintf(w, "%sreg_ops_limited_total{op=\"query\",by=\"ip\"} %d\n", prefix, s.QueriesLimitedByIP)
+	fmt.Fprintf(w, "%sreg_ops_limited_total{op=\"query\",by=\"key\"} %d\n", prefix, s.QueriesLimitedByKey)
+}
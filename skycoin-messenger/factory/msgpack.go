@@ -0,0 +1,872 @@
+package factory
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// the subset of msgpack (https://msgpack.org) the ops are encoded with when
+// ENCODING_MSGPACK is negotiated. Structs are maps named like encoding/json
+// names their fields, json tags and embedded structs included, byte slices
+// and arrays are bin and text marshalers are str
+
+var (
+	ErrMsgpackShort = errors.New("msgpack: unexpected end of data")
+	ErrMsgpackType  = errors.New("msgpack: unexpected type")
+	ErrMsgpackRange = errors.New("msgpack: number out of range")
+
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+const (
+	msgpackNil     = 0xc0
+	msgpackFalse   = 0xc2
+	msgpackTrue    = 0xc3
+	msgpackBin8    = 0xc4
+	msgpackBin16   = 0xc5
+	msgpackBin32   = 0xc6
+	msgpackFloat32 = 0xca
+	msgpackFloat64 = 0xcb
+	msgpackUint8   = 0xcc
+	msgpackUint16  = 0xcd
+	msgpackUint32  = 0xce
+	msgpackUint64  = 0xcf
+	msgpackInt8    = 0xd0
+	msgpackInt16   = 0xd1
+	msgpackInt32   = 0xd2
+	msgpackInt64   = 0xd3
+	msgpackStr8    = 0xd9
+	msgpackStr16   = 0xda
+	msgpackStr32   = 0xdb
+	msgpackArray16 = 0xdc
+	msgpackArray32 = 0xdd
+	msgpackMap16   = 0xde
+	msgpackMap32   = 0xdf
+)
+
+// msgpackOP is implemented by the ops whose UnmarshalJSON does more than
+// resetting the op, the decoder calls it instead of filling the fields
+type msgpackOP interface {
+	unmarshalMsgpack(data []byte) error
+}
+
+// marshalMsgpack encodes v, the bodies of ops are maps
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{buf: make([]byte, 0, 128)}
+	err := e.encode(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// unmarshalMsgpack decodes data into the pointer v. A struct is zeroed
+// first, so a pooled op needs no reset of what it held before
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	if op, ok := v.(msgpackOP); ok {
+		return op.unmarshalMsgpack(data)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("msgpack: decode into a non pointer")
+	}
+	if rv.Elem().Kind() == reflect.Struct {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
+	d := &msgpackDecoder{data: data}
+	return d.decode(rv.Elem())
+}
+
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type msgpackStruct struct {
+	fields []msgpackField
+	byName map[string]int
+}
+
+// reflect.Type -> *msgpackStruct
+var msgpackStructs sync.Map
+
+func msgpackStructOf(t reflect.Type) *msgpackStruct {
+	if s, ok := msgpackStructs.Load(t); ok {
+		return s.(*msgpackStruct)
+	}
+	s := &msgpackStruct{byName: make(map[string]int)}
+	s.collect(t, nil)
+	msgpackStructs.Store(t, s)
+	return s
+}
+
+// collect adds the fields of t, the fields of its embedded structs after
+// its own ones so the outer ones win like in encoding/json
+func (s *msgpackStruct) collect(t reflect.Type, index []int) {
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.IndexByte(tag, ','); i >= 0 {
+			name, opts = tag[:i], tag[i:]
+		}
+		if sf.Anonymous {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if name == "" && ft.Kind() == reflect.Struct {
+				embedded = append(embedded, sf)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if _, ok := s.byName[name]; ok {
+			continue
+		}
+		s.byName[name] = len(s.fields)
+		s.fields = append(s.fields, msgpackField{
+			name:      name,
+			index:     append(append([]int(nil), index...), i),
+			omitEmpty: strings.Contains(opts, ",omitempty"),
+		})
+	}
+	for _, sf := range embedded {
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		s.collect(ft, append(append([]int(nil), index...), sf.Index[0]))
+	}
+}
+
+// field returns the field f of v, invalid if an embedded pointer on the way
+// is nil
+func (f *msgpackField) field(v reflect.Value) reflect.Value {
+	for i, x := range f.index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// fieldAlloc is field for the decoder, it makes the embedded pointers
+func (f *msgpackField) fieldAlloc(v reflect.Value) reflect.Value {
+	for i, x := range f.index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, msgpackNil)
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.writeString(string(text))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, msgpackTrue)
+		} else {
+			e.buf = append(e.buf, msgpackFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, msgpackFloat32)
+		e.buf = appendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, msgpackFloat64)
+		e.buf = appendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, msgpackNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBin(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBinHeader(v.Len())
+			for i := 0; i < v.Len(); i++ {
+				e.buf = append(e.buf, byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, msgpackNil)
+			return nil
+		}
+		e.writeHeader(v.Len(), 0x80, msgpackMap16, msgpackMap32)
+		for _, k := range v.MapKeys() {
+			switch k.Kind() {
+			case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			default:
+				return errors.New("msgpack: unsupported map key " + k.Type().String())
+			}
+			err := e.encode(k)
+			if err != nil {
+				return err
+			}
+			err = e.encode(v.MapIndex(k))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, msgpackNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Struct:
+		s := msgpackStructOf(v.Type())
+		values := make([]reflect.Value, len(s.fields))
+		n := 0
+		for i := range s.fields {
+			fv := s.fields[i].field(v)
+			if !fv.IsValid() || s.fields[i].omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			values[i] = fv
+			n++
+		}
+		e.writeHeader(n, 0x80, msgpackMap16, msgpackMap32)
+		for i, fv := range values {
+			if !fv.IsValid() {
+				continue
+			}
+			e.writeString(s.fields[i].name)
+			err := e.encode(fv)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("msgpack: unsupported type " + v.Type().String())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	e.writeHeader(v.Len(), 0x90, msgpackArray16, msgpackArray32)
+	for i := 0; i < v.Len(); i++ {
+		err := e.encode(v.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.writeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, msgpackInt8, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, msgpackInt16, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, msgpackInt32)
+		e.buf = appendUint32(e.buf, uint32(i))
+	default:
+		e.buf = append(e.buf, msgpackInt64)
+		e.buf = appendUint64(e.buf, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) writeUint(u uint64) {
+	switch {
+	case u < 0x80:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, msgpackUint8, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, msgpackUint16, byte(u>>8), byte(u))
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, msgpackUint32)
+		e.buf = appendUint32(e.buf, uint32(u))
+	default:
+		e.buf = append(e.buf, msgpackUint64)
+		e.buf = appendUint64(e.buf, u)
+	}
+}
+
+func (e *msgpackEncoder) writeString(s string) {
+	if len(s) < 32 {
+		e.buf = append(e.buf, 0xa0|byte(len(s)))
+	} else {
+		e.writeLen(len(s), msgpackStr8, msgpackStr16, msgpackStr32)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) writeBin(b []byte) {
+	e.writeBinHeader(len(b))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) writeBinHeader(n int) {
+	e.writeLen(n, msgpackBin8, msgpackBin16, msgpackBin32)
+}
+
+// writeHeader writes the header of a map or an array of n items
+func (e *msgpackEncoder) writeHeader(n int, fix, c16, c32 byte) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, c16, byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, c32)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) writeLen(n int, c8, c16, c32 byte) {
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, c8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, c16, byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, c32)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, ErrMsgpackShort
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	b, err := d.peek()
+	if err == nil {
+		d.pos++
+	}
+	return b, err
+}
+
+// readUintN reads an unsigned big endian number of n bytes
+func (d *msgpackDecoder) readUintN(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// readInteger reads any int or uint, the bits of an int64 if neg
+func (d *msgpackDecoder) readInteger() (v uint64, neg bool, err error) {
+	c, err := d.readByte()
+	if err != nil {
+		return
+	}
+	switch {
+	case c < 0x80:
+		return uint64(c), false, nil
+	case c >= 0xe0:
+		return uint64(int64(int8(c))), true, nil
+	}
+	switch c {
+	case msgpackUint8, msgpackUint16, msgpackUint32, msgpackUint64:
+		v, err = d.readUintN(1 << (c - msgpackUint8))
+		return
+	case msgpackInt8:
+		v, err = d.readUintN(1)
+		v = uint64(int64(int8(v)))
+	case msgpackInt16:
+		v, err = d.readUintN(2)
+		v = uint64(int64(int16(v)))
+	case msgpackInt32:
+		v, err = d.readUintN(4)
+		v = uint64(int64(int32(v)))
+	case msgpackInt64:
+		v, err = d.readUintN(8)
+	default:
+		// not a number, left for the next read
+		d.pos--
+		return 0, false, ErrMsgpackType
+	}
+	return v, int64(v) < 0, err
+}
+
+func (d *msgpackDecoder) readFloat() (float64, error) {
+	c, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	switch c {
+	case msgpackFloat32:
+		d.pos++
+		v, err := d.readUintN(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case msgpackFloat64:
+		d.pos++
+		v, err := d.readUintN(8)
+		return math.Float64frombits(v), err
+	}
+	v, neg, err := d.readInteger()
+	if neg {
+		return float64(int64(v)), err
+	}
+	return float64(v), err
+}
+
+// readBytes reads a bin or a str, the bytes are of data
+func (d *msgpackDecoder) readBytes() ([]byte, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	switch {
+	case c&0xe0 == 0xa0:
+		n = uint64(c & 0x1f)
+	case c == msgpackBin8 || c == msgpackStr8:
+		n, err = d.readUintN(1)
+	case c == msgpackBin16 || c == msgpackStr16:
+		n, err = d.readUintN(2)
+	case c == msgpackBin32 || c == msgpackStr32:
+		n, err = d.readUintN(4)
+	default:
+		d.pos--
+		return nil, ErrMsgpackType
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.next(int(n))
+}
+
+// readHeader reads the number of items of a map or an array
+func (d *msgpackDecoder) readHeader(fix, c16, c32 byte) (int, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case c&0xf0 == fix:
+		return int(c & 0x0f), nil
+	case c == c16:
+		n, err = d.readUintN(2)
+	case c == c32:
+		n, err = d.readUintN(4)
+	default:
+		return 0, ErrMsgpackType
+	}
+	// each item takes a byte at least
+	if err == nil && n > uint64(len(d.data)-d.pos) {
+		err = ErrMsgpackShort
+	}
+	return int(n), err
+}
+
+func (d *msgpackDecoder) readMapLen() (int, error) {
+	return d.readHeader(0x80, msgpackMap16, msgpackMap32)
+}
+
+func (d *msgpackDecoder) readArrayLen() (int, error) {
+	return d.readHeader(0x90, msgpackArray16, msgpackArray32)
+}
+
+// skip skips the next value, e.g. of a field the op does not have
+func (d *msgpackDecoder) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c < 0x80 || c >= 0xe0 || c == msgpackNil || c == msgpackFalse || c == msgpackTrue:
+		d.pos++
+		return nil
+	case c&0xf0 == 0x80 || c == msgpackMap16 || c == msgpackMap32:
+		n, err := d.readMapLen()
+		if err != nil {
+			return err
+		}
+		return d.skipN(2 * n)
+	case isMsgpackArray(c):
+		n, err := d.readArrayLen()
+		if err != nil {
+			return err
+		}
+		return d.skipN(n)
+	case c == msgpackFloat32 || c == msgpackFloat64:
+		_, err = d.readFloat()
+		return err
+	}
+	if _, _, err = d.readInteger(); err != ErrMsgpackType {
+		return err
+	}
+	_, err = d.readBytes()
+	return err
+}
+
+func (d *msgpackDecoder) skipN(n int) error {
+	for i := 0; i < n; i++ {
+		err := d.skip()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isMsgpackArray reports if c starts an array, bytes may come as arrays of
+// numbers too like in json
+func isMsgpackArray(c byte) bool {
+	return c&0xf0 == 0x90 || c == msgpackArray16 || c == msgpackArray32
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == msgpackNil {
+		d.pos++
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+	if v.Kind() != reflect.Interface && v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		text, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(text)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		c, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if c != msgpackTrue && c != msgpackFalse {
+			return ErrMsgpackType
+		}
+		v.SetBool(c == msgpackTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		u, neg, err := d.readInteger()
+		if err != nil {
+			return err
+		}
+		i := int64(u)
+		if !neg && i < 0 || v.OverflowInt(i) {
+			return ErrMsgpackRange
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, neg, err := d.readInteger()
+		if err != nil {
+			return err
+		}
+		if neg || v.OverflowUint(u) {
+			return ErrMsgpackRange
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := d.readFloat()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && !isMsgpackArray(c) {
+			b, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			// data is the buffer of the message, it is not kept
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		n, err := d.readArrayLen()
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			err = d.decode(s.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && !isMsgpackArray(c) {
+			b, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.Zero(v.Type()))
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		n, err := d.readArrayLen()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.Zero(v.Type()))
+		for i := 0; i < n; i++ {
+			if i >= v.Len() {
+				err = d.skip()
+			} else {
+				err = d.decode(v.Index(i))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.readMapLen()
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		kt, vt := v.Type().Key(), v.Type().Elem()
+		for i := 0; i < n; i++ {
+			k := reflect.New(kt).Elem()
+			err = d.decode(k)
+			if err != nil {
+				return err
+			}
+			e := reflect.New(vt).Elem()
+			err = d.decode(e)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	case reflect.Struct:
+		return d.decodeStruct(v)
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return errors.New("msgpack: decode into " + v.Type().String())
+		}
+		a, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(a))
+		}
+	default:
+		return errors.New("msgpack: unsupported type " + v.Type().String())
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeStruct(v reflect.Value) error {
+	n, err := d.readMapLen()
+	if err != nil {
+		return err
+	}
+	s := msgpackStructOf(v.Type())
+	for i := 0; i < n; i++ {
+		name, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		f, ok := s.byName[string(name)]
+		if !ok {
+			// case insensitive like encoding/json
+			f = -1
+			for j := range s.fields {
+				if strings.EqualFold(s.fields[j].name, string(name)) {
+					f = j
+					break
+				}
+			}
+		}
+		var fv reflect.Value
+		if f >= 0 {
+			fv = s.fields[f].fieldAlloc(v)
+		}
+		if !fv.IsValid() {
+			err = d.skip()
+		} else {
+			err = d.decode(fv)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeAny decodes into an interface{} like encoding/json, numbers are
+// float64 and maps have string keys
+func (d *msgpackDecoder) decodeAny() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == msgpackNil:
+		d.pos++
+		return nil, nil
+	case c == msgpackFalse || c == msgpackTrue:
+		d.pos++
+		return c == msgpackTrue, nil
+	case c&0xf0 == 0x80 || c == msgpackMap16 || c == msgpackMap32:
+		n, err := d.readMapLen()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := d.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)], err = d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case isMsgpackArray(c):
+		n, err := d.readArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case c&0xe0 == 0xa0 || c == msgpackStr8 || c == msgpackStr16 || c == msgpackStr32:
+		b, err := d.readBytes()
+		return string(b), err
+	case c == msgpackBin8 || c == msgpackBin16 || c == msgpackBin32:
+		b, err := d.readBytes()
+		return append([]byte{}, b...), err
+	}
+	return d.readFloat()
+}
@@ -2,6 +2,7 @@ package factory
 
 import (
 	"errors"
+	"reflect"
 	"sync"
 )
 
@@ -34,7 +35,9 @@ func getOP(n int) interface{} {
 	if pool == nil {
 		return nil
 	}
-	return pool.Get()
+	op := pool.Get()
+	zeroPooled(op)
+	return op
 }
 
 func putOP(n int, op interface{}) {
@@ -56,7 +59,21 @@ func getResp(n int) resp {
 	if pool == nil {
 		return nil
 	}
-	return pool.Get().(resp)
+	r := pool.Get().(resp)
+	zeroPooled(r)
+	return r
+}
+
+// zeroPooled clears an op or resp taken from its pool, json.Unmarshal leaves
+// the fields missing in a frame as they are and merges into maps, so the last
+// frame decoded into it would leak into the next one
+func zeroPooled(v interface{}) {
+	p := reflect.ValueOf(v)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return
+	}
+	e := p.Elem()
+	e.Set(reflect.Zero(e.Type()))
 }
 
 func putResp(n int, r resp) {
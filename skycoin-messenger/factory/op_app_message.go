@@ -0,0 +1,149 @@
+package factory
+
+import (
+	"sync"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func init() {
+	ops[OP_APP_MESSAGE] = &sync.Pool{
+		New: func() interface{} {
+			return new(appMessage)
+		},
+	}
+}
+
+// appMessage is sent by a node to the servers it is connected to for every
+// PriorityMsg of its apps
+type appMessage struct {
+	App cipher.PubKey
+	Msg PriorityMsg
+	opNonce
+}
+
+// run on server
+func (req *appMessage) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	err = conn.checkOPNonce(&req.opNonce)
+	if err != nil || !conn.IsKeySet() {
+		return
+	}
+	app := req.App
+	// only the apps offering a service through the node are known to be its
+	if _, ok := conn.getService(app); !ok {
+		app = cipher.PubKey{}
+	}
+	f.publishAppMessage(&AppMessage{Node: conn.GetKey(), App: app, Msg: req.Msg})
+	return
+}
+
+// AppMessage is a message of an app of Node, App is empty if the app offers
+// no service through the node
+type AppMessage struct {
+	Node cipher.PubKey
+	App  cipher.PubKey
+	Msg  PriorityMsg
+}
+
+const appMessageSubscriptionSize = 64
+
+// AppMessageSubscription receives the app messages of the nodes connected to the server
+type AppMessageSubscription struct {
+	C <-chan *AppMessage
+	c chan *AppMessage
+
+	// nil for all nodes
+	nodes      map[cipher.PubKey]struct{}
+	nodesMutex sync.RWMutex
+
+	hub *appMessageHub
+}
+
+// SetNodes limits the subscription to nodes, all nodes if empty
+func (s *AppMessageSubscription) SetNodes(nodes []cipher.PubKey) {
+	var m map[cipher.PubKey]struct{}
+	if len(nodes) > 0 {
+		m = make(map[cipher.PubKey]struct{}, len(nodes))
+		for _, n := range nodes {
+			m[n] = struct{}{}
+		}
+	}
+	s.nodesMutex.Lock()
+	s.nodes = m
+	s.nodesMutex.Unlock()
+}
+
+func (s *AppMessageSubscription) wants(node cipher.PubKey) (ok bool) {
+	s.nodesMutex.RLock()
+	if s.nodes == nil {
+		ok = true
+	} else {
+		_, ok = s.nodes[node]
+	}
+	s.nodesMutex.RUnlock()
+	return
+}
+
+// Close stops the subscription and closes C
+func (s *AppMessageSubscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+type appMessageHub struct {
+	subscriptions      map[*AppMessageSubscription]struct{}
+	subscriptionsMutex sync.RWMutex
+}
+
+// SubscribeAppMessages streams new app messages of nodes, of all nodes if empty.
+// Messages are dropped for a subscriber that does not keep up
+func (f *MessengerFactory) SubscribeAppMessages(nodes ...cipher.PubKey) *AppMessageSubscription {
+	c := make(chan *AppMessage, appMessageSubscriptionSize)
+	s := &AppMessageSubscription{C: c, c: c, hub: &f.appMessageHub}
+	s.SetNodes(nodes)
+	f.appMessageHub.subscriptionsMutex.Lock()
+	if f.appMessageHub.subscriptions == nil {
+		f.appMessageHub.subscriptions = make(map[*AppMessageSubscription]struct{})
+	}
+	f.appMessageHub.subscriptions[s] = struct{}{}
+	f.appMessageHub.subscriptionsMutex.Unlock()
+	return s
+}
+
+func (h *appMessageHub) unsubscribe(s *AppMessageSubscription) {
+	h.subscriptionsMutex.Lock()
+	if _, ok := h.subscriptions[s]; ok {
+		delete(h.subscriptions, s)
+		close(s.c)
+	}
+	h.subscriptionsMutex.Unlock()
+}
+
+func (f *MessengerFactory) publishAppMessage(m *AppMessage) {
+	f.appMessageHub.subscriptionsMutex.RLock()
+	defer f.appMessageHub.subscriptionsMutex.RUnlock()
+	for s := range f.appMessageHub.subscriptions {
+		if !s.wants(m.Node) {
+			continue
+		}
+		select {
+		case s.c <- m:
+		default:
+		}
+	}
+}
+
+// reportAppMessage forwards a message of app to the servers, run on node
+func (f *MessengerFactory) reportAppMessage(app cipher.PubKey, msg PriorityMsg) {
+	f.fieldsMutex.RLock()
+	connected := f.factory != nil
+	f.fieldsMutex.RUnlock()
+	if !connected {
+		return
+	}
+	f.ForEachConn(func(connection *Connection) {
+		err := connection.writeOP(OP_APP_MESSAGE, &appMessage{App: app, Msg: msg, opNonce: connection.nextOPNonce()})
+		if err != nil {
+			connection.GetContextLogger().Debugf("report app message err %v", err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package factory
+
+import (
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestAppMessages(t *testing.T) {
+	f := NewMessengerFactory()
+	node1, node2 := NewSeedConfig().publicKey, NewSeedConfig().publicKey
+	app, other := NewSeedConfig().publicKey, NewSeedConfig().publicKey
+	conn := func(node cipher.PubKey) *Connection {
+		return &Connection{key: node, keySet: true, servicesMap: map[cipher.PubKey]*Service{app: {Key: app}}}
+	}
+	c1, c2 := conn(node1), conn(node2)
+	send := func(c *Connection, app cipher.PubKey, msg string) {
+		if _, err := (&appMessage{App: app, Msg: PriorityMsg{Msg: msg}}).Execute(f, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(s *AppMessageSubscription, want ...string) []*AppMessage {
+		var ms []*AppMessage
+		for _, msg := range want {
+			select {
+			case m := <-s.C:
+				if m.Msg.Msg != msg {
+					t.Fatalf("message %q, want %q", m.Msg.Msg, msg)
+				}
+				ms = append(ms, m)
+			default:
+				t.Fatalf("no message %q", msg)
+			}
+		}
+		select {
+		case m := <-s.C:
+			t.Fatalf("message %q of another node", m.Msg.Msg)
+		default:
+		}
+		return ms
+	}
+
+	all := f.SubscribeAppMessages()
+	defer all.Close()
+	one := f.SubscribeAppMessages(node1)
+	defer one.Close()
+	send(c1, app, "1")
+	send(c2, app, "2")
+	// no service of it on node1
+	send(c1, other, "3")
+	ms := recv(all, "1", "2", "3")
+	if ms[0].Node != node1 || ms[0].App != app || ms[1].Node != node2 {
+		t.Fatal("message of the wrong node or app")
+	}
+	if ms[2].App != (cipher.PubKey{}) {
+		t.Fatal("app not of the node published")
+	}
+	recv(one, "1", "3")
+	one.SetNodes([]cipher.PubKey{node2})
+	send(c1, app, "4")
+	send(c2, app, "5")
+	recv(one, "5")
+	recv(all, "4", "5")
+
+	// a subscriber that does not keep up misses the newer messages
+	slow := f.SubscribeAppMessages()
+	for i := 0; i < appMessageSubscriptionSize+10; i++ {
+		send(c1, app, "slow")
+		<-all.C
+	}
+	if len(slow.C) != appMessageSubscriptionSize {
+		t.Fatalf("slow subscriber has %d messages", len(slow.C))
+	}
+	slow.Close()
+	for range slow.C {
+	}
+}
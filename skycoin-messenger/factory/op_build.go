@@ -1,13 +1,12 @@
 package factory
 
 import (
-	"crypto/aes"
-	"crypto/rand"
+	"context"
 	"fmt"
 	"github.com/skycoin/skycoin/src/cipher"
-	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 func init() {
@@ -71,6 +70,9 @@ func init() {
 type appConn struct {
 	Node cipher.PubKey
 	App  cipher.PubKey
+	// the app follows the state of the transport, it is told by
+	// OP_TRANSPORT_CLOSED and OP_TRANSPORT_RECONNECTED
+	Reconnect bool `json:",omitempty"`
 }
 
 // run on node A
@@ -78,41 +80,26 @@ func (req *appConn) Execute(f *MessengerFactory, conn *Connection) (r resp, err
 	if !f.Proxy {
 		return
 	}
+	if conn.IsDraining() {
+		conn.GetContextLogger().Debugf("app conn is draining")
+		return
+	}
 
 	f.ForEachConn(func(connection *Connection) {
-		fromNode := connection.GetKey()
-		fromApp := conn.GetKey()
-		iv := make([]byte, aes.BlockSize)
-		if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-			conn.GetContextLogger().Debugf("transport err %v", err)
+		if connection.IsDraining() {
 			return
 		}
+		fromNode := connection.GetKey()
+		fromApp := conn.GetKey()
 		tr := NewTransport(f, conn, fromNode, req.Node, fromApp, req.App)
-		tr.SetOnAcceptedUDPCallback(func(connection *Connection) {
-			sc := f.GetDefaultSeedConfig()
-			connection.GetContextLogger().Debugf("set crypto sc %v", sc)
-			if sc == nil {
-				connection.GetContextLogger().Debugf("tr sc is nil")
-			}
-			err := connection.SetCrypto(sc.publicKey, sc.secKey, req.Node, iv)
-			if err != nil {
-				connection.GetContextLogger().Debugf("set crypto err %v", err)
-			}
-		})
+		tr.reconnect = req.Reconnect
 		conn.GetContextLogger().Debugf("app conn create transport to %s", connection.GetRemoteAddr().String())
-		c, err := tr.ListenAndConnect(connection.GetRemoteAddr().String(), connection.GetTargetKey())
-		if err != nil {
+		connection.addActiveTransport(tr)
+		if err := tr.connectNode(connection); err != nil {
 			conn.GetContextLogger().Debugf("transport err %v", err)
+			connection.activeTransportDone()
 			return
 		}
-		nodeConn := &forwardNodeConn{
-			Node:     req.Node,
-			App:      req.App,
-			FromApp:  fromApp,
-			FromNode: fromNode,
-			Num:      iv,
-		}
-		c.writeOP(OP_FORWARD_NODE_CONN, nodeConn)
 		conn.setTransport(req.App, tr)
 		tr.SetupTimeout()
 	})
@@ -150,19 +137,30 @@ type AppConnResp struct {
 	Port   int
 	Failed bool
 	Msg    PriorityMsg
+	// ErrOPTimeout if no resp came in time, see OPPolicy
+	Err error `json:"-"`
 }
 
 // run on app
 func (req *AppConnResp) Run(conn *Connection) (err error) {
 	conn.GetContextLogger().Debugf("recv %#v", req)
-	if conn.appConnectionInitCallback != nil {
+	if !conn.opResp(pendingOPKey{op: OP_BUILD_APP_CONN, app: req.App}) {
+		return
+	}
+	if _, dialing := conn.appDials.Load(req.App); dialing || conn.hasAppConnCallback() {
 		addr := conn.GetRemoteAddr().String()
 		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
 			return err
 		}
 		req.Host = host
-		fb := conn.appConnectionInitCallback(req)
+		if conn.dialed(req) {
+			return conn.writeOP(OP_APP_FEEDBACK, &AppFeedback{App: req.App, Port: req.Port, Failed: req.Failed, Msg: req.Msg})
+		}
+		if !conn.hasAppConnCallback() {
+			return nil
+		}
+		fb := conn.appConnResp(req)
 		fb.App = req.App
 		err = conn.writeOP(OP_APP_FEEDBACK, fb)
 	}
@@ -179,7 +177,9 @@ type AppFeedback struct {
 
 func (req *AppFeedback) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
 	conn.GetContextLogger().Debugf("recv %#v", req)
-	conn.appFeedback.Store(req)
+	// req goes back to the pool
+	fb := *req
+	conn.appFeedback.Store(&fb)
 	tr, ok := conn.getTransport(req.App)
 	if !ok {
 		conn.GetContextLogger().Debugf("AppFeedback tr %x not found", req.App)
@@ -204,6 +204,17 @@ func (req *buildConnResp) Execute(f *MessengerFactory, conn *Connection) (r resp
 		conn.GetContextLogger().Debugf("buildConnResp tr %x not found", req.App)
 		return
 	}
+	// sealed before the conn is set, the apps may write once it is
+	err = tr.sealWith(req.Key)
+	if err != nil {
+		appConn.writeOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{
+			App:    req.App,
+			Failed: true,
+			Msg:    PriorityMsg{Priority: NotAllowed, Msg: fmt.Sprintf("node %x: %v", req.Node, err), Type: Failed},
+		})
+		tr.Close()
+		return
+	}
 	tr.setUDPConn(conn)
 	fnOK := func(port int) {
 		msg := fmt.Sprintf("connected app %x", req.App)
@@ -221,6 +232,7 @@ func (req *buildConnResp) Execute(f *MessengerFactory, conn *Connection) (r resp
 		return
 	}
 	tr.connAck()
+	tr.publish(EVENT_TRANSPORT_BUILT)
 	err = conn.writeOP(OP_APP_CONN_ACK|RESP_PREFIX, &connAck{
 		FromApp: req.FromApp,
 		App:     req.App,
@@ -251,13 +263,54 @@ type forwardNodeConn struct {
 	FromApp  cipher.PubKey
 	FromNode cipher.PubKey
 	Num      []byte
+	// of node A, see transportKey. Old nodes send none
+	Key *transportKey `json:",omitempty"`
+	// node A reads TYPE_ACK_WINDOW, see conn.UDPConn.EnableAckWindow
+	AckWindow bool `json:",omitempty"`
 }
 
 // run on manager, conn is udp conn from node A
 func (req *forwardNodeConn) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	fwd := *req
+	if conn.IsKeySet() {
+		err = fwd.forward(f, conn)
+		return
+	}
+	// it may overtake the sig of the reg of node A over udp, one waits for it
+	if _, loaded := conn.context.LoadOrStore(forwardPending, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		defer conn.context.Delete(forwardPending)
+		if conn.WaitForKeyContext(context.Background()) != nil {
+			return
+		}
+		if err := fwd.forward(f, conn); err != nil {
+			conn.GetContextLogger().Debugf("forward node conn err %v", err)
+		}
+	}()
+	return
+}
+
+func (req *forwardNodeConn) forward(f *MessengerFactory, conn *Connection) (err error) {
+	key := req.Key
 	c, ok := f.GetConnection(req.Node)
-	if !ok {
+	// node A builds from the key it registered with, the acl and its
+	// counters go by it
+	spoofed := !conn.IsKeySet() || conn.GetKey() != req.FromNode
+	if spoofed || !ok || c.IsDraining() || !f.allowBuild(c, req.App, req.FromNode) {
 		cause := fmt.Sprintf("node %x not exists", req.Node)
+		priority := NotFound
+		if spoofed {
+			cause = fmt.Sprintf("from node %x is not the key of the conn", req.FromNode)
+			priority = NotAllowed
+		} else if ok && c.IsDraining() {
+			cause = fmt.Sprintf("node %x is draining", req.Node)
+			priority = NotAllowed
+		} else if ok {
+			cause = fmt.Sprintf("node %x app %x forbid %x", req.Node, req.App, req.FromNode)
+			priority = NotAllowed
+		}
 		conn.GetContextLogger().Debugf(cause)
 		err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP|RESP_PREFIX, &forwardNodeConnResp{
 			Node:     req.Node,
@@ -265,7 +318,7 @@ func (req *forwardNodeConn) Execute(f *MessengerFactory, conn *Connection) (r re
 			FromApp:  req.FromApp,
 			FromNode: req.FromNode,
 			Failed:   true,
-			Msg:      PriorityMsg{Priority: NotFound, Msg: cause, Type: Failed},
+			Msg:      PriorityMsg{Priority: priority, Msg: cause, Type: Failed},
 			Num:      req.Num,
 		})
 		return
@@ -274,12 +327,14 @@ func (req *forwardNodeConn) Execute(f *MessengerFactory, conn *Connection) (r re
 	conn.GetContextLogger().Debugf("conn remote addr %v", conn.GetRemoteAddr())
 	err = c.writeOP(OP_BUILD_NODE_CONN|RESP_PREFIX,
 		&buildConn{
-			Address:  conn.GetRemoteAddr().String(),
-			Node:     req.Node,
-			App:      req.App,
-			FromApp:  req.FromApp,
-			FromNode: req.FromNode,
-			Num:      req.Num,
+			Address:   conn.GetRemoteAddr().String(),
+			Node:      req.Node,
+			App:       req.App,
+			FromApp:   req.FromApp,
+			FromNode:  req.FromNode,
+			Num:       req.Num,
+			Key:       key,
+			AckWindow: req.AckWindow,
 		})
 	return
 }
@@ -349,8 +404,13 @@ type buildConn struct {
 	FromApp  cipher.PubKey
 	FromNode cipher.PubKey
 	Num      []byte
+	// of node A, see transportKey
+	Key *transportKey `json:",omitempty"`
+	// see forwardNodeConn
+	AckWindow bool `json:",omitempty"`
 }
 
+// run on node B
 func (req *buildConn) Run(conn *Connection) (err error) {
 	appConn, ok := conn.factory.GetConnection(req.App)
 	if !ok {
@@ -364,33 +424,49 @@ func (req *buildConn) Run(conn *Connection) (err error) {
 		return
 	}
 
-	if len(s.AllowNodes) > 0 {
-		allow := false
-		for _, k := range s.AllowNodes {
-			if k == req.FromNode.Hex() {
-				allow = true
-				break
-			}
+	var cause string
+	if conn.IsDraining() || appConn.IsDraining() {
+		cause = fmt.Sprintf("node %x is draining", req.Node)
+	} else if acl := s.acl(); acl != nil && !acl.allows(req.FromNode, nil, time.Now()) {
+		cause = fmt.Sprintf("node %x app %x forbid %x", req.Node, req.App, req.FromNode)
+	} else if e := checkTransportKey(conn.factory, req.Key, req.FromNode, req.FromApp, req.App, req.Num); e != nil {
+		cause = fmt.Sprintf("node %x app %x key of %x: %v", req.Node, req.App, req.FromNode, e)
+	}
+	if len(cause) > 0 {
+		conn.GetContextLogger().Debugf(cause)
+		err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
+			Node:     req.Node,
+			App:      req.App,
+			FromApp:  req.FromApp,
+			FromNode: req.FromNode,
+			Failed:   true,
+			Msg:      PriorityMsg{Priority: NotAllowed, Msg: cause, Type: Failed},
+			Num:      req.Num,
+		})
+		return
+	}
+
+	tr := NewTransport(conn.factory, appConn, req.FromNode, req.Node, req.FromApp, req.App)
+	tr.SetWeight(s.Weight)
+	if req.Key != nil {
+		var trKey *transportKey
+		var sec cipher.SecKey
+		trKey, sec, err = tr.newTransportKey(conn.factory.GetDefaultSeedConfig().keys, req.Num)
+		if err != nil {
+			return
 		}
-		if !allow {
-			cause := fmt.Sprintf("node %x app %x forbid %x", req.Node, req.App, req.FromNode)
-			conn.GetContextLogger().Debugf(cause)
-			err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
-				Node:     req.Node,
-				App:      req.App,
-				FromApp:  req.FromApp,
-				FromNode: req.FromNode,
-				Failed:   true,
-				Msg:      PriorityMsg{Priority: NotAllowed, Msg: cause, Type: Failed},
-				Num:      req.Num,
-			})
+		err = tr.seal(req.Key, sec)
+		if err != nil {
 			return
 		}
+		tr.fieldsMutex.Lock()
+		tr.sealOffer = trKey
+		tr.fieldsMutex.Unlock()
 	}
-
-	tr := NewTransport(conn.factory, appConn, req.FromNode, req.Node, req.FromApp, req.App)
+	conn.addActiveTransport(tr)
 	connection, err := tr.ListenAndConnect(conn.GetRemoteAddr().String(), conn.GetTargetKey())
 	if err != nil {
+		conn.activeTransportDone()
 		return
 	}
 	err = connection.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
@@ -404,7 +480,7 @@ func (req *buildConn) Run(conn *Connection) (err error) {
 	if err != nil {
 		return
 	}
-	err = tr.serverSiceConnect(req.Address, s.Address, conn.factory.GetDefaultSeedConfig(), req.Num)
+	err = tr.serverSiceConnect(req.Address, s.Address, conn.factory.GetDefaultSeedConfig(), req.Num, req.AckWindow)
 	appConn.setTransport(req.FromApp, tr)
 	tr.SetupTimeout()
 	return
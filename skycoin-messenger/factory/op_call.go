@@ -0,0 +1,164 @@
+package factory
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+// how long Call waits when neither its timeout nor an OPPolicy of OP_CALL is set
+const DEFAULT_CALL_TIMEOUT = 10 * time.Second
+
+func init() {
+	ops[OP_CALL] = &sync.Pool{
+		New: func() interface{} {
+			return new(call)
+		},
+	}
+	resps[OP_CALL] = &sync.Pool{
+		New: func() interface{} {
+			return new(callResp)
+		},
+	}
+}
+
+// CallHandler answers the calls of a method, req is the json of the request
+// of the caller and resp is sent back as json. It runs in line with the
+// other ops of conn
+type CallHandler func(conn *Connection, req json.RawMessage) (resp interface{}, err error)
+
+// CallError is the error a CallHandler returned to the caller
+type CallError struct {
+	Method string
+	Msg    string
+}
+
+func (e *CallError) Error() string {
+	return "call " + e.Method + ": " + e.Msg
+}
+
+const callNotFound = "method not found"
+
+// HandleCall registers the handler of the calls of method, nil removes it
+func (f *MessengerFactory) HandleCall(method string, h CallHandler) {
+	f.fieldsMutex.Lock()
+	if h == nil {
+		delete(f.callHandlers, method)
+	} else {
+		if f.callHandlers == nil {
+			f.callHandlers = make(map[string]CallHandler)
+		}
+		f.callHandlers[method] = h
+	}
+	f.fieldsMutex.Unlock()
+}
+
+func (f *MessengerFactory) getCallHandler(method string) (h CallHandler) {
+	f.fieldsMutex.RLock()
+	h = f.callHandlers[method]
+	f.fieldsMutex.RUnlock()
+	return
+}
+
+type call struct {
+	Seq    uint32
+	Method string
+	Req    json.RawMessage `json:",omitempty"`
+}
+
+// run on the server
+func (req *call) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	resp := &callResp{Seq: req.Seq}
+	r = resp
+	h := f.getCallHandler(req.Method)
+	if h == nil {
+		resp.Err = callNotFound
+		return
+	}
+	v, e := h(conn, req.Req)
+	if e != nil {
+		resp.Err = e.Error()
+		return
+	}
+	if v != nil {
+		resp.Resp, e = json.Marshal(v)
+		if e != nil {
+			resp.Err = e.Error()
+		}
+	}
+	return
+}
+
+type callResp struct {
+	Seq  uint32
+	Resp json.RawMessage `json:",omitempty"`
+	Err  string          `json:",omitempty"`
+}
+
+// run on the conn that made the call
+func (resp *callResp) Run(conn *Connection) (err error) {
+	r := &callResult{resp: resp.Resp, err: resp.Err}
+	v, ok := conn.calls.Load(resp.Seq)
+	if !ok {
+		conn.GetContextLogger().Debugf("drop resp of call seq %d", resp.Seq)
+		return
+	}
+	select {
+	case v.(chan *callResult) <- r:
+	default:
+	}
+	return
+}
+
+type callResult struct {
+	resp json.RawMessage
+	err  string
+}
+
+// Call sends req to the handler of method on the server and decodes its
+// answer into resp, which may be nil. The answer is matched by the seq of
+// the call. Once timeout passes it gives up with ErrOPTimeout, the
+// OPPolicy of OP_CALL or DEFAULT_CALL_TIMEOUT if 0. A CallError is the
+// error of the handler
+func (c *Connection) Call(method string, req, resp interface{}, timeout time.Duration) (err error) {
+	if timeout <= 0 {
+		timeout = c.getOPPolicy(OP_CALL).Timeout
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_CALL_TIMEOUT
+	}
+	r := &call{Seq: atomic.AddUint32(&c.callSeq, 1), Method: method}
+	if req != nil {
+		r.Req, err = json.Marshal(req)
+		if err != nil {
+			return
+		}
+	}
+	done := make(chan *callResult, 1)
+	c.calls.Store(r.Seq, done)
+	defer c.calls.Delete(r.Seq)
+	err = c.writeOP(OP_CALL, r)
+	if err != nil {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var result *callResult
+	select {
+	case result = <-done:
+	case <-timer.C:
+		return ErrOPTimeout
+	case <-c.Disconnected():
+		return cn.ErrConnClosed
+	}
+	if len(result.err) > 0 {
+		return &CallError{Method: method, Msg: result.err}
+	}
+	if resp != nil && len(result.resp) > 0 {
+		err = json.Unmarshal(result.resp, resp)
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package factory
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25969"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.HandleCall("echo", func(conn *Connection, req json.RawMessage) (interface{}, error) {
+		var v string
+		err := json.Unmarshal(req, &v)
+		return v, err
+	})
+	s.HandleCall("fail", func(conn *Connection, req json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	s.HandleCall("slow", func(conn *Connection, req json.RawMessage) (interface{}, error) {
+		time.Sleep(300 * time.Millisecond)
+		return "late", nil
+	})
+
+	c := NewMessengerFactory()
+	if err := c.ConnectWithConfig("127.0.0.1:25969", &ConnConfig{SeedConfig: NewSeedConfig()}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var conn *Connection
+	c.ForEachConn(func(c *Connection) { conn = c })
+
+	var resp string
+	if err := conn.Call("echo", "hello", &resp, time.Second); err != nil || resp != "hello" {
+		t.Fatalf("echo %q err %v", resp, err)
+	}
+	err := conn.Call("fail", nil, nil, time.Second)
+	if e, ok := err.(*CallError); !ok || e.Msg != "failed" {
+		t.Fatalf("err of the handler %v", err)
+	}
+	err = conn.Call("missing", nil, nil, time.Second)
+	if e, ok := err.(*CallError); !ok || e.Msg != callNotFound {
+		t.Fatalf("err of a missing method %v", err)
+	}
+	if err = conn.Call("slow", nil, &resp, 100*time.Millisecond); err != ErrOPTimeout {
+		t.Fatalf("slow call err %v", err)
+	}
+	// the late resp of the slow call is not taken for the next one
+	resp = ""
+	if err = conn.Call("echo", "again", &resp, time.Second); err != nil || resp != "again" {
+		t.Fatalf("echo after a timeout %q err %v", resp, err)
+	}
+}
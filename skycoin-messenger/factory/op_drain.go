@@ -0,0 +1,93 @@
+package factory
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+func init() {
+	ops[OP_DRAIN] = &sync.Pool{
+		New: func() interface{} {
+			return new(drain)
+		},
+	}
+}
+
+var (
+	ErrDraining     = errors.New("connection is draining")
+	ErrDrainTimeout = cn.NewError(cn.ErrTimeout, "transports still active after drain timeout")
+)
+
+type drain struct {
+}
+
+// run on the peer of a draining connection
+func (req *drain) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	conn.setDraining()
+	conn.GetContextLogger().Debugf("peer is draining")
+	return
+}
+
+// Drain takes the connection out of service without cutting app sessions:
+// no new transports are built through it, the peer is told to stop routing
+// new ones here and the connection closes once the active transports finished,
+// or after timeout with ErrDrainTimeout. A drained connection does not reconnect
+func (c *Connection) Drain(timeout time.Duration) (err error) {
+	c.setDraining()
+	err = c.writeOP(OP_DRAIN, &drain{})
+	if err != nil {
+		c.Close()
+		return
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for c.countActiveTransports() > 0 {
+		select {
+		case <-deadline:
+			err = ErrDrainTimeout
+			c.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+	c.Close()
+	return
+}
+
+func (c *Connection) setDraining() {
+	c.fieldsMutex.Lock()
+	c.draining = true
+	c.fieldsMutex.Unlock()
+}
+
+func (c *Connection) IsDraining() (draining bool) {
+	c.fieldsMutex.RLock()
+	draining = c.draining
+	c.fieldsMutex.RUnlock()
+	return
+}
+
+// transports built through this connection to the manager
+// plus the ones held by this app connection
+func (c *Connection) countActiveTransports() int {
+	c.appTransportsMutex.RLock()
+	n := len(c.appTransports)
+	c.appTransportsMutex.RUnlock()
+	return n + int(atomic.LoadInt32(&c.activeTransports))
+}
+
+func (c *Connection) addActiveTransport(t *Transport) {
+	atomic.AddInt32(&c.activeTransports, 1)
+	t.fieldsMutex.Lock()
+	t.via = c
+	t.fieldsMutex.Unlock()
+}
+
+func (c *Connection) activeTransportDone() {
+	atomic.AddInt32(&c.activeTransports, -1)
+}
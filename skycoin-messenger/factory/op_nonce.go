@@ -0,0 +1,85 @@
+package factory
+
+import (
+	"bytes"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const opSessionSize = 16
+
+var ErrOPReplayed = cn.NewError(cn.ErrUnauthorized, "op replayed or from another session")
+
+// opNonce is carried by sensitive ops (service updates, app messages) once the
+// server handed out a session id at reg. The server accepts a frame only within
+// its session and with a nonce it did not see yet, so captured frames can not
+// be replayed even if the transport crypto is off. The nonces are checked in a
+// window and not in order, the priority of the ops lets a later one overtake
+// an earlier one on the wire
+type opNonce struct {
+	Session []byte `json:",omitempty"`
+	Nonce   uint64 `json:",omitempty"`
+}
+
+type opSession struct {
+	id []byte
+	// set by the server after the client echoed id at reg
+	required bool
+	// last nonce sent by the client
+	nonce uint64
+	// nonces accepted by the server
+	window cn.ReplayWindow
+}
+
+func newOPSessionID() []byte {
+	return cipher.RandByte(opSessionSize)
+}
+
+func (c *Connection) setOPSession(id []byte) {
+	c.fieldsMutex.Lock()
+	c.opSession = opSession{id: id}
+	c.fieldsMutex.Unlock()
+}
+
+func (c *Connection) getOPSessionID() (id []byte) {
+	c.fieldsMutex.RLock()
+	id = c.opSession.id
+	c.fieldsMutex.RUnlock()
+	return
+}
+
+// requireOPSession makes the server reject sensitive ops without a valid nonce
+func (c *Connection) requireOPSession(id []byte) error {
+	c.fieldsMutex.Lock()
+	defer c.fieldsMutex.Unlock()
+	if !bytes.Equal(id, c.opSession.id) {
+		return ErrOPReplayed
+	}
+	c.opSession.required = true
+	return nil
+}
+
+// run on client, zero if the server did not hand out a session
+func (c *Connection) nextOPNonce() opNonce {
+	c.fieldsMutex.Lock()
+	defer c.fieldsMutex.Unlock()
+	if len(c.opSession.id) < 1 {
+		return opNonce{}
+	}
+	c.opSession.nonce++
+	return opNonce{Session: c.opSession.id, Nonce: c.opSession.nonce}
+}
+
+// run on server
+func (c *Connection) checkOPNonce(n *opNonce) error {
+	c.fieldsMutex.Lock()
+	defer c.fieldsMutex.Unlock()
+	if !c.opSession.required {
+		return nil
+	}
+	if n.Nonce < 1 || !bytes.Equal(n.Session, c.opSession.id) || !c.opSession.window.Accept(n.Nonce) {
+		return ErrOPReplayed
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package factory
+
+import (
+	"testing"
+)
+
+func TestCheckOPNonce(t *testing.T) {
+	client := &Connection{}
+	server := &Connection{}
+	if n := client.nextOPNonce(); n.Nonce != 0 || n.Session != nil {
+		t.Fatalf("nonce without session %+v", n)
+	}
+	// legacy clients are not checked
+	if err := server.checkOPNonce(&opNonce{}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := newOPSessionID()
+	server.setOPSession(id)
+	client.setOPSession(id)
+	if err := server.requireOPSession(newOPSessionID()); err != ErrOPReplayed {
+		t.Fatalf("wrong session err %v", err)
+	}
+	if err := server.requireOPSession(id); err != nil {
+		t.Fatal(err)
+	}
+
+	first := client.nextOPNonce()
+	n := first
+	if err := server.checkOPNonce(&n); err != nil {
+		t.Fatal(err)
+	}
+	n = first
+	if err := server.checkOPNonce(&n); err != ErrOPReplayed {
+		t.Fatalf("replay err %v", err)
+	}
+	n = client.nextOPNonce()
+	n.Session = newOPSessionID()
+	if err := server.checkOPNonce(&n); err != ErrOPReplayed {
+		t.Fatalf("other session err %v", err)
+	}
+	if err := server.checkOPNonce(&opNonce{}); err != ErrOPReplayed {
+		t.Fatalf("missing nonce err %v", err)
+	}
+	// a control op sent later overtakes an app message on the wire
+	earlier, later := client.nextOPNonce(), client.nextOPNonce()
+	n = later
+	if err := server.checkOPNonce(&n); err != nil {
+		t.Fatal(err)
+	}
+	n = earlier
+	if err := server.checkOPNonce(&n); err != nil {
+		t.Fatalf("overtaken nonce err %v", err)
+	}
+	n = earlier
+	if err := server.checkOPNonce(&n); err != ErrOPReplayed {
+		t.Fatalf("overtaken replay err %v", err)
+	}
+}
@@ -2,10 +2,13 @@ package factory
 
 import (
 	"encoding/json"
+	"errors"
 	"net"
 	"sync"
 )
 
+var ErrServiceMetadataSize = errors.New("service metadata too large")
+
 func init() {
 	ops[OP_OFFER_SERVICE] = &sync.Pool{
 		New: func() interface{} {
@@ -16,6 +19,7 @@ func init() {
 
 type offer struct {
 	Services *NodeServices
+	opNonce
 }
 
 func (offer *offer) UnmarshalJSON(data []byte) (err error) {
@@ -25,10 +29,26 @@ func (offer *offer) UnmarshalJSON(data []byte) (err error) {
 		return
 	}
 	offer.Services = ss
+	err = json.Unmarshal(data, &offer.opNonce)
+	return
+}
+
+func (offer *offer) unmarshalMsgpack(data []byte) (err error) {
+	ss := &NodeServices{}
+	err = unmarshalMsgpack(data, ss)
+	if err != nil {
+		return
+	}
+	offer.Services = ss
+	err = unmarshalMsgpack(data, &offer.opNonce)
 	return
 }
 
 func (offer *offer) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	err = conn.checkOPNonce(&offer.opNonce)
+	if err != nil {
+		return
+	}
 	if len(offer.Services.ServiceAddress) > 0 {
 		var host, port string
 		_, port, err = net.SplitHostPort(offer.Services.ServiceAddress)
@@ -42,6 +62,13 @@ func (offer *offer) Execute(f *MessengerFactory, conn *Connection) (r resp, err
 		}
 		offer.Services.ServiceAddress = net.JoinHostPort(host, port)
 	}
+	for _, service := range offer.Services.Services {
+		if service.Metadata.size() > MAX_SERVICE_METADATA_SIZE {
+			err = ErrServiceMetadataSize
+			return
+		}
+	}
+	conn.discoveryLogger().Debugf("offer %d services ttl %d", len(offer.Services.Services), offer.Services.TTL)
 	f.discoveryRegister(conn, offer.Services)
 	return
 }
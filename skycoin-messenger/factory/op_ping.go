@@ -0,0 +1,114 @@
+package factory
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+func init() {
+	ops[OP_PING] = &sync.Pool{
+		New: func() interface{} {
+			return new(ping)
+		},
+	}
+	resps[OP_PING] = &sync.Pool{
+		New: func() interface{} {
+			return new(pong)
+		},
+	}
+}
+
+type ping struct {
+	Seq uint64
+}
+
+// run on the server, clients answer in answerPing
+func (req *ping) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	r = &pong{Seq: req.Seq}
+	return
+}
+
+type pong struct {
+	Seq uint64
+}
+
+// run on the conn that sent the ping
+func (resp *pong) Run(conn *Connection) (err error) {
+	conn.receivePong(resp.Seq)
+	return
+}
+
+// Ping sends a probe op to the peer and returns the time until its answer
+// arrived. Unlike the ack latencies it is the round trip an app sees, the
+// queues of both ends included. The last one is kept for GetPingRTT
+func (c *Connection) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	if p := c.getOPPolicy(OP_PING); p.Timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+			defer cancel()
+		}
+	}
+	seq := atomic.AddUint64(&c.pingSeq, 1)
+	done := make(chan struct{}, 1)
+	c.pings.Store(seq, done)
+	defer c.pings.Delete(seq)
+	start := time.Now()
+	err = c.writeOP(OP_PING, &ping{Seq: seq})
+	if err != nil {
+		return
+	}
+	select {
+	case <-done:
+		rtt = time.Since(start)
+		atomic.StoreInt64(&c.pingRTT, int64(rtt))
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.Disconnected():
+		err = cn.ErrConnClosed
+	}
+	return
+}
+
+// GetPingRTT returns the result of the last successful Ping, 0 if none
+func (c *Connection) GetPingRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.pingRTT))
+}
+
+func (c *Connection) receivePong(seq uint64) {
+	v, ok := c.pings.Load(seq)
+	if !ok {
+		c.GetContextLogger().Debugf("pong of unknown seq %d", seq)
+		return
+	}
+	select {
+	case v.(chan struct{}) <- struct{}{}:
+	default:
+	}
+}
+
+// answerPing answers the ping of the server, the ops a client receives are
+// not executed by the factory
+func (c *Connection) answerPing(body []byte) error {
+	var req ping
+	err := unmarshalOP(body, &req)
+	if err != nil {
+		return err
+	}
+	return c.writeOP(OP_PING|RESP_PREFIX, &pong{Seq: req.Seq})
+}
+
+// runPong is the pong to a Ping of the server, the factory only executes the
+// requests of clients
+func (c *Connection) runPong(body []byte) error {
+	var r pong
+	err := unmarshalOP(body, &r)
+	if err != nil {
+		return err
+	}
+	return r.Run(c)
+}
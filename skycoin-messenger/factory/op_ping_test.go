@@ -0,0 +1,53 @@
+package factory
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25946"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sc := NewSeedConfig()
+	c := NewMessengerFactory()
+	defer c.Close()
+	if err := c.ConnectWithConfig("127.0.0.1:25946", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	var client *Connection
+	c.ForEachConn(func(conn *Connection) { client = conn })
+	deadline := time.Now().Add(5 * time.Second)
+	server, ok := s.GetConnection(sc.publicKey)
+	for !ok {
+		if time.Now().After(deadline) {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+		server, ok = s.GetConnection(sc.publicKey)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for name, conn := range map[string]*Connection{"client": client, "server": server} {
+		rtt, err := conn.Ping(ctx)
+		if err != nil {
+			t.Fatalf("%s ping err %v", name, err)
+		}
+		if rtt <= 0 || conn.GetPingRTT() != rtt {
+			t.Fatalf("%s rtt %v last %v", name, rtt, conn.GetPingRTT())
+		}
+	}
+
+	// nothing answers a ping of the server once the client stopped reading
+	client.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Ping(ctx); err == nil {
+		t.Fatal("ping of a closed conn")
+	}
+}
@@ -1,6 +1,7 @@
 package factory
 
 import (
+	"encoding/json"
 	"sync"
 
 	"sync/atomic"
@@ -50,7 +51,7 @@ func (query *query) Execute(f *MessengerFactory, conn *Connection) (r resp, err
 	if !f.Proxy {
 		r = &QueryResp{
 			Seq:    query.Seq,
-			Result: f.findServiceAddresses(query.Keys, conn.GetKey()),
+			Result: f.filterVisibleNodes(f.findServiceAddresses(query.Keys, conn.GetKey()), conn),
 		}
 		return
 	}
@@ -65,15 +66,18 @@ func (query *query) Execute(f *MessengerFactory, conn *Connection) (r resp, err
 type QueryResp struct {
 	Seq    uint32
 	Result []*ServiceInfo
+	// ErrOPTimeout if no resp came in time, see OPPolicy
+	Err error `json:"-"`
 }
 
 func (resp *QueryResp) Run(conn *Connection) (err error) {
 	if connection, ok := conn.removeProxyConnection(resp.Seq); ok {
 		return connection.writeOP(OP_QUERY_SERVICE_NODES|RESP_PREFIX, resp)
 	}
-	if conn.findServiceNodesByKeysCallback != nil {
-		conn.findServiceNodesByKeysCallback(resp)
+	if !conn.opResp(pendingOPKey{op: OP_QUERY_SERVICE_NODES, seq: resp.Seq}) {
+		return
 	}
+	conn.keysQueryResp(resp)
 	return
 }
 
@@ -81,6 +85,17 @@ func (resp *QueryResp) Run(conn *Connection) (err error) {
 type queryByAttrs struct {
 	Attrs []string
 	Seq   uint32
+	// how Attrs match, ATTR_MATCH_EXACT if empty
+	Match string `json:",omitempty"`
+	// nodes of the page, all if 0. The server may send less, see
+	// MessengerFactory.MaxQueryResults
+	Limit int `json:",omitempty"`
+	// the page starts after this node, QueryByAttrsResp.Next of the page before
+	Cursor string `json:",omitempty"`
+	// QUERY_ORDER_KEY if empty
+	Order string `json:",omitempty"`
+	// of the client, for QUERY_ORDER_NEAREST
+	Region string `json:",omitempty"`
 }
 
 func newQueryByAttrs(attrs []string) *queryByAttrs {
@@ -90,7 +105,16 @@ func newQueryByAttrs(attrs []string) *queryByAttrs {
 
 func (query *queryByAttrs) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
 	if !f.Proxy {
-		r = &QueryByAttrsResp{Seq: query.Seq, Result: f.findByAttributes(query.Attrs...)}
+		resp := &QueryByAttrsResp{Seq: query.Seq}
+		result := f.filterVisible(f.findByAttributesMatch(query.Match, query.Attrs...), conn)
+		if query.Order == QUERY_ORDER_NEAREST {
+			resp.Result, resp.Nearest, resp.Next = pageNearestNodes(result, f.findRegions(result), query.Region, query.Cursor, f.queryLimit(query.Limit))
+		} else {
+			resp.Result, resp.Next = pageNodes(result, query.Cursor, f.queryLimit(query.Limit))
+		}
+		resp.Metadata = f.findMetadata(resp.Result)
+		resp.Health = f.findHealth(resp.Result)
+		r = resp
 		return
 	}
 	f.ForEachConn(func(connection *Connection) {
@@ -104,14 +128,34 @@ func (query *queryByAttrs) Execute(f *MessengerFactory, conn *Connection) (r res
 type QueryByAttrsResp struct {
 	Result map[string][]cipher.PubKey
 	Seq    uint32
+	// cursor of the next page, empty on the last one
+	Next string `json:",omitempty"`
+	// node => service key => Service.Metadata of the services in Result
+	// that have metadata
+	Metadata map[string]map[string]ServiceMetadata `json:",omitempty"`
+	// node => service key => health of the services in Result checked by
+	// the server, see CheckHealth
+	Health map[string]map[string]*ServiceHealth `json:",omitempty"`
+	// the nodes of Result nearest first for QUERY_ORDER_NEAREST
+	Nearest []string `json:",omitempty"`
+	// ErrOPTimeout if no resp came in time, see OPPolicy
+	Err error `json:"-"`
+}
+
+// UnmarshalJSON drops what the resp held before it came from the pool
+func (resp *QueryByAttrsResp) UnmarshalJSON(data []byte) error {
+	type plain QueryByAttrsResp
+	*resp = QueryByAttrsResp{}
+	return json.Unmarshal(data, (*plain)(resp))
 }
 
 func (resp *QueryByAttrsResp) Run(conn *Connection) (err error) {
 	if connection, ok := conn.removeProxyConnection(resp.Seq); ok {
 		return connection.writeOP(OP_QUERY_BY_ATTRS|RESP_PREFIX, resp)
 	}
-	if conn.findServiceNodesByAttributesCallback != nil {
-		conn.findServiceNodesByAttributesCallback(resp)
+	if !conn.opResp(pendingOPKey{op: OP_QUERY_BY_ATTRS, seq: resp.Seq}) {
+		return
 	}
+	conn.attrsQueryResp(resp)
 	return
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"sync"
 
+	cn "github.com/skycoin/net/conn"
 	"github.com/skycoin/skycoin/src/cipher"
 )
 
@@ -74,6 +75,14 @@ func (resp *regResp) Run(conn *Connection) (err error) {
 const (
 	publicKey = iota
 	randomBytes
+	// see regChallengeHash
+	regChallenge
+	// context accepted by the ContextValidator, see ContextCommitter
+	regContext
+	// see regSuiteChoice
+	regSuites
+	// a forwardNodeConn waits for the reg of node A
+	forwardPending
 )
 
 type RegVersion int
@@ -87,6 +96,18 @@ type regWithKey struct {
 	PublicKey cipher.PubKey
 	Context   map[string]string
 	Version   RegVersion
+	// offered compressions, best first
+	Compressions []string `json:",omitempty"`
+	// offered cipher suites, best first
+	Suites []string `json:",omitempty"`
+	// offered checksums of udp packets, cheapest first
+	Checksums []string `json:",omitempty"`
+	// of an anonymous client, see ConnConfig.Anonymous
+	Anonymous bool `json:",omitempty"`
+	// offered encodings of ops, best first
+	Encodings []string `json:",omitempty"`
+	// the udp client reads TYPE_ACK_WINDOW, see conn.UDPConn.EnableAckWindow
+	AckWindow bool `json:",omitempty"`
 }
 
 func (reg *regWithKey) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
@@ -97,7 +118,17 @@ func (reg *regWithKey) Execute(f *MessengerFactory, conn *Connection) (r resp, e
 	for k, v := range reg.Context {
 		conn.StoreContext(k, v)
 	}
+	err = f.validateContext(conn, reg)
+	if err != nil {
+		return
+	}
 	conn.StoreContext(publicKey, reg.PublicKey)
+	if reg.Anonymous {
+		f.acceptAnonymous(conn)
+	}
+	if reg.AckWindow && conn.IsUDP() {
+		conn.EnableAckWindow()
+	}
 	if reg.Version == RegWithKeyAndEncryptionVersion {
 		sc := f.GetDefaultSeedConfig()
 		if sc == nil {
@@ -107,22 +138,54 @@ func (reg *regWithKey) Execute(f *MessengerFactory, conn *Connection) (r resp, e
 		n := cipher.RandByte(64)
 		hash := cipher.SumSHA256(n)
 		conn.StoreContext(randomBytes, hash)
+		challenge := cipher.RandByte(REG_CHALLENGE_SIZE)
+		conn.StoreContext(regChallenge, challenge)
 		resp := &regWithKeyResp{
 			Num:       make([]byte, aes.BlockSize),
 			PublicKey: sc.publicKey,
 			Version:   reg.Version,
 			Hash:      hash,
+			Session:   newOPSessionID(),
+			Challenge: challenge,
 		}
+		conn.setOPSession(resp.Session)
 		if _, err = io.ReadFull(rand.Reader, resp.Num); err != nil {
 			return
 		}
-		err = conn.SetCrypto(sc.publicKey, sc.secKey, reg.PublicKey, resp.Num)
+		if len(reg.Suites) > 0 {
+			resp.Suite = cn.NegotiateCipherSuite(reg.Suites, f.CipherSuites)
+			conn.StoreContext(regSuites, regSuiteChoice{offered: reg.Suites, chosen: resp.Suite})
+		}
+		err = conn.SetCryptoWithKeyProvider(sc.keys, reg.PublicKey, resp.Num, resp.Suite)
 		if err != nil {
 			return
 		}
+		if len(reg.Checksums) > 0 && conn.IsUDP() {
+			resp.Checksum = cn.NegotiateChecksum(reg.Checksums, f.Checksums, conn.GetCrypto().IsAEAD())
+			err = conn.SetChecksum(resp.Checksum)
+			if err != nil {
+				return
+			}
+		}
+		if len(reg.Compressions) > 0 && len(f.Compressions) > 0 {
+			resp.Compression = cn.NegotiateCompression(reg.Compressions, f.Compressions)
+			err = conn.SetCompression(resp.Compression, f.CompressionThreshold)
+			if err != nil {
+				return
+			}
+		}
+
+		if len(reg.Encodings) > 0 {
+			resp.Encoding = NegotiateEncoding(reg.Encodings, f.Encodings)
+		}
 
 		err = conn.writeOPReq(OP_REG_KEY|RESP_PREFIX,
 			resp)
+		if err != nil {
+			return
+		}
+		// the resp is json, the client may not know the encoding before it
+		err = conn.SetEncoding(resp.Encoding)
 		return
 	}
 	n := cipher.RandByte(64)
@@ -136,9 +199,27 @@ type regWithKeyResp struct {
 	Hash      cipher.SHA256
 	PublicKey cipher.PubKey
 	Version   RegVersion
+	// negotiated compression, none if empty
+	Compression string `json:",omitempty"`
+	// negotiated cipher suite, aes-cfb if empty
+	Suite string `json:",omitempty"`
+	// negotiated checksum of udp packets, crc32 if empty
+	Checksum string `json:",omitempty"`
+	// negotiated encoding of the ops after this resp, json if empty
+	Encoding string `json:",omitempty"`
+	// id for the nonces of sensitive ops, see opNonce
+	Session []byte `json:",omitempty"`
+	// signed by the client with its key, see regChallengeHash
+	Challenge []byte `json:",omitempty"`
+	// see ContextValidator
+	Rejection *RegRejection `json:",omitempty"`
 }
 
 func (resp *regWithKeyResp) Run(conn *Connection) (err error) {
+	if resp.Rejection != nil {
+		conn.setRegRejection(resp.Rejection)
+		return resp.Rejection
+	}
 	if resp.Version == RegWithKeyAndEncryptionVersion {
 		k, ok := conn.context.Load(publicKey)
 		if !ok {
@@ -155,21 +236,62 @@ func (resp *regWithKeyResp) Run(conn *Connection) (err error) {
 		if t != EMPATY_PUBLIC_KEY && t != tpk {
 			tpk = t
 		}
-		err = conn.SetCrypto(pk, conn.GetSecKey(), tpk, resp.Num)
+		// the key used, a server presenting another one can not read the reg
+		err = conn.checkServerKey(tpk, false)
+		if err != nil {
+			return
+		}
+		err = conn.SetCryptoWithKeyProvider(conn.GetKeyProvider(), tpk, resp.Num, resp.Suite)
+		if err != nil {
+			return
+		}
+		if len(resp.Checksum) > 0 {
+			err = conn.SetChecksum(resp.Checksum)
+			if err != nil {
+				return
+			}
+		}
+		if len(resp.Compression) > 0 {
+			err = conn.SetCompression(resp.Compression, conn.compressionThreshold)
+			if err != nil {
+				return
+			}
+		}
+		err = conn.SetEncoding(resp.Encoding)
+		if err != nil {
+			return
+		}
+		conn.setOPSession(resp.Session)
+		hash := resp.Hash
+		challenged := len(resp.Challenge) > 0
+		if challenged {
+			hash = regChallengeHash(resp.Challenge, pk, resp.PublicKey, conn.cipherSuites, resp.Suite)
+		}
+		var sig cipher.Sig
+		sig, err = conn.signHash(hash)
 		if err != nil {
 			return
 		}
-		sig := cipher.SignHash(resp.Hash, conn.GetSecKey())
 		err = conn.writeOPResp(OP_REG_SIG, &regCheckSig{
-			Sig:     sig,
-			Version: resp.Version,
+			Sig:        sig,
+			Version:    resp.Version,
+			Session:    resp.Session,
+			Challenged: challenged,
 		})
+		if err != nil {
+			return
+		}
+		err = conn.checkServerKey(tpk, true)
+		if err != nil {
+			return
+		}
 		conn.SetKey(pk)
 		return
 	}
-	sk := conn.GetSecKey()
-	hash := cipher.SumSHA256(resp.Num)
-	sig := cipher.SignHash(hash, sk)
+	sig, err := conn.signHash(cipher.SumSHA256(resp.Num))
+	if err != nil {
+		return
+	}
 	err = conn.writeOP(OP_REG_SIG, &regCheckSig{Sig: sig})
 	return
 }
@@ -177,6 +299,10 @@ func (resp *regWithKeyResp) Run(conn *Connection) (err error) {
 type regCheckSig struct {
 	Sig     cipher.Sig
 	Version RegVersion
+	// echoed session of regWithKeyResp, old clients leave it empty
+	Session []byte `json:",omitempty"`
+	// Sig is of the challenge of regWithKeyResp, old clients sign its Hash
+	Challenged bool `json:",omitempty"`
 }
 
 func (reg *regCheckSig) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
@@ -200,33 +326,63 @@ func (reg *regCheckSig) Execute(f *MessengerFactory, conn *Connection) (r resp,
 			err = errors.New("hash not found")
 			return
 		}
+		conn.context.Delete(randomBytes)
 		hash, ok := n.(cipher.SHA256)
 		if !ok {
-			err = errors.New("hash is invalid")
+			err = ErrRegVersion
 			return
 		}
-		err = cipher.VerifySignature(pk, reg.Sig, hash)
+		err = f.verifyRegChallenge(conn, pk, reg.Sig, reg.Challenged, hash)
 		if err != nil {
+			err = cn.Wrap(cn.ErrUnauthorized, err)
 			return
 		}
+		if len(reg.Session) > 0 {
+			err = conn.requireOPSession(reg.Session)
+			if err != nil {
+				return
+			}
+		}
 		goto OK
 	} else {
+		if f.RequireRegChallenge {
+			err = ErrRegChallenge
+			return
+		}
 		n, ok := conn.context.Load(randomBytes)
 		if !ok {
 			err = errors.New("randomBytes not found")
 			return
 		}
-		hash := cipher.SumSHA256(n.([]byte))
+		conn.context.Delete(randomBytes)
+		num, ok := n.([]byte)
+		if !ok {
+			err = ErrRegVersion
+			return
+		}
+		hash := cipher.SumSHA256(num)
 		err = cipher.VerifySignature(pk, reg.Sig, hash)
 		if err != nil {
+			err = cn.Wrap(cn.ErrUnauthorized, err)
 			return
 		}
 	}
 	r = &regResp{PubKey: pk}
 OK:
+	// a key is charged once it is proven, so no one else locks it out
+	if !f.allowRegKey(conn, pk) {
+		r = nil
+		err = ErrRegLimited
+		return
+	}
+	err = f.commitContext(conn, pk)
+	if err != nil {
+		r = nil
+		return
+	}
 	conn.SetKey(pk)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("pubkey", pk.Hex()))
-	if conn.IsTCP() {
+	if conn.IsTCP() && !conn.IsAnonymous() {
 		f.register(pk, conn)
 	}
 	return
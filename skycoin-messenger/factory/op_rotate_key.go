@@ -0,0 +1,192 @@
+package factory
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+var (
+	ErrKeyInUse      = errors.New("key registered by another conn")
+	ErrNotRegistered = errors.New("conn not registered")
+)
+
+func init() {
+	ops[OP_ROTATE_KEY] = &sync.Pool{
+		New: func() interface{} {
+			return new(rotateKey)
+		},
+	}
+	resps[OP_ROTATE_KEY] = &sync.Pool{
+		New: func() interface{} {
+			return new(rotateKeyResp)
+		},
+	}
+}
+
+// rotateKey is signed by the key of the conn and by NewKey, so neither a
+// stolen old key nor a key the node does not hold can take the registration
+type rotateKey struct {
+	NewKey cipher.PubKey
+	OldSig cipher.Sig
+	NewSig cipher.Sig
+	opNonce
+}
+
+// rotationHash binds the rotation to the keys and to the nonce of the op, a
+// captured rotation can not be sent again
+func rotationHash(old, new cipher.PubKey, n opNonce) cipher.SHA256 {
+	b := make([]byte, 0, len(old)+len(new)+len(n.Session)+8)
+	b = append(b, old[:]...)
+	b = append(b, new[:]...)
+	b = append(b, n.Session...)
+	var nonce [8]byte
+	binary.BigEndian.PutUint64(nonce[:], n.Nonce)
+	return cipher.SumSHA256(append(b, nonce[:]...))
+}
+
+// run on the server
+func (req *rotateKey) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	n := req.opNonce
+	err = conn.checkOPNonce(&req.opNonce)
+	if err != nil {
+		return
+	}
+	if !conn.IsKeySet() {
+		err = ErrNotRegistered
+		return
+	}
+	old := conn.GetKey()
+	hash := rotationHash(old, req.NewKey, n)
+	err = cipher.VerifySignature(old, req.OldSig, hash)
+	if err != nil {
+		err = cn.Wrap(cn.ErrUnauthorized, err)
+		return
+	}
+	err = cipher.VerifySignature(req.NewKey, req.NewSig, hash)
+	if err != nil {
+		err = cn.Wrap(cn.ErrUnauthorized, err)
+		return
+	}
+	resp := &rotateKeyResp{NewKey: req.NewKey}
+	if e := f.rekey(conn, old, req.NewKey); e != nil {
+		resp.Refused = e.Error()
+	}
+	r = resp
+	return
+}
+
+type rotateKeyResp struct {
+	NewKey cipher.PubKey
+	// why the server kept the old key
+	Refused string `json:",omitempty"`
+}
+
+// run on the conn that sent the rotation
+func (resp *rotateKeyResp) Run(conn *Connection) (err error) {
+	v, ok := conn.rotations.Load(resp.NewKey)
+	if !ok {
+		conn.GetContextLogger().Debugf("rotation to unknown key %s", resp.NewKey.Hex())
+		return
+	}
+	rotation := v.(*keyRotation)
+	if len(resp.Refused) > 0 {
+		rotation.done <- errors.New(resp.Refused)
+		return
+	}
+	conn.swapKey(resp.NewKey, rotation.keys)
+	rotation.done <- nil
+	return
+}
+
+type keyRotation struct {
+	keys cn.KeyProvider
+	done chan error
+}
+
+// RotateKey replaces the key of the registered conn by the one of sc without
+// closing it. The server moves the registration and the services offered to
+// the new key at once, the app transports and the crypto of the conn are kept.
+// Messages sent to the old key are not delivered once it returns
+func (c *Connection) RotateKey(ctx context.Context, sc *SeedConfig) (err error) {
+	err = sc.parse()
+	if err != nil {
+		return
+	}
+	if !c.IsKeySet() {
+		return ErrNotRegistered
+	}
+	old := c.GetKey()
+	n := c.nextOPNonce()
+	hash := rotationHash(old, sc.publicKey, n)
+	req := &rotateKey{NewKey: sc.publicKey, opNonce: n}
+	req.OldSig, err = c.signHash(hash)
+	if err != nil {
+		return
+	}
+	req.NewSig, err = sc.keys.SignHash(hash)
+	if err != nil {
+		return
+	}
+	rotation := &keyRotation{keys: sc.keys, done: make(chan error, 1)}
+	c.rotations.Store(sc.publicKey, rotation)
+	defer c.rotations.Delete(sc.publicKey)
+	err = c.writeOP(OP_ROTATE_KEY, req)
+	if err != nil {
+		return
+	}
+	select {
+	case err = <-rotation.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.Disconnected():
+		err = cn.ErrConnClosed
+	}
+	return
+}
+
+// swapKey sets the key of a registered conn without the callbacks of SetKey
+func (c *Connection) swapKey(key cipher.PubKey, keys cn.KeyProvider) {
+	c.fieldsMutex.Lock()
+	c.key = key
+	if keys != nil {
+		c.keys = keys
+	}
+	c.fieldsMutex.Unlock()
+	c.SetContextLogger(c.GetContextLogger().WithField("pubkey", key.Hex()))
+}
+
+// rekey moves the registration and the services of conn from old to new,
+// run on the server. Lookups of the registry see either key, never none
+func (f *MessengerFactory) rekey(conn *Connection, old, new cipher.PubKey) error {
+	if old == new {
+		return nil
+	}
+	f.regConnectionsMutex.Lock()
+	if c, ok := f.regConnections[new]; ok && c != conn {
+		f.regConnectionsMutex.Unlock()
+		return ErrKeyInUse
+	}
+	c, registered := f.regConnections[old]
+	registered = registered && c == conn
+	conn.swapKey(new, nil)
+	if registered {
+		delete(f.regConnections, old)
+		f.regConnections[new] = conn
+		atomic.AddUint64(&f.regVersion, 1)
+	}
+	f.regConnectionsMutex.Unlock()
+
+	if ns := f.serviceDiscovery.rekey(old, new); ns != nil {
+		f.deleteStoredServices(old)
+		f.saveServices(new, ns)
+	}
+	conn.GetContextLogger().Infof("rotated key from %s", old.Hex())
+	f.publish(Event{Type: EVENT_KEY_ROTATED, Key: new, Peer: old, Conn: conn})
+	return nil
+}
@@ -0,0 +1,82 @@
+package factory
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRotateKey(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25965"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sub := s.Subscribe(0, EVENT_KEY_ROTATED)
+
+	connect := func(sc *SeedConfig) (*MessengerFactory, *Connection) {
+		f := NewMessengerFactory()
+		if err := f.ConnectWithConfig("127.0.0.1:25965", &ConnConfig{SeedConfig: sc}); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return f, conn
+	}
+	old, taken := NewSeedConfig(), NewSeedConfig()
+	c, conn := connect(old)
+	defer c.Close()
+	other, _ := connect(taken)
+	defer other.Close()
+	if err := conn.OfferService("rotate"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(s.serviceDiscovery.findByAttributes("rotate")) < 1; i++ {
+		if i > 50 {
+			t.Fatal("service not offered")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.RotateKey(ctx, taken); err == nil {
+		t.Fatal("rotated to the key of another conn")
+	}
+	if _, ok := s.GetConnection(old.publicKey); !ok || conn.GetKey() != old.publicKey {
+		t.Fatal("refused rotation changed the key")
+	}
+
+	sc := NewSeedConfig()
+	if err := conn.RotateKey(ctx, sc); err != nil {
+		t.Fatal(err)
+	}
+	if conn.GetKey() != sc.publicKey || conn.GetKeyProvider().PubKey() != sc.publicKey {
+		t.Fatal("client kept the old key")
+	}
+	if _, ok := s.GetConnection(old.publicKey); ok {
+		t.Fatal("old key still registered")
+	}
+	accepted, ok := s.GetConnection(sc.publicKey)
+	if !ok || accepted.GetKey() != sc.publicKey {
+		t.Fatal("new key not registered")
+	}
+	nodes := s.serviceDiscovery.findByAttributes("rotate")
+	if _, ok := nodes[sc.publicKey.Hex()]; !ok || len(nodes) != 1 {
+		t.Fatalf("services not moved to the new key %v", nodes)
+	}
+	select {
+	case e := <-sub.C:
+		if e.Key != sc.publicKey || e.Peer != old.publicKey {
+			t.Fatal("event of the wrong keys")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event of the rotation")
+	}
+
+	// the conn survives the rotation
+	if _, err := conn.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
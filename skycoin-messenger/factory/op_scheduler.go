@@ -0,0 +1,227 @@
+package factory
+
+import (
+	"fmt"
+	"sync"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+// ops queued per connection before its reads wait
+const DEFAULT_OP_QUEUE_SIZE = 16
+
+var ErrOPSchedulerClosed = cn.NewError(cn.ErrClosed, "op scheduler closed")
+
+// opQueue holds the ops of one connection, they run one at a time and in order
+type opQueue struct {
+	conn  *Connection
+	msgs  [][]byte
+	busy  bool
+	ready bool
+	err   error
+	// signaled when msgs has room or err is set
+	space *sync.Cond
+}
+
+// opScheduler runs the ops of the tcp connections on a fixed set of workers.
+// The connections with queued ops take turns, one op each, so a client flooding
+// cheap ops waits behind its own queue and not in front of the ops of others
+type opScheduler struct {
+	execute func(conn *Connection, m []byte) error
+	limits  map[byte]int
+	size    int
+
+	running map[byte]int
+	queues  map[*opQueue]struct{}
+	// connections with queued ops and none running, in turn order
+	ready  []*opQueue
+	closed bool
+	work   *sync.Cond
+	mutex  sync.Mutex
+}
+
+func newOPScheduler(workers, size int, limits map[byte]int, execute func(conn *Connection, m []byte) error) *opScheduler {
+	if size <= 0 {
+		size = DEFAULT_OP_QUEUE_SIZE
+	}
+	s := &opScheduler{
+		execute: execute,
+		limits:  make(map[byte]int),
+		size:    size,
+		running: make(map[byte]int),
+		queues:  make(map[*opQueue]struct{}),
+	}
+	for op, limit := range limits {
+		s.limits[op] = limit
+	}
+	s.work = sync.NewCond(&s.mutex)
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// loop reads the ops of conn into its queue until conn is closed or one of its
+// ops failed, it replaces callbackLoop
+func (s *opScheduler) loop(conn *Connection) (err error) {
+	q := &opQueue{conn: conn, space: sync.NewCond(&s.mutex)}
+	s.mutex.Lock()
+	s.queues[q] = struct{}{}
+	s.mutex.Unlock()
+	defer func() {
+		e := s.remove(q)
+		if err == nil {
+			err = e
+		}
+	}()
+	for {
+		m, ok := <-conn.GetChanIn()
+		if !ok {
+			return
+		}
+		if len(m) < MSG_HEADER_END {
+			return
+		}
+		err = s.push(q, m)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *opScheduler) push(q *opQueue, m []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(q.msgs) >= s.size && q.err == nil && !s.closed {
+		q.space.Wait()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	if s.closed {
+		return ErrOPSchedulerClosed
+	}
+	q.msgs = append(q.msgs, m)
+	if !q.busy && !q.ready {
+		q.ready = true
+		s.ready = append(s.ready, q)
+		s.work.Signal()
+	}
+	return nil
+}
+
+// remove drops the queued ops of q, an op still running finishes
+func (s *opScheduler) remove(q *opQueue) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.queues, q)
+	if q.ready {
+		for i, r := range s.ready {
+			if r == q {
+				s.ready = append(s.ready[:i], s.ready[i+1:]...)
+				break
+			}
+		}
+		q.ready = false
+	}
+	q.msgs = nil
+	err := q.err
+	if q.err == nil {
+		q.err = ErrOPSchedulerClosed
+	}
+	return err
+}
+
+// take must be called with the lock held, it skips the connections whose next
+// op is at its limit
+func (s *opScheduler) take() (*opQueue, []byte) {
+	if s.closed {
+		return nil, nil
+	}
+	for i, q := range s.ready {
+		op := q.msgs[0][MSG_OP_BEGIN]
+		if limit, ok := s.limits[op]; ok && s.running[op] >= limit {
+			continue
+		}
+		s.ready = append(s.ready[:i], s.ready[i+1:]...)
+		q.ready = false
+		q.busy = true
+		m := q.msgs[0]
+		q.msgs[0] = nil
+		q.msgs = q.msgs[1:]
+		s.running[op]++
+		q.space.Signal()
+		return q, m
+	}
+	return nil, nil
+}
+
+func (s *opScheduler) worker() {
+	s.mutex.Lock()
+	for {
+		q, m := s.take()
+		for q == nil {
+			if s.closed {
+				s.mutex.Unlock()
+				return
+			}
+			s.work.Wait()
+			q, m = s.take()
+		}
+		s.mutex.Unlock()
+
+		err := s.run(q.conn, m)
+		if err == ErrDetach {
+			err = nil
+		}
+		if err != nil {
+			q.conn.GetContextLogger().Debugf("err in %x", m)
+		}
+
+		s.mutex.Lock()
+		op := m[MSG_OP_BEGIN]
+		s.running[op]--
+		q.busy = false
+		if err != nil && q.err == nil {
+			q.err = err
+			q.msgs = nil
+			q.space.Signal()
+		}
+		if len(q.msgs) > 0 && q.err == nil {
+			q.ready = true
+			s.ready = append(s.ready, q)
+		}
+		if len(s.ready) > 0 {
+			s.work.Signal()
+		}
+		if err != nil {
+			s.mutex.Unlock()
+			// ends the loop of the connection
+			q.conn.Close()
+			s.mutex.Lock()
+		}
+	}
+}
+
+func (s *opScheduler) run(conn *Connection, m []byte) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("op recovered err %v", e)
+		}
+	}()
+	return s.execute(conn, m)
+}
+
+// close stops the workers once the running ops are done, queued ops are dropped
+func (s *opScheduler) close() {
+	s.mutex.Lock()
+	s.closed = true
+	for q := range s.queues {
+		q.ready = false
+		q.msgs = nil
+		q.space.Signal()
+	}
+	s.ready = nil
+	s.work.Broadcast()
+	s.mutex.Unlock()
+}
@@ -0,0 +1,87 @@
+package factory
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func opMsg(op byte) []byte {
+	m := make([]byte, MSG_HEADER_END)
+	m[MSG_OP_BEGIN] = op
+	return m
+}
+
+func TestOPSchedulerTakesTurns(t *testing.T) {
+	var order []*Connection
+	var mutex sync.Mutex
+	gate := make(chan struct{})
+	s := newOPScheduler(0, 100, nil, func(conn *Connection, m []byte) error {
+		<-gate
+		mutex.Lock()
+		order = append(order, conn)
+		mutex.Unlock()
+		return nil
+	})
+	defer s.close()
+
+	flood, other := &Connection{}, &Connection{}
+	fq := &opQueue{conn: flood, space: sync.NewCond(&s.mutex)}
+	oq := &opQueue{conn: other, space: sync.NewCond(&s.mutex)}
+	for i := 0; i < 10; i++ {
+		s.push(fq, opMsg(OP_QUERY_SERVICE_NODES))
+	}
+	s.push(oq, opMsg(OP_BUILD_APP_CONN))
+	close(gate)
+	go s.worker()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		n := len(order)
+		mutex.Unlock()
+		if n == 11 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ran %d ops", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if order[1] != other {
+		t.Fatal("op of the other connection waited behind the flood")
+	}
+}
+
+func TestOPSchedulerLimit(t *testing.T) {
+	var running, max int
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	s := newOPScheduler(4, 0, map[byte]int{OP_QUERY_BY_ATTRS: 1}, func(conn *Connection, m []byte) error {
+		mutex.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		wg.Done()
+		return nil
+	})
+	defer s.close()
+
+	for i := 0; i < 4; i++ {
+		q := &opQueue{conn: &Connection{}, space: sync.NewCond(&s.mutex)}
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			s.push(q, opMsg(OP_QUERY_BY_ATTRS))
+		}
+	}
+	wg.Wait()
+	if max != 1 {
+		t.Fatalf("%d ops ran at once", max)
+	}
+}
@@ -3,6 +3,7 @@ package factory
 import (
 	"sync"
 
+	cn "github.com/skycoin/net/conn"
 	"github.com/skycoin/skycoin/src/cipher"
 )
 
@@ -27,6 +28,10 @@ func (send *send) RawExecute(f *MessengerFactory, conn *Connection, m []byte) (r
 	f.regConnectionsMutex.RUnlock()
 	if !ok {
 		conn.GetContextLogger().Infof("Key %s not found", key.Hex())
+		cn.RecordDrop(cn.DROP_NO_ROUTE, conn.GetRemoteAddr(), m)
+		return
+	}
+	if !f.allowRelay(conn, m) {
 		return
 	}
 	err = c.Write(m)
@@ -34,6 +39,8 @@ func (send *send) RawExecute(f *MessengerFactory, conn *Connection, m []byte) (r
 		conn.GetContextLogger().Errorf("forward to Key %s err %v", key.Hex(), err)
 		c.GetContextLogger().Errorf("write %x err %v", m, err)
 		c.Close()
+		return
 	}
+	f.publishRelayed(conn, key, len(m))
 	return
 }
@@ -0,0 +1,33 @@
+package factory
+
+import (
+	"testing"
+)
+
+func TestPooledOPZeroed(t *testing.T) {
+	for _, body := range []string{`{"Context":{"operator":"acme"},"Compressions":["gzip"]}`, `{"Context":{"x":"1"}}`} {
+		reg := getOP(OP_REG_KEY).(*regWithKey)
+		if err := unmarshalOP([]byte(body), reg); err != nil {
+			t.Fatal(err)
+		}
+		putOP(OP_REG_KEY, reg)
+	}
+	reg := getOP(OP_REG_KEY).(*regWithKey)
+	if reg.Context != nil || reg.Compressions != nil {
+		t.Fatalf("reg from the pool %+v", reg)
+	}
+	if err := unmarshalOP([]byte(`{"Context":{"x":"1"}}`), reg); err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.Context) != 1 {
+		t.Fatalf("context %v", reg.Context)
+	}
+	putOP(OP_REG_KEY, reg)
+
+	r := getResp(OP_REG_KEY).(*regWithKeyResp)
+	r.Compression = "gzip"
+	putResp(OP_REG_KEY, r)
+	if r = getResp(OP_REG_KEY).(*regWithKeyResp); r.Compression != "" {
+		t.Fatalf("resp from the pool %+v", r)
+	}
+}
@@ -0,0 +1,136 @@
+package factory
+
+import (
+	"sync"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+var ErrOPTimeout = cn.NewError(cn.ErrTimeout, "no resp of the op before its timeout")
+
+// how long a client waits for the key when OP_REG_KEY has no policy
+const DEFAULT_REG_TIMEOUT = 15 * time.Second
+
+// OPPolicy is how long a client waits for the resp of an op. Ops safe to
+// repeat are sent again with the same seq, so the server answers the same
+// and the resps after the first one are dropped
+type OPPolicy struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// ops sent again after their timeout, queries only read
+var retryableOPs = map[byte]bool{
+	OP_QUERY_SERVICE_NODES: true,
+	OP_QUERY_BY_ATTRS:      true,
+}
+
+// DefaultOPPolicies waits long for reg and app conns, which wait for other
+// nodes, and retries the queries
+func DefaultOPPolicies() map[byte]OPPolicy {
+	return map[byte]OPPolicy{
+		OP_REG_KEY:             {Timeout: DEFAULT_REG_TIMEOUT},
+		OP_QUERY_SERVICE_NODES: {Timeout: 5 * time.Second, Retries: 2},
+		OP_QUERY_BY_ATTRS:      {Timeout: 5 * time.Second, Retries: 2},
+		OP_BUILD_APP_CONN:      {Timeout: 40 * time.Second},
+		OP_PING:                {Timeout: 5 * time.Second},
+	}
+}
+
+func (c *Connection) getOPPolicy(op byte) OPPolicy {
+	if c.factory == nil {
+		return OPPolicy{}
+	}
+	p, ok := c.factory.OPPolicies[op]
+	if !ok && c.IsAnonymous() {
+		p = anonymousOPPolicies[op]
+	}
+	return p
+}
+
+// the resp of an op is found by the seq of queries or the app of app conns
+type pendingOPKey struct {
+	op  byte
+	seq uint32
+	app cipher.PubKey
+}
+
+type pendingOP struct {
+	object  interface{}
+	retries int
+	timer   *time.Timer
+	sync.Mutex
+}
+
+// writeTrackedOP writes object and waits for the resp of key.op if the op has
+// a policy, see OPPolicy
+func (c *Connection) writeTrackedOP(key pendingOPKey, object interface{}) error {
+	p := c.getOPPolicy(key.op)
+	if p.Timeout > 0 {
+		op := &pendingOP{object: object, retries: p.Retries}
+		op.Lock()
+		c.pendingOPs.Store(key, op)
+		op.timer = time.AfterFunc(p.Timeout, func() { c.opTimeout(key, p.Timeout) })
+		op.Unlock()
+	}
+	return c.writeOP(key.op, object)
+}
+
+// opTimeout sends the op of key again or gives it up
+func (c *Connection) opTimeout(key pendingOPKey, timeout time.Duration) {
+	v, ok := c.pendingOPs.Load(key)
+	if !ok {
+		return
+	}
+	op := v.(*pendingOP)
+	op.Lock()
+	if op.retries > 0 && retryableOPs[key.op] && !c.IsClosed() {
+		op.retries--
+		op.timer.Reset(timeout)
+		op.Unlock()
+		c.GetContextLogger().Debugf("op %d seq %d timeout, retry", key.op, key.seq)
+		if err := c.writeOP(key.op, op.object); err == nil {
+			return
+		}
+	} else {
+		op.Unlock()
+	}
+	if _, ok := c.pendingOPs.LoadAndDelete(key); !ok {
+		return
+	}
+	op.timer.Stop()
+	c.GetContextLogger().Debugf("op %d seq %d timeout", key.op, key.seq)
+	switch key.op {
+	case OP_QUERY_SERVICE_NODES:
+		c.keysQueryResp(&QueryResp{Seq: key.seq, Err: ErrOPTimeout})
+	case OP_QUERY_BY_ATTRS:
+		c.attrsQueryResp(&QueryByAttrsResp{Seq: key.seq, Err: ErrOPTimeout})
+	case OP_BUILD_APP_CONN:
+		msg := PriorityMsg{Priority: Timeout, Msg: ErrOPTimeout.Error(), Type: Failed, Time: time.Now().Unix()}
+		c.PutMessage(msg)
+		resp := &AppConnResp{App: key.app, Failed: true, Msg: msg, Err: ErrOPTimeout}
+		if !c.dialed(resp) && c.hasAppConnCallback() {
+			c.appConnResp(resp)
+		}
+	}
+}
+
+// opResp returns false if the resp of key is late or came before, its op
+// was tracked then but is not anymore
+func (c *Connection) opResp(key pendingOPKey) bool {
+	if c.getOPPolicy(key.op).Timeout == 0 {
+		return true
+	}
+	v, ok := c.pendingOPs.LoadAndDelete(key)
+	if !ok {
+		c.GetContextLogger().Debugf("drop resp of op %d seq %d", key.op, key.seq)
+		return false
+	}
+	op := v.(*pendingOP)
+	op.Lock()
+	op.timer.Stop()
+	op.Unlock()
+	return true
+}
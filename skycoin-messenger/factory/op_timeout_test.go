@@ -0,0 +1,120 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestOPTimeout(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25949"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	queries := make(chan *QueryResp, 4)
+	apps := make(chan *AppConnResp, 4)
+	c := NewMessengerFactory()
+	c.OPPolicies = map[byte]OPPolicy{
+		OP_QUERY_SERVICE_NODES: {Timeout: 100 * time.Millisecond, Retries: 1},
+		OP_BUILD_APP_CONN:      {Timeout: 100 * time.Millisecond, Retries: 1},
+	}
+	defer c.Close()
+	err := c.ConnectWithConfig("127.0.0.1:25949", &ConnConfig{
+		SeedConfig:                     NewSeedConfig(),
+		FindServiceNodesByKeysCallback: func(resp *QueryResp) { queries <- resp },
+		AppConnectionInitCallback: func(resp *AppConnResp) *AppFeedback {
+			apps <- resp
+			return &AppFeedback{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client *Connection
+	c.ForEachConn(func(conn *Connection) { client = conn })
+
+	// answered once
+	if err = client.FindServiceNodesByKeys([]cipher.PubKey{{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-queries:
+		if resp.Err != nil {
+			t.Fatalf("query err %v", resp.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no query resp")
+	}
+
+	// the server only builds app conns as a node, the one retry is not safe
+	start := time.Now()
+	app, _ := cipher.GenerateKeyPair()
+	if err = client.BuildAppConnection(cipher.PubKey{0x02}, app); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-apps:
+		if resp.Err != ErrOPTimeout || !resp.Failed || resp.Msg.Priority != Timeout || resp.App != app {
+			t.Fatalf("app conn resp %#v", resp)
+		}
+		if d := time.Since(start); d > 190*time.Millisecond {
+			t.Fatalf("app conn retried, timeout after %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no app conn timeout")
+	}
+
+	select {
+	case resp := <-queries:
+		t.Fatalf("query resp again %#v", resp)
+	default:
+	}
+	if _, ok := client.pendingOPs.Load(pendingOPKey{op: OP_QUERY_SERVICE_NODES, seq: querySeq}); ok {
+		t.Fatal("query still pending")
+	}
+}
+
+func TestOPRetry(t *testing.T) {
+	// a proxy sends the query to the other nodes, there are none
+	s := NewMessengerFactory()
+	s.Proxy = true
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25950"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	queries := make(chan *QueryByAttrsResp, 4)
+	c := NewMessengerFactory()
+	c.OPPolicies = map[byte]OPPolicy{OP_QUERY_BY_ATTRS: {Timeout: 50 * time.Millisecond, Retries: 2}}
+	defer c.Close()
+	err := c.ConnectWithConfig("127.0.0.1:25950", &ConnConfig{
+		SeedConfig:                           NewSeedConfig(),
+		FindServiceNodesByAttributesCallback: func(resp *QueryByAttrsResp) { queries <- resp },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client *Connection
+	c.ForEachConn(func(conn *Connection) { client = conn })
+
+	start := time.Now()
+	if err = client.FindServiceNodesByAttributes("vpn"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-queries:
+		if resp.Err != ErrOPTimeout {
+			t.Fatalf("query err %v", resp.Err)
+		}
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Fatalf("timeout after %v without the retries", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no query timeout")
+	}
+}
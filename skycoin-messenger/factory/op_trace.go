@@ -0,0 +1,183 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func init() {
+	ops[OP_SEND_TRACED] = &sync.Pool{
+		New: func() interface{} {
+			return new(sendTraced)
+		},
+	}
+}
+
+type TraceLayer byte
+
+const (
+	// the sender called SendTraced
+	TRACE_APP TraceLayer = iota
+	// the server received the message and forwarded it
+	TRACE_RELAY_IN
+	TRACE_RELAY_OUT
+	// the destination connection received the message
+	TRACE_FACTORY
+)
+
+func (l TraceLayer) String() string {
+	switch l {
+	case TRACE_APP:
+		return "app"
+	case TRACE_RELAY_IN:
+		return "relay in"
+	case TRACE_RELAY_OUT:
+		return "relay out"
+	case TRACE_FACTORY:
+		return "factory"
+	}
+	return fmt.Sprintf("layer %d", l)
+}
+
+const (
+	TRACE_HOP_SIZE = 1 + 8
+	// count of hops
+	TRACE_HEADER_SIZE = 1
+	TRACE_MAX_HOPS    = 255
+)
+
+type TraceHop struct {
+	Layer TraceLayer
+	Time  time.Time
+}
+
+// Trace of the layers a message went through, in order
+type Trace struct {
+	Hops []TraceHop
+}
+
+// String lists each hop with the time since the previous one
+func (t *Trace) String() string {
+	var b bytes.Buffer
+	for i, h := range t.Hops {
+		if i > 0 {
+			b.WriteString(", ")
+			fmt.Fprintf(&b, "%s +%v", h.Layer, h.Time.Sub(t.Hops[i-1].Time))
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s", h.Layer, h.Time.Format(time.RFC3339Nano))
+	}
+	return b.String()
+}
+
+// SendTraced sends msg like Send, the server and the destination add their
+// timestamps and the destination hands the trace to OnTrace
+func (c *Connection) SendTraced(to cipher.PubKey, msg []byte) error {
+	m := make([]byte, SEND_MSG_META_END+TRACE_HEADER_SIZE+len(msg))
+	m[MSG_OP_BEGIN] = OP_SEND_TRACED
+	key := c.GetKey()
+	copy(m[SEND_MSG_PUBLIC_KEY_BEGIN:], key[:])
+	copy(m[SEND_MSG_TO_PUBLIC_KEY_BEGIN:], to[:])
+	copy(m[SEND_MSG_META_END+TRACE_HEADER_SIZE:], msg)
+	return c.Write(addTraceHop(m, TRACE_APP))
+}
+
+// addTraceHop returns a copy of the traced msg m with one more hop
+func addTraceHop(m []byte, layer TraceLayer) []byte {
+	if len(m) < SEND_MSG_META_END+TRACE_HEADER_SIZE {
+		return m
+	}
+	n := int(m[SEND_MSG_META_END])
+	if n >= TRACE_MAX_HOPS {
+		return m
+	}
+	end := SEND_MSG_META_END + TRACE_HEADER_SIZE + n*TRACE_HOP_SIZE
+	if len(m) < end {
+		return m
+	}
+	result := make([]byte, len(m)+TRACE_HOP_SIZE)
+	copy(result, m[:end])
+	result[SEND_MSG_META_END] = byte(n + 1)
+	result[end] = byte(layer)
+	binary.BigEndian.PutUint64(result[end+1:], uint64(time.Now().UnixNano()))
+	copy(result[end+TRACE_HOP_SIZE:], m[end:])
+	return result
+}
+
+// parseTrace splits the traced msg m into its trace and a plain OP_SEND msg
+func parseTrace(m []byte) (trace *Trace, send []byte, ok bool) {
+	if len(m) < SEND_MSG_META_END+TRACE_HEADER_SIZE {
+		return
+	}
+	n := int(m[SEND_MSG_META_END])
+	begin := SEND_MSG_META_END + TRACE_HEADER_SIZE
+	end := begin + n*TRACE_HOP_SIZE
+	if len(m) < end {
+		return
+	}
+	trace = &Trace{Hops: make([]TraceHop, n)}
+	for i := range trace.Hops {
+		h := m[begin+i*TRACE_HOP_SIZE:]
+		trace.Hops[i] = TraceHop{
+			Layer: TraceLayer(h[0]),
+			Time:  time.Unix(0, int64(binary.BigEndian.Uint64(h[1:TRACE_HOP_SIZE]))),
+		}
+	}
+	send = make([]byte, SEND_MSG_META_END+len(m)-end)
+	copy(send, m[:SEND_MSG_META_END])
+	send[MSG_OP_BEGIN] = OP_SEND
+	copy(send[SEND_MSG_META_END:], m[end:])
+	ok = true
+	return
+}
+
+type sendTraced struct {
+}
+
+// run on the server
+func (req *sendTraced) RawExecute(f *MessengerFactory, conn *Connection, m []byte) (rb []byte, err error) {
+	m = addTraceHop(m, TRACE_RELAY_IN)
+	if len(m) < SEND_MSG_META_END {
+		return
+	}
+	key := cipher.NewPubKey(m[SEND_MSG_TO_PUBLIC_KEY_BEGIN:SEND_MSG_TO_PUBLIC_KEY_END])
+	c, ok := f.GetConnection(key)
+	if !ok {
+		conn.GetContextLogger().Infof("Key %s not found", key.Hex())
+		cn.RecordDrop(cn.DROP_NO_ROUTE, conn.GetRemoteAddr(), m)
+		return
+	}
+	if !f.allowRelay(conn, m) {
+		return
+	}
+	err = c.Write(addTraceHop(m, TRACE_RELAY_OUT))
+	if err != nil {
+		conn.GetContextLogger().Errorf("forward to Key %s err %v", key.Hex(), err)
+		c.Close()
+		err = nil
+		return
+	}
+	f.publishRelayed(conn, key, len(m))
+	return
+}
+
+// run on the destination, returns the msg for GetChanIn
+func (c *Connection) receiveTraced(m []byte) []byte {
+	trace, send, ok := parseTrace(addTraceHop(m, TRACE_FACTORY))
+	if !ok {
+		return m
+	}
+	from := cipher.NewPubKey(send[SEND_MSG_PUBLIC_KEY_BEGIN:SEND_MSG_PUBLIC_KEY_END])
+	if c.factory.OnTrace != nil {
+		c.factory.OnTrace(c, from, trace)
+	} else {
+		c.GetContextLogger().Infof("trace from %s: %s", from.Hex(), trace)
+	}
+	return send
+}
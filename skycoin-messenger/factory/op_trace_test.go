@@ -0,0 +1,36 @@
+package factory
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestTraceHops(t *testing.T) {
+	from, _ := cipher.GenerateKeyPair()
+	to, _ := cipher.GenerateKeyPair()
+	m := make([]byte, SEND_MSG_META_END+TRACE_HEADER_SIZE+5)
+	m[MSG_OP_BEGIN] = OP_SEND_TRACED
+	copy(m[SEND_MSG_PUBLIC_KEY_BEGIN:], from[:])
+	copy(m[SEND_MSG_TO_PUBLIC_KEY_BEGIN:], to[:])
+	copy(m[SEND_MSG_META_END+TRACE_HEADER_SIZE:], "hello")
+	for _, l := range []TraceLayer{TRACE_APP, TRACE_RELAY_IN, TRACE_RELAY_OUT, TRACE_FACTORY} {
+		m = addTraceHop(m, l)
+	}
+	trace, send, ok := parseTrace(m)
+	if !ok {
+		t.Fatal("parse failed")
+	}
+	if len(trace.Hops) != 4 || trace.Hops[3].Layer != TRACE_FACTORY {
+		t.Fatalf("hops %v", trace)
+	}
+	for i := 1; i < len(trace.Hops); i++ {
+		if trace.Hops[i].Time.Before(trace.Hops[i-1].Time) {
+			t.Fatalf("hops out of order %v", trace)
+		}
+	}
+	if !bytes.Equal(send, GenSendMsg(from, to, []byte("hello"))) {
+		t.Fatalf("send msg %x", send)
+	}
+}
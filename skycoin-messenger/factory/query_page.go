@@ -0,0 +1,38 @@
+package factory
+
+import (
+	"sort"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func (f *MessengerFactory) queryLimit(limit int) int {
+	if f.MaxQueryResults > 0 && (limit <= 0 || limit > f.MaxQueryResults) {
+		return f.MaxQueryResults
+	}
+	return limit
+}
+
+// pageNodes returns the nodes of result after cursor in order of their keys,
+// at most limit if above 0, and the cursor of the page after
+func pageNodes(result map[string][]cipher.PubKey, cursor string, limit int) (page map[string][]cipher.PubKey, next string) {
+	if len(cursor) == 0 && (limit <= 0 || len(result) <= limit) {
+		return result, ""
+	}
+	nodes := make([]string, 0, len(result))
+	for node := range result {
+		if node > cursor {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	if limit > 0 && len(nodes) > limit {
+		nodes = nodes[:limit]
+		next = nodes[limit-1]
+	}
+	page = make(map[string][]cipher.PubKey, len(nodes))
+	for _, node := range nodes {
+		page[node] = result[node]
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package factory
+
+import (
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestPageNodes(t *testing.T) {
+	result := map[string][]cipher.PubKey{"a": nil, "b": nil, "c": nil, "d": nil, "e": nil}
+	var pages [][]string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		page, next := pageNodes(result, cursor, 2)
+		var nodes []string
+		for _, n := range []string{"a", "b", "c", "d", "e"} {
+			if _, ok := page[n]; ok {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) != len(page) {
+			t.Fatalf("page %v", page)
+		}
+		pages = append(pages, nodes)
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	if len(pages) != 3 || pages[0][1] != "b" || pages[1][0] != "c" || len(pages[2]) != 1 || pages[2][0] != "e" {
+		t.Fatalf("pages %v", pages)
+	}
+	if page, next := pageNodes(result, "", 0); len(page) != 5 || next != "" {
+		t.Fatalf("unlimited page %d next %q", len(page), next)
+	}
+
+	f := NewMessengerFactory()
+	f.MaxQueryResults = 3
+	if f.queryLimit(0) != 3 || f.queryLimit(10) != 3 || f.queryLimit(2) != 2 {
+		t.Fatal("server cap not applied")
+	}
+}
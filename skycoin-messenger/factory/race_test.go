@@ -0,0 +1,155 @@
+package factory
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// run with -race, connects, sends and closes from many goroutines at once
+func TestRaceConnectSendClose(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25940"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.CustomMsgHandler = func(c *Connection, b []byte) {}
+
+	const clients = 8
+	var keys []cipher.PubKey
+	var factories []*MessengerFactory
+	for i := 0; i < clients; i++ {
+		c := NewMessengerFactory()
+		sc := NewSeedConfig()
+		keys = append(keys, sc.publicKey)
+		factories = append(factories, c)
+		defer c.Close()
+		go func() {
+			c.ConnectWithConfig("127.0.0.1:25940", &ConnConfig{SeedConfig: sc})
+		}()
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i, c := range factories {
+		to := keys[(i+1)%clients]
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.ForEachConn(func(conn *Connection) {
+					conn.Send(to, []byte("race"))
+					conn.SendCustom([]byte("race"))
+					conn.GetKey()
+					conn.IsClosed()
+					conn.Stats()
+				})
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.ForEachConn(func(conn *Connection) {
+					select {
+					case <-conn.GetChanIn():
+					default:
+					}
+				})
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.ForEachAcceptedConnection(func(key cipher.PubKey, conn *Connection) {
+				conn.Stats()
+			})
+			for _, k := range keys {
+				s.GetConnection(k)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	var closing sync.WaitGroup
+	for i, c := range factories {
+		if i%2 == 0 {
+			continue
+		}
+		c := c
+		closing.Add(2)
+		go func() {
+			defer closing.Done()
+			c.ForEachConn(func(conn *Connection) { conn.Close() })
+		}()
+		go func() {
+			defer closing.Done()
+			c.Close()
+		}()
+	}
+	closing.Wait()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
+
+// run with -race, a udp conn between two messenger factories
+func TestRaceUDPSendClose(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25941"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.CustomMsgHandler = func(c *Connection, b []byte) {}
+
+	c := NewMessengerFactory()
+	c.SetDefaultSeedConfig(NewSeedConfig())
+	if err := c.Listen("127.0.0.1:25942"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := c.connectUDPWithConfig("127.0.0.1:25941", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200 && !conn.IsClosed(); j++ {
+				conn.SendCustom([]byte("race"))
+				conn.Stats()
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	wg.Wait()
+}
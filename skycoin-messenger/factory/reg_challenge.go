@@ -0,0 +1,75 @@
+package factory
+
+import (
+	"errors"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	REG_CHALLENGE_SIZE = 32
+	// prefix of the signed challenge, so the signature is of no use outside a reg
+	REG_CHALLENGE_DOMAIN = "skycoin-net/reg-challenge"
+)
+
+var (
+	ErrRegChallenge = cn.NewError(cn.ErrUnauthorized, "reg without an answer to the challenge")
+	ErrRegVersion   = errors.New("reg sig of another version than the reg key")
+)
+
+// regChallengeHash is what the client signs at reg, the challenge of the
+// server bound to the key the client registers and the key of the server.
+// The cipher suites the client offered and the one the server chose are bound
+// too if it offered any, so a downgrade to the stream cipher fails the reg
+func regChallengeHash(challenge []byte, client, server cipher.PubKey, suites []string, suite string) cipher.SHA256 {
+	b := make([]byte, 0, len(REG_CHALLENGE_DOMAIN)+len(challenge)+len(client)+len(server))
+	b = append(b, REG_CHALLENGE_DOMAIN...)
+	b = append(b, challenge...)
+	b = append(b, client[:]...)
+	b = append(b, server[:]...)
+	if len(suites) > 0 {
+		for _, s := range suites {
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+		b = append(b, byte(len(suite)))
+		b = append(b, suite...)
+	}
+	return cipher.SumSHA256(b)
+}
+
+// regSuiteChoice is the negotiation of the cipher suite at reg, see
+// regChallengeHash
+type regSuiteChoice struct {
+	offered []string
+	chosen  string
+}
+
+// verifyRegChallenge checks the answer of the client to the challenge of
+// the server, it is used once. Clients that sign the bare hash of the reg
+// are accepted unless MessengerFactory.RequireRegChallenge
+func (f *MessengerFactory) verifyRegChallenge(conn *Connection, pk cipher.PubKey, sig cipher.Sig, challenged bool, hash cipher.SHA256) (err error) {
+	v, _ := conn.context.Load(regChallenge)
+	conn.context.Delete(regChallenge)
+	if !challenged {
+		if f.RequireRegChallenge {
+			return ErrRegChallenge
+		}
+		return cipher.VerifySignature(pk, sig, hash)
+	}
+	challenge, ok := v.([]byte)
+	if !ok {
+		return ErrRegChallenge
+	}
+	sc := f.GetDefaultSeedConfig()
+	if sc == nil {
+		return errors.New("GetDefaultSeedConfig is nil")
+	}
+	var suites regSuiteChoice
+	if v, ok := conn.context.Load(regSuites); ok {
+		conn.context.Delete(regSuites)
+		suites, _ = v.(regSuiteChoice)
+	}
+	return cipher.VerifySignature(pk, sig, regChallengeHash(challenge, pk, sc.publicKey, suites.offered, suites.chosen))
+}
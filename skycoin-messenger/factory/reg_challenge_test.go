@@ -0,0 +1,47 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+func TestRegChallenge(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	s.RequireRegChallenge = true
+	if err := s.Listen("127.0.0.1:25966"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sc := NewSeedConfig()
+	c := NewMessengerFactory()
+	if err := c.ConnectWithConfig("127.0.0.1:25966", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; ; i++ {
+		if _, ok := s.GetConnection(sc.publicKey); ok {
+			break
+		}
+		if i > 50 {
+			t.Fatal("client answering the challenge not registered")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	challenge := []byte("challenge")
+	client, server := NewSeedConfig().publicKey, s.GetDefaultSeedConfig().publicKey
+	hash := regChallengeHash(challenge, client, server, nil, "")
+	if hash == regChallengeHash(challenge, server, client, nil, "") || hash == regChallengeHash([]byte("other"), client, server, nil, "") {
+		t.Fatal("challenge hash not bound to the keys")
+	}
+	offered := []string{cn.CIPHER_SUITE_AES_GCM}
+	hash = regChallengeHash(challenge, client, server, offered, cn.CIPHER_SUITE_AES_GCM)
+	if hash == regChallengeHash(challenge, client, server, offered, cn.CIPHER_SUITE_AES_CFB) ||
+		hash == regChallengeHash(challenge, client, server, nil, cn.CIPHER_SUITE_AES_GCM) {
+		t.Fatal("challenge hash not bound to the cipher suites")
+	}
+}
@@ -0,0 +1,194 @@
+package factory
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// buckets not taken from for this long are full again and forgotten
+const REG_LIMIT_IDLE = 10 * time.Second
+
+var ErrRegLimited = cn.NewError(cn.ErrUnauthorized, "too many regs")
+
+// RegLimits caps the regs and the queries of the clients of a server per
+// second, by the ip of the client and by its key. A conn over a reg limit is
+// closed, a query over a limit is dropped. Bursts of up to one second are
+// allowed
+type RegLimits struct {
+	// OP_REG and OP_REG_KEY, unlimited if 0. The regs of a key are counted
+	// once its signature was verified
+	RegPerIP  int
+	RegPerKey int
+	// OP_QUERY_SERVICE_NODES, OP_QUERY_BY_ATTRS and the routes opened by
+	// STREAM_ROUTE, unlimited if 0
+	QueryPerIP  int
+	QueryPerKey int
+
+	stats   RegLimitStats
+	buckets map[regLimitKey]*regLimitBucket
+	swept   time.Time
+	sync.Mutex
+}
+
+// RegLimitStats counts the ops seen and the ones over a limit
+type RegLimitStats struct {
+	Regs                uint64
+	RegsLimitedByIP     uint64
+	RegsLimitedByKey    uint64
+	Queries             uint64
+	QueriesLimitedByIP  uint64
+	QueriesLimitedByKey uint64
+}
+
+type regLimitKey struct {
+	query bool
+	// ip or hex key
+	id string
+}
+
+type regLimitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token of the bucket of k, true if unlimited
+func (l *RegLimits) take(k regLimitKey, rate int) bool {
+	if rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[regLimitKey]*regLimitBucket)
+	}
+	if now.Sub(l.swept) > REG_LIMIT_IDLE {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > REG_LIMIT_IDLE {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &regLimitBucket{tokens: float64(rate), last: now}
+		l.buckets[k] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowIP counts an op of a client at ip
+func (l *RegLimits) allowIP(query bool, ip string) bool {
+	if query {
+		atomic.AddUint64(&l.stats.Queries, 1)
+		if !l.take(regLimitKey{query: true, id: ip}, l.QueryPerIP) {
+			atomic.AddUint64(&l.stats.QueriesLimitedByIP, 1)
+			return false
+		}
+		return true
+	}
+	atomic.AddUint64(&l.stats.Regs, 1)
+	if !l.take(regLimitKey{id: ip}, l.RegPerIP) {
+		atomic.AddUint64(&l.stats.RegsLimitedByIP, 1)
+		return false
+	}
+	return true
+}
+
+// allowKey checks an op of the client of key, already counted by allowIP
+func (l *RegLimits) allowKey(query bool, key cipher.PubKey) bool {
+	if query {
+		if !l.take(regLimitKey{query: true, id: key.Hex()}, l.QueryPerKey) {
+			atomic.AddUint64(&l.stats.QueriesLimitedByKey, 1)
+			return false
+		}
+		return true
+	}
+	if !l.take(regLimitKey{id: key.Hex()}, l.RegPerKey) {
+		atomic.AddUint64(&l.stats.RegsLimitedByKey, 1)
+		return false
+	}
+	return true
+}
+
+// Stats returns the counters since the server started
+func (l *RegLimits) Stats() RegLimitStats {
+	return RegLimitStats{
+		Regs:                atomic.LoadUint64(&l.stats.Regs),
+		RegsLimitedByIP:     atomic.LoadUint64(&l.stats.RegsLimitedByIP),
+		RegsLimitedByKey:    atomic.LoadUint64(&l.stats.RegsLimitedByKey),
+		Queries:             atomic.LoadUint64(&l.stats.Queries),
+		QueriesLimitedByIP:  atomic.LoadUint64(&l.stats.QueriesLimitedByIP),
+		QueriesLimitedByKey: atomic.LoadUint64(&l.stats.QueriesLimitedByKey),
+	}
+}
+
+func isRegOP(op byte) bool {
+	return op == OP_REG || op == OP_REG_KEY
+}
+
+// isQueryOP is true of OP_STREAM as only its STREAM_ROUTE frames are checked,
+// see allowRoute
+func isQueryOP(op byte) bool {
+	return op == OP_QUERY_SERVICE_NODES || op == OP_QUERY_BY_ATTRS || op == OP_STREAM
+}
+
+// remoteIP is the host of the address of conn, the whole address if it has
+// no port
+func remoteIP(conn *Connection) string {
+	addr := conn.GetRemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// allowOPRate checks the reg and query ops of conn against RegLimits, the
+// regs by key are checked once the key is read in regWithKey
+func (f *MessengerFactory) allowOPRate(conn *Connection, op byte) bool {
+	l := f.RegLimits
+	if l == nil {
+		return true
+	}
+	query := isQueryOP(op)
+	if !query && !isRegOP(op) {
+		return true
+	}
+	if !l.allowIP(query, remoteIP(conn)) {
+		conn.GetContextLogger().Debugf("op %d over the limit of ip %s", op, remoteIP(conn))
+		return false
+	}
+	if query && conn.IsKeySet() && !l.allowKey(true, conn.GetKey()) {
+		conn.GetContextLogger().Debugf("op %d over the limit of its key", op)
+		return false
+	}
+	return true
+}
+
+// allowRegKey checks the reg of key against RegLimits.RegPerKey
+func (f *MessengerFactory) allowRegKey(conn *Connection, key cipher.PubKey) bool {
+	if f.RegLimits == nil || f.RegLimits.allowKey(false, key) {
+		return true
+	}
+	conn.GetContextLogger().Debugf("reg over the limit of key %s", key.Hex())
+	return false
+}
@@ -0,0 +1,94 @@
+package factory
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRegLimits(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	s.RegLimits = &RegLimits{RegPerIP: 2, QueryPerKey: 1}
+	if err := s.Listen("127.0.0.1:25967"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	connect := func() (closed bool) {
+		c := NewMessengerFactory()
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err := c.ConnectWithConfigContext(ctx, "127.0.0.1:25967", &ConnConfig{SeedConfig: NewSeedConfig()})
+		if err != nil {
+			return true
+		}
+		closed = true
+		c.ForEachConn(func(conn *Connection) { closed = !conn.IsKeySet() })
+		return
+	}
+	for i := 0; i < 2; i++ {
+		if connect() {
+			t.Fatal("reg within the limit refused")
+		}
+	}
+	if !connect() {
+		t.Fatal("reg over the limit of the ip accepted")
+	}
+
+	key := NewSeedConfig().publicKey
+	l := s.RegLimits
+	if !l.allowKey(true, key) || l.allowKey(true, key) {
+		t.Fatal("query limit of the key")
+	}
+	stats := l.Stats()
+	if stats.Regs != 3 || stats.RegsLimitedByIP != 1 || stats.QueriesLimitedByKey != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	time.Sleep(time.Second)
+	if !l.allowKey(true, key) {
+		t.Fatal("bucket not refilled")
+	}
+}
+
+func TestRegLimitsByProvenKey(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	s.RegLimits = &RegLimits{RegPerKey: 1}
+	if err := s.Listen("127.0.0.1:25989"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	connect := func(sc *SeedConfig) (registered bool) {
+		c := NewMessengerFactory()
+		defer c.Close()
+		err := c.ConnectWithConfig("127.0.0.1:25989", &ConnConfig{SeedConfig: sc})
+		if err != nil {
+			return
+		}
+		for i := 0; i < 50 && !registered; i++ {
+			time.Sleep(10 * time.Millisecond)
+			c.ForEachConn(func(conn *Connection) { registered = conn.IsKeySet() })
+		}
+		return
+	}
+	victim := NewSeedConfig()
+	// the key of victim claimed without its secret key
+	impostor := &SeedConfig{PublicKey: victim.PublicKey, SecKey: NewSeedConfig().SecKey}
+	for i := 0; i < 3; i++ {
+		if connect(impostor) {
+			t.Fatal("reg with a wrong signature")
+		}
+	}
+	if !connect(victim) {
+		t.Fatal("key locked out by regs it did not sign")
+	}
+	if connect(victim) {
+		t.Fatal("reg over the limit of the key accepted")
+	}
+	if stats := s.RegLimits.Stats(); stats.RegsLimitedByKey != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
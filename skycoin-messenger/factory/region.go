@@ -0,0 +1,197 @@
+package factory
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// orders of the nodes in a resp to OP_QUERY_BY_ATTRS
+const (
+	// by the keys of the nodes
+	QUERY_ORDER_KEY = ""
+	// the nodes in the region of the query first, then the ones sharing the
+	// most leading parts of it split by '-', e.g. "eu-west" before "us-east"
+	// for "eu-north". Nodes without a region come last
+	QUERY_ORDER_NEAREST = "nearest"
+)
+
+// distance of a node of no region or a query of none
+const REGION_DISTANCE_UNKNOWN = 1 << 16
+
+var ErrNoServiceNode = errors.New("no node offers the service")
+
+// regionDistance is 0 for the same region, more the less leading parts a and
+// b have in common
+func regionDistance(a, b string) int {
+	if len(a) < 1 || len(b) < 1 {
+		return REGION_DISTANCE_UNKNOWN
+	}
+	pa, pb := strings.Split(a, "-"), strings.Split(b, "-")
+	common := 0
+	for common < len(pa) && common < len(pb) && pa[common] == pb[common] {
+		common++
+	}
+	if len(pa) > len(pb) {
+		return len(pa) - common
+	}
+	return len(pb) - common
+}
+
+// region returns the region of the service key
+func (ns *NodeServices) region(key cipher.PubKey) string {
+	for _, s := range ns.Services {
+		if s.Key == key {
+			return s.Region
+		}
+	}
+	return ""
+}
+
+// findRegions returns the region of each node in nodes, a result of
+// findByAttributes, the one of its first service that has a region
+func (sd *serviceDiscovery) findRegions(nodes map[string][]cipher.PubKey) map[string]string {
+	sd.subscription2SubscriberMutex.RLock()
+	defer sd.subscription2SubscriberMutex.RUnlock()
+
+	regions := make(map[string]string, len(nodes))
+	for node, keys := range nodes {
+		nodeKey, err := cipher.PubKeyFromHex(node)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			m, ok := sd.subscription2Subscriber[key]
+			if !ok {
+				continue
+			}
+			ns, ok := m.Nodes[nodeKey]
+			if !ok {
+				continue
+			}
+			if r := ns.region(key); len(r) > 0 {
+				regions[node] = r
+				break
+			}
+		}
+	}
+	return regions
+}
+
+// pageNearestNodes is pageNodes in order of the distance of the nodes to
+// region, the order of the page is returned too. The cursor holds the
+// distance of the last node so the next page starts after it
+func pageNearestNodes(result map[string][]cipher.PubKey, regions map[string]string, region, cursor string, limit int) (page map[string][]cipher.PubKey, order []string, next string) {
+	type near struct {
+		node     string
+		distance int
+	}
+	after := near{distance: -1}
+	if i := strings.IndexByte(cursor, ':'); i > 0 {
+		if d, err := strconv.Atoi(cursor[:i]); err == nil {
+			after = near{node: cursor[i+1:], distance: d}
+		}
+	}
+	less := func(a, b near) bool {
+		if a.distance != b.distance {
+			return a.distance < b.distance
+		}
+		return a.node < b.node
+	}
+	nodes := make([]near, 0, len(result))
+	for node := range result {
+		n := near{node: node, distance: regionDistance(region, regions[node])}
+		if less(after, n) {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return less(nodes[i], nodes[j])
+	})
+	if limit > 0 && len(nodes) > limit {
+		nodes = nodes[:limit]
+		last := nodes[limit-1]
+		next = strconv.Itoa(last.distance) + ":" + last.node
+	}
+	page = make(map[string][]cipher.PubKey, len(nodes))
+	order = make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		page[n.node] = result[n.node]
+		order = append(order, n.node)
+	}
+	return
+}
+
+// NearestNode returns the first node of Nearest offering service, of Result
+// if the resp is not in QUERY_ORDER_NEAREST. Any service if service is empty
+func (resp *QueryByAttrsResp) NearestNode(service cipher.PubKey) (node cipher.PubKey, ok bool) {
+	order := resp.Nearest
+	if len(order) < 1 {
+		order = make([]string, 0, len(resp.Result))
+		for n := range resp.Result {
+			order = append(order, n)
+		}
+		sort.Strings(order)
+	}
+	for _, n := range order {
+		for _, key := range resp.Result[n] {
+			if service != EMPATY_PUBLIC_KEY && key != service {
+				continue
+			}
+			node, err := cipher.PubKeyFromHex(n)
+			if err != nil {
+				break
+			}
+			return node, true
+		}
+	}
+	return
+}
+
+// BuildNearestAppConnection builds the app connection to app on the nearest
+// node of resp offering it, see ConnConfig.Region
+func (c *Connection) BuildNearestAppConnection(resp *QueryByAttrsResp, app cipher.PubKey) error {
+	node, ok := resp.NearestNode(app)
+	if !ok {
+		return ErrNoServiceNode
+	}
+	return c.BuildAppConnection(node, app)
+}
+
+// newQueryByAttrs asks for the nearest nodes first if the conn knows its
+// region
+func (c *Connection) newQueryByAttrs(attrs []string) *queryByAttrs {
+	q := newQueryByAttrs(attrs)
+	if len(c.region) > 0 {
+		q.Order, q.Region = QUERY_ORDER_NEAREST, c.region
+	}
+	return q
+}
+
+// withRegion gives the services of ns without a region the one of the conn
+func (c *Connection) withRegion(ns *NodeServices) *NodeServices {
+	if ns == nil || len(c.region) < 1 {
+		return ns
+	}
+	var services []*Service
+	for i, s := range ns.Services {
+		if len(s.Region) > 0 {
+			continue
+		}
+		if services == nil {
+			services = append([]*Service(nil), ns.Services...)
+		}
+		withRegion := *s
+		withRegion.Region = c.region
+		services[i] = &withRegion
+	}
+	if services == nil {
+		return ns
+	}
+	r := *ns
+	r.Services = services
+	return &r
+}
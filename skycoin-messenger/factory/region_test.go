@@ -0,0 +1,59 @@
+package factory
+
+import (
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestNearestQuery(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		distance int
+	}{
+		{"eu-north", "eu-north", 0},
+		{"eu-north", "eu-west", 1},
+		{"eu", "eu-west-1", 2},
+		{"eu-north", "us-east", 2},
+		{"eu-north", "", REGION_DISTANCE_UNKNOWN},
+	} {
+		if d := regionDistance(c.a, c.b); d != c.distance {
+			t.Fatalf("distance %s %s %d", c.a, c.b, d)
+		}
+	}
+
+	f := NewMessengerFactory()
+	regions := []string{"us-east", "", "eu-west", "eu-north"}
+	nodes := make([]cipher.PubKey, len(regions))
+	for i, region := range regions {
+		nodes[i] = NewSeedConfig().publicKey
+		f.restore(nodes[i], &NodeServices{Services: []*Service{{Key: nodes[i], Attributes: []string{"vpn"}, Region: region}}})
+	}
+	query := func(cursor string) *QueryByAttrsResp {
+		r, err := (&queryByAttrs{Attrs: []string{"vpn"}, Order: QUERY_ORDER_NEAREST, Region: "eu-north", Limit: 2, Cursor: cursor}).Execute(f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.(*QueryByAttrsResp)
+	}
+	resp := query("")
+	if len(resp.Nearest) != 2 || resp.Nearest[0] != nodes[3].Hex() || resp.Nearest[1] != nodes[2].Hex() || len(resp.Next) < 1 {
+		t.Fatalf("first page %v next %s", resp.Nearest, resp.Next)
+	}
+	if node, ok := resp.NearestNode(nodes[2]); !ok || node != nodes[2] {
+		t.Fatal("nearest node offering the service")
+	}
+	if node, _ := resp.NearestNode(cipher.PubKey{}); node != nodes[3] {
+		t.Fatal("nearest node")
+	}
+	resp = query(resp.Next)
+	if len(resp.Nearest) != 2 || resp.Nearest[0] != nodes[0].Hex() || resp.Nearest[1] != nodes[1].Hex() || len(resp.Next) > 0 {
+		t.Fatalf("last page %v next %s", resp.Nearest, resp.Next)
+	}
+
+	c := &Connection{region: "eu-north"}
+	ns := &NodeServices{Services: []*Service{{Key: nodes[0]}, {Key: nodes[1], Region: "us-east"}}}
+	if r := c.withRegion(ns); r.Services[0].Region != "eu-north" || r.Services[1].Region != "us-east" || len(ns.Services[0].Region) > 0 {
+		t.Fatal("region of the offered services")
+	}
+}
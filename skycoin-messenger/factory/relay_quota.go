@@ -0,0 +1,155 @@
+package factory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// RelayQuotas divides the bytes a server relays between nodes into the pools
+// of their operators, taken from the ENROLLMENT_ACCOUNT_CONTEXT of the sender,
+// see Enrollment. Nodes of no operator share the default pool. A message over
+// the quota of its pool is dropped
+type RelayQuotas struct {
+	// bytes/sec of a pool without a limit of its own, unlimited if 0
+	DefaultLimit int
+
+	pools map[string]*relayPool
+	sync.Mutex
+}
+
+// RelayUsage is what the nodes of an operator relayed
+type RelayUsage struct {
+	// hex of the account, empty for the default pool
+	Operator string
+	// bytes/sec, unlimited if 0
+	Limit           int
+	Bytes           uint64
+	Messages        uint64
+	DroppedBytes    uint64
+	DroppedMessages uint64
+}
+
+type relayPool struct {
+	limit  int
+	own    bool
+	tokens float64
+	last   time.Time
+	usage  RelayUsage
+}
+
+// operatorPool returns the pool name of operator, the empty key is the
+// default pool
+func operatorPool(operator cipher.PubKey) string {
+	if operator == (cipher.PubKey{}) {
+		return ""
+	}
+	return operator.Hex()
+}
+
+func NewRelayQuotas(defaultLimit int) *RelayQuotas {
+	return &RelayQuotas{DefaultLimit: defaultLimit, pools: make(map[string]*relayPool)}
+}
+
+func (q *RelayQuotas) pool(operator string) *relayPool {
+	p, ok := q.pools[operator]
+	if !ok {
+		p = &relayPool{limit: q.DefaultLimit, last: time.Now()}
+		p.tokens = float64(p.limit)
+		p.usage.Operator = operator
+		q.pools[operator] = p
+	}
+	if !p.own {
+		p.limit = q.DefaultLimit
+	}
+	return p
+}
+
+// SetLimit sets the bytes/sec of the pool of operator, unlimited if 0
+func (q *RelayQuotas) SetLimit(operator cipher.PubKey, bytesPerSecond int) {
+	q.Lock()
+	p := q.pool(operatorPool(operator))
+	p.limit, p.own = bytesPerSecond, true
+	if p.tokens > float64(p.limit) {
+		p.tokens = float64(p.limit)
+	}
+	q.Unlock()
+}
+
+// ResetLimit makes the pool of operator use DefaultLimit again
+func (q *RelayQuotas) ResetLimit(operator cipher.PubKey) {
+	q.Lock()
+	q.pool(operatorPool(operator)).own = false
+	q.Unlock()
+}
+
+// Usage returns the usage of the pool of operator
+func (q *RelayQuotas) Usage(operator cipher.PubKey) RelayUsage {
+	q.Lock()
+	defer q.Unlock()
+	p, ok := q.pools[operatorPool(operator)]
+	if !ok {
+		return RelayUsage{Operator: operatorPool(operator), Limit: q.DefaultLimit}
+	}
+	q.pool(p.usage.Operator)
+	p.usage.Limit = p.limit
+	return p.usage
+}
+
+// AllUsage returns the usage of every pool that relayed or has a limit of
+// its own, the default pool first
+func (q *RelayQuotas) AllUsage() (r []RelayUsage) {
+	q.Lock()
+	for _, p := range q.pools {
+		q.pool(p.usage.Operator)
+		p.usage.Limit = p.limit
+		r = append(r, p.usage)
+	}
+	q.Unlock()
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Operator < r[j].Operator
+	})
+	return
+}
+
+// allow takes n bytes from the pool of operator
+func (q *RelayQuotas) allow(operator string, n int) bool {
+	q.Lock()
+	defer q.Unlock()
+	p := q.pool(operator)
+	if p.limit > 0 {
+		now := time.Now()
+		p.tokens += now.Sub(p.last).Seconds() * float64(p.limit)
+		if p.tokens > float64(p.limit) {
+			p.tokens = float64(p.limit)
+		}
+		p.last = now
+		// a message larger than the limit takes the tokens of the seconds after it
+		if p.tokens <= 0 {
+			p.usage.DroppedBytes += uint64(n)
+			p.usage.DroppedMessages++
+			return false
+		}
+		p.tokens -= float64(n)
+	}
+	p.usage.Bytes += uint64(n)
+	p.usage.Messages++
+	return true
+}
+
+// allowRelay reports whether the message m of conn fits the quota of its
+// operator
+func (f *MessengerFactory) allowRelay(conn *Connection, m []byte) bool {
+	if f.RelayQuotas == nil {
+		return true
+	}
+	operator, _ := conn.LoadContext(ENROLLMENT_ACCOUNT_CONTEXT)
+	s, _ := operator.(string)
+	if f.RelayQuotas.allow(s, len(m)) {
+		return true
+	}
+	conn.GetContextLogger().Debugf("relay quota of operator %q exceeded, drop %d bytes", s, len(m))
+	return false
+}
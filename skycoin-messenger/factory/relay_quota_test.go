@@ -0,0 +1,45 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestRelayQuotas(t *testing.T) {
+	q := NewRelayQuotas(1000)
+	a, b := NewSeedConfig().publicKey, NewSeedConfig().publicKey
+	q.SetLimit(a, 100)
+
+	if !q.allow(a.Hex(), 80) || !q.allow(a.Hex(), 80) {
+		t.Fatal("first messages of a dropped")
+	}
+	if q.allow(a.Hex(), 10) {
+		t.Fatal("a over quota allowed")
+	}
+	// the pools are apart
+	if !q.allow(b.Hex(), 500) || !q.allow("", 500) {
+		t.Fatal("b or default pool dropped")
+	}
+
+	u := q.Usage(a)
+	if u.Limit != 100 || u.Bytes != 160 || u.Messages != 2 || u.DroppedBytes != 10 || u.DroppedMessages != 1 {
+		t.Fatalf("usage of a %+v", u)
+	}
+	if u = q.Usage(cipher.PubKey{}); u.Operator != "" || u.Bytes != 500 || u.Limit != 1000 {
+		t.Fatalf("usage of the default pool %+v", u)
+	}
+	if all := q.AllUsage(); len(all) != 3 || all[0].Operator != "" {
+		t.Fatalf("all usage %+v", all)
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	if !q.allow(a.Hex(), 10) {
+		t.Fatal("a not refilled")
+	}
+	q.ResetLimit(a)
+	if u = q.Usage(a); u.Limit != 1000 {
+		t.Fatalf("limit of a %d after reset", u.Limit)
+	}
+}
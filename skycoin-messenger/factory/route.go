@@ -0,0 +1,262 @@
+package factory
+
+import (
+	"context"
+	"crypto/aes"
+	cipher2 "crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// relays and the node of the app a route may pass
+	ROUTE_MAX_HOPS = 8
+	// the node of the app answers it once it connected to the app
+	ROUTE_OK byte = 1
+	// of the key of a layer and its tag
+	ROUTE_LAYER_OVERHEAD = MSG_PUBLIC_KEY_SIZE + 16
+	// the node of the app waits this long for it to accept
+	ROUTE_DIAL_TIMEOUT = 10 * time.Second
+	// routes relayed at once for the peer of a conn, the newer ones are reset
+	ROUTE_MAX_STREAMS = 16
+)
+
+var (
+	ErrRouteHops   = errors.New("route needs 1 to ROUTE_MAX_HOPS hops")
+	ErrRouteLayer  = errors.New("route layer can not be opened")
+	ErrRouteFailed = cn.NewError(cn.ErrNotFound, "route not built")
+)
+
+// DialRoute builds an app connection to app through a chain of nodes, hops
+// are their keys from the peer of c to the node of app. Each hop is a stream
+// on the conn to the next one and is set up by a layer sealed to its node,
+// the layer holds the key of the next node only, so no relay learns the
+// others. A hop is reached by the conn it registered with or the conn to it
+// connected with its TargetKey. The route is torn down hop by hop once either
+// end closes it or a conn on the way closes
+func (c *Connection) DialRoute(ctx context.Context, hops []cipher.PubKey, app cipher.PubKey) (conn net.Conn, err error) {
+	layer, err := routeLayers(hops, app)
+	if err != nil {
+		return
+	}
+	s, err := c.openStream(STREAM_ROUTE, layer)
+	if err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := io.ReadFull(s, b[:])
+		if err == nil && b[0] != ROUTE_OK {
+			err = ErrRouteFailed
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			c.GetContextLogger().Debugf("route to app %x err %v", app, err)
+			err = ErrRouteFailed
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		s.Close()
+		return
+	}
+	return s, nil
+}
+
+// routeLayers seals the layer of each hop, the first one is sent
+func routeLayers(hops []cipher.PubKey, app cipher.PubKey) (layer []byte, err error) {
+	if len(hops) < 1 || len(hops) > ROUTE_MAX_HOPS {
+		return nil, ErrRouteHops
+	}
+	// the node of app has no next hop
+	layer = app[:]
+	var next cipher.PubKey
+	for i := len(hops) - 1; i >= 0; i-- {
+		plain := append(next[:], layer...)
+		layer, err = sealRouteLayer(hops[i], plain)
+		if err != nil {
+			return
+		}
+		next = hops[i]
+	}
+	return
+}
+
+// routeAEAD is the cipher of a layer, its key is used once only so the nonce
+// is constant
+func routeAEAD(secret []byte) (cipher2.AEAD, error) {
+	key := cipher.SumSHA256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher2.NewGCM(block)
+}
+
+// sealRouteLayer seals plain to node with a new key, [key 33][sealed]
+func sealRouteLayer(node cipher.PubKey, plain []byte) (layer []byte, err error) {
+	pub, sec := cipher.GenerateKeyPair()
+	secret, err := cn.NewSecKeyProvider(pub, sec).ECDH(node)
+	if err != nil {
+		return
+	}
+	aead, err := routeAEAD(secret)
+	if err != nil {
+		return
+	}
+	layer = append(make([]byte, 0, len(pub)+len(plain)+aead.Overhead()), pub[:]...)
+	return aead.Seal(layer, make([]byte, aead.NonceSize()), plain, nil), nil
+}
+
+// openRouteLayer returns the next hop of a layer sealed to keys and its
+// rest, the layer of the next hop or the app if next is empty
+func openRouteLayer(keys cn.KeyProvider, layer []byte) (next cipher.PubKey, rest []byte, err error) {
+	if keys == nil || len(layer) < ROUTE_LAYER_OVERHEAD+MSG_PUBLIC_KEY_SIZE {
+		err = ErrRouteLayer
+		return
+	}
+	secret, err := keys.ECDH(cipher.NewPubKey(layer[:len(next)]))
+	if err != nil {
+		return
+	}
+	aead, err := routeAEAD(secret)
+	if err != nil {
+		return
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), layer[len(next):], nil)
+	if err != nil || len(plain) < len(next) {
+		err = ErrRouteLayer
+		return
+	}
+	copy(next[:], plain)
+	rest = plain[len(next):]
+	return
+}
+
+// routeStream runs a hop of a route opened by the peer of c, it relays s to
+// the next node or connects it to the app
+func (c *Connection) routeStream(s *Stream, layer []byte) {
+	defer func() {
+		c.streams.Lock()
+		c.streams.routes--
+		c.streams.Unlock()
+	}()
+	f := c.factory
+	var keys cn.KeyProvider
+	if sc := f.GetDefaultSeedConfig(); sc != nil {
+		keys = sc.keys
+	}
+	if c.clientSide() {
+		// the node is known by the key it registered with
+		if k := c.GetKeyProvider(); k != nil {
+			keys = k
+		}
+	}
+	next, rest, err := openRouteLayer(keys, layer)
+	if err != nil {
+		c.GetContextLogger().Debugf("route stream %d err %v", s.Id(), err)
+		resetStream(s)
+		return
+	}
+	var out net.Conn
+	if next == (cipher.PubKey{}) {
+		out, err = f.dialRouteApp(rest)
+		if err == nil {
+			_, err = s.Write([]byte{ROUTE_OK})
+		}
+	} else if link, ok := f.routeLink(next); ok {
+		var hop *Stream
+		hop, err = link.openStream(STREAM_ROUTE, rest)
+		if err == nil {
+			out = hop
+		}
+	} else {
+		err = ErrRouteFailed
+	}
+	if err != nil {
+		c.GetContextLogger().Debugf("route stream %d to %x err %v", s.Id(), next, err)
+		if out != nil {
+			out.Close()
+		}
+		resetStream(s)
+		return
+	}
+	pipeRoute(s, out)
+}
+
+// allowRoute checks a route opened by the peer of c. A client has to be
+// registered with its key and the routes count as its queries, see RegLimits.
+// The server a node connected to is trusted
+func (c *Connection) allowRoute() bool {
+	if c.clientSide() {
+		return true
+	}
+	if !c.IsKeySet() || c.IsAnonymous() {
+		c.GetContextLogger().Debugf("route of an unregistered conn")
+		return false
+	}
+	return c.factory.allowOPRate(c, OP_STREAM)
+}
+
+// routeLink returns the conn to the node of key
+func (f *MessengerFactory) routeLink(key cipher.PubKey) (link *Connection, ok bool) {
+	link, ok = f.GetConnection(key)
+	if ok {
+		return
+	}
+	f.ForEachConn(func(c *Connection) {
+		if !ok && c.GetTargetKey() == key {
+			link, ok = c, true
+		}
+	})
+	return
+}
+
+// dialRouteApp connects to the service of the app of key, the origin of a
+// route is not known so a service with an acl is not reached
+func (f *MessengerFactory) dialRouteApp(key []byte) (conn net.Conn, err error) {
+	if len(key) != MSG_PUBLIC_KEY_SIZE {
+		return nil, ErrRouteLayer
+	}
+	app := cipher.NewPubKey(key)
+	appConn, ok := f.GetConnection(app)
+	if !ok {
+		return nil, ErrRouteFailed
+	}
+	s, ok := appConn.getService(app)
+	if !ok || s.acl() != nil || appConn.IsDraining() {
+		return nil, ErrRouteFailed
+	}
+	return net.DialTimeout("tcp", s.Address, ROUTE_DIAL_TIMEOUT)
+}
+
+// resetStream drops s on both ends
+func resetStream(s *Stream) {
+	s.fail(ErrStreamReset)
+	if err := s.conn.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_RESET, s.id, nil); err != nil {
+		s.conn.GetContextLogger().Debugf("stream %d reset err %v", s.id, err)
+	}
+}
+
+// pipeRoute copies between the two sides of a hop until either ends, then
+// closes both
+func pipeRoute(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		b.Close()
+	}()
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,209 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/net/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestRouteLayers(t *testing.T) {
+	hop1, hop2 := NewSeedConfig(), NewSeedConfig()
+	app, _ := cipher.GenerateKeyPair()
+	layer, err := routeLayers([]cipher.PubKey{hop1.publicKey, hop2.publicKey}, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = openRouteLayer(hop2.keys, layer); err != ErrRouteLayer {
+		t.Fatalf("layer of hop1 opened by hop2 err %v", err)
+	}
+	next, rest, err := openRouteLayer(hop1.keys, layer)
+	if err != nil || next != hop2.publicKey {
+		t.Fatalf("next %x err %v", next, err)
+	}
+	next, rest, err = openRouteLayer(hop2.keys, rest)
+	if err != nil || next != (cipher.PubKey{}) || cipher.NewPubKey(rest) != app {
+		t.Fatalf("next %x rest %x err %v", next, rest, err)
+	}
+	if _, err = routeLayers(nil, app); err != ErrRouteHops {
+		t.Fatalf("no hops err %v", err)
+	}
+}
+
+func TestDialRoute(t *testing.T) {
+	addr := func(i int) string { return "127.0.0.1:" + strconv.Itoa(25978+i) }
+	msc := NewSeedConfig()
+	m := NewMessengerFactory()
+	m.SetDefaultSeedConfig(msc)
+	if err := m.Listen(addr(0)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	node := func(i int) (*MessengerFactory, *SeedConfig) {
+		sc := NewSeedConfig()
+		n := NewMessengerFactory()
+		n.SetDefaultSeedConfig(sc)
+		if err := n.Listen(addr(i)); err != nil {
+			t.Fatal(err)
+		}
+		err := n.ConnectWithConfig(addr(0), &ConnConfig{SeedConfig: sc, TargetKey: msc.publicKey, UseCrypto: RegWithKeyAndEncryptionVersion})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, sc
+	}
+	nodeA, a := node(1)
+	defer nodeA.Close()
+	nodeB, b := node(2)
+	defer nodeB.Close()
+
+	echo, err := net.Listen("tcp", addr(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	app := func(i int) *Connection {
+		f := NewMessengerFactory()
+		if err := f.ConnectWithConfig(addr(i), &ConnConfig{SeedConfig: NewSeedConfig()}); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return conn
+	}
+	server := app(2)
+	defer server.Close()
+	if err = server.OfferServiceWithAddress(addr(3), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	client := app(1)
+	defer client.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the node of the client, the server and the node of the app
+	hops := []cipher.PubKey{a.publicKey, msc.publicKey, b.publicKey}
+	conn, err := client.DialRoute(ctx, hops, server.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q err %v", buf, err)
+	}
+	// torn down through the relay once the client closes it
+	conn.Close()
+	var hopStreams int
+	for i := 0; i < 100; i++ {
+		hopStreams = 0
+		m.ForEachAcceptedConnection(func(key cipher.PubKey, c *Connection) {
+			c.streams.Lock()
+			hopStreams += len(c.streams.streams)
+			c.streams.Unlock()
+		})
+		if hopStreams == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hopStreams != 0 {
+		t.Fatalf("streams left on the relay %d", hopStreams)
+	}
+
+	// a hop not connected to the next one
+	_, err = client.DialRoute(ctx, []cipher.PubKey{a.publicKey, b.publicKey}, server.GetKey())
+	if !errors.Is(err, cn.ErrNotFound) {
+		t.Fatalf("route past a hop err %v", err)
+	}
+}
+
+func TestRouteUnregistered(t *testing.T) {
+	addr := func(i int) string { return "127.0.0.1:" + strconv.Itoa(25987+i) }
+	msc := NewSeedConfig()
+	m := NewMessengerFactory()
+	m.SetDefaultSeedConfig(msc)
+	if err := m.Listen(addr(0)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	echo, err := net.Listen("tcp", addr(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	app := func() *Connection {
+		f := NewMessengerFactory()
+		if err := f.ConnectWithConfig(addr(0), &ConnConfig{SeedConfig: NewSeedConfig()}); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return conn
+	}
+	server := app()
+	defer server.Close()
+	if err = server.OfferServiceWithAddress(addr(1), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	layer, err := routeLayers([]cipher.PubKey{msc.publicKey}, server.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := func(conn *Connection) error {
+		s, err := conn.openStream(STREAM_ROUTE, layer)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(10 * time.Second))
+		var b [1]byte
+		_, err = s.Read(b[:])
+		return err
+	}
+
+	c, err := factory.NewTCPFactory().Connect(addr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unregistered := newClientConnection(c, NewMessengerFactory())
+	defer unregistered.Close()
+	if err = route(unregistered); err != ErrStreamReset {
+		t.Fatalf("route of an unregistered conn err %v", err)
+	}
+	client := app()
+	defer client.Close()
+	if err = route(client); err != nil {
+		t.Fatalf("route of a registered conn err %v", err)
+	}
+}
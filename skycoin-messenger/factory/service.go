@@ -2,6 +2,7 @@ package factory
 
 import (
 	"sync"
+	"time"
 
 	"github.com/skycoin/skycoin/src/cipher"
 )
@@ -11,12 +12,41 @@ type Service struct {
 	Attributes        []string `json:",omitempty"`
 	Address           string
 	HideFromDiscovery bool
-	AllowNodes        []string
+	// hex keys of the nodes allowed, see ACL
+	AllowNodes []string
+	// who finds the service and builds app conns to it, takes over AllowNodes
+	ACL *ServiceACL `json:",omitempty"`
+	// share of the node bandwidth against other services, see Transport.SetWeight
+	Weight int `json:",omitempty"`
+	// where apps of other nodes reach the service, e.g. of an HTTPTunnel,
+	// nodes report it to the manager
+	PublicAddress string `json:",omitempty"`
+	// returned in the query resps so clients can pick a service,
+	// e.g. version, region, capacity or port hints
+	Metadata ServiceMetadata `json:",omitempty"`
+	// where the node runs, e.g. "eu-west", see QUERY_ORDER_NEAREST
+	Region string `json:",omitempty"`
+}
+
+// ServiceMetadata of a service, at most MAX_SERVICE_METADATA_SIZE bytes of
+// keys and values
+type ServiceMetadata map[string]string
+
+const MAX_SERVICE_METADATA_SIZE = 4096
+
+func (m ServiceMetadata) size() (n int) {
+	for k, v := range m {
+		n += len(k) + len(v)
+	}
+	return
 }
 
 type NodeServices struct {
 	Services       []*Service
 	ServiceAddress string
+	// seconds the discovery keeps the services without an offer, the node
+	// offers them again before. Forever if 0
+	TTL int `json:",omitempty"`
 }
 
 type ServiceNodes struct {
@@ -31,6 +61,28 @@ type serviceDiscovery struct {
 	// attribute => subscription key
 	attribute2Keys map[string]map[cipher.PubKey]struct{}
 	key2Attributes map[cipher.PubKey]map[string]struct{}
+	// subscription key => public address
+	key2PublicAddress map[cipher.PubKey]string
+	// node => services restored from a DiscoveryStore, until the node offers
+	// them again
+	restored map[cipher.PubKey]*NodeServices
+	// node => services offered to this server
+	local map[cipher.PubKey]*offeredServices
+	// node => services gossiped by a federation peer, see federate
+	federated map[cipher.PubKey]*offeredServices
+	// of the services offered to this server, see CheckHealth
+	health map[healthKey]*ServiceHealth
+	// service key => *ACLCounters
+	aclCounters sync.Map
+}
+
+// offeredServices are the services of a node and when it offered them
+type offeredServices struct {
+	ns *NodeServices
+	// unix nano
+	at int64
+	// the federation peer that gossiped them
+	origin cipher.PubKey
 }
 
 func newServiceDiscovery() serviceDiscovery {
@@ -38,6 +90,11 @@ func newServiceDiscovery() serviceDiscovery {
 		subscription2Subscriber: make(map[cipher.PubKey]*ServiceNodes),
 		attribute2Keys:          make(map[string]map[cipher.PubKey]struct{}),
 		key2Attributes:          make(map[cipher.PubKey]map[string]struct{}),
+		key2PublicAddress:       make(map[cipher.PubKey]string),
+		restored:                make(map[cipher.PubKey]*NodeServices),
+		local:                   make(map[cipher.PubKey]*offeredServices),
+		federated:               make(map[cipher.PubKey]*offeredServices),
+		health:                  make(map[healthKey]*ServiceHealth),
 	}
 }
 
@@ -53,7 +110,10 @@ func (sd *serviceDiscovery) pack() *NodeServices {
 		for attr := range v {
 			attrs = append(attrs, attr)
 		}
-		s := &Service{Key: k, Attributes: attrs}
+		s := &Service{Key: k, Attributes: attrs, PublicAddress: sd.key2PublicAddress[k]}
+		if nodes, ok := sd.subscription2Subscriber[k]; ok {
+			s.Metadata = nodes.Service.Metadata
+		}
 		ss = append(ss, s)
 	}
 	ns := &NodeServices{Services: ss}
@@ -71,15 +131,26 @@ func (sd *serviceDiscovery) register(conn *Connection, ns *NodeServices) {
 	sd.subscription2SubscriberMutex.Lock()
 	defer sd.subscription2SubscriberMutex.Unlock()
 	sd._unregister(conn)
+	node := conn.GetKey()
+	// the offer is newer than the one gossiped
+	if s, ok := sd.federated[node]; ok {
+		delete(sd.federated, node)
+		sd._unregisterServices(node, s.ns)
+	}
+	sd._registerServices(node, ns)
+	sd.local[node] = &offeredServices{ns: ns, at: time.Now().UnixNano()}
+	conn.setServices(ns)
+}
 
+func (sd *serviceDiscovery) _registerServices(node cipher.PubKey, ns *NodeServices) {
 	for _, service := range ns.Services {
 		nodes, ok := sd.subscription2Subscriber[service.Key]
 		if !ok {
 			nodes = &ServiceNodes{Nodes: make(map[cipher.PubKey]*NodeServices), Service: service}
-			nodes.Nodes[conn.GetKey()] = ns
+			nodes.Nodes[node] = ns
 			sd.subscription2Subscriber[service.Key] = nodes
 		} else {
-			nodes.Nodes[conn.GetKey()] = ns
+			nodes.Nodes[node] = ns
 		}
 
 		for _, attr := range service.Attributes {
@@ -104,21 +175,44 @@ func (sd *serviceDiscovery) register(conn *Connection, ns *NodeServices) {
 				km[attr] = struct{}{}
 			}
 		}
+		if len(service.PublicAddress) > 0 && !service.HideFromDiscovery {
+			sd.key2PublicAddress[service.Key] = service.PublicAddress
+		}
 	}
-	conn.setServices(ns)
 }
 
-func (sd *serviceDiscovery) _unregister(conn *Connection) {
+// _unregister removes the services of conn and the ones restored for its key,
+// it reports whether there were any
+func (sd *serviceDiscovery) _unregister(conn *Connection) (removed bool) {
+	// GetKey waits for the reg
+	if !conn.IsKeySet() {
+		return
+	}
+	if ns, ok := sd.restored[conn.GetKey()]; ok {
+		delete(sd.restored, conn.GetKey())
+		sd._unregisterServices(conn.GetKey(), ns)
+		removed = true
+	}
 	ns := conn.GetServices()
 	if ns == nil {
 		return
 	}
+	// not in the index while a newer offer on a federation peer is
+	if _, ok := sd.federated[conn.GetKey()]; !ok {
+		sd._unregisterServices(conn.GetKey(), ns)
+	}
+	delete(sd.local, conn.GetKey())
+	conn.setServices(nil)
+	return true
+}
+
+func (sd *serviceDiscovery) _unregisterServices(node cipher.PubKey, ns *NodeServices) {
 	for _, service := range ns.Services {
 		m, ok := sd.subscription2Subscriber[service.Key]
 		if !ok {
 			continue
 		}
-		delete(m.Nodes, conn.GetKey())
+		delete(m.Nodes, node)
 		// no one subscribes to service.Key
 		if len(m.Nodes) < 1 {
 			delete(sd.subscription2Subscriber, service.Key)
@@ -136,21 +230,110 @@ func (sd *serviceDiscovery) _unregister(conn *Connection) {
 			if service.HideFromDiscovery {
 				continue
 			}
+			delete(sd.key2PublicAddress, service.Key)
 			_, ok = sd.key2Attributes[service.Key]
 			if !ok {
 				continue
 			}
 			delete(sd.key2Attributes, service.Key)
+			continue
+		}
+		// other nodes offer service.Key still, the attributes only node gave
+		// it go
+		for _, attr := range service.Attributes {
+			if am, ok := sd.attribute2Keys[attr]; ok && !offersAttribute(m, service.Key, attr, false) {
+				delete(am, service.Key)
+				if len(am) < 1 {
+					delete(sd.attribute2Keys, attr)
+				}
+			}
+			if km, ok := sd.key2Attributes[service.Key]; ok && !offersAttribute(m, service.Key, attr, true) {
+				delete(km, attr)
+				if len(km) < 1 {
+					delete(sd.key2Attributes, service.Key)
+				}
+			}
 		}
 	}
-	conn.setServices(nil)
 }
 
-func (sd *serviceDiscovery) unregister(conn *Connection) {
+// offersAttribute is true if one of the nodes of m offers key with attr, only
+// if it is not hidden from discovery if visible
+func offersAttribute(m *ServiceNodes, key cipher.PubKey, attr string, visible bool) bool {
+	for _, ns := range m.Nodes {
+		for _, s := range ns.Services {
+			if s.Key != key || visible && s.HideFromDiscovery {
+				continue
+			}
+			for _, a := range s.Attributes {
+				if a == attr {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (sd *serviceDiscovery) unregister(conn *Connection) bool {
 	sd.subscription2SubscriberMutex.Lock()
 	defer sd.subscription2SubscriberMutex.Unlock()
 
-	sd._unregister(conn)
+	return sd._unregister(conn)
+}
+
+// restore registers the services of node without a conn, until the node
+// offers again or leaves
+func (sd *serviceDiscovery) restore(node cipher.PubKey, ns *NodeServices) {
+	sd.subscription2SubscriberMutex.Lock()
+	defer sd.subscription2SubscriberMutex.Unlock()
+
+	if _, ok := sd.federated[node]; ok {
+		return
+	}
+	if old, ok := sd.restored[node]; ok {
+		sd._unregisterServices(node, old)
+	}
+	sd.restored[node] = ns
+	sd._registerServices(node, ns)
+}
+
+// rekey moves the services node offered and their health to the key new, it
+// returns them, nil if node offered none
+func (sd *serviceDiscovery) rekey(node, new cipher.PubKey) *NodeServices {
+	sd.subscription2SubscriberMutex.Lock()
+	defer sd.subscription2SubscriberMutex.Unlock()
+
+	s, ok := sd.local[node]
+	if !ok {
+		return nil
+	}
+	delete(sd.local, node)
+	if _, ok := sd.federated[node]; !ok {
+		sd._unregisterServices(node, s.ns)
+	}
+	sd._registerServices(new, s.ns)
+	sd.local[new] = s
+	for k, h := range sd.health {
+		if k.node == node {
+			delete(sd.health, k)
+			sd.health[healthKey{node: new, service: k.service}] = h
+		}
+	}
+	return s.ns
+}
+
+// dropRestored removes the services restored for node if they are still ns
+func (sd *serviceDiscovery) dropRestored(node cipher.PubKey, ns *NodeServices) bool {
+	sd.subscription2SubscriberMutex.Lock()
+	defer sd.subscription2SubscriberMutex.Unlock()
+
+	if sd.restored[node] != ns {
+		return false
+	}
+	delete(sd.restored, node)
+	sd._unregisterServices(node, ns)
+	return true
 }
 
 // find public keys of nodes by subscription key
@@ -176,6 +359,10 @@ type NodeInfo struct {
 	PubKey cipher.PubKey
 	// node address
 	Address string
+	// of the service on the node
+	Metadata ServiceMetadata `json:",omitempty"`
+	// nil if the server does not check it, see CheckHealth
+	Health *ServiceHealth `json:",omitempty"`
 }
 
 // info of nodes for the service key
@@ -195,12 +382,14 @@ func (sd *serviceDiscovery) _findServiceAddress(key cipher.PubKey, exclude ciphe
 
 	result := make([]*NodeInfo, 0, len(m.Nodes))
 	for k, v := range m.Nodes {
-		if k == exclude {
+		if k == exclude || sd._unhealthy(k, key) {
 			continue
 		}
 		result = append(result, &NodeInfo{
-			PubKey:  k,
-			Address: v.ServiceAddress,
+			PubKey:   k,
+			Address:  v.ServiceAddress,
+			Metadata: v.metadata(key),
+			Health:   sd._health(k, key),
 		})
 	}
 	return result
@@ -233,16 +422,37 @@ func (sd *serviceDiscovery) findServiceAddresses(keys []cipher.PubKey, exclude c
 // find public keys of nodes by subscription attrs
 // return intersect map of node key => sub keys
 func (sd *serviceDiscovery) findByAttributes(attrs ...string) map[string][]cipher.PubKey {
-	if len(attrs) < 1 {
+	return sd.findByAttributesMatch(ATTR_MATCH_EXACT, attrs...)
+}
+
+// findByAttributesMatch is findByAttributes with patterns of the match mode,
+// each pattern must match an attribute of the service
+func (sd *serviceDiscovery) findByAttributesMatch(match string, patterns ...string) map[string][]cipher.PubKey {
+	if len(patterns) < 1 {
 		return nil
 	}
+	matchers := make([]func(attr string) bool, 0, len(patterns))
+	if match != ATTR_MATCH_EXACT {
+		for _, p := range patterns {
+			m, err := attrMatcher(match, p)
+			if err != nil {
+				return nil
+			}
+			matchers = append(matchers, m)
+		}
+	}
 	sd.subscription2SubscriberMutex.RLock()
 	defer sd.subscription2SubscriberMutex.RUnlock()
 
 	var maps []map[cipher.PubKey]struct{}
-	for _, attr := range attrs {
-		m, ok := sd.attribute2Keys[attr]
-		if !ok {
+	for i, attr := range patterns {
+		var m map[cipher.PubKey]struct{}
+		if match == ATTR_MATCH_EXACT {
+			m = sd.attribute2Keys[attr]
+		} else {
+			m = sd.matchAttributes(matchers[i])
+		}
+		if len(m) < 1 {
 			return nil
 		}
 		maps = append(maps, m)
@@ -256,12 +466,62 @@ func (sd *serviceDiscovery) findByAttributes(attrs ...string) map[string][]ciphe
 			continue
 		}
 		for k := range m.Nodes {
+			if sd._unhealthy(k, key) {
+				continue
+			}
 			nodes[k.Hex()] = append(nodes[k.Hex()], key)
 		}
 	}
 	return nodes
 }
 
+// metadata returns the metadata of the service key
+func (ns *NodeServices) metadata(key cipher.PubKey) ServiceMetadata {
+	for _, s := range ns.Services {
+		if s.Key == key {
+			return s.Metadata
+		}
+	}
+	return nil
+}
+
+// findMetadata returns the metadata of the services in nodes, a result of
+// findByAttributes, by node and service key
+func (sd *serviceDiscovery) findMetadata(nodes map[string][]cipher.PubKey) map[string]map[string]ServiceMetadata {
+	sd.subscription2SubscriberMutex.RLock()
+	defer sd.subscription2SubscriberMutex.RUnlock()
+
+	var result map[string]map[string]ServiceMetadata
+	for node, keys := range nodes {
+		nodeKey, err := cipher.PubKeyFromHex(node)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			m, ok := sd.subscription2Subscriber[key]
+			if !ok {
+				continue
+			}
+			ns, ok := m.Nodes[nodeKey]
+			if !ok {
+				continue
+			}
+			metadata := ns.metadata(key)
+			if len(metadata) < 1 {
+				continue
+			}
+			if result == nil {
+				result = make(map[string]map[string]ServiceMetadata)
+			}
+			if result[node] == nil {
+				result[node] = make(map[string]ServiceMetadata)
+			}
+			result[node][key.Hex()] = metadata
+		}
+	}
+	return result
+}
+
 func mapKeys(m map[cipher.PubKey]struct{}) (keys []cipher.PubKey) {
 	if len(m) < 1 {
 		return
@@ -99,3 +99,71 @@ func TestRegisterAndFind(t *testing.T) {
 		t.Fatal(service.key2Attributes)
 	}
 }
+
+func TestFindByAttributePatterns(t *testing.T) {
+	conn := newTestConnection()
+	conn.SetKey(cipher.PubKey([33]byte{0x01}))
+	vpnUS, vpnEU, proxy := cipher.PubKey([33]byte{0xf1}), cipher.PubKey([33]byte{0xf2}), cipher.PubKey([33]byte{0xf3})
+	service := newServiceDiscovery()
+	service.register(conn, &NodeServices{Services: []*Service{
+		{Key: vpnUS, Attributes: []string{"vpn-us", "fast"}},
+		{Key: vpnEU, Attributes: []string{"vpn-eu"}},
+		{Key: proxy, Attributes: []string{"proxy.v2", "fast"}},
+	}})
+	count := func(match string, patterns ...string) int {
+		return len(service.findByAttributesMatch(match, patterns...)[conn.GetKey().Hex()])
+	}
+	for _, c := range []struct {
+		match    string
+		patterns []string
+		want     int
+	}{
+		{ATTR_MATCH_EXACT, []string{"vpn-*"}, 0},
+		{ATTR_MATCH_PREFIX, []string{"vpn-"}, 2},
+		{ATTR_MATCH_WILDCARD, []string{"vpn-*"}, 2},
+		{ATTR_MATCH_WILDCARD, []string{"vpn-?s"}, 1},
+		{ATTR_MATCH_WILDCARD, []string{"vpn-*", "fast"}, 1},
+		// . is no wildcard
+		{ATTR_MATCH_WILDCARD, []string{"proxy?v2"}, 1},
+		{ATTR_MATCH_WILDCARD, []string{"proxy.v*"}, 1},
+		{ATTR_MATCH_WILDCARD, []string{"proxyxv*"}, 0},
+		{ATTR_MATCH_REGEX, []string{"vpn-(us|eu)"}, 2},
+		// matched whole
+		{ATTR_MATCH_REGEX, []string{"vpn"}, 0},
+		{ATTR_MATCH_REGEX, []string{"("}, 0},
+		{"fuzzy", []string{"vpn"}, 0},
+	} {
+		if n := count(c.match, c.patterns...); n != c.want {
+			t.Fatalf("%q %v matched %d, want %d", c.match, c.patterns, n, c.want)
+		}
+	}
+}
+
+func TestServiceMetadata(t *testing.T) {
+	conn := newTestConnection()
+	conn.SetKey(cipher.PubKey([33]byte{0x01}))
+	vpn, proxy := cipher.PubKey([33]byte{0xf1}), cipher.PubKey([33]byte{0xf2})
+	service := newServiceDiscovery()
+	service.register(conn, &NodeServices{Services: []*Service{
+		{Key: vpn, Attributes: []string{"vpn"}, Metadata: ServiceMetadata{"version": "1.2", "region": "eu"}},
+		{Key: proxy, Attributes: []string{"proxy"}},
+	}})
+
+	node := conn.GetKey().Hex()
+	metadata := service.findMetadata(service.findByAttributes("vpn"))
+	if metadata[node][vpn.Hex()]["region"] != "eu" {
+		t.Fatalf("metadata %v", metadata)
+	}
+	if metadata = service.findMetadata(service.findByAttributes("proxy")); metadata != nil {
+		t.Fatalf("metadata of proxy %v", metadata)
+	}
+	infos := service.findServiceAddresses([]cipher.PubKey{vpn}, cipher.PubKey{})
+	for _, info := range infos {
+		if info != nil && (len(info.Nodes) != 1 || info.Nodes[0].Metadata["version"] != "1.2") {
+			t.Fatalf("nodes of vpn %+v", info.Nodes)
+		}
+	}
+	if ServiceMetadata(map[string]string{"k": string(make([]byte, MAX_SERVICE_METADATA_SIZE))}).size() <= MAX_SERVICE_METADATA_SIZE {
+		t.Fatal("size of large metadata")
+	}
+}
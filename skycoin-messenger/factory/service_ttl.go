@@ -0,0 +1,74 @@
+package factory
+
+import (
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+// ttlSeconds rounds ttl up to the seconds of NodeServices.TTL
+func ttlSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+// discoveryLogger logs the services of the conn
+func (c *Connection) discoveryLogger() cn.Logger {
+	return cn.WithSubsystem(c.GetContextLogger(), cn.LOG_DISCOVERY)
+}
+
+// expireServices unregisters the services of the conn ttl seconds after its
+// last offer, never if 0. Run on the server
+func (c *Connection) expireServices(ttl int, unregister func()) {
+	c.fieldsMutex.Lock()
+	defer c.fieldsMutex.Unlock()
+	if c.servicesExpiry != nil {
+		c.servicesExpiry.Stop()
+		c.servicesExpiry = nil
+	}
+	if ttl <= 0 {
+		return
+	}
+	var timer *cn.WheelTimer
+	timer = factoryTimers.AfterFunc(time.Duration(ttl)*time.Second, func() {
+		c.fieldsMutex.Lock()
+		expired := c.servicesExpiry == timer
+		if expired {
+			c.servicesExpiry = nil
+		}
+		c.fieldsMutex.Unlock()
+		if !expired {
+			return
+		}
+		c.discoveryLogger().Infof("services expired after %ds", ttl)
+		go unregister()
+	})
+	c.servicesExpiry = timer
+}
+
+// refreshServices offers the services again every third of their TTL while
+// the conn is open. Run on the client
+func (c *Connection) refreshServices(ttl int) {
+	c.fieldsMutex.Lock()
+	defer c.fieldsMutex.Unlock()
+	if c.servicesRefresh != nil {
+		c.servicesRefresh.Stop()
+		c.servicesRefresh = nil
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.servicesRefresh = factoryTimers.AfterFunc(time.Duration(ttl)*time.Second/3, func() {
+		ns := c.GetServices()
+		if c.IsClosed() || ns == nil {
+			return
+		}
+		go func() {
+			if err := c.UpdateServices(ns); err != nil {
+				c.discoveryLogger().Errorf("refresh services err %v", err)
+			}
+		}()
+	})
+}
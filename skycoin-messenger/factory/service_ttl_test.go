@@ -0,0 +1,53 @@
+package factory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceTTL(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25954"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	offer := func(service *SeedConfig) *Connection {
+		c := NewMessengerFactory()
+		c.ServiceTTL = time.Second
+		if err := c.ConnectWithConfig("127.0.0.1:25954", &ConnConfig{SeedConfig: NewSeedConfig()}); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		c.ForEachConn(func(c *Connection) {
+			conn = c
+		})
+		if err := conn.UpdateServices(&NodeServices{Services: []*Service{{Key: service.publicKey}}}); err != nil {
+			t.Fatal(err)
+		}
+		if ns := conn.GetServices(); ns.TTL != 1 {
+			t.Fatalf("ttl %d", ns.TTL)
+		}
+		return conn
+	}
+	alive, dead := NewSeedConfig(), NewSeedConfig()
+	a := offer(alive)
+	defer a.Close()
+	d := offer(dead)
+	defer d.Close()
+	// the node hangs, its conn stays open
+	d.refreshServices(0)
+
+	time.Sleep(300 * time.Millisecond)
+	if len(s.find(alive.publicKey)) != 1 || len(s.find(dead.publicKey)) != 1 {
+		t.Fatal("services not offered")
+	}
+	time.Sleep(2 * time.Second)
+	if len(s.find(alive.publicKey)) != 1 {
+		t.Fatal("refreshed services expired")
+	}
+	if len(s.find(dead.publicKey)) != 0 {
+		t.Fatal("services of the hanging node not expired")
+	}
+}
@@ -0,0 +1,521 @@
+package factory
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	cn "github.com/skycoin/net/conn"
+)
+
+// types of the frames of OP_STREAM, [type 1][stream id 4][payload]
+const (
+	// opens a stream, no payload
+	STREAM_OPEN byte = iota + 1
+	STREAM_DATA
+	// the receiver read 4 byte big endian more bytes of the stream
+	STREAM_WINDOW
+	// the sender closed the stream, the data sent before is read first
+	STREAM_CLOSE
+	// the stream is dropped at once
+	STREAM_RESET
+	// opens a stream of a route, the payload is the layer of the receiver,
+	// see DialRoute
+	STREAM_ROUTE
+)
+
+const (
+	STREAM_HEADER_SIZE = 5
+	// bytes a stream may have in flight unread by the peer
+	STREAM_WINDOW_SIZE = 256 * 1024
+	// of the data of a frame, it fits in msg.MAX_MESSAGE_SIZE
+	STREAM_FRAME_SIZE = 8 * 1024
+	// opened streams not accepted yet, the newer ones are reset
+	STREAM_ACCEPT_BACKLOG = 32
+)
+
+var (
+	ErrStreamClosed   = cn.NewError(cn.ErrClosed, "stream closed")
+	ErrStreamReset    = cn.NewError(cn.ErrClosed, "stream reset by peer")
+	ErrStreamTimeout  = cn.NewError(cn.ErrTimeout, "stream deadline exceeded")
+	ErrStreamExceeded = errors.New("stream data over the window")
+	ErrStreamFrame    = errors.New("invalid stream frame")
+)
+
+func genStreamFrame(typ byte, id uint32, payload []byte) []byte {
+	m := make([]byte, MSG_HEADER_END+STREAM_HEADER_SIZE+len(payload))
+	m[MSG_OP_BEGIN] = OP_STREAM
+	m[MSG_HEADER_END] = typ
+	binary.BigEndian.PutUint32(m[MSG_HEADER_END+1:], id)
+	copy(m[MSG_HEADER_END+STREAM_HEADER_SIZE:], payload)
+	return m
+}
+
+// clientSide is true on the conns a factory connected, only they preprocess
+// the messages they read
+func (c *Connection) clientSide() bool {
+	return c.in != nil
+}
+
+// writeStreamFrame writes a frame at p, the frames of a stream that may
+// overtake its data, STREAM_WINDOW and STREAM_RESET, are control frames
+func (c *Connection) writeStreamFrame(p cn.Priority, typ byte, id uint32, payload []byte) error {
+	return c.WriteContext(priorityContexts[p], genStreamFrame(typ, id, payload))
+}
+
+// streamMux is the streams of a conn, the ids of the streams opened by the
+// client side are odd and the ones of the server side even
+type streamMux struct {
+	streams map[uint32]*Stream
+	nextId  uint32
+	accept  chan *Stream
+	closed  bool
+	// streams of routes relayed, up to ROUTE_MAX_STREAMS
+	routes int
+	sync.Mutex
+}
+
+// acceptChan returns the backlog of the streams opened by the peer, mux
+// must be locked
+func (m *streamMux) acceptChan() chan *Stream {
+	if m.accept == nil {
+		m.accept = make(chan *Stream, STREAM_ACCEPT_BACKLOG)
+	}
+	return m.accept
+}
+
+func (m *streamMux) remove(id uint32) {
+	m.Lock()
+	delete(m.streams, id)
+	m.Unlock()
+}
+
+// Stream is an independent ordered byte stream carried by a Connection next
+// to its ops. The bytes written are held back once the peer has
+// STREAM_WINDOW_SIZE of them unread, so a slow stream does not stall the
+// others or the conn
+type Stream struct {
+	id   uint32
+	conn *Connection
+
+	buf []byte
+	// read since the last STREAM_WINDOW sent
+	unacked int
+	// may be sent before the peer grants more
+	sendWindow int
+	// see SetPriority
+	priority cn.Priority
+
+	closed       bool
+	remoteClosed bool
+	err          error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	timers        [2]*time.Timer
+
+	cond *sync.Cond
+	sync.Mutex
+}
+
+func newStream(c *Connection, id uint32) *Stream {
+	s := &Stream{id: id, conn: c, sendWindow: STREAM_WINDOW_SIZE, priority: cn.PRIORITY_BULK}
+	s.cond = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// OpenStream opens a stream to the peer of the conn, it is usable at once
+// and the peer gets it from AcceptStream
+func (c *Connection) OpenStream() (s *Stream, err error) {
+	return c.openStream(STREAM_OPEN, nil)
+}
+
+func (c *Connection) openStream(typ byte, payload []byte) (s *Stream, err error) {
+	m := &c.streams
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return nil, cn.ErrConnClosed
+	}
+	if m.streams == nil {
+		m.streams = make(map[uint32]*Stream)
+	}
+	if m.nextId == 0 {
+		m.nextId = 2
+		if c.clientSide() {
+			m.nextId = 1
+		}
+	}
+	s = newStream(c, m.nextId)
+	m.nextId += 2
+	m.streams[s.id] = s
+	m.Unlock()
+	err = c.writeStreamFrame(s.priority, typ, s.id, payload)
+	if err != nil {
+		m.remove(s.id)
+		s = nil
+	}
+	return
+}
+
+// AcceptStream returns the next stream opened by the peer
+func (c *Connection) AcceptStream(ctx context.Context) (s *Stream, err error) {
+	c.streams.Lock()
+	accept := c.streams.acceptChan()
+	c.streams.Unlock()
+	select {
+	case s = <-accept:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.Disconnected():
+		err = cn.ErrConnClosed
+	}
+	return
+}
+
+// receiveStreamFrame runs a frame of OP_STREAM from the peer, it never waits
+// for a reader
+func (c *Connection) receiveStreamFrame(body []byte) (err error) {
+	if len(body) < STREAM_HEADER_SIZE {
+		return ErrStreamFrame
+	}
+	typ := body[0]
+	id := binary.BigEndian.Uint32(body[1:])
+	payload := body[STREAM_HEADER_SIZE:]
+	if typ == STREAM_ROUTE && !c.allowRoute() {
+		return c.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_RESET, id, nil)
+	}
+	m := &c.streams
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return
+	}
+	s, ok := m.streams[id]
+	if typ == STREAM_OPEN || typ == STREAM_ROUTE {
+		local := id%2 == 1 == c.clientSide()
+		if ok || local || id == 0 {
+			m.Unlock()
+			return ErrStreamFrame
+		}
+		if m.streams == nil {
+			m.streams = make(map[uint32]*Stream)
+		}
+		if typ == STREAM_ROUTE {
+			if m.routes >= ROUTE_MAX_STREAMS {
+				m.Unlock()
+				c.GetContextLogger().Debugf("stream %d over the routes of the conn", id)
+				return c.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_RESET, id, nil)
+			}
+			// relayed by the factory, never accepted
+			s = newStream(c, id)
+			m.streams[id] = s
+			m.routes++
+			m.Unlock()
+			go c.routeStream(s, append([]byte(nil), payload...))
+			return
+		}
+		s = newStream(c, id)
+		select {
+		case m.acceptChan() <- s:
+			m.streams[id] = s
+			m.Unlock()
+		default:
+			m.Unlock()
+			c.GetContextLogger().Debugf("stream %d over the accept backlog", id)
+			return c.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_RESET, id, nil)
+		}
+		return
+	}
+	m.Unlock()
+	if !ok {
+		if typ == STREAM_DATA {
+			return c.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_RESET, id, nil)
+		}
+		return
+	}
+	switch typ {
+	case STREAM_DATA:
+		if !s.receive(payload) {
+			c.GetContextLogger().Debugf("stream %d %v", id, ErrStreamExceeded)
+			s.fail(ErrStreamReset)
+			return c.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_RESET, id, nil)
+		}
+	case STREAM_WINDOW:
+		if len(payload) < 4 {
+			return ErrStreamFrame
+		}
+		s.grant(int(binary.BigEndian.Uint32(payload)))
+	case STREAM_CLOSE:
+		s.Lock()
+		s.remoteClosed = true
+		s.cond.Broadcast()
+		s.Unlock()
+		m.remove(id)
+	case STREAM_RESET:
+		s.fail(ErrStreamReset)
+	default:
+		return ErrStreamFrame
+	}
+	return
+}
+
+// closeStreams fails the streams of a closed conn
+func (c *Connection) closeStreams() {
+	m := &c.streams
+	m.Lock()
+	m.closed = true
+	streams := m.streams
+	m.streams = nil
+	m.Unlock()
+	for _, s := range streams {
+		s.fail(cn.ErrConnClosed)
+	}
+}
+
+// receive queues data, false if the peer sent more than the window allows
+func (s *Stream) receive(data []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed || s.err != nil {
+		return true
+	}
+	if len(s.buf)+s.unacked+len(data) > STREAM_WINDOW_SIZE {
+		return false
+	}
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	return true
+}
+
+func (s *Stream) grant(n int) {
+	s.Lock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+	s.Unlock()
+}
+
+func (s *Stream) fail(err error) {
+	s.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.Unlock()
+	s.conn.streams.remove(s.id)
+}
+
+// SetPriority sets the priority of the data written to the stream,
+// PRIORITY_BULK by default. Set it before writing, the frames of different
+// priorities may be sent out of order
+func (s *Stream) SetPriority(p cn.Priority) {
+	if p < 0 || p >= cn.PRIORITY_SIZE {
+		return
+	}
+	s.Lock()
+	s.priority = p
+	s.Unlock()
+}
+
+// Id of the stream on its conn
+func (s *Stream) Id() uint32 {
+	return s.id
+}
+
+// Conn returns the connection carrying the stream
+func (s *Stream) Conn() *Connection {
+	return s.conn
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Read reads the data of the stream, io.EOF once the peer closed it and all
+// was read
+func (s *Stream) Read(p []byte) (n int, err error) {
+	s.Lock()
+	for len(s.buf) < 1 {
+		switch {
+		case s.closed:
+			err = ErrStreamClosed
+		case s.err != nil:
+			err = s.err
+		case s.remoteClosed:
+			err = io.EOF
+		case expired(s.readDeadline):
+			err = ErrStreamTimeout
+		}
+		if err != nil {
+			s.Unlock()
+			return
+		}
+		s.cond.Wait()
+	}
+	n = copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) < 1 {
+		s.buf = nil
+	}
+	s.unacked += n
+	var grant int
+	if s.unacked >= STREAM_WINDOW_SIZE/2 && !s.remoteClosed {
+		grant = s.unacked
+		s.unacked = 0
+	}
+	s.Unlock()
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(grant))
+		if e := s.conn.writeStreamFrame(cn.PRIORITY_CONTROL, STREAM_WINDOW, s.id, b[:]); e != nil {
+			s.conn.GetContextLogger().Debugf("stream %d window %v", s.id, e)
+		}
+	}
+	return
+}
+
+// Write writes p to the stream, it waits while the window of the peer is
+// full
+func (s *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		s.Lock()
+		for s.sendWindow < 1 && !s.closed && s.err == nil && !s.remoteClosed && !expired(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		switch {
+		case s.closed, s.remoteClosed:
+			err = ErrStreamClosed
+		case s.err != nil:
+			err = s.err
+		case expired(s.writeDeadline):
+			err = ErrStreamTimeout
+		}
+		if err != nil {
+			s.Unlock()
+			return
+		}
+		priority := s.priority
+		size := len(p)
+		if size > s.sendWindow {
+			size = s.sendWindow
+		}
+		if size > STREAM_FRAME_SIZE {
+			size = STREAM_FRAME_SIZE
+		}
+		s.sendWindow -= size
+		s.Unlock()
+		err = s.conn.writeStreamFrame(priority, STREAM_DATA, s.id, p[:size])
+		if err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// Close closes the stream, the peer reads the data written before and then
+// io.EOF. The data of the peer not read yet is dropped
+func (s *Stream) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	notify := !s.remoteClosed && s.err == nil
+	priority := s.priority
+	s.buf = nil
+	s.stopTimers()
+	s.cond.Broadcast()
+	s.Unlock()
+	s.conn.streams.remove(s.id)
+	if notify {
+		return s.conn.writeStreamFrame(priority, STREAM_CLOSE, s.id, nil)
+	}
+	return nil
+}
+
+// stopTimers stops the timers of the deadlines, s must be locked
+func (s *Stream) stopTimers() {
+	for i, t := range s.timers {
+		if t != nil {
+			t.Stop()
+			s.timers[i] = nil
+		}
+	}
+}
+
+func (s *Stream) setDeadline(i int, deadline *time.Time, t time.Time) {
+	*deadline = t
+	if s.timers[i] != nil {
+		s.timers[i].Stop()
+		s.timers[i] = nil
+	}
+	if !t.IsZero() {
+		s.timers[i] = time.AfterFunc(time.Until(t), func() {
+			s.Lock()
+			s.cond.Broadcast()
+			s.Unlock()
+		})
+	}
+	s.cond.Broadcast()
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.Lock()
+	s.setDeadline(0, &s.readDeadline, t)
+	s.Unlock()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.Lock()
+	s.setDeadline(1, &s.writeDeadline, t)
+	s.Unlock()
+	return nil
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.Lock()
+	s.setDeadline(0, &s.readDeadline, t)
+	s.setDeadline(1, &s.writeDeadline, t)
+	s.Unlock()
+	return nil
+}
+
+// StreamAddr is the address of a stream, the key of one end of the conn and
+// the stream id
+type StreamAddr struct {
+	Key string
+	Id  uint32
+}
+
+func (a StreamAddr) Network() string {
+	return "stream"
+}
+
+func (a StreamAddr) String() string {
+	return a.Key + "/" + strconv.FormatUint(uint64(a.Id), 10)
+}
+
+// LocalAddr is the key of the conn, empty until it is set
+func (s *Stream) LocalAddr() net.Addr {
+	a := StreamAddr{Id: s.id}
+	if s.conn.IsKeySet() {
+		a.Key = s.conn.GetKey().Hex()
+	}
+	return a
+}
+
+// RemoteAddr is the address of the peer of the conn
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.conn.GetRemoteAddr()
+}
+
+var _ net.Conn = (*Stream)(nil)
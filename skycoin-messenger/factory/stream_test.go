@@ -0,0 +1,110 @@
+package factory
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25968"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewMessengerFactory()
+	sc := NewSeedConfig()
+	if err := c.ConnectWithConfig("127.0.0.1:25968", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var conn *Connection
+	c.ForEachConn(func(c *Connection) { conn = c })
+	var accepted *Connection
+	for i := 0; accepted == nil; i++ {
+		if i > 50 {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(20 * time.Millisecond)
+		accepted, _ = s.GetConnection(sc.publicKey)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	slow, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slow.Id() != 1 || fast.Id() != 3 {
+		t.Fatalf("client stream ids %d %d", slow.Id(), fast.Id())
+	}
+	slowPeer, err := accepted.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastPeer, err := accepted.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the slow stream is never read, its writes stop at the window
+	slow.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := slow.Write(make([]byte, 2*STREAM_WINDOW_SIZE))
+	if err != ErrStreamTimeout || n != STREAM_WINDOW_SIZE {
+		t.Fatalf("wrote %d over the window of an unread stream, err %v", n, err)
+	}
+
+	data := bytes.Repeat([]byte("stream"), STREAM_WINDOW_SIZE)
+	go func() {
+		fast.Write(data)
+		fast.Close()
+	}()
+	read, err := ioutil.ReadAll(fastPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("read %d bytes of %d", len(read), len(data))
+	}
+	if _, err = fast.Write([]byte("closed")); err != ErrStreamClosed {
+		t.Fatalf("write to a closed stream err %v", err)
+	}
+
+	// the server opens streams too
+	back, err := accepted.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Id()%2 != 0 {
+		t.Fatalf("server stream id %d", back.Id())
+	}
+	backPeer, err := conn.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = back.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(backPeer, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read %q err %v", buf, err)
+	}
+
+	// streams fail with their conn once the data received is read
+	conn.Close()
+	read, err = ioutil.ReadAll(slowPeer)
+	if err == nil || len(read) != STREAM_WINDOW_SIZE {
+		t.Fatalf("read %d bytes of a closed conn, err %v", len(read), err)
+	}
+	if _, err = back.Write(buf); err == nil {
+		t.Fatal("stream of a closed conn written")
+	}
+}
@@ -1,10 +1,11 @@
 package factory
 
 import (
+	"crypto/aes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	cn "github.com/skycoin/net/conn"
 	"github.com/skycoin/skycoin/src/cipher"
 	"io"
@@ -16,6 +17,10 @@ import (
 )
 
 type Transport struct {
+	// unix nano of the last app traffic, see MessengerFactory.TransportIdleTimeout
+	lastActive int64
+	idleTimer  *cn.WheelTimer
+
 	creator *MessengerFactory
 	// node
 	factory *MessengerFactory
@@ -35,12 +40,37 @@ type Transport struct {
 
 	timeoutTimer  *time.Timer
 	appConnHolder *Connection
+	// conn to the manager the transport was built through
+	via *Connection
 
 	uploadBW   bandwidth
 	downloadBW bandwidth
 
 	connAcked bool
 
+	// see SetWeight
+	weight int
+	// see SetUnordered
+	unordered bool
+	// see SetReceiverReportCallback
+	reportCallback func(r cn.ReceiverReport)
+
+	// the conn between nodes is closed until the next app conn
+	hibernated bool
+	// closed by setUDPConn while waking
+	ready chan struct{}
+
+	// seals the data of the apps, see IsEndToEnd
+	sealer *transportSealer
+	// of the key offered to node B by node A and the iv it is signed with
+	sealKey cipher.SecKey
+	sealIV  []byte
+	// answered to node A by node B
+	sealOffer *transportKey
+
+	// the app is told once the path fails, see fail
+	reconnect bool
+
 	fieldsMutex sync.RWMutex
 }
 
@@ -62,14 +92,23 @@ func NewTransport(creator *MessengerFactory, appConn *Connection, fromNode, toNo
 		FromApp:       fromApp,
 		ToApp:         toApp,
 		clientSide:    cs,
-		factory:       NewMessengerFactory(),
+		factory:       newTransportFactory(creator),
 		conns:         make(map[uint32]net.Conn),
 	}
-	t.factory.Parent = creator
-	t.factory.SetDefaultSeedConfig(creator.GetDefaultSeedConfig())
 	return t
 }
 
+func newTransportFactory(creator *MessengerFactory) *MessengerFactory {
+	f := NewMessengerFactory()
+	f.Parent = creator
+	f.Bandwidth = creator.Bandwidth
+	f.ReceiverReportInterval = creator.ReceiverReportInterval
+	f.UDPCookies = creator.UDPCookies
+	f.SocketOptions = creator.SocketOptions
+	f.SetDefaultSeedConfig(creator.GetDefaultSeedConfig())
+	return f
+}
+
 func (t *Transport) SetOnAcceptedUDPCallback(fn func(connection *Connection)) {
 	t.factory.OnAcceptedUDPCallback = fn
 }
@@ -93,6 +132,47 @@ func (t *Transport) ListenAndConnect(address string, key cipher.PubKey) (conn *C
 	return
 }
 
+// Ask the node manager behind via to build the udp conn to node B, run on node A
+func (t *Transport) connectNode(via *Connection) (err error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return
+	}
+	key, sec, err := t.newTransportKey(t.creator.GetDefaultSeedConfig().keys, iv)
+	if err != nil {
+		return
+	}
+	t.fieldsMutex.Lock()
+	t.sealKey = sec
+	t.sealIV = iv
+	t.fieldsMutex.Unlock()
+	t.SetOnAcceptedUDPCallback(func(connection *Connection) {
+		sc := t.creator.GetDefaultSeedConfig()
+		connection.GetContextLogger().Debugf("set crypto sc %v", sc)
+		if sc == nil {
+			connection.GetContextLogger().Debugf("tr sc is nil")
+		}
+		err := connection.SetCryptoWithKeyProvider(sc.keys, t.ToNode, iv, cn.CIPHER_SUITE_AES_CFB)
+		if err != nil {
+			connection.GetContextLogger().Debugf("set crypto err %v", err)
+		}
+	})
+	c, err := t.ListenAndConnect(via.GetRemoteAddr().String(), via.GetTargetKey())
+	if err != nil {
+		return
+	}
+	err = c.writeOP(OP_FORWARD_NODE_CONN, &forwardNodeConn{
+		Node:      t.ToNode,
+		App:       t.ToApp,
+		FromApp:   t.FromApp,
+		FromNode:  t.FromNode,
+		Num:       iv,
+		Key:       key,
+		AckWindow: true,
+	})
+	return
+}
+
 // Connect to node B
 func (t *Transport) clientSideConnect(address string, sc *SeedConfig, iv []byte) (err error) {
 	t.fieldsMutex.Lock()
@@ -108,7 +188,7 @@ func (t *Transport) clientSideConnect(address string, sc *SeedConfig, iv []byte)
 	if err != nil {
 		return
 	}
-	err = conn.SetCrypto(sc.publicKey, sc.secKey, t.ToNode, iv)
+	err = conn.SetCryptoWithKeyProvider(sc.keys, t.ToNode, iv, cn.CIPHER_SUITE_AES_CFB)
 	if err != nil {
 		return
 	}
@@ -122,31 +202,42 @@ func (t *Transport) connAck() {
 	t.fieldsMutex.Unlock()
 }
 
-// Connect to node A and server app
-func (t *Transport) serverSiceConnect(address, appAddress string, sc *SeedConfig, iv []byte) (err error) {
+// Connect to node A and server app, ackWindow if node A reads TYPE_ACK_WINDOW
+func (t *Transport) serverSiceConnect(address, appAddress string, sc *SeedConfig, iv []byte, ackWindow bool) (err error) {
 	conn, err := t.factory.connectUDPWithConfig(address, &ConnConfig{
 		Creator: t.creator,
 	})
 	if err != nil {
 		return
 	}
-	err = conn.SetCrypto(sc.publicKey, sc.secKey, t.FromNode, iv)
+	if ackWindow {
+		// node A switches at the first of them
+		conn.EnableAckWindow()
+	}
+	err = conn.SetCryptoWithKeyProvider(sc.keys, t.FromNode, iv, cn.CIPHER_SUITE_AES_CFB)
 	if err != nil {
 		return
 	}
+	t.fieldsMutex.RLock()
+	key := t.sealOffer
+	t.fieldsMutex.RUnlock()
 	err = conn.writeOP(OP_BUILD_APP_CONN_OK,
 		&buildConnResp{
 			FromNode: t.FromNode,
 			Node:     t.ToNode,
 			FromApp:  t.FromApp,
 			App:      t.ToApp,
+			Key:      key,
 		})
 	if err != nil {
 		return
 	}
 	t.fieldsMutex.Lock()
 	t.conn = conn
+	t.applyWeight()
+	t.applyReportCallback()
 	t.fieldsMutex.Unlock()
+	t.publish(EVENT_TRANSPORT_BUILT)
 
 	go t.nodeReadLoop(conn, func(id uint32) net.Conn {
 		t.connsMutex.Lock()
@@ -155,7 +246,7 @@ func (t *Transport) serverSiceConnect(address, appAddress string, sc *SeedConfig
 		if !ok {
 			appConn, err = net.Dial("tcp", appAddress)
 			if err != nil {
-				log.Debugf("app conn dial err %v", err)
+				cn.GetLogger().Debugf("app conn dial err %v", err)
 				return nil
 			}
 			t.conns[id] = appConn
@@ -170,7 +261,13 @@ func (t *Transport) serverSiceConnect(address, appAddress string, sc *SeedConfig
 // Read from node, write to app
 func (t *Transport) nodeReadLoop(conn *Connection, getAppConn func(id uint32) net.Conn) {
 	defer func() {
-		t.Close()
+		// the conn is replaced on hibernation
+		t.fieldsMutex.RLock()
+		current := t.conn == conn
+		t.fieldsMutex.RUnlock()
+		if current {
+			t.fail()
+		}
 	}()
 	var err error
 	for {
@@ -182,12 +279,17 @@ func (t *Transport) nodeReadLoop(conn *Connection, getAppConn func(id uint32) ne
 			}
 			conn.GetContextLogger().Debugf("get chan in %x", m)
 			t.downloadBW.add(len(m))
+			t.touch()
+			op := m[PKG_HEADER_OP_BEGIN]
+			if op == OP_SHUTDOWN {
+				conn.GetContextLogger().Debugf("node conn shutdown by peer")
+				return
+			}
 			id := binary.BigEndian.Uint32(m[PKG_HEADER_ID_BEGIN:PKG_HEADER_ID_END])
 			appConn := getAppConn(id)
 			if appConn == nil {
 				continue
 			}
-			op := m[PKG_HEADER_OP_BEGIN]
 			if op == OP_CLOSE {
 				t.connsMutex.Lock()
 				t.conns[id] = nil
@@ -199,6 +301,13 @@ func (t *Transport) nodeReadLoop(conn *Connection, getAppConn func(id uint32) ne
 				continue
 			}
 			body := m[PKG_HEADER_END:]
+			if s := t.getSealer(); s != nil {
+				body, err = s.open(m)
+				if err != nil {
+					conn.GetContextLogger().Debugf("app conn %d drop %v", id, err)
+					continue
+				}
+			}
 			err = writeAll(appConn, body)
 			if err != nil {
 				conn.GetContextLogger().Debugf("app conn write err %v", err)
@@ -249,25 +358,92 @@ func (t *Transport) appReadLoop(id uint32, appConn net.Conn, conn *Connection, c
 		conn.WriteToChannel(channel, buf[:PKG_HEADER_END])
 	}
 	for {
-		n, err := appConn.Read(buf[PKG_HEADER_END:])
+		// room for the seal
+		n, err := appConn.Read(buf[PKG_HEADER_END : len(buf)-TRANSPORT_SEAL_OVERHEAD])
 		if err != nil {
-			log.Debugf("app conn read err %v, %d", err, n)
+			cn.GetLogger().Debugf("app conn read err %v, %d", err, n)
 			return
 		}
 		pkg := make([]byte, PKG_HEADER_END+n)
 		copy(pkg, buf[:PKG_HEADER_END+n])
+		if s := t.getSealer(); s != nil {
+			pkg = s.seal(pkg)
+		}
 		conn.GetContextLogger().Debugf("app conn in %x", pkg)
 		t.uploadBW.add(len(pkg))
-		conn.WriteToChannel(channel, pkg)
+		t.touch()
+		if t.isUnordered() {
+			conn.WriteUnreliable(pkg)
+		} else {
+			conn.WriteToChannel(channel, pkg)
+		}
 	}
 }
 
 func (t *Transport) setUDPConn(conn *Connection) {
 	t.fieldsMutex.Lock()
 	t.conn = conn
+	t.applyWeight()
+	t.applyReportCallback()
+	if t.ready != nil {
+		close(t.ready)
+		t.ready = nil
+	}
 	t.fieldsMutex.Unlock()
 }
 
+// SetWeight sets the share of the transport against the other transports of the
+// node within MessengerFactory.Bandwidth, 1 by default. The app connections of one
+// transport share it round robin
+func (t *Transport) SetWeight(weight int) {
+	t.fieldsMutex.Lock()
+	t.weight = weight
+	t.applyWeight()
+	t.fieldsMutex.Unlock()
+}
+
+// SetUnordered sends the data of the apps unreliably, a lost read is not sent
+// again and a late one is dropped if a newer one arrived, for apps like voice
+// or games that rather skip data than wait for it. Opening and closing app
+// connections stays reliable. Only the data sent by this side is affected
+func (t *Transport) SetUnordered(unordered bool) {
+	t.fieldsMutex.Lock()
+	t.unordered = unordered
+	t.fieldsMutex.Unlock()
+}
+
+// SetReceiverReportCallback calls fn with the reports the peer node sends about
+// the data of this side every MessengerFactory.ReceiverReportInterval of the
+// peer, so an app can adapt its bitrate to the loss and jitter on the way
+func (t *Transport) SetReceiverReportCallback(fn func(r cn.ReceiverReport)) {
+	t.fieldsMutex.Lock()
+	t.reportCallback = fn
+	t.applyReportCallback()
+	t.fieldsMutex.Unlock()
+}
+
+// fieldsMutex must be held
+func (t *Transport) applyReportCallback() {
+	if t.conn == nil || t.reportCallback == nil {
+		return
+	}
+	t.conn.SetReceiverReportCallback(t.reportCallback)
+}
+
+func (t *Transport) isUnordered() bool {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	return t.unordered
+}
+
+// fieldsMutex must be held
+func (t *Transport) applyWeight() {
+	if t.conn == nil || t.weight < 1 || t.creator.Bandwidth == nil {
+		return
+	}
+	t.conn.SetSharedBandwidth(t.creator.Bandwidth, t.weight)
+}
+
 var (
 	appPort      int = 30000
 	appPortMutex sync.Mutex
@@ -338,18 +514,25 @@ func (t *Transport) accept() {
 	tConn := t.conn
 	t.fieldsMutex.RUnlock()
 
-	go t.nodeReadLoop(tConn, func(id uint32) net.Conn {
-		t.connsMutex.RLock()
-		conn := t.conns[id]
-		t.connsMutex.RUnlock()
-		return conn
-	})
+	go t.nodeReadLoop(tConn, t.getAppConn)
+	if timeout := t.creator.TransportIdleTimeout; timeout > 0 {
+		t.touch()
+		t.watchIdle(timeout)
+	}
 	var idSeq uint32
 	for {
 		conn, err := t.appNet.Accept()
 		if err != nil {
 			return
 		}
+		t.touch()
+		tConn, err := t.wake()
+		if err != nil {
+			cn.GetLogger().Debugf("transport wake err %v", err)
+			conn.Close()
+			t.fail()
+			return
+		}
 		id := atomic.AddUint32(&idSeq, 1)
 		t.connsMutex.Lock()
 		t.conns[id] = conn
@@ -358,6 +541,13 @@ func (t *Transport) accept() {
 	}
 }
 
+func (t *Transport) getAppConn(id uint32) net.Conn {
+	t.connsMutex.RLock()
+	conn := t.conns[id]
+	t.connsMutex.RUnlock()
+	return conn
+}
+
 func (t *Transport) Close() {
 	t.fieldsMutex.Lock()
 	defer t.fieldsMutex.Unlock()
@@ -365,6 +555,9 @@ func (t *Transport) Close() {
 	if t.factory == nil {
 		return
 	}
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+	}
 
 	t.connsMutex.RLock()
 	for _, v := range t.conns {
@@ -384,6 +577,10 @@ func (t *Transport) Close() {
 	}
 	t.factory.Close()
 	t.factory = nil
+	t.publish(EVENT_TRANSPORT_CLOSED)
+	if t.via != nil {
+		t.via.activeTransportDone()
+	}
 
 	if t.clientSide {
 		t.appConnHolder.setTransport(t.ToApp, nil)
@@ -0,0 +1,164 @@
+package factory
+
+import (
+	"crypto/aes"
+	cipher2 "crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	cn "github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// the seq and the tag a sealed packet of a transport is longer by
+const TRANSPORT_SEAL_OVERHEAD = 8 + 16
+
+var (
+	ErrTransportKey       = cn.NewError(cn.ErrUnauthorized, "transport key invalid")
+	ErrTransportKeyNeeded = cn.NewError(cn.ErrUnauthorized, "transport key needed")
+	ErrTransportSealed    = errors.New("transport packet can not be opened")
+)
+
+// transportKey is the ephemeral key a node offers for the data of the apps of
+// a transport, signed by the node so the manager forwarding it can not swap it
+type transportKey struct {
+	Key cipher.PubKey
+	Sig cipher.Sig
+}
+
+// transportKeyHash binds key to the apps and the iv of one build
+func transportKeyHash(key, fromApp, toApp cipher.PubKey, iv []byte) cipher.SHA256 {
+	b := make([]byte, 0, 3*len(key)+len(iv))
+	b = append(b, key[:]...)
+	b = append(b, fromApp[:]...)
+	b = append(b, toApp[:]...)
+	b = append(b, iv...)
+	return cipher.SumSHA256(b)
+}
+
+// newTransportKey makes an ephemeral key of t signed by keys
+func (t *Transport) newTransportKey(keys cn.KeyProvider, iv []byte) (k *transportKey, sec cipher.SecKey, err error) {
+	pub, sec := cipher.GenerateKeyPair()
+	sig, err := keys.SignHash(transportKeyHash(pub, t.FromApp, t.ToApp, iv))
+	if err != nil {
+		return
+	}
+	k = &transportKey{Key: pub, Sig: sig}
+	return
+}
+
+// checkTransportKey checks the key node offered for a transport from
+// fromApp to toApp, a node without one is refused by
+// MessengerFactory.RequireTransportE2E only
+func checkTransportKey(f *MessengerFactory, peer *transportKey, node, fromApp, toApp cipher.PubKey, iv []byte) error {
+	if peer == nil {
+		if f.RequireTransportE2E {
+			return ErrTransportKeyNeeded
+		}
+		return nil
+	}
+	if cipher.VerifySignature(node, peer.Sig, transportKeyHash(peer.Key, fromApp, toApp, iv)) != nil {
+		return ErrTransportKey
+	}
+	return nil
+}
+
+// seal derives the key of the apps of t from the checked key of the peer
+// node and sec, only the two nodes know it. The data is not sealed if peer
+// is nil
+func (t *Transport) seal(peer *transportKey, sec cipher.SecKey) (err error) {
+	var s *transportSealer
+	if current := t.getSealer(); current != nil && peer != nil && current.peer == peer.Key {
+		// again, a new sealer would repeat the nonces
+		return
+	}
+	if peer != nil {
+		secret := append(cipher.ECDH(peer.Key, sec), t.FromApp[:]...)
+		secret = append(secret, t.ToApp[:]...)
+		key := cipher.SumSHA256(secret)
+		var block cipher2.Block
+		block, err = aes.NewCipher(key[:])
+		if err != nil {
+			return
+		}
+		s = &transportSealer{peer: peer.Key}
+		s.aead, err = cipher2.NewGCM(block)
+		if err != nil {
+			return
+		}
+		if !t.clientSide {
+			s.out = 1
+		}
+	}
+	t.fieldsMutex.Lock()
+	t.sealer = s
+	t.fieldsMutex.Unlock()
+	return
+}
+
+func (t *Transport) getSealer() *transportSealer {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	return t.sealer
+}
+
+// sealWith checks the key node B answered to the one of connectNode and
+// seals with it, run on node A
+func (t *Transport) sealWith(peer *transportKey) error {
+	t.fieldsMutex.RLock()
+	sec, iv := t.sealKey, t.sealIV
+	t.fieldsMutex.RUnlock()
+	err := checkTransportKey(t.creator, peer, t.ToNode, t.FromApp, t.ToApp, iv)
+	if err != nil {
+		return err
+	}
+	return t.seal(peer, sec)
+}
+
+// IsEndToEnd reports if the data of the apps is sealed with a key of the two
+// nodes of the transport, the conns it passes can not read it
+func (t *Transport) IsEndToEnd() bool {
+	return t.getSealer() != nil
+}
+
+// transportSealer seals the bodies of the packets of a transport, the header
+// stays readable and is authenticated
+type transportSealer struct {
+	aead cipher2.AEAD
+	// the key of the peer node it is derived from
+	peer cipher.PubKey
+	// first byte of the nonces of the packets sent, 0 on node A and 1 on
+	// node B
+	out byte
+	seq uint64
+}
+
+func (s *transportSealer) nonce(dir byte, seq uint64) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	nonce[0] = dir
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// seal returns pkg with its body sealed
+func (s *transportSealer) seal(pkg []byte) []byte {
+	seq := atomic.AddUint64(&s.seq, 1)
+	sealed := make([]byte, PKG_HEADER_END+8, len(pkg)+TRANSPORT_SEAL_OVERHEAD)
+	copy(sealed, pkg[:PKG_HEADER_END])
+	binary.BigEndian.PutUint64(sealed[PKG_HEADER_END:], seq)
+	return s.aead.Seal(sealed, s.nonce(s.out, seq), pkg[PKG_HEADER_END:], pkg[:PKG_HEADER_END])
+}
+
+// open returns the body of the sealed pkg of the peer
+func (s *transportSealer) open(pkg []byte) ([]byte, error) {
+	if len(pkg) < PKG_HEADER_END+TRANSPORT_SEAL_OVERHEAD {
+		return nil, ErrTransportSealed
+	}
+	seq := binary.BigEndian.Uint64(pkg[PKG_HEADER_END:])
+	body, err := s.aead.Open(nil, s.nonce(s.out^1, seq), pkg[PKG_HEADER_END+8:], pkg[:PKG_HEADER_END])
+	if err != nil {
+		return nil, ErrTransportSealed
+	}
+	return body, nil
+}
@@ -0,0 +1,81 @@
+package factory
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestTransportSeal(t *testing.T) {
+	f := NewMessengerFactory()
+	fromApp, _ := cipher.GenerateKeyPair()
+	toApp, _ := cipher.GenerateKeyPair()
+	nodeA, nodeB := NewSeedConfig(), NewSeedConfig()
+	a := &Transport{creator: f, clientSide: true, FromApp: fromApp, ToApp: toApp}
+	b := &Transport{creator: f, FromApp: fromApp, ToApp: toApp}
+	iv := []byte("iv of the build")
+
+	keyA, secA, err := a.newTransportKey(nodeA.keys, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkTransportKey(f, keyA, nodeA.publicKey, fromApp, toApp, iv); err != nil {
+		t.Fatal(err)
+	}
+	// swapped by the manager or replayed from another build
+	if err = checkTransportKey(f, keyA, nodeB.publicKey, fromApp, toApp, iv); err != ErrTransportKey {
+		t.Fatalf("key of another node err %v", err)
+	}
+	if err = checkTransportKey(f, keyA, nodeA.publicKey, fromApp, toApp, []byte("other")); err != ErrTransportKey {
+		t.Fatalf("key of another build err %v", err)
+	}
+	if err = checkTransportKey(f, nil, nodeA.publicKey, fromApp, toApp, iv); err != nil {
+		t.Fatalf("no key err %v", err)
+	}
+	f.RequireTransportE2E = true
+	if err = checkTransportKey(f, nil, nodeA.publicKey, fromApp, toApp, iv); err != ErrTransportKeyNeeded {
+		t.Fatalf("no key required err %v", err)
+	}
+
+	keyB, secB, err := b.newTransportKey(nodeB.keys, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.seal(keyA, secB); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.seal(keyB, secA); err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsEndToEnd() || !b.IsEndToEnd() {
+		t.Fatal("not end to end")
+	}
+
+	pkg := append(make([]byte, PKG_HEADER_END), "hello"...)
+	pkg[PKG_HEADER_ID_END-1] = 7
+	sealed := a.getSealer().seal(pkg)
+	if len(sealed) != len(pkg)+TRANSPORT_SEAL_OVERHEAD || bytes.Contains(sealed, []byte("hello")) {
+		t.Fatalf("sealed %x", sealed)
+	}
+	body, err := b.getSealer().open(sealed)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("opened %q err %v", body, err)
+	}
+	// a packet of its own direction
+	if _, err = a.getSealer().open(sealed); err != ErrTransportSealed {
+		t.Fatalf("open of own packet err %v", err)
+	}
+	sealed[PKG_HEADER_ID_END-1] = 8
+	if _, err = b.getSealer().open(sealed); err != ErrTransportSealed {
+		t.Fatalf("open of moved packet err %v", err)
+	}
+	body, err = a.getSealer().open(b.getSealer().seal(pkg))
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("opened %q err %v", body, err)
+	}
+
+	if err = a.seal(nil, secA); err != nil || a.IsEndToEnd() {
+		t.Fatalf("unsealed err %v", err)
+	}
+}
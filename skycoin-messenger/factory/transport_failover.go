@@ -0,0 +1,60 @@
+package factory
+
+func (t *Transport) getVia() *Connection {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	return t.via
+}
+
+// failoverTransports carries the transports built through the server of c
+// over to another server the node is connected to, run once c closed. Without
+// one they stay on c and fail at the next wake
+func (f *MessengerFactory) failoverTransports(c *Connection) {
+	var trs []*Transport
+	f.ForEachTransport(func(t *Transport) {
+		if t.getVia() == c {
+			trs = append(trs, t)
+		}
+	})
+	if len(trs) < 1 {
+		return
+	}
+	var via *Connection
+	f.ForEachConn(func(conn *Connection) {
+		if via == nil && conn != c && !conn.IsClosed() && !conn.IsDraining() && conn.IsKeySet() {
+			via = conn
+		}
+	})
+	if via == nil {
+		c.GetContextLogger().Debugf("no server to carry %d transports over to", len(trs))
+		return
+	}
+	for _, t := range trs {
+		t.failover(c, via)
+	}
+}
+
+// failover moves t from the closed old to via. The conn between the nodes
+// does not pass the server so the app conns go on, a transport still being
+// built is built again through via
+func (t *Transport) failover(old, via *Connection) {
+	t.fieldsMutex.RLock()
+	closed := t.factory == nil
+	building := t.clientSide && t.conn == nil && !t.hibernated
+	t.fieldsMutex.RUnlock()
+	if closed {
+		return
+	}
+	old.activeTransportDone()
+	via.addActiveTransport(t)
+	if building {
+		if err := t.connectNode(via); err != nil {
+			via.GetContextLogger().Debugf("transport failover err %v", err)
+			t.fail()
+			return
+		}
+	}
+	via.GetContextLogger().Debugf("transport failover %s", t)
+	t.publish(EVENT_TRANSPORT_RECONNECTED)
+	t.notifyApp(OP_TRANSPORT_RECONNECTED)
+}
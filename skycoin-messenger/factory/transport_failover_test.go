@@ -0,0 +1,158 @@
+package factory
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestTransportFailover(t *testing.T) {
+	addr := func(i int) string { return "127.0.0.1:" + strconv.Itoa(25982+i) }
+	server := func(i int) (*MessengerFactory, *SeedConfig) {
+		sc := NewSeedConfig()
+		m := NewMessengerFactory()
+		m.SetDefaultSeedConfig(sc)
+		if err := m.Listen(addr(i)); err != nil {
+			t.Fatal(err)
+		}
+		return m, sc
+	}
+	m1, msc1 := server(0)
+	defer m1.Close()
+	m2, msc2 := server(1)
+	defer m2.Close()
+	connect := func(n *MessengerFactory, sc *SeedConfig, i int, msc *SeedConfig) *Connection {
+		err := n.ConnectWithConfig(addr(i), &ConnConfig{SeedConfig: sc, TargetKey: msc.publicKey, UseCrypto: RegWithKeyAndEncryptionVersion})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		n.ForEachConn(func(c *Connection) {
+			if c.GetTargetKey() == msc.publicKey {
+				conn = c
+			}
+		})
+		return conn
+	}
+	node := func(i int) (*MessengerFactory, *SeedConfig) {
+		sc := NewSeedConfig()
+		n := NewMessengerFactory()
+		n.Proxy = true
+		n.SetDefaultSeedConfig(sc)
+		if err := n.Listen(addr(i)); err != nil {
+			t.Fatal(err)
+		}
+		connect(n, sc, 0, msc1)
+		return n, sc
+	}
+	nodeA, a := node(2)
+	defer nodeA.Close()
+	nodeB, b := node(3)
+	defer nodeB.Close()
+
+	echo, err := net.Listen("tcp", addr(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	app := func(i int, config *ConnConfig) *Connection {
+		f := NewMessengerFactory()
+		config.SeedConfig = NewSeedConfig()
+		if err := f.ConnectWithConfig(addr(i), config); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return conn
+	}
+	service := app(3, &ConnConfig{})
+	defer service.Close()
+	if err = service.OfferServiceWithAddress(addr(4), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	ports := make(chan int, 1)
+	states := make(chan TransportState, 1)
+	client := app(2, &ConnConfig{
+		OnAppConnection: func(ctx context.Context, resp *AppConnResp, err error) *AppFeedback {
+			ports <- resp.Port
+			return nil
+		},
+		OnTransportState: func(ctx context.Context, node, app cipher.PubKey, state TransportState, resp *AppConnResp, err error) {
+			states <- state
+		},
+	})
+	defer client.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	echoed := func(port int) {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err = c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("echo %q err %v", buf, err)
+		}
+	}
+	if err = client.BuildAppConnection(b.publicKey, service.GetKey()); err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	select {
+	case port = <-ports:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no port")
+	}
+	echoed(port)
+
+	// the nodes reach the second server once the transport is built
+	via2 := connect(nodeA, a, 1, msc2)
+	connect(nodeB, b, 1, msc2)
+	events := nodeA.Subscribe(0, EVENT_TRANSPORT_RECONNECTED)
+	defer events.Unsubscribe()
+	// the first server dies, Close leaves the conns it accepted open
+	m1.Close()
+	var accepted []*Connection
+	m1.ForEachAcceptedConnection(func(key cipher.PubKey, c *Connection) { accepted = append(accepted, c) })
+	for _, c := range accepted {
+		c.Close()
+	}
+
+	select {
+	case e := <-events.C:
+		if e.Transport.getVia() != via2 {
+			t.Fatal("transport not carried over to the second server")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no reconnected event")
+	}
+	select {
+	case s := <-states:
+		if s != TRANSPORT_RECONNECTED {
+			t.Fatalf("state %s", s)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no state")
+	}
+	// on the port it had
+	echoed(port)
+}
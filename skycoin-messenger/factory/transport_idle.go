@@ -0,0 +1,128 @@
+package factory
+
+import (
+	cn "github.com/skycoin/net/conn"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTransportWakeTimeout = cn.NewError(cn.ErrTimeout, "transport wake timeout")
+
+const (
+	FACTORY_TIMER_TICK  = 100 * time.Millisecond
+	FACTORY_TIMER_SLOTS = 512
+)
+
+// factoryTimers is the wheel of the idle transports and the service TTLs of
+// every connection
+var factoryTimers = cn.NewTimerWheel(FACTORY_TIMER_TICK, FACTORY_TIMER_SLOTS)
+
+func (t *Transport) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+func (t *Transport) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&t.lastActive))
+}
+
+func (t *Transport) countAppConns() (n int) {
+	t.connsMutex.RLock()
+	for _, v := range t.conns {
+		if v != nil {
+			n++
+		}
+	}
+	t.connsMutex.RUnlock()
+	return
+}
+
+func (t *Transport) isClosed() bool {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	return t.factory == nil
+}
+
+// watchIdle checks the transport every half of timeout until it is closed,
+// run on node A
+func (t *Transport) watchIdle(timeout time.Duration) {
+	t.fieldsMutex.Lock()
+	t.idleTimer = factoryTimers.AfterFunc(timeout/2, func() {
+		if t.isClosed() {
+			return
+		}
+		go t.hibernate(timeout)
+		t.fieldsMutex.RLock()
+		t.idleTimer.Reset(timeout / 2)
+		t.fieldsMutex.RUnlock()
+	})
+	t.fieldsMutex.Unlock()
+}
+
+// hibernate closes the udp conn to node B and its sockets,
+// the app listener stays open and the next app conn wakes the transport up
+func (t *Transport) hibernate(timeout time.Duration) {
+	t.fieldsMutex.Lock()
+	// checked under the lock, accept touches before it wakes the transport
+	if t.idleFor() < timeout || t.countAppConns() > 0 ||
+		t.factory == nil || t.hibernated || t.conn == nil {
+		t.fieldsMutex.Unlock()
+		return
+	}
+	conn := t.conn
+	f := t.factory
+	t.conn = nil
+	t.connAcked = false
+	t.hibernated = true
+	t.factory = newTransportFactory(t.creator)
+	t.fieldsMutex.Unlock()
+
+	conn.GetContextLogger().Debugf("transport hibernate %s", t)
+	pkg := make([]byte, PKG_HEADER_END)
+	pkg[PKG_HEADER_OP_BEGIN] = OP_SHUTDOWN
+	err := conn.Write(pkg)
+	if err != nil {
+		conn.GetContextLogger().Debugf("transport shutdown err %v", err)
+	}
+	// give the shutdown a chance to be sent
+	time.AfterFunc(time.Second, func() {
+		conn.Close()
+		f.Close()
+	})
+}
+
+// wake builds the udp conn to node B again through the manager the transport
+// was built through, and returns the current conn if not hibernated
+func (t *Transport) wake() (conn *Connection, err error) {
+	t.fieldsMutex.Lock()
+	if !t.hibernated {
+		conn = t.conn
+		t.fieldsMutex.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	t.ready = ready
+	via := t.via
+	t.fieldsMutex.Unlock()
+
+	if via == nil || via.IsClosed() {
+		err = cn.ErrConnClosed
+		return
+	}
+	err = t.connectNode(via)
+	if err != nil {
+		return
+	}
+	select {
+	case <-ready:
+	case <-time.After(30 * time.Second):
+		err = ErrTransportWakeTimeout
+		return
+	}
+	t.fieldsMutex.Lock()
+	t.hibernated = false
+	conn = t.conn
+	t.fieldsMutex.Unlock()
+	conn.GetContextLogger().Debugf("transport woke up %s", t)
+	go t.nodeReadLoop(conn, t.getAppConn)
+	return
+}
@@ -0,0 +1,66 @@
+package factory
+
+import (
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// TransportMetrics is a snapshot of the app traffic of a transport
+type TransportMetrics struct {
+	FromNode, ToNode cipher.PubKey
+	FromApp, ToApp   cipher.PubKey
+	ClientSide       bool
+	// of the apps, from and to this side, headers of the packets included
+	SentBytes     uint64
+	ReceivedBytes uint64
+	// bytes/sec of the last second
+	SendRate    uint64
+	ReceiveRate uint64
+	// smoothed rtt of the conn between the nodes, 0 while hibernated
+	RTT time.Duration
+	// open app conns
+	AppConns   int
+	Hibernated bool
+	EndToEnd   bool
+}
+
+// Metrics returns the counters of t
+func (t *Transport) Metrics() TransportMetrics {
+	m := TransportMetrics{
+		FromNode:      t.FromNode,
+		ToNode:        t.ToNode,
+		FromApp:       t.FromApp,
+		ToApp:         t.ToApp,
+		SentBytes:     uint64(t.uploadBW.getTotal()),
+		ReceivedBytes: uint64(t.downloadBW.getTotal()),
+		SendRate:      uint64(t.uploadBW.get()),
+		ReceiveRate:   uint64(t.downloadBW.get()),
+		AppConns:      t.countAppConns(),
+		EndToEnd:      t.IsEndToEnd(),
+	}
+	t.fieldsMutex.RLock()
+	m.ClientSide = t.clientSide
+	m.Hibernated = t.hibernated
+	conn := t.conn
+	t.fieldsMutex.RUnlock()
+	if conn != nil {
+		m.RTT = conn.Metrics().RTT
+	}
+	return m
+}
+
+// ForEachTransport calls fn with each transport of the apps connected to the
+// node, fn may close it
+func (f *MessengerFactory) ForEachTransport(fn func(t *Transport)) {
+	var trs []*Transport
+	// the transports are of the apps, the conns accepted by the node
+	f.ForEachAcceptedConnection(func(key cipher.PubKey, conn *Connection) {
+		conn.ForEachTransport(func(t *Transport) {
+			trs = append(trs, t)
+		})
+	})
+	for _, t := range trs {
+		fn(t)
+	}
+}
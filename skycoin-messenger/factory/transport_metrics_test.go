@@ -0,0 +1,60 @@
+package factory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestTransportMetrics(t *testing.T) {
+	s := NewMessengerFactory()
+	s.SetDefaultSeedConfig(NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25973"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sc := NewSeedConfig()
+	c := NewMessengerFactory()
+	defer c.Close()
+	if err := c.ConnectWithConfig("127.0.0.1:25973", &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	var app *Connection
+	for i := 0; i < 100 && app == nil; i++ {
+		app, _ = s.GetConnection(sc.publicKey)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if app == nil {
+		t.Fatal("app not registered")
+	}
+
+	to, _ := cipher.GenerateKeyPair()
+	tr := &Transport{FromApp: sc.publicKey, ToApp: to, clientSide: true, conns: make(map[uint32]net.Conn)}
+	tr.conns[1] = &net.TCPConn{}
+	tr.conns[2] = nil
+	tr.uploadBW.add(100)
+	tr.downloadBW.add(40)
+	tr.downloadBW.add(2)
+	app.setTransport(to, tr)
+
+	var got []TransportMetrics
+	s.ForEachTransport(func(t *Transport) { got = append(got, t.Metrics()) })
+	if len(got) != 1 {
+		t.Fatalf("transports %d", len(got))
+	}
+	m := got[0]
+	if m.FromApp != sc.publicKey || m.ToApp != to || !m.ClientSide || m.SentBytes != 100 ||
+		m.ReceivedBytes != 42 || m.AppConns != 1 || m.RTT != 0 || m.EndToEnd {
+		t.Fatalf("metrics %+v", m)
+	}
+
+	// fn may close the transport it is called with
+	s.ForEachTransport(func(t *Transport) { app.setTransport(t.ToApp, nil) })
+	got = nil
+	s.ForEachTransport(func(t *Transport) { got = append(got, t.Metrics()) })
+	if len(got) != 0 {
+		t.Fatalf("transports after close %d", len(got))
+	}
+}
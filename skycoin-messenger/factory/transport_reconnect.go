@@ -0,0 +1,171 @@
+package factory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func init() {
+	resps[OP_TRANSPORT_CLOSED] = &sync.Pool{
+		New: func() interface{} {
+			return new(transportClosed)
+		},
+	}
+	resps[OP_TRANSPORT_RECONNECTED] = &sync.Pool{
+		New: func() interface{} {
+			return new(transportReconnected)
+		},
+	}
+}
+
+// a build is given up after this, node A waits as long for its feedback,
+// see SetupTimeout
+const TRANSPORT_BUILD_TIMEOUT = 30 * time.Second
+
+// TransportState of a transport an app built, see ConnConfig.TransportReconnect
+type TransportState int
+
+const (
+	// built again
+	TRANSPORT_CONNECTED TransportState = iota + 1
+	// the path failed, the transport is being built again
+	TRANSPORT_RECONNECTING
+	// given up after ConnConfig.TransportReconnectAttempts or with the conn
+	TRANSPORT_CLOSED
+	// the server it was built through closed and the node carried it over to
+	// another one, its port stays
+	TRANSPORT_RECONNECTED
+)
+
+var transportStateNames = map[TransportState]string{
+	TRANSPORT_CONNECTED:    "connected",
+	TRANSPORT_RECONNECTING: "reconnecting",
+	TRANSPORT_CLOSED:       "closed",
+	TRANSPORT_RECONNECTED:  "reconnected",
+}
+
+func (s TransportState) String() string {
+	if name, ok := transportStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// TransportStateCallback is told the state of the transport to app on node.
+// resp is the one of the build for TRANSPORT_CONNECTED, the app conns connect
+// to its port from then on. err is why it was given up for TRANSPORT_CLOSED
+type TransportStateCallback func(ctx context.Context, node, app cipher.PubKey, state TransportState, resp *AppConnResp, err error)
+
+type transportReconnect struct {
+	wait     time.Duration
+	attempts int
+}
+
+// transportClosed is sent to the app by node A once the path of a transport
+// it built failed
+type transportClosed struct {
+	Node cipher.PubKey
+	App  cipher.PubKey
+}
+
+// run on app
+func (req *transportClosed) Run(conn *Connection) (err error) {
+	conn.GetContextLogger().Debugf("recv %#v", req)
+	if conn.transportReconnect != nil {
+		go conn.rebuildTransport(req.Node, req.App)
+	} else {
+		conn.transportState(req.Node, req.App, TRANSPORT_CLOSED, nil, nil)
+	}
+	return
+}
+
+type transportReconnected transportClosed
+
+// run on app
+func (req *transportReconnected) Run(conn *Connection) (err error) {
+	conn.GetContextLogger().Debugf("recv %#v", req)
+	conn.transportState(req.Node, req.App, TRANSPORT_RECONNECTED, nil, nil)
+	return
+}
+
+// fail closes t after its path to node B failed, the app is told if it
+// follows the transport
+func (t *Transport) fail() {
+	t.fieldsMutex.RLock()
+	notify := t.factory != nil
+	t.fieldsMutex.RUnlock()
+	t.Close()
+	if notify {
+		t.notifyApp(OP_TRANSPORT_CLOSED)
+	}
+}
+
+// notifyApp sends op to the app that built t and follows its state
+func (t *Transport) notifyApp(op byte) {
+	if !t.clientSide || !t.reconnect {
+		return
+	}
+	err := t.appConnHolder.writeOP(op|RESP_PREFIX, &transportClosed{Node: t.ToNode, App: t.ToApp})
+	if err != nil {
+		t.appConnHolder.GetContextLogger().Debugf("transport notify op %d err %v", op, err)
+	}
+}
+
+// rebuildTransport builds the transport to app on node again until it
+// connects, the wait between the builds doubles
+func (c *Connection) rebuildTransport(node, app cipher.PubKey) {
+	if _, loaded := c.transportRebuilds.LoadOrStore(app, struct{}{}); loaded {
+		return
+	}
+	defer c.transportRebuilds.Delete(app)
+	c.transportState(node, app, TRANSPORT_RECONNECTING, nil, nil)
+
+	r := c.transportReconnect
+	wait := r.wait
+	if wait <= 0 {
+		wait = DEFAULT_RETRY_WAIT
+	}
+	var err error
+	for i := 0; r.attempts < 1 || i < r.attempts; i++ {
+		if i > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.Disconnected():
+				timer.Stop()
+				c.transportState(node, app, TRANSPORT_CLOSED, nil, ErrAppConnFailed)
+				return
+			}
+			wait *= 2
+			if wait > MAX_RETRY_WAIT {
+				wait = MAX_RETRY_WAIT
+			}
+		}
+		ctx, cancel := context.WithTimeout(c.Context(), TRANSPORT_BUILD_TIMEOUT)
+		var resp *AppConnResp
+		resp, err = c.awaitAppConnection(ctx, node, app)
+		cancel()
+		if err == nil {
+			if !resp.Failed {
+				c.transportState(node, app, TRANSPORT_CONNECTED, resp, nil)
+				return
+			}
+			err = resp.typedErr()
+		}
+		c.GetContextLogger().Debugf("rebuild transport to app %x err %v", app, err)
+		if c.IsClosed() {
+			break
+		}
+	}
+	c.transportState(node, app, TRANSPORT_CLOSED, nil, err)
+}
+
+func (c *Connection) transportState(node, app cipher.PubKey, state TransportState, resp *AppConnResp, err error) {
+	c.GetContextLogger().Debugf("transport to app %x on node %x %s", app, node, state)
+	if c.onTransportState != nil {
+		c.onTransportState(c.Context(), node, app, state, resp, err)
+	}
+}
@@ -0,0 +1,139 @@
+package factory
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestTransportReconnect(t *testing.T) {
+	addr := func(i int) string { return "127.0.0.1:" + strconv.Itoa(25974+i) }
+	msc := NewSeedConfig()
+	m := NewMessengerFactory()
+	m.SetDefaultSeedConfig(msc)
+	if err := m.Listen(addr(0)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	node := func(i int) (*MessengerFactory, *Connection) {
+		sc := NewSeedConfig()
+		n := NewMessengerFactory()
+		n.Proxy = true
+		n.SetDefaultSeedConfig(sc)
+		if err := n.Listen(addr(i)); err != nil {
+			t.Fatal(err)
+		}
+		err := n.ConnectWithConfig(addr(0), &ConnConfig{SeedConfig: sc, TargetKey: msc.publicKey, UseCrypto: RegWithKeyAndEncryptionVersion})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		n.ForEachConn(func(c *Connection) { conn = c })
+		return n, conn
+	}
+	nodeA, _ := node(1)
+	defer nodeA.Close()
+	nodeB, toNode := node(2)
+	defer nodeB.Close()
+
+	echo, err := net.Listen("tcp", addr(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	app := func(i int, config *ConnConfig) *Connection {
+		f := NewMessengerFactory()
+		config.SeedConfig = NewSeedConfig()
+		if err := f.ConnectWithConfig(addr(i), config); err != nil {
+			t.Fatal(err)
+		}
+		var conn *Connection
+		f.ForEachConn(func(c *Connection) { conn = c })
+		return conn
+	}
+	server := app(2, &ConnConfig{})
+	defer server.Close()
+	if err = server.OfferServiceWithAddress(addr(3), "echo"); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := make(chan int, 1)
+	states := make(chan TransportState, 4)
+	client := app(1, &ConnConfig{
+		TransportReconnect:     true,
+		TransportReconnectWait: 100 * time.Millisecond,
+		OnAppConnection: func(ctx context.Context, resp *AppConnResp, err error) *AppFeedback {
+			ports <- resp.Port
+			return nil
+		},
+		OnTransportState: func(ctx context.Context, node, app cipher.PubKey, state TransportState, resp *AppConnResp, err error) {
+			if state == TRANSPORT_CONNECTED {
+				ports <- resp.Port
+			}
+			states <- state
+		},
+	})
+	defer client.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	port := func() int {
+		select {
+		case p := <-ports:
+			return p
+		case <-time.After(10 * time.Second):
+			t.Fatal("no port")
+		}
+		return 0
+	}
+	echoed := func(port int) {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err = c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("echo %q err %v", buf, err)
+		}
+	}
+	if err = client.BuildAppConnection(toNode.GetKey(), server.GetKey()); err != nil {
+		t.Fatal(err)
+	}
+	echoed(port())
+
+	// the path to node B fails
+	nodeA.ForEachTransport(func(tr *Transport) {
+		tr.fieldsMutex.RLock()
+		tr.conn.Close()
+		tr.fieldsMutex.RUnlock()
+	})
+	for _, want := range []TransportState{TRANSPORT_RECONNECTING, TRANSPORT_CONNECTED} {
+		select {
+		case s := <-states:
+			if s != want {
+				t.Fatalf("state %s want %s", s, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no state %s", want)
+		}
+	}
+	echoed(port())
+}
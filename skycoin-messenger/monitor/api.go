@@ -0,0 +1,29 @@
+package monitor
+
+import (
+	"net/http"
+	"strings"
+)
+
+// every api path is also served under this prefix, always enveloped
+const APIV2Prefix = "/api/v2"
+
+type apiHandler func(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int)
+
+// handleAPI registers fn on the legacy path, which is deprecated, and under APIV2Prefix
+func (m *Monitor) handleAPI(path string, fn apiHandler) {
+	legacy := bundle(fn)
+	successor := "<" + APIV2Prefix + path + ">; rel=\"successor-version\""
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", successor)
+		legacy(w, r)
+	})
+	http.HandleFunc(APIV2Prefix+path, func(w http.ResponseWriter, r *http.Request) {
+		bundleEnvelope(fn, w, r)
+	})
+}
+
+func isAPIV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, APIV2Prefix+"/")
+}
@@ -0,0 +1,194 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const BACKUP_VERSION = 1
+
+var ErrBackupSigner = errors.New("backup signed by another manager, confirm its key")
+
+// Backup is the state of a manager signed by the key of its messenger
+type Backup struct {
+	Version int             `json:"version"`
+	Created int64           `json:"created"`
+	State   json.RawMessage `json:"state"`
+	PubKey  cipher.PubKey   `json:"pubkey"`
+	Sig     cipher.Sig      `json:"sig"`
+}
+
+// BackupState has the files of the data dir and the node configs
+type BackupState struct {
+	User          *User                 `json:"user,omitempty"`
+	NodeConfigs   map[string]*Config    `json:"nodeConfigs"`
+	SSHClients    clientConnectionSlice `json:"sshClients"`
+	SocketClients clientConnectionSlice `json:"socketClients"`
+}
+
+func (m *Monitor) backupState() (s *BackupState, err error) {
+	s = &BackupState{}
+	s.User, err = readUserConfig(m.userPath())
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.SSHClients, err = m.readConfig(m.clientPath("ssh"))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.SocketClients, err = m.readConfig(m.clientPath("socket"))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	m.configsMutex.RLock()
+	s.NodeConfigs = make(map[string]*Config, len(m.configs))
+	for k, v := range m.configs {
+		s.NodeConfigs[k] = v
+	}
+	m.configsMutex.RUnlock()
+	return
+}
+
+// restoreState replaces the state of the manager by s
+func (m *Monitor) restoreState(s *BackupState) (err error) {
+	if s.User != nil {
+		var data []byte
+		data, err = json.Marshal(s.User)
+		if err != nil {
+			return
+		}
+		err = WriteConfig(data, m.userPath())
+		if err != nil {
+			return
+		}
+	}
+	err = m.saveClientFile(s.SSHClients, m.clientPath("ssh"))
+	if err != nil {
+		return
+	}
+	err = m.saveClientFile(s.SocketClients, m.clientPath("socket"))
+	if err != nil {
+		return
+	}
+	m.configsMutex.Lock()
+	defer m.configsMutex.Unlock()
+	for key := range m.configs {
+		if _, ok := s.NodeConfigs[key]; !ok {
+			delete(m.configs, key)
+			delete(m.configRevisions, key)
+		}
+	}
+	for key, config := range s.NodeConfigs {
+		var data []byte
+		data, err = json.Marshal(config)
+		if err != nil {
+			return
+		}
+		m.configs[key] = config
+		m.pushConfigRevision(key, data)
+	}
+	return m.saveNodeConfigs()
+}
+
+// NewBackup signs the current state
+func (m *Monitor) NewBackup() (b *Backup, err error) {
+	sc := m.factory.GetDefaultSeedConfig()
+	if sc == nil || sc.Keys() == nil {
+		return nil, errors.New("no key to sign the backup")
+	}
+	s, err := m.backupState()
+	if err != nil {
+		return
+	}
+	b = &Backup{Version: BACKUP_VERSION, Created: time.Now().Unix(), PubKey: sc.Keys().PubKey()}
+	b.State, err = json.Marshal(s)
+	if err != nil {
+		return
+	}
+	b.Sig, err = sc.Keys().SignHash(cipher.SumSHA256(b.State))
+	return
+}
+
+// Verify checks the version and the signature of b
+func (b *Backup) Verify() error {
+	if b.Version != BACKUP_VERSION {
+		return errors.Errorf("backup version %d", b.Version)
+	}
+	return cipher.VerifySignature(b.PubKey, b.Sig, cipher.SumSHA256(b.State))
+}
+
+// Restore verifies b and replaces the current state by it. A backup of another
+// manager is restored only if signer is its key
+func (m *Monitor) Restore(b *Backup, signer string) (err error) {
+	err = b.Verify()
+	if err != nil {
+		return
+	}
+	sc := m.factory.GetDefaultSeedConfig()
+	if (sc == nil || sc.Keys() == nil || sc.Keys().PubKey() != b.PubKey) && signer != b.PubKey.Hex() {
+		return ErrBackupSigner
+	}
+	var s *BackupState
+	err = json.Unmarshal(b.State, &s)
+	if err != nil {
+		return
+	}
+	if s == nil {
+		return errors.New("empty backup")
+	}
+	return m.restoreState(s)
+}
+
+func (m *Monitor) exportBackup(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	b, err := m.NewBackup()
+	if err != nil {
+		return
+	}
+	result, err = json.Marshal(b)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="manager-backup.json"`)
+	return
+}
+
+func (m *Monitor) importBackup(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		code = BAD_REQUEST
+		err = errors.New("please use post method")
+		return
+	}
+	var b *Backup
+	err = json.Unmarshal([]byte(r.FormValue("data")), &b)
+	if err != nil || b == nil {
+		code = BAD_REQUEST
+		err = errors.New("invalid backup")
+		return
+	}
+	if err = b.Verify(); err != nil {
+		code = BAD_REQUEST
+		return
+	}
+	err = m.Restore(b, r.FormValue("key"))
+	if err == ErrBackupSigner {
+		code = BAD_REQUEST
+	}
+	if err != nil {
+		return
+	}
+	globalSessions.SessionDestroy(w, r)
+	result = []byte("true")
+	return
+}
@@ -0,0 +1,63 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+)
+
+func newBackupMonitor(t *testing.T) (m *Monitor, dir string) {
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := factory.NewMessengerFactory()
+	f.SetDefaultSeedConfig(factory.NewSeedConfig())
+	m = New(f, "", "", "", "")
+	m.SetDataDir(dir)
+	return
+}
+
+func TestBackupRestore(t *testing.T) {
+	a, dirA := newBackupMonitor(t)
+	defer os.RemoveAll(dirA)
+	a.configs["node"] = &Config{DiscoveryAddresses: []string{"127.0.0.1:5999"}}
+	err := a.saveClientFile(clientConnectionSlice{{Label: "vpn", NodeKey: "n", AppKey: "a"}}, a.clientPath("ssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkPass(a.userPath(), "1234"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := a.NewBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, dirC := newBackupMonitor(t)
+	defer os.RemoveAll(dirC)
+	c.configs["old"] = &Config{}
+	if err = c.Restore(b, ""); err != ErrBackupSigner {
+		t.Fatalf("restored from an unknown key: %v", err)
+	}
+	if err = c.Restore(b, b.PubKey.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.configs["old"]; ok || c.configs["node"] == nil {
+		t.Fatalf("configs %v", c.configs)
+	}
+	cfs, err := c.readConfig(c.clientPath("ssh"))
+	if err != nil || len(cfs) != 1 || cfs[0].Label != "vpn" {
+		t.Fatalf("ssh clients %v %v", cfs, err)
+	}
+	if err = checkPass(c.userPath(), "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	b.State = append(b.State[:len(b.State)-1], ` `...)
+	if err = a.Restore(b, ""); err == nil {
+		t.Fatal("restored a modified backup")
+	}
+}
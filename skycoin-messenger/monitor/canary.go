@@ -0,0 +1,361 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/skycoin/net/skycoin-messenger/factory"
+)
+
+// round trips of the canary
+const (
+	CANARY_REGISTER = "register"
+	CANARY_QUERY    = "query"
+	CANARY_SEND     = "send"
+)
+
+const (
+	DEFAULT_CANARY_INTERVAL = 30 * time.Second
+	DEFAULT_CANARY_TIMEOUT  = 5 * time.Second
+	// query waits this long before asking again for a service not offered yet
+	CANARY_QUERY_RETRY = 50 * time.Millisecond
+)
+
+var canaryChecks = []string{CANARY_REGISTER, CANARY_QUERY, CANARY_SEND}
+
+// CanaryConfig of the synthetic clients the monitor keeps on its server, see
+// StartCanary
+type CanaryConfig struct {
+	// between the rounds, DEFAULT_CANARY_INTERVAL if 0
+	Interval time.Duration
+	// a round trip taking longer fails, DEFAULT_CANARY_TIMEOUT if 0
+	Timeout time.Duration
+	// a round trip slower than this alerts, never if 0
+	MaxLatency time.Duration
+	// failures in a row that alert, 1 if 0
+	MaxFailures int
+	// called when a check starts or stops alerting
+	OnAlert func(a CanaryAlert)
+}
+
+// CanaryAlert is a check of the canary breaching or going back below its
+// thresholds
+type CanaryAlert struct {
+	Check string `json:"check"`
+	// false once the check recovered
+	Firing bool `json:"firing"`
+	// milliseconds
+	Latency  float64 `json:"latency"`
+	Failures int     `json:"failures"`
+	Err      string  `json:"err,omitempty"`
+	Time     int64   `json:"time"`
+}
+
+// CanaryStatus of a check, latencies in milliseconds
+type CanaryStatus struct {
+	Check     string  `json:"check"`
+	Latency   float64 `json:"latency"`
+	Runs      uint64  `json:"runs"`
+	Errors    uint64  `json:"errors"`
+	Failures  int     `json:"failures"`
+	LastError string  `json:"last_error,omitempty"`
+	LastRun   int64   `json:"last_run"`
+	Alerting  bool    `json:"alerting"`
+}
+
+type canary struct {
+	config  CanaryConfig
+	address string
+	f       *factory.MessengerFactory
+	// a queries the service b offers and sends to b
+	a, b      *factory.Connection
+	attribute string
+	queried   chan *factory.QueryByAttrsResp
+	received  chan []byte
+
+	status      map[string]*CanaryStatus
+	statusMutex sync.Mutex
+	stop        chan struct{}
+}
+
+// StartCanary keeps synthetic clients on the server of m that register, query
+// and send to each other every round, and alerts by config when a round trip
+// fails or is slow. The status is served at /conn/getCanary
+func (m *Monitor) StartCanary(config CanaryConfig) {
+	if config.Interval <= 0 {
+		config.Interval = DEFAULT_CANARY_INTERVAL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DEFAULT_CANARY_TIMEOUT
+	}
+	if config.MaxFailures < 1 {
+		config.MaxFailures = 1
+	}
+	c := &canary{
+		config:   config,
+		address:  canaryAddress(m.serverAddress),
+		f:        factory.NewMessengerFactory(),
+		queried:  make(chan *factory.QueryByAttrsResp, 8),
+		received: make(chan []byte, 8),
+		status:   make(map[string]*CanaryStatus),
+		stop:     make(chan struct{}),
+	}
+	for _, check := range canaryChecks {
+		c.status[check] = &CanaryStatus{Check: check}
+	}
+	m.canaryMutex.Lock()
+	if m.canary != nil {
+		m.canary.close()
+	}
+	m.canary = c
+	m.canaryMutex.Unlock()
+	go c.run()
+}
+
+// canaryAddress dials the server on the loopback if it listens on every address
+func canaryAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (c *canary) close() {
+	close(c.stop)
+}
+
+func (c *canary) run() {
+	defer c.f.Close()
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.round()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *canary) round() {
+	start := time.Now()
+	conn, err := c.connect(nil)
+	if conn != nil {
+		conn.Close()
+	}
+	c.report(CANARY_REGISTER, time.Since(start), err)
+
+	if err = c.setup(); err != nil {
+		c.report(CANARY_QUERY, 0, err)
+		c.report(CANARY_SEND, 0, err)
+		return
+	}
+	start = time.Now()
+	c.report(CANARY_QUERY, time.Since(start), c.query())
+	start = time.Now()
+	c.report(CANARY_SEND, time.Since(start), c.send())
+}
+
+// connect registers a new key on the server
+func (c *canary) connect(config *factory.ConnConfig) (conn *factory.Connection, err error) {
+	if config == nil {
+		config = &factory.ConnConfig{}
+	}
+	config.SeedConfig = factory.NewSeedConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+	err = c.f.ConnectWithConfigContext(ctx, c.address, config)
+	if err != nil {
+		return
+	}
+	c.f.ForEachConn(func(connection *factory.Connection) {
+		if connection.GetKey().Hex() == config.SeedConfig.PublicKey {
+			conn = connection
+		}
+	})
+	if conn == nil {
+		err = errors.New("canary connection closed")
+	}
+	return
+}
+
+// setup connects a and b again once they are closed
+func (c *canary) setup() (err error) {
+	if c.a != nil && !c.a.IsClosed() && c.b != nil && !c.b.IsClosed() {
+		return
+	}
+	for _, conn := range []*factory.Connection{c.a, c.b} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	c.a, c.b = nil, nil
+	a, err := c.connect(&factory.ConnConfig{
+		FindServiceNodesByAttributesCallback: func(resp *factory.QueryByAttrsResp) {
+			// the resp goes back to its pool
+			r := *resp
+			select {
+			case c.queried <- &r:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return
+	}
+	b, err := c.connect(nil)
+	if err != nil {
+		a.Close()
+		return
+	}
+	go c.read(a, nil)
+	go c.read(b, c.received)
+	c.attribute = "canary-" + b.GetKey().Hex()
+	if err = b.OfferService(c.attribute); err != nil {
+		a.Close()
+		b.Close()
+		return
+	}
+	c.a, c.b = a, b
+	return
+}
+
+// read takes the messages of conn so it never blocks, the ones sent to it go
+// to received
+func (c *canary) read(conn *factory.Connection, received chan []byte) {
+	for m := range conn.GetChanIn() {
+		if received == nil || len(m) < factory.SEND_MSG_META_END || m[factory.MSG_OP_BEGIN] != factory.OP_SEND {
+			continue
+		}
+		select {
+		case received <- m[factory.SEND_MSG_META_END:]:
+		default:
+		}
+	}
+}
+
+// query finds the service of b, asking again until the offer reached the
+// discovery
+func (c *canary) query() error {
+	timeout := time.NewTimer(c.config.Timeout)
+	defer timeout.Stop()
+	for {
+		seq, err := c.a.FindServiceNodesWithSeqByAttributes(c.attribute)
+		if err != nil {
+			return err
+		}
+	WAIT:
+		for {
+			select {
+			case resp := <-c.queried:
+				if resp.Seq != seq {
+					continue
+				}
+				if _, ok := resp.Result[c.b.GetKey().Hex()]; ok {
+					return nil
+				}
+				break WAIT
+			case <-timeout.C:
+				return errors.New("query timeout")
+			}
+		}
+		select {
+		case <-time.After(CANARY_QUERY_RETRY):
+		case <-timeout.C:
+			return errors.New("service of the canary not found")
+		}
+	}
+}
+
+func (c *canary) send() error {
+	timeout := time.NewTimer(c.config.Timeout)
+	defer timeout.Stop()
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	if err := c.a.Send(c.b.GetKey(), nonce); err != nil {
+		return err
+	}
+	for {
+		select {
+		case m := <-c.received:
+			if bytes.Equal(m, nonce) {
+				return nil
+			}
+		case <-timeout.C:
+			return errors.New("send timeout")
+		}
+	}
+}
+
+// report records a round trip of check and alerts if it crossed a threshold
+func (c *canary) report(check string, latency time.Duration, err error) {
+	ms := float64(latency) / float64(time.Millisecond)
+	now := time.Now().Unix()
+	c.statusMutex.Lock()
+	s := c.status[check]
+	s.Runs++
+	s.LastRun = now
+	s.Latency = ms
+	s.LastError = ""
+	if err != nil {
+		s.Errors++
+		s.Failures++
+		s.LastError = err.Error()
+	} else {
+		s.Failures = 0
+	}
+	breached := s.Failures >= c.config.MaxFailures ||
+		err == nil && c.config.MaxLatency > 0 && latency > c.config.MaxLatency
+	changed := breached != s.Alerting
+	s.Alerting = breached
+	alert := CanaryAlert{Check: check, Firing: breached, Latency: ms, Failures: s.Failures, Err: s.LastError, Time: now}
+	c.statusMutex.Unlock()
+	if !changed {
+		return
+	}
+	if breached {
+		monitorLogger().Errorf("canary %s alerting: latency %.1fms failures %d %s", check, ms, alert.Failures, alert.Err)
+	} else {
+		monitorLogger().Infof("canary %s recovered", check)
+	}
+	if c.config.OnAlert != nil {
+		c.config.OnAlert(alert)
+	}
+}
+
+func (c *canary) statuses() (r []CanaryStatus) {
+	c.statusMutex.Lock()
+	for _, check := range canaryChecks {
+		r = append(r, *c.status[check])
+	}
+	c.statusMutex.Unlock()
+	return
+}
+
+func (m *Monitor) getCanary(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	m.canaryMutex.Lock()
+	c := m.canary
+	m.canaryMutex.Unlock()
+	if c == nil {
+		code = NOT_FOUND
+		err = errors.New("canary not started")
+		return
+	}
+	result, err = json.Marshal(c.statuses())
+	return
+}
@@ -0,0 +1,53 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+)
+
+func TestCanary(t *testing.T) {
+	s := factory.NewMessengerFactory()
+	s.SetDefaultSeedConfig(factory.NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25955"); err != nil {
+		t.Fatal(err)
+	}
+	m := New(s, ":25955", "", "", "")
+	defer m.Close()
+	alerts := make(chan CanaryAlert, 8)
+	m.StartCanary(CanaryConfig{
+		Interval: 100 * time.Millisecond,
+		Timeout:  time.Second,
+		OnAlert: func(a CanaryAlert) {
+			alerts <- a
+		},
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ok := true
+		for _, st := range m.canary.statuses() {
+			if st.Runs == 0 || st.Errors > 0 {
+				ok = false
+			}
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("canary statuses %+v", m.canary.statuses())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.Close()
+	select {
+	case a := <-alerts:
+		if !a.Firing || len(a.Err) == 0 {
+			t.Fatalf("alert %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert once the server closed")
+	}
+}
@@ -0,0 +1,95 @@
+package monitor
+
+import (
+	"errors"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// how many revisions of a node config are kept to diff against
+const maxConfigRevisions = 8
+
+var ErrConfigHashMismatch = errors.New("config hash mismatch")
+
+// ConfigUpdate is sent to a node that reports the last revision it acknowledged.
+// Exactly one of Delta and Full is set when the node is out of date, neither when
+// it is already at Revision.
+type ConfigUpdate struct {
+	Revision uint64 `json:"revision"`
+	Base     uint64 `json:"base,omitempty"`
+	Hash     string `json:"hash"`
+	Delta    []byte `json:"delta,omitempty"`
+	Full     []byte `json:"full,omitempty"`
+}
+
+type configRevision struct {
+	revision uint64
+	data     []byte
+	hash     cipher.SHA256
+}
+
+// ApplyConfigUpdate returns the config document described by u, built from the
+// document of the revision the node acknowledged, and verifies its hash
+func ApplyConfigUpdate(current []byte, u *ConfigUpdate) (data []byte, err error) {
+	switch {
+	case u.Full != nil:
+		data = u.Full
+	case u.Delta != nil:
+		data, err = ApplyDelta(current, u.Delta)
+		if err != nil {
+			return
+		}
+	default:
+		data = current
+	}
+	if cipher.SumSHA256(data).Hex() != u.Hash {
+		return nil, ErrConfigHashMismatch
+	}
+	return
+}
+
+// configsMutex must be held
+func (m *Monitor) pushConfigRevision(key string, data []byte) {
+	revs := m.configRevisions[key]
+	var rev uint64 = 1
+	if len(revs) > 0 {
+		last := revs[len(revs)-1]
+		if string(last.data) == string(data) {
+			return
+		}
+		rev = last.revision + 1
+	}
+	revs = append(revs, &configRevision{revision: rev, data: data, hash: cipher.SumSHA256(data)})
+	if len(revs) > maxConfigRevisions {
+		revs = revs[len(revs)-maxConfigRevisions:]
+	}
+	m.configRevisions[key] = revs
+}
+
+// configsMutex must be held
+func (m *Monitor) configUpdate(key string, base uint64) (u *ConfigUpdate, ok bool) {
+	revs := m.configRevisions[key]
+	if len(revs) < 1 {
+		return
+	}
+	last := revs[len(revs)-1]
+	u = &ConfigUpdate{Revision: last.revision, Hash: last.hash.Hex()}
+	ok = true
+	if base == last.revision {
+		return
+	}
+	for _, r := range revs[:len(revs)-1] {
+		if r.revision != base {
+			continue
+		}
+		delta := MakeDelta(r.data, last.data)
+		if len(delta) < len(last.data) {
+			u.Base = base
+			u.Delta = delta
+			return
+		}
+		break
+	}
+	u.Full = last.data
+	return
+}
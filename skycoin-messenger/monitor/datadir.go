@@ -0,0 +1,88 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/skycoin/skycoin/src/util/file"
+)
+
+// DefaultDataDir is $XDG_DATA_HOME/skywire/manager, ~/.skywire/manager if a
+// manager kept its data there before and ~/.local/share/skywire/manager else
+func DefaultDataDir() string {
+	if xdg := os.Getenv("XDG_DATA_HOME"); len(xdg) > 0 && filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "skywire", "manager")
+	}
+	home := file.UserHome()
+	legacy := filepath.Join(home, ".skywire", "manager")
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return filepath.Join(home, ".local", "share", "skywire", "manager")
+}
+
+// SetDataDir keeps the user, the client connections and the node configs in
+// dir instead of DefaultDataDir, call it before Start
+func (m *Monitor) SetDataDir(dir string) {
+	m.dataDir = dir
+}
+
+// DataDir returns the directory of the manager's files
+func (m *Monitor) DataDir() string {
+	return m.dataDir
+}
+
+func (m *Monitor) userPath() string {
+	return filepath.Join(m.dataDir, "user.json")
+}
+
+func (m *Monitor) nodeConfigPath() string {
+	return filepath.Join(m.dataDir, "nodeConfig.json")
+}
+
+func (m *Monitor) clientPath(client string) string {
+	switch client {
+	case "ssh":
+		client = filepath.Join(m.dataDir, "sshClient.json")
+	case "socket":
+		client = filepath.Join(m.dataDir, "socketClient.json")
+	}
+	return client
+}
+
+// configsMutex must be held
+func (m *Monitor) saveNodeConfigs() error {
+	data, err := json.Marshal(m.configs)
+	if err != nil {
+		return err
+	}
+	return WriteConfig(data, m.nodeConfigPath())
+}
+
+func (m *Monitor) loadNodeConfigs() error {
+	fb, err := ioutil.ReadFile(m.nodeConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var configs map[string]*Config
+	err = json.Unmarshal(fb, &configs)
+	if err != nil {
+		return err
+	}
+	m.configsMutex.Lock()
+	defer m.configsMutex.Unlock()
+	for key, config := range configs {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		m.configs[key] = config
+		m.pushConfigRevision(key, data)
+	}
+	return nil
+}
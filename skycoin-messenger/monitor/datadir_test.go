@@ -0,0 +1,58 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultDataDirXDG(t *testing.T) {
+	old, ok := os.LookupEnv("XDG_DATA_HOME")
+	defer func() {
+		if ok {
+			os.Setenv("XDG_DATA_HOME", old)
+		} else {
+			os.Unsetenv("XDG_DATA_HOME")
+		}
+	}()
+	os.Setenv("XDG_DATA_HOME", "/xdg/data")
+	if dir := DefaultDataDir(); dir != filepath.Join("/xdg/data", "skywire", "manager") {
+		t.Fatalf("data dir %s", dir)
+	}
+	// relative values are invalid by the spec
+	os.Setenv("XDG_DATA_HOME", "data")
+	if dir := DefaultDataDir(); !filepath.IsAbs(dir) {
+		t.Fatalf("data dir %s", dir)
+	}
+}
+
+func TestNodeConfigsInDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := New(nil, "", "", "", "")
+	m.SetDataDir(dir)
+	m.configs["a"] = &Config{DiscoveryAddresses: []string{"127.0.0.1:5999"}}
+	if err = m.saveNodeConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.clientPath("ssh"); filepath.Dir(p) != dir {
+		t.Fatalf("client path %s", p)
+	}
+
+	m = New(nil, "", "", "", "")
+	m.SetDataDir(dir)
+	if err = m.loadNodeConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	c := m.configs["a"]
+	if c == nil || len(c.DiscoveryAddresses) != 1 || c.DiscoveryAddresses[0] != "127.0.0.1:5999" {
+		t.Fatalf("config %v", c)
+	}
+	if u, ok := m.configUpdate("a", 0); !ok || u.Revision != 1 {
+		t.Fatalf("update %v", u)
+	}
+}
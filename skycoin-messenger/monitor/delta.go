@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// delta ops
+const (
+	deltaCopy   = 0x01
+	deltaInsert = 0x02
+
+	deltaBlockSize = 16
+)
+
+var ErrBadDelta = errors.New("malformed delta")
+
+// MakeDelta encodes dst as a sequence of copy and insert ops against src
+func MakeDelta(src, dst []byte) []byte {
+	index := make(map[string]int)
+	for i := 0; i+deltaBlockSize <= len(src); i++ {
+		k := string(src[i : i+deltaBlockSize])
+		if _, ok := index[k]; !ok {
+			index[k] = i
+		}
+	}
+
+	delta := make([]byte, 0, 64)
+	var pending []byte
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		delta = append(delta, deltaInsert)
+		delta = appendUvarint(delta, uint64(len(pending)))
+		delta = append(delta, pending...)
+		pending = pending[:0]
+	}
+
+	for j := 0; j < len(dst); {
+		if j+deltaBlockSize <= len(dst) {
+			if i, ok := index[string(dst[j:j+deltaBlockSize])]; ok {
+				n := deltaBlockSize
+				for i+n < len(src) && j+n < len(dst) && src[i+n] == dst[j+n] {
+					n++
+				}
+				flush()
+				delta = append(delta, deltaCopy)
+				delta = appendUvarint(delta, uint64(i))
+				delta = appendUvarint(delta, uint64(n))
+				j += n
+				continue
+			}
+		}
+		pending = append(pending, dst[j])
+		j++
+	}
+	flush()
+	return delta
+}
+
+// ApplyDelta rebuilds the document encoded by MakeDelta from src
+func ApplyDelta(src, delta []byte) (dst []byte, err error) {
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch op {
+		case deltaCopy:
+			offset, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, ErrBadDelta
+			}
+			delta = delta[n:]
+			length, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, ErrBadDelta
+			}
+			delta = delta[n:]
+			if offset+length < offset || offset+length > uint64(len(src)) {
+				return nil, ErrBadDelta
+			}
+			dst = append(dst, src[offset:offset+length]...)
+		case deltaInsert:
+			length, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, ErrBadDelta
+			}
+			delta = delta[n:]
+			if length > uint64(len(delta)) {
+				return nil, ErrBadDelta
+			}
+			dst = append(dst, delta[:length]...)
+			delta = delta[length:]
+		default:
+			return nil, ErrBadDelta
+		}
+	}
+	return
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,80 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	var src, dst Config
+	for i := 0; i < 200; i++ {
+		src.DiscoveryAddresses = append(src.DiscoveryAddresses, fmt.Sprintf("10.0.%d.%d:5999", i/256, i%256))
+	}
+	dst.DiscoveryAddresses = append([]string{"discovery.skycoin.net:5999"}, src.DiscoveryAddresses[:100]...)
+	dst.DiscoveryAddresses = append(dst.DiscoveryAddresses, src.DiscoveryAddresses[101:]...)
+
+	s, _ := json.Marshal(src)
+	d, _ := json.Marshal(dst)
+	delta := MakeDelta(s, d)
+	t.Logf("src %d dst %d delta %d", len(s), len(d), len(delta))
+	if len(delta) >= len(d)/4 {
+		t.Fatalf("delta too large %d", len(delta))
+	}
+	r, err := ApplyDelta(s, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r, d) {
+		t.Fatalf("rebuilt %s", r)
+	}
+
+	_, err = ApplyDelta(s[:10], delta)
+	if err != ErrBadDelta {
+		t.Fatalf("expect ErrBadDelta, got %v", err)
+	}
+}
+
+func TestConfigUpdate(t *testing.T) {
+	m := &Monitor{configRevisions: make(map[string][]*configRevision)}
+	var docs [][]byte
+	for i := 1; i <= maxConfigRevisions+2; i++ {
+		c := &Config{}
+		for j := 0; j < 50+i; j++ {
+			c.DiscoveryAddresses = append(c.DiscoveryAddresses, fmt.Sprintf("192.168.1.%d:5999", j))
+		}
+		d, _ := json.Marshal(c)
+		docs = append(docs, d)
+		m.pushConfigRevision("node", d)
+	}
+	last := docs[len(docs)-1]
+
+	u, ok := m.configUpdate("node", uint64(len(docs)-1))
+	if !ok || u.Delta == nil {
+		t.Fatalf("expect delta, got %+v", u)
+	}
+	r, err := ApplyConfigUpdate(docs[len(docs)-2], u)
+	if err != nil || !bytes.Equal(r, last) {
+		t.Fatalf("apply delta: %v", err)
+	}
+
+	// revision 1 has been dropped from history
+	u, _ = m.configUpdate("node", 1)
+	if u.Full == nil {
+		t.Fatal("expect full document")
+	}
+	r, err = ApplyConfigUpdate(docs[0], u)
+	if err != nil || !bytes.Equal(r, last) {
+		t.Fatalf("apply full: %v", err)
+	}
+
+	u, _ = m.configUpdate("node", u.Revision)
+	if u.Full != nil || u.Delta != nil {
+		t.Fatal("expect no change")
+	}
+	_, err = ApplyConfigUpdate(docs[0], u)
+	if err != ErrConfigHashMismatch {
+		t.Fatalf("expect ErrConfigHashMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/skycoin/net/conn"
+)
+
+// getDrops returns the messages dropped by the connections of the process,
+// by reason and the last ones
+func (m *Monitor) getDrops(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	result, err = json.Marshal(conn.GetDropStats())
+	return
+}
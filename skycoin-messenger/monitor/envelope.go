@@ -0,0 +1,92 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// requests accepting this media type get every response wrapped in an Envelope,
+// requests under APIV2Prefix always do
+const EnvelopeMediaType = "application/vnd.skywire.v2+json"
+
+type Envelope struct {
+	Code  int             `json:"code"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+func wantsEnvelope(r *http.Request) bool {
+	return isAPIV2(r) || strings.Contains(r.Header.Get("Accept"), EnvelopeMediaType)
+}
+
+// writeEnvelope writes data as it is if it is json, otherwise as a json string
+func writeEnvelope(w http.ResponseWriter, code int, data []byte, errMsg string) {
+	e := &Envelope{Code: code, Error: errMsg}
+	if len(data) > 0 {
+		if json.Valid(data) {
+			e.Data = data
+		} else {
+			e.Data, _ = json.Marshal(string(data))
+		}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, err.Error(), SERVER_ERROR)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeError writes an error in the format the request asked for
+func writeError(w http.ResponseWriter, r *http.Request, errMsg string, code int) {
+	if wantsEnvelope(r) {
+		writeEnvelope(w, code, nil, errMsg)
+		return
+	}
+	http.Error(w, errMsg, code)
+}
+
+// unauthorized keeps the legacy 302 for the manager ui, enveloped responses get a real 401
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	if wantsEnvelope(r) {
+		writeEnvelope(w, http.StatusUnauthorized, nil, "Unauthorized")
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusFound)
+}
+
+// responseRecorder tells bundle whether a handler already answered,
+// e.g. verifyLogin failed
+type responseRecorder struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.written = true
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.written = true
+	return rr.ResponseWriter.Write(b)
+}
+
+func bundleEnvelope(fn apiHandler, w http.ResponseWriter, r *http.Request) {
+	rr := &responseRecorder{ResponseWriter: w}
+	result, err, code := fn(rr, r)
+	if rr.written {
+		return
+	}
+	if err != nil {
+		if code == 0 {
+			code = SERVER_ERROR
+		}
+		writeEnvelope(w, code, nil, err.Error())
+		return
+	}
+	writeEnvelope(w, http.StatusOK, result, "")
+}
@@ -0,0 +1,53 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBundleEnvelope(t *testing.T) {
+	cases := []struct {
+		fn   func(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int)
+		code int
+		err  string
+		data string
+	}{
+		{func(w http.ResponseWriter, r *http.Request) ([]byte, error, int) {
+			return []byte(`[{"key":"a"}]`), nil, 0
+		}, 200, "", `[{"key":"a"}]`},
+		{func(w http.ResponseWriter, r *http.Request) ([]byte, error, int) {
+			return []byte("127.0.0.1:5998-02ab"), nil, 0
+		}, 200, "", `"127.0.0.1:5998-02ab"`},
+		{func(w http.ResponseWriter, r *http.Request) ([]byte, error, int) {
+			return nil, errors.New("No connection is found"), NOT_FOUND
+		}, 404, "No connection is found", ""},
+		{func(w http.ResponseWriter, r *http.Request) ([]byte, error, int) {
+			unauthorized(w, r)
+			return nil, nil, 0
+		}, 401, "Unauthorized", ""},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/conn/getAll", nil)
+		r.Header.Set("Accept", EnvelopeMediaType)
+		w := httptest.NewRecorder()
+		bundle(c.fn)(w, r)
+		e := &Envelope{}
+		if err := json.Unmarshal(w.Body.Bytes(), e); err != nil {
+			t.Fatalf("%d: %v %s", i, err, w.Body.String())
+		}
+		if w.Code != c.code || e.Code != c.code || e.Error != c.err || string(e.Data) != c.data {
+			t.Fatalf("%d: status %d envelope %+v data %s", i, w.Code, e, e.Data)
+		}
+
+		// legacy clients keep the bare responses
+		r.Header.Del("Accept")
+		w = httptest.NewRecorder()
+		bundle(c.fn)(w, r)
+		if json.Unmarshal(w.Body.Bytes(), &Envelope{}) == nil && w.Body.Len() > 0 && w.Body.Bytes()[0] == '{' {
+			t.Fatalf("%d: legacy response enveloped %s", i, w.Body.String())
+		}
+	}
+}
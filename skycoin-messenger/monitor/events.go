@@ -0,0 +1,111 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+)
+
+// getEvents serves this many of the latest events of the factory
+const MONITOR_EVENTS_KEPT = 200
+
+// the relayed messages are too many to keep
+var monitorEventTypes = []factory.EventType{
+	factory.EVENT_CONN_REGISTERED,
+	factory.EVENT_CONN_UNREGISTERED,
+	factory.EVENT_SERVICES_OFFERED,
+	factory.EVENT_SERVICES_REMOVED,
+	factory.EVENT_TRANSPORT_BUILT,
+	factory.EVENT_TRANSPORT_CLOSED,
+}
+
+type Event struct {
+	Type string `json:"type"`
+	Time int64  `json:"time"`
+	Key  string `json:"key,omitempty"`
+	Peer string `json:"peer,omitempty"`
+	// attributes of the services offered
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+// eventLog keeps the latest events of the factory from its subscription
+type eventLog struct {
+	sub    *factory.Subscription
+	events []Event
+	// next index written once events is full
+	next int
+	sync.Mutex
+}
+
+func newEvent(e factory.Event) Event {
+	r := Event{Type: e.Type.String(), Time: e.Time.Unix()}
+	if e.Key != factory.EMPATY_PUBLIC_KEY {
+		r.Key = e.Key.Hex()
+	}
+	if e.Peer != factory.EMPATY_PUBLIC_KEY {
+		r.Peer = e.Peer.Hex()
+	}
+	if e.Services != nil {
+		for _, s := range e.Services.Services {
+			r.Attributes = append(r.Attributes, s.Attributes...)
+		}
+	}
+	return r
+}
+
+func (l *eventLog) start(f *factory.MessengerFactory) {
+	l.Lock()
+	defer l.Unlock()
+	if l.sub != nil {
+		return
+	}
+	l.sub = f.Subscribe(0, monitorEventTypes...)
+	go l.run(l.sub)
+}
+
+func (l *eventLog) stop() {
+	l.Lock()
+	defer l.Unlock()
+	if l.sub != nil {
+		l.sub.Unsubscribe()
+		l.sub = nil
+	}
+}
+
+func (l *eventLog) run(sub *factory.Subscription) {
+	for e := range sub.C {
+		l.add(newEvent(e))
+	}
+}
+
+func (l *eventLog) add(e Event) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.events) < MONITOR_EVENTS_KEPT {
+		l.events = append(l.events, e)
+		return
+	}
+	l.events[l.next] = e
+	l.next = (l.next + 1) % MONITOR_EVENTS_KEPT
+}
+
+// latest returns the events kept, oldest first
+func (l *eventLog) latest() []Event {
+	l.Lock()
+	defer l.Unlock()
+	r := make([]Event, 0, len(l.events))
+	r = append(r, l.events[l.next:]...)
+	return append(r, l.events[:l.next]...)
+}
+
+// getEvents returns the latest conns registered and left, services offered
+// and transports built and closed on the server
+func (m *Monitor) getEvents(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	result, err = json.Marshal(m.events.latest())
+	return
+}
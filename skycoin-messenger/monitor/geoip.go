@@ -0,0 +1,177 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// GeoIPLookup returns the country code and the autonomous system of ip,
+// empty if unknown
+type GeoIPLookup func(ip net.IP) (country, asn string)
+
+// SetGeoIPLookup serves the node counts per country and per autonomous system
+// at /conn/getGeoStats, call it before Start
+func (m *Monitor) SetGeoIPLookup(fn GeoIPLookup) {
+	m.geoIP = fn
+}
+
+type geoIPRange struct {
+	start, end   net.IP
+	country, asn string
+}
+
+// GeoIPRanges is a GeoIPLookup of ip ranges
+type GeoIPRanges struct {
+	ranges []geoIPRange
+}
+
+// LoadGeoIPRanges reads a csv of "start ip,end ip,country[,asn]" lines like the
+// free country and asn databases, lines starting with # are skipped
+func LoadGeoIPRanges(path string) (g *GeoIPRanges, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return ReadGeoIPRanges(f)
+}
+
+// ReadGeoIPRanges is LoadGeoIPRanges of r
+func ReadGeoIPRanges(r io.Reader) (g *GeoIPRanges, err error) {
+	g = &GeoIPRanges{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) < 1 || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("geoip line %d: %d fields", line, len(fields))
+		}
+		for i := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+		}
+		rg := geoIPRange{
+			start:   net.ParseIP(fields[0]).To16(),
+			end:     net.ParseIP(fields[1]).To16(),
+			country: fields[2],
+		}
+		if rg.start == nil || rg.end == nil || bytes.Compare(rg.start, rg.end) > 0 {
+			return nil, fmt.Errorf("geoip line %d: invalid range %s-%s", line, fields[0], fields[1])
+		}
+		if len(fields) > 3 {
+			rg.asn = fields[3]
+		}
+		g.ranges = append(g.ranges, rg)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(g.ranges, func(i, j int) bool {
+		return bytes.Compare(g.ranges[i].start, g.ranges[j].start) < 0
+	})
+	return
+}
+
+// Lookup is a GeoIPLookup
+func (g *GeoIPRanges) Lookup(ip net.IP) (country, asn string) {
+	ip = ip.To16()
+	if ip == nil {
+		return
+	}
+	// the last range starting at or before ip
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, g.ranges[i].end) > 0 {
+		return
+	}
+	return g.ranges[i].country, g.ranges[i].asn
+}
+
+type GeoCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// GeoStats has no addresses, only counts
+type GeoStats struct {
+	Total     int        `json:"total"`
+	Unknown   int        `json:"unknown"`
+	Countries []GeoCount `json:"countries"`
+	ASNs      []GeoCount `json:"asns"`
+}
+
+func geoCounts(m map[string]int) []GeoCount {
+	counts := make([]GeoCount, 0, len(m))
+	for name, c := range m {
+		counts = append(counts, GeoCount{Name: name, Count: c})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
+}
+
+func geoStats(lookup GeoIPLookup, addrs []net.Addr) *GeoStats {
+	s := &GeoStats{Total: len(addrs)}
+	countries := make(map[string]int)
+	asns := make(map[string]int)
+	for _, addr := range addrs {
+		var country, asn string
+		if addr != nil {
+			host, _, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				host = addr.String()
+			}
+			if ip := net.ParseIP(host); ip != nil {
+				country, asn = lookup(ip)
+			}
+		}
+		if len(country) < 1 && len(asn) < 1 {
+			s.Unknown++
+			continue
+		}
+		if len(country) > 0 {
+			countries[country]++
+		}
+		if len(asn) > 0 {
+			asns[asn]++
+		}
+	}
+	s.Countries = geoCounts(countries)
+	s.ASNs = geoCounts(asns)
+	return s
+}
+
+func (m *Monitor) getGeoStats(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	var addrs []net.Addr
+	m.factory.ForEachAcceptedConnection(func(key cipher.PubKey, conn *factory.Connection) {
+		addrs = append(addrs, conn.GetRemoteAddr())
+	})
+	result, err = json.Marshal(geoStats(m.geoIP, addrs))
+	if err != nil {
+		code = SERVER_ERROR
+	}
+	return
+}
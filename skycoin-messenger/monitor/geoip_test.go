@@ -0,0 +1,54 @@
+package monitor
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testGeoIPRanges = `# start,end,country,asn
+"10.0.0.0","10.0.255.255","DE","AS3320"
+10.1.0.0,10.1.255.255,FR
+2001:db8::,2001:db8::ffff,NL,AS1136
+`
+
+func TestGeoIPRanges(t *testing.T) {
+	g, err := ReadGeoIPRanges(strings.NewReader(testGeoIPRanges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][2]string{
+		"10.0.3.4":      {"DE", "AS3320"},
+		"10.1.0.0":      {"FR", ""},
+		"10.2.0.1":      {"", ""},
+		"9.255.255.255": {"", ""},
+		"2001:db8::1":   {"NL", "AS1136"},
+	}
+	for ip, want := range cases {
+		country, asn := g.Lookup(net.ParseIP(ip))
+		if country != want[0] || asn != want[1] {
+			t.Fatalf("%s %s %s, want %v", ip, country, asn, want)
+		}
+	}
+	if _, err = ReadGeoIPRanges(strings.NewReader("10.0.0.9,10.0.0.1,DE")); err == nil {
+		t.Fatal("reversed range accepted")
+	}
+
+	addrs := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1},
+		&net.UDPAddr{IP: net.ParseIP("10.1.0.1"), Port: 1},
+		&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 1},
+		nil,
+	}
+	s := geoStats(g.Lookup, addrs)
+	if s.Total != 5 || s.Unknown != 2 {
+		t.Fatalf("total %d unknown %d", s.Total, s.Unknown)
+	}
+	if len(s.Countries) != 2 || s.Countries[0] != (GeoCount{"DE", 2}) || s.Countries[1] != (GeoCount{"FR", 1}) {
+		t.Fatalf("countries %v", s.Countries)
+	}
+	if len(s.ASNs) != 1 || s.ASNs[0] != (GeoCount{"AS3320", 2}) {
+		t.Fatalf("asns %v", s.ASNs)
+	}
+}
@@ -0,0 +1,192 @@
+package monitor
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	defaultGuestTokenTTL = time.Hour
+	maxGuestTokenTTL     = 24 * time.Hour
+	// the only url of a node a guest may open
+	nodeTermScheme = "ws"
+	nodeTermPath   = "/node/run/term"
+)
+
+var errGuestNodeNotFound = errors.New("node not connected")
+
+// guestToken grants terminal access to a single node until it expires
+type guestToken struct {
+	Node    cipher.PubKey
+	Expires time.Time
+}
+
+type GuestToken struct {
+	Token   string `json:"token"`
+	Node    string `json:"node"`
+	Expires int64  `json:"expires"`
+}
+
+func (m *Monitor) createGuestToken(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		code = BAD_REQUEST
+		err = errors.New("please use post method")
+		return
+	}
+	key, err := cipher.PubKeyFromHex(r.FormValue("key"))
+	if err != nil {
+		code = BAD_REQUEST
+		return
+	}
+	ttl := defaultGuestTokenTTL
+	if v := r.FormValue("ttl"); len(v) > 0 {
+		var sec int
+		sec, err = strconv.Atoi(v)
+		if err != nil || sec <= 0 {
+			code = BAD_REQUEST
+			err = errors.New("invalid ttl")
+			return
+		}
+		ttl = time.Duration(sec) * time.Second
+		if ttl > maxGuestTokenTTL {
+			ttl = maxGuestTokenTTL
+		}
+	}
+	token, gt, err := m.addGuestToken(key, ttl)
+	if err != nil {
+		code = NOT_FOUND
+		return
+	}
+	result, err = json.Marshal(&GuestToken{Token: token, Node: key.Hex(), Expires: gt.Expires.Unix()})
+	return
+}
+
+// addGuestToken mints a token for the node of key, it has to be connected
+func (m *Monitor) addGuestToken(key cipher.PubKey, ttl time.Duration) (token string, gt *guestToken, err error) {
+	if _, ok := m.factory.GetConnection(key); !ok {
+		err = errGuestNodeNotFound
+		return
+	}
+	token = hex.EncodeToString(cipher.RandByte(16))
+	gt = &guestToken{Node: key, Expires: time.Now().Add(ttl)}
+	m.guestTokensMutex.Lock()
+	m.removeExpiredGuestTokens()
+	m.guestTokens[token] = gt
+	m.guestTokensMutex.Unlock()
+	return
+}
+
+func (m *Monitor) revokeGuestToken(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	m.removeGuestToken(r.FormValue("token"))
+	result = []byte("true")
+	return
+}
+
+func (m *Monitor) removeGuestToken(token string) {
+	m.guestTokensMutex.Lock()
+	delete(m.guestTokens, token)
+	m.guestTokensMutex.Unlock()
+}
+
+// guestTokensMutex must be held
+func (m *Monitor) removeExpiredGuestTokens() {
+	now := time.Now()
+	for k, v := range m.guestTokens {
+		if now.After(v.Expires) {
+			delete(m.guestTokens, k)
+		}
+	}
+}
+
+// verifyGuestToken checks the token is alive and the url is the terminal of the node it was minted for
+func (m *Monitor) verifyGuestToken(w http.ResponseWriter, token, termUrl string) bool {
+	m.guestTokensMutex.Lock()
+	gt, ok := m.guestTokens[token]
+	if ok && time.Now().After(gt.Expires) {
+		delete(m.guestTokens, token)
+		ok = false
+	}
+	m.guestTokensMutex.Unlock()
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	c, ok := m.factory.GetConnection(gt.Node)
+	if !ok {
+		http.Error(w, "No connection is found", NOT_FOUND)
+		return false
+	}
+	addr, err := nodeAPIAddress(c)
+	if err != nil || len(addr) == 0 {
+		http.Error(w, "node api address unknown", NOT_FOUND)
+		return false
+	}
+	u, err := url.Parse(termUrl)
+	if err != nil || u.Scheme != nodeTermScheme || u.Host != addr || u.Path != nodeTermPath ||
+		u.User != nil || len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type EnrollmentToken struct {
+	Token   string `json:"token"`
+	Account string `json:"account"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// createEnrollmentToken issues a token that binds a new node to the account
+// of this manager at the discovery server, see factory.Enrollment
+func (m *Monitor) createEnrollmentToken(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		code = BAD_REQUEST
+		err = errors.New("please use post method")
+		return
+	}
+	sc := m.factory.GetDefaultSeedConfig()
+	if sc == nil || sc.Keys() == nil {
+		code = SERVER_ERROR
+		err = errors.New("no key to sign the token")
+		return
+	}
+	var ttl time.Duration
+	if v := r.FormValue("ttl"); len(v) > 0 {
+		var sec int
+		sec, err = strconv.Atoi(v)
+		if err != nil || sec <= 0 {
+			code = BAD_REQUEST
+			err = errors.New("invalid ttl")
+			return
+		}
+		ttl = time.Duration(sec) * time.Second
+	}
+	token, err := factory.IssueEnrollmentToken(sc.Keys(), ttl)
+	if err != nil {
+		code = SERVER_ERROR
+		return
+	}
+	et := &EnrollmentToken{Token: token, Account: sc.Keys().PubKey().Hex()}
+	if ttl > 0 {
+		et.Expires = time.Now().Add(ttl).Unix()
+	}
+	result, err = json.Marshal(et)
+	return
+}
@@ -0,0 +1,86 @@
+package monitor
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestGuestToken(t *testing.T) {
+	s := factory.NewMessengerFactory()
+	s.SetDefaultSeedConfig(factory.NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25991"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m := New(s, "", "", "", "")
+
+	sc := factory.NewSeedConfig()
+	c := factory.NewMessengerFactory()
+	defer c.Close()
+	err := c.ConnectWithConfig("127.0.0.1:25991", &factory.ConnConfig{SeedConfig: sc, Context: map[string]string{"node-api": ":8001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := cipher.PubKeyFromHex(sc.PublicKey)
+	for i := 0; ; i++ {
+		if _, ok := s.GetConnection(key); ok {
+			break
+		}
+		if i > 50 {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	unknown, _ := cipher.GenerateKeyPair()
+	if _, _, err = m.addGuestToken(unknown, time.Minute); err != errGuestNodeNotFound {
+		t.Fatalf("token of an unknown node err %v", err)
+	}
+	token, _, err := m.addGuestToken(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(token, url string) bool {
+		return m.verifyGuestToken(httptest.NewRecorder(), token, url)
+	}
+	const term = "ws://127.0.0.1:8001/node/run/term"
+	if !verify(token, term) {
+		t.Fatal("terminal of the node refused")
+	}
+	for _, url := range []string{
+		"ws://127.0.0.1:8001/node/run/exec",
+		"ws://127.0.0.1:8001/node/run/term/../exec",
+		"wss://127.0.0.1:8001/node/run/term",
+		"ws://127.0.0.1:8002/node/run/term",
+		"ws://127.0.0.1:8001/node/run/term?cmd=sh",
+		"ws://user@127.0.0.1:8001/node/run/term",
+	} {
+		if verify(token, url) {
+			t.Fatalf("%s allowed", url)
+		}
+	}
+
+	m.removeGuestToken(token)
+	if verify(token, term) {
+		t.Fatal("revoked token allowed")
+	}
+
+	token, _, err = m.addGuestToken(key, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if verify(token, term) {
+		t.Fatal("expired token allowed")
+	}
+	m.guestTokensMutex.Lock()
+	_, ok := m.guestTokens[token]
+	m.guestTokensMutex.Unlock()
+	if ok {
+		t.Fatal("expired token kept")
+	}
+}
@@ -0,0 +1,95 @@
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipRules are checked against the source address of every request,
+// deny wins over allow and an empty allow list allows everyone not denied
+type ipRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(rules []string) (nets []*net.IPNet, err error) {
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if len(r) < 1 {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				err = fmt.Errorf("invalid ip %s", r)
+				return
+			}
+			if ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(r)
+		if err != nil {
+			return
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *ipRules) allowed(ip net.IP) bool {
+	if containsIP(rs.deny, ip) {
+		return false
+	}
+	return len(rs.allow) < 1 || containsIP(rs.allow, ip)
+}
+
+// SetIPRules sets the CIDRs or single ips allowed or denied to reach the web server,
+// it takes effect for the next request
+func (m *Monitor) SetIPRules(allow, deny []string) (err error) {
+	rs := &ipRules{}
+	rs.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return
+	}
+	rs.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return
+	}
+	m.ipRules.Store(rs)
+	return
+}
+
+// filterIP rejects requests from addresses not allowed before next runs,
+// forwarded headers are ignored so a proxy in front has to be allowed itself
+func (m *Monitor) filterIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs, ok := m.ipRules.Load().(*ipRules)
+		if ok {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !rs.allowed(ip) {
+				writeError(w, r, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilterIP(t *testing.T) {
+	m := &Monitor{}
+	h := m.filterIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	code := func(addr string) int {
+		r := httptest.NewRequest("GET", "/conn/getAll", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if c := code("8.8.8.8:1234"); c != http.StatusOK {
+		t.Fatalf("no rules, code %d", c)
+	}
+
+	err := m.SetIPRules([]string{"10.0.0.0/8", "::1"}, []string{"10.1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int{
+		"10.2.3.4:80":   http.StatusOK,
+		"[::1]:80":      http.StatusOK,
+		"10.1.2.3:80":   http.StatusForbidden,
+		"8.8.8.8:80":    http.StatusForbidden,
+		"not an ip":     http.StatusForbidden,
+		"[fe80::1]:443": http.StatusForbidden,
+	}
+	for addr, want := range cases {
+		if c := code(addr); c != want {
+			t.Fatalf("%s code %d, want %d", addr, c, want)
+		}
+	}
+
+	if err = m.SetIPRules([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+	if err = m.SetIPRules(nil, []string{"8.8.8.8"}); err != nil {
+		t.Fatal(err)
+	}
+	if c := code("1.1.1.1:80"); c != http.StatusOK {
+		t.Fatalf("deny only, code %d", c)
+	}
+}
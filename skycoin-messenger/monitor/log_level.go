@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/skycoin/net/conn"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func monitorLogger() conn.Logger {
+	return conn.WithSubsystem(conn.GetLogger(), conn.LOG_MONITOR)
+}
+
+// handleLogLevels returns the log levels of the subsystems on get. On post it
+// sets the level of the subsystem, or of the connection of the node key. An
+// empty level resets the subsystem
+func (m *Monitor) handleLogLevels(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	if r.Method == "POST" {
+		code, err = m.setLogLevel(r)
+		if err != nil {
+			return
+		}
+	}
+	levels := make(map[string]string)
+	for s, l := range conn.SubsystemLogLevels() {
+		levels[s] = l.String()
+	}
+	result, err = json.Marshal(levels)
+	return
+}
+
+func (m *Monitor) setLogLevel(r *http.Request) (code int, err error) {
+	v := r.FormValue("level")
+	var level conn.LogLevel
+	if k := r.FormValue("key"); len(k) > 0 {
+		var key cipher.PubKey
+		key, err = cipher.PubKeyFromHex(k)
+		if err != nil {
+			return BAD_REQUEST, err
+		}
+		level, err = conn.ParseLogLevel(v)
+		if err != nil {
+			return BAD_REQUEST, err
+		}
+		c, ok := m.factory.GetConnection(key)
+		if !ok {
+			return NOT_FOUND, errors.New("No connection is found")
+		}
+		c.SetLogLevel(level)
+		return
+	}
+	subsystem := r.FormValue("subsystem")
+	switch subsystem {
+	case conn.LOG_CONN, conn.LOG_FACTORY, conn.LOG_DISCOVERY, conn.LOG_MONITOR:
+	default:
+		return BAD_REQUEST, errors.Errorf("unknown subsystem %q", subsystem)
+	}
+	if len(v) == 0 {
+		conn.ResetSubsystemLogLevel(subsystem)
+		return
+	}
+	level, err = conn.ParseLogLevel(v)
+	if err != nil {
+		return BAD_REQUEST, err
+	}
+	conn.SetSubsystemLogLevel(subsystem, level)
+	return
+}
@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// AppMessage of an app on a node, App is empty if the app offers no service
+// through the node
+type AppMessage struct {
+	Node string              `json:"node"`
+	App  string              `json:"app,omitempty"`
+	Msg  factory.PriorityMsg `json:"msg"`
+}
+
+// sent by the manager to change which nodes it gets messages of, all if empty
+type appMessageFilter struct {
+	Nodes []string `json:"nodes"`
+}
+
+func parseKeys(hexKeys []string) (keys []cipher.PubKey, err error) {
+	for _, h := range hexKeys {
+		if len(h) < 1 {
+			continue
+		}
+		var k cipher.PubKey
+		k, err = cipher.PubKeyFromHex(h)
+		if err != nil {
+			return
+		}
+		keys = append(keys, k)
+	}
+	return
+}
+
+// handleAppMessages streams the app messages of all nodes over one websocket,
+// nodes=key1,key2 limits them to some nodes
+func (m *Monitor) handleAppMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if token := query.Get("token"); len(token) > 0 {
+		if !verifyWs(w, r, token) {
+			return
+		}
+	} else if !verifyLogin(w, r) {
+		return
+	}
+	nodes, err := parseKeys(strings.Split(query.Get("nodes"), ","))
+	if err != nil {
+		writeError(w, r, err.Error(), BAD_REQUEST)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		monitorLogger().Errorf("ws error: %s", err.Error())
+		return
+	}
+	sub := m.factory.SubscribeAppMessages(nodes...)
+	go func() {
+		defer sub.Close()
+		for {
+			filter := &appMessageFilter{}
+			err := conn.ReadJSON(filter)
+			if err != nil {
+				return
+			}
+			keys, err := parseKeys(filter.Nodes)
+			if err != nil {
+				monitorLogger().Debugf("app messages filter err: %s", err.Error())
+				continue
+			}
+			sub.SetNodes(keys)
+		}
+	}()
+	defer conn.Close()
+	for msg := range sub.C {
+		am := &AppMessage{Node: msg.Node.Hex(), Msg: msg.Msg}
+		if msg.App != (cipher.PubKey{}) {
+			am.App = msg.App.Hex()
+		}
+		err = conn.WriteJSON(am)
+		if err != nil {
+			sub.Close()
+			return
+		}
+	}
+}
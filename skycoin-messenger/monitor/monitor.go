@@ -1,22 +1,22 @@
 package monitor
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
+	"github.com/skycoin/net/conn"
 	"github.com/skycoin/net/skycoin-messenger/factory"
 	"github.com/skycoin/skycoin/src/cipher"
-	"github.com/skycoin/skycoin/src/util/file"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/astaxie/beego/session"
 )
@@ -38,20 +38,49 @@ func init() {
 }
 
 type Conn struct {
-	Key         string `json:"key"`
-	Type        string `json:"type"`
-	SendBytes   uint64 `json:"send_bytes"`
-	RecvBytes   uint64 `json:"recv_bytes"`
-	LastAckTime int64  `json:"last_ack_time"`
-	StartTime   int64  `json:"start_time"`
+	Key         string          `json:"key"`
+	Type        string          `json:"type"`
+	SendBytes   uint64          `json:"send_bytes"`
+	RecvBytes   uint64          `json:"recv_bytes"`
+	LastAckTime int64           `json:"last_ack_time"`
+	StartTime   int64           `json:"start_time"`
+	RTT         *RTTPercentiles `json:"rtt,omitempty"`
+	// of the last Ping in milliseconds
+	Ping float64 `json:"ping,omitempty"`
 }
 type NodeServices struct {
-	Type        string `json:"type"`
-	Addr        string `json:"addr"`
-	SendBytes   uint64 `json:"send_bytes"`
-	RecvBytes   uint64 `json:"recv_bytes"`
-	LastAckTime int64  `json:"last_ack_time"`
-	StartTime   int64  `json:"start_time"`
+	Type             string          `json:"type"`
+	Addr             string          `json:"addr"`
+	SendBytes        uint64          `json:"send_bytes"`
+	RecvBytes        uint64          `json:"recv_bytes"`
+	LastAckTime      int64           `json:"last_ack_time"`
+	StartTime        int64           `json:"start_time"`
+	Compression      string          `json:"compression,omitempty"`
+	CompressionRatio float64         `json:"compression_ratio,omitempty"`
+	Replays          uint64          `json:"replays,omitempty"`
+	RTT              *RTTPercentiles `json:"rtt,omitempty"`
+	// probed when requested, in milliseconds
+	Ping float64 `json:"ping,omitempty"`
+	// of the services of the node reachable from outside like http tunnels
+	PublicAddresses []string `json:"public_addresses,omitempty"`
+	// of the phases of the connection setup
+	Setup *SetupTimes `json:"setup,omitempty"`
+}
+
+// SetupTimes of the phases the connection of a node took to set up in
+// milliseconds, see conn.SetupTimes
+type SetupTimes struct {
+	Connect       float64 `json:"connect"`
+	Handshake     float64 `json:"handshake"`
+	Registration  float64 `json:"registration"`
+	FirstServices float64 `json:"first_services"`
+}
+
+// RTTPercentiles of the ack latencies of a connection in milliseconds
+type RTTPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
 }
 type App struct {
 	Index      int      `json:"index"`
@@ -77,51 +106,129 @@ type Monitor struct {
 	code    string
 	version string
 
-	configs      map[string]*Config
-	configsMutex sync.RWMutex
+	configs         map[string]*Config
+	configRevisions map[string][]*configRevision
+	configsMutex    sync.RWMutex
+
+	guestTokens      map[string]*guestToken
+	guestTokensMutex sync.Mutex
+
+	// *ipRules, no filtering if not set
+	ipRules atomic.Value
+
+	metrics bool
+	// see SetGeoIPLookup
+	geoIP GeoIPLookup
+
+	dataDir string
+	// see SetStorageCodec
+	codec StorageCodec
+	// of files newer than this version, see readConfig
+	fileVersions sync.Map
+
+	// json of getAllNode
+	nodeList nodeList
+	// see getEvents
+	events eventLog
+
+	// see StartCanary
+	canary      *canary
+	canaryMutex sync.Mutex
+
+	// see StartSnapshots
+	snapshotStop  chan struct{}
+	snapshotKeep  int
+	snapshotMutex sync.Mutex
 }
 
 func New(f *factory.MessengerFactory, serverAddress, webAddr, code, version string) *Monitor {
 	return &Monitor{
-		factory:       f,
-		serverAddress: serverAddress,
-		address:       webAddr,
-		srv:           &http.Server{Addr: webAddr},
-		code:          code,
-		version:       version,
-		configs:       make(map[string]*Config),
+		factory:         f,
+		serverAddress:   serverAddress,
+		address:         webAddr,
+		srv:             &http.Server{Addr: webAddr},
+		code:            code,
+		version:         version,
+		configs:         make(map[string]*Config),
+		configRevisions: make(map[string][]*configRevision),
+		guestTokens:     make(map[string]*guestToken),
+		dataDir:         DefaultDataDir(),
 	}
 }
 
+// EnableMetrics serves the connection statistics for Prometheus at /metrics
+// without login, call it before Start and limit access with SetIPRules
+func (m *Monitor) EnableMetrics() {
+	m.metrics = true
+}
+
 func (m *Monitor) Close() error {
+	m.canaryMutex.Lock()
+	if m.canary != nil {
+		m.canary.close()
+		m.canary = nil
+	}
+	m.canaryMutex.Unlock()
+	m.events.stop()
+	m.stopSnapshots()
 	return m.srv.Close()
 }
 func (m *Monitor) Start(webDir string) {
+	if err := m.loadNodeConfigs(); err != nil {
+		monitorLogger().Errorf("load node configs: %v", err)
+	}
+	m.events.start(m.factory)
 	http.Handle("/", http.FileServer(http.Dir(webDir)))
-	http.HandleFunc("/conn/getAll", bundle(m.getAllNode))
-	http.HandleFunc("/conn/getServerInfo", bundle(m.getServerInfo))
-	http.HandleFunc("/conn/getNode", bundle(m.getNode))
-	http.HandleFunc("/conn/setNodeConfig", bundle(m.setNodeConfig))
-	http.HandleFunc("/conn/getNodeConfig", bundle(m.getNodeConfig))
-	http.HandleFunc("/conn/saveClientConnection", bundle(m.SaveClientConnection))
-	http.HandleFunc("/conn/removeClientConnection", bundle(m.RemoveClientConnection))
-	http.HandleFunc("/conn/editClientConnection", bundle(m.EditClientConnection))
-	http.HandleFunc("/conn/getClientConnection", bundle(m.GetClientConnection))
-	http.HandleFunc("/login", bundle(m.Login))
-	http.HandleFunc("/checkLogin", bundle(m.checkLogin))
-	http.HandleFunc("/updatePass", bundle(m.UpdatePass))
-	http.HandleFunc("/node", bundle(requestNode))
+	m.handleAPI("/conn/getAll", m.getAllNode)
+	m.handleAPI("/conn/getServerInfo", m.getServerInfo)
+	m.handleAPI("/conn/getNode", m.getNode)
+	m.handleAPI("/conn/setNodeConfig", m.setNodeConfig)
+	m.handleAPI("/conn/getNodeConfig", m.getNodeConfig)
+	m.handleAPI("/conn/saveClientConnection", m.SaveClientConnection)
+	m.handleAPI("/conn/removeClientConnection", m.RemoveClientConnection)
+	m.handleAPI("/conn/editClientConnection", m.EditClientConnection)
+	m.handleAPI("/conn/getClientConnection", m.GetClientConnection)
+	m.handleAPI("/login", m.Login)
+	m.handleAPI("/checkLogin", m.checkLogin)
+	m.handleAPI("/updatePass", m.UpdatePass)
+	m.handleAPI("/node", requestNode)
+	m.handleAPI("/conn/createGuestToken", m.createGuestToken)
+	m.handleAPI("/conn/revokeGuestToken", m.revokeGuestToken)
+	m.handleAPI("/conn/createEnrollmentToken", m.createEnrollmentToken)
+	m.handleAPI("/conn/getRelayUsage", m.getRelayUsage)
+	m.handleAPI("/conn/getACLCounters", m.getACLCounters)
+	m.handleAPI("/conn/getRegLimits", m.getRegLimits)
+	m.handleAPI("/conn/logLevels", m.handleLogLevels)
+	m.handleAPI("/conn/getCanary", m.getCanary)
+	m.handleAPI("/conn/getEvents", m.getEvents)
+	m.handleAPI("/conn/getDrops", m.getDrops)
+	m.handleAPI("/conn/exportBackup", m.exportBackup)
+	m.handleAPI("/conn/importBackup", m.importBackup)
+	m.handleAPI("/conn/getSnapshots", m.getSnapshots)
+	m.handleAPI("/conn/rollbackSnapshot", m.rollbackSnapshot)
 	http.HandleFunc("/term", m.handleNodeTerm)
+	http.HandleFunc("/conn/appMessages", m.handleAppMessages)
+	if m.geoIP != nil {
+		m.handleAPI("/conn/getGeoStats", m.getGeoStats)
+	}
+	if m.metrics {
+		http.Handle("/metrics", m.factory.MetricsHandler())
+	}
+	m.srv.Handler = m.filterIP(http.DefaultServeMux)
 	go func() {
 		if err := m.srv.ListenAndServe(); err != nil {
-			log.Printf("http server: ListenAndServe() error: %s", err)
+			monitorLogger().Errorf("http server: ListenAndServe() error: %s", err)
 		}
 	}()
-	log.Debugf("http server listen on %s", m.address)
+	monitorLogger().Debugf("http server listen on %s", m.address)
 }
 
 func bundle(fn func(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if wantsEnvelope(r) {
+			bundleEnvelope(fn, w, r)
+			return
+		}
 		result, err, code := fn(w, r)
 		if err != nil {
 			if code == 0 {
@@ -152,7 +259,7 @@ func requestNode(w http.ResponseWriter, r *http.Request) (result []byte, err err
 	defer res.Body.Close()
 	result, err = ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Debugf("node error: %s", err.Error())
+		monitorLogger().Debugf("node error: %s", err.Error())
 		return result, err, SERVER_ERROR
 	}
 	return
@@ -162,23 +269,7 @@ func (m *Monitor) getAllNode(w http.ResponseWriter, r *http.Request) (result []b
 	if !verifyLogin(w, r) {
 		return
 	}
-	cs := make([]Conn, 0)
-	m.factory.ForEachAcceptedConnection(func(key cipher.PubKey, conn *factory.Connection) {
-		now := time.Now().Unix()
-		content := Conn{
-			Key:         key.Hex(),
-			SendBytes:   conn.GetSentBytes(),
-			RecvBytes:   conn.GetReceivedBytes(),
-			StartTime:   now - conn.GetConnectTime(),
-			LastAckTime: now - conn.GetLastTime()}
-		if conn.IsTCP() {
-			content.Type = "TCP"
-		} else {
-			content.Type = "UDP"
-		}
-		cs = append(cs, content)
-	})
-	result, err = json.Marshal(cs)
+	result, err = m.nodeList.get(m.factory)
 	if err != nil {
 		code = SERVER_ERROR
 		return
@@ -186,6 +277,9 @@ func (m *Monitor) getAllNode(w http.ResponseWriter, r *http.Request) (result []b
 	return
 }
 
+// getNode waits this long for the pong of the node
+const NODE_PING_TIMEOUT = time.Second
+
 func (m *Monitor) getNode(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
 	if !verifyLogin(w, r) {
 		return
@@ -211,29 +305,37 @@ func (m *Monitor) getNode(w http.ResponseWriter, r *http.Request) (result []byte
 		SendBytes:   c.GetSentBytes(),
 		RecvBytes:   c.GetReceivedBytes(),
 		StartTime:   now - c.GetConnectTime(),
-		LastAckTime: now - c.GetLastTime()}
+		LastAckTime: now - c.GetLastTime(),
+		RTT:         rttPercentiles(c.LatencyHistogram()),
+		Setup:       setupTimes(c.SetupTimes())}
+	if cp := c.GetCompression(); len(cp) > 0 {
+		nodeService.Compression = cp
+		nodeService.CompressionRatio = c.GetCompressionRatio()
+	}
+	if crypto := c.GetCrypto(); crypto != nil {
+		nodeService.Replays = crypto.GetReplayCount()
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), NODE_PING_TIMEOUT)
+	if rtt, err := c.Ping(ctx); err == nil {
+		nodeService.Ping = float64(rtt) / float64(time.Millisecond)
+	}
+	cancel()
+	if ns := c.GetServices(); ns != nil {
+		for _, s := range ns.Services {
+			if len(s.PublicAddress) > 0 {
+				nodeService.PublicAddresses = append(nodeService.PublicAddresses, s.PublicAddress)
+			}
+		}
+	}
 	if c.IsTCP() {
 		nodeService.Type = "TCP"
 	} else {
 		nodeService.Type = "UDP"
 	}
-	v, ok := c.LoadContext("node-api")
-	if ok {
-		webPort, ok := v.(string)
-		if ok && len(webPort) > 1 {
-			var host, port string
-			host, _, err = net.SplitHostPort(c.GetRemoteAddr().String())
-			if err != nil {
-				code = SERVER_ERROR
-				return
-			}
-			_, port, err = net.SplitHostPort(webPort)
-			if err != nil {
-				code = SERVER_ERROR
-				return
-			}
-			nodeService.Addr = net.JoinHostPort(host, port)
-		}
+	nodeService.Addr, err = nodeAPIAddress(c)
+	if err != nil {
+		code = SERVER_ERROR
+		return
 	}
 	result, err = json.Marshal(nodeService)
 	if err != nil {
@@ -243,6 +345,51 @@ func (m *Monitor) getNode(w http.ResponseWriter, r *http.Request) (result []byte
 	return
 }
 
+// rttPercentiles returns nil before the first ack
+func rttPercentiles(h *conn.Histogram) *RTTPercentiles {
+	if h.Count() < 1 {
+		return nil
+	}
+	ms := func(p float64) float64 {
+		return float64(h.Percentile(p)) / float64(time.Millisecond)
+	}
+	return &RTTPercentiles{P50: ms(50), P95: ms(95), P99: ms(99)}
+}
+
+func setupTimes(t conn.SetupTimes) *SetupTimes {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return &SetupTimes{
+		Connect:       ms(t.Connect),
+		Handshake:     ms(t.Handshake),
+		Registration:  ms(t.Registration),
+		FirstServices: ms(t.FirstServices),
+	}
+}
+
+// nodeAPIAddress returns the address of the web api the node reported at reg, empty if none
+func nodeAPIAddress(c *factory.Connection) (addr string, err error) {
+	v, ok := c.LoadContext("node-api")
+	if !ok {
+		return
+	}
+	webPort, ok := v.(string)
+	if !ok || len(webPort) <= 1 {
+		return
+	}
+	host, _, err := net.SplitHostPort(c.GetRemoteAddr().String())
+	if err != nil {
+		return
+	}
+	_, port, err := net.SplitHostPort(webPort)
+	if err != nil {
+		return
+	}
+	addr = net.JoinHostPort(host, port)
+	return
+}
+
 type Config struct {
 	DiscoveryAddresses []string
 }
@@ -263,9 +410,18 @@ func (m *Monitor) setNodeConfig(w http.ResponseWriter, r *http.Request) (result
 	if err != nil {
 		return
 	}
+	data, err = json.Marshal(config)
+	if err != nil {
+		return
+	}
 	m.configsMutex.Lock()
 	m.configs[key] = config
+	m.pushConfigRevision(key, data)
+	err = m.saveNodeConfigs()
 	m.configsMutex.Unlock()
+	if err != nil {
+		return
+	}
 	result = []byte("true")
 	return
 }
@@ -282,6 +438,22 @@ func (m *Monitor) getNodeConfig(w http.ResponseWriter, r *http.Request) (result
 	key := r.FormValue("key")
 	m.configsMutex.Lock()
 	defer m.configsMutex.Unlock()
+	// nodes that report the revision they have get a delta against it
+	if rev := r.FormValue("rev"); len(rev) > 0 {
+		var base uint64
+		base, err = strconv.ParseUint(rev, 10, 64)
+		if err != nil {
+			code = BAD_REQUEST
+			return
+		}
+		u, ok := m.configUpdate(key, base)
+		if !ok {
+			result = []byte(NULL)
+			return
+		}
+		result, err = json.Marshal(u)
+		return
+	}
 	result, err = json.Marshal(m.configs[key])
 	return
 }
@@ -291,6 +463,8 @@ type ClientConnection struct {
 	NodeKey string `json:"nodeKey"`
 	AppKey  string `json:"appKey"`
 	Count   int    `json:"count"`
+	// fields of newer versions, kept so a rollback does not lose them
+	extra map[string]interface{}
 }
 type clientConnectionSlice []ClientConnection
 
@@ -307,8 +481,6 @@ func (c clientConnectionSlice) Exist(rf ClientConnection) bool {
 	return false
 }
 
-var sshClient = filepath.Join(file.UserHome(), ".skywire", "manager", "sshClient.json")
-var socketClient = filepath.Join(file.UserHome(), ".skywire", "manager", "socketClient.json")
 var clientLimit = 5
 
 func (m *Monitor) SaveClientConnection(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
@@ -322,14 +494,8 @@ func (m *Monitor) SaveClientConnection(w http.ResponseWriter, r *http.Request) (
 	if err != nil {
 		return
 	}
-	switch path {
-	case "ssh":
-		path = sshClient
-		break
-	case "socket":
-		path = socketClient
-	}
-	cfs, err := readConfig(path)
+	path = m.clientPath(path)
+	cfs, err := m.readConfig(path)
 	if err != nil && !os.IsNotExist(err) {
 		return
 	}
@@ -349,7 +515,7 @@ func (m *Monitor) SaveClientConnection(w http.ResponseWriter, r *http.Request) (
 		cfs = append(cfs, config)
 	}
 	sort.Sort(cfs)
-	err = saveClientFile(cfs, path)
+	err = m.saveClientFile(cfs, path)
 	if err != nil {
 		return
 	}
@@ -361,15 +527,7 @@ func (m *Monitor) GetClientConnection(w http.ResponseWriter, r *http.Request) (r
 	if !verifyLogin(w, r) {
 		return
 	}
-	client := r.FormValue("client")
-	switch client {
-	case "ssh":
-		client = sshClient
-		break
-	case "socket":
-		client = socketClient
-	}
-	cf, err := readConfig(client)
+	cf, err := m.readConfig(m.clientPath(r.FormValue("client")))
 	result, err = json.Marshal(cf)
 	return
 }
@@ -383,13 +541,13 @@ func (m *Monitor) RemoveClientConnection(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		return
 	}
-	path = getFilePath(path)
-	cfs, err := readConfig(path)
+	path = m.clientPath(path)
+	cfs, err := m.readConfig(path)
 	if err != nil && !os.IsNotExist(err) {
 		return
 	}
 	cfs = append(cfs[:index], cfs[index+1:]...)
-	err = saveClientFile(cfs, path)
+	err = m.saveClientFile(cfs, path)
 	if err != nil {
 		return
 	}
@@ -407,13 +565,13 @@ func (m *Monitor) EditClientConnection(w http.ResponseWriter, r *http.Request) (
 	if err != nil {
 		return
 	}
-	path = getFilePath(path)
-	cfs, err := readConfig(path)
+	path = m.clientPath(path)
+	cfs, err := m.readConfig(path)
 	if err != nil && !os.IsNotExist(err) {
 		return
 	}
 	cfs[index].Label = label
-	err = saveClientFile(cfs, path)
+	err = m.saveClientFile(cfs, path)
 	if err != nil {
 		return
 	}
@@ -421,73 +579,43 @@ func (m *Monitor) EditClientConnection(w http.ResponseWriter, r *http.Request) (
 	return
 }
 
-func readConfig(path string) (cfs clientConnectionSlice, err error) {
-	fb, err := ioutil.ReadFile(path)
-	if err != nil {
-		return
-	}
-	err = json.Unmarshal(fb, &cfs)
-	if err != nil {
-		return
-	}
-	return
-}
-
-func saveClientFile(data interface{}, path string) (err error) {
-	d, err := json.Marshal(data)
-	if err != nil {
-		return
-	}
-	dir := filepath.Dir(path)
-	err = os.MkdirAll(dir, 0700)
-	if err != nil {
-		return
-	}
-	err = ioutil.WriteFile(path, d, 0600)
-	return
-}
-
-func getFilePath(client string) string {
-	switch client {
-	case "ssh":
-		client = sshClient
-		break
-	case "socket":
-		client = socketClient
-	}
-	return client
-}
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
 
 func (m *Monitor) handleNodeTerm(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query()["token"][0]
-	if len(token) == 0 {
-		return
-	}
-	if !verifyWs(w, r, token) {
-		return
-	}
-	url := r.URL.Query()["url"][0]
+	query := r.URL.Query()
+	url := query.Get("url")
 	if len(url) <= 0 {
-		log.Errorf("url is: %s", url)
+		monitorLogger().Errorf("url is: %s", url)
 		return
 	}
+	if guest := query.Get("guest"); len(guest) > 0 {
+		if !m.verifyGuestToken(w, guest, url) {
+			return
+		}
+	} else {
+		token := query.Get("token")
+		if len(token) == 0 {
+			return
+		}
+		if !verifyWs(w, r, token) {
+			return
+		}
+	}
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return true
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Errorf("ws error: %s", err.Error())
+		monitorLogger().Errorf("ws error: %s", err.Error())
 		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
 		return
 	}
 	c, _, err := websocket.DefaultDialer.Dial(string(url), nil)
 	if err != nil {
-		log.Errorf("node connection error: %s", err.Error())
+		monitorLogger().Errorf("node connection error: %s", err.Error())
 		conn.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("node connection error: %s", err.Error())))
 		return
 	}
@@ -519,8 +647,6 @@ func (m *Monitor) handleNodeTerm(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
-var userPath = filepath.Join(file.UserHome(), ".skywire", "manager", "user.json")
-
 func (m *Monitor) checkLogin(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
 	if !verifyLogin(w, r) {
 		result = []byte("false")
@@ -540,7 +666,7 @@ func (m *Monitor) Login(w http.ResponseWriter, r *http.Request) (result []byte,
 		result = []byte("false")
 		return
 	}
-	err = checkPass(pass)
+	err = checkPass(m.userPath(), pass)
 	if err != nil {
 		result = []byte("false")
 		return
@@ -570,7 +696,7 @@ func (m *Monitor) UpdatePass(w http.ResponseWriter, r *http.Request) (result []b
 		result = []byte("false")
 		return
 	}
-	err = checkPass(oldPass)
+	err = checkPass(m.userPath(), oldPass)
 	if err != nil {
 		return
 	}
@@ -578,7 +704,7 @@ func (m *Monitor) UpdatePass(w http.ResponseWriter, r *http.Request) (result []b
 	if err != nil {
 		return
 	}
-	err = WriteConfig(data, userPath)
+	err = WriteConfig(data, m.userPath())
 	if err != nil {
 		return
 	}
@@ -592,22 +718,22 @@ func verifyWs(w http.ResponseWriter, r *http.Request, token string) bool {
 	defer sess.SessionRelease(w)
 	pass := sess.Get("user")
 	if pass == nil {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	hash := sess.Get("pass")
 	if pass == nil {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	hashStr, ok := hash.(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	passStr, ok := pass.(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	return matchPassword(hashStr, passStr)
@@ -618,22 +744,22 @@ func verifyLogin(w http.ResponseWriter, r *http.Request) bool {
 	defer sess.SessionRelease(w)
 	pass := sess.Get("user")
 	if pass == nil {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	hash := sess.Get("pass")
 	if pass == nil {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	hashStr, ok := hash.(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	passStr, ok := pass.(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusFound)
+		unauthorized(w, r)
 		return false
 	}
 	return matchPassword(hashStr, passStr)
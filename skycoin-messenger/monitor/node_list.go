@@ -0,0 +1,102 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// getAllNode serves the same list this long, the counters in it are this old
+// at most. A node connecting or leaving changes it at once
+const NODE_LIST_MAX_AGE = time.Second
+
+// nodeList is the json of getAllNode, built again only when polled after a
+// change of the registry or NODE_LIST_MAX_AGE
+type nodeList struct {
+	version uint64
+	built   time.Time
+	json    []byte
+	// the json of each conn, kept while it is registered
+	entries map[cipher.PubKey]*nodeListEntry
+	sync.Mutex
+}
+
+type nodeListEntry struct {
+	conn  *factory.Connection
+	built time.Time
+	json  []byte
+}
+
+func newConn(key cipher.PubKey, conn *factory.Connection) Conn {
+	now := time.Now().Unix()
+	content := Conn{
+		Key:         key.Hex(),
+		SendBytes:   conn.GetSentBytes(),
+		RecvBytes:   conn.GetReceivedBytes(),
+		StartTime:   now - conn.GetConnectTime(),
+		LastAckTime: now - conn.GetLastTime(),
+		RTT:         rttPercentiles(conn.LatencyHistogram()),
+		Ping:        float64(conn.GetPingRTT()) / float64(time.Millisecond)}
+	if conn.IsTCP() {
+		content.Type = "TCP"
+	} else {
+		content.Type = "UDP"
+	}
+	return content
+}
+
+// get returns the json of the conns of f sorted by key
+func (l *nodeList) get(f *factory.MessengerFactory) (result []byte, err error) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	version := f.RegistryVersion()
+	if l.json != nil && version == l.version && now.Sub(l.built) < NODE_LIST_MAX_AGE {
+		return l.json, nil
+	}
+	if l.entries == nil {
+		l.entries = make(map[cipher.PubKey]*nodeListEntry)
+	}
+	registered := make(map[cipher.PubKey]*factory.Connection)
+	f.ForEachAcceptedConnection(func(key cipher.PubKey, conn *factory.Connection) {
+		registered[key] = conn
+	})
+	for key, e := range l.entries {
+		if registered[key] != e.conn {
+			delete(l.entries, key)
+		}
+	}
+	keys := make([]cipher.PubKey, 0, len(registered))
+	for key, conn := range registered {
+		keys = append(keys, key)
+		e, ok := l.entries[key]
+		if ok && now.Sub(e.built) < NODE_LIST_MAX_AGE {
+			continue
+		}
+		var b []byte
+		b, err = json.Marshal(newConn(key, conn))
+		if err != nil {
+			return
+		}
+		l.entries[key] = &nodeListEntry{conn: conn, built: now, json: b}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(l.entries[key].json)
+	}
+	buf.WriteByte(']')
+	l.json, l.version, l.built = buf.Bytes(), version, now
+	return l.json, nil
+}
@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func TestNodeList(t *testing.T) {
+	s := factory.NewMessengerFactory()
+	s.SetDefaultSeedConfig(factory.NewSeedConfig())
+	if err := s.Listen("127.0.0.1:25960"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var l nodeList
+	nodes := func() (cs []Conn, b []byte) {
+		b, err := l.get(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(b, &cs); err != nil {
+			t.Fatalf("%s %v", b, err)
+		}
+		return
+	}
+	if cs, b := nodes(); len(cs) != 0 || string(b) != "[]" {
+		t.Fatalf("nodes %s", b)
+	}
+
+	sc := factory.NewSeedConfig()
+	c := factory.NewMessengerFactory()
+	if err := c.ConnectWithConfig("127.0.0.1:25960", &factory.ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := cipher.PubKeyFromHex(sc.PublicKey)
+	for i := 0; ; i++ {
+		if _, ok := s.GetConnection(key); ok {
+			break
+		}
+		if i > 50 {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cs, b := nodes()
+	if len(cs) != 1 || cs[0].Key != sc.PublicKey || cs[0].Type != "TCP" {
+		t.Fatalf("nodes %s", b)
+	}
+	if _, again := nodes(); &again[0] != &b[0] {
+		t.Fatal("list built again without a change")
+	}
+
+	c.Close()
+	for i := 0; ; i++ {
+		if cs, _ = nodes(); len(cs) == 0 {
+			break
+		}
+		if i > 50 {
+			t.Fatal("node kept after it left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,66 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/skycoin/net/skycoin-messenger/factory"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// getRelayUsage returns what the nodes of each operator relayed through the
+// server, or of the operator in key only
+func (m *Monitor) getRelayUsage(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	q := m.factory.RelayQuotas
+	if q == nil {
+		code = NOT_FOUND
+		err = errors.New("relay quotas disabled")
+		return
+	}
+	if v := r.FormValue("key"); len(v) > 0 {
+		var key cipher.PubKey
+		key, err = cipher.PubKeyFromHex(v)
+		if err != nil {
+			code = BAD_REQUEST
+			return
+		}
+		result, err = json.Marshal(q.Usage(key))
+		return
+	}
+	result, err = json.Marshal(q.AllUsage())
+	return
+}
+
+// getACLCounters returns how often each service with an acl was shown or
+// hidden by the server, by service key
+func (m *Monitor) getACLCounters(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	counters := make(map[string]factory.ACLCounters)
+	for k, v := range m.factory.ACLCounters() {
+		counters[k.Hex()] = v
+	}
+	result, err = json.Marshal(counters)
+	return
+}
+
+// getRegLimits returns the reg and query ops the server checked against its
+// reg limits and the ones over a limit
+func (m *Monitor) getRegLimits(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	l := m.factory.RegLimits
+	if l == nil {
+		code = NOT_FOUND
+		err = errors.New("reg limits disabled")
+		return
+	}
+	result, err = json.Marshal(l.Stats())
+	return
+}
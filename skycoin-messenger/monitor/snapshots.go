@@ -0,0 +1,270 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_SNAPSHOT_INTERVAL = time.Hour
+	DEFAULT_SNAPSHOT_KEEP     = 48
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// SnapshotPolicy of the snapshots of the configs the manager pushes to the
+// nodes, see StartSnapshots
+type SnapshotPolicy struct {
+	// between the snapshots, DEFAULT_SNAPSHOT_INTERVAL if 0
+	Interval time.Duration
+	// the older ones are deleted, DEFAULT_SNAPSHOT_KEEP if 0
+	Keep int
+}
+
+// Snapshot is the node configs and client connections of the manager at
+// Created, the user is left out so a rollback keeps the password
+type Snapshot struct {
+	Id      string       `json:"id"`
+	Created int64        `json:"created"`
+	State   *BackupState `json:"state,omitempty"`
+}
+
+func (m *Monitor) snapshotDir() string {
+	return filepath.Join(m.dataDir, "snapshots")
+}
+
+func (m *Monitor) snapshotPath(id string) string {
+	return filepath.Join(m.snapshotDir(), id+".json")
+}
+
+// StartSnapshots takes a snapshot of the configs every interval of p, one
+// equal to the last is skipped. The snapshots are served at
+// /conn/getSnapshots and restored by /conn/rollbackSnapshot
+func (m *Monitor) StartSnapshots(p SnapshotPolicy) {
+	if p.Interval <= 0 {
+		p.Interval = DEFAULT_SNAPSHOT_INTERVAL
+	}
+	if p.Keep < 1 {
+		p.Keep = DEFAULT_SNAPSHOT_KEEP
+	}
+	stop := make(chan struct{})
+	m.snapshotMutex.Lock()
+	if m.snapshotStop != nil {
+		close(m.snapshotStop)
+	}
+	m.snapshotStop = stop
+	m.snapshotKeep = p.Keep
+	m.snapshotMutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			if _, err := m.TakeSnapshot(); err != nil {
+				monitorLogger().Errorf("snapshot: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *Monitor) stopSnapshots() {
+	m.snapshotMutex.Lock()
+	if m.snapshotStop != nil {
+		close(m.snapshotStop)
+		m.snapshotStop = nil
+	}
+	m.snapshotMutex.Unlock()
+}
+
+// TakeSnapshot writes a snapshot of the current configs, it returns the last
+// one if nothing changed since
+func (m *Monitor) TakeSnapshot() (s *Snapshot, err error) {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+	return m.takeSnapshot()
+}
+
+// snapshotMutex must be held
+func (m *Monitor) takeSnapshot() (s *Snapshot, err error) {
+	state, err := m.backupState()
+	if err != nil {
+		return
+	}
+	state.User = nil
+	s = &Snapshot{Created: time.Now().UnixNano(), State: state}
+	s.Id = strconv.FormatInt(s.Created, 10)
+	data, err := json.Marshal(s.State)
+	if err != nil {
+		return
+	}
+	ids, err := m.snapshotIds()
+	if err != nil {
+		return
+	}
+	if len(ids) > 0 {
+		last, e := ioutil.ReadFile(m.snapshotPath(ids[len(ids)-1]))
+		if e == nil && bytes.Equal(last, data) {
+			return m.snapshot(ids[len(ids)-1], false)
+		}
+	}
+	err = writeFileAtomic(m.snapshotPath(s.Id), data)
+	if err != nil {
+		return
+	}
+	ids = append(ids, s.Id)
+	keep := m.snapshotKeep
+	if keep < 1 {
+		keep = DEFAULT_SNAPSHOT_KEEP
+	}
+	for len(ids) > keep {
+		if err = os.Remove(m.snapshotPath(ids[0])); err != nil {
+			return
+		}
+		ids = ids[1:]
+	}
+	return
+}
+
+// snapshotIds are oldest first
+func (m *Monitor) snapshotIds() (ids []string, err error) {
+	infos, err := ioutil.ReadDir(m.snapshotDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var created []int64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		n, e := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if e != nil {
+			continue
+		}
+		created = append(created, n)
+	}
+	sort.Slice(created, func(i, j int) bool { return created[i] < created[j] })
+	for _, n := range created {
+		ids = append(ids, strconv.FormatInt(n, 10))
+	}
+	return
+}
+
+func (m *Monitor) snapshot(id string, withState bool) (s *Snapshot, err error) {
+	created, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, ErrSnapshotNotFound
+	}
+	s = &Snapshot{Id: id, Created: created}
+	if !withState {
+		if _, err = os.Stat(m.snapshotPath(id)); os.IsNotExist(err) {
+			err = ErrSnapshotNotFound
+		}
+		return
+	}
+	data, err := ioutil.ReadFile(m.snapshotPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrSnapshotNotFound
+		}
+		return
+	}
+	err = json.Unmarshal(data, &s.State)
+	if err == nil && s.State == nil {
+		err = errors.New("empty snapshot")
+	}
+	return
+}
+
+// Snapshots returns the snapshots kept, oldest first and without their state
+func (m *Monitor) Snapshots() (snapshots []*Snapshot, err error) {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+	ids, err := m.snapshotIds()
+	if err != nil {
+		return
+	}
+	snapshots = make([]*Snapshot, 0, len(ids))
+	for _, id := range ids {
+		created, _ := strconv.ParseInt(id, 10, 64)
+		snapshots = append(snapshots, &Snapshot{Id: id, Created: created})
+	}
+	return
+}
+
+// RollbackSnapshot restores the configs of snapshot id. The configs it
+// replaces are snapshotted first, so the rollback can be rolled back
+func (m *Monitor) RollbackSnapshot(id string) (err error) {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+	s, err := m.snapshot(id, true)
+	if err != nil {
+		return
+	}
+	_, err = m.takeSnapshot()
+	if err != nil {
+		return
+	}
+	return m.restoreState(s.State)
+}
+
+func (m *Monitor) getSnapshots(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	if id := r.FormValue("id"); len(id) > 0 {
+		var s *Snapshot
+		s, err = m.snapshot(id, true)
+		if err == ErrSnapshotNotFound {
+			code = NOT_FOUND
+		}
+		if err != nil {
+			return
+		}
+		result, err = json.Marshal(s)
+		return
+	}
+	snapshots, err := m.Snapshots()
+	if err != nil {
+		return
+	}
+	result, err = json.Marshal(snapshots)
+	return
+}
+
+func (m *Monitor) rollbackSnapshot(w http.ResponseWriter, r *http.Request) (result []byte, err error, code int) {
+	if !verifyLogin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		code = BAD_REQUEST
+		err = errors.New("please use post method")
+		return
+	}
+	err = m.RollbackSnapshot(r.FormValue("id"))
+	if err == ErrSnapshotNotFound {
+		code = NOT_FOUND
+	}
+	if err != nil {
+		return
+	}
+	result = []byte("true")
+	return
+}
@@ -0,0 +1,51 @@
+package monitor
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	m, dir := newBackupMonitor(t)
+	defer os.RemoveAll(dir)
+	m.snapshotKeep = 2
+	m.configs["node"] = &Config{DiscoveryAddresses: []string{"127.0.0.1:5999"}}
+	first, err := m.TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := m.TakeSnapshot(); err != nil || s.Id != first.Id {
+		t.Fatalf("unchanged configs snapshotted again: %v", err)
+	}
+
+	// a bulk change pushed by mistake
+	m.configs["node"] = &Config{}
+	m.configs["other"] = &Config{}
+	if _, err = m.TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.RollbackSnapshot(first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.configs["other"]; ok || len(m.configs["node"].DiscoveryAddresses) != 1 {
+		t.Fatalf("configs %v", m.configs)
+	}
+	if rev := m.configRevisions["node"]; len(rev) < 1 {
+		t.Fatal("restored config not pushed to the node")
+	}
+
+	// the rolled back configs are the newest, the first is deleted
+	if _, err = m.TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := m.Snapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[0].Id == first.Id {
+		t.Fatalf("snapshots %v %v", snapshots, err)
+	}
+	if err = m.RollbackSnapshot(first.Id); err != ErrSnapshotNotFound {
+		t.Fatalf("rollback to a deleted snapshot %v", err)
+	}
+	if err = m.RollbackSnapshot("../user"); err != ErrSnapshotNotFound {
+		t.Fatalf("rollback to an invalid id %v", err)
+	}
+}
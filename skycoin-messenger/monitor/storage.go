@@ -0,0 +1,221 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// version of the client connection files written, older files are migrated
+// when read and newer ones are kept as they are
+const CLIENT_CONNECTIONS_VERSION = 1
+
+// StorageCodec encodes the files of the data dir
+type StorageCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// SetStorageCodec encodes the client connection files by c instead of json,
+// call it before Start
+func (m *Monitor) SetStorageCodec(c StorageCodec) {
+	m.codec = c
+}
+
+// Migration upgrades the records of a file by one version, unknown fields of a
+// record must be kept
+type Migration func(records []map[string]interface{}) ([]map[string]interface{}, error)
+
+var (
+	migrationsMutex            sync.RWMutex
+	clientConnectionMigrations = make(map[int]Migration)
+)
+
+// RegisterClientConnectionMigration upgrades client connection files of version
+// from to from+1. It panics if one is registered twice for from
+func RegisterClientConnectionMigration(from int, m Migration) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	if m == nil {
+		panic("monitor: RegisterClientConnectionMigration migration is nil")
+	}
+	if _, dup := clientConnectionMigrations[from]; dup {
+		panic(fmt.Sprintf("monitor: RegisterClientConnectionMigration called twice for version %d", from))
+	}
+	clientConnectionMigrations[from] = m
+}
+
+func init() {
+	// version 0 files are json arrays of the same records
+	RegisterClientConnectionMigration(0, func(records []map[string]interface{}) ([]map[string]interface{}, error) {
+		return records, nil
+	})
+}
+
+func migrateClientConnections(version int, records []map[string]interface{}) (_ []map[string]interface{}, err error) {
+	migrationsMutex.RLock()
+	defer migrationsMutex.RUnlock()
+	for ; version < CLIENT_CONNECTIONS_VERSION; version++ {
+		m, ok := clientConnectionMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration of client connections from version %d", version)
+		}
+		records, err = m(records)
+		if err != nil {
+			return nil, fmt.Errorf("migrate client connections from version %d: %v", version, err)
+		}
+	}
+	return records, nil
+}
+
+type storedFile struct {
+	Version int                      `json:"version"`
+	Records []map[string]interface{} `json:"records"`
+}
+
+func (m *Monitor) storageCodec() StorageCodec {
+	if m.codec == nil {
+		return jsonCodec{}
+	}
+	return m.codec
+}
+
+func (m *Monitor) readConfig(path string) (cfs clientConnectionSlice, err error) {
+	fb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var f storedFile
+	if trimmed := bytes.TrimSpace(fb); len(trimmed) > 0 && (trimmed[0] == '[' || string(trimmed) == "null") {
+		// json of version 0
+		err = json.Unmarshal(trimmed, &f.Records)
+	} else {
+		err = m.storageCodec().Unmarshal(fb, &f)
+	}
+	if err != nil {
+		return
+	}
+	records := f.Records
+	if f.Version < CLIENT_CONNECTIONS_VERSION {
+		records, err = migrateClientConnections(f.Version, records)
+		if err != nil {
+			return
+		}
+	}
+	cfs = make(clientConnectionSlice, len(records))
+	for i, r := range records {
+		cfs[i].fromRecord(r)
+	}
+	// a file of a newer version stays at it, so its fields survive a rollback
+	if f.Version > CLIENT_CONNECTIONS_VERSION {
+		m.fileVersions.Store(path, f.Version)
+	}
+	return
+}
+
+func (m *Monitor) saveClientFile(cfs clientConnectionSlice, path string) (err error) {
+	f := storedFile{Version: CLIENT_CONNECTIONS_VERSION, Records: make([]map[string]interface{}, len(cfs))}
+	if v, ok := m.fileVersions.Load(path); ok {
+		f.Version = v.(int)
+	}
+	for i := range cfs {
+		f.Records[i] = cfs[i].record()
+	}
+	d, err := m.storageCodec().Marshal(&f)
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(path, d)
+}
+
+// writeFileAtomic never leaves a partly written file at path
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *ClientConnection) fromRecord(r map[string]interface{}) {
+	c.Label, _ = r["label"].(string)
+	c.NodeKey, _ = r["nodeKey"].(string)
+	c.AppKey, _ = r["appKey"].(string)
+	switch n := r["count"].(type) {
+	case float64:
+		c.Count = int(n)
+	case int:
+		c.Count = n
+	case int64:
+		c.Count = int(n)
+	case uint64:
+		c.Count = int(n)
+	}
+	c.extra = make(map[string]interface{})
+	for k, v := range r {
+		switch k {
+		case "label", "nodeKey", "appKey", "count":
+		default:
+			c.extra[k] = v
+		}
+	}
+}
+
+func (c *ClientConnection) record() map[string]interface{} {
+	r := make(map[string]interface{}, len(c.extra)+4)
+	for k, v := range c.extra {
+		r[k] = v
+	}
+	r["label"] = c.Label
+	r["nodeKey"] = c.NodeKey
+	r["appKey"] = c.AppKey
+	r["count"] = c.Count
+	return r
+}
+
+// MarshalJSON keeps the fields of newer versions
+func (c ClientConnection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.record())
+}
+
+func (c *ClientConnection) UnmarshalJSON(data []byte) error {
+	var r map[string]interface{}
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		return err
+	}
+	c.fromRecord(r)
+	return nil
+}
@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLegacyClientFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sshClient.json")
+	err = ioutil.WriteFile(path, []byte(`[{"label":"a","nodeKey":"n","appKey":"k","count":3}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(nil, "", "", "", "")
+	cfs, err := m.readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfs) != 1 || cfs[0].Label != "a" || cfs[0].NodeKey != "n" || cfs[0].AppKey != "k" || cfs[0].Count != 3 {
+		t.Fatalf("client connections %v", cfs)
+	}
+	if err = m.saveClientFile(cfs, path); err != nil {
+		t.Fatal(err)
+	}
+	var f storedFile
+	fb, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(fb, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != CLIENT_CONNECTIONS_VERSION || len(f.Records) != 1 {
+		t.Fatalf("file %s", fb)
+	}
+}
+
+func TestNewerClientFileKeepsFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sshClient.json")
+	newer := CLIENT_CONNECTIONS_VERSION + 1
+	data, _ := json.Marshal(&storedFile{
+		Version: newer,
+		Records: []map[string]interface{}{{"label": "a", "nodeKey": "n", "appKey": "k", "count": 1, "future": "x"}},
+	})
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := New(nil, "", "", "", "")
+	cfs, err := m.readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfs[0].Count++
+	if err = m.saveClientFile(cfs, path); err != nil {
+		t.Fatal(err)
+	}
+	var f storedFile
+	fb, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(fb, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != newer || f.Records[0]["future"] != "x" || f.Records[0]["count"] != float64(2) {
+		t.Fatalf("file %s", fb)
+	}
+}
+
+func TestMissingClientConnectionMigration(t *testing.T) {
+	if _, err := migrateClientConnections(-1, nil); err == nil {
+		t.Fatal("migrated without a migration")
+	}
+}
@@ -33,7 +33,7 @@ func WriteConfig(data []byte, path string) (err error) {
 	return
 }
 
-func checkPass(pass string) (err error) {
+func checkPass(userPath, pass string) (err error) {
 	user, err := readUserConfig(userPath)
 	if err != nil {
 		if os.IsNotExist(err) {